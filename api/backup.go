@@ -2,21 +2,81 @@ package api
 
 import (
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/api"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/rancher/longhorn-manager/engineapi"
 )
 
+// refreshRequested returns if the request asks to bypass the cache of the
+// backupstore listing by `?refresh=true`, e.g. right after a backup is taken
+// outside of Longhorn
+func refreshRequested(req *http.Request) (bool, error) {
+	refresh := req.URL.Query().Get("refresh")
+	if refresh == "" {
+		return false, nil
+	}
+	r, err := strconv.ParseBool(refresh)
+	if err != nil {
+		return false, errors.Errorf("invalid refresh parameter %v", refresh)
+	}
+	return r, nil
+}
+
+func isRefreshRequested(req *http.Request) bool {
+	refresh, err := refreshRequested(req)
+	// the invalid parameter is rejected by the handler
+	return err == nil && refresh
+}
+
+// backupFilterFromRequest returns the filter of the backup listing by
+// `?labelSelector=app=db,run=42&createdAfter=<RFC3339>&createdBefore=<RFC3339>`
+func backupFilterFromRequest(req *http.Request) (engineapi.BackupFilter, error) {
+	filter := engineapi.BackupFilter{}
+	query := req.URL.Query()
+	if selector := query.Get("labelSelector"); selector != "" {
+		s, err := labels.Parse(selector)
+		if err != nil {
+			return filter, errors.Wrapf(err, "invalid labelSelector parameter %v", selector)
+		}
+		filter.Selector = s
+	}
+	for param, t := range map[string]*time.Time{
+		"createdAfter":  &filter.CreatedAfter,
+		"createdBefore": &filter.CreatedBefore,
+	} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.Wrapf(err, "invalid %v parameter %v", param, value)
+		}
+		*t = parsed
+	}
+	return filter, nil
+}
+
 func (s *Server) BackupVolumeList(w http.ResponseWriter, req *http.Request) error {
 	apiContext := api.GetApiContext(req)
 
-	volumes, err := s.m.ListBackupVolumes()
+	refresh, err := refreshRequested(req)
+	if err != nil {
+		return err
+	}
+	volumes, status, err := s.m.ListBackupVolumes(refresh)
 	if err != nil {
 		return errors.Wrapf(err, "error listing backups")
 	}
-	apiContext.Write(toBackupVolumeCollection(volumes, apiContext))
+	apiContext.Write(toBackupVolumeCollection(volumes, status, apiContext))
 	return nil
 }
 
@@ -25,22 +85,39 @@ func (s *Server) BackupVolumeGet(w http.ResponseWriter, req *http.Request) error
 
 	volName := mux.Vars(req)["volName"]
 
-	bv, err := s.m.GetBackupVolume(volName)
+	refresh, err := refreshRequested(req)
+	if err != nil {
+		return err
+	}
+	bv, status, err := s.m.GetBackupVolume(volName, refresh)
 	if err != nil {
 		return errors.Wrapf(err, "error get backup volume '%s'", volName)
 	}
-	apiContext.Write(toBackupVolumeResource(bv, apiContext))
+	if bv == nil {
+		logrus.Warnf("cannot find backup volume %v", volName)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	apiContext.Write(toBackupVolumeResource(bv, status, apiContext))
 	return nil
 }
 
 func (s *Server) BackupList(w http.ResponseWriter, req *http.Request) error {
 	volName := mux.Vars(req)["volName"]
 
-	bs, err := s.m.ListBackupsForVolume(volName)
+	refresh, err := refreshRequested(req)
+	if err != nil {
+		return err
+	}
+	filter, err := backupFilterFromRequest(req)
+	if err != nil {
+		return err
+	}
+	bs, status, err := s.m.ListBackupsForVolume(volName, refresh)
 	if err != nil {
 		return errors.Wrapf(err, "error listing backups for volume '%s'", volName)
 	}
-	api.GetApiContext(req).Write(toBackupCollection(bs))
+	api.GetApiContext(req).Write(toBackupCollection(engineapi.FilterBackups(bs, filter), status))
 	return nil
 }
 
@@ -57,7 +134,11 @@ func (s *Server) BackupGet(w http.ResponseWriter, req *http.Request) error {
 	}
 	volName := mux.Vars(req)["volName"]
 
-	backup, err := s.m.GetBackup(input.Name, volName)
+	refresh, err := refreshRequested(req)
+	if err != nil {
+		return err
+	}
+	backup, status, err := s.m.GetBackup(input.Name, volName, refresh)
 	if err != nil {
 		return errors.Wrapf(err, "error getting backup %v of volume %v", input.Name, volName)
 	}
@@ -66,7 +147,7 @@ func (s *Server) BackupGet(w http.ResponseWriter, req *http.Request) error {
 		w.WriteHeader(http.StatusNotFound)
 		return nil
 	}
-	apiContext.Write(toBackupResource(backup))
+	apiContext.Write(toBackupResource(backup, status))
 	return nil
 }
 
@@ -90,3 +171,40 @@ func (s *Server) BackupDelete(w http.ResponseWriter, req *http.Request) error {
 	logrus.Debugf("Removed backup %v of volume %v", input.Name, volName)
 	return nil
 }
+
+func (s *Server) BackupVolumeDelete(w http.ResponseWriter, req *http.Request) error {
+	var input BackupVolumeDeleteInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return err
+	}
+
+	volName := mux.Vars(req)["volName"]
+
+	deletion, err := s.m.DeleteBackupVolume(volName, input.DryRun)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting backup volume %v", volName)
+	}
+	apiContext.Write(toBackupVolumeDeletionResource(deletion))
+	return nil
+}
+
+func (s *Server) BackupTargetTest(w http.ResponseWriter, req *http.Request) error {
+	var input BackupTargetTestInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read backupTargetTestInput")
+	}
+	if err := validateBackupTargetTestInput(&input); err != nil {
+		return err
+	}
+
+	result, err := s.m.TestBackupTarget(input.BackupTarget, input.CredentialSecret)
+	if err != nil {
+		return errors.Wrapf(err, "unable to test backup target %v", input.BackupTarget)
+	}
+	apiContext.Write(toBackupTargetTestResultResource(result))
+	return nil
+}
@@ -58,6 +58,9 @@ func (s *Server) EngineImageCreate(rw http.ResponseWriter, req *http.Request) er
 	if err := apiContext.Read(&img); err != nil {
 		return err
 	}
+	if err := validateEngineImageCreate(&img); err != nil {
+		return err
+	}
 
 	ei, err := s.m.CreateEngineImage(img.Image)
 	if err != nil {
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher/api"
+)
+
+func OwnerIDFromEngineUpgrade(req *http.Request) (string, error) {
+	return mux.Vars(req)["nodeID"], nil
+}
+
+func (s *Server) EngineUpgradeCreate(w http.ResponseWriter, req *http.Request) error {
+	var input EngineUpgradeJobInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error read engineUpgradeJobInput")
+	}
+	if err := validateEngineUpgradeJobInput(&input); err != nil {
+		return err
+	}
+
+	job, err := s.m.UpgradeVolumeEngines(input.FromImage, input.ToImage, input.Concurrency)
+	if err != nil {
+		return errors.Wrapf(err, "unable to upgrade engines from %v to %v", input.FromImage, input.ToImage)
+	}
+	apiContext.Write(toEngineUpgradeResource(job, apiContext))
+	return nil
+}
+
+func (s *Server) EngineUpgradeGet(w http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+
+	name := mux.Vars(req)["name"]
+
+	job := s.m.GetEngineUpgradeJob(name)
+	if job == nil {
+		logrus.Warnf("cannot find engine upgrade %v", name)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	apiContext.Write(toEngineUpgradeResource(job, apiContext))
+	return nil
+}
+
+func (s *Server) EngineUpgradePause(w http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+
+	name := mux.Vars(req)["name"]
+	job, err := s.m.PauseEngineUpgradeJob(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to pause engine upgrade %v", name)
+	}
+	apiContext.Write(toEngineUpgradeResource(job, apiContext))
+	return nil
+}
+
+func (s *Server) EngineUpgradeResume(w http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+
+	name := mux.Vars(req)["name"]
+	job, err := s.m.ResumeEngineUpgradeJob(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to resume engine upgrade %v", name)
+	}
+	apiContext.Write(toEngineUpgradeResource(job, apiContext))
+	return nil
+}
@@ -2,7 +2,10 @@ package api
 
 import (
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/api"
 	"github.com/rancher/go-rancher/client"
@@ -26,3 +29,32 @@ func (s *Server) eventList(apiContext *api.ApiContext) (*client.GenericCollectio
 	}
 	return toEventCollection(eventList), nil
 }
+
+func (s *Server) VolumeEventList(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	volumeName := mux.Vars(req)["name"]
+
+	var since time.Time
+	if value := req.URL.Query().Get("since"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid parameter since %v", value)
+		}
+		since = t
+	}
+	limit := 0
+	if value := req.URL.Query().Get("limit"); value != "" {
+		l, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid parameter limit %v", value)
+		}
+		limit = l
+	}
+
+	eventList, err := s.m.ListVolumeEvents(volumeName, since, limit)
+	if err != nil {
+		return errors.Wrapf(err, "fail to list events of volume %v", volumeName)
+	}
+	apiContext.Write(toEventCollection(eventList))
+	return nil
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Healthz is for the liveness probe, it only shows the API server is up. The
+// handler doesn't go through the API context, so it works for any client.
+func (s *Server) Healthz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok\n"))
+}
+
+// Readyz is for the readiness probe. The details of the check are returned
+// in the body for debugging.
+func (s *Server) Readyz(rw http.ResponseWriter, req *http.Request) {
+	status := s.health.Check()
+	data, err := json.Marshal(status)
+	if err != nil {
+		logrus.Errorf("Failed to encode the readiness status: %v", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !status.Ready {
+		logrus.Warnf("Manager is not ready: %s", data)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if status.Ready {
+		rw.WriteHeader(http.StatusOK)
+	} else {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	rw.Write(data)
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	OperationBackupstoreAccess = "backupstore-access"
+	OperationSupportBundle     = "support-bundle"
+	OperationEngineUpgradeJob  = "engine-upgrade-job"
+
+	// how long the client is asked to wait before retrying the operation
+	// rejected due to the limit
+	limitedOperationRetryAfter = 10 * time.Second
+)
+
+var rejectedOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "longhorn_manager",
+	Subsystem: "api",
+	Name:      "rejected_operations_total",
+	Help:      "The number of the expensive API operations rejected due to the concurrency limit",
+}, []string{"operation"})
+
+func init() {
+	prometheus.MustRegister(rejectedOperations)
+}
+
+// TooManyRequestsError is returned if the operation is over the concurrency
+// limit, and is written as 429 with Retry-After
+type TooManyRequestsError struct {
+	Operation  string
+	Limit      int64
+	RetryAfter time.Duration
+}
+
+func (e *TooManyRequestsError) Error() string {
+	return fmt.Sprintf("too many %v operations in progress, the limit is %v", e.Operation, e.Limit)
+}
+
+// operationLimiter bounds the number of an expensive operation in progress
+// on the manager. The operation in progress is either the request being
+// handled, or the background job started by the request and counted by
+// running. The limit is read on each request so it can be changed on the fly.
+type operationLimiter struct {
+	operation string
+	limit     func() int64
+	running   func() int
+
+	lock     sync.Mutex
+	inflight int
+}
+
+func newOperationLimiter(operation string, limit func() int64, running func() int) *operationLimiter {
+	l := &operationLimiter{
+		operation: operation,
+		limit:     limit,
+		running:   running,
+	}
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "longhorn_manager",
+		Subsystem:   "api",
+		Name:        "inflight_operations",
+		Help:        "The number of the expensive API operations in progress",
+		ConstLabels: prometheus.Labels{"operation": operation},
+	}, func() float64 {
+		return float64(l.inProgress())
+	})
+	if err := prometheus.Register(gauge); err != nil {
+		logrus.Warnf("Fail to register the metrics of operation %v: %v", operation, err)
+	}
+	return l
+}
+
+// newSettingOperationLimiter returns the limiter of the operation with the
+// limit of the setting
+func newSettingOperationLimiter(operation string, s *Server, setting types.SettingName, running func() int) *operationLimiter {
+	return newOperationLimiter(operation, func() int64 {
+		limit, err := s.m.GetSettingAsInt(setting)
+		if err != nil {
+			logrus.Warnf("Fail to get the limit of operation %v from setting %v, use the default: %v", operation, setting, err)
+			limit, _ = strconv.ParseInt(types.SettingDefinitions[setting].Default, 10, 64)
+		}
+		return limit
+	}, running)
+}
+
+func (l *operationLimiter) inProgress() int {
+	l.lock.Lock()
+	inflight := l.inflight
+	l.lock.Unlock()
+	if l.running != nil {
+		inflight += l.running()
+	}
+	return inflight
+}
+
+func (l *operationLimiter) acquire() error {
+	limit := l.limit()
+	running := 0
+	if l.running != nil {
+		running = l.running()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if int64(l.inflight+running) >= limit {
+		rejectedOperations.WithLabelValues(l.operation).Inc()
+		return &TooManyRequestsError{
+			Operation:  l.operation,
+			Limit:      limit,
+			RetryAfter: limitedOperationRetryAfter,
+		}
+	}
+	l.inflight++
+	return nil
+}
+
+func (l *operationLimiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inflight--
+}
+
+// Handler guards the handler by the limit
+func (l *operationLimiter) Handler(h HandleFuncWithError) HandleFuncWithError {
+	return l.HandlerIf(nil, h)
+}
+
+// HandlerIf guards the handler by the limit only if the request is expensive
+// by guarded, e.g. bypassing the cache
+func (l *operationLimiter) HandlerIf(guarded func(req *http.Request) bool, h HandleFuncWithError) HandleFuncWithError {
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		if guarded != nil && !guarded(req) {
+			return h(rw, req)
+		}
+		if err := l.acquire(); err != nil {
+			return err
+		}
+		defer l.release()
+		return h(rw, req)
+	}
+}
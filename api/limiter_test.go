@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperationLimiter(t *testing.T) {
+	assert := require.New(t)
+
+	limit := int64(2)
+	running := 0
+	l := newOperationLimiter("test-operation", func() int64 { return limit }, func() int { return running })
+
+	assert.Nil(l.acquire())
+	assert.Nil(l.acquire())
+	err := l.acquire()
+	assert.NotNil(err)
+	limitErr, ok := err.(*TooManyRequestsError)
+	assert.True(ok)
+	assert.Equal(int64(2), limitErr.Limit)
+	assert.Equal(2, l.inProgress())
+
+	l.release()
+	assert.Nil(l.acquire())
+	l.release()
+	l.release()
+	assert.Equal(0, l.inProgress())
+
+	// the background jobs count against the limit
+	running = 2
+	assert.NotNil(l.acquire())
+	assert.Equal(2, l.inProgress())
+
+	// the limit can be raised on the fly
+	limit = 3
+	assert.Nil(l.acquire())
+	l.release()
+}
+
+func TestOperationLimiterHandlerIf(t *testing.T) {
+	assert := require.New(t)
+
+	l := newOperationLimiter("test-operation-if", func() int64 { return 1 }, nil)
+	// hold the only slot
+	assert.Nil(l.acquire())
+
+	h := l.HandlerIf(isRefreshRequested, func(rw http.ResponseWriter, req *http.Request) error {
+		return nil
+	})
+	req := httptest.NewRequest("GET", "/v1/backupvolumes", nil)
+	assert.Nil(h(httptest.NewRecorder(), req))
+	req = httptest.NewRequest("GET", "/v1/backupvolumes?refresh=true", nil)
+	assert.NotNil(h(httptest.NewRecorder(), req))
+
+	l.release()
+	assert.Nil(h(httptest.NewRecorder(), req))
+	assert.Equal(0, l.inProgress())
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"net/url"
 	"strconv"
 
 	"github.com/Sirupsen/logrus"
@@ -13,6 +14,7 @@ import (
 	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/manager"
 	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
 
 	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
 )
@@ -33,6 +35,28 @@ type Volume struct {
 	BaseImage           string                 `json:"baseImage"`
 	Created             string                 `json:"created"`
 	MigrationNodeID     string                 `json:"migrationNodeID"`
+	DiskSelector        []string               `json:"diskSelector"`
+	NodeSelector        []string               `json:"nodeSelector"`
+	ZoneSelector        []string               `json:"zoneSelector"`
+	DisableFrontend     bool                   `json:"disableFrontend"`
+	KubernetesStatus    types.KubernetesStatus `json:"kubernetesStatus"`
+	AccessMode          types.VolumeAccessMode `json:"accessMode"`
+	// ReadOnlyNodeIDs are the nodes the volume is attached read-only to
+	ReadOnlyNodeIDs []string `json:"readOnlyNodeIDs"`
+	// QoS is the I/O limits of the volume, and CurrentQoS is the limits
+	// applied by the engine
+	QoS        types.VolumeQoS `json:"qos"`
+	CurrentQoS types.VolumeQoS `json:"currentQoS"`
+
+	BackupTargetCredentialSecret string `json:"backupTargetCredentialSecret"`
+	// the backups waiting for or holding the slots of the concurrent
+	// backups
+	BackupStatus []types.BackupTicket `json:"backupStatus"`
+	// TrashedAt is when the volume was deleted and moved to the trash
+	TrashedAt string `json:"trashedAt"`
+	// SkippedRecurringJobRuns are the latest scheduled runs of the
+	// recurring jobs which couldn't execute
+	SkippedRecurringJobRuns []types.SkippedRecurringJobRun `json:"skippedRecurringJobRuns"`
 
 	RecurringJobs []types.RecurringJob                          `json:"recurringJobs"`
 	Conditions    map[types.VolumeConditionType]types.Condition `json:"conditions"`
@@ -44,16 +68,61 @@ type Volume struct {
 type Snapshot struct {
 	client.Resource
 	engineapi.Snapshot
+	ReadyToUse bool `json:"readyToUse"`
+}
+
+type BackupStatus struct {
+	client.Resource
+	Volume    string                  `json:"volume"`
+	Node      string                  `json:"node"`
+	Snapshot  string                  `json:"snapshot"`
+	Priority  bool                    `json:"priority"`
+	State     types.BackupTicketState `json:"state"`
+	Requested string                  `json:"requested"`
+	Progress  int                     `json:"progress"`
+	Error     string                  `json:"error"`
+	URL       string                  `json:"url"`
+	Finished  string                  `json:"finished"`
 }
 
 type BackupVolume struct {
 	client.Resource
 	engineapi.BackupVolume
+	// when the backup volume was listed from the backupstore
+	LastRefreshed string `json:"lastRefreshed"`
+	// the backupstore couldn't be listed since then
+	Stale            bool   `json:"stale"`
+	LastRefreshError string `json:"lastRefreshError"`
 }
 
 type Backup struct {
 	client.Resource
 	engineapi.Backup
+	// when the backup was listed from the backupstore
+	LastRefreshed string `json:"lastRefreshed"`
+	// the backupstore couldn't be listed since then
+	Stale            bool   `json:"stale"`
+	LastRefreshError string `json:"lastRefreshError"`
+}
+
+type SupportBundle struct {
+	client.Resource
+	manager.SupportBundle
+}
+
+type Version struct {
+	client.Resource
+	manager.Version
+}
+
+type EngineUpgrade struct {
+	client.Resource
+	manager.EngineUpgradeJob
+}
+
+type BackupTargetTestResult struct {
+	client.Resource
+	manager.BackupTargetTestResult
 }
 
 type Setting struct {
@@ -61,6 +130,26 @@ type Setting struct {
 	Name       string                  `json:"name"`
 	Value      string                  `json:"value"`
 	Definition types.SettingDefinition `json:"definition"`
+	// Warning is set if the value was applied but the test of it failed,
+	// e.g. the backup target is unreachable
+	Warning string `json:"warning,omitempty"`
+	// Note tells when the value takes effect, if not right away
+	Note string `json:"note,omitempty"`
+	// the availability of the backup target by the backupstore poll
+	Conditions    map[types.SettingConditionType]types.Condition `json:"conditions"`
+	LastAvailable string                                         `json:"lastAvailable"`
+	// History is the recent changes, the oldest first
+	History []types.SettingChange `json:"history"`
+}
+
+type SettingsExport struct {
+	client.Resource
+	manager.SettingsExport
+}
+
+type SettingsImport struct {
+	client.Resource
+	Results []manager.SettingImportResult `json:"results"`
 }
 
 type Instance struct {
@@ -84,6 +173,15 @@ type Replica struct {
 	DataPath string `json:"dataPath"`
 	Mode     string `json:"mode"`
 	FailedAt string `json:"failedAt"`
+
+	FailureReason string `json:"failureReason"`
+	FailedNodeID  string `json:"failedNodeID"`
+	FailedDiskID  string `json:"failedDiskID"`
+
+	FileStats types.ReplicaFileStats `json:"fileStats"`
+
+	Zone               string `json:"zone"`
+	SchedulingDecision string `json:"schedulingDecision"`
 }
 
 type EngineImage struct {
@@ -96,18 +194,47 @@ type EngineImage struct {
 }
 
 type AttachInput struct {
+	HostID          string `json:"hostId"`
+	DisableFrontend bool   `json:"disableFrontend"`
+	// ReadOnly attaches the rox volume read-only, which can be attached to
+	// the other nodes read-only at the same time
+	ReadOnly bool `json:"readOnly"`
+}
+
+type DetachInput struct {
+	Force bool `json:"force"`
+	// HostID detaches the volume from the node only, if it's attached
+	// read-only to the other nodes as well
 	HostID string `json:"hostId"`
 }
 
+type BackupStatusInput struct {
+	ID string `json:"id"`
+}
+
 type SnapshotInput struct {
 	Name   string            `json:"name"`
 	Labels map[string]string `json:"labels"`
+	// Priority lets the backup jump the queue of the concurrent backups
+	Priority bool `json:"priority"`
 }
 
 type BackupInput struct {
 	Name string `json:"name"`
 }
 
+type BackupVolumeDeleteInput struct {
+	// DryRun only reports what would be removed
+	DryRun bool `json:"dryRun"`
+}
+
+type BackupVolumeDeletion struct {
+	client.Resource
+	Volume  string   `json:"volume"`
+	Backups []string `json:"backups"`
+	DryRun  bool     `json:"dryRun"`
+}
+
 type RecurringInput struct {
 	Jobs []types.RecurringJob `json:"jobs"`
 }
@@ -124,17 +251,62 @@ type EngineUpgradeInput struct {
 	Image string `json:"image"`
 }
 
+type PVCreateInput struct {
+	PVName        string `json:"pvName"`
+	FSType        string `json:"fsType"`
+	ReclaimPolicy string `json:"reclaimPolicy"`
+}
+
+type PVCCreateInput struct {
+	Namespace string `json:"namespace"`
+	PVCName   string `json:"pvcName"`
+}
+
+type UpdateReplicaCountInput struct {
+	ReplicaCount int `json:"replicaCount"`
+}
+
+// UpdateQoSInput is the I/O limits of the volume. The bandwidth is in MB/s,
+// and zero means unlimited.
+type UpdateQoSInput struct {
+	ReadIOPS       int `json:"readIOPS"`
+	WriteIOPS      int `json:"writeIOPS"`
+	ReadBandwidth  int `json:"readBandwidth"`
+	WriteBandwidth int `json:"writeBandwidth"`
+}
+
+type UpdateBackupTargetCredentialSecretInput struct {
+	CredentialSecret string `json:"credentialSecret"`
+}
+
+type EngineUpgradeJobInput struct {
+	FromImage   string `json:"fromImage"`
+	ToImage     string `json:"toImage"`
+	Concurrency int    `json:"concurrency"`
+}
+
+type BackupTargetTestInput struct {
+	BackupTarget     string `json:"backupTarget"`
+	CredentialSecret string `json:"credentialSecret"`
+}
+
 type NodeInput struct {
 	NodeID string `json:"nodeId"`
 }
 
 type Node struct {
 	client.Resource
-	Name            string                                      `json:"name"`
-	Address         string                                      `json:"address"`
-	AllowScheduling bool                                        `json:"allowScheduling"`
-	Disks           map[string]DiskInfo                         `json:"disks"`
-	Conditions      map[types.NodeConditionType]types.Condition `json:"conditions"`
+	Name              string                                      `json:"name"`
+	Address           string                                      `json:"address"`
+	AllowScheduling   bool                                        `json:"allowScheduling"`
+	EvictionRequested bool                                        `json:"evictionRequested"`
+	MaintenanceMode   bool                                        `json:"maintenanceMode"`
+	Disks             map[string]DiskInfo                         `json:"disks"`
+	Conditions        map[types.NodeConditionType]types.Condition `json:"conditions"`
+	Tags              []string                                    `json:"tags"`
+	Zone              string                                      `json:"zone"`
+
+	EvictionRemainingReplicas int `json:"evictionRemainingReplicas"`
 }
 
 type DiskInfo struct {
@@ -146,6 +318,11 @@ type DiskUpdateInput struct {
 	Disks []types.DiskSpec `json:"disks"`
 }
 
+type OrphanDeleteInput struct {
+	DiskID string `json:"diskId"`
+	Name   string `json:"name"`
+}
+
 type Event struct {
 	client.Resource
 	v1.Event
@@ -160,22 +337,53 @@ func NewSchema() *client.Schemas {
 	schemas.AddType("error", client.ServerApiError{})
 	schemas.AddType("snapshot", Snapshot{})
 	schemas.AddType("attachInput", AttachInput{})
+	schemas.AddType("detachInput", DetachInput{})
 	schemas.AddType("snapshotInput", SnapshotInput{})
 	schemas.AddType("backup", Backup{})
 	schemas.AddType("backupInput", BackupInput{})
+	schemas.AddType("backupVolumeDeleteInput", BackupVolumeDeleteInput{})
+	schemas.AddType("backupVolumeDeletion", BackupVolumeDeletion{})
 	schemas.AddType("recurringJob", types.RecurringJob{})
+	schemas.AddType("skippedRecurringJobRun", types.SkippedRecurringJobRun{})
+	schemas.AddType("backupTicket", types.BackupTicket{})
+	schemas.AddType("backupStatus", BackupStatus{})
+	schemas.AddType("backupStatusInput", BackupStatusInput{})
 	schemas.AddType("replicaRemoveInput", ReplicaRemoveInput{})
 	schemas.AddType("salvageInput", SalvageInput{})
 	schemas.AddType("engineUpgradeInput", EngineUpgradeInput{})
+	schemas.AddType("engineUpgradeJobInput", EngineUpgradeJobInput{})
+	schemas.AddType("engineUpgradeVolume", manager.EngineUpgradeVolume{})
+	schemas.AddType("engineUpgradeProgress", manager.EngineUpgradeProgress{})
+	schemas.AddType("updateReplicaCountInput", UpdateReplicaCountInput{})
+	schemas.AddType("updateQoSInput", UpdateQoSInput{})
+	schemas.AddType("updateBackupTargetCredentialSecretInput", UpdateBackupTargetCredentialSecretInput{})
+	schemas.AddType("backupTargetTestInput", BackupTargetTestInput{})
+	schemas.AddType("backupTargetTestResult", BackupTargetTestResult{})
+	schemas.AddType("pvCreateInput", PVCreateInput{})
+	schemas.AddType("pvcCreateInput", PVCCreateInput{})
+	schemas.AddType("kubernetesStatus", types.KubernetesStatus{})
+	schemas.AddType("volumeQoS", types.VolumeQoS{})
+	schemas.AddType("version", Version{})
+	schemas.AddType("engineVersionDetails", types.EngineVersionDetails{})
 	schemas.AddType("replica", Replica{})
 	schemas.AddType("controller", Controller{})
 	schemas.AddType("diskUpdate", types.DiskSpec{})
 	schemas.AddType("nodeInput", NodeInput{})
-	schemas.AddType("settingDefinition", types.SettingDefinition{})
+	settingDefinition := schemas.AddType("settingDefinition", types.SettingDefinition{})
+	// the bounds are pointers, which the schema doesn't pick up
+	settingDefinition.ResourceFields["min"] = client.Field{Type: "int", Nullable: true}
+	settingDefinition.ResourceFields["max"] = client.Field{Type: "int", Nullable: true}
 	// to avoid duplicate name with built-in type condition
 	schemas.AddType("volumeCondition", types.Condition{})
 	schemas.AddType("nodeCondition", types.Condition{})
 	schemas.AddType("diskCondition", types.Condition{})
+	schemas.AddType("settingCondition", types.Condition{})
+	schemas.AddType("engineImageCondition", types.Condition{})
+	schemas.AddType("engineImageNodePullStatus", types.EngineImageNodePullStatus{})
+	schemas.AddType("settingChange", types.SettingChange{})
+	settingsExportSchema(schemas.AddType("settingsExport", SettingsExport{}))
+	schemas.AddType("settingImportResult", manager.SettingImportResult{})
+	settingsImportSchema(schemas.AddType("settingsImport", SettingsImport{}))
 
 	schemas.AddType("event", Event{})
 
@@ -184,9 +392,12 @@ func NewSchema() *client.Schemas {
 	settingSchema(schemas.AddType("setting", Setting{}))
 	recurringSchema(schemas.AddType("recurringInput", RecurringInput{}))
 	engineImageSchema(schemas.AddType("engineImage", EngineImage{}))
+	engineUpgradeSchema(schemas.AddType("engineUpgrade", EngineUpgrade{}))
 	nodeSchema(schemas.AddType("node", Node{}))
 	diskSchema(schemas.AddType("diskUpdateInput", DiskUpdateInput{}))
+	schemas.AddType("orphanedReplicaDirectory", types.OrphanedReplicaDirectory{})
 	diskInfoSchema(schemas.AddType("diskInfo", DiskInfo{}))
+	schemas.AddType("orphanDeleteInput", OrphanDeleteInput{})
 
 	return schemas
 }
@@ -200,6 +411,16 @@ func nodeSchema(node *client.Schema) {
 			Input:  "diskUpdateInput",
 			Output: "node",
 		},
+		"orphanDelete": {
+			Input:  "orphanDeleteInput",
+			Output: "node",
+		},
+		"maintenanceModeEnter": {
+			Output: "node",
+		},
+		"maintenanceModeExit": {
+			Output: "node",
+		},
 	}
 
 	allowScheduling := node.ResourceFields["allowScheduling"]
@@ -213,6 +434,12 @@ func nodeSchema(node *client.Schema) {
 	conditions := node.ResourceFields["conditions"]
 	conditions.Type = "map[nodeCondition]"
 	node.ResourceFields["conditions"] = conditions
+	tags := node.ResourceFields["tags"]
+	tags.Update = true
+	node.ResourceFields["tags"] = tags
+	evictionRequested := node.ResourceFields["evictionRequested"]
+	evictionRequested.Update = true
+	node.ResourceFields["evictionRequested"] = evictionRequested
 }
 
 func diskSchema(diskUpdateInput *client.Schema) {
@@ -225,6 +452,9 @@ func diskInfoSchema(diskInfo *client.Schema) {
 	conditions := diskInfo.ResourceFields["conditions"]
 	conditions.Type = "map[diskCondition]"
 	diskInfo.ResourceFields["conditions"] = conditions
+	orphans := diskInfo.ResourceFields["orphanedReplicaDirectories"]
+	orphans.Type = "map[orphanedReplicaDirectory]"
+	diskInfo.ResourceFields["orphanedReplicaDirectories"] = orphans
 }
 
 func engineImageSchema(engineImage *client.Schema) {
@@ -236,6 +466,16 @@ func engineImageSchema(engineImage *client.Schema) {
 	image.Required = true
 	image.Unique = true
 	engineImage.ResourceFields["image"] = image
+
+	conditions := engineImage.ResourceFields["conditions"]
+	conditions.Type = "map[engineImageCondition]"
+	engineImage.ResourceFields["conditions"] = conditions
+	nodeDeploymentMap := engineImage.ResourceFields["nodeDeploymentMap"]
+	nodeDeploymentMap.Type = "map[boolean]"
+	engineImage.ResourceFields["nodeDeploymentMap"] = nodeDeploymentMap
+	nodePullStatus := engineImage.ResourceFields["nodePullStatus"]
+	nodePullStatus.Type = "map[engineImageNodePullStatus]"
+	engineImage.ResourceFields["nodePullStatus"] = nodePullStatus
 }
 
 func recurringSchema(recurring *client.Schema) {
@@ -257,6 +497,10 @@ func backupVolumeSchema(backupVolume *client.Schema) {
 			Input:  "backupInput",
 			Output: "backupVolume",
 		},
+		"backupVolumeDelete": {
+			Input:  "backupVolumeDeleteInput",
+			Output: "backupVolumeDeletion",
+		},
 	}
 }
 
@@ -278,6 +522,50 @@ func settingSchema(setting *client.Schema) {
 		Type:     "settingDefinition",
 		Nullable: false,
 	}
+
+	conditions := setting.ResourceFields["conditions"]
+	conditions.Type = "map[settingCondition]"
+	setting.ResourceFields["conditions"] = conditions
+
+	history := setting.ResourceFields["history"]
+	history.Type = "array[settingChange]"
+	setting.ResourceFields["history"] = history
+}
+
+func settingsExportSchema(export *client.Schema) {
+	settings := export.ResourceFields["settings"]
+	settings.Type = "map[string]"
+	export.ResourceFields["settings"] = settings
+
+	redacted := export.ResourceFields["redacted"]
+	redacted.Type = "array[string]"
+	export.ResourceFields["redacted"] = redacted
+}
+
+func engineUpgradeSchema(engineUpgrade *client.Schema) {
+	engineUpgrade.CollectionMethods = []string{"POST"}
+	engineUpgrade.ResourceMethods = []string{"GET"}
+	engineUpgrade.ResourceActions = map[string]client.Action{
+		"pause": {
+			Output: "engineUpgrade",
+		},
+		"resume": {
+			Output: "engineUpgrade",
+		},
+	}
+
+	progress := engineUpgrade.ResourceFields["progress"]
+	progress.Type = "engineUpgradeProgress"
+	engineUpgrade.ResourceFields["progress"] = progress
+	volumes := engineUpgrade.ResourceFields["volumes"]
+	volumes.Type = "array[engineUpgradeVolume]"
+	engineUpgrade.ResourceFields["volumes"] = volumes
+}
+
+func settingsImportSchema(settingsImport *client.Schema) {
+	results := settingsImport.ResourceFields["results"]
+	results.Type = "array[settingImportResult]"
+	settingsImport.ResourceFields["results"] = results
 }
 
 func volumeSchema(volume *client.Schema) {
@@ -289,6 +577,7 @@ func volumeSchema(volume *client.Schema) {
 			Output: "volume",
 		},
 		"detach": {
+			Input:  "detachInput",
 			Output: "volume",
 		},
 		"salvage": {
@@ -298,8 +587,7 @@ func volumeSchema(volume *client.Schema) {
 
 		"snapshotPurge": {},
 		"snapshotCreate": {
-			Input:  "snapshotInput",
-			Output: "snapshot",
+			Input: "snapshotInput",
 		},
 		"snapshotGet": {
 			Input:  "snapshotInput",
@@ -307,15 +595,20 @@ func volumeSchema(volume *client.Schema) {
 		},
 		"snapshotList": {},
 		"snapshotDelete": {
-			Input:  "snapshotInput",
-			Output: "snapshot",
+			Input: "snapshotInput",
 		},
 		"snapshotRevert": {
-			Input:  "snapshotInput",
-			Output: "snapshot",
+			Input: "snapshotInput",
 		},
 		"snapshotBackup": {
-			Input: "snapshotInput",
+			Input:  "snapshotInput",
+			Output: "backupStatus",
+		},
+
+		"backupStatusList": {},
+		"backupStatusGet": {
+			Input:  "backupStatusInput",
+			Output: "backupStatus",
 		},
 
 		"recurringUpdate": {
@@ -333,11 +626,37 @@ func volumeSchema(volume *client.Schema) {
 			Input: "engineUpgradeInput",
 		},
 
+		"updateReplicaCount": {
+			Input:  "updateReplicaCountInput",
+			Output: "volume",
+		},
+		"updateQoS": {
+			Input:  "updateQoSInput",
+			Output: "volume",
+		},
+		"updateBackupTargetCredentialSecret": {
+			Input:  "updateBackupTargetCredentialSecretInput",
+			Output: "volume",
+		},
+
+		"pvCreate": {
+			Input:  "pvCreateInput",
+			Output: "volume",
+		},
+		"pvcCreate": {
+			Input:  "pvcCreateInput",
+			Output: "volume",
+		},
+
 		"migrationStart": {
 			Input: "nodeInput",
 		},
 		"migrationConfirm":  {},
 		"migrationRollback": {},
+
+		"restoreTrashed": {
+			Output: "volume",
+		},
 	}
 	volume.ResourceFields["controllers"] = client.Field{
 		Type:     "array[controller]",
@@ -380,6 +699,22 @@ func volumeSchema(volume *client.Schema) {
 	volumeBaseImage.Create = true
 	volume.ResourceFields["baseImage"] = volumeBaseImage
 
+	volumeDiskSelector := volume.ResourceFields["diskSelector"]
+	volumeDiskSelector.Create = true
+	volume.ResourceFields["diskSelector"] = volumeDiskSelector
+
+	volumeNodeSelector := volume.ResourceFields["nodeSelector"]
+	volumeNodeSelector.Create = true
+	volume.ResourceFields["nodeSelector"] = volumeNodeSelector
+
+	volumeZoneSelector := volume.ResourceFields["zoneSelector"]
+	volumeZoneSelector.Create = true
+	volume.ResourceFields["zoneSelector"] = volumeZoneSelector
+
+	volumeBackupTargetCredentialSecret := volume.ResourceFields["backupTargetCredentialSecret"]
+	volumeBackupTargetCredentialSecret.Create = true
+	volume.ResourceFields["backupTargetCredentialSecret"] = volumeBackupTargetCredentialSecret
+
 	replicas := volume.ResourceFields["replicas"]
 	replicas.Type = "array[replica]"
 	volume.ResourceFields["replicas"] = replicas
@@ -388,13 +723,23 @@ func volumeSchema(volume *client.Schema) {
 	recurringJobs.Type = "array[recurringJob]"
 	volume.ResourceFields["recurringJobs"] = recurringJobs
 
+	skippedRecurringJobRuns := volume.ResourceFields["skippedRecurringJobRuns"]
+	skippedRecurringJobRuns.Type = "array[skippedRecurringJobRun]"
+	volume.ResourceFields["skippedRecurringJobRuns"] = skippedRecurringJobRuns
+
+	backupStatus := volume.ResourceFields["backupStatus"]
+	backupStatus.Type = "array[backupTicket]"
+	volume.ResourceFields["backupStatus"] = backupStatus
+
 	conditions := volume.ResourceFields["conditions"]
 	conditions.Type = "map[volumeCondition]"
 	volume.ResourceFields["conditions"] = conditions
 }
 
+const SettingNoteRequiresRestart = "takes effect after component restart"
+
 func toSettingResource(setting *longhorn.Setting) *Setting {
-	return &Setting{
+	s := &Setting{
 		Resource: client.Resource{
 			Id:    setting.Name,
 			Type:  "setting",
@@ -404,6 +749,34 @@ func toSettingResource(setting *longhorn.Setting) *Setting {
 		Value: setting.Value,
 
 		Definition: types.SettingDefinitions[types.SettingName(setting.Name)],
+		History:    setting.Status.History,
+	}
+	if s.Definition.RequiresRestart {
+		s.Note = SettingNoteRequiresRestart
+	}
+	// the status of the previous backup target doesn't count
+	if setting.Value != "" && setting.Status.BackupTarget == setting.Value {
+		s.Conditions = setting.Status.Conditions
+		s.LastAvailable = setting.Status.LastAvailable
+	}
+	return s
+}
+
+func toSettingsExportResource(export *manager.SettingsExport) *SettingsExport {
+	return &SettingsExport{
+		Resource: client.Resource{
+			Type: "settingsExport",
+		},
+		SettingsExport: *export,
+	}
+}
+
+func toSettingsImportResource(results []manager.SettingImportResult) *SettingsImport {
+	return &SettingsImport{
+		Resource: client.Resource{
+			Type: "settingsImport",
+		},
+		Results: results,
 	}
 }
 
@@ -415,6 +788,44 @@ func toSettingCollection(settings []*longhorn.Setting) *client.GenericCollection
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "setting"}}
 }
 
+// toVolumePagination returns the pagination of the volume collection, with
+// the link to the next page if there is one
+func toVolumePagination(apiContext *api.ApiContext, query url.Values, opts *manager.VolumeListOptions, page *manager.VolumePage) *client.Pagination {
+	limit := int64(opts.Limit)
+	total := int64(page.Total)
+	pagination := &client.Pagination{
+		Marker:  opts.Marker,
+		Total:   &total,
+		Partial: page.Marker != "",
+	}
+	if opts.Limit != 0 {
+		pagination.Limit = &limit
+	}
+	if page.Marker != "" {
+		next := url.Values{}
+		for k, v := range query {
+			next[k] = v
+		}
+		next.Set("marker", page.Marker)
+		pagination.Next = apiContext.UrlBuilder.Current() + "?" + next.Encode()
+	}
+	return pagination
+}
+
+func toVolumeSort(opts *manager.VolumeListOptions) *client.Sort {
+	sort := &client.Sort{
+		Name:  opts.SortBy,
+		Order: "asc",
+	}
+	if sort.Name == "" {
+		sort.Name = manager.VolumeSortByName
+	}
+	if opts.Descending {
+		sort.Order = "desc"
+	}
+	return sort
+}
+
 func toVolumeResource(v *longhorn.Volume, ves []*longhorn.Engine, vrs []*longhorn.Replica, apiContext *api.ApiContext) *Volume {
 	var ve *longhorn.Engine
 	controllers := []Controller{}
@@ -454,6 +865,15 @@ func toVolumeResource(v *longhorn.Volume, ves []*longhorn.Engine, vrs []*longhor
 			DataPath: r.Spec.DataPath,
 			Mode:     mode,
 			FailedAt: r.Spec.FailedAt,
+
+			FailureReason: string(r.Status.FailureReason),
+			FailedNodeID:  r.Status.FailedNodeID,
+			FailedDiskID:  r.Status.FailedDiskID,
+
+			FileStats: r.Status.FileStats,
+
+			Zone:               r.Status.Zone,
+			SchedulingDecision: string(r.Status.SchedulingDecision),
 		})
 	}
 
@@ -478,6 +898,19 @@ func toVolumeResource(v *longhorn.Volume, ves []*longhorn.Engine, vrs []*longhor
 		CurrentImage:        v.Status.CurrentImage,
 		BaseImage:           v.Spec.BaseImage,
 		MigrationNodeID:     v.Spec.MigrationNodeID,
+		DiskSelector:        v.Spec.DiskSelector,
+		NodeSelector:        v.Spec.NodeSelector,
+		ZoneSelector:        v.Spec.ZoneSelector,
+		DisableFrontend:     v.Spec.DisableFrontend,
+		KubernetesStatus:    v.Status.KubernetesStatus,
+		AccessMode:          v.Spec.AccessMode,
+		ReadOnlyNodeIDs:     v.Spec.ReadOnlyNodeIDs,
+		QoS:                 v.Spec.QoS,
+		CurrentQoS:          v.Status.CurrentQoS,
+
+		BackupTargetCredentialSecret: v.Spec.BackupTargetCredentialSecret,
+		TrashedAt:                    v.Spec.TrashedAt,
+		SkippedRecurringJobRuns:      v.Status.SkippedRecurringJobRuns,
 
 		Conditions: v.Status.Conditions,
 
@@ -486,8 +919,15 @@ func toVolumeResource(v *longhorn.Volume, ves []*longhorn.Engine, vrs []*longhor
 	}
 
 	actions := map[string]struct{}{}
-
-	if v.Status.Robustness == types.VolumeRobustnessFaulted {
+	// the backups can be followed after the volume is detached
+	actions["backupStatusList"] = struct{}{}
+	actions["backupStatusGet"] = struct{}{}
+
+	if v.Spec.TrashedAt != "" {
+		// the volume in the trash can only be restored, or deleted with
+		// force
+		actions["restoreTrashed"] = struct{}{}
+	} else if v.Status.Robustness == types.VolumeRobustnessFaulted {
 		actions["salvage"] = struct{}{}
 	} else {
 		switch v.Status.State {
@@ -496,10 +936,18 @@ func toVolumeResource(v *longhorn.Volume, ves []*longhorn.Engine, vrs []*longhor
 			actions["recurringUpdate"] = struct{}{}
 			actions["replicaRemove"] = struct{}{}
 			actions["engineUpgrade"] = struct{}{}
+			actions["updateReplicaCount"] = struct{}{}
+			actions["updateQoS"] = struct{}{}
+			actions["updateBackupTargetCredentialSecret"] = struct{}{}
+			actions["pvCreate"] = struct{}{}
+			actions["pvcCreate"] = struct{}{}
 		case types.VolumeStateAttaching:
 			actions["detach"] = struct{}{}
 		case types.VolumeStateAttached:
 			actions["detach"] = struct{}{}
+			if len(v.Spec.ReadOnlyNodeIDs) != 0 {
+				actions["attach"] = struct{}{}
+			}
 			actions["snapshotPurge"] = struct{}{}
 			actions["snapshotCreate"] = struct{}{}
 			actions["snapshotList"] = struct{}{}
@@ -510,6 +958,11 @@ func toVolumeResource(v *longhorn.Volume, ves []*longhorn.Engine, vrs []*longhor
 			actions["recurringUpdate"] = struct{}{}
 			actions["replicaRemove"] = struct{}{}
 			actions["engineUpgrade"] = struct{}{}
+			actions["updateReplicaCount"] = struct{}{}
+			actions["updateQoS"] = struct{}{}
+			actions["updateBackupTargetCredentialSecret"] = struct{}{}
+			actions["pvCreate"] = struct{}{}
+			actions["pvcCreate"] = struct{}{}
 			actions["migrationStart"] = struct{}{}
 			actions["migrationConfirm"] = struct{}{}
 			actions["migrationRollback"] = struct{}{}
@@ -519,25 +972,45 @@ func toVolumeResource(v *longhorn.Volume, ves []*longhorn.Engine, vrs []*longhor
 	for action := range actions {
 		r.Actions[action] = apiContext.UrlBuilder.ActionLink(r.Resource, action)
 	}
+	r.Links["events"] = apiContext.UrlBuilder.Link(r.Resource, "events")
 
 	return r
 }
 
-func toSnapshotResource(s *engineapi.Snapshot) *Snapshot {
+func toSnapshotResource(s *longhorn.Snapshot) *Snapshot {
 	if s == nil {
 		logrus.Warn("weird: nil snapshot")
 		return nil
 	}
+	children := map[string]struct{}{}
+	for child := range s.Status.Children {
+		children[child] = struct{}{}
+	}
+	// the labels are known before the snapshot is taken
+	labels := s.Status.Labels
+	if labels == nil {
+		labels = s.Spec.Labels
+	}
 	return &Snapshot{
 		Resource: client.Resource{
 			Id:   s.Name,
 			Type: "snapshot",
 		},
-		Snapshot: *s,
+		Snapshot: engineapi.Snapshot{
+			Name:        s.Name,
+			Parent:      s.Status.Parent,
+			Children:    children,
+			Removed:     s.Status.MarkRemoved,
+			UserCreated: s.Status.UserCreated,
+			Created:     s.Status.CreationTime,
+			Size:        strconv.FormatInt(s.Status.Size, 10),
+			Labels:      labels,
+		},
+		ReadyToUse: s.Status.ReadyToUse,
 	}
 }
 
-func toSnapshotCollection(ss map[string]*engineapi.Snapshot) *client.GenericCollection {
+func toSnapshotCollection(ss []*longhorn.Snapshot) *client.GenericCollection {
 	data := []interface{}{}
 	for _, v := range ss {
 		data = append(data, toSnapshotResource(v))
@@ -545,7 +1018,34 @@ func toSnapshotCollection(ss map[string]*engineapi.Snapshot) *client.GenericColl
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "snapshot"}}
 }
 
-func toBackupVolumeResource(bv *engineapi.BackupVolume, apiContext *api.ApiContext) *BackupVolume {
+func toBackupStatusResource(t *types.BackupTicket) *BackupStatus {
+	return &BackupStatus{
+		Resource: client.Resource{
+			Id:   t.ID,
+			Type: "backupStatus",
+		},
+		Volume:    t.Volume,
+		Node:      t.Node,
+		Snapshot:  t.Snapshot,
+		Priority:  t.Priority,
+		State:     t.State,
+		Requested: t.Requested,
+		Progress:  t.Progress,
+		Error:     t.Error,
+		URL:       t.URL,
+		Finished:  t.Finished,
+	}
+}
+
+func toBackupStatusCollection(tickets []types.BackupTicket) *client.GenericCollection {
+	data := []interface{}{}
+	for i := range tickets {
+		data = append(data, toBackupStatusResource(&tickets[i]))
+	}
+	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "backupStatus"}}
+}
+
+func toBackupVolumeResource(bv *engineapi.BackupVolume, status manager.BackupStoreListingStatus, apiContext *api.ApiContext) *BackupVolume {
 	if bv == nil {
 		logrus.Warnf("weird: nil backupVolume")
 		return nil
@@ -556,47 +1056,138 @@ func toBackupVolumeResource(bv *engineapi.BackupVolume, apiContext *api.ApiConte
 			Type:  "backupVolume",
 			Links: map[string]string{},
 		},
-		BackupVolume: *bv,
+		BackupVolume:  *bv,
+		LastRefreshed: util.FormatTimeZ(status.Refreshed),
+		Stale:         status.Stale(),
+	}
+	if status.Error != nil {
+		b.LastRefreshError = status.Error.Error()
 	}
 	b.Actions = map[string]string{
 		"backupList":   apiContext.UrlBuilder.ActionLink(b.Resource, "backupList"),
 		"backupGet":    apiContext.UrlBuilder.ActionLink(b.Resource, "backupGet"),
 		"backupDelete": apiContext.UrlBuilder.ActionLink(b.Resource, "backupDelete"),
+
+		"backupVolumeDelete": apiContext.UrlBuilder.ActionLink(b.Resource, "backupVolumeDelete"),
 	}
 	return b
 }
 
-func toBackupVolumeCollection(bv []*engineapi.BackupVolume, apiContext *api.ApiContext) *client.GenericCollection {
+func toBackupVolumeDeletionResource(d *manager.BackupVolumeDeletion) *BackupVolumeDeletion {
+	return &BackupVolumeDeletion{
+		Resource: client.Resource{
+			Id:   d.Volume,
+			Type: "backupVolumeDeletion",
+		},
+		Volume:  d.Volume,
+		Backups: d.Backups,
+		DryRun:  d.DryRun,
+	}
+}
+
+func toBackupVolumeCollection(bv []*engineapi.BackupVolume, status manager.BackupStoreListingStatus, apiContext *api.ApiContext) *client.GenericCollection {
 	data := []interface{}{}
 	for _, v := range bv {
-		data = append(data, toBackupVolumeResource(v, apiContext))
+		data = append(data, toBackupVolumeResource(v, status, apiContext))
 	}
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "backupVolume"}}
 }
 
-func toBackupResource(b *engineapi.Backup) *Backup {
+func toBackupResource(b *engineapi.Backup, status manager.BackupStoreListingStatus) *Backup {
 	if b == nil {
 		logrus.Warnf("weird: nil backup")
 		return nil
 	}
-	return &Backup{
+	r := &Backup{
 		Resource: client.Resource{
 			Id:    b.Name,
 			Type:  "backup",
 			Links: map[string]string{},
 		},
-		Backup: *b,
+		Backup:        *b,
+		LastRefreshed: util.FormatTimeZ(status.Refreshed),
+		Stale:         status.Stale(),
+	}
+	if status.Error != nil {
+		r.LastRefreshError = status.Error.Error()
 	}
+	return r
 }
 
-func toBackupCollection(bs []*engineapi.Backup) *client.GenericCollection {
+func toBackupCollection(bs []*engineapi.Backup, status manager.BackupStoreListingStatus) *client.GenericCollection {
 	data := []interface{}{}
 	for _, v := range bs {
-		data = append(data, toBackupResource(v))
+		data = append(data, toBackupResource(v, status))
 	}
 	return &client.GenericCollection{Data: data, Collection: client.Collection{ResourceType: "backup"}}
 }
 
+func toSupportBundleResource(b *manager.SupportBundle, apiContext *api.ApiContext) *SupportBundle {
+	// the bundle is only on the node generating it, so the node is part
+	// of the links
+	self := apiContext.UrlBuilder.ReferenceByIdLink("supportBundle", b.NodeID+"/"+b.Name)
+	r := &SupportBundle{
+		Resource: client.Resource{
+			Id:   b.Name,
+			Type: "supportBundle",
+			Links: map[string]string{
+				"self": self,
+			},
+		},
+		SupportBundle: *b,
+	}
+	if b.State == manager.SupportBundleStateReadyForDownload {
+		r.Links["download"] = self + "/download"
+	}
+	return r
+}
+
+func toVersionResource(v *manager.Version, apiContext *api.ApiContext) *Version {
+	return &Version{
+		Resource: client.Resource{
+			Id:   manager.APIVersion,
+			Type: "version",
+			Links: map[string]string{
+				"self": apiContext.UrlBuilder.Version(manager.APIVersion) + "/version",
+			},
+		},
+		Version: *v,
+	}
+}
+
+func toEngineUpgradeResource(j *manager.EngineUpgradeJob, apiContext *api.ApiContext) *EngineUpgrade {
+	// the job only runs on the node creating it
+	self := apiContext.UrlBuilder.ReferenceByIdLink("engineUpgrade", j.NodeID+"/"+j.Name)
+	actions := map[string]string{}
+	if !manager.IsEngineUpgradeJobDone(j) {
+		if j.Paused {
+			actions["resume"] = self + "?action=resume"
+		} else {
+			actions["pause"] = self + "?action=pause"
+		}
+	}
+	return &EngineUpgrade{
+		Resource: client.Resource{
+			Id:   j.Name,
+			Type: "engineUpgrade",
+			Links: map[string]string{
+				"self": self,
+			},
+			Actions: actions,
+		},
+		EngineUpgradeJob: *j,
+	}
+}
+
+func toBackupTargetTestResultResource(r *manager.BackupTargetTestResult) *BackupTargetTestResult {
+	return &BackupTargetTestResult{
+		Resource: client.Resource{
+			Type: "backupTargetTestResult",
+		},
+		BackupTargetTestResult: *r,
+	}
+}
+
 func toEngineImageResource(ei *longhorn.EngineImage, isDefault bool) *EngineImage {
 	return &EngineImage{
 		Resource: client.Resource{
@@ -621,17 +1212,35 @@ func toEngineImageCollection(eis []*longhorn.EngineImage, defaultImage string) *
 }
 
 type Server struct {
-	m   *manager.VolumeManager
-	wsc *controller.WebsocketController
-	fwd *Fwd
+	m      *manager.VolumeManager
+	wsc    *controller.WebsocketController
+	fwd    *Fwd
+	health *controller.Health
+
+	backupstoreLimiter   *operationLimiter
+	supportBundleLimiter *operationLimiter
+	engineUpgradeLimiter *operationLimiter
 }
 
-func NewServer(m *manager.VolumeManager, wsc *controller.WebsocketController) *Server {
+func NewServer(m *manager.VolumeManager, wsc *controller.WebsocketController, health *controller.Health) *Server {
 	s := &Server{
-		m:   m,
-		wsc: wsc,
-		fwd: NewFwd(m),
+		m:      m,
+		wsc:    wsc,
+		fwd:    NewFwd(m),
+		health: health,
 	}
+	s.backupstoreLimiter = newSettingOperationLimiter(OperationBackupstoreAccess, s,
+		types.SettingNameConcurrentBackupstoreAccessLimit, nil)
+	// only the latest support bundle is kept, so one is collected at a time
+	s.supportBundleLimiter = newOperationLimiter(OperationSupportBundle, func() int64 { return 1 },
+		func() int {
+			if m.IsSupportBundleInProgress() {
+				return 1
+			}
+			return 0
+		})
+	s.engineUpgradeLimiter = newSettingOperationLimiter(OperationEngineUpgradeJob, s,
+		types.SettingNameConcurrentEngineUpgradeJobLimit, m.CountRunningEngineUpgradeJobs)
 	return s
 }
 
@@ -643,10 +1252,16 @@ func toNodeResource(node *longhorn.Node, address string, apiContext *api.ApiCont
 			Actions: map[string]string{},
 			Links:   map[string]string{},
 		},
-		Name:            node.Name,
-		Address:         address,
-		AllowScheduling: node.Spec.AllowScheduling,
-		Conditions:      node.Status.Conditions,
+		Name:              node.Name,
+		Address:           address,
+		AllowScheduling:   node.Spec.AllowScheduling,
+		EvictionRequested: node.Spec.EvictionRequested,
+		MaintenanceMode:   node.Spec.MaintenanceMode,
+		Conditions:        node.Status.Conditions,
+		Tags:              node.Spec.Tags,
+		Zone:              node.Status.Zone,
+
+		EvictionRemainingReplicas: node.Status.EvictionRemainingReplicas,
 	}
 
 	disks := map[string]DiskInfo{}
@@ -660,7 +1275,13 @@ func toNodeResource(node *longhorn.Node, address string, apiContext *api.ApiCont
 	n.Disks = disks
 
 	n.Actions = map[string]string{
-		"diskUpdate": apiContext.UrlBuilder.ActionLink(n.Resource, "diskUpdate"),
+		"diskUpdate":   apiContext.UrlBuilder.ActionLink(n.Resource, "diskUpdate"),
+		"orphanDelete": apiContext.UrlBuilder.ActionLink(n.Resource, "orphanDelete"),
+	}
+	if node.Spec.MaintenanceMode {
+		n.Actions["maintenanceModeExit"] = apiContext.UrlBuilder.ActionLink(n.Resource, "maintenanceModeExit")
+	} else {
+		n.Actions["maintenanceModeEnter"] = apiContext.UrlBuilder.ActionLink(n.Resource, "maintenanceModeEnter")
 	}
 
 	return n
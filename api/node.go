@@ -59,6 +59,9 @@ func (s *Server) NodeUpdate(rw http.ResponseWriter, req *http.Request) error {
 	if err := apiContext.Read(&n); err != nil {
 		return err
 	}
+	if err := validateNodeUpdate(&n); err != nil {
+		return err
+	}
 
 	id := mux.Vars(req)["name"]
 
@@ -67,7 +70,7 @@ func (s *Server) NodeUpdate(rw http.ResponseWriter, req *http.Request) error {
 		return errors.Wrap(err, "fail to get node ip")
 	}
 	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
-		return s.m.UpdateNode(id, n.AllowScheduling)
+		return s.m.UpdateNode(id, n.AllowScheduling, n.EvictionRequested, n.Tags)
 	})
 	if err != nil {
 		return err
@@ -81,12 +84,45 @@ func (s *Server) NodeUpdate(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+func (s *Server) NodeMaintenanceModeEnter(rw http.ResponseWriter, req *http.Request) error {
+	return s.updateNodeMaintenanceMode(rw, req, s.m.EnterNodeMaintenanceMode)
+}
+
+func (s *Server) NodeMaintenanceModeExit(rw http.ResponseWriter, req *http.Request) error {
+	return s.updateNodeMaintenanceMode(rw, req, s.m.ExitNodeMaintenanceMode)
+}
+
+func (s *Server) updateNodeMaintenanceMode(rw http.ResponseWriter, req *http.Request, update func(name string) (*longhorn.Node, error)) error {
+	apiContext := api.GetApiContext(req)
+	id := mux.Vars(req)["name"]
+
+	nodeIPMap, err := s.m.GetManagerNodeIPMap()
+	if err != nil {
+		return errors.Wrap(err, "fail to get node ip")
+	}
+	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
+		return update(id)
+	})
+	if err != nil {
+		return err
+	}
+	unode, ok := obj.(*longhorn.Node)
+	if !ok {
+		return fmt.Errorf("BUG: cannot convert to node %v object", id)
+	}
+	apiContext.Write(toNodeResource(unode, nodeIPMap[id], apiContext))
+	return nil
+}
+
 func (s *Server) DiskUpdate(rw http.ResponseWriter, req *http.Request) error {
 	var diskUpdate DiskUpdateInput
 	apiContext := api.GetApiContext(req)
 	if err := apiContext.Read(&diskUpdate); err != nil {
 		return err
 	}
+	if err := validateDiskUpdateInput(&diskUpdate); err != nil {
+		return err
+	}
 
 	id := mux.Vars(req)["name"]
 
@@ -109,6 +145,37 @@ func (s *Server) DiskUpdate(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+func (s *Server) OrphanDelete(rw http.ResponseWriter, req *http.Request) error {
+	var input OrphanDeleteInput
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return err
+	}
+	if err := validateOrphanDeleteInput(&input); err != nil {
+		return err
+	}
+
+	id := mux.Vars(req)["name"]
+
+	nodeIPMap, err := s.m.GetManagerNodeIPMap()
+	if err != nil {
+		return errors.Wrap(err, "fail to get node ip")
+	}
+
+	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
+		return s.m.DeleteOrphanedReplicaDirectory(id, input.DiskID, input.Name)
+	})
+	if err != nil {
+		return err
+	}
+	unode, ok := obj.(*longhorn.Node)
+	if !ok {
+		return fmt.Errorf("BUG: cannot convert to node %v object", id)
+	}
+	apiContext.Write(toNodeResource(unode, nodeIPMap[id], apiContext))
+	return nil
+}
+
 func (s *Server) NodeDelete(rw http.ResponseWriter, req *http.Request) error {
 	id := mux.Vars(req)["name"]
 	if err := s.m.DeleteNode(id); err != nil {
@@ -2,15 +2,19 @@ package api
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rancher/go-rancher/api"
 	"github.com/rancher/go-rancher/client"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/rancher/longhorn-manager/manager"
 )
 
 var (
@@ -34,26 +38,102 @@ func HandleError(s *client.Schemas, t HandleFuncWithError) http.Handler {
 		if err != nil {
 			logrus.Warnf("HTTP handling error %v", err)
 			apiContext := api.GetApiContext(req)
-			apiContext.WriteErr(err)
+			writeErr(rw, apiContext, err)
 		}
 	}))
 }
 
+type validationErrorResponse struct {
+	client.ServerApiError
+	FieldErrors []FieldError `json:"fieldErrors"`
+}
+
+// writeErr writes the errors known to be caused by the request with the
+// status code other than 500, e.g. the snapshot of the volume is not found
+func writeErr(rw http.ResponseWriter, apiContext *api.ApiContext, err error) {
+	if limitErr, ok := errors.Cause(err).(*TooManyRequestsError); ok {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(limitErr.RetryAfter.Seconds())))
+		rw.WriteHeader(http.StatusTooManyRequests)
+		if writeErr := apiContext.WriteResource(&client.ServerApiError{
+			Resource: client.Resource{
+				Type: "error",
+			},
+			Status:  http.StatusTooManyRequests,
+			Code:    "TooManyRequests",
+			Message: err.Error(),
+		}); writeErr != nil {
+			logrus.Errorf("Failed to write err: %v", err)
+		}
+		return
+	}
+	if validationErr, ok := errors.Cause(err).(*ValidationError); ok {
+		rw.WriteHeader(http.StatusUnprocessableEntity)
+		if writeErr := apiContext.WriteResource(&validationErrorResponse{
+			ServerApiError: client.ServerApiError{
+				Resource: client.Resource{
+					Type: "error",
+				},
+				Status:  http.StatusUnprocessableEntity,
+				Code:    "InvalidFields",
+				Message: err.Error(),
+			},
+			FieldErrors: validationErr.FieldErrors,
+		}); writeErr != nil {
+			logrus.Errorf("Failed to write err: %v", err)
+		}
+		return
+	}
+	managerErr, ok := errors.Cause(err).(*manager.Error)
+	if !ok {
+		apiContext.WriteErr(err)
+		return
+	}
+	status := http.StatusInternalServerError
+	switch managerErr.Reason {
+	case manager.ErrorReasonInvalidInput:
+		status = http.StatusBadRequest
+	case manager.ErrorReasonNotFound:
+		status = http.StatusNotFound
+	case manager.ErrorReasonInvalidState:
+		status = http.StatusConflict
+	case manager.ErrorReasonForbidden:
+		status = http.StatusForbidden
+	}
+	rw.WriteHeader(status)
+	if writeErr := apiContext.WriteResource(&client.ServerApiError{
+		Resource: client.Resource{
+			Type: "error",
+		},
+		Status:  status,
+		Code:    string(managerErr.Reason),
+		Message: err.Error(),
+	}); writeErr != nil {
+		logrus.Errorf("Failed to write err: %v", err)
+	}
+}
+
 func NewRouter(s *Server) *mux.Router {
 	schemas := NewSchema()
 	r := mux.NewRouter().StrictSlash(true)
 	f := HandleError
 
 	versionsHandler := api.VersionsHandler(schemas, "v1")
-	versionHandler := api.VersionHandler(schemas, "v1")
+	versionHandler := f(schemas, s.APIVersionGet(schemas))
 	r.Methods("GET").Path("/").Handler(versionsHandler)
 	r.Methods("GET").Path("/v1").Handler(versionHandler)
 	r.Methods("GET").Path("/v1/apiversions").Handler(versionsHandler)
 	r.Methods("GET").Path("/v1/apiversions/v1").Handler(versionHandler)
+	r.Methods("GET").Path("/v1/version").Handler(f(schemas, s.VersionGet))
+	r.Methods("GET").Path("/v1/healthz").HandlerFunc(s.Healthz)
+	r.Methods("GET").Path("/v1/readyz").HandlerFunc(s.Readyz)
+	r.Methods("GET").Path("/metrics").Handler(promhttp.Handler())
 	r.Methods("GET").Path("/v1/schemas").Handler(api.SchemasHandler(schemas))
 	r.Methods("GET").Path("/v1/schemas/{id}").Handler(api.SchemaHandler(schemas))
 
 	r.Methods("GET").Path("/v1/settings").Handler(f(schemas, s.SettingList))
+	// registered before the setting of the name, which would match it too
+	r.Methods("GET").Path("/v1/settings/export").Handler(f(schemas, s.SettingsExport))
+	r.Methods("POST").Path("/v1/settings/import").Handler(f(schemas, s.SettingsImport))
 	r.Methods("GET").Path("/v1/settings/{name}").Handler(f(schemas, s.SettingGet))
 	r.Methods("PUT").Path("/v1/settings/{name}").Handler(f(schemas, s.SettingSet))
 
@@ -61,6 +141,7 @@ func NewRouter(s *Server) *mux.Router {
 	r.Methods("GET").Path("/v1/volumes/{name}").Handler(f(schemas, s.VolumeGet))
 	r.Methods("DELETE").Path("/v1/volumes/{name}").Handler(f(schemas, s.VolumeDelete))
 	r.Methods("POST").Path("/v1/volumes").Handler(f(schemas, s.VolumeCreate))
+	r.Methods("GET").Path("/v1/volumes/{name}/events").Handler(f(schemas, s.VolumeEventList))
 
 	volumeActions := map[string]func(http.ResponseWriter, *http.Request) error{
 		"attach":          s.VolumeAttach,
@@ -71,10 +152,19 @@ func NewRouter(s *Server) *mux.Router {
 		"replicaRemove": s.ReplicaRemove,
 		"engineUpgrade": s.EngineUpgrade,
 
+		"updateReplicaCount":                 s.UpdateReplicaCount,
+		"updateQoS":                          s.UpdateQoS,
+		"updateBackupTargetCredentialSecret": s.UpdateBackupTargetCredentialSecret,
+
+		"pvCreate":  s.PVCreate,
+		"pvcCreate": s.PVCCreate,
+
 		"migrationStart":    s.MigrationStart,
 		"migrationConfirm":  s.MigrationConfirm,
 		"migrationRollback": s.MigrationRollback,
 
+		"restoreTrashed": s.VolumeRestoreTrashed,
+
 		"snapshotPurge":  s.fwd.Handler(OwnerIDFromVolume(s.m), s.SnapshotPurge),
 		"snapshotCreate": s.fwd.Handler(OwnerIDFromVolume(s.m), s.SnapshotCreate),
 		"snapshotList":   s.fwd.Handler(OwnerIDFromVolume(s.m), s.SnapshotList),
@@ -82,17 +172,25 @@ func NewRouter(s *Server) *mux.Router {
 		"snapshotDelete": s.fwd.Handler(OwnerIDFromVolume(s.m), s.SnapshotDelete),
 		"snapshotRevert": s.fwd.Handler(OwnerIDFromVolume(s.m), s.SnapshotRevert),
 		"snapshotBackup": s.fwd.Handler(OwnerIDFromVolume(s.m), s.SnapshotBackup),
+
+		"backupStatusList": s.BackupStatusList,
+		"backupStatusGet":  s.BackupStatusGet,
 	}
 	for name, action := range volumeActions {
 		r.Methods("POST").Path("/v1/volumes/{name}").Queries("action", name).Handler(f(schemas, action))
 	}
 
-	r.Methods("GET").Path("/v1/backupvolumes").Handler(f(schemas, s.BackupVolumeList))
-	r.Methods("GET").Path("/v1/backupvolumes/{volName}").Handler(f(schemas, s.BackupVolumeGet))
+	// the backup listing only accesses the backupstore if bypassing the cache
+	backupstore := s.backupstoreLimiter
+	r.Methods("POST").Path("/v1/backuptargets/test").Handler(f(schemas, backupstore.Handler(s.BackupTargetTest)))
+	r.Methods("GET").Path("/v1/backupvolumes").Handler(f(schemas, backupstore.HandlerIf(isRefreshRequested, s.BackupVolumeList)))
+	r.Methods("GET").Path("/v1/backupvolumes/{volName}").Handler(f(schemas, backupstore.HandlerIf(isRefreshRequested, s.BackupVolumeGet)))
 	backupActions := map[string]func(http.ResponseWriter, *http.Request) error{
-		"backupList":   s.BackupList,
-		"backupGet":    s.BackupGet,
-		"backupDelete": s.BackupDelete,
+		"backupList":   backupstore.HandlerIf(isRefreshRequested, s.BackupList),
+		"backupGet":    backupstore.HandlerIf(isRefreshRequested, s.BackupGet),
+		"backupDelete": backupstore.Handler(s.BackupDelete),
+
+		"backupVolumeDelete": backupstore.Handler(s.BackupVolumeDelete),
 	}
 	for name, action := range backupActions {
 		r.Methods("POST").Path("/v1/backupvolumes/{volName}").Queries("action", name).Handler(f(schemas, action))
@@ -103,7 +201,11 @@ func NewRouter(s *Server) *mux.Router {
 	r.Methods("PUT").Path("/v1/nodes/{name}").Handler(f(schemas, s.NodeUpdate))
 	r.Methods("DELETE").Path("/v1/nodes/{name}").Handler(f(schemas, s.NodeDelete))
 	nodeActions := map[string]func(http.ResponseWriter, *http.Request) error{
-		"diskUpdate": s.fwd.Handler(OwnerIDFromNode(s.m), s.DiskUpdate),
+		"diskUpdate":   s.fwd.Handler(OwnerIDFromNode(s.m), s.DiskUpdate),
+		"orphanDelete": s.fwd.Handler(OwnerIDFromNode(s.m), s.OrphanDelete),
+
+		"maintenanceModeEnter": s.NodeMaintenanceModeEnter,
+		"maintenanceModeExit":  s.NodeMaintenanceModeExit,
 	}
 	for name, action := range nodeActions {
 		r.Methods("POST").Path("/v1/nodes/{name}").Queries("action", name).Handler(f(schemas, action))
@@ -116,6 +218,20 @@ func NewRouter(s *Server) *mux.Router {
 
 	r.Methods("Get").Path("/v1/events").Handler(f(schemas, s.EventList))
 
+	r.Methods("POST").Path("/v1/supportbundles").Handler(f(schemas, s.supportBundleLimiter.Handler(s.SupportBundleCreate)))
+	r.Methods("GET").Path("/v1/supportbundles/{nodeID}/{name}").Handler(f(schemas, s.fwd.Handler(OwnerIDFromSupportBundle, s.SupportBundleGet)))
+	r.Methods("GET").Path("/v1/supportbundles/{nodeID}/{name}/download").Handler(f(schemas, s.fwd.Handler(OwnerIDFromSupportBundle, s.SupportBundleDownload)))
+
+	r.Methods("POST").Path("/v1/engineupgrades").Handler(f(schemas, s.engineUpgradeLimiter.Handler(s.EngineUpgradeCreate)))
+	r.Methods("GET").Path("/v1/engineupgrades/{nodeID}/{name}").Handler(f(schemas, s.fwd.Handler(OwnerIDFromEngineUpgrade, s.EngineUpgradeGet)))
+	engineUpgradeActions := map[string]func(http.ResponseWriter, *http.Request) error{
+		"pause":  s.EngineUpgradePause,
+		"resume": s.EngineUpgradeResume,
+	}
+	for name, action := range engineUpgradeActions {
+		r.Methods("POST").Path("/v1/engineupgrades/{nodeID}/{name}").Queries("action", name).Handler(f(schemas, s.fwd.Handler(OwnerIDFromEngineUpgrade, action)))
+	}
+
 	settingListStream := NewStreamHandlerFunc("settings", s.wsc.NewWatcher("setting"), s.settingList)
 	r.Path("/v1/ws/settings").Handler(f(schemas, settingListStream))
 	r.Path("/v1/ws/{period}/settings").Handler(f(schemas, settingListStream))
@@ -136,5 +252,7 @@ func NewRouter(s *Server) *mux.Router {
 	r.Path("/v1/ws/events").Handler(f(schemas, eventListStream))
 	r.Path("/v1/ws/{period}/events").Handler(f(schemas, eventListStream))
 
+	r.Path("/v1/ws/changes").Handler(f(schemas, s.ChangeStream))
+
 	return r
 }
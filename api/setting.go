@@ -2,14 +2,17 @@ package api
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/api"
 	"github.com/rancher/go-rancher/client"
 
+	"github.com/rancher/longhorn-manager/manager"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 
@@ -57,14 +60,20 @@ func (s *Server) SettingSet(w http.ResponseWriter, req *http.Request) error {
 
 	name := mux.Vars(req)["name"]
 	sName := types.SettingName(name)
+	value := strings.TrimSpace(setting.Value)
+	if err := validateSettingInput(sName, value); err != nil {
+		return err
+	}
 
+	// force overrides the check of the operations the change would disrupt
+	force := req.URL.Query().Get("force") == "true"
 	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
 		si, err := s.m.GetSetting(sName)
 		if err != nil {
 			return nil, err
 		}
-		si.Value = strings.TrimSpace(setting.Value)
-		return s.m.CreateOrUpdateSetting(si)
+		si.Value = value
+		return s.m.CreateOrUpdateSetting(si, requesterOf(req), force)
 	})
 	if err != nil {
 		return err
@@ -74,6 +83,83 @@ func (s *Server) SettingSet(w http.ResponseWriter, req *http.Request) error {
 		return fmt.Errorf("BUG: cannot convert to setting %v object", name)
 	}
 
-	apiContext.Write(toSettingResource(si))
+	resource := toSettingResource(si)
+	// the backup target is optionally tested by `?test=true`, and only warned
+	// about since the backupstore may be set up after the setting
+	if sName == types.SettingNameBackupTarget && req.URL.Query().Get("test") == "true" {
+		if result := s.m.TestBackupTargetSetting(si.Value); result != nil && !result.Success {
+			resource.Warning = fmt.Sprintf("backup target is unreachable: %v: %v", result.ErrorType, result.Message)
+		}
+	}
+	apiContext.Write(resource)
 	return nil
 }
+
+// SettingsExport exports the settings. The credentials are only included by
+// `?includeCredentials=true` from the user authenticated by the proxy.
+func (s *Server) SettingsExport(w http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+
+	includeCredentials := req.URL.Query().Get("includeCredentials") == "true"
+	if includeCredentials && authenticatedUserOf(req) == "" {
+		return &manager.Error{
+			Reason:  manager.ErrorReasonForbidden,
+			Message: "exporting the credentials requires an authenticated user",
+		}
+	}
+	export, err := s.m.ExportSettings(includeCredentials)
+	if err != nil {
+		return errors.Wrap(err, "fail to export settings")
+	}
+	if includeCredentials {
+		logrus.Infof("Exported settings with the credentials for %v", requesterOf(req))
+	}
+	apiContext.Write(toSettingsExportResource(export))
+	return nil
+}
+
+// SettingsImport imports the settings exported by SettingsExport. The
+// cluster specific settings are only imported by `?force=true`.
+func (s *Server) SettingsImport(w http.ResponseWriter, req *http.Request) error {
+	var input SettingsExport
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrap(err, "error read settingsExport")
+	}
+
+	force := req.URL.Query().Get("force") == "true"
+	results, err := s.m.ImportSettings(&input.SettingsExport, force, requesterOf(req))
+	if err != nil {
+		return errors.Wrap(err, "fail to import settings")
+	}
+	apiContext.Write(toSettingsImportResource(results))
+	return nil
+}
+
+// authenticatedUserOf returns the user authenticated by the proxy in front
+// of the API, or empty if the request doesn't come through one
+func authenticatedUserOf(req *http.Request) string {
+	for _, header := range []string{"X-Remote-User", "X-Forwarded-User"} {
+		if user := strings.TrimSpace(req.Header.Get(header)); user != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// requesterOf returns who sent the request. The user is only known if the
+// request comes through an authenticating proxy, otherwise it's the address
+// of the client.
+func requesterOf(req *http.Request) string {
+	if user := authenticatedUserOf(req); user != "" {
+		return user
+	}
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/manager"
+)
+
+func TestRequesterOf(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := map[string]struct {
+		headers    map[string]string
+		remoteAddr string
+		requester  string
+	}{
+		"client address": {
+			remoteAddr: "10.42.0.5:51234",
+			requester:  "10.42.0.5",
+		},
+		"forwarded client address": {
+			headers:    map[string]string{"X-Forwarded-For": "192.168.1.10, 10.42.0.1"},
+			remoteAddr: "10.42.0.1:51234",
+			requester:  "192.168.1.10",
+		},
+		"authenticated user": {
+			headers: map[string]string{
+				"X-Remote-User":   "alice",
+				"X-Forwarded-For": "192.168.1.10",
+			},
+			remoteAddr: "10.42.0.1:51234",
+			requester:  "alice",
+		},
+		"forwarded user": {
+			headers:    map[string]string{"X-Forwarded-User": "bob"},
+			remoteAddr: "10.42.0.1:51234",
+			requester:  "bob",
+		},
+	}
+	for name, tc := range testCases {
+		req := httptest.NewRequest("PUT", "/v1/settings/backup-target", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		assert.Equal(tc.requester, requesterOf(req), name)
+	}
+}
+
+func TestSettingsExportCredentialsRequireAuthenticatedUser(t *testing.T) {
+	assert := require.New(t)
+
+	s := &Server{}
+	req := httptest.NewRequest("GET", "/v1/settings/export?includeCredentials=true", nil)
+	err := s.SettingsExport(httptest.NewRecorder(), req)
+	managerErr, ok := errors.Cause(err).(*manager.Error)
+	assert.True(ok)
+	assert.Equal(manager.ErrorReasonForbidden, managerErr.Reason)
+}
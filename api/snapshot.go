@@ -20,14 +20,17 @@ func (s *Server) SnapshotCreate(w http.ResponseWriter, req *http.Request) (err e
 	if err := apiContext.Read(&input); err != nil {
 		return err
 	}
+	if err := validateSnapshotInput(&input, false); err != nil {
+		return err
+	}
 
 	volName := mux.Vars(req)["name"]
 
-	snapshot, err := s.m.CreateSnapshot(input.Name, input.Labels, volName)
+	snapList, err := s.m.CreateSnapshot(input.Name, input.Labels, volName)
 	if err != nil {
 		return err
 	}
-	apiContext.Write(toSnapshotResource(snapshot))
+	apiContext.Write(toSnapshotCollection(snapList))
 	return nil
 }
 
@@ -57,6 +60,9 @@ func (s *Server) SnapshotGet(w http.ResponseWriter, req *http.Request) (err erro
 	if err := apiContext.Read(&input); err != nil {
 		return err
 	}
+	if err := validateSnapshotInput(&input, true); err != nil {
+		return err
+	}
 	volName := mux.Vars(req)["name"]
 
 	snap, err := s.m.GetSnapshot(input.Name, volName)
@@ -78,12 +84,17 @@ func (s *Server) SnapshotDelete(w http.ResponseWriter, req *http.Request) (err e
 	if err := apiContext.Read(&input); err != nil {
 		return err
 	}
+	if err := validateSnapshotInput(&input, true); err != nil {
+		return err
+	}
 
 	volName := mux.Vars(req)["name"]
 
-	if err := s.m.DeleteSnapshot(input.Name, volName); err != nil {
+	snapList, err := s.m.DeleteSnapshot(input.Name, volName)
+	if err != nil {
 		return err
 	}
+	apiContext.Write(toSnapshotCollection(snapList))
 	return nil
 }
 
@@ -98,12 +109,16 @@ func (s *Server) SnapshotRevert(w http.ResponseWriter, req *http.Request) (err e
 	if err := apiContext.Read(&input); err != nil {
 		return err
 	}
+	if err := validateSnapshotInput(&input, true); err != nil {
+		return err
+	}
 	volName := mux.Vars(req)["name"]
 
-	if err := s.m.RevertSnapshot(input.Name, volName); err != nil {
+	snapList, err := s.m.RevertSnapshot(input.Name, volName)
+	if err != nil {
 		return err
 	}
-
+	apiContext.Write(toSnapshotCollection(snapList))
 	return nil
 }
 
@@ -118,6 +133,9 @@ func (s *Server) SnapshotBackup(w http.ResponseWriter, req *http.Request) (err e
 	if err := apiContext.Read(&input); err != nil {
 		return err
 	}
+	if err := validateSnapshotInput(&input, true); err != nil {
+		return err
+	}
 
 	volName := mux.Vars(req)["name"]
 
@@ -127,11 +145,55 @@ func (s *Server) SnapshotBackup(w http.ResponseWriter, req *http.Request) (err e
 	}
 
 	labels := make(map[string]string)
+	for key, value := range input.Labels {
+		labels[key] = value
+	}
 	if vol.Spec.BaseImage != "" {
 		labels[types.BaseImageLabel] = vol.Spec.BaseImage
 	}
 
-	return s.m.BackupSnapshot(input.Name, labels, volName)
+	ticket, err := s.m.BackupSnapshot(input.Name, labels, volName, input.Priority)
+	if err != nil {
+		return err
+	}
+	apiContext.Write(toBackupStatusResource(ticket))
+	return nil
+}
+
+func (s *Server) BackupStatusList(w http.ResponseWriter, req *http.Request) (err error) {
+	defer func() {
+		err = errors.Wrap(err, "fail to list backup status")
+	}()
+
+	volName := mux.Vars(req)["name"]
+
+	tickets, err := s.m.ListBackupStatus(volName)
+	if err != nil {
+		return err
+	}
+	api.GetApiContext(req).Write(toBackupStatusCollection(tickets))
+	return nil
+}
+
+func (s *Server) BackupStatusGet(w http.ResponseWriter, req *http.Request) (err error) {
+	defer func() {
+		err = errors.Wrap(err, "fail to get backup status")
+	}()
+
+	var input BackupStatusInput
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return err
+	}
+	volName := mux.Vars(req)["name"]
+
+	ticket, err := s.m.GetBackupStatus(input.ID, volName)
+	if err != nil {
+		return err
+	}
+	apiContext.Write(toBackupStatusResource(ticket))
+	return nil
 }
 
 func (s *Server) SnapshotPurge(w http.ResponseWriter, req *http.Request) (err error) {
@@ -141,5 +203,10 @@ func (s *Server) SnapshotPurge(w http.ResponseWriter, req *http.Request) (err er
 
 	volName := mux.Vars(req)["name"]
 
-	return s.m.PurgeSnapshot(volName)
+	snapList, err := s.m.PurgeSnapshot(volName)
+	if err != nil {
+		return err
+	}
+	api.GetApiContext(req).Write(toSnapshotCollection(snapList))
+	return nil
 }
@@ -1,10 +1,12 @@
 package api
 
 import (
+	"fmt"
 	"math/rand"
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -14,14 +16,43 @@ import (
 	"github.com/rancher/go-rancher/client"
 
 	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/manager"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
 )
 
 const (
 	keepAlivePeriod = 15 * time.Second
 
 	writeWait = 10 * time.Second
+	// the client not answering the pings for this long is considered dead
+	pongWait = 2 * keepAlivePeriod
+
+	changeMessageTypeSnapshot = "snapshot"
 )
 
+// changeStreamResources are the resource types can be subscribed in the change
+// stream, and the resources watched for each of them. The engines and the
+// replicas are part of the volume objects, so their changes are delivered as
+// the updates of the volumes.
+var changeStreamResources = map[string][]string{
+	"volume":  {"volume", "engine", "replica"},
+	"node":    {"node"},
+	"setting": {"setting"},
+}
+
+// changeMessage is sent for the initial snapshot of each resource type, with
+// the collection in Data, then for each object created, updated or deleted,
+// with the object in Data. The objects are the same as the REST API returns.
+type changeMessage struct {
+	Type         string      `json:"type"`
+	ResourceType string      `json:"resourceType"`
+	ID           string      `json:"id,omitempty"`
+	Data         interface{} `json:"data"`
+}
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
@@ -133,3 +164,241 @@ func getPeriod(r *http.Request) time.Duration {
 	}
 	return period
 }
+
+// ChangeStream streams the changes of the volumes, nodes and settings. The
+// resource types are subscribed by the query parameter `resources`, e.g.
+// `?resources=volume,node`, and all of them by default. The snapshot of each
+// resource type is sent first, and again if the client falls behind.
+func (s *Server) ChangeStream(w http.ResponseWriter, r *http.Request) error {
+	resourceTypes, watchedResources, err := parseChangeStreamResources(r.URL.Query().Get("resources"))
+	if err != nil {
+		return err
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fields := logrus.Fields{
+		"id":   strconv.Itoa(rand.Int()),
+		"type": "changes",
+	}
+	logrus.WithFields(fields).Debug("websocket: open")
+
+	// subscribe before the snapshot, so no change is missed in between
+	watcher := s.wsc.NewChangeWatcher(watchedResources...)
+	defer s.wsc.RemoveChangeWatcher(watcher)
+
+	// the read deadline is extended by every pong, so the connection of
+	// the dead client is cleaned up
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				logrus.WithFields(fields).Debug(err.Error())
+				return
+			}
+		}
+	}()
+
+	apiContext := api.GetApiContext(r)
+	writeSnapshots := func() error {
+		return s.writeChangeSnapshots(conn, apiContext, resourceTypes)
+	}
+	writeChange := func(change controller.Change) error {
+		msg, err := s.toChangeMessage(apiContext, change)
+		if err != nil || msg == nil {
+			return err
+		}
+		return writeChangeMessage(conn, msg)
+	}
+	return streamChanges(conn, watcher, done, fields, writeSnapshots, writeChange)
+}
+
+// parseChangeStreamResources returns the resource types requested, and the
+// resources to watch for them
+func parseChangeStreamResources(requested string) ([]string, []string, error) {
+	resourceTypes := []string{}
+	watchedResources := []string{}
+	if requested == "" {
+		requested = "volume,node,setting"
+	}
+	for _, resourceType := range strings.Split(requested, ",") {
+		resources, ok := changeStreamResources[resourceType]
+		if !ok {
+			return nil, nil, &manager.Error{
+				Reason:  manager.ErrorReasonInvalidInput,
+				Message: fmt.Sprintf("invalid resource type %v to watch", resourceType),
+			}
+		}
+		resourceTypes = append(resourceTypes, resourceType)
+		watchedResources = append(watchedResources, resources...)
+	}
+	return resourceTypes, watchedResources, nil
+}
+
+// streamChanges sends the snapshots, then the changes received by the
+// watcher until the client is done. If the client falls behind, the queued
+// changes are dropped and the snapshots are sent again.
+func streamChanges(conn *websocket.Conn, watcher *controller.ChangeWatcher, done <-chan struct{}, fields logrus.Fields,
+	writeSnapshots func() error, writeChange func(change controller.Change) error) error {
+	if err := writeSnapshots(); err != nil {
+		return err
+	}
+
+	keepAliveTicker := time.NewTicker(keepAlivePeriod)
+	defer keepAliveTicker.Stop()
+	for {
+		var err error
+		select {
+		case <-done:
+			return nil
+		case <-watcher.Overflowed():
+			logrus.WithFields(fields).Debug("websocket: client falls behind, sending snapshots again")
+			for len(watcher.Changes()) > 0 {
+				<-watcher.Changes()
+			}
+			err = writeSnapshots()
+		case change := <-watcher.Changes():
+			err = writeChange(change)
+		case <-keepAliveTicker.C:
+			err = conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) writeChangeSnapshots(conn *websocket.Conn, apiContext *api.ApiContext, resourceTypes []string) error {
+	for _, resourceType := range resourceTypes {
+		var resp *client.GenericCollection
+		var err error
+		switch resourceType {
+		case "volume":
+			resp, err = s.volumeList(apiContext)
+		case "node":
+			resp, err = s.nodeList(apiContext)
+		case "setting":
+			resp, err = s.settingList(apiContext)
+		}
+		if err != nil {
+			return err
+		}
+		data, err := apiContext.PopulateCollection(resp)
+		if err != nil {
+			return err
+		}
+		if err := writeChangeMessage(conn, &changeMessage{
+			Type:         changeMessageTypeSnapshot,
+			ResourceType: resourceType,
+			Data:         data,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toChangeMessage returns the message of the change with the object as the
+// REST API returns, or nil if there is nothing to send
+func (s *Server) toChangeMessage(apiContext *api.ApiContext, change controller.Change) (*changeMessage, error) {
+	msg := &changeMessage{
+		Type: string(change.Type),
+	}
+	var resource interface{}
+	switch obj := change.Obj.(type) {
+	case *longhorn.Volume:
+		msg.ResourceType = "volume"
+		msg.ID = obj.Name
+		if change.Type == controller.ChangeTypeDeleted {
+			resource = toVolumeResource(obj, nil, nil, apiContext)
+			break
+		}
+		r, err := s.getVolumeResource(apiContext, obj.Name)
+		if err != nil || r == nil {
+			return nil, err
+		}
+		resource = r
+	case *longhorn.Engine, *longhorn.Replica:
+		volumeName := ""
+		if e, ok := obj.(*longhorn.Engine); ok {
+			volumeName = e.Spec.VolumeName
+		} else {
+			volumeName = obj.(*longhorn.Replica).Spec.VolumeName
+		}
+		msg.Type = string(controller.ChangeTypeUpdated)
+		msg.ResourceType = "volume"
+		msg.ID = volumeName
+		r, err := s.getVolumeResource(apiContext, volumeName)
+		if err != nil || r == nil {
+			return nil, err
+		}
+		resource = r
+	case *longhorn.Node:
+		msg.ResourceType = "node"
+		msg.ID = obj.Name
+		nodeIPMap, err := s.m.GetManagerNodeIPMap()
+		if err != nil {
+			return nil, err
+		}
+		resource = toNodeResource(obj, nodeIPMap[obj.Name], apiContext)
+	case *longhorn.Setting:
+		// the deleted setting falls back to the default value
+		msg.Type = string(controller.ChangeTypeUpdated)
+		msg.ResourceType = "setting"
+		msg.ID = obj.Name
+		setting, err := s.m.GetSetting(types.SettingName(obj.Name))
+		if err != nil {
+			logrus.Warnf("Skip the change of setting %v: %v", obj.Name, err)
+			return nil, nil
+		}
+		resource = toSettingResource(setting)
+	default:
+		return nil, fmt.Errorf("BUG: unknown object %T of change", change.Obj)
+	}
+
+	// populate the links the same way as the collection
+	data, err := apiContext.PopulateCollection(&client.GenericCollection{Data: []interface{}{resource}})
+	if err != nil {
+		return nil, err
+	}
+	if resources, ok := data["data"].([]map[string]interface{}); ok && len(resources) == 1 {
+		msg.Data = resources[0]
+	} else {
+		msg.Data = resource
+	}
+	return msg, nil
+}
+
+// getVolumeResource returns the volume with its engines and replicas, or nil
+// if the volume has been deleted
+func (s *Server) getVolumeResource(apiContext *api.ApiContext, name string) (*Volume, error) {
+	v, err := s.m.Get(name)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	controllers, err := s.m.GetEnginesSorted(name)
+	if err != nil {
+		return nil, err
+	}
+	replicas, err := s.m.GetReplicasSorted(name)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumeResource(v, controllers, replicas, apiContext), nil
+}
+
+func writeChangeMessage(conn *websocket.Conn, msg *changeMessage) error {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteJSON(msg)
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/manager"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+)
+
+const TestNamespace = "longhorn-system"
+
+func TestParseChangeStreamResources(t *testing.T) {
+	assert := require.New(t)
+
+	resourceTypes, watchedResources, err := parseChangeStreamResources("")
+	assert.Nil(err)
+	assert.Equal([]string{"volume", "node", "setting"}, resourceTypes)
+	assert.Equal([]string{"volume", "engine", "replica", "node", "setting"}, watchedResources)
+
+	resourceTypes, watchedResources, err = parseChangeStreamResources("node")
+	assert.Nil(err)
+	assert.Equal([]string{"node"}, resourceTypes)
+	assert.Equal([]string{"node"}, watchedResources)
+
+	// the invalid resource types are reported as bad requests
+	for _, invalid := range []string{"engine", "volume,disk", "volume,"} {
+		_, _, err := parseChangeStreamResources(invalid)
+		managerErr, ok := errors.Cause(err).(*manager.Error)
+		assert.True(ok, invalid)
+		assert.Equal(manager.ErrorReasonInvalidInput, managerErr.Reason, invalid)
+	}
+}
+
+func newTestSetting(name string) *longhorn.Setting {
+	return &longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: TestNamespace,
+		},
+	}
+}
+
+func TestStreamChangesOverflow(t *testing.T) {
+	assert := require.New(t)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, 0)
+	lhInformers := lhInformerFactory.Longhorn().V1alpha1()
+	wsc := controller.NewWebsocketController(lhInformers.Volumes(), lhInformers.Engines(), lhInformers.Replicas(),
+		lhInformers.Settings(), lhInformers.EngineImages(), lhInformers.Nodes())
+
+	// the client falls behind before the stream starts, with the settings
+	// more than the buffer listed by the informer
+	watcher := wsc.NewChangeWatcher("setting")
+	defer wsc.RemoveChangeWatcher(watcher)
+	for i := 0; i <= controller.ChangeWatcherBufferSize; i++ {
+		_, err := lhClient.LonghornV1alpha1().Settings(TestNamespace).Create(newTestSetting(fmt.Sprintf("setting-%v", i)))
+		assert.Nil(err)
+	}
+	lhInformerFactory.Start(stopCh)
+	assert.True(cache.WaitForCacheSync(stopCh, lhInformers.Settings().Informer().HasSynced))
+	for i := 0; i < 100 && len(watcher.Overflowed()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Len(watcher.Overflowed(), 1)
+	assert.Len(watcher.Changes(), controller.ChangeWatcherBufferSize)
+
+	done := make(chan struct{})
+	defer close(done)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writeSnapshots := func() error {
+			return writeChangeMessage(conn, &changeMessage{Type: changeMessageTypeSnapshot, ResourceType: "setting"})
+		}
+		writeChange := func(change controller.Change) error {
+			setting := change.Obj.(*longhorn.Setting)
+			return writeChangeMessage(conn, &changeMessage{Type: string(change.Type), ResourceType: "setting", ID: setting.Name})
+		}
+		streamChanges(conn, watcher, done, logrus.Fields{}, writeSnapshots, writeChange)
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(err)
+	defer conn.Close()
+	readMessage := func() *changeMessage {
+		msg := &changeMessage{}
+		assert.Nil(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+		assert.Nil(conn.ReadJSON(msg))
+		return msg
+	}
+
+	// the initial snapshot, then the snapshot again once the overflow is
+	// noticed, without the changes queued before it
+	assert.Equal(changeMessageTypeSnapshot, readMessage().Type)
+	changes := 0
+	for msg := readMessage(); msg.Type != changeMessageTypeSnapshot; msg = readMessage() {
+		changes++
+	}
+	assert.True(changes < controller.ChangeWatcherBufferSize)
+	assert.Len(watcher.Changes(), 0)
+
+	// and the changes are streamed after the snapshot
+	_, err = lhClient.LonghornV1alpha1().Settings(TestNamespace).Create(newTestSetting("setting-after-snapshot"))
+	assert.Nil(err)
+	msg := readMessage()
+	assert.Equal(string(controller.ChangeTypeCreated), msg.Type)
+	assert.Equal("setting-after-snapshot", msg.ID)
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher/api"
+)
+
+func OwnerIDFromSupportBundle(req *http.Request) (string, error) {
+	return mux.Vars(req)["nodeID"], nil
+}
+
+func (s *Server) SupportBundleCreate(w http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+
+	bundle, err := s.m.CreateSupportBundle()
+	if err != nil {
+		return errors.Wrap(err, "unable to create support bundle")
+	}
+	apiContext.Write(toSupportBundleResource(bundle, apiContext))
+	return nil
+}
+
+func (s *Server) SupportBundleGet(w http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+
+	name := mux.Vars(req)["name"]
+
+	bundle := s.m.GetSupportBundle(name)
+	if bundle == nil {
+		logrus.Warnf("cannot find support bundle %v", name)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	apiContext.Write(toSupportBundleResource(bundle, apiContext))
+	return nil
+}
+
+func (s *Server) SupportBundleDownload(w http.ResponseWriter, req *http.Request) error {
+	name := mux.Vars(req)["name"]
+
+	bundle, f, err := s.m.OpenSupportBundle(name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to download support bundle %v", name)
+	}
+	if bundle == nil {
+		logrus.Warnf("cannot find support bundle %v", name)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v", bundle.Filename))
+	w.Header().Set("Content-Length", strconv.FormatInt(bundle.Size, 10))
+	if _, err := io.Copy(w, f); err != nil {
+		// the response has started, only log the failure
+		logrus.Errorf("Fail to send support bundle %v: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+// FieldError is the failure of the validation of a field of the request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned by the handlers if the request fails the
+// validation, and is written as 422 with all the field errors
+type ValidationError struct {
+	FieldErrors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := []string{}
+	for _, fe := range e.FieldErrors {
+		msgs = append(msgs, fe.Field+": "+fe.Message)
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+// fieldCheck returns the message if the value is invalid
+type fieldCheck func(value interface{}) string
+
+// fieldRule validates a field of the request. The checks are skipped if the
+// value is empty and the field is not required.
+type fieldRule struct {
+	field    string
+	value    interface{}
+	required bool
+	checks   []fieldCheck
+}
+
+func validateFields(rules []fieldRule) error {
+	fieldErrors := []FieldError{}
+	for _, rule := range rules {
+		if isEmptyValue(rule.value) {
+			if rule.required {
+				fieldErrors = append(fieldErrors, FieldError{rule.field, "is required"})
+			}
+			continue
+		}
+		for _, check := range rule.checks {
+			if msg := check(rule.value); msg != "" {
+				fieldErrors = append(fieldErrors, FieldError{rule.field, msg})
+				break
+			}
+		}
+	}
+	if len(fieldErrors) != 0 {
+		return &ValidationError{FieldErrors: fieldErrors}
+	}
+	return nil
+}
+
+func isEmptyValue(value interface{}) bool {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return reflect.DeepEqual(value, reflect.Zero(v.Type()).Interface())
+}
+
+func checkVolumeName(value interface{}) string {
+	if err := util.ValidateVolumeName(fmt.Sprint(value)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func checkName(value interface{}) string {
+	if !util.ValidateName(fmt.Sprint(value)) {
+		return fmt.Sprintf("invalid name %v", value)
+	}
+	return ""
+}
+
+func checkNames(value interface{}) string {
+	for _, name := range value.([]string) {
+		if msg := checkName(name); msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
+
+func checkCron(value interface{}) string {
+	if _, err := util.ParseCronSchedule(fmt.Sprint(value)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func checkTimezone(value interface{}) string {
+	if _, err := types.LoadRecurringJobLocation(fmt.Sprint(value)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func checkVolumeSize(value interface{}) string {
+	if _, err := util.ValidateVolumeSize(fmt.Sprint(value)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func checkTags(value interface{}) string {
+	if _, err := util.ValidateTags(value.([]string)); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// checkLabels rejects the labels reserved by Longhorn, besides the invalid
+// ones
+func checkLabels(value interface{}) string {
+	labels := value.(map[string]string)
+	if err := util.ValidateLabels(labels); err != nil {
+		return err.Error()
+	}
+	for _, key := range []string{types.BaseImageLabel, types.RecurringJobLabel} {
+		if _, ok := labels[key]; ok {
+			return fmt.Sprintf("label %v is reserved", key)
+		}
+	}
+	return ""
+}
+
+func checkOneOf(values ...string) fieldCheck {
+	return func(value interface{}) string {
+		s := fmt.Sprint(value)
+		for _, v := range values {
+			if s == v {
+				return ""
+			}
+		}
+		return fmt.Sprintf("invalid value %v, must be one of %v", s, strings.Join(values, ", "))
+	}
+}
+
+func checkMin(min int) fieldCheck {
+	return func(value interface{}) string {
+		if value.(int) < min {
+			return fmt.Sprintf("invalid value %v, must be at least %v", value, min)
+		}
+		return ""
+	}
+}
+
+func validateVolumeCreate(v *Volume) error {
+	return validateFields([]fieldRule{
+		{field: "name", value: v.Name, required: true, checks: []fieldCheck{checkVolumeName}},
+		// the size is from the backup if the volume is restored
+		{field: "size", value: v.Size, required: v.FromBackup == "", checks: []fieldCheck{checkVolumeSize}},
+		{field: "frontend", value: string(v.Frontend), checks: []fieldCheck{
+			checkOneOf(string(types.VolumeFrontendBlockDev), string(types.VolumeFrontendISCSI))}},
+		{field: "accessMode", value: string(v.AccessMode), checks: []fieldCheck{
+			checkOneOf(string(types.VolumeAccessModeReadWriteOnce), string(types.VolumeAccessModeReadOnlyMany))}},
+		{field: "numberOfReplicas", value: v.NumberOfReplicas, checks: []fieldCheck{checkMin(1)}},
+		{field: "staleReplicaTimeout", value: v.StaleReplicaTimeout, checks: []fieldCheck{checkMin(1)}},
+		{field: "diskSelector", value: v.DiskSelector, checks: []fieldCheck{checkTags}},
+		{field: "nodeSelector", value: v.NodeSelector, checks: []fieldCheck{checkTags}},
+		{field: "zoneSelector", value: v.ZoneSelector, checks: []fieldCheck{checkNames}},
+		{field: "backupTargetCredentialSecret", value: v.BackupTargetCredentialSecret, checks: []fieldCheck{checkName}},
+		{field: "qos.readIOPS", value: v.QoS.ReadIOPS, checks: []fieldCheck{checkMin(0)}},
+		{field: "qos.writeIOPS", value: v.QoS.WriteIOPS, checks: []fieldCheck{checkMin(0)}},
+		{field: "qos.readBandwidth", value: v.QoS.ReadBandwidth, checks: []fieldCheck{checkMin(0)}},
+		{field: "qos.writeBandwidth", value: v.QoS.WriteBandwidth, checks: []fieldCheck{checkMin(0)}},
+	})
+}
+
+func validateAttachInput(input *AttachInput) error {
+	return validateFields([]fieldRule{
+		{field: "hostId", value: input.HostID, required: true},
+	})
+}
+
+func validateSnapshotInput(input *SnapshotInput, nameRequired bool) error {
+	return validateFields([]fieldRule{
+		{field: "name", value: input.Name, required: nameRequired, checks: []fieldCheck{checkName}},
+		{field: "labels", value: input.Labels, checks: []fieldCheck{checkLabels}},
+	})
+}
+
+func validateSalvageInput(input *SalvageInput) error {
+	return validateFields([]fieldRule{
+		{field: "names", value: input.Names, required: true, checks: []fieldCheck{checkNames}},
+	})
+}
+
+func validateRecurringInput(input *RecurringInput) error {
+	rules := []fieldRule{}
+	for i, job := range input.Jobs {
+		prefix := fmt.Sprintf("jobs[%v].", i)
+		rules = append(rules,
+			fieldRule{field: prefix + "name", value: job.Name, required: true, checks: []fieldCheck{checkName}},
+			fieldRule{field: prefix + "task", value: string(job.Type), required: true, checks: []fieldCheck{
+				checkOneOf(string(types.RecurringJobTypeSnapshot), string(types.RecurringJobTypeBackup))}},
+			fieldRule{field: prefix + "cron", value: job.Cron, required: true, checks: []fieldCheck{checkCron}},
+			fieldRule{field: prefix + "timezone", value: job.Timezone, checks: []fieldCheck{checkTimezone}},
+			fieldRule{field: prefix + "retain", value: job.Retain, required: true, checks: []fieldCheck{checkMin(1)}},
+			fieldRule{field: prefix + "backupTargetCredentialSecret", value: job.BackupTargetCredentialSecret, checks: []fieldCheck{checkName}},
+			fieldRule{field: prefix + "jitter", value: job.Jitter, checks: []fieldCheck{checkMin(0)}},
+			fieldRule{field: prefix + "labels", value: job.Labels, checks: []fieldCheck{checkLabels}},
+		)
+	}
+	return validateFields(rules)
+}
+
+func validateReplicaRemoveInput(input *ReplicaRemoveInput) error {
+	return validateFields([]fieldRule{
+		{field: "name", value: input.Name, required: true},
+	})
+}
+
+func validateEngineUpgradeInput(input *EngineUpgradeInput) error {
+	return validateFields([]fieldRule{
+		{field: "image", value: input.Image, required: true},
+	})
+}
+
+func validateUpdateReplicaCountInput(input *UpdateReplicaCountInput) error {
+	return validateFields([]fieldRule{
+		{field: "replicaCount", value: input.ReplicaCount, required: true, checks: []fieldCheck{checkMin(1)}},
+	})
+}
+
+func validateUpdateQoSInput(input *UpdateQoSInput) error {
+	// the zero limits are unlimited
+	return validateFields([]fieldRule{
+		{field: "readIOPS", value: input.ReadIOPS, checks: []fieldCheck{checkMin(0)}},
+		{field: "writeIOPS", value: input.WriteIOPS, checks: []fieldCheck{checkMin(0)}},
+		{field: "readBandwidth", value: input.ReadBandwidth, checks: []fieldCheck{checkMin(0)}},
+		{field: "writeBandwidth", value: input.WriteBandwidth, checks: []fieldCheck{checkMin(0)}},
+	})
+}
+
+func validateUpdateBackupTargetCredentialSecretInput(input *UpdateBackupTargetCredentialSecretInput) error {
+	// the empty secret falls back to the global one
+	return validateFields([]fieldRule{
+		{field: "credentialSecret", value: input.CredentialSecret, checks: []fieldCheck{checkName}},
+	})
+}
+
+func validateNodeInput(input *NodeInput) error {
+	return validateFields([]fieldRule{
+		{field: "nodeId", value: input.NodeID, required: true},
+	})
+}
+
+func validatePVCreateInput(input *PVCreateInput) error {
+	return validateFields([]fieldRule{
+		{field: "pvName", value: input.PVName, checks: []fieldCheck{checkName}},
+		{field: "reclaimPolicy", value: input.ReclaimPolicy, checks: []fieldCheck{checkOneOf("Retain", "Delete")}},
+	})
+}
+
+func validatePVCCreateInput(input *PVCCreateInput) error {
+	return validateFields([]fieldRule{
+		{field: "namespace", value: input.Namespace, required: true, checks: []fieldCheck{checkName}},
+		{field: "pvcName", value: input.PVCName, checks: []fieldCheck{checkName}},
+	})
+}
+
+func validateEngineUpgradeJobInput(input *EngineUpgradeJobInput) error {
+	return validateFields([]fieldRule{
+		{field: "fromImage", value: input.FromImage, required: true},
+		{field: "toImage", value: input.ToImage, required: true},
+		{field: "concurrency", value: input.Concurrency, checks: []fieldCheck{checkMin(1)}},
+	})
+}
+
+func validateBackupTargetTestInput(input *BackupTargetTestInput) error {
+	return validateFields([]fieldRule{
+		{field: "backupTarget", value: input.BackupTarget, required: true},
+		{field: "credentialSecret", value: input.CredentialSecret, checks: []fieldCheck{checkName}},
+	})
+}
+
+func validateEngineImageCreate(img *EngineImage) error {
+	return validateFields([]fieldRule{
+		{field: "image", value: img.Image, required: true},
+	})
+}
+
+func validateNodeUpdate(n *Node) error {
+	return validateFields([]fieldRule{
+		{field: "tags", value: n.Tags, checks: []fieldCheck{checkTags}},
+	})
+}
+
+func validateDiskUpdateInput(input *DiskUpdateInput) error {
+	rules := []fieldRule{}
+	for i, disk := range input.Disks {
+		prefix := fmt.Sprintf("disks[%v].", i)
+		rules = append(rules,
+			fieldRule{field: prefix + "path", value: disk.Path, required: true},
+			fieldRule{field: prefix + "storageReserved", value: int(disk.StorageReserved), checks: []fieldCheck{checkMin(0)}},
+			fieldRule{field: prefix + "tags", value: disk.Tags, checks: []fieldCheck{checkTags}},
+		)
+	}
+	return validateFields(rules)
+}
+
+func validateOrphanDeleteInput(input *OrphanDeleteInput) error {
+	return validateFields([]fieldRule{
+		{field: "diskId", value: input.DiskID, required: true},
+		{field: "name", value: input.Name, required: true},
+	})
+}
+
+// validateSettingInput checks the value against the setting definition, and
+// rejects the unknown and the read-only settings
+func validateSettingInput(name types.SettingName, value string) error {
+	definition, ok := types.SettingDefinitions[name]
+	if !ok {
+		return &ValidationError{FieldErrors: []FieldError{{"name", fmt.Sprintf("setting %v is not supported", name)}}}
+	}
+	if definition.ReadOnly {
+		return &ValidationError{FieldErrors: []FieldError{{"name", fmt.Sprintf("setting %v is read-only", name)}}}
+	}
+	return validateFields([]fieldRule{
+		{field: "value", value: value, required: definition.Required, checks: []fieldCheck{checkSettingValue(name)}},
+	})
+}
+
+func checkSettingValue(name types.SettingName) fieldCheck {
+	return func(value interface{}) string {
+		if err := types.ValidateSettingValue(name, fmt.Sprint(value)); err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+}
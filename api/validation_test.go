@@ -0,0 +1,255 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+func TestValidateVolumeCreate(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := map[string]struct {
+		volume      Volume
+		fieldErrors []string
+	}{
+		"valid": {
+			volume: Volume{Name: "vol-1", Size: "10Gi", NumberOfReplicas: 3},
+		},
+		"valid restore without size": {
+			volume: Volume{Name: "vol-1", FromBackup: "s3://backupbucket@us-east-1/?backup=backup-1&volume=vol"},
+		},
+		"missing name and size": {
+			volume:      Volume{},
+			fieldErrors: []string{"name", "size"},
+		},
+		"invalid name": {
+			volume:      Volume{Name: "vol/1", Size: "10Gi"},
+			fieldErrors: []string{"name"},
+		},
+		"name too long": {
+			volume:      Volume{Name: strings.Repeat("a", 41), Size: "10Gi"},
+			fieldErrors: []string{"name"},
+		},
+		"invalid size": {
+			volume:      Volume{Name: "vol-1", Size: "ten"},
+			fieldErrors: []string{"size"},
+		},
+		"negative size": {
+			volume:      Volume{Name: "vol-1", Size: "-1Gi"},
+			fieldErrors: []string{"size"},
+		},
+		"invalid frontend": {
+			volume:      Volume{Name: "vol-1", Size: "10Gi", Frontend: "nvme"},
+			fieldErrors: []string{"frontend"},
+		},
+		"negative replica count and timeout": {
+			volume:      Volume{Name: "vol-1", Size: "10Gi", NumberOfReplicas: -1, StaleReplicaTimeout: -1},
+			fieldErrors: []string{"numberOfReplicas", "staleReplicaTimeout"},
+		},
+		"invalid selectors": {
+			volume:      Volume{Name: "vol-1", Size: "10Gi", DiskSelector: []string{"ssd!"}, NodeSelector: []string{"a b"}},
+			fieldErrors: []string{"diskSelector", "nodeSelector"},
+		},
+		"invalid zone selector": {
+			volume:      Volume{Name: "vol-1", Size: "10Gi", ZoneSelector: []string{"us-east-1a", "us east"}},
+			fieldErrors: []string{"zoneSelector"},
+		},
+		"invalid backup target credential secret": {
+			volume:      Volume{Name: "vol-1", Size: "10Gi", BackupTargetCredentialSecret: "tenant/secret"},
+			fieldErrors: []string{"backupTargetCredentialSecret"},
+		},
+		"negative qos": {
+			volume:      Volume{Name: "vol-1", Size: "10Gi", QoS: types.VolumeQoS{ReadIOPS: -1, ReadBandwidth: 100}},
+			fieldErrors: []string{"qos.readIOPS"},
+		},
+	}
+	for name, tc := range testCases {
+		assertFieldErrors(assert, name, validateVolumeCreate(&tc.volume), tc.fieldErrors)
+	}
+}
+
+func TestValidateInputs(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := map[string]struct {
+		err         error
+		fieldErrors []string
+	}{
+		"attach without host": {
+			err:         validateAttachInput(&AttachInput{}),
+			fieldErrors: []string{"hostId"},
+		},
+		"snapshot create without name": {
+			err: validateSnapshotInput(&SnapshotInput{}, false),
+		},
+		"snapshot delete without name": {
+			err:         validateSnapshotInput(&SnapshotInput{}, true),
+			fieldErrors: []string{"name"},
+		},
+		"snapshot with invalid name": {
+			err:         validateSnapshotInput(&SnapshotInput{Name: "snap/1"}, false),
+			fieldErrors: []string{"name"},
+		},
+		"snapshot with labels": {
+			err: validateSnapshotInput(&SnapshotInput{Labels: map[string]string{"app": "mysql", "tier": "db"}}, false),
+		},
+		"snapshot with reserved label": {
+			err:         validateSnapshotInput(&SnapshotInput{Labels: map[string]string{types.RecurringJobLabel: "hourly"}}, false),
+			fieldErrors: []string{"labels"},
+		},
+		"snapshot with invalid label value": {
+			err:         validateSnapshotInput(&SnapshotInput{Labels: map[string]string{"app": "my sql"}}, false),
+			fieldErrors: []string{"labels"},
+		},
+		"salvage without replicas": {
+			err:         validateSalvageInput(&SalvageInput{}),
+			fieldErrors: []string{"names"},
+		},
+		"recurring job with invalid task and retain": {
+			err: validateRecurringInput(&RecurringInput{Jobs: []types.RecurringJob{
+				{Name: "job-1", Type: types.RecurringJobTypeSnapshot, Cron: "* * * * *", Retain: 1},
+				{Name: "job-2", Type: "clone", Cron: "* * * * *", Retain: -1},
+			}}),
+			fieldErrors: []string{"jobs[1].task", "jobs[1].retain"},
+		},
+		"recurring job with invalid credential secret": {
+			err: validateRecurringInput(&RecurringInput{Jobs: []types.RecurringJob{
+				{Name: "job-1", Type: types.RecurringJobTypeBackup, Cron: "* * * * *", Retain: 1, BackupTargetCredentialSecret: "tenant-a-secret"},
+				{Name: "job-2", Type: types.RecurringJobTypeBackup, Cron: "* * * * *", Retain: 1, BackupTargetCredentialSecret: "tenant a"},
+			}}),
+			fieldErrors: []string{"jobs[1].backupTargetCredentialSecret"},
+		},
+		"recurring job with reserved label": {
+			err: validateRecurringInput(&RecurringInput{Jobs: []types.RecurringJob{
+				{Name: "job-1", Type: types.RecurringJobTypeBackup, Cron: "* * * * *", Retain: 1, Labels: map[string]string{"app": "mysql"}},
+				{Name: "job-2", Type: types.RecurringJobTypeBackup, Cron: "* * * * *", Retain: 1, Labels: map[string]string{types.BaseImageLabel: "image"}},
+			}}),
+			fieldErrors: []string{"jobs[1].labels"},
+		},
+		"recurring job with invalid cron and timezone": {
+			err: validateRecurringInput(&RecurringInput{Jobs: []types.RecurringJob{
+				{Name: "job-1", Type: types.RecurringJobTypeBackup, Cron: "0 2 * * mon-fri", Retain: 1, Timezone: "Europe/Berlin"},
+				{Name: "job-2", Type: types.RecurringJobTypeBackup, Cron: "0 25 * * *", Retain: 1, Timezone: "Mars/Olympus"},
+			}}),
+			fieldErrors: []string{"jobs[1].cron", "jobs[1].timezone"},
+		},
+		"backup target credential secret reset to global": {
+			err: validateUpdateBackupTargetCredentialSecretInput(&UpdateBackupTargetCredentialSecretInput{}),
+		},
+		"invalid backup target credential secret": {
+			err:         validateUpdateBackupTargetCredentialSecretInput(&UpdateBackupTargetCredentialSecretInput{CredentialSecret: "tenant/secret"}),
+			fieldErrors: []string{"credentialSecret"},
+		},
+		"replica count zero": {
+			err:         validateUpdateReplicaCountInput(&UpdateReplicaCountInput{}),
+			fieldErrors: []string{"replicaCount"},
+		},
+		"replica count negative": {
+			err:         validateUpdateReplicaCountInput(&UpdateReplicaCountInput{ReplicaCount: -2}),
+			fieldErrors: []string{"replicaCount"},
+		},
+		"qos unlimited": {
+			err: validateUpdateQoSInput(&UpdateQoSInput{}),
+		},
+		"qos negative": {
+			err:         validateUpdateQoSInput(&UpdateQoSInput{ReadIOPS: 100, WriteIOPS: -1, WriteBandwidth: -10}),
+			fieldErrors: []string{"writeIOPS", "writeBandwidth"},
+		},
+		"engine upgrade without image": {
+			err:         validateEngineUpgradeInput(&EngineUpgradeInput{}),
+			fieldErrors: []string{"image"},
+		},
+		"pv with invalid reclaim policy": {
+			err:         validatePVCreateInput(&PVCreateInput{ReclaimPolicy: "Recycle"}),
+			fieldErrors: []string{"reclaimPolicy"},
+		},
+		"pvc without namespace": {
+			err:         validatePVCCreateInput(&PVCCreateInput{}),
+			fieldErrors: []string{"namespace"},
+		},
+		"engine upgrade job": {
+			err:         validateEngineUpgradeJobInput(&EngineUpgradeJobInput{ToImage: "longhornio/longhorn-engine:v0.5.0", Concurrency: -1}),
+			fieldErrors: []string{"fromImage", "concurrency"},
+		},
+		"disk without path": {
+			err:         validateDiskUpdateInput(&DiskUpdateInput{Disks: []types.DiskSpec{{Path: "/var/lib/rancher/longhorn"}, {}}}),
+			fieldErrors: []string{"disks[1].path"},
+		},
+		"setting": {
+			err: validateSettingInput(types.SettingNameBackupstorePollInterval, "300"),
+		},
+		"unknown setting": {
+			err:         validateSettingInput("backupstore-pool-interval", "300"),
+			fieldErrors: []string{"name"},
+		},
+		"read-only setting": {
+			err:         validateSettingInput(types.SettingNameDefaultEngineImage, "longhornio/longhorn-engine:v0.5.0"),
+			fieldErrors: []string{"name"},
+		},
+		"setting in minutes instead of seconds": {
+			err:         validateSettingInput(types.SettingNameBackupstorePollInterval, "5m"),
+			fieldErrors: []string{"value"},
+		},
+		"setting out of bounds": {
+			err:         validateSettingInput(types.SettingNameStorageMinimalAvailablePercentage, "101"),
+			fieldErrors: []string{"value"},
+		},
+		"required setting empty": {
+			err:         validateSettingInput(types.SettingNameOrphanAutoDeletion, ""),
+			fieldErrors: []string{"value"},
+		},
+		"setting not in options": {
+			err:         validateSettingInput(types.SettingNameKubernetesNodeCordonPolicy, "drain"),
+			fieldErrors: []string{"value"},
+		},
+		"setting with invalid taint toleration": {
+			err:         validateSettingInput(types.SettingNameTaintToleration, "key1=value1"),
+			fieldErrors: []string{"value"},
+		},
+		"setting with invalid csi node selector": {
+			err:         validateSettingInput(types.SettingNameCSINodeSelector, "storage"),
+			fieldErrors: []string{"value"},
+		},
+		"setting with invalid csi priority class": {
+			err:         validateSettingInput(types.SettingNameCSIPriorityClass, "System_Node_Critical"),
+			fieldErrors: []string{"value"},
+		},
+		"setting with invalid csi resources": {
+			err:         validateSettingInput(types.SettingNameCSIPluginResources, "requests.memory=256Mi; limits.memory=128Mi"),
+			fieldErrors: []string{"value"},
+		},
+		"setting with invalid upgrade checker url": {
+			err:         validateSettingInput(types.SettingNameUpgradeCheckerURL, "ftp://example.com/check"),
+			fieldErrors: []string{"value"},
+		},
+		"read-only latest version": {
+			err:         validateSettingInput(types.SettingNameLatestLonghornVersion, "v9.9.9"),
+			fieldErrors: []string{"name"},
+		},
+		"optional setting reset": {
+			err: validateSettingInput(types.SettingNameBackupTarget, ""),
+		},
+	}
+	for name, tc := range testCases {
+		assertFieldErrors(assert, name, tc.err, tc.fieldErrors)
+	}
+}
+
+func assertFieldErrors(assert *require.Assertions, name string, err error, fields []string) {
+	if len(fields) == 0 {
+		assert.Nil(err, name)
+		return
+	}
+	assert.NotNil(err, name)
+	validationErr, ok := err.(*ValidationError)
+	assert.True(ok, name)
+	errFields := []string{}
+	for _, fe := range validationErr.FieldErrors {
+		errFields = append(errFields, fe.Field)
+	}
+	assert.Equal(fields, errFields, name)
+}
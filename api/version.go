@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/rancher/go-rancher/api"
+	"github.com/rancher/go-rancher/client"
+
+	"github.com/rancher/longhorn-manager/manager"
+)
+
+// APIVersion is the root of the v1 API. Besides the links to the collections
+// like the default one of go-rancher, it includes the version information.
+type APIVersion struct {
+	client.Resource
+	Version *Version `json:"version"`
+}
+
+// VersionGet doesn't depend on the datastore being synced, so it can be used
+// by the health checks early in the startup
+func (s *Server) VersionGet(rw http.ResponseWriter, req *http.Request) error {
+	apiContext := api.GetApiContext(req)
+	apiContext.Write(toVersionResource(s.m.GetVersion(), apiContext))
+	return nil
+}
+
+func (s *Server) APIVersionGet(schemas *client.Schemas) HandleFuncWithError {
+	return func(rw http.ResponseWriter, req *http.Request) error {
+		apiContext := api.GetApiContext(req)
+
+		r := &APIVersion{
+			Resource: client.Resource{
+				Id:    manager.APIVersion,
+				Type:  "apiVersion",
+				Links: map[string]string{},
+			},
+			Version: toVersionResource(s.m.GetVersion(), apiContext),
+		}
+		for _, schema := range schemas.Data {
+			for _, method := range schema.CollectionMethods {
+				if method == http.MethodGet {
+					r.Links[schema.PluralName] = apiContext.UrlBuilder.Collection(schema.Id)
+					break
+				}
+			}
+		}
+		r.Links["version"] = apiContext.UrlBuilder.Version(manager.APIVersion) + "/version"
+		apiContext.Write(r)
+		return nil
+	}
+}
@@ -2,14 +2,19 @@ package api
 
 import (
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher/api"
 	"github.com/rancher/go-rancher/client"
 
 	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/manager"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 
@@ -23,7 +28,7 @@ func (s *Server) VolumeList(rw http.ResponseWriter, req *http.Request) (err erro
 
 	apiContext := api.GetApiContext(req)
 
-	resp, err := s.volumeList(apiContext)
+	resp, err := s.volumeListWithQuery(apiContext, req.URL.Query())
 	if err != nil {
 		return err
 	}
@@ -33,14 +38,79 @@ func (s *Server) VolumeList(rw http.ResponseWriter, req *http.Request) (err erro
 	return nil
 }
 
+// volumeListParams are the query parameters selecting a page of the volumes.
+// All the volumes are listed if none is supplied.
+var volumeListParams = []string{"limit", "marker", "sort", "order", "state", "node", "name"}
+
+func parseVolumeListOptions(query url.Values) (*manager.VolumeListOptions, error) {
+	paginated := false
+	for _, param := range volumeListParams {
+		if _, ok := query[param]; ok {
+			paginated = true
+			break
+		}
+	}
+	if !paginated {
+		return nil, nil
+	}
+
+	opts := &manager.VolumeListOptions{
+		Marker:       query.Get("marker"),
+		SortBy:       query.Get("sort"),
+		State:        query.Get("state"),
+		NodeID:       query.Get("node"),
+		NameContains: query.Get("name"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 0 {
+			return nil, &manager.Error{
+				Reason:  manager.ErrorReasonInvalidInput,
+				Message: fmt.Sprintf("invalid limit %v", limit),
+			}
+		}
+		opts.Limit = l
+	}
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return nil, &manager.Error{
+			Reason:  manager.ErrorReasonInvalidInput,
+			Message: fmt.Sprintf("invalid order %v, should be asc or desc", order),
+		}
+	}
+	return opts, nil
+}
+
 func (s *Server) volumeList(apiContext *api.ApiContext) (*client.GenericCollection, error) {
+	return s.volumeListWithQuery(apiContext, nil)
+}
+
+func (s *Server) volumeListWithQuery(apiContext *api.ApiContext, query url.Values) (*client.GenericCollection, error) {
 	resp := &client.GenericCollection{}
 
-	volumes, err := s.m.ListSorted()
+	opts, err := parseVolumeListOptions(query)
 	if err != nil {
 		return nil, err
 	}
+	var volumes []*longhorn.Volume
+	if opts == nil {
+		if volumes, err = s.m.ListSorted(); err != nil {
+			return nil, err
+		}
+	} else {
+		page, err := s.m.ListPage(*opts)
+		if err != nil {
+			return nil, err
+		}
+		volumes = page.Volumes
+		resp.Pagination = toVolumePagination(apiContext, query, opts, page)
+		resp.Sort = toVolumeSort(opts)
+	}
 
+	backupTickets := s.getBackupTickets()
 	for _, v := range volumes {
 		controllers, err := s.m.GetEnginesSorted(v.Name)
 		if err != nil {
@@ -51,7 +121,9 @@ func (s *Server) volumeList(apiContext *api.ApiContext) (*client.GenericCollecti
 			return nil, err
 		}
 
-		resp.Data = append(resp.Data, toVolumeResource(v, controllers, replicas, apiContext))
+		r := toVolumeResource(v, controllers, replicas, apiContext)
+		r.BackupStatus = backupTickets[v.Name]
+		resp.Data = append(resp.Data, r)
 	}
 	resp.ResourceType = "volume"
 	resp.CreateTypes = map[string]string{
@@ -94,10 +166,23 @@ func (s *Server) responseWithVolume(rw http.ResponseWriter, req *http.Request, i
 		return err
 	}
 
-	apiContext.Write(toVolumeResource(v, controllers, replicas, apiContext))
+	r := toVolumeResource(v, controllers, replicas, apiContext)
+	r.BackupStatus = s.getBackupTickets()[v.Name]
+	apiContext.Write(r)
 	return nil
 }
 
+// getBackupTickets returns the backups waiting or in progress by volume. The
+// volumes are still returned without them if failed.
+func (s *Server) getBackupTickets() map[string][]types.BackupTicket {
+	tickets, err := s.m.ListBackupTickets()
+	if err != nil {
+		logrus.Warnf("Fail to list the backup tickets: %v", err)
+		return map[string][]types.BackupTicket{}
+	}
+	return tickets
+}
+
 func (s *Server) VolumeCreate(rw http.ResponseWriter, req *http.Request) error {
 	var volume Volume
 	apiContext := api.GetApiContext(req)
@@ -105,6 +190,9 @@ func (s *Server) VolumeCreate(rw http.ResponseWriter, req *http.Request) error {
 	if err := apiContext.Read(&volume); err != nil {
 		return err
 	}
+	if err := validateVolumeCreate(&volume); err != nil {
+		return err
+	}
 
 	if volume.Frontend == "" {
 		volume.Frontend = types.VolumeFrontendBlockDev
@@ -120,6 +208,13 @@ func (s *Server) VolumeCreate(rw http.ResponseWriter, req *http.Request) error {
 		NumberOfReplicas:    volume.NumberOfReplicas,
 		StaleReplicaTimeout: volume.StaleReplicaTimeout,
 		BaseImage:           volume.BaseImage,
+		DiskSelector:        volume.DiskSelector,
+		NodeSelector:        volume.NodeSelector,
+		ZoneSelector:        volume.ZoneSelector,
+		AccessMode:          volume.AccessMode,
+		QoS:                 volume.QoS,
+
+		BackupTargetCredentialSecret: volume.BackupTargetCredentialSecret,
 	})
 	if err != nil {
 		return errors.Wrap(err, "unable to create volume")
@@ -130,13 +225,35 @@ func (s *Server) VolumeCreate(rw http.ResponseWriter, req *http.Request) error {
 func (s *Server) VolumeDelete(rw http.ResponseWriter, req *http.Request) error {
 	id := mux.Vars(req)["name"]
 
-	if err := s.m.Delete(id); err != nil {
+	// force cleans up the volume right away, rather than moving it to the
+	// trash for the volume deletion grace period
+	force := req.URL.Query().Get("force") == "true"
+	if _, err := util.RetryOnConflictCause(func() (interface{}, error) {
+		return nil, s.m.Delete(id, force)
+	}); err != nil {
 		return errors.Wrap(err, "unable to delete volume")
 	}
 
 	return nil
 }
 
+func (s *Server) VolumeRestoreTrashed(rw http.ResponseWriter, req *http.Request) error {
+	id := mux.Vars(req)["name"]
+
+	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
+		return s.m.RestoreTrashed(id)
+	})
+	if err != nil {
+		return err
+	}
+	v, ok := obj.(*longhorn.Volume)
+	if !ok {
+		return fmt.Errorf("BUG: cannot convert to volume %v object", id)
+	}
+
+	return s.responseWithVolume(rw, req, "", v)
+}
+
 func (s *Server) VolumeAttach(rw http.ResponseWriter, req *http.Request) error {
 	var input AttachInput
 
@@ -144,20 +261,14 @@ func (s *Server) VolumeAttach(rw http.ResponseWriter, req *http.Request) error {
 	if err := apiContext.Read(&input); err != nil {
 		return err
 	}
-
-	id := mux.Vars(req)["name"]
-	// check attach node state
-	node, err := s.m.GetNode(input.HostID)
-	if err != nil {
+	if err := validateAttachInput(&input); err != nil {
 		return err
 	}
-	readyCondition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
-	if readyCondition.Status != types.ConditionStatusTrue {
-		return fmt.Errorf("Node %v is not ready, couldn't attach volume %v to it", node.Name, id)
-	}
+
+	id := mux.Vars(req)["name"]
 
 	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
-		return s.m.Attach(id, input.HostID)
+		return s.m.Attach(id, input.HostID, input.DisableFrontend, input.ReadOnly)
 	})
 	if err != nil {
 		return err
@@ -171,10 +282,18 @@ func (s *Server) VolumeAttach(rw http.ResponseWriter, req *http.Request) error {
 }
 
 func (s *Server) VolumeDetach(rw http.ResponseWriter, req *http.Request) error {
+	var input DetachInput
+
+	apiContext := api.GetApiContext(req)
+	// the input is optional
+	if err := apiContext.Read(&input); err != nil && err != io.EOF {
+		return err
+	}
+
 	id := mux.Vars(req)["name"]
 
 	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
-		return s.m.Detach(id)
+		return s.m.Detach(id, input.HostID, input.Force)
 	})
 	if err != nil {
 		return err
@@ -194,6 +313,9 @@ func (s *Server) VolumeSalvage(rw http.ResponseWriter, req *http.Request) error
 	if err := apiContext.Read(&input); err != nil {
 		return errors.Wrapf(err, "error read salvageInput")
 	}
+	if err := validateSalvageInput(&input); err != nil {
+		return err
+	}
 
 	id := mux.Vars(req)["name"]
 
@@ -219,6 +341,9 @@ func (s *Server) VolumeRecurringUpdate(rw http.ResponseWriter, req *http.Request
 	if err := apiContext.Read(&input); err != nil {
 		return errors.Wrapf(err, "error reading recurringInput")
 	}
+	if err := validateRecurringInput(&input); err != nil {
+		return err
+	}
 
 	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
 		return s.m.UpdateRecurringJobs(id, input.Jobs)
@@ -234,6 +359,89 @@ func (s *Server) VolumeRecurringUpdate(rw http.ResponseWriter, req *http.Request
 	return s.responseWithVolume(rw, req, "", v)
 }
 
+func (s *Server) UpdateReplicaCount(rw http.ResponseWriter, req *http.Request) error {
+	var input UpdateReplicaCountInput
+	id := mux.Vars(req)["name"]
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error reading updateReplicaCountInput")
+	}
+	if err := validateUpdateReplicaCountInput(&input); err != nil {
+		return err
+	}
+
+	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
+		return s.m.UpdateReplicaCount(id, input.ReplicaCount)
+	})
+	if err != nil {
+		return err
+	}
+	v, ok := obj.(*longhorn.Volume)
+	if !ok {
+		return fmt.Errorf("BUG: cannot convert to volume %v object", id)
+	}
+
+	return s.responseWithVolume(rw, req, "", v)
+}
+
+func (s *Server) UpdateQoS(rw http.ResponseWriter, req *http.Request) error {
+	var input UpdateQoSInput
+	id := mux.Vars(req)["name"]
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error reading updateQoSInput")
+	}
+	if err := validateUpdateQoSInput(&input); err != nil {
+		return err
+	}
+
+	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
+		return s.m.UpdateQoS(id, types.VolumeQoS{
+			ReadIOPS:       input.ReadIOPS,
+			WriteIOPS:      input.WriteIOPS,
+			ReadBandwidth:  input.ReadBandwidth,
+			WriteBandwidth: input.WriteBandwidth,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	v, ok := obj.(*longhorn.Volume)
+	if !ok {
+		return fmt.Errorf("BUG: cannot convert to volume %v object", id)
+	}
+
+	return s.responseWithVolume(rw, req, "", v)
+}
+
+func (s *Server) UpdateBackupTargetCredentialSecret(rw http.ResponseWriter, req *http.Request) error {
+	var input UpdateBackupTargetCredentialSecretInput
+	id := mux.Vars(req)["name"]
+
+	apiContext := api.GetApiContext(req)
+	if err := apiContext.Read(&input); err != nil {
+		return errors.Wrapf(err, "error reading updateBackupTargetCredentialSecretInput")
+	}
+	if err := validateUpdateBackupTargetCredentialSecretInput(&input); err != nil {
+		return err
+	}
+
+	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
+		return s.m.UpdateBackupTargetCredentialSecret(id, input.CredentialSecret)
+	})
+	if err != nil {
+		return err
+	}
+	v, ok := obj.(*longhorn.Volume)
+	if !ok {
+		return fmt.Errorf("BUG: cannot convert to volume %v object", id)
+	}
+
+	return s.responseWithVolume(rw, req, "", v)
+}
+
 func (s *Server) ReplicaRemove(rw http.ResponseWriter, req *http.Request) error {
 	var input ReplicaRemoveInput
 
@@ -241,6 +449,9 @@ func (s *Server) ReplicaRemove(rw http.ResponseWriter, req *http.Request) error
 	if err := apiContext.Read(&input); err != nil {
 		return errors.Wrapf(err, "error read replicaRemoveInput")
 	}
+	if err := validateReplicaRemoveInput(&input); err != nil {
+		return err
+	}
 
 	id := mux.Vars(req)["name"]
 
@@ -258,6 +469,9 @@ func (s *Server) EngineUpgrade(rw http.ResponseWriter, req *http.Request) error
 	if err := apiContext.Read(&input); err != nil {
 		return errors.Wrapf(err, "error read engineUpgradeInput")
 	}
+	if err := validateEngineUpgradeInput(&input); err != nil {
+		return err
+	}
 
 	id := mux.Vars(req)["name"]
 
@@ -283,6 +497,9 @@ func (s *Server) MigrationStart(rw http.ResponseWriter, req *http.Request) error
 	if err := apiContext.Read(&input); err != nil {
 		return errors.Wrapf(err, "error read nodeInput")
 	}
+	if err := validateNodeInput(&input); err != nil {
+		return err
+	}
 
 	obj, err := util.RetryOnConflictCause(func() (interface{}, error) {
 		return s.m.MigrationStart(id, input.NodeID)
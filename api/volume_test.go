@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/manager"
+)
+
+func TestParseVolumeListOptions(t *testing.T) {
+	assert := require.New(t)
+
+	opts, err := parseVolumeListOptions(url.Values{})
+	assert.Nil(err)
+	assert.Nil(opts)
+
+	query, err := url.ParseQuery("limit=10&sort=size&order=desc&state=attached&node=node-1&name=db")
+	assert.Nil(err)
+	opts, err = parseVolumeListOptions(query)
+	assert.Nil(err)
+	assert.Equal(&manager.VolumeListOptions{
+		Limit:        10,
+		SortBy:       manager.VolumeSortBySize,
+		Descending:   true,
+		State:        "attached",
+		NodeID:       "node-1",
+		NameContains: "db",
+	}, opts)
+
+	// the invalid parameters are reported as bad requests
+	for _, invalid := range []string{
+		"limit=ten",
+		"limit=-1",
+		"order=random",
+	} {
+		query, err := url.ParseQuery(invalid)
+		assert.Nil(err)
+		_, err = parseVolumeListOptions(query)
+		managerErr, ok := errors.Cause(err).(*manager.Error)
+		assert.True(ok, invalid)
+		assert.Equal(manager.ErrorReasonInvalidInput, managerErr.Reason, invalid)
+	}
+}
@@ -18,7 +18,7 @@ func CSICommand() cli.Command {
 			},
 			cli.StringFlag{
 				Name:  "drivername",
-				Value: "io.rancher.longhorn",
+				Value: csi.DefaultCSIDriverName,
 				Usage: "Name of the CSI driver",
 			},
 			cli.StringFlag{
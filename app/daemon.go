@@ -1,21 +1,29 @@
 package app
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
 	"github.com/rancher/go-iscsi-helper/iscsi"
 	iscsi_util "github.com/rancher/go-iscsi-helper/util"
 	"github.com/urfave/cli"
 
+	"k8s.io/apimachinery/pkg/util/wait"
+
 	"github.com/rancher/longhorn-manager/api"
 	"github.com/rancher/longhorn-manager/controller"
 	"github.com/rancher/longhorn-manager/datastore"
 	"github.com/rancher/longhorn-manager/manager"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
+	"github.com/rancher/longhorn-manager/webhook"
 )
 
 const (
@@ -23,6 +31,24 @@ const (
 	FlagManagerImage   = "manager-image"
 	FlagServiceAccount = "service-account"
 	FlagKubeConfig     = "kube-config"
+
+	FlagResyncPeriod   = "resync-period"
+	FlagQueueBaseDelay = "queue-base-delay"
+	FlagQueueMaxDelay  = "queue-max-delay"
+	FlagQueueQPS       = "queue-qps"
+	FlagQueueBurst     = "queue-burst"
+
+	FlagShutdownTimeout = "shutdown-timeout"
+
+	FlagDebugEndpoints = "debug-endpoints"
+	FlagDebugAddress   = "debug-address"
+
+	defaultEngineImageRetryInterval = time.Minute
+	leaderReleaseTimeout            = 5 * time.Second
+	// within the default termination grace period of the pod
+	defaultShutdownTimeout = 25 * time.Second
+	// reachable by port forwarding only
+	defaultDebugAddress = "localhost:6060"
 )
 
 func DaemonCmd() cli.Command {
@@ -45,6 +71,51 @@ func DaemonCmd() cli.Command {
 				Name:  FlagKubeConfig,
 				Usage: "Specify path to kube config (optional)",
 			},
+			cli.DurationFlag{
+				Name: FlagResyncPeriod,
+				Usage: "Specify how often all objects are resynced by the controllers. " +
+					"Every resync costs CPU in proportion to the number of the volumes, engines and replicas, " +
+					"while a longer period delays the recovery from the missed events",
+				Value: controller.DefaultResyncPeriod,
+			},
+			cli.DurationFlag{
+				Name:  FlagQueueBaseDelay,
+				Usage: "Specify the initial delay of retrying the failed sync of an object, doubled on each failure",
+				Value: controller.DefaultQueueBaseDelay,
+			},
+			cli.DurationFlag{
+				Name: FlagQueueMaxDelay,
+				Usage: "Specify the maximum delay of retrying the failed sync of an object. " +
+					"A lower value recovers the objects sooner after an incident, " +
+					"at the cost of more CPU and API server load while the syncs keep failing",
+				Value: controller.DefaultQueueMaxDelay,
+			},
+			cli.Float64Flag{
+				Name: FlagQueueQPS,
+				Usage: "Specify the overall rate of the retries per second of each controller. " +
+					"A higher value retries more objects at once during an incident, with more API server load",
+				Value: controller.DefaultQueueQPS,
+			},
+			cli.IntFlag{
+				Name:  FlagQueueBurst,
+				Usage: "Specify the burst of the retries of each controller above the rate",
+				Value: controller.DefaultQueueBurst,
+			},
+			cli.DurationFlag{
+				Name: FlagShutdownTimeout,
+				Usage: "Specify how long to wait on SIGTERM for the API requests and the syncs in flight to complete before exiting. " +
+					"It should be shorter than the termination grace period of the pod",
+				Value: defaultShutdownTimeout,
+			},
+			cli.BoolFlag{
+				Name:  FlagDebugEndpoints,
+				Usage: "Serve the profiles, the goroutine dump and the internals of the manager on the debug address. It overrides the setting debug-endpoints",
+			},
+			cli.StringFlag{
+				Name:  FlagDebugAddress,
+				Usage: "Specify the address of the debug endpoints",
+				Value: defaultDebugAddress,
+			},
 		},
 		Action: func(c *cli.Context) {
 			if err := startManager(c); err != nil {
@@ -72,11 +143,22 @@ func startManager(c *cli.Context) error {
 		return fmt.Errorf("require %v", FlagServiceAccount)
 	}
 	kubeconfigPath := c.String(FlagKubeConfig)
+	controllerConfig := controller.ControllerConfig{
+		ResyncPeriod:   c.Duration(FlagResyncPeriod),
+		QueueBaseDelay: c.Duration(FlagQueueBaseDelay),
+		QueueMaxDelay:  c.Duration(FlagQueueMaxDelay),
+		QueueQPS:       c.Float64(FlagQueueQPS),
+		QueueBurst:     c.Int(FlagQueueBurst),
+	}
+	if err := controllerConfig.Validate(); err != nil {
+		return err
+	}
 
+	// the details are reported by the RequiredPackages condition of the
+	// node, no volume would be placed on the node until it's fixed
 	if err := environmentCheck(); err != nil {
-		logrus.Errorf("Failed environment check, please make sure you " +
-			"have iscsiadm/open-iscsi installed on the host")
-		return fmt.Errorf("Environment check failed: %v", err)
+		logrus.Warnf("Failed environment check, please make sure you "+
+			"have iscsiadm/open-iscsi installed on the host: %v", err)
 	}
 
 	currentNodeID, err := util.GetRequiredEnv(types.EnvNodeName)
@@ -89,16 +171,43 @@ func startManager(c *cli.Context) error {
 		return fmt.Errorf("BUG: fail to detect the node IP")
 	}
 
+	shutdownTimeout := c.Duration(FlagShutdownTimeout)
+
 	done := make(chan struct{})
+	var controllersWG sync.WaitGroup
 
-	ds, wsc, err := controller.StartControllers(done, currentNodeID, serviceAccount, managerImage, kubeconfigPath)
+	ds, wsc, health, leader, err := controller.StartControllers(done, &controllersWG, currentNodeID, serviceAccount, managerImage, kubeconfigPath, controllerConfig)
 	if err != nil {
 		return err
 	}
 
-	m := manager.NewVolumeManager(currentNodeID, ds)
+	m := manager.NewVolumeManager(currentNodeID, ds, done)
 
-	if err := updateSettingDefaultEngineImage(m, engineImage); err != nil {
+	if err := ds.InitSettings(); err != nil {
+		return err
+	}
+
+	// the debug flag overrides the setting
+	if !c.GlobalBool("debug") {
+		applySettingLogLevel(ds)
+		ds.OnSettingChange(func(types.SettingName) {
+			applySettingLogLevel(ds)
+		}, types.SettingNameLogLevel)
+	}
+
+	debug := newDebugServer(c.String(FlagDebugAddress), health, ds)
+	defer debug.stop()
+	// the flag overrides the setting
+	if c.Bool(FlagDebugEndpoints) {
+		debug.setEnabled(true)
+	} else {
+		applySettingDebugEndpoints(ds, debug)
+		ds.OnSettingChange(func(types.SettingName) {
+			applySettingDebugEndpoints(ds, debug)
+		}, types.SettingNameDebugEndpoints)
+	}
+
+	if err := updateSettingDefaultEngineImage(m, engineImage, done); err != nil {
 		return err
 	}
 
@@ -110,16 +219,63 @@ func startManager(c *cli.Context) error {
 		return err
 	}
 
-	server := api.NewServer(m, wsc)
+	m.StartBackupStoreCacheRefresh(done)
+
+	server := api.NewServer(m, wsc, health)
 	router := http.Handler(api.NewRouter(server))
 
 	listen := types.GetAPIServerAddressFromIP(currentIP)
 	logrus.Infof("Listening on %s", listen)
 
-	go http.ListenAndServe(listen, router)
+	httpServer := &http.Server{Addr: listen, Handler: router}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Error serving the API: %v", err)
+		}
+	}()
+
+	// the webhook is served before the certificate is ready, and rejects
+	// the handshakes until then, which the API server treats by the
+	// failure policy
+	webhookServer := webhook.NewServer(ds, os.Getenv(types.EnvPodNamespace), serviceAccount)
+	go webhookServer.Run(done)
+	webhookListen := types.GetWebhookServerAddressFromIP(currentIP)
+	logrus.Infof("Serving admission webhook on %s", webhookListen)
+	webhookHTTPServer := &http.Server{
+		Addr:      webhookListen,
+		Handler:   webhookServer,
+		TLSConfig: &tls.Config{GetCertificate: webhookServer.GetCertificate},
+	}
+	go func() {
+		if err := webhookHTTPServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Error serving the admission webhook: %v", err)
+		}
+	}()
 
 	util.RegisterShutdownChannel(done)
 	<-done
+
+	// stop taking the new requests and wait for the ones in flight, while
+	// the controllers finish the syncs in flight
+	deadline := time.Now().Add(shutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logrus.Warnf("Fail to wait for the API requests to complete: %v", err)
+	}
+	if err := webhookHTTPServer.Shutdown(ctx); err != nil {
+		logrus.Warnf("Fail to wait for the admission webhook requests to complete: %v", err)
+	}
+	if !util.WaitGroupWithTimeout(&controllersWG, time.Until(deadline)) {
+		logrus.Warnf("Timeout waiting for the controllers to stop")
+	}
+	// give the leader the chance to release the lease, so another manager
+	// takes over without waiting for the lease to expire
+	select {
+	case <-leader.Stopped():
+	case <-time.After(leaderReleaseTimeout):
+		logrus.Warnf("Timeout waiting for the leader election to stop")
+	}
 	return nil
 }
 
@@ -135,23 +291,65 @@ func environmentCheck() error {
 	return nil
 }
 
-func updateSettingDefaultEngineImage(m *manager.VolumeManager, engineImage string) error {
-	settingDefaultEngineImage, err := m.GetSetting(types.SettingNameDefaultEngineImage)
+func applySettingLogLevel(ds *datastore.DataStore) {
+	value, err := ds.GetSettingValue(types.SettingNameLogLevel)
+	if err != nil {
+		logrus.Warnf("Failed to get setting %v: %v", types.SettingNameLogLevel, err)
+		return
+	}
+	level, err := logrus.ParseLevel(value)
 	if err != nil {
+		logrus.Warnf("Invalid setting %v %v: %v", types.SettingNameLogLevel, value, err)
+		return
+	}
+	if level != logrus.GetLevel() {
+		logrus.Infof("Log level is set to %v", level)
+		logrus.SetLevel(level)
+	}
+}
+
+// updateSettingDefaultEngineImage sets the default engine image to the one
+// of the manager. If the engine upgrades in progress block the change, it's
+// retried in the background until they're done.
+func updateSettingDefaultEngineImage(m *manager.VolumeManager, engineImage string, stopCh chan struct{}) error {
+	updated, err := trySettingDefaultEngineImage(m, engineImage)
+	if err != nil || updated {
 		return err
 	}
-	if settingDefaultEngineImage.Value != engineImage {
-		settingDefaultEngineImage.Value = engineImage
-		if _, err := m.CreateOrUpdateSetting(settingDefaultEngineImage); err != nil {
-			return err
+	logrus.Warnf("Postpone setting the default engine image to %v until the engine upgrades in progress are done", engineImage)
+	go wait.PollUntil(defaultEngineImageRetryInterval, func() (bool, error) {
+		updated, err := trySettingDefaultEngineImage(m, engineImage)
+		if err != nil {
+			logrus.Warnf("Fail to set the default engine image to %v: %v", engineImage, err)
+			return false, nil
 		}
-	}
+		return updated, nil
+	}, stopCh)
 	return nil
 }
 
+func trySettingDefaultEngineImage(m *manager.VolumeManager, engineImage string) (bool, error) {
+	settingDefaultEngineImage, err := m.GetSetting(types.SettingNameDefaultEngineImage)
+	if err != nil {
+		return false, err
+	}
+	if settingDefaultEngineImage.Value == engineImage {
+		return true, nil
+	}
+	settingDefaultEngineImage.Value = engineImage
+	if _, err := m.CreateOrUpdateSetting(settingDefaultEngineImage, "longhorn-manager", false); err != nil {
+		if merr, ok := errors.Cause(err).(*manager.Error); ok && merr.Reason == manager.ErrorReasonInvalidState {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 func initDaemonNode(ds *datastore.DataStore) error {
 	nodeName := os.Getenv("NODE_NAME")
-	if _, err := ds.GetNode(nodeName); err != nil {
+	node, err := ds.GetNode(nodeName)
+	if err != nil {
 		// init default disk on node when starting longhorn-manager
 		if datastore.ErrorIsNotFound(err) {
 			if _, err = ds.CreateDefaultNode(nodeName); err != nil {
@@ -160,5 +358,10 @@ func initDaemonNode(ds *datastore.DataStore) error {
 		}
 		return err
 	}
+	// the node was removed from the cluster before, don't pick up the
+	// stale disks of it. Restart after the deletion completes
+	if node.DeletionTimestamp != nil {
+		return fmt.Errorf("node %v is being deleted, wait for the deletion to complete before adding it back", nodeName)
+	}
 	return nil
 }
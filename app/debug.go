@@ -0,0 +1,108 @@
+package app
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+// debugServer serves the profiles and the internals of the manager on a
+// separate address. It's started and stopped at runtime, so it's only
+// exposed while troubleshooting.
+type debugServer struct {
+	address string
+	handler http.Handler
+
+	lock   sync.Mutex
+	server *http.Server
+}
+
+func newDebugServer(address string, health *controller.Health, ds *datastore.DataStore) *debugServer {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	// the lastProcessed of the controller is when it last finished a sync
+	expvar.Publish("controllers", expvar.Func(func() interface{} {
+		return health.CheckControllers()
+	}))
+	expvar.Publish("informerCacheSizes", expvar.Func(func() interface{} {
+		return ds.GetCacheSizes()
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", dumpGoroutines)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	return &debugServer{
+		address: address,
+		handler: mux,
+	}
+}
+
+// dumpGoroutines writes the stacks of all the goroutines, in the format of
+// the unrecovered panic
+func dumpGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := runtimepprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		logrus.Warnf("Fail to dump the goroutines: %v", err)
+	}
+}
+
+func (d *debugServer) setEnabled(enabled bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if enabled == (d.server != nil) {
+		return
+	}
+	if !enabled {
+		if err := d.server.Close(); err != nil {
+			logrus.Warnf("Fail to stop the debug endpoints: %v", err)
+		}
+		d.server = nil
+		logrus.Infof("Debug endpoints are stopped")
+		return
+	}
+
+	listener, err := net.Listen("tcp", d.address)
+	if err != nil {
+		logrus.Errorf("Fail to serve the debug endpoints on %v: %v", d.address, err)
+		return
+	}
+	server := &http.Server{Handler: d.handler}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Error serving the debug endpoints: %v", err)
+		}
+	}()
+	d.server = server
+	logrus.Infof("Debug endpoints are served on %v", d.address)
+}
+
+func (d *debugServer) stop() {
+	d.setEnabled(false)
+}
+
+func applySettingDebugEndpoints(ds *datastore.DataStore, d *debugServer) {
+	enabled, err := ds.GetSettingAsBool(types.SettingNameDebugEndpoints)
+	if err != nil {
+		logrus.Warnf("Failed to get setting %v: %v", types.SettingNameDebugEndpoints, err)
+		return
+	}
+	d.setEnabled(enabled)
+}
@@ -3,7 +3,8 @@ package app
 import (
 	"fmt"
 	"os"
-	"sync"
+	"reflect"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
@@ -42,10 +43,16 @@ const (
 	FlagCSIProvisionerImage     = "csi-provisioner-image"
 	FlagCSIDriverRegistrarImage = "csi-driver-registrar-image"
 	FlagCSIProvisionerName      = "csi-provisioner-name"
+	FlagCSISnapshotterImage     = "csi-snapshotter-image"
 	EnvCSIAttacherImage         = "CSI_ATTACHER_IMAGE"
 	EnvCSIProvisionerImage      = "CSI_PROVISIONER_IMAGE"
 	EnvCSIDriverRegistrarImage  = "CSI_DRIVER_REGISTRAR_IMAGE"
 	EnvCSIProvisionerName       = "CSI_PROVISIONER_NAME"
+	EnvCSISnapshotterImage      = "CSI_SNAPSHOTTER_IMAGE"
+
+	csiCleanupRetryCount    = 3
+	csiCleanupRetryInterval = 5 * time.Second
+	csiSettingPollInterval  = 30 * time.Second
 )
 
 func DeployDriverCmd() cli.Command {
@@ -71,19 +78,19 @@ func DeployDriverCmd() cli.Command {
 			},
 			cli.StringFlag{
 				Name:   FlagCSIAttacherImage,
-				Usage:  "Specify CSI attacher image",
+				Usage:  "Specify CSI attacher image, overridden by the setting csi-attacher-image if set",
 				EnvVar: EnvCSIAttacherImage,
 				Value:  csi.DefaultCSIAttacherImage,
 			},
 			cli.StringFlag{
 				Name:   FlagCSIProvisionerImage,
-				Usage:  "Specify CSI provisioner image",
+				Usage:  "Specify CSI provisioner image, overridden by the setting csi-provisioner-image if set",
 				EnvVar: EnvCSIProvisionerImage,
 				Value:  csi.DefaultCSIProvisionerImage,
 			},
 			cli.StringFlag{
 				Name:   FlagCSIDriverRegistrarImage,
-				Usage:  "Specify CSI driver-registrar image",
+				Usage:  "Specify CSI driver-registrar image, overridden by the setting csi-driver-registrar-image if set",
 				EnvVar: EnvCSIDriverRegistrarImage,
 				Value:  csi.DefaultCSIDriverRegistrarImage,
 			},
@@ -93,6 +100,12 @@ func DeployDriverCmd() cli.Command {
 				EnvVar: EnvCSIProvisionerName,
 				Value:  csi.DefaultCSIProvisionerName,
 			},
+			cli.StringFlag{
+				Name:   FlagCSISnapshotterImage,
+				Usage:  "Specify CSI snapshotter image, overridden by the setting csi-snapshotter-image if set",
+				EnvVar: EnvCSISnapshotterImage,
+				Value:  csi.DefaultCSISnapshotterImage,
+			},
 		},
 		Action: func(c *cli.Context) {
 			if err := deployDriver(c); err != nil {
@@ -188,10 +201,117 @@ func isKubernetesVersionAtLeast(kubeClient *clientset.Clientset, vers string) (b
 	return currentVersion.AtLeast(minVersion), nil
 }
 
+// csiSettings are what the CSI components are deployed with. The image
+// settings override the flags of the deployer.
+type csiSettings struct {
+	attacherImage        string
+	provisionerImage     string
+	driverRegistrarImage string
+	snapshotterImage     string
+	podOptions           csi.PodOptions
+
+	attacherResources        v1.ResourceRequirements
+	provisionerResources     v1.ResourceRequirements
+	driverRegistrarResources v1.ResourceRequirements
+	snapshotterResources     v1.ResourceRequirements
+	pluginResources          v1.ResourceRequirements
+}
+
+func getCSISettings(apiClient *longhornclient.RancherClient, flagSettings csiSettings) (csiSettings, error) {
+	settings, err := apiClient.Setting.List(&longhornclient.ListOpts{})
+	if err != nil {
+		return flagSettings, errors.Wrap(err, "unable to list settings")
+	}
+	s := flagSettings
+	resources := map[types.SettingName]*v1.ResourceRequirements{
+		types.SettingNameCSIAttacherResources:        &s.attacherResources,
+		types.SettingNameCSIProvisionerResources:     &s.provisionerResources,
+		types.SettingNameCSIDriverRegistrarResources: &s.driverRegistrarResources,
+		types.SettingNameCSISnapshotterResources:     &s.snapshotterResources,
+		types.SettingNameCSIPluginResources:          &s.pluginResources,
+	}
+	for _, setting := range settings.Data {
+		if setting.Value == "" {
+			continue
+		}
+		if r, ok := resources[types.SettingName(setting.Name)]; ok {
+			requirements, err := util.UnmarshalResourceRequirements(setting.Value)
+			if err != nil {
+				return flagSettings, errors.Wrapf(err, "invalid setting %v", setting.Name)
+			}
+			*r = requirements
+			continue
+		}
+		switch types.SettingName(setting.Name) {
+		case types.SettingNameCSIAttacherImage:
+			s.attacherImage = setting.Value
+		case types.SettingNameCSIProvisionerImage:
+			s.provisionerImage = setting.Value
+		case types.SettingNameCSIDriverRegistrarImage:
+			s.driverRegistrarImage = setting.Value
+		case types.SettingNameCSISnapshotterImage:
+			s.snapshotterImage = setting.Value
+		case types.SettingNameTaintToleration:
+			tolerations, err := util.UnmarshalTolerations(setting.Value)
+			if err != nil {
+				return flagSettings, errors.Wrapf(err, "invalid setting %v", setting.Name)
+			}
+			if len(tolerations) != 0 {
+				s.podOptions.Tolerations = tolerations
+			}
+		case types.SettingNameCSINodeSelector:
+			nodeSelector, err := util.UnmarshalNodeSelector(setting.Value)
+			if err != nil {
+				return flagSettings, errors.Wrapf(err, "invalid setting %v", setting.Name)
+			}
+			if len(nodeSelector) != 0 {
+				s.podOptions.NodeSelector = nodeSelector
+			}
+		case types.SettingNameCSIPriorityClass:
+			s.podOptions.PriorityClassName = setting.Value
+		}
+	}
+	return s, nil
+}
+
+type csiDeployment interface {
+	Deploy(kubeClient *clientset.Clientset) error
+	Cleanup(kubeClient *clientset.Clientset) error
+}
+
+// csiComponent is redeployed once the settings it's built with change
+type csiComponent struct {
+	name      string
+	image     func(s csiSettings) string
+	resources func(s csiSettings) []v1.ResourceRequirements
+	build     func(s csiSettings) csiDeployment
+
+	deployment csiDeployment
+	deployed   csiSettings
+}
+
+func (c *csiComponent) isOutdated(s csiSettings) bool {
+	return c.image(s) != c.image(c.deployed) ||
+		!reflect.DeepEqual(c.resources(s), c.resources(c.deployed)) ||
+		!reflect.DeepEqual(s.podOptions, c.deployed.podOptions)
+}
+
+func (c *csiComponent) deploy(kubeClient *clientset.Clientset, s csiSettings) error {
+	c.deployment = c.build(s)
+	if err := c.deployment.Deploy(kubeClient); err != nil {
+		return err
+	}
+	c.deployed = s
+	return nil
+}
+
 func deployCSIDriver(kubeClient *clientset.Clientset, c *cli.Context, managerImage, managerURL string) error {
-	csiAttacherImage := c.String(FlagCSIAttacherImage)
-	csiProvisionerImage := c.String(FlagCSIProvisionerImage)
-	csiDriverRegistrarImage := c.String(FlagCSIDriverRegistrarImage)
+	flagSettings := csiSettings{
+		attacherImage:        c.String(FlagCSIAttacherImage),
+		provisionerImage:     c.String(FlagCSIProvisionerImage),
+		driverRegistrarImage: c.String(FlagCSIDriverRegistrarImage),
+		snapshotterImage:     c.String(FlagCSISnapshotterImage),
+	}
 	csiProvisionerName := c.String(FlagCSIProvisionerName)
 	namespace := os.Getenv(types.EnvPodNamespace)
 	serviceAccountName := os.Getenv(types.EnvServiceAccount)
@@ -201,41 +321,111 @@ func deployCSIDriver(kubeClient *clientset.Clientset, c *cli.Context, managerIma
 		return err
 	}
 
-	attacherDeployment := csi.NewAttacherDeployment(namespace, serviceAccountName, csiAttacherImage)
-	if err := attacherDeployment.Deploy(kubeClient); err != nil {
-		return err
+	apiClient, err := longhornclient.NewRancherClient(&longhornclient.ClientOpts{Url: managerURL})
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize Longhorn API client")
 	}
-
-	provisionerDeployment := csi.NewProvisionerDeployment(namespace, serviceAccountName, csiProvisionerImage, csiProvisionerName)
-	if err := provisionerDeployment.Deploy(kubeClient); err != nil {
-		return err
+	settings, err := getCSISettings(apiClient, flagSettings)
+	if err != nil {
+		logrus.Warnf("Deploying CSI driver with the flags only: %v", err)
 	}
 
-	pluginDeployment := csi.NewPluginDeployment(namespace, serviceAccountName, csiDriverRegistrarImage, managerImage, managerURL, kubeletPluginWatcherEnabled)
-	if err := pluginDeployment.Deploy(kubeClient); err != nil {
-		return err
+	components := []*csiComponent{
+		{
+			name:  "attacher",
+			image: func(s csiSettings) string { return s.attacherImage },
+			resources: func(s csiSettings) []v1.ResourceRequirements {
+				return []v1.ResourceRequirements{s.attacherResources}
+			},
+			build: func(s csiSettings) csiDeployment {
+				return csi.NewAttacherDeployment(namespace, serviceAccountName, s.attacherImage, s.attacherResources, s.podOptions)
+			},
+		},
+		{
+			name:  "provisioner",
+			image: func(s csiSettings) string { return s.provisionerImage },
+			resources: func(s csiSettings) []v1.ResourceRequirements {
+				return []v1.ResourceRequirements{s.provisionerResources}
+			},
+			build: func(s csiSettings) csiDeployment {
+				return csi.NewProvisionerDeployment(namespace, serviceAccountName, s.provisionerImage, csiProvisionerName, s.provisionerResources, s.podOptions)
+			},
+		},
+		{
+			name:  "snapshotter",
+			image: func(s csiSettings) string { return s.snapshotterImage },
+			resources: func(s csiSettings) []v1.ResourceRequirements {
+				return []v1.ResourceRequirements{s.snapshotterResources}
+			},
+			build: func(s csiSettings) csiDeployment {
+				return csi.NewSnapshotterDeployment(namespace, serviceAccountName, s.snapshotterImage, s.snapshotterResources, s.podOptions)
+			},
+		},
+		{
+			name:  "plugin",
+			image: func(s csiSettings) string { return s.driverRegistrarImage },
+			resources: func(s csiSettings) []v1.ResourceRequirements {
+				return []v1.ResourceRequirements{s.driverRegistrarResources, s.pluginResources}
+			},
+			build: func(s csiSettings) csiDeployment {
+				return csi.NewPluginDeployment(namespace, serviceAccountName, s.driverRegistrarImage, managerImage, managerURL, kubeletPluginWatcherEnabled, s.driverRegistrarResources, s.pluginResources, s.podOptions)
+			},
+		},
+	}
+	for _, component := range components {
+		if err := component.deploy(kubeClient, settings); err != nil {
+			return err
+		}
 	}
 
 	defer func() {
-		var wg sync.WaitGroup
-		util.RunAsync(&wg, func() {
-			attacherDeployment.Cleanup(kubeClient)
-		})
-		util.RunAsync(&wg, func() {
-			provisionerDeployment.Cleanup(kubeClient)
-		})
-		util.RunAsync(&wg, func() {
-			pluginDeployment.Cleanup(kubeClient)
-		})
-		wg.Wait()
+		cleanups := []func() error{}
+		for _, component := range components {
+			deployment := component.deployment
+			cleanups = append(cleanups, func() error { return deployment.Cleanup(kubeClient) })
+		}
+		// the cleanup is idempotent, so it's retried as a whole until the
+		// components aren't left behind
+		for i := 0; i < csiCleanupRetryCount; i++ {
+			err := util.RunConcurrent(cleanups...)
+			if err == nil {
+				return
+			}
+			logrus.Warnf("Failed to cleanup CSI driver, attempt %v/%v: %v", i+1, csiCleanupRetryCount, err)
+			time.Sleep(csiCleanupRetryInterval)
+		}
+		logrus.Errorf("Gave up cleaning up CSI driver, the components may be left behind")
 	}()
 
 	done := make(chan struct{})
 	util.RegisterShutdownChannel(done)
 
-	<-done
-
-	return nil
+	// redeploy the components whose settings are changed. The failed one
+	// is retried on the next poll, since its settings are only recorded
+	// once deployed.
+	ticker := time.NewTicker(csiSettingPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+		settings, err := getCSISettings(apiClient, flagSettings)
+		if err != nil {
+			logrus.Warnf("Failed to check the settings of CSI driver: %v", err)
+			continue
+		}
+		for _, component := range components {
+			if !component.isOutdated(settings) {
+				continue
+			}
+			logrus.Infof("Redeploying CSI %v with image %v", component.name, component.image(settings))
+			if err := component.deploy(kubeClient, settings); err != nil {
+				logrus.Errorf("Failed to redeploy CSI %v: %v", component.name, err)
+			}
+		}
+	}
 }
 
 func deployFlexvolumeDriver(kubeClient *clientset.Clientset, c *cli.Context, managerImage, managerURL string) error {
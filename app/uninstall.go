@@ -0,0 +1,522 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/rancher/longhorn-manager/controller"
+	"github.com/rancher/longhorn-manager/csi"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhclientset "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned"
+)
+
+const (
+	FlagForce              = "force"
+	FlagUninstallTimeout   = "timeout"
+	LonghornDriverDeployer = "longhorn-driver-deployer"
+
+	defaultUninstallTimeout = 30 * time.Minute
+	uninstallPollInterval   = 5 * time.Second
+)
+
+var (
+	longhornFinalizerKey = longhorn.SchemeGroupVersion.Group
+
+	longhornCRDNames = []string{
+		"volumes." + longhorn.SchemeGroupVersion.Group,
+		"engines." + longhorn.SchemeGroupVersion.Group,
+		"replicas." + longhorn.SchemeGroupVersion.Group,
+		"engineimages." + longhorn.SchemeGroupVersion.Group,
+		"nodes." + longhorn.SchemeGroupVersion.Group,
+		"settings." + longhorn.SchemeGroupVersion.Group,
+		"snapshots." + longhorn.SchemeGroupVersion.Group,
+	}
+)
+
+func UninstallCmd() cli.Command {
+	return cli.Command{
+		Name:  "uninstall",
+		Usage: "Remove the volumes, the driver and the CRDs of Longhorn. It must run while the managers are running, and can be rerun to resume",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name: FlagForce,
+				Usage: "Delete the persistent volumes using Longhorn and the attached volumes as well, " +
+					"and remove the finalizers of the objects not cleaned up in time. The data on the unreachable nodes would be left behind",
+			},
+			cli.DurationFlag{
+				Name:  FlagUninstallTimeout,
+				Usage: "Specify how long to wait for the managers to clean up the volumes and the nodes",
+				Value: defaultUninstallTimeout,
+			},
+		},
+		Action: func(c *cli.Context) {
+			if err := uninstall(c); err != nil {
+				logrus.Fatalf("Error uninstalling: %v", err)
+			}
+		},
+	}
+}
+
+type uninstaller struct {
+	namespace string
+	force     bool
+	timeout   time.Duration
+
+	kubeClient clientset.Interface
+	lhClient   lhclientset.Interface
+
+	// the driver components and the CRDs are deleted through the clients
+	// not available as the interfaces, so they're replaced by the tests
+	cleanupDriverComponents func() error
+	deleteCRD               func(name string) error
+}
+
+func uninstall(c *cli.Context) error {
+	namespace := os.Getenv(types.EnvPodNamespace)
+	if namespace == "" {
+		return fmt.Errorf("Cannot detect pod namespace, environment variable %v is missing", types.EnvPodNamespace)
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return errors.Wrap(err, "unable to get client config")
+	}
+	kubeClient, err := clientset.NewForConfig(config)
+	if err != nil {
+		return errors.Wrap(err, "unable to get k8s client")
+	}
+	lhClient, err := lhclientset.NewForConfig(config)
+	if err != nil {
+		return errors.Wrap(err, "unable to get clientset")
+	}
+
+	u := &uninstaller{
+		namespace:  namespace,
+		force:      c.Bool(FlagForce),
+		timeout:    c.Duration(FlagUninstallTimeout),
+		kubeClient: kubeClient,
+		lhClient:   lhClient,
+		cleanupDriverComponents: func() error {
+			return cleanupDriverComponents(kubeClient, namespace)
+		},
+		deleteCRD: func(name string) error {
+			return deleteCRD(kubeClient, name)
+		},
+	}
+	return u.run()
+}
+
+func (u *uninstaller) run() error {
+	// every step skips what's been done, so an interrupted uninstall resumes
+	// from where it stopped when rerun
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"check the persistent volumes", u.checkPersistentVolumes},
+		{"delete the volumes", u.deleteVolumes},
+		{"delete the engine images and the nodes", u.deleteEngineImagesAndNodes},
+		{"tear down the driver", u.deleteDriver},
+		{"remove the finalizers", u.removeFinalizers},
+		{"delete the CRDs", u.deleteCRDs},
+	}
+	for i, step := range steps {
+		logrus.Infof("Uninstall step %v/%v: %v", i+1, len(steps), step.name)
+		if err := step.run(); err != nil {
+			return errors.Wrapf(err, "failed to %v", step.name)
+		}
+	}
+	logrus.Infof("Uninstalled Longhorn, the manager and the other components can be deleted now")
+	return nil
+}
+
+func isLonghornPersistentVolume(pv *corev1.PersistentVolume) bool {
+	if pv.Spec.CSI != nil {
+		return pv.Spec.CSI.Driver == csi.DefaultCSIDriverName
+	}
+	if pv.Spec.FlexVolume != nil {
+		return pv.Spec.FlexVolume.Driver == controller.LonghornDriver
+	}
+	return false
+}
+
+// checkPersistentVolumes refuses to go on if the volumes are still in use by
+// the workloads, unless it's forced to delete the persistent volumes as well
+func (u *uninstaller) checkPersistentVolumes() error {
+	pvList, err := u.kubeClient.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	pvs := []corev1.PersistentVolume{}
+	for _, pv := range pvList.Items {
+		if isLonghornPersistentVolume(&pv) {
+			pvs = append(pvs, pv)
+		}
+	}
+	volumes, err := u.listVolumes()
+	if err != nil {
+		return err
+	}
+	attached := []string{}
+	for _, v := range volumes {
+		if v.DeletionTimestamp == nil && v.Status.State == types.VolumeStateAttached {
+			attached = append(attached, v.Name)
+		}
+	}
+
+	if !u.force {
+		if len(pvs) != 0 {
+			names := []string{}
+			for _, pv := range pvs {
+				names = append(names, pv.Name)
+			}
+			return fmt.Errorf("persistent volumes %v are using Longhorn, delete them first or use --%v to delete them as well", names, FlagForce)
+		}
+		if len(attached) != 0 {
+			return fmt.Errorf("volumes %v are attached, detach them first or use --%v to delete them anyway", attached, FlagForce)
+		}
+		return nil
+	}
+
+	for _, pv := range pvs {
+		if pv.Spec.ClaimRef != nil {
+			logrus.Infof("Deleting persistent volume claim %v/%v", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+			if err := u.kubeClient.CoreV1().PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).Delete(pv.Spec.ClaimRef.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+		logrus.Infof("Deleting persistent volume %v", pv.Name)
+		if err := u.kubeClient.CoreV1().PersistentVolumes().Delete(pv.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	if len(attached) != 0 {
+		logrus.Warnf("Deleting the attached volumes %v", attached)
+	}
+	return nil
+}
+
+// deleteVolumes leaves the detaching and the cleanup of the engines, the
+// replicas and their data to the managers
+func (u *uninstaller) deleteVolumes() error {
+	volumes, err := u.listVolumes()
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		if v.DeletionTimestamp != nil {
+			continue
+		}
+		logrus.Infof("Deleting volume %v", v.Name)
+		if err := u.lhClient.LonghornV1alpha1().Volumes(u.namespace).Delete(v.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return u.waitForDeletion("volumes", func() (int, error) {
+		volumes, err := u.listVolumes()
+		return len(volumes), err
+	})
+}
+
+// deleteEngineImagesAndNodes deletes the objects once no volume is using
+// them. The default engine image is held by the managers, it's released in
+// the finalizer step.
+func (u *uninstaller) deleteEngineImagesAndNodes() error {
+	engineImages, err := u.listEngineImages()
+	if err != nil {
+		return err
+	}
+	for _, ei := range engineImages {
+		if ei.DeletionTimestamp != nil {
+			continue
+		}
+		logrus.Infof("Deleting engine image %v (%v)", ei.Name, ei.Spec.Image)
+		if err := u.lhClient.LonghornV1alpha1().EngineImages(u.namespace).Delete(ei.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	nodes, err := u.listNodes()
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node.DeletionTimestamp != nil {
+			continue
+		}
+		logrus.Infof("Deleting node %v", node.Name)
+		if err := u.lhClient.LonghornV1alpha1().Nodes(u.namespace).Delete(node.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return u.waitForDeletion("nodes", func() (int, error) {
+		nodes, err := u.listNodes()
+		return len(nodes), err
+	})
+}
+
+// deleteDriver deletes the driver deployer first, so the driver won't be
+// deployed again, then tears down what it deployed
+func (u *uninstaller) deleteDriver() error {
+	propagation := metav1.DeletePropagationForeground
+	if err := u.kubeClient.AppsV1beta2().Deployments(u.namespace).Delete(LonghornDriverDeployer,
+		&metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return u.cleanupDriverComponents()
+}
+
+func cleanupDriverComponents(kubeClient *clientset.Clientset, namespace string) error {
+	dsOps, err := newDaemonSetOps(kubeClient)
+	if err != nil {
+		return err
+	}
+	if err := dsOps.Delete(LonghornFlexvolumeDriver); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	// only the names of the components are needed for the cleanup
+	attacherDeployment := csi.NewAttacherDeployment(namespace, "", "", corev1.ResourceRequirements{}, csi.PodOptions{})
+	provisionerDeployment := csi.NewProvisionerDeployment(namespace, "", "", "", corev1.ResourceRequirements{}, csi.PodOptions{})
+	snapshotterDeployment := csi.NewSnapshotterDeployment(namespace, "", "", corev1.ResourceRequirements{}, csi.PodOptions{})
+	pluginDeployment := csi.NewPluginDeployment(namespace, "", "", "", "", false, corev1.ResourceRequirements{}, corev1.ResourceRequirements{}, csi.PodOptions{})
+	return util.RunConcurrent(
+		func() error { return attacherDeployment.Cleanup(kubeClient) },
+		func() error { return provisionerDeployment.Cleanup(kubeClient) },
+		func() error { return snapshotterDeployment.Cleanup(kubeClient) },
+		func() error { return pluginDeployment.Cleanup(kubeClient) },
+	)
+}
+
+// removeFinalizers releases the objects left, e.g. the default engine image,
+// and the ones not cleaned up in time when forced
+func (u *uninstaller) removeFinalizers() error {
+	engineImages, err := u.listEngineImages()
+	if err != nil {
+		return err
+	}
+	for _, ei := range engineImages {
+		if err := u.kubeClient.AppsV1beta2().DaemonSets(u.namespace).Delete(controller.GetEngineImageDaemonSetName(ei.Name),
+			&metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err := u.removeFinalizer("engine image", &ei, func(obj runtime.Object) error {
+			_, err := u.lhClient.LonghornV1alpha1().EngineImages(u.namespace).Update(obj.(*longhorn.EngineImage))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	volumes, err := u.listVolumes()
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		if err := u.removeFinalizer("volume", &v, func(obj runtime.Object) error {
+			_, err := u.lhClient.LonghornV1alpha1().Volumes(u.namespace).Update(obj.(*longhorn.Volume))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	engines, err := u.listEngines()
+	if err != nil {
+		return err
+	}
+	for _, e := range engines {
+		if err := u.removeFinalizer("engine", &e, func(obj runtime.Object) error {
+			_, err := u.lhClient.LonghornV1alpha1().Engines(u.namespace).Update(obj.(*longhorn.Engine))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	snapshots, err := u.listSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, snap := range snapshots {
+		if err := u.removeFinalizer("snapshot", &snap, func(obj runtime.Object) error {
+			_, err := u.lhClient.LonghornV1alpha1().Snapshots(u.namespace).Update(obj.(*longhorn.Snapshot))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	replicas, err := u.listReplicas()
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		if util.FinalizerExists(longhornFinalizerKey, &r) {
+			logrus.Warnf("The data of replica %v may be left behind at %v on node %v", r.Name, r.Spec.DataPath, r.Spec.NodeID)
+		}
+		if err := u.removeFinalizer("replica", &r, func(obj runtime.Object) error {
+			_, err := u.lhClient.LonghornV1alpha1().Replicas(u.namespace).Update(obj.(*longhorn.Replica))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	nodes, err := u.listNodes()
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if err := u.removeFinalizer("node", &node, func(obj runtime.Object) error {
+			_, err := u.lhClient.LonghornV1alpha1().Nodes(u.namespace).Update(obj.(*longhorn.Node))
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *uninstaller) removeFinalizer(kind string, obj runtime.Object, update func(obj runtime.Object) error) error {
+	if !util.FinalizerExists(longhornFinalizerKey, obj) {
+		return nil
+	}
+	if err := util.RemoveFinalizer(longhornFinalizerKey, obj); err != nil {
+		return err
+	}
+	if err := update(obj); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "unable to remove finalizer for %v", kind)
+	}
+	return nil
+}
+
+// deleteCRDs deletes the CRDs once all the objects are released. The objects
+// left are deleted with them.
+func (u *uninstaller) deleteCRDs() error {
+	for _, name := range longhornCRDNames {
+		logrus.Infof("Deleting CRD %v", name)
+		if err := u.deleteCRD(name); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCRD deletes the CRD through the REST client, since the client of the
+// API extensions isn't vendored
+func deleteCRD(kubeClient *clientset.Clientset, name string) error {
+	return kubeClient.Discovery().RESTClient().Delete().
+		AbsPath("/apis/apiextensions.k8s.io/v1beta1/customresourcedefinitions", name).
+		Do().Error()
+}
+
+// waitForDeletion reports the progress until the objects are gone. Once it
+// times out, the remaining objects are left to the finalizer step if it's
+// forced, otherwise the uninstall stops to be resumed later.
+func (u *uninstaller) waitForDeletion(kind string, count func() (int, error)) error {
+	last := -1
+	err := wait.PollImmediate(uninstallPollInterval, u.timeout, func() (bool, error) {
+		remaining, err := count()
+		if err != nil {
+			logrus.Warnf("Fail to check the %v being deleted, retry later: %v", kind, err)
+			return false, nil
+		}
+		if remaining != last {
+			logrus.Infof("Waiting for %v %v to be deleted", remaining, kind)
+			last = remaining
+		}
+		return remaining == 0, nil
+	})
+	if err == nil {
+		return nil
+	}
+	if u.force {
+		logrus.Warnf("Timeout waiting for %v %v to be deleted, their finalizers will be removed", last, kind)
+		return nil
+	}
+	return fmt.Errorf("timeout waiting for %v %v to be deleted, make sure the managers are running and rerun to resume, or use --%v", last, kind, FlagForce)
+}
+
+// the objects are gone with the CRD if the uninstall is resumed after it's
+// deleted
+func (u *uninstaller) listVolumes() ([]longhorn.Volume, error) {
+	list, err := u.lhClient.LonghornV1alpha1().Volumes(u.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (u *uninstaller) listEngineImages() ([]longhorn.EngineImage, error) {
+	list, err := u.lhClient.LonghornV1alpha1().EngineImages(u.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (u *uninstaller) listNodes() ([]longhorn.Node, error) {
+	list, err := u.lhClient.LonghornV1alpha1().Nodes(u.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (u *uninstaller) listEngines() ([]longhorn.Engine, error) {
+	list, err := u.lhClient.LonghornV1alpha1().Engines(u.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (u *uninstaller) listReplicas() ([]longhorn.Replica, error) {
+	list, err := u.lhClient.LonghornV1alpha1().Replicas(u.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (u *uninstaller) listSnapshots() ([]longhorn.Snapshot, error) {
+	list, err := u.lhClient.LonghornV1alpha1().Snapshots(u.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return list.Items, nil
+}
@@ -0,0 +1,257 @@
+package app
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/rancher/longhorn-manager/csi"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+)
+
+const (
+	TestNamespace = "longhorn-system"
+	TestNode1     = "test-node-1"
+	TestNode2     = "test-node-2"
+)
+
+// testUninstaller records what the uninstaller deletes, in order
+type testUninstaller struct {
+	*uninstaller
+
+	kubeClient *fake.Clientset
+	lhClient   *lhfake.Clientset
+
+	lock    sync.Mutex
+	deleted []string
+}
+
+func newTestUninstaller(force bool, lhObjects ...runtime.Object) *testUninstaller {
+	u := &testUninstaller{
+		kubeClient: fake.NewSimpleClientset(),
+		lhClient:   lhfake.NewSimpleClientset(lhObjects...),
+		deleted:    []string{},
+	}
+	u.uninstaller = &uninstaller{
+		namespace:  TestNamespace,
+		force:      force,
+		timeout:    10 * time.Millisecond,
+		kubeClient: u.kubeClient,
+		lhClient:   u.lhClient,
+		cleanupDriverComponents: func() error {
+			u.record("driver")
+			return nil
+		},
+		deleteCRD: func(name string) error {
+			u.record("crd/" + name)
+			return nil
+		},
+	}
+	record := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		u.record(action.GetResource().Resource + "/" + action.(k8stesting.DeleteAction).GetName())
+		return false, nil, nil
+	}
+	u.kubeClient.PrependReactor("delete", "*", record)
+	u.lhClient.PrependReactor("delete", "*", record)
+	return u
+}
+
+func (u *testUninstaller) record(name string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.deleted = append(u.deleted, name)
+}
+
+// getDeletedKinds returns the kinds deleted in order, each once
+func (u *testUninstaller) getDeletedKinds() []string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	kinds := []string{}
+	for _, name := range u.deleted {
+		kind := strings.SplitN(name, "/", 2)[0]
+		if len(kinds) == 0 || kinds[len(kinds)-1] != kind {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+func (u *testUninstaller) getDeleted(kind string) []string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	names := []string{}
+	for _, name := range u.deleted {
+		if strings.HasPrefix(name, kind+"/") {
+			names = append(names, strings.TrimPrefix(name, kind+"/"))
+		}
+	}
+	return names
+}
+
+// holdDeletion keeps the objects of the resource, as if the managers are not
+// there to clean them up and remove the finalizers
+func (u *testUninstaller) holdDeletion(resource string, hold *bool) {
+	u.lhClient.PrependReactor("delete", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !*hold {
+			return false, nil, nil
+		}
+		u.record(action.GetResource().Resource + "/" + action.(k8stesting.DeleteAction).GetName())
+		return true, nil, nil
+	})
+}
+
+func newTestUninstallVolume(name string, state types.VolumeState) *longhorn.Volume {
+	return &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Namespace:  TestNamespace,
+			Finalizers: []string{longhornFinalizerKey},
+		},
+		Status: types.VolumeStatus{
+			State: state,
+		},
+	}
+}
+
+func newTestUninstallEngineImage(name string) *longhorn.EngineImage {
+	return &longhorn.EngineImage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Namespace:  TestNamespace,
+			Finalizers: []string{longhornFinalizerKey},
+		},
+	}
+}
+
+func newTestUninstallNode(name string) *longhorn.Node {
+	return &longhorn.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Namespace:  TestNamespace,
+			Finalizers: []string{longhornFinalizerKey},
+		},
+	}
+}
+
+func TestUninstallOrder(t *testing.T) {
+	assert := require.New(t)
+
+	u := newTestUninstaller(false,
+		newTestUninstallVolume("vol-1", types.VolumeStateDetached),
+		newTestUninstallVolume("vol-2", types.VolumeStateDetached),
+		newTestUninstallEngineImage("ei-1"),
+		newTestUninstallNode(TestNode1),
+		newTestUninstallNode(TestNode2))
+	// the default engine image is held by the managers
+	defaultEngineImage := true
+	u.holdDeletion("engineimages", &defaultEngineImage)
+	assert.Nil(u.run())
+
+	assert.Equal([]string{"volumes", "engineimages", "nodes", "deployments", "driver", "daemonsets", "crd"}, u.getDeletedKinds())
+	assert.Equal([]string{"engine-image-ei-1"}, u.getDeleted("daemonsets"))
+	engineImages, err := u.listEngineImages()
+	assert.Nil(err)
+	assert.Len(engineImages, 1)
+	assert.Empty(engineImages[0].Finalizers)
+	assert.Equal([]string{"vol-1", "vol-2"}, u.getDeleted("volumes"))
+	assert.Equal([]string{TestNode1, TestNode2}, u.getDeleted("nodes"))
+	assert.Equal([]string{LonghornDriverDeployer}, u.getDeleted("deployments"))
+	assert.Equal(longhornCRDNames, u.getDeleted("crd"))
+}
+
+func TestUninstallPersistentVolumesInUse(t *testing.T) {
+	assert := require.New(t)
+
+	u := newTestUninstaller(false, newTestUninstallVolume("vol-1", types.VolumeStateDetached))
+	_, err := u.kubeClient.CoreV1().PersistentVolumes().Create(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       csi.DefaultCSIDriverName,
+					VolumeHandle: "vol-1",
+				},
+			},
+			ClaimRef: &corev1.ObjectReference{Namespace: "default", Name: "pvc-1"},
+		},
+	})
+	assert.Nil(err)
+
+	// nothing is deleted unless forced
+	err = u.run()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "pv-1")
+	assert.Empty(u.getDeletedKinds())
+
+	u.force = true
+	assert.Nil(u.run())
+	assert.Equal([]string{"persistentvolumeclaims", "persistentvolumes", "volumes"}, u.getDeletedKinds()[:3])
+}
+
+func TestUninstallResume(t *testing.T) {
+	assert := require.New(t)
+
+	u := newTestUninstaller(false,
+		newTestUninstallVolume("vol-1", types.VolumeStateDetached),
+		newTestUninstallEngineImage("ei-1"),
+		newTestUninstallNode(TestNode1),
+		newTestUninstallNode(TestNode2))
+	managersDown := true
+	u.holdDeletion("nodes", &managersDown)
+
+	// the nodes are not cleaned up in time, the uninstall stops before
+	// tearing down the driver
+	err := u.run()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "timeout waiting for 2 nodes")
+	assert.Equal([]string{"volumes", "engineimages", "nodes"}, u.getDeletedKinds())
+	nodes, err := u.listNodes()
+	assert.Nil(err)
+	assert.Len(nodes, 2)
+	for _, node := range nodes {
+		now := metav1.Now()
+		node.DeletionTimestamp = &now
+		_, err := u.lhClient.LonghornV1alpha1().Nodes(TestNamespace).Update(&node)
+		assert.Nil(err)
+	}
+
+	// the objects being deleted are not deleted again once resumed, and
+	// the ones not cleaned up are released when forced
+	u.deleted = []string{}
+	u.force = true
+	assert.Nil(u.run())
+	assert.Equal([]string{"deployments", "driver", "crd"}, u.getDeletedKinds())
+	nodes, err = u.listNodes()
+	assert.Nil(err)
+	assert.Len(nodes, 2)
+	for _, node := range nodes {
+		assert.Empty(node.Finalizers, node.Name)
+	}
+
+	// the objects are gone with the CRDs if the uninstall is interrupted
+	// after deleting them
+	u.deleted = []string{}
+	u.force = false
+	u.lhClient.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(action.GetResource().GroupResource(), "")
+	})
+	u.deleteCRD = func(name string) error {
+		u.record("crd/" + name)
+		return apierrors.NewNotFound(longhorn.Resource("customresourcedefinitions"), name)
+	}
+	assert.Nil(u.run())
+	assert.Equal([]string{"deployments", "driver", "crd"}, u.getDeletedKinds())
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"fmt"
+	"math/rand"
 	"os"
 	"sort"
 	"time"
@@ -10,7 +11,9 @@ import (
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
 	"github.com/rancher/longhorn-manager/datastore"
@@ -18,6 +21,7 @@ import (
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
 	lhclientset "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned"
 )
 
@@ -26,6 +30,14 @@ const (
 	FlagLabels       = "labels"
 	FlagRetain       = "retain"
 	FlagBackupTarget = "backuptarget"
+	FlagJitter       = "jitter"
+
+	EventReasonSkippedRecurringBackup = "SkippedRecurringBackup"
+
+	// the availability of the backup target is recorded at least every
+	// minute by the backupstore poll while it's unavailable, so the older
+	// one means the managers are not checking it
+	backupTargetStatusMaxAge = 5 * time.Minute
 )
 
 func SnapshotCmd() cli.Command {
@@ -48,6 +60,10 @@ func SnapshotCmd() cli.Command {
 				Name:  FlagBackupTarget,
 				Usage: "backup to destination if supplied, would be url like s3://bucket@region/path/ or vfs:///path/",
 			},
+			cli.IntFlag{
+				Name:  FlagJitter,
+				Usage: "wait a random number of seconds up to the value before starting",
+			},
 		},
 		Action: func(c *cli.Context) {
 			if err := snapshot(c); err != nil {
@@ -81,6 +97,13 @@ func snapshot(c *cli.Context) error {
 		}
 	}
 
+	if jitter := c.Int(FlagJitter); jitter > 0 {
+		rand.Seed(time.Now().UnixNano())
+		delay := time.Duration(rand.Intn(jitter)) * time.Second
+		logrus.Debugf("Waiting %v before taking snapshot of %v", delay, volume)
+		time.Sleep(delay)
+	}
+
 	backupTarget := c.String(FlagBackupTarget)
 	job, err := NewJob(volume, snapshotName, backupTarget, labelMap, retain)
 	if err != nil {
@@ -102,6 +125,12 @@ type Job struct {
 
 	engine      engineapi.EngineClient
 	engineImage string
+	volume      *longhorn.Volume
+	// the node the engine runs on, for the limit of the concurrent backups
+	engineNodeID string
+
+	kubeClient clientset.Interface
+	lhClient   lhclientset.Interface
 }
 
 func NewJob(volumeName, snapshotName, backupTarget string, labels map[string]string, retain int) (*Job, error) {
@@ -118,6 +147,10 @@ func NewJob(volumeName, snapshotName, backupTarget string, labels map[string]str
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to get clientset")
 	}
+	kubeClient, err := clientset.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get k8s clientset")
+	}
 
 	v, err := lhClient.LonghornV1alpha1().Volumes(namespace).Get(volumeName, metav1.GetOptions{})
 	if err != nil {
@@ -146,6 +179,7 @@ func NewJob(volumeName, snapshotName, backupTarget string, labels map[string]str
 		VolumeName:  v.Name,
 		EngineImage: engineImage,
 		IP:          e.Status.IP,
+		Port:        e.Status.Port,
 	})
 	if err != nil {
 		return nil, err
@@ -163,6 +197,10 @@ func NewJob(volumeName, snapshotName, backupTarget string, labels map[string]str
 		retain:       retain,
 		engine:       engineClient,
 		engineImage:  engineImage,
+		volume:       v,
+		engineNodeID: e.Spec.NodeID,
+		kubeClient:   kubeClient,
+		lhClient:     lhClient,
 	}, nil
 }
 
@@ -200,12 +238,13 @@ func (job *Job) listSnapshotNamesForCleanup(snapshots map[string]*engineapi.Snap
 
 	// if no label specified, don't action. We don't want to remove all
 	// unlabeled snapshots
-	if len(job.labels) == 0 {
+	labels := job.retentionLabels()
+	if len(labels) == 0 {
 		return []string{}
 	}
 	for _, snapshot := range snapshots {
 		matched := true
-		for k, v := range job.labels {
+		for k, v := range labels {
 			value, ok := snapshot.Labels[k]
 			if !ok {
 				matched = false
@@ -232,6 +271,17 @@ func (job *Job) listSnapshotNamesForCleanup(snapshots map[string]*engineapi.Snap
 	return job.getCleanupList(sts)
 }
 
+// retentionLabels are the labels of the snapshots and the backups counted for
+// the retention. Only the label of the job name is counted for the recurring
+// job, so the ones taken before the other labels of the job changed are
+// still pruned.
+func (job *Job) retentionLabels() map[string]string {
+	if name, ok := job.labels[types.RecurringJobLabel]; ok {
+		return map[string]string{types.RecurringJobLabel: name}
+	}
+	return job.labels
+}
+
 func (job *Job) getCleanupList(sts []*NameWithTimestamp) []string {
 	sort.Slice(sts, func(i, j int) bool {
 		if sts[i].Timestamp.Before(sts[j].Timestamp) {
@@ -248,11 +298,41 @@ func (job *Job) getCleanupList(sts []*NameWithTimestamp) []string {
 }
 
 func (job *Job) backupAndCleanup() error {
+	if err := job.checkBackupTargetAvailable(); err != nil {
+		// skipped rather than waiting for the backup to time out
+		logrus.Warnf("Skipped the recurring backup of volume %v: %v", job.volumeName, err)
+		job.recordEvent(corev1.EventTypeWarning, EventReasonSkippedRecurringBackup, "Skipped the recurring backup: %v", err)
+		return nil
+	}
 	if err := job.snapshotAndCleanup(); err != nil {
 		return err
 	}
+	admission := datastore.NewBackupAdmission(job.kubeClient, job.namespace, func() (datastore.BackupLimits, error) {
+		return datastore.GetBackupLimitsFromClient(job.lhClient, job.namespace)
+	})
+	ticket, err := admission.Queue(types.BackupTicket{
+		Volume:   job.volumeName,
+		Node:     job.engineNodeID,
+		Snapshot: job.snapshotName,
+	})
+	if err != nil {
+		return err
+	}
+	// give up the turn if the job is terminated while waiting, so the
+	// ticket doesn't hold the slot until the heartbeat expires
+	done := make(chan struct{})
+	util.RegisterShutdownChannel(done)
+	finish, err := admission.Acquire(ticket, done)
+	if err != nil {
+		return errors.Wrapf(err, "failed to wait for the turn to back up snapshot %v", job.snapshotName)
+	}
 	// CronJob template has covered the credential already, so we don't need to get the credential secret.
-	if err := job.engine.SnapshotBackup(job.snapshotName, job.backupTarget, job.labels, nil); err != nil {
+	url, err := job.engine.SnapshotBackup(job.snapshotName, job.backupTarget, job.labels, nil)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to back up snapshot %v (%v)", job.snapshotName, engineapi.ClassifyBackupTargetError(err))
+	}
+	finish(url, err)
+	if err != nil {
 		return err
 	}
 	target := engineapi.NewBackupTarget(job.backupTarget, job.engineImage, nil)
@@ -270,17 +350,71 @@ func (job *Job) backupAndCleanup() error {
 	return nil
 }
 
+// checkBackupTargetAvailable returns error if the backupstore poll recently
+// found the backup target unavailable
+func (job *Job) checkBackupTargetAvailable() error {
+	setting, err := job.lhClient.LonghornV1alpha1().Settings(job.namespace).Get(string(types.SettingNameBackupTarget), metav1.GetOptions{})
+	if err != nil {
+		// cannot tell, so just try the backup
+		logrus.Warnf("Fail to get the availability of the backup target: %v", err)
+		return nil
+	}
+	if setting.Status.BackupTarget != job.backupTarget {
+		return nil
+	}
+	condition := types.GetSettingConditionFromStatus(setting.Status, types.SettingConditionTypeBackupTargetAvailable)
+	if condition.Status != types.ConditionStatusFalse {
+		return nil
+	}
+	probed, err := util.ParseTime(condition.LastProbeTime)
+	if err != nil || time.Since(probed) > backupTargetStatusMaxAge {
+		return nil
+	}
+	return fmt.Errorf("backup target is unavailable since %v: %v: %v", condition.LastTransitionTime, condition.Reason, condition.Message)
+}
+
+// recordEvent creates the event of the volume right away, since the job
+// exits before the recorder gets to send it
+func (job *Job) recordEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", job.volumeName, now.UnixNano()),
+			Namespace: job.namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:            "Volume",
+			APIVersion:      longhorn.SchemeGroupVersion.String(),
+			Namespace:       job.namespace,
+			Name:            job.volume.Name,
+			UID:             job.volume.UID,
+			ResourceVersion: job.volume.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: "longhorn-recurring-job"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := job.kubeClient.CoreV1().Events(job.namespace).Create(event); err != nil {
+		logrus.Warnf("Fail to record event %v of volume %v: %v", reason, job.volumeName, err)
+	}
+}
+
 func (job *Job) listBackupURLsForCleanup(backups []*engineapi.Backup) []string {
 	sts := []*NameWithTimestamp{}
 
 	// if no label specified, don't action. We don't want to remove all
 	// unlabeled backups
-	if len(job.labels) == 0 {
+	labels := job.retentionLabels()
+	if len(labels) == 0 {
 		return []string{}
 	}
 	for _, backup := range backups {
 		matched := true
-		for k, v := range job.labels {
+		for k, v := range labels {
 			value, ok := backup.Labels[k]
 			if !ok {
 				matched = false
@@ -7,7 +7,11 @@ const (
 type AttachInput struct {
 	Resource `yaml:"-"`
 
+	DisableFrontend bool `json:"disableFrontend,omitempty" yaml:"disable_frontend,omitempty"`
+
 	HostId string `json:"hostId,omitempty" yaml:"host_id,omitempty"`
+
+	ReadOnly bool `json:"readOnly,omitempty" yaml:"read_only,omitempty"`
 }
 
 type AttachInputCollection struct {
@@ -0,0 +1,79 @@
+package client
+
+const (
+	BACKUP_STATUS_INPUT_TYPE = "backupStatusInput"
+)
+
+type BackupStatusInput struct {
+	Resource `yaml:"-"`
+
+	Id string `json:"id,omitempty" yaml:"id,omitempty"`
+}
+
+type BackupStatusInputCollection struct {
+	Collection
+	Data   []BackupStatusInput `json:"data,omitempty"`
+	client *BackupStatusInputClient
+}
+
+type BackupStatusInputClient struct {
+	rancherClient *RancherClient
+}
+
+type BackupStatusInputOperations interface {
+	List(opts *ListOpts) (*BackupStatusInputCollection, error)
+	Create(opts *BackupStatusInput) (*BackupStatusInput, error)
+	Update(existing *BackupStatusInput, updates interface{}) (*BackupStatusInput, error)
+	ById(id string) (*BackupStatusInput, error)
+	Delete(container *BackupStatusInput) error
+}
+
+func newBackupStatusInputClient(rancherClient *RancherClient) *BackupStatusInputClient {
+	return &BackupStatusInputClient{
+		rancherClient: rancherClient,
+	}
+}
+
+func (c *BackupStatusInputClient) Create(container *BackupStatusInput) (*BackupStatusInput, error) {
+	resp := &BackupStatusInput{}
+	err := c.rancherClient.doCreate(BACKUP_STATUS_INPUT_TYPE, container, resp)
+	return resp, err
+}
+
+func (c *BackupStatusInputClient) Update(existing *BackupStatusInput, updates interface{}) (*BackupStatusInput, error) {
+	resp := &BackupStatusInput{}
+	err := c.rancherClient.doUpdate(BACKUP_STATUS_INPUT_TYPE, &existing.Resource, updates, resp)
+	return resp, err
+}
+
+func (c *BackupStatusInputClient) List(opts *ListOpts) (*BackupStatusInputCollection, error) {
+	resp := &BackupStatusInputCollection{}
+	err := c.rancherClient.doList(BACKUP_STATUS_INPUT_TYPE, opts, resp)
+	resp.client = c
+	return resp, err
+}
+
+func (cc *BackupStatusInputCollection) Next() (*BackupStatusInputCollection, error) {
+	if cc != nil && cc.Pagination != nil && cc.Pagination.Next != "" {
+		resp := &BackupStatusInputCollection{}
+		err := cc.client.rancherClient.doNext(cc.Pagination.Next, resp)
+		resp.client = cc.client
+		return resp, err
+	}
+	return nil, nil
+}
+
+func (c *BackupStatusInputClient) ById(id string) (*BackupStatusInput, error) {
+	resp := &BackupStatusInput{}
+	err := c.rancherClient.doById(BACKUP_STATUS_INPUT_TYPE, id, resp)
+	if apiError, ok := err.(*ApiError); ok {
+		if apiError.StatusCode == 404 {
+			return nil, nil
+		}
+	}
+	return resp, err
+}
+
+func (c *BackupStatusInputClient) Delete(container *BackupStatusInput) error {
+	return c.rancherClient.doResourceDelete(BACKUP_STATUS_INPUT_TYPE, &container.Resource)
+}
@@ -42,6 +42,8 @@ type BackupVolumeOperations interface {
 	ActionBackupDelete(*BackupVolume, *BackupInput) (*BackupVolume, error)
 
 	ActionBackupGet(*BackupVolume, *BackupInput) (*Backup, error)
+
+	ActionBackupList(*BackupVolume) (*BackupCollection, error)
 }
 
 func newBackupVolumeClient(rancherClient *RancherClient) *BackupVolumeClient {
@@ -111,3 +113,12 @@ func (c *BackupVolumeClient) ActionBackupGet(resource *BackupVolume, input *Back
 
 	return resp, err
 }
+
+func (c *BackupVolumeClient) ActionBackupList(resource *BackupVolume) (*BackupCollection, error) {
+
+	resp := &BackupCollection{}
+
+	err := c.rancherClient.doAction(BACKUP_VOLUME_TYPE, "backupList", &resource.Resource, nil, resp)
+
+	return resp, err
+}
@@ -7,9 +7,12 @@ type RancherClient struct {
 	Error              ErrorOperations
 	Snapshot           SnapshotOperations
 	AttachInput        AttachInputOperations
+	DetachInput        DetachInputOperations
 	SnapshotInput      SnapshotInputOperations
 	Backup             BackupOperations
 	BackupInput        BackupInputOperations
+	BackupStatus       BackupStatusOperations
+	BackupStatusInput  BackupStatusInputOperations
 	RecurringJob       RecurringJobOperations
 	ReplicaRemoveInput ReplicaRemoveInputOperations
 	SalvageInput       SalvageInputOperations
@@ -20,6 +23,7 @@ type RancherClient struct {
 	NodeInput          NodeInputOperations
 	SettingDefinition  SettingDefinitionOperations
 	VolumeCondition    VolumeConditionOperations
+	VolumeQoS          VolumeQoSOperations
 	NodeCondition      NodeConditionOperations
 	DiskCondition      DiskConditionOperations
 	Volume             VolumeOperations
@@ -41,9 +45,12 @@ func constructClient(rancherBaseClient *RancherBaseClientImpl) *RancherClient {
 	client.Error = newErrorClient(client)
 	client.Snapshot = newSnapshotClient(client)
 	client.AttachInput = newAttachInputClient(client)
+	client.DetachInput = newDetachInputClient(client)
 	client.SnapshotInput = newSnapshotInputClient(client)
 	client.Backup = newBackupClient(client)
 	client.BackupInput = newBackupInputClient(client)
+	client.BackupStatus = newBackupStatusClient(client)
+	client.BackupStatusInput = newBackupStatusInputClient(client)
 	client.RecurringJob = newRecurringJobClient(client)
 	client.ReplicaRemoveInput = newReplicaRemoveInputClient(client)
 	client.SalvageInput = newSalvageInputClient(client)
@@ -54,6 +61,7 @@ func constructClient(rancherBaseClient *RancherBaseClientImpl) *RancherClient {
 	client.NodeInput = newNodeInputClient(client)
 	client.SettingDefinition = newSettingDefinitionClient(client)
 	client.VolumeCondition = newVolumeConditionClient(client)
+	client.VolumeQoS = newVolumeQoSClient(client)
 	client.NodeCondition = newNodeConditionClient(client)
 	client.DiskCondition = newDiskConditionClient(client)
 	client.Volume = newVolumeClient(client)
@@ -13,6 +13,8 @@ type EngineImage struct {
 
 	CliAPIVersion int64 `json:"cliAPIVersion,omitempty" yaml:"cli_apiversion,omitempty"`
 
+	Conditions map[string]interface{} `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+
 	ControllerAPIMinVersion int64 `json:"controllerAPIMinVersion,omitempty" yaml:"controller_apimin_version,omitempty"`
 
 	ControllerAPIVersion int64 `json:"controllerAPIVersion,omitempty" yaml:"controller_apiversion,omitempty"`
@@ -31,6 +33,10 @@ type EngineImage struct {
 
 	NoRefSince string `json:"noRefSince,omitempty" yaml:"no_ref_since,omitempty"`
 
+	NodeDeploymentMap map[string]bool `json:"nodeDeploymentMap,omitempty" yaml:"node_deployment_map,omitempty"`
+
+	NodePullStatus map[string]interface{} `json:"nodePullStatus,omitempty" yaml:"node_pull_status,omitempty"`
+
 	RefCount int64 `json:"refCount,omitempty" yaml:"ref_count,omitempty"`
 
 	State string `json:"state,omitempty" yaml:"state,omitempty"`
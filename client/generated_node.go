@@ -16,6 +16,8 @@ type Node struct {
 	Disks map[string]interface{} `json:"disks,omitempty" yaml:"disks,omitempty"`
 
 	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	Zone string `json:"zone,omitempty" yaml:"zone,omitempty"`
 }
 
 type NodeCollection struct {
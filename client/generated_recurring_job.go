@@ -14,6 +14,8 @@ type RecurringJob struct {
 	Retain int64 `json:"retain,omitempty" yaml:"retain,omitempty"`
 
 	Task string `json:"task,omitempty" yaml:"task,omitempty"`
+
+	Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
 }
 
 type RecurringJobCollection struct {
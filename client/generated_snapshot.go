@@ -17,6 +17,8 @@ type Snapshot struct {
 
 	Parent string `json:"parent,omitempty" yaml:"parent,omitempty"`
 
+	ReadyToUse bool `json:"readyToUse,omitempty" yaml:"ready_to_use,omitempty"`
+
 	Removed bool `json:"removed,omitempty" yaml:"removed,omitempty"`
 
 	Size string `json:"size,omitempty" yaml:"size,omitempty"`
@@ -10,6 +10,8 @@ type SnapshotInput struct {
 	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
 
 	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	Priority bool `json:"priority,omitempty" yaml:"priority,omitempty"`
 }
 
 type SnapshotInputCollection struct {
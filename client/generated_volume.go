@@ -7,6 +7,8 @@ const (
 type Volume struct {
 	Resource `yaml:"-"`
 
+	AccessMode string `json:"accessMode,omitempty" yaml:"access_mode,omitempty"`
+
 	BaseImage string `json:"baseImage,omitempty" yaml:"base_image,omitempty"`
 
 	Conditions map[string]interface{} `json:"conditions,omitempty" yaml:"conditions,omitempty"`
@@ -17,6 +19,8 @@ type Volume struct {
 
 	CurrentImage string `json:"currentImage,omitempty" yaml:"current_image,omitempty"`
 
+	CurrentQoS *VolumeQoS `json:"currentQoS,omitempty" yaml:"current_qo_s,omitempty"`
+
 	EngineImage string `json:"engineImage,omitempty" yaml:"engine_image,omitempty"`
 
 	FromBackup string `json:"fromBackup,omitempty" yaml:"from_backup,omitempty"`
@@ -29,6 +33,10 @@ type Volume struct {
 
 	NumberOfReplicas int64 `json:"numberOfReplicas,omitempty" yaml:"number_of_replicas,omitempty"`
 
+	Qos *VolumeQoS `json:"qos,omitempty" yaml:"qos,omitempty"`
+
+	ReadOnlyNodeIDs []string `json:"readOnlyNodeIDs,omitempty" yaml:"read_only_node_ids,omitempty"`
+
 	RecurringJobs []RecurringJob `json:"recurringJobs,omitempty" yaml:"recurring_jobs,omitempty"`
 
 	Replicas []Replica `json:"replicas,omitempty" yaml:"replicas,omitempty"`
@@ -40,6 +48,10 @@ type Volume struct {
 	StaleReplicaTimeout int64 `json:"staleReplicaTimeout,omitempty" yaml:"stale_replica_timeout,omitempty"`
 
 	State string `json:"state,omitempty" yaml:"state,omitempty"`
+
+	TrashedAt string `json:"trashedAt,omitempty" yaml:"trashed_at,omitempty"`
+
+	ZoneSelector []string `json:"zoneSelector,omitempty" yaml:"zone_selector,omitempty"`
 }
 
 type VolumeCollection struct {
@@ -61,12 +73,20 @@ type VolumeOperations interface {
 
 	ActionAttach(*Volume, *AttachInput) (*Volume, error)
 
-	ActionDetach(*Volume) (*Volume, error)
+	ActionBackupStatusGet(*Volume, *BackupStatusInput) (*BackupStatus, error)
+
+	ActionBackupStatusList(*Volume) (*BackupStatusCollection, error)
+
+	ActionDetach(*Volume, *DetachInput) (*Volume, error)
 
 	ActionReplicaRemove(*Volume, *ReplicaRemoveInput) (*Volume, error)
 
+	ActionRestoreTrashed(*Volume) (*Volume, error)
+
 	ActionSalvage(*Volume, *SalvageInput) (*Volume, error)
 
+	ActionSnapshotBackup(*Volume, *SnapshotInput) (*BackupStatus, error)
+
 	ActionSnapshotCreate(*Volume, *SnapshotInput) (*Snapshot, error)
 
 	ActionSnapshotDelete(*Volume, *SnapshotInput) (*Snapshot, error)
@@ -135,11 +155,29 @@ func (c *VolumeClient) ActionAttach(resource *Volume, input *AttachInput) (*Volu
 	return resp, err
 }
 
-func (c *VolumeClient) ActionDetach(resource *Volume) (*Volume, error) {
+func (c *VolumeClient) ActionBackupStatusGet(resource *Volume, input *BackupStatusInput) (*BackupStatus, error) {
+
+	resp := &BackupStatus{}
+
+	err := c.rancherClient.doAction(VOLUME_TYPE, "backupStatusGet", &resource.Resource, input, resp)
+
+	return resp, err
+}
+
+func (c *VolumeClient) ActionBackupStatusList(resource *Volume) (*BackupStatusCollection, error) {
+
+	resp := &BackupStatusCollection{}
+
+	err := c.rancherClient.doAction(VOLUME_TYPE, "backupStatusList", &resource.Resource, nil, resp)
+
+	return resp, err
+}
+
+func (c *VolumeClient) ActionDetach(resource *Volume, input *DetachInput) (*Volume, error) {
 
 	resp := &Volume{}
 
-	err := c.rancherClient.doAction(VOLUME_TYPE, "detach", &resource.Resource, nil, resp)
+	err := c.rancherClient.doAction(VOLUME_TYPE, "detach", &resource.Resource, input, resp)
 
 	return resp, err
 }
@@ -153,6 +191,15 @@ func (c *VolumeClient) ActionReplicaRemove(resource *Volume, input *ReplicaRemov
 	return resp, err
 }
 
+func (c *VolumeClient) ActionRestoreTrashed(resource *Volume) (*Volume, error) {
+
+	resp := &Volume{}
+
+	err := c.rancherClient.doAction(VOLUME_TYPE, "restoreTrashed", &resource.Resource, nil, resp)
+
+	return resp, err
+}
+
 func (c *VolumeClient) ActionSalvage(resource *Volume, input *SalvageInput) (*Volume, error) {
 
 	resp := &Volume{}
@@ -162,6 +209,15 @@ func (c *VolumeClient) ActionSalvage(resource *Volume, input *SalvageInput) (*Vo
 	return resp, err
 }
 
+func (c *VolumeClient) ActionSnapshotBackup(resource *Volume, input *SnapshotInput) (*BackupStatus, error) {
+
+	resp := &BackupStatus{}
+
+	err := c.rancherClient.doAction(VOLUME_TYPE, "snapshotBackup", &resource.Resource, input, resp)
+
+	return resp, err
+}
+
 func (c *VolumeClient) ActionSnapshotCreate(resource *Volume, input *SnapshotInput) (*Snapshot, error) {
 
 	resp := &Snapshot{}
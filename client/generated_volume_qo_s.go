@@ -0,0 +1,85 @@
+package client
+
+const (
+	VOLUME_QO_S_TYPE = "volumeQoS"
+)
+
+type VolumeQoS struct {
+	Resource `yaml:"-"`
+
+	ReadBandwidth int64 `json:"readBandwidth,omitempty" yaml:"read_bandwidth,omitempty"`
+
+	ReadIOPS int64 `json:"readIOPS,omitempty" yaml:"read_iops,omitempty"`
+
+	WriteBandwidth int64 `json:"writeBandwidth,omitempty" yaml:"write_bandwidth,omitempty"`
+
+	WriteIOPS int64 `json:"writeIOPS,omitempty" yaml:"write_iops,omitempty"`
+}
+
+type VolumeQoSCollection struct {
+	Collection
+	Data   []VolumeQoS `json:"data,omitempty"`
+	client *VolumeQoSClient
+}
+
+type VolumeQoSClient struct {
+	rancherClient *RancherClient
+}
+
+type VolumeQoSOperations interface {
+	List(opts *ListOpts) (*VolumeQoSCollection, error)
+	Create(opts *VolumeQoS) (*VolumeQoS, error)
+	Update(existing *VolumeQoS, updates interface{}) (*VolumeQoS, error)
+	ById(id string) (*VolumeQoS, error)
+	Delete(container *VolumeQoS) error
+}
+
+func newVolumeQoSClient(rancherClient *RancherClient) *VolumeQoSClient {
+	return &VolumeQoSClient{
+		rancherClient: rancherClient,
+	}
+}
+
+func (c *VolumeQoSClient) Create(container *VolumeQoS) (*VolumeQoS, error) {
+	resp := &VolumeQoS{}
+	err := c.rancherClient.doCreate(VOLUME_QO_S_TYPE, container, resp)
+	return resp, err
+}
+
+func (c *VolumeQoSClient) Update(existing *VolumeQoS, updates interface{}) (*VolumeQoS, error) {
+	resp := &VolumeQoS{}
+	err := c.rancherClient.doUpdate(VOLUME_QO_S_TYPE, &existing.Resource, updates, resp)
+	return resp, err
+}
+
+func (c *VolumeQoSClient) List(opts *ListOpts) (*VolumeQoSCollection, error) {
+	resp := &VolumeQoSCollection{}
+	err := c.rancherClient.doList(VOLUME_QO_S_TYPE, opts, resp)
+	resp.client = c
+	return resp, err
+}
+
+func (cc *VolumeQoSCollection) Next() (*VolumeQoSCollection, error) {
+	if cc != nil && cc.Pagination != nil && cc.Pagination.Next != "" {
+		resp := &VolumeQoSCollection{}
+		err := cc.client.rancherClient.doNext(cc.Pagination.Next, resp)
+		resp.client = cc.client
+		return resp, err
+	}
+	return nil, nil
+}
+
+func (c *VolumeQoSClient) ById(id string) (*VolumeQoS, error) {
+	resp := &VolumeQoS{}
+	err := c.rancherClient.doById(VOLUME_QO_S_TYPE, id, resp)
+	if apiError, ok := err.(*ApiError); ok {
+		if apiError.StatusCode == 404 {
+			return nil, nil
+		}
+	}
+	return resp, err
+}
+
+func (c *VolumeQoSClient) Delete(container *VolumeQoS) error {
+	return c.rancherClient.doResourceDelete(VOLUME_QO_S_TYPE, &container.Resource)
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	// DefaultResyncPeriod is longer than the 30 seconds used before, since
+	// every resync syncs every object. The changes are delivered by the
+	// watch, and the controllers poll the instances by themselves, so the
+	// resync is only the safety net for the missed events
+	DefaultResyncPeriod = 5 * time.Minute
+
+	DefaultQueueBaseDelay = 5 * time.Millisecond
+	// DefaultQueueMaxDelay caps the per-item backoff much lower than the
+	// 1000 seconds of the Kubernetes default, so the objects failed during
+	// an incident are retried soon after it's over
+	DefaultQueueMaxDelay = time.Minute
+	DefaultQueueQPS      = 50
+	DefaultQueueBurst    = 300
+)
+
+// ControllerConfig tunes the informers and the workqueues of the controllers
+type ControllerConfig struct {
+	// ResyncPeriod is how often the informers replay all objects to the
+	// controllers. A shorter period recovers from the missed events sooner,
+	// at the cost of CPU in proportion to the number of the objects
+	ResyncPeriod time.Duration
+
+	// QueueBaseDelay and QueueMaxDelay bound the per-item exponential
+	// backoff of the failed syncs
+	QueueBaseDelay time.Duration
+	QueueMaxDelay  time.Duration
+
+	// QueueQPS and QueueBurst limit the overall rate of the retries of each
+	// controller
+	QueueQPS   float64
+	QueueBurst int
+}
+
+func DefaultControllerConfig() ControllerConfig {
+	return ControllerConfig{
+		ResyncPeriod:   DefaultResyncPeriod,
+		QueueBaseDelay: DefaultQueueBaseDelay,
+		QueueMaxDelay:  DefaultQueueMaxDelay,
+		QueueQPS:       DefaultQueueQPS,
+		QueueBurst:     DefaultQueueBurst,
+	}
+}
+
+func (c ControllerConfig) Validate() error {
+	if c.ResyncPeriod < 0 {
+		return fmt.Errorf("invalid resync period %v", c.ResyncPeriod)
+	}
+	if c.QueueBaseDelay <= 0 || c.QueueMaxDelay < c.QueueBaseDelay {
+		return fmt.Errorf("invalid queue delays: base %v, max %v", c.QueueBaseDelay, c.QueueMaxDelay)
+	}
+	if c.QueueQPS <= 0 || c.QueueBurst <= 0 {
+		return fmt.Errorf("invalid queue rate limit: qps %v, burst %v", c.QueueQPS, c.QueueBurst)
+	}
+	return nil
+}
+
+// newRateLimiter works as workqueue.DefaultControllerRateLimiter with the
+// configured parameters: the item is delayed by the larger of the per-item
+// backoff and the overall token bucket
+func (c ControllerConfig) newRateLimiter() workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(c.QueueBaseDelay, c.QueueMaxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(c.QueueQPS), c.QueueBurst)},
+	)
+}
+
+func (c ControllerConfig) newQueue(name string) workqueue.RateLimitingInterface {
+	return workqueue.NewNamedRateLimitingQueue(c.newRateLimiter(), name)
+}
+
+// runWorkers runs the workers of the queue until the stop channel is closed.
+// The queue then stops accepting new items, and it returns once the workers
+// have finished the syncs in flight and the items already queued, so no
+// status is left half-written on shutdown.
+func runWorkers(workers int, worker func(), queue workqueue.Interface, stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		util.RunAsync(&wg, func() {
+			wait.Until(worker, time.Second, stopCh)
+		})
+	}
+	<-stopCh
+	queue.ShutDown()
+	wg.Wait()
+}
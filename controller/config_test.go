@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/kubernetes/pkg/controller"
+
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestControllerConfigValidate(c *C) {
+	c.Assert(DefaultControllerConfig().Validate(), IsNil)
+
+	config := DefaultControllerConfig()
+	config.QueueMaxDelay = config.QueueBaseDelay / 2
+	c.Assert(config.Validate(), NotNil)
+
+	config = DefaultControllerConfig()
+	config.QueueQPS = 0
+	c.Assert(config.Validate(), NotNil)
+
+	config = DefaultControllerConfig()
+	config.ResyncPeriod = -time.Second
+	c.Assert(config.Validate(), NotNil)
+}
+
+func (s *TestSuite) TestControllerConfigMaxDelay(c *C) {
+	config := DefaultControllerConfig()
+	config.QueueMaxDelay = 2 * time.Second
+
+	limiter := config.newRateLimiter()
+	var delay time.Duration
+	for i := 0; i < 20; i++ {
+		delay = limiter.When("item")
+		c.Assert(delay <= config.QueueMaxDelay, Equals, true)
+	}
+	c.Assert(delay, Equals, config.QueueMaxDelay)
+
+	limiter.Forget("item")
+	c.Assert(limiter.When("item"), Equals, config.QueueBaseDelay)
+}
+
+func (s *TestSuite) TestControllerQueueUsesConfig(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+
+	config := DefaultControllerConfig()
+	config.QueueBaseDelay = time.Millisecond
+	config.QueueMaxDelay = 2 * time.Millisecond
+	rc := newTestReplicaControllerWithConfig(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1, config)
+	defer rc.queue.ShutDown()
+
+	// the 10th retry would be delayed by seconds with the default base delay
+	// and no lower max delay
+	for i := 0; i < 10; i++ {
+		rc.queue.AddRateLimited("item")
+		got := make(chan struct{})
+		go func() {
+			key, _ := rc.queue.Get()
+			rc.queue.Done(key)
+			close(got)
+		}()
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			c.Fatalf("retry %v isn't capped by the max delay", i)
+		}
+	}
+	c.Assert(rc.queue.NumRequeues("item"), Equals, 10)
+}
+
+func (s *TestSuite) TestRunWorkersDrainsQueue(c *C) {
+	queue := workqueue.New()
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var mutex sync.Mutex
+	processed := []string{}
+	worker := func() {
+		for {
+			key, quit := queue.Get()
+			if quit {
+				return
+			}
+			if key == "slow" {
+				close(started)
+				<-release
+			}
+			mutex.Lock()
+			processed = append(processed, key.(string))
+			mutex.Unlock()
+			queue.Done(key)
+		}
+	}
+
+	queue.Add("slow")
+	queue.Add("queued-1")
+	queue.Add("queued-2")
+
+	stopCh := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		runWorkers(1, worker, queue, stopCh)
+		close(returned)
+	}()
+
+	<-started
+	close(stopCh)
+	for !queue.ShuttingDown() {
+		time.Sleep(time.Millisecond)
+	}
+	// no new work is taken once it's stopping
+	queue.Add("new")
+
+	select {
+	case <-returned:
+		c.Fatal("returned before the sync in flight completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-returned
+
+	c.Assert(processed, DeepEquals, []string{"slow", "queued-1", "queued-2"})
+}
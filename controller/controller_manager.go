@@ -3,12 +3,14 @@ package controller
 import (
 	"fmt"
 	"os"
-	"time"
+	"reflect"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	clientset "k8s.io/client-go/kubernetes"
@@ -17,6 +19,7 @@ import (
 	"github.com/rancher/longhorn-manager/datastore"
 	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
 
 	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
 	lhclientset "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned"
@@ -28,7 +31,9 @@ var (
 	longhornFinalizerKey = longhorn.SchemeGroupVersion.Group
 )
 
-func StartControllers(stopCh chan struct{}, controllerID, serviceAccount, managerImage, kubeconfigPath string) (*datastore.DataStore, *WebsocketController, error) {
+// StartControllers starts the controllers, which stop once stopCh is closed.
+// wg is done when they have finished the work in flight.
+func StartControllers(stopCh chan struct{}, wg *sync.WaitGroup, controllerID, serviceAccount, managerImage, kubeconfigPath string, controllerConfig ControllerConfig) (*datastore.DataStore, *WebsocketController, *Health, *LeaderElection, error) {
 	namespace := os.Getenv(types.EnvPodNamespace)
 	if namespace == "" {
 		logrus.Warnf("Cannot detect pod namespace, environment variable %v is missing, "+
@@ -38,26 +43,28 @@ func StartControllers(stopCh chan struct{}, controllerID, serviceAccount, manage
 
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "unable to get client config")
+		return nil, nil, nil, nil, errors.Wrap(err, "unable to get client config")
 	}
 
 	kubeClient, err := clientset.NewForConfig(config)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "unable to get k8s client")
+		return nil, nil, nil, nil, errors.Wrap(err, "unable to get k8s client")
 	}
 
 	lhClient, err := lhclientset.NewForConfig(config)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "unable to get clientset")
+		return nil, nil, nil, nil, errors.Wrap(err, "unable to get clientset")
 	}
 
 	scheme := runtime.NewScheme()
 	if err := longhorn.SchemeBuilder.AddToScheme(scheme); err != nil {
-		return nil, nil, errors.Wrap(err, "unable to create scheme")
+		return nil, nil, nil, nil, errors.Wrap(err, "unable to create scheme")
 	}
 
-	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, time.Second*30)
-	lhInformerFactory := lhinformers.NewSharedInformerFactory(lhClient, time.Second*30)
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controllerConfig.ResyncPeriod)
+	lhInformerFactory := lhinformers.NewSharedInformerFactory(lhClient, controllerConfig.ResyncPeriod)
+	// the events are only watched in the Longhorn namespace
+	kubeNamespaceInformerFactory := informers.NewFilteredSharedInformerFactory(kubeClient, controllerConfig.ResyncPeriod, namespace, nil)
 
 	replicaInformer := lhInformerFactory.Longhorn().V1alpha1().Replicas()
 	engineInformer := lhInformerFactory.Longhorn().V1alpha1().Engines()
@@ -65,48 +72,121 @@ func StartControllers(stopCh chan struct{}, controllerID, serviceAccount, manage
 	engineImageInformer := lhInformerFactory.Longhorn().V1alpha1().EngineImages()
 	nodeInformer := lhInformerFactory.Longhorn().V1alpha1().Nodes()
 	settingInformer := lhInformerFactory.Longhorn().V1alpha1().Settings()
+	snapshotInformer := lhInformerFactory.Longhorn().V1alpha1().Snapshots()
 
 	podInformer := kubeInformerFactory.Core().V1().Pods()
 	kubeNodeInformer := kubeInformerFactory.Core().V1().Nodes()
 	cronJobInformer := kubeInformerFactory.Batch().V1beta1().CronJobs()
 	daemonSetInformer := kubeInformerFactory.Apps().V1beta2().DaemonSets()
+	eventInformer := kubeNamespaceInformerFactory.Core().V1().Events()
+	persistentVolumeInformer := kubeInformerFactory.Core().V1().PersistentVolumes()
+	persistentVolumeClaimInformer := kubeInformerFactory.Core().V1().PersistentVolumeClaims()
+	volumeAttachmentInformer := kubeInformerFactory.Storage().V1beta1().VolumeAttachments()
 
 	ds := datastore.NewDataStore(
 		volumeInformer, engineInformer, replicaInformer,
 		engineImageInformer, nodeInformer, settingInformer,
-		lhClient,
-		podInformer, cronJobInformer, daemonSetInformer,
+		snapshotInformer, lhClient,
+		podInformer, cronJobInformer, daemonSetInformer, eventInformer,
+		persistentVolumeInformer, persistentVolumeClaimInformer, volumeAttachmentInformer,
 		kubeClient, namespace)
-	rc := NewReplicaController(ds, scheme,
+	rc := NewReplicaController(ds, scheme, controllerConfig,
 		replicaInformer, podInformer,
-		kubeClient, namespace, controllerID)
-	ec := NewEngineController(ds, scheme,
+		kubeClient, &engineapi.InstanceManagerCollection{}, namespace, controllerID)
+	ec := NewEngineController(ds, scheme, controllerConfig,
 		engineInformer, podInformer,
-		kubeClient, &engineapi.EngineCollection{}, namespace, controllerID)
-	vc := NewVolumeController(ds, scheme,
-		volumeInformer, engineInformer, replicaInformer,
+		kubeClient, &engineapi.EngineCollection{}, &engineapi.InstanceManagerCollection{}, namespace, controllerID)
+	vc := NewVolumeController(ds, scheme, controllerConfig,
+		volumeInformer, engineInformer, replicaInformer, nodeInformer,
 		kubeClient, namespace, controllerID,
 		serviceAccount, managerImage)
-	ic := NewEngineImageController(ds, scheme,
+	ic := NewEngineImageController(ds, scheme, controllerConfig,
 		engineImageInformer, volumeInformer, daemonSetInformer,
 		kubeClient, namespace, controllerID)
-	nc := NewNodeController(ds, scheme,
+	nc := NewNodeController(ds, scheme, controllerConfig,
 		nodeInformer, settingInformer, podInformer, replicaInformer, kubeNodeInformer,
 		kubeClient, namespace, controllerID)
+	kpc := NewKubernetesPodController(ds, scheme, controllerConfig,
+		podInformer, volumeInformer, nodeInformer,
+		kubeClient, namespace, controllerID)
+	sc := NewSnapshotController(ds, scheme, controllerConfig,
+		snapshotInformer, volumeInformer, engineInformer,
+		kubeClient, &engineapi.EngineCollection{}, namespace, controllerID)
 	ws := NewWebsocketController(volumeInformer, engineInformer, replicaInformer,
 		settingInformer, engineImageInformer, nodeInformer)
 
+	sw := NewOrphanSweeper(ds, controllerID)
+	scr := NewStorageClassReconciler(ds, controllerID)
+	uc := NewUpgradeChecker(ds, controllerID)
+
+	// the cluster wide work runs on the leader alone, while the node local
+	// work keeps running on every manager
+	leader := NewLeaderElection(kubeClient, namespace, controllerID)
+	vc.isLeaderHandler = leader.IsLeader
+	ic.isLeaderHandler = leader.IsLeader
+	nc.isLeaderHandler = leader.IsLeader
+	kpc.isLeaderHandler = leader.IsLeader
+	sc.isLeaderHandler = leader.IsLeader
+	sw.isLeaderHandler = leader.IsLeader
+	scr.isLeaderHandler = leader.IsLeader
+	uc.isLeaderHandler = leader.IsLeader
+	leader.AddStartedLeadingHandler(enqueueAllObjects(volumeInformer.Informer(), vc.queue))
+	leader.AddStartedLeadingHandler(enqueueAllObjects(engineImageInformer.Informer(), ic.queue))
+	leader.AddStartedLeadingHandler(enqueueAllObjects(nodeInformer.Informer(), nc.queue))
+	leader.AddStartedLeadingHandler(enqueueAllObjects(podInformer.Informer(), kpc.queue))
+	leader.AddStartedLeadingHandler(enqueueAllObjects(snapshotInformer.Informer(), sc.queue))
+
+	health := NewHealth(ds)
+	for _, q := range []*queueHealth{rc.health, ec.health, vc.health, ic.health, nc.health, kpc.health, sc.health} {
+		health.addQueue(q)
+	}
+
 	go kubeInformerFactory.Start(stopCh)
 	go lhInformerFactory.Start(stopCh)
+	go kubeNamespaceInformerFactory.Start(stopCh)
 	if !ds.Sync(stopCh) {
-		return nil, nil, fmt.Errorf("datastore cache sync up failed")
+		return nil, nil, nil, nil, fmt.Errorf("datastore cache sync up failed")
+	}
+	// the controllers must not see the objects of the older versions, e.g.
+	// the ones without the volume label are invisible to the listing by
+	// volume, so they don't start until the objects are migrated
+	if err := ds.MigrateResources(); err != nil {
+		return nil, nil, nil, nil, errors.Wrap(err, "failed to migrate the objects of the older versions")
+	}
+
+	go leader.Run(stopCh)
+	util.RunAsync(wg, func() { rc.Run(Workers, stopCh) })
+	util.RunAsync(wg, func() { ec.Run(Workers, stopCh) })
+	util.RunAsync(wg, func() { vc.Run(Workers, stopCh) })
+	util.RunAsync(wg, func() { ic.Run(Workers, stopCh) })
+	util.RunAsync(wg, func() { nc.Run(Workers, stopCh) })
+	util.RunAsync(wg, func() { kpc.Run(Workers, stopCh) })
+	util.RunAsync(wg, func() { sc.Run(Workers, stopCh) })
+	util.RunAsync(wg, func() { ws.Run(stopCh) })
+	util.RunAsync(wg, func() { sw.Run(stopCh) })
+	util.RunAsync(wg, func() { scr.Run(stopCh) })
+	util.RunAsync(wg, func() { uc.Run(stopCh) })
+
+	return ds, ws, health, leader, nil
+}
+
+// isSpecOrMetaChanged returns if the spec or the metadata of the object is
+// changed during the sync. They are written by update separately from the
+// status, which is written through the status subresource
+func isSpecOrMetaChanged(existingMeta, meta *metav1.ObjectMeta, existingSpec, spec interface{}) bool {
+	return !reflect.DeepEqual(existingMeta, meta) || !reflect.DeepEqual(existingSpec, spec)
+}
+
+// reconcileVolumeLabel sets the volume label of the engine or the replica
+// back if it was removed or modified, since the objects of the volume are
+// listed by it
+func reconcileVolumeLabel(meta *metav1.ObjectMeta, volumeName string) {
+	if meta.Labels[datastore.LonghornVolumeKey] == volumeName {
+		return
+	}
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
 	}
-	go rc.Run(Workers, stopCh)
-	go ec.Run(Workers, stopCh)
-	go vc.Run(Workers, stopCh)
-	go ic.Run(Workers, stopCh)
-	go nc.Run(Workers, stopCh)
-	go ws.Run(stopCh)
-
-	return ds, ws, nil
+	logrus.Infof("Reset the volume label of %v from %q to %v", meta.Name, meta.Labels[datastore.LonghornVolumeKey], volumeName)
+	meta.Labels[datastore.LonghornVolumeKey] = volumeName
 }
@@ -39,12 +39,18 @@ const (
 
 	TestTimeNow = "2015-01-02T00:00:00Z"
 
-	TestDefaultDataPath   = "/var/lib/rancher/longhorn"
-	TestDaemon1           = "longhorn-manager-1"
-	TestDaemon2           = "longhorn-manager-2"
-	TestDiskID1           = "fsid"
-	TestDiskSize          = 5000000000
-	TestDiskAvailableSize = 3000000000
+	TestDefaultDataPath        = "/var/lib/rancher/longhorn"
+	TestDaemon1                = "longhorn-manager-1"
+	TestDaemon2                = "longhorn-manager-2"
+	TestDiskID1                = "fsid"
+	TestDiskID2                = "fsid2"
+	TestDiskPath2              = "/mnt/disk2"
+	TestDiskPathReadOnly       = "/mnt/read-only"
+	TestDiskUUID               = "disk-uuid"
+	TestReplicaDirName         = "test-volume-r-existing"
+	TestOrphanedReplicaDirName = "test-volume-r-orphaned"
+	TestDiskSize               = 5000000000
+	TestDiskAvailableSize      = 3000000000
 )
 
 var (
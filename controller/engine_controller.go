@@ -3,6 +3,7 @@ package controller
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,6 +19,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
 	clientset "k8s.io/client-go/kubernetes"
@@ -30,6 +32,7 @@ import (
 	"github.com/rancher/longhorn-manager/datastore"
 	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
 
 	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
 	lhinformers "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions/longhorn/v1alpha1"
@@ -51,6 +54,11 @@ var (
 
 	EnginePollInterval = 5 * time.Second
 	EnginePollTimeout  = 30 * time.Second
+
+	ReplicaFileStatsRefreshInterval = 1 * time.Minute
+	SnapshotRefreshInterval         = 30 * time.Second
+
+	monitorStopCheckInterval = 100 * time.Millisecond
 )
 
 type EngineController struct {
@@ -67,7 +75,9 @@ type EngineController struct {
 	eStoreSynced cache.InformerSynced
 	pStoreSynced cache.InformerSynced
 
-	queue workqueue.RateLimitingInterface
+	queue  workqueue.RateLimitingInterface
+	health *queueHealth
+	logger logrus.FieldLogger
 
 	instanceHandler *InstanceHandler
 
@@ -75,12 +85,17 @@ type EngineController struct {
 	engineMonitorMutex       *sync.RWMutex
 	engineMonitorMap         map[string]chan struct{}
 	engineMonitoringRemoveCh chan string
+
+	// stopCh is closed when the manager is shutting down, which the long
+	// running operations of the syncs observe
+	stopCh <-chan struct{}
 }
 
 type EngineMonitor struct {
 	namespace     string
 	ds            *datastore.DataStore
 	eventRecorder record.EventRecorder
+	logger        logrus.FieldLogger
 
 	Name    string
 	engines engineapi.EngineClientCollection
@@ -89,15 +104,20 @@ type EngineMonitor struct {
 	controllerID string
 	// used to notify the controller that monitoring has stopped
 	monitoringRemoveCh chan string
+
+	lastReplicaFileStatsRefresh time.Time
+	lastSnapshotRefresh         time.Time
 }
 
 func NewEngineController(
 	ds *datastore.DataStore,
 	scheme *runtime.Scheme,
+	config ControllerConfig,
 	engineInformer lhinformers.EngineInformer,
 	podInformer coreinformers.PodInformer,
 	kubeClient clientset.Interface,
 	engines engineapi.EngineClientCollection,
+	instanceManagers engineapi.InstanceManagerClientCollection,
 	namespace string, controllerID string) *EngineController {
 
 	eventBroadcaster := record.NewBroadcaster()
@@ -115,14 +135,17 @@ func NewEngineController(
 		eStoreSynced:  engineInformer.Informer().HasSynced,
 		pStoreSynced:  podInformer.Informer().HasSynced,
 
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "longhorn-engine"),
+		queue:  config.newQueue("longhorn-engine"),
+		logger: newControllerLogger("longhorn-engine"),
 
 		engines:                  engines,
 		engineMonitorMutex:       &sync.RWMutex{},
 		engineMonitorMap:         map[string]chan struct{}{},
 		engineMonitoringRemoveCh: make(chan string, 1),
 	}
-	ec.instanceHandler = NewInstanceHandler(podInformer, kubeClient, namespace, ec, ec.eventRecorder)
+	ec.health = newQueueHealth("longhorn-engine", ec.queue)
+	ec.instanceHandler = NewInstanceHandler(ds, podInformer, kubeClient, namespace,
+		types.InstanceManagerTypeEngine, ec, instanceManagers, ec.eventRecorder, ec.logger)
 
 	engineInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -158,18 +181,17 @@ func (ec *EngineController) Run(workers int, stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
 	defer ec.queue.ShutDown()
 
-	logrus.Infof("Start Longhorn engine controller")
-	defer logrus.Infof("Shutting down Longhorn engine controller")
+	ec.logger.Infof("Start Longhorn engine controller")
+	defer ec.logger.Infof("Shutting down Longhorn engine controller")
 
 	if !controller.WaitForCacheSync("longhorn engines", stopCh, ec.eStoreSynced, ec.pStoreSynced) {
 		return
 	}
 
-	for i := 0; i < workers; i++ {
-		go wait.Until(ec.worker, time.Second, stopCh)
-	}
-
-	<-stopCh
+	ec.stopCh = stopCh
+	runWorkers(workers, ec.worker, ec.queue, stopCh)
+	// no monitor would be started once the syncs are done
+	ec.stopAllMonitoring()
 }
 
 func (ec *EngineController) worker() {
@@ -184,6 +206,7 @@ func (ec *EngineController) processNextWorkItem() bool {
 		return false
 	}
 	defer ec.queue.Done(key)
+	defer ec.health.processed()
 
 	err := ec.syncEngine(key.(string))
 	ec.handleErr(err, key)
@@ -198,13 +221,13 @@ func (ec *EngineController) handleErr(err error, key interface{}) {
 	}
 
 	if ec.queue.NumRequeues(key) < maxRetries {
-		logrus.Warnf("Error syncing Longhorn engine %v: %v", key, err)
+		ec.logger.WithField("engine", key).Warnf("Error syncing Longhorn engine: %v", err)
 		ec.queue.AddRateLimited(key)
 		return
 	}
 
 	utilruntime.HandleError(err)
-	logrus.Warnf("Dropping Longhorn engine %v out of the queue: %v", key, err)
+	ec.logger.WithField("engine", key).Warnf("Dropping Longhorn engine out of the queue: %v", err)
 	ec.queue.Forget(key)
 }
 
@@ -224,7 +247,7 @@ func (ec *EngineController) syncEngine(key string) (err error) {
 	engine, err := ec.ds.GetEngine(name)
 	if err != nil {
 		if datastore.ErrorIsNotFound(err) {
-			logrus.Infof("Longhorn engine %v has been deleted", key)
+			ec.logger.WithField("engine", key).Infof("Longhorn engine has been deleted")
 			return nil
 		}
 		return err
@@ -237,7 +260,7 @@ func (ec *EngineController) syncEngine(key string) (err error) {
 
 	if engine.DeletionTimestamp != nil {
 		// don't go through state transition because it can go wrong
-		if err := ec.instanceHandler.DeleteInstanceForObject(engine); err != nil {
+		if err := ec.instanceHandler.DeleteInstanceForObject(engine, &engine.Status.InstanceStatus); err != nil {
 			return err
 		}
 		return ec.ds.RemoveFinalizerForEngine(engine)
@@ -247,20 +270,41 @@ func (ec *EngineController) syncEngine(key string) (err error) {
 	defer func() {
 		// we're going to update engine assume things changes
 		if err == nil && !reflect.DeepEqual(existingEngine, engine) {
-			_, err = ec.ds.UpdateEngine(engine)
+			// the spec is written by update and the status through the
+			// status subresource, so writing the status won't clobber the
+			// spec changed by others in the meantime
+			status := engine.Status
+			updated := engine
+			if isSpecOrMetaChanged(&existingEngine.ObjectMeta, &engine.ObjectMeta, existingEngine.Spec, engine.Spec) {
+				updated, err = ec.ds.UpdateEngine(engine)
+			}
+			if err == nil && !reflect.DeepEqual(existingEngine.Status, status) {
+				// the status is owned by the controller, so it can be
+				// applied on top of the changes by others
+				_, err = ec.ds.UpdateEngineStatusWithRetry(updated, func(e *longhorn.Engine) {
+					e.Status = status
+				})
+			}
 		}
 		// requeue if it's conflict
 		if apierrors.IsConflict(errors.Cause(err)) {
-			logrus.Debugf("Requeue %v due to conflict", key)
+			getLoggerForEngine(ec.logger, engine).Debugf("Requeue engine due to conflict")
 			ec.enqueueEngine(engine)
 			err = nil
 		}
 	}()
 
+	reconcileVolumeLabel(&engine.ObjectMeta, engine.Spec.VolumeName)
+
 	if err := ec.instanceHandler.ReconcileInstanceState(engine, &engine.Spec.InstanceSpec, &engine.Status.InstanceStatus); err != nil {
 		return err
 	}
 
+	if engine.Status.CurrentState != types.InstanceStateRunning {
+		// the limits are gone with the engine process
+		engine.Status.CurrentQoS = types.VolumeQoS{}
+	}
+
 	if engine.Status.CurrentState == types.InstanceStateRunning {
 		// we allow across monitoring temporaily due to migration case
 		if !ec.isMonitoring(engine) {
@@ -311,11 +355,27 @@ func (ec *EngineController) CreatePodSpec(obj interface{}) (*v1.Pod, error) {
 		return nil, fmt.Errorf("BUG: invalid object for engine pod spec creation: %v", obj)
 	}
 	if err := validateEngine(e); err != nil {
-		logrus.Errorf("Invalid spec for create controller: %v", e)
+		getLoggerForEngine(ec.logger, e).Errorf("Invalid spec for create controller: %v", e)
+		return nil, err
+	}
+	tolerations, err := ec.ds.GetSettingTaintToleration()
+	if err != nil {
 		return nil, err
 	}
 
-	if e.Spec.Frontend == types.VolumeFrontendBlockDev {
+	if e.Spec.DisableFrontend {
+		// no frontend to check, so check the controller is serving
+		port, err := strconv.Atoi(engineapi.ControllerDefaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("BUG: Invalid controller default port %v", engineapi.ControllerDefaultPort)
+		}
+		readinessHandler = v1.Handler{
+			HTTPGet: &v1.HTTPGetAction{
+				Path: "/v1/",
+				Port: intstr.FromInt(port),
+			},
+		}
+	} else if e.Spec.Frontend == types.VolumeFrontendBlockDev {
 		frontend = EngineFrontendBlockDev
 		readinessHandler = v1.Handler{
 			Exec: &v1.ExecAction{
@@ -345,12 +405,16 @@ func (ec *EngineController) CreatePodSpec(obj interface{}) (*v1.Pod, error) {
 		"--launcher-listen", "0.0.0.0:" + engineapi.EngineLauncherDefaultPort,
 		"--longhorn-binary", types.DefaultEngineBinaryPath,
 		"--listen", "0.0.0.0:" + engineapi.ControllerDefaultPort,
-		"--frontend", frontend,
-		"--size", strconv.FormatInt(e.Spec.VolumeSize, 10),
 	}
-	for _, ip := range e.Spec.ReplicaAddressMap {
-		url := engineapi.GetReplicaDefaultURL(ip)
-		cmd = append(cmd, "--replica", url)
+	if frontend != "" {
+		cmd = append(cmd, "--frontend", frontend)
+		if e.Spec.FrontendReadOnly {
+			cmd = append(cmd, "--frontend-readonly")
+		}
+	}
+	cmd = append(cmd, "--size", strconv.FormatInt(e.Spec.VolumeSize, 10))
+	for _, address := range e.Spec.ReplicaAddressMap {
+		cmd = append(cmd, "--replica", engineapi.GetReplicaURL(address))
 	}
 	cmd = append(cmd, e.Spec.VolumeName)
 
@@ -371,6 +435,7 @@ func (ec *EngineController) CreatePodSpec(obj interface{}) (*v1.Pod, error) {
 		Spec: v1.PodSpec{
 			NodeName:      e.Spec.NodeID,
 			RestartPolicy: v1.RestartPolicyNever,
+			Tolerations:   tolerations,
 			Containers: []v1.Container{
 				{
 					Name:    e.Name,
@@ -432,10 +497,51 @@ func (ec *EngineController) CreatePodSpec(obj interface{}) (*v1.Pod, error) {
 	return pod, nil
 }
 
+// CreateProcessSpec returns the engine process started by the engine instance
+// manager, which serves the frontend without the launcher
+func (ec *EngineController) CreateProcessSpec(obj interface{}) (*engineapi.ProcessSpec, error) {
+	e, ok := obj.(*longhorn.Engine)
+	if !ok {
+		return nil, fmt.Errorf("BUG: invalid object for engine process spec creation: %v", obj)
+	}
+	if err := validateEngine(e); err != nil {
+		getLoggerForEngine(ec.logger, e).Errorf("Invalid spec for create controller: %v", e)
+		return nil, err
+	}
+
+	args := []string{"controller", e.Spec.VolumeName}
+	if !e.Spec.DisableFrontend {
+		switch e.Spec.Frontend {
+		case types.VolumeFrontendBlockDev:
+			args = append(args, "--frontend", EngineFrontendBlockDev)
+		case types.VolumeFrontendISCSI:
+			args = append(args, "--frontend", EngineFrontendISCSI)
+		default:
+			return nil, fmt.Errorf("unknown volume frontend %v", e.Spec.Frontend)
+		}
+		if e.Spec.FrontendReadOnly {
+			args = append(args, "--frontend-readonly")
+		}
+	}
+	for _, address := range e.Spec.ReplicaAddressMap {
+		args = append(args, "--replica", engineapi.GetReplicaURL(address))
+	}
+	return &engineapi.ProcessSpec{
+		Binary:    types.DefaultEngineBinaryPath,
+		Args:      args,
+		PortCount: engineapi.EngineProcessPortCount,
+		PortArgs:  []string{"--listen,0.0.0.0:"},
+	}, nil
+}
+
 func (ec *EngineController) enqueueControlleeChange(obj interface{}) {
 	metaObj, err := meta.Accessor(obj)
 	if err != nil {
-		logrus.Warnf("BUG: %v cannot be convert to metav1.Object: %v", obj, err)
+		ec.logger.Warnf("BUG: %v cannot be convert to metav1.Object: %v", obj, err)
+		return
+	}
+	if types.IsInstanceManagerPod(metaObj.GetLabels()) {
+		ec.enqueueInstanceManagerChange(metaObj)
 		return
 	}
 	ownerRefs := metaObj.GetOwnerReferences()
@@ -449,6 +555,24 @@ func (ec *EngineController) enqueueControlleeChange(obj interface{}) {
 	}
 }
 
+// enqueueInstanceManagerChange enqueues the engines running as the processes
+// of the engine instance manager
+func (ec *EngineController) enqueueInstanceManagerChange(im metav1.Object) {
+	if im.GetLabels()[types.LonghornInstanceManagerTypeKey] != string(types.InstanceManagerTypeEngine) {
+		return
+	}
+	engines, err := ec.ds.ListEnginesRO()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Couldn't list engines for instance manager %v: %v", im.GetName(), err))
+		return
+	}
+	for _, e := range engines {
+		if e.Status.InstanceManagerName == im.GetName() && e.Spec.OwnerID == ec.controllerID {
+			ec.enqueueEngine(e)
+		}
+	}
+}
+
 func (ec *EngineController) ResolveRefAndEnqueue(namespace string, ref *metav1.OwnerReference) {
 	if ref.Kind != ownerKindEngine {
 		return
@@ -489,6 +613,31 @@ func (ec *EngineController) removeFromEngineMonitorMap(engineName string) {
 	}
 }
 
+// stopAllMonitoring stops the engine monitors on shutdown, and waits for
+// them to exit so no refresh is cut off halfway. Unlike stopMonitoring, the
+// monitoring status of the engines is kept for the next manager to pick up.
+func (ec *EngineController) stopAllMonitoring() {
+	ec.engineMonitorMutex.RLock()
+	for _, stopCh := range ec.engineMonitorMap {
+		// the monitor may be stopping by itself already
+		select {
+		case stopCh <- struct{}{}:
+		default:
+		}
+	}
+	ec.engineMonitorMutex.RUnlock()
+
+	for {
+		ec.engineMonitorMutex.RLock()
+		count := len(ec.engineMonitorMap)
+		ec.engineMonitorMutex.RUnlock()
+		if count == 0 {
+			return
+		}
+		time.Sleep(monitorStopCheckInterval)
+	}
+}
+
 func (ec *EngineController) isMonitoring(e *longhorn.Engine) bool {
 	ec.engineMonitorMutex.RLock()
 	defer ec.engineMonitorMutex.RUnlock()
@@ -500,12 +649,12 @@ func (ec *EngineController) isMonitoring(e *longhorn.Engine) bool {
 func (ec *EngineController) startMonitoring(e *longhorn.Engine) {
 	client, err := GetClientForEngine(e, ec.engines, e.Status.CurrentImage)
 	if err != nil {
-		logrus.Warnf("Failed to start monitoring %v, cannot create engine client", e.Name)
+		getLoggerForEngine(ec.logger, e).Warnf("Failed to start monitoring, cannot create engine client")
 		return
 	}
 	endpoint := client.Endpoint()
 	if endpoint == "" {
-		logrus.Warnf("Failed to start monitoring %v, cannot connect", e.Name)
+		getLoggerForEngine(ec.logger, e).Warnf("Failed to start monitoring, cannot connect")
 		return
 	}
 
@@ -519,6 +668,7 @@ func (ec *EngineController) startMonitoring(e *longhorn.Engine) {
 		namespace:          e.Namespace,
 		ds:                 ec.ds,
 		eventRecorder:      ec.eventRecorder,
+		logger:             getLoggerForEngine(ec.logger, e),
 		engines:            ec.engines,
 		stopCh:             stopCh,
 		controllerID:       ec.controllerID,
@@ -529,7 +679,7 @@ func (ec *EngineController) startMonitoring(e *longhorn.Engine) {
 	defer ec.engineMonitorMutex.Unlock()
 
 	if _, ok := ec.engineMonitorMap[e.Name]; ok {
-		logrus.Warnf("BUG: Monitoring for %v already exists", e.Name)
+		monitor.logger.Warnf("BUG: Monitoring for the engine already exists")
 		return
 	}
 	ec.engineMonitorMap[e.Name] = stopCh
@@ -549,7 +699,7 @@ func (ec *EngineController) stopMonitoring(e *longhorn.Engine) {
 
 	stopCh, ok := ec.engineMonitorMap[e.Name]
 	if !ok {
-		logrus.Warnf("engine %v: stop monitoring called when there is no monitoring", e.Name)
+		getLoggerForEngine(ec.logger, e).Warnf("Stop monitoring called when there is no monitoring")
 		return
 	}
 	stopCh <- struct{}{}
@@ -557,17 +707,17 @@ func (ec *EngineController) stopMonitoring(e *longhorn.Engine) {
 }
 
 func (m *EngineMonitor) Run() {
-	logrus.Debugf("Start monitoring %v", m.Name)
+	m.logger.Debugf("Start monitoring")
 	defer func() {
 		m.monitoringRemoveCh <- m.Name
-		logrus.Debugf("Stop monitoring %v", m.Name)
+		m.logger.Debugf("Stop monitoring")
 	}()
 
 	wait.Until(func() {
 		engine, err := m.ds.GetEngine(m.Name)
 		if err != nil {
 			if datastore.ErrorIsNotFound(err) {
-				logrus.Infof("stop engine %v monitoring because the engine no longer exists", m.Name)
+				m.logger.Infof("Stop monitoring because the engine no longer exists")
 				m.stop(engine)
 				return
 			}
@@ -577,8 +727,7 @@ func (m *EngineMonitor) Run() {
 
 		// when engine stopped, nodeID will be empty as well
 		if engine.Spec.OwnerID != m.controllerID {
-			logrus.Infof("stop engine %v monitoring because the engine is no longer running on node %v",
-				m.Name, m.controllerID)
+			m.logger.Infof("Stop monitoring because the engine is no longer running on node %v", m.controllerID)
 			m.stop(engine)
 			return
 		}
@@ -595,6 +744,21 @@ func (m *EngineMonitor) Run() {
 
 		if err := m.refresh(engine); err != nil {
 			utilruntime.HandleError(errors.Wrapf(err, "fail to update status for engine %v", m.Name))
+			return
+		}
+
+		if time.Since(m.lastReplicaFileStatsRefresh) > ReplicaFileStatsRefreshInterval {
+			m.lastReplicaFileStatsRefresh = time.Now()
+			if err := m.refreshReplicaFileStats(engine); err != nil {
+				utilruntime.HandleError(errors.Wrapf(err, "fail to update replica file stats for engine %v", m.Name))
+			}
+		}
+
+		if time.Since(m.lastSnapshotRefresh) > SnapshotRefreshInterval {
+			m.lastSnapshotRefresh = time.Now()
+			if err := m.refreshSnapshots(engine); err != nil {
+				utilruntime.HandleError(errors.Wrapf(err, "fail to update snapshots for engine %v", m.Name))
+			}
 		}
 	}, EnginePollInterval, m.stopCh)
 }
@@ -614,7 +778,7 @@ func (m *EngineMonitor) refresh(engine *longhorn.Engine) error {
 	addressReplicaMap := map[string]string{}
 	for replica, address := range engine.Spec.ReplicaAddressMap {
 		if addressReplicaMap[address] != "" {
-			return fmt.Errorf("invalid ReplicaAddressMap: duplicate IPs")
+			return fmt.Errorf("invalid ReplicaAddressMap: duplicate addresses")
 		}
 		addressReplicaMap[address] = replica
 	}
@@ -631,11 +795,11 @@ func (m *EngineMonitor) refresh(engine *longhorn.Engine) error {
 
 	currentReplicaModeMap := map[string]types.ReplicaMode{}
 	for url, r := range replicaURLModeMap {
-		ip := engineapi.GetIPFromURL(url)
-		replica, exists := addressReplicaMap[ip]
+		address := engineapi.GetReplicaAddressFromURL(url)
+		replica, exists := addressReplicaMap[address]
 		if !exists {
 			// we have a entry doesn't exist in our spec
-			replica = unknownReplicaPrefix + ip
+			replica = unknownReplicaPrefix + address
 		}
 		currentReplicaModeMap[replica] = r.Mode
 
@@ -643,22 +807,161 @@ func (m *EngineMonitor) refresh(engine *longhorn.Engine) error {
 			if r.Mode != engine.Status.ReplicaModeMap[replica] {
 				switch r.Mode {
 				case types.ReplicaModeERR:
-					m.eventRecorder.Eventf(engine, v1.EventTypeWarning, EventReasonFaulted, "Detected replica %v (%v) in error", replica, ip)
+					m.eventRecorder.Eventf(engine, v1.EventTypeWarning, EventReasonFaulted, "Detected replica %v (%v) in error", replica, address)
 				case types.ReplicaModeWO:
-					m.eventRecorder.Eventf(engine, v1.EventTypeNormal, EventReasonRebuilding, "Detected rebuilding replica %v (%v)", replica, ip)
+					m.eventRecorder.Eventf(engine, v1.EventTypeNormal, EventReasonRebuilding, "Detected rebuilding replica %v (%v)", replica, address)
 				case types.ReplicaModeRW:
-					m.eventRecorder.Eventf(engine, v1.EventTypeNormal, EventReasonRebuilded, "Detected replica %v (%v) has been rebuilded", replica, ip)
+					m.eventRecorder.Eventf(engine, v1.EventTypeNormal, EventReasonRebuilded, "Detected replica %v (%v) has been rebuilded", replica, address)
 				default:
-					logrus.Errorf("Invalid engine replica mode %v", r.Mode)
+					m.logger.WithField("replica", replica).Errorf("Invalid engine replica mode %v", r.Mode)
 				}
 			}
 		}
 	}
 	if !reflect.DeepEqual(engine.Status.ReplicaModeMap, currentReplicaModeMap) {
 		engine.Status.ReplicaModeMap = currentReplicaModeMap
-		_, err = m.ds.UpdateEngine(engine)
+		_, err = m.ds.UpdateEngineStatusWithRetry(engine, func(e *longhorn.Engine) {
+			e.Status.ReplicaModeMap = currentReplicaModeMap
+		})
+		return err
+	}
+	return nil
+}
+
+// refreshReplicaFileStats updates the file stats of the healthy replicas
+// with the information provided by the engine
+func (m *EngineMonitor) refreshReplicaFileStats(engine *longhorn.Engine) error {
+	client, err := GetClientForEngine(engine, m.engines, engine.Status.CurrentImage)
+	if err != nil {
 		return err
 	}
+
+	for name, address := range engine.Spec.ReplicaAddressMap {
+		if engine.Status.ReplicaModeMap[name] != types.ReplicaModeRW {
+			continue
+		}
+		info, err := client.ReplicaInfo(engineapi.GetReplicaURL(address))
+		if err != nil {
+			m.logger.WithField("replica", name).Warnf("Cannot get info of replica: %v", err)
+			continue
+		}
+		stats, err := engineapi.GetReplicaFileStats(info)
+		if err != nil {
+			m.logger.WithField("replica", name).Warnf("Cannot get file stats of replica: %v", err)
+			continue
+		}
+		r, err := m.ds.GetReplica(name)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if reflect.DeepEqual(r.Status.FileStats, *stats) {
+			continue
+		}
+		if _, err := m.ds.UpdateReplicaStatusWithRetry(r, func(r *longhorn.Replica) {
+			r.Status.FileStats = *stats
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshSnapshots brings the snapshots in the engine to the snapshot objects
+// of the volume. The snapshots taken behind the objects, e.g. by the
+// recurring jobs, get the objects of their own, and the objects of the
+// snapshots which have been purged from the engine are deleted.
+func (m *EngineMonitor) refreshSnapshots(engine *longhorn.Engine) error {
+	v, err := m.ds.GetVolumeRO(engine.Spec.VolumeName)
+	if err != nil {
+		return err
+	}
+	if v.DeletionTimestamp != nil || v.Spec.MigrationNodeID != "" {
+		return nil
+	}
+
+	// the objects are listed before the engine, so the object of the
+	// snapshot created after the listing of the engine won't be taken as
+	// purged
+	snapshots, err := m.ds.ListSnapshotsByVolumeRO(v.Name)
+	if err != nil {
+		return err
+	}
+	client, err := GetClientForEngine(engine, m.engines, engine.Status.CurrentImage)
+	if err != nil {
+		return err
+	}
+	engineSnapshots, err := client.SnapshotList()
+	if err != nil {
+		return err
+	}
+
+	existingSnapshots := map[string]struct{}{}
+	for _, snapshot := range snapshots {
+		existingSnapshots[snapshot.Name] = struct{}{}
+		if snapshot.DeletionTimestamp != nil {
+			continue
+		}
+		engineSnapshot := engineSnapshots[snapshot.Name]
+		if engineSnapshot == nil {
+			// the snapshot not created yet is left to the snapshot
+			// controller
+			if snapshot.Status.CreationTime == "" {
+				continue
+			}
+			if err := m.ds.DeleteSnapshot(snapshot.Name); err != nil && !datastore.ErrorIsNotFound(err) {
+				return err
+			}
+			m.logger.WithField("snapshot", snapshot.Name).Infof("Deleted the snapshot which no longer exists in the engine")
+			continue
+		}
+		status := snapshot.Status
+		syncSnapshotStatus(&status, engineSnapshot)
+		if reflect.DeepEqual(status, snapshot.Status) {
+			continue
+		}
+		if _, err := m.ds.UpdateSnapshotStatusWithRetry(snapshot, func(snapshot *longhorn.Snapshot) {
+			syncSnapshotStatus(&snapshot.Status, engineSnapshot)
+		}); err != nil && !datastore.ErrorIsNotFound(err) {
+			return err
+		}
+	}
+
+	for name, engineSnapshot := range engineSnapshots {
+		if _, exists := existingSnapshots[name]; exists || engineSnapshot.Removed {
+			continue
+		}
+		// e.g. the snapshots taken by the older managers
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+			m.logger.WithField("snapshot", name).Debugf("Cannot represent the snapshot by the object: %v", errs)
+			continue
+		}
+		snapshot, err := m.ds.CreateSnapshot(&longhorn.Snapshot{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				OwnerReferences: getOwnerReferencesForVolume(v),
+			},
+			Spec: types.SnapshotSpec{
+				Volume: v.Name,
+				Labels: engineSnapshot.Labels,
+			},
+		})
+		if err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				m.logger.WithField("snapshot", name).Warnf("Cannot create the snapshot object, the name is taken by the snapshot of another volume")
+				continue
+			}
+			return err
+		}
+		if _, err := m.ds.UpdateSnapshotStatusWithRetry(snapshot, func(snapshot *longhorn.Snapshot) {
+			syncSnapshotStatus(&snapshot.Status, engineSnapshot)
+		}); err != nil {
+			return err
+		}
+		m.logger.WithField("snapshot", name).Debugf("Created the snapshot object for the snapshot in the engine")
+	}
 	return nil
 }
 
@@ -669,6 +972,39 @@ func (ec *EngineController) ReconcileEngineState(e *longhorn.Engine) error {
 	if err := ec.rebuildingNewReplica(e); err != nil {
 		return err
 	}
+	if err := ec.syncQoS(e); err != nil {
+		return err
+	}
+	return nil
+}
+
+// syncQoS applies the I/O limits in the spec to the running engine. The
+// engine image not supporting them is skipped, and reported by the volume
+// condition qosSupported.
+func (ec *EngineController) syncQoS(e *longhorn.Engine) error {
+	if e.Status.CurrentQoS == e.Spec.QoS {
+		return nil
+	}
+	ei, err := ec.ds.GetEngineImage(types.GetEngineImageChecksumName(e.Status.CurrentImage))
+	if err != nil {
+		return err
+	}
+	if ei.Status.CLIAPIVersion < engineapi.QoSMinCLIAPIVersion {
+		getLoggerForEngine(ec.logger, e).Debugf("Engine image %v doesn't support QoS, skip applying %+v", e.Status.CurrentImage, e.Spec.QoS)
+		return nil
+	}
+	client, err := GetClientForEngine(e, ec.engines, e.Status.CurrentImage)
+	if err != nil {
+		return err
+	}
+	qos := e.Spec.QoS
+	if err := client.QoSSet(&qos); err != nil {
+		return err
+	}
+	e.Status.CurrentQoS = qos
+	ec.eventRecorder.Eventf(e, v1.EventTypeNormal, EventReasonQoSApplied,
+		"Applied QoS read IOPS %v, write IOPS %v, read bandwidth %vMB/s, write bandwidth %vMB/s",
+		qos.ReadIOPS, qos.WriteIOPS, qos.ReadBandwidth, qos.WriteBandwidth)
 	return nil
 }
 
@@ -686,6 +1022,7 @@ func GetClientForEngine(e *longhorn.Engine, engines engineapi.EngineClientCollec
 		VolumeName:  e.Spec.VolumeName,
 		EngineImage: image,
 		IP:          e.Status.IP,
+		Port:        e.Status.Port,
 	})
 	if err != nil {
 		return nil, err
@@ -694,14 +1031,14 @@ func GetClientForEngine(e *longhorn.Engine, engines engineapi.EngineClientCollec
 }
 
 func (ec *EngineController) removeUnknownReplica(e *longhorn.Engine) error {
-	unknownReplicaIPs := []string{}
+	unknownReplicaAddresses := []string{}
 	for replica := range e.Status.ReplicaModeMap {
-		// unknown replicas have been named as `unknownReplicaPrefix-<IP>`
+		// unknown replicas have been named as `unknownReplicaPrefix-<address>`
 		if strings.HasPrefix(replica, unknownReplicaPrefix) {
-			unknownReplicaIPs = append(unknownReplicaIPs, strings.TrimPrefix(replica, unknownReplicaPrefix))
+			unknownReplicaAddresses = append(unknownReplicaAddresses, strings.TrimPrefix(replica, unknownReplicaPrefix))
 		}
 	}
-	if len(unknownReplicaIPs) == 0 {
+	if len(unknownReplicaAddresses) == 0 {
 		return nil
 	}
 
@@ -709,20 +1046,27 @@ func (ec *EngineController) removeUnknownReplica(e *longhorn.Engine) error {
 	if err != nil {
 		return err
 	}
-	for _, ip := range unknownReplicaIPs {
-		go func(ip string) {
-			url := engineapi.GetReplicaDefaultURL(ip)
+	for _, address := range unknownReplicaAddresses {
+		go func(address string) {
+			url := engineapi.GetReplicaURL(address)
 			if err := client.ReplicaRemove(url); err != nil {
-				ec.eventRecorder.Eventf(e, v1.EventTypeWarning, EventReasonFailedDeleting, "Failed to remove unknown replica IP %v from engine: %v", ip, err)
+				ec.eventRecorder.Eventf(e, v1.EventTypeWarning, EventReasonFailedDeleting, "Failed to remove unknown replica address %v from engine: %v", address, err)
 			} else {
-				ec.eventRecorder.Eventf(e, v1.EventTypeNormal, EventReasonDelete, "Removed unknown replica IP %v from engine", ip)
+				ec.eventRecorder.Eventf(e, v1.EventTypeNormal, EventReasonDelete, "Removed unknown replica address %v from engine", address)
 			}
-		}(ip)
+		}(address)
 	}
 	return nil
 }
 
 func (ec *EngineController) rebuildingNewReplica(e *longhorn.Engine) error {
+	// only keep the rebuild records of the replicas still belong to the engine
+	for replica := range e.Status.RebuildStatus {
+		if _, exists := e.Spec.ReplicaAddressMap[replica]; !exists {
+			delete(e.Status.RebuildStatus, replica)
+		}
+	}
+
 	rebuildingInProgress := false
 	replicaExists := make(map[string]bool)
 	for replica, mode := range e.Status.ReplicaModeMap {
@@ -734,36 +1078,40 @@ func (ec *EngineController) rebuildingNewReplica(e *longhorn.Engine) error {
 	}
 	// We cannot rebuild more than one replica at one time
 	if rebuildingInProgress {
-		logrus.Debugf("Skip rebuilding for volume %v because there is rebuilding in process", e.Spec.VolumeName)
+		getLoggerForEngine(ec.logger, e).Debugf("Skip rebuilding because there is rebuilding in process")
 		return nil
 	}
-	for replica, ip := range e.Spec.ReplicaAddressMap {
+	for replica, address := range e.Spec.ReplicaAddressMap {
 		// one is enough
 		if !replicaExists[replica] {
-			return ec.startRebuilding(e, replica, ip)
+			return ec.startRebuilding(e, replica, address)
 		}
 	}
 	return nil
 }
 
-func doesIPExistInEngine(ip string, client engineapi.EngineClient) (bool, error) {
+func doesAddressExistInEngine(address string, client engineapi.EngineClient) (bool, error) {
 	replicaURLModeMap, err := client.ReplicaList()
 	if err != nil {
 		return false, err
 	}
 	for url := range replicaURLModeMap {
 		// the replica has been rebuilt or in the process already
-		if ip == engineapi.GetIPFromURL(url) {
+		if address == engineapi.GetReplicaAddressFromURL(url) {
 			return true, nil
 		}
 	}
 	return false, nil
 }
 
-func (ec *EngineController) startRebuilding(e *longhorn.Engine, replica, ip string) (err error) {
+func (ec *EngineController) startRebuilding(e *longhorn.Engine, replica, address string) (err error) {
 	defer func() {
 		err = errors.Wrapf(err, "fail to start rebuild for %v of %v", replica, e.Name)
 	}()
+	log := getLoggerForEngine(ec.logger, e).WithFields(logrus.Fields{
+		"replica":        replica,
+		"replicaAddress": address,
+	})
 
 	client, err := GetClientForEngine(e, ec.engines, e.Status.CurrentImage)
 	if err != nil {
@@ -772,54 +1120,243 @@ func (ec *EngineController) startRebuilding(e *longhorn.Engine, replica, ip stri
 
 	// we need to know the current status, since ReplicaAddressMap may
 	// haven't been updated since last rebuild
-	alreadyExists, err := doesIPExistInEngine(ip, client)
+	alreadyExists, err := doesAddressExistInEngine(address, client)
 	if err != nil {
 		return err
 	}
 	// replica has already been added to the engine
 	if alreadyExists {
-		logrus.Debugf("replica %v ip %v has been added to the engine already", replica, ip)
+		log.Debugf("Replica has been added to the engine already")
 		return nil
 	}
 
-	replicaURL := engineapi.GetReplicaDefaultURL(ip)
+	// the engine will choose the source by itself if we cannot find a
+	// preferred one
+	source, err := ec.getRebuildSource(e, replica)
+	if err != nil {
+		log.Warnf("Cannot decide rebuild source for replica, let engine choose: %v", err)
+		source = nil
+	}
+	rebuildStatus := types.RebuildStatus{
+		StartedAt: util.Now(),
+	}
+	sourceURL := ""
+	sourceDesc := "source chosen by engine"
+	if source != nil {
+		sourceURL = engineapi.GetReplicaURL(source.Address)
+		sourceDesc = fmt.Sprintf("source replica %v on node %v", source.Replica, source.NodeID)
+		rebuildStatus.SourceReplica = source.Replica
+		rebuildStatus.SourceNodeID = source.NodeID
+		rebuildStatus.SourceZone = source.Zone
+		rebuildStatus.SameZone = source.SameZone
+	}
+	if e.Status.RebuildStatus == nil {
+		e.Status.RebuildStatus = map[string]types.RebuildStatus{}
+	}
+	e.Status.RebuildStatus[replica] = rebuildStatus
+
+	replicaURL := engineapi.GetReplicaURL(address)
 	go func() {
 		// start rebuild
-		ec.eventRecorder.Eventf(e, v1.EventTypeNormal, EventReasonRebuilding, "Start rebuilding replica %v with IP %v for %v", replica, ip, e.Spec.VolumeName)
-		if err := client.ReplicaAdd(replicaURL); err != nil {
-			logrus.Errorf("Failed rebuilding %v of %v: %v", ip, e.Spec.VolumeName, err)
-			ec.eventRecorder.Eventf(e, v1.EventTypeWarning, EventReasonFailedRebuilding, "Failed rebuilding replica with IP %v: %v", ip, err)
+		ec.eventRecorder.Eventf(e, v1.EventTypeNormal, EventReasonRebuilding, "Start rebuilding replica %v with address %v for %v from %v", replica, address, e.Spec.VolumeName, sourceDesc)
+		if err := client.ReplicaAdd(replicaURL, sourceURL); err != nil {
+			log.Errorf("Failed rebuilding: %v", err)
+			ec.eventRecorder.Eventf(e, v1.EventTypeWarning, EventReasonFailedRebuilding, "Failed rebuilding replica with address %v: %v", address, err)
 			// we've sent out event to notify user. we don't want to
 			// automatically handle it because it may cause chain
 			// reaction to create numerous new replicas if we set
 			// the replica to failed.
 			// user can decide to delete it then we will try again
 			if err := client.ReplicaRemove(replicaURL); err != nil {
-				logrus.Errorf("Failed to remove rebuilding replica %v of %v due to rebuilding failure: %v", ip, e.Spec.VolumeName, err)
+				log.Errorf("Failed to remove rebuilding replica due to rebuilding failure: %v", err)
 				ec.eventRecorder.Eventf(e, v1.EventTypeWarning, EventReasonFailedDeleting,
-					"Failed to remove rebuilding replica %v with ip %v for %v due to rebuilding failure: %v", replica, ip, e.Spec.VolumeName, err)
+					"Failed to remove rebuilding replica %v with address %v for %v due to rebuilding failure: %v", replica, address, e.Spec.VolumeName, err)
 			} else {
-				logrus.Errorf("Removed failed rebuilding replica %v of %v", ip, e.Spec.VolumeName)
+				log.Errorf("Removed failed rebuilding replica")
 			}
 			return
 		}
 		ec.eventRecorder.Eventf(e, v1.EventTypeNormal, EventReasonRebuilded,
-			"Replica %v with IP %v has been rebuilded for volume %v", replica, ip, e.Spec.VolumeName)
+			"Replica %v with address %v has been rebuilded for volume %v", replica, address, e.Spec.VolumeName)
 	}()
 	//wait until engine confirmed that rebuild started
 	if err := wait.PollImmediate(EnginePollInterval, EnginePollTimeout, func() (bool, error) {
-		return doesIPExistInEngine(ip, client)
+		select {
+		case <-ec.stopCh:
+			return false, fmt.Errorf("stopped waiting for the rebuild to start since the manager is shutting down")
+		default:
+		}
+		return doesAddressExistInEngine(address, client)
 	}); err != nil {
 		return err
 	}
 	return nil
 }
 
+type rebuildSourceCandidate struct {
+	Replica         string
+	Address         string
+	NodeID          string
+	Zone            string
+	SameZone        bool
+	RebuildLoad     int
+	DiskUtilization float64
+}
+
+// getRebuildSource returns the healthy replica which the new replica should
+// be rebuilt from, or nil if there is no candidate or the engine image
+// doesn't take the source
+func (ec *EngineController) getRebuildSource(e *longhorn.Engine, replicaName string) (*rebuildSourceCandidate, error) {
+	ei, err := ec.ds.GetEngineImage(types.GetEngineImageChecksumName(e.Status.CurrentImage))
+	if err != nil {
+		return nil, err
+	}
+	if ei.Status.CLIAPIVersion < engineapi.RebuildSourceMinCLIAPIVersion {
+		getLoggerForEngine(ec.logger, e).Debugf("Engine image %v doesn't support the rebuild source, let engine choose", e.Status.CurrentImage)
+		return nil, nil
+	}
+	target, err := ec.ds.GetReplica(replicaName)
+	if err != nil {
+		return nil, err
+	}
+	nodeZones := map[string]string{}
+	targetZone, err := ec.getNodeZone(target.Spec.NodeID, nodeZones)
+	if err != nil {
+		return nil, err
+	}
+	rebuildLoad, err := ec.getRebuildLoadByNode()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []*rebuildSourceCandidate{}
+	nodes := map[string]*longhorn.Node{}
+	for name, mode := range e.Status.ReplicaModeMap {
+		if mode != types.ReplicaModeRW || name == replicaName {
+			continue
+		}
+		address := e.Spec.ReplicaAddressMap[name]
+		if address == "" {
+			continue
+		}
+		r, err := ec.ds.GetReplica(name)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if r.DeletionTimestamp != nil || r.Spec.FailedAt != "" {
+			continue
+		}
+		zone, err := ec.getNodeZone(r.Spec.NodeID, nodeZones)
+		if err != nil {
+			return nil, err
+		}
+		candidate := &rebuildSourceCandidate{
+			Replica:     name,
+			Address:     address,
+			NodeID:      r.Spec.NodeID,
+			Zone:        zone,
+			SameZone:    r.Spec.NodeID == target.Spec.NodeID || (zone != "" && zone == targetZone),
+			RebuildLoad: rebuildLoad[r.Spec.NodeID],
+		}
+
+		node, exists := nodes[r.Spec.NodeID]
+		if !exists {
+			node, err = ec.ds.GetNodeRO(r.Spec.NodeID)
+			if err != nil && !datastore.ErrorIsNotFound(err) {
+				return nil, err
+			}
+			nodes[r.Spec.NodeID] = node
+		}
+		if node != nil {
+			diskStatus := node.Status.DiskStatus[r.Spec.DiskID]
+			if diskStatus.StorageMaximum > 0 {
+				candidate.DiskUtilization = float64(diskStatus.StorageMaximum-diskStatus.StorageAvailable) / float64(diskStatus.StorageMaximum)
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	return pickRebuildSource(candidates), nil
+}
+
+// pickRebuildSource prefers the candidate in the same zone as the new
+// replica, then the one on the node with fewer ongoing rebuilds, then the
+// one on the less utilized disk
+func pickRebuildSource(candidates []*rebuildSourceCandidate) *rebuildSourceCandidate {
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.SameZone != b.SameZone {
+			return a.SameZone
+		}
+		if a.RebuildLoad != b.RebuildLoad {
+			return a.RebuildLoad < b.RebuildLoad
+		}
+		if a.DiskUtilization != b.DiskUtilization {
+			return a.DiskUtilization < b.DiskUtilization
+		}
+		return a.Replica < b.Replica
+	})
+	return candidates[0]
+}
+
+func (ec *EngineController) getNodeZone(nodeID string, nodeZones map[string]string) (string, error) {
+	if nodeID == "" {
+		return "", nil
+	}
+	if zone, exists := nodeZones[nodeID]; exists {
+		return zone, nil
+	}
+	kubeNode, err := ec.ds.GetKubernetesNode(nodeID)
+	if err != nil {
+		if !datastore.ErrorIsNotFound(err) {
+			return "", err
+		}
+		kubeNode = nil
+	}
+	zone := ""
+	if kubeNode != nil {
+		zone = types.GetZoneFromKubeNodeLabels(kubeNode.Labels)
+	}
+	nodeZones[nodeID] = zone
+	return zone, nil
+}
+
+// getRebuildLoadByNode counts the ongoing rebuilds using a replica on the
+// node as the source
+func (ec *EngineController) getRebuildLoadByNode() (map[string]int, error) {
+	engines, err := ec.ds.ListEnginesRO()
+	if err != nil {
+		return nil, err
+	}
+	rebuildLoad := map[string]int{}
+	for _, engine := range engines {
+		for replica, status := range engine.Status.RebuildStatus {
+			if status.SourceNodeID == "" {
+				continue
+			}
+			if engine.Status.ReplicaModeMap[replica] == types.ReplicaModeWO {
+				rebuildLoad[status.SourceNodeID]++
+			}
+		}
+	}
+	return rebuildLoad, nil
+}
+
 func (ec *EngineController) Upgrade(e *longhorn.Engine) (err error) {
 	defer func() {
 		err = errors.Wrapf(err, "cannot live upgrade image for %v", e.Name)
 	}()
 
+	// the engine process is started without the launcher doing the upgrade
+	if e.Status.InstanceManagerName != "" {
+		return fmt.Errorf("engine running in instance manager %v cannot be live upgraded, detach the volume to upgrade", e.Status.InstanceManagerName)
+	}
+
 	client, err := GetClientForEngine(e, ec.engines, e.Spec.EngineImage)
 	if err != nil {
 		return err
@@ -832,20 +1369,21 @@ func (ec *EngineController) Upgrade(e *longhorn.Engine) (err error) {
 	// will cause live replica to be removed. Volume controller should filter those.
 	if err != nil || version.ClientVersion.GitCommit != version.ServerVersion.GitCommit {
 		replicaURLs := []string{}
-		for _, ip := range e.Spec.UpgradedReplicaAddressMap {
-			replicaURLs = append(replicaURLs, engineapi.GetReplicaDefaultURL(ip))
+		for _, address := range e.Spec.UpgradedReplicaAddressMap {
+			replicaURLs = append(replicaURLs, engineapi.GetReplicaURL(address))
 		}
 		binary := types.GetEngineBinaryDirectoryInContainerForImage(e.Spec.EngineImage) + "/longhorn"
-		logrus.Debugf("About to upgrade %v from %v to %v for %v",
-			e.Name, e.Status.CurrentImage, e.Spec.EngineImage, e.Spec.VolumeName)
+		getLoggerForEngine(ec.logger, e).Debugf("About to upgrade from %v to %v", e.Status.CurrentImage, e.Spec.EngineImage)
 		if err := client.Upgrade(binary, replicaURLs); err != nil {
 			return err
 		}
 	}
-	logrus.Debugf("Engine %v has been upgraded from %v to %v", e.Name, e.Status.CurrentImage, e.Spec.EngineImage)
+	getLoggerForEngine(ec.logger, e).Debugf("Engine has been upgraded from %v to %v", e.Status.CurrentImage, e.Spec.EngineImage)
 	e.Status.CurrentImage = e.Spec.EngineImage
 	// reset ReplicaModeMap to reflect the new replicas
 	e.Status.ReplicaModeMap = nil
+	// the new engine starts without the limits
+	e.Status.CurrentQoS = types.VolumeQoS{}
 	e.Spec.ReplicaAddressMap = e.Spec.UpgradedReplicaAddressMap
 	e.Spec.UpgradedReplicaAddressMap = map[string]string{}
 	return nil
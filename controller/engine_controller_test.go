@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/controller"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+
+	. "gopkg.in/check.v1"
+)
+
+func newTestEngineControllerWithSettings(c *C, settings map[types.SettingName]string) *EngineController {
+	return newTestEngineControllerWithEngineImages(c, settings)
+}
+
+func newTestEngineControllerWithEngineImages(c *C, settings map[types.SettingName]string, eis ...*longhorn.EngineImage) *EngineController {
+	return newTestEngineControllerWithObjects(c, settings, eis, nil)
+}
+
+func newTestEngineControllerWithObjects(c *C, settings map[types.SettingName]string, eis []*longhorn.EngineImage, replicas []*longhorn.Replica) *EngineController {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	settingInformer := lhInformerFactory.Longhorn().V1alpha1().Settings()
+
+	ds := datastore.NewDataStore(
+		lhInformerFactory.Longhorn().V1alpha1().Volumes(),
+		lhInformerFactory.Longhorn().V1alpha1().Engines(),
+		lhInformerFactory.Longhorn().V1alpha1().Replicas(),
+		lhInformerFactory.Longhorn().V1alpha1().EngineImages(),
+		lhInformerFactory.Longhorn().V1alpha1().Nodes(),
+		settingInformer,
+		lhInformerFactory.Longhorn().V1alpha1().Snapshots(),
+		lhClient,
+		kubeInformerFactory.Core().V1().Pods(),
+		kubeInformerFactory.Batch().V1beta1().CronJobs(),
+		kubeInformerFactory.Apps().V1beta2().DaemonSets(),
+		kubeInformerFactory.Core().V1().Events(),
+		kubeInformerFactory.Core().V1().PersistentVolumes(),
+		kubeInformerFactory.Core().V1().PersistentVolumeClaims(),
+		kubeInformerFactory.Storage().V1beta1().VolumeAttachments(),
+		kubeClient, TestNamespace)
+	for name, value := range settings {
+		setting := &longhorn.Setting{
+			ObjectMeta: metav1.ObjectMeta{Name: string(name), Namespace: TestNamespace},
+			Setting:    types.Setting{Value: value},
+		}
+		c.Assert(settingInformer.Informer().GetIndexer().Add(setting), IsNil)
+	}
+	for _, ei := range eis {
+		c.Assert(lhInformerFactory.Longhorn().V1alpha1().EngineImages().Informer().GetIndexer().Add(ei), IsNil)
+	}
+	for _, r := range replicas {
+		c.Assert(lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer().Add(r), IsNil)
+	}
+	return &EngineController{
+		ds:            ds,
+		engines:       engineapi.NewEngineSimulatorCollection(),
+		eventRecorder: record.NewFakeRecorder(100),
+		logger:        newControllerLogger("longhorn-engine"),
+	}
+}
+
+func (s *TestSuite) TestPickRebuildSource(c *C) {
+	c.Assert(pickRebuildSource(nil), IsNil)
+
+	// same zone wins over load and disk utilization
+	source := pickRebuildSource([]*rebuildSourceCandidate{
+		{Replica: "r1", SameZone: false, RebuildLoad: 0, DiskUtilization: 0.1},
+		{Replica: "r2", SameZone: true, RebuildLoad: 2, DiskUtilization: 0.9},
+	})
+	c.Assert(source.Replica, Equals, "r2")
+
+	// then the less loaded node
+	source = pickRebuildSource([]*rebuildSourceCandidate{
+		{Replica: "r1", SameZone: true, RebuildLoad: 1, DiskUtilization: 0.1},
+		{Replica: "r2", SameZone: true, RebuildLoad: 0, DiskUtilization: 0.9},
+	})
+	c.Assert(source.Replica, Equals, "r2")
+
+	// then the less utilized disk
+	source = pickRebuildSource([]*rebuildSourceCandidate{
+		{Replica: "r1", SameZone: false, RebuildLoad: 1, DiskUtilization: 0.5},
+		{Replica: "r2", SameZone: false, RebuildLoad: 1, DiskUtilization: 0.2},
+	})
+	c.Assert(source.Replica, Equals, "r2")
+}
+
+func (s *TestSuite) TestGetRebuildSourceByCLIAPIVersion(c *C) {
+	v := newVolume(TestVolumeName, 2)
+	e := newEngineForVolume(v)
+	e.Status.CurrentImage = TestEngineImage
+	source := newReplicaForVolume(v, e, TestNode1, TestDiskID1)
+	target := newReplicaForVolume(v, e, TestNode2, TestDiskID1)
+	source.Namespace = TestNamespace
+	target.Namespace = TestNamespace
+	e.Spec.ReplicaAddressMap = map[string]string{source.Name: TestIP1, target.Name: TestIP2}
+	e.Status.ReplicaModeMap = map[string]types.ReplicaMode{source.Name: types.ReplicaModeRW}
+
+	for _, tc := range []struct {
+		name          string
+		cliAPIVersion int
+		supported     bool
+	}{
+		{"supported", engineapi.RebuildSourceMinCLIAPIVersion, true},
+		{"unsupported", engineapi.RebuildSourceMinCLIAPIVersion - 1, false},
+	} {
+		ec := newTestEngineControllerWithObjects(c, nil,
+			[]*longhorn.EngineImage{newInstanceManagerEngineImage(TestEngineImage, tc.cliAPIVersion)},
+			[]*longhorn.Replica{source, target})
+		candidate, err := ec.getRebuildSource(e, target.Name)
+		c.Assert(err, IsNil, Commentf(tc.name))
+		if !tc.supported {
+			// the engine is asked to add the replica without the source
+			c.Assert(candidate, IsNil, Commentf(tc.name))
+			continue
+		}
+		c.Assert(candidate, NotNil, Commentf(tc.name))
+		c.Assert(candidate.Replica, Equals, source.Name, Commentf(tc.name))
+		c.Assert(candidate.Address, Equals, TestIP1, Commentf(tc.name))
+	}
+}
+
+func (s *TestSuite) TestEnginePodSpecDisableFrontend(c *C) {
+	ec := newTestEngineControllerWithSettings(c, nil)
+	e := newEngineForVolume(newVolume(TestVolumeName, 2))
+	e.Spec.NodeID = TestNode1
+	e.Spec.ReplicaAddressMap = map[string]string{"r1": TestIP1}
+
+	pod, err := ec.CreatePodSpec(e)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Join(pod.Spec.Containers[0].Command, " "), Matches, ".*--frontend "+EngineFrontendBlockDev+".*")
+
+	// the engine for the maintenance starts without the frontend
+	e.Spec.DisableFrontend = true
+	pod, err = ec.CreatePodSpec(e)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Join(pod.Spec.Containers[0].Command, " "), Not(Matches), ".*--frontend.*")
+	c.Assert(pod.Spec.Containers[0].ReadinessProbe.Handler.HTTPGet, NotNil)
+}
+
+func (s *TestSuite) TestEngineFrontendReadOnly(c *C) {
+	ec := newTestEngineControllerWithSettings(c, nil)
+	e := newEngineForVolume(newVolume(TestVolumeName, 2))
+	e.Spec.Frontend = types.VolumeFrontendISCSI
+	e.Spec.NodeID = TestNode1
+	e.Spec.ReplicaAddressMap = map[string]string{"r1": TestIP1}
+
+	pod, err := ec.CreatePodSpec(e)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Join(pod.Spec.Containers[0].Command, " "), Not(Matches), ".*--frontend-readonly.*")
+	spec, err := ec.CreateProcessSpec(e)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Join(spec.Args, " "), Not(Matches), ".*--frontend-readonly.*")
+
+	// the engine of the volume attached read-only rejects the writes
+	e.Spec.FrontendReadOnly = true
+	pod, err = ec.CreatePodSpec(e)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Join(pod.Spec.Containers[0].Command, " "), Matches, ".*--frontend "+EngineFrontendISCSI+" --frontend-readonly.*")
+	spec, err = ec.CreateProcessSpec(e)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Join(spec.Args, " "), Matches, ".*--frontend "+EngineFrontendISCSI+" --frontend-readonly.*")
+}
+
+func (s *TestSuite) TestEnginePodSpecTolerations(c *C) {
+	e := newEngineForVolume(newVolume(TestVolumeName, 2))
+	e.Spec.NodeID = TestNode1
+	e.Spec.ReplicaAddressMap = map[string]string{"r1": TestIP1}
+
+	ec := newTestEngineControllerWithSettings(c, nil)
+	pod, err := ec.CreatePodSpec(e)
+	c.Assert(err, IsNil)
+	c.Assert(pod.Spec.Tolerations, HasLen, 0)
+
+	ec = newTestEngineControllerWithSettings(c, map[types.SettingName]string{
+		types.SettingNameTaintToleration: "dedicated=storage:NoSchedule",
+	})
+	pod, err = ec.CreatePodSpec(e)
+	c.Assert(err, IsNil)
+	c.Assert(pod.Spec.Tolerations, DeepEquals, []v1.Toleration{
+		{Key: "dedicated", Operator: v1.TolerationOpEqual, Value: "storage", Effect: v1.TaintEffectNoSchedule},
+	})
+}
+
+func (s *TestSuite) TestEngineSyncQoS(c *C) {
+	qos := types.VolumeQoS{ReadIOPS: 1000, WriteBandwidth: 50}
+	for _, tc := range []struct {
+		name          string
+		cliAPIVersion int
+		applied       bool
+	}{
+		{"supported", engineapi.QoSMinCLIAPIVersion, true},
+		{"unsupported", engineapi.QoSMinCLIAPIVersion - 1, false},
+	} {
+		ec := newTestEngineControllerWithEngineImages(c, nil, newInstanceManagerEngineImage(TestEngineImage, tc.cliAPIVersion))
+		engines := ec.engines.(*engineapi.EngineSimulatorCollection)
+		e := newEngineForVolume(newVolume(TestVolumeName, 2))
+		e.Spec.QoS = qos
+		e.Status.CurrentState = types.InstanceStateRunning
+		e.Status.CurrentImage = TestEngineImage
+		e.Status.IP = TestIP1
+		c.Assert(engines.CreateEngineSimulator(&engineapi.EngineSimulatorRequest{
+			VolumeName:     e.Spec.VolumeName,
+			VolumeSize:     TestVolumeSize,
+			ControllerAddr: TestIP1,
+		}), IsNil)
+		sim, err := engines.GetEngineSimulator(e.Spec.VolumeName)
+		c.Assert(err, IsNil)
+
+		c.Assert(ec.syncQoS(e), IsNil, Commentf(tc.name))
+		if !tc.applied {
+			c.Assert(e.Status.CurrentQoS, Equals, types.VolumeQoS{}, Commentf(tc.name))
+			c.Assert(sim.QoSGet(), Equals, types.VolumeQoS{}, Commentf(tc.name))
+			continue
+		}
+		c.Assert(e.Status.CurrentQoS, Equals, qos, Commentf(tc.name))
+		c.Assert(sim.QoSGet(), Equals, qos, Commentf(tc.name))
+
+		// the limits removed at runtime
+		e.Spec.QoS = types.VolumeQoS{}
+		c.Assert(ec.syncQoS(e), IsNil)
+		c.Assert(e.Status.CurrentQoS, Equals, types.VolumeQoS{})
+		c.Assert(sim.QoSGet(), Equals, types.VolumeQoS{})
+	}
+}
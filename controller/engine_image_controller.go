@@ -3,6 +3,8 @@ package controller
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -15,7 +17,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
 	appsinformers_v1beta2 "k8s.io/client-go/informers/apps/v1beta2"
 	clientset "k8s.io/client-go/kubernetes"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -36,7 +37,16 @@ import (
 var (
 	ownerKindEngineImage = longhorn.SchemeGroupVersion.WithKind("EngineImage").String()
 
-	ExpiredEngineImageTimeout = 60 * time.Minute
+	// imagePullFailureReasons are the reasons reported by the kubelet for a
+	// waiting container when it cannot pull the image, e.g. the image is
+	// not found or the registry rejects the credentials
+	imagePullFailureReasons = map[string]struct{}{
+		"ErrImagePull":        {},
+		"ImagePullBackOff":    {},
+		"InvalidImageName":    {},
+		"ErrImageNeverPull":   {},
+		"RegistryUnavailable": {},
+	}
 )
 
 type EngineImageController struct {
@@ -54,12 +64,17 @@ type EngineImageController struct {
 	vStoreSynced  cache.InformerSynced
 	dsStoreSynced cache.InformerSynced
 
-	queue workqueue.RateLimitingInterface
+	queue  workqueue.RateLimitingInterface
+	health *queueHealth
+	logger logrus.FieldLogger
+
+	isLeaderHandler IsLeaderHandler
 }
 
 func NewEngineImageController(
 	ds *datastore.DataStore,
 	scheme *runtime.Scheme,
+	config ControllerConfig,
 	engineImageInformer lhinformers.EngineImageInformer,
 	volumeInformer lhinformers.VolumeInformer,
 	dsInformer appsinformers_v1beta2.DaemonSetInformer,
@@ -84,8 +99,12 @@ func NewEngineImageController(
 		vStoreSynced:  volumeInformer.Informer().HasSynced,
 		dsStoreSynced: dsInformer.Informer().HasSynced,
 
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "longhorn-engine-image"),
+		queue:  config.newQueue("longhorn-engine-image"),
+		logger: newControllerLogger("longhorn-engine-image"),
+
+		isLeaderHandler: alwaysLeader,
 	}
+	ic.health = newQueueHealth("longhorn-engine-image", ic.queue)
 
 	engineImageInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -137,18 +156,14 @@ func (ic *EngineImageController) Run(workers int, stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
 	defer ic.queue.ShutDown()
 
-	logrus.Infof("Start Longhorn Engine Image controller")
-	defer logrus.Infof("Shutting down Longhorn Engine Image controller")
+	ic.logger.Infof("Start Longhorn Engine Image controller")
+	defer ic.logger.Infof("Shutting down Longhorn Engine Image controller")
 
 	if !controller.WaitForCacheSync("longhorn engine images", stopCh, ic.iStoreSynced, ic.dsStoreSynced) {
 		return
 	}
 
-	for i := 0; i < workers; i++ {
-		go wait.Until(ic.worker, time.Second, stopCh)
-	}
-
-	<-stopCh
+	runWorkers(workers, ic.worker, ic.queue, stopCh)
 }
 
 func (ic *EngineImageController) worker() {
@@ -163,6 +178,7 @@ func (ic *EngineImageController) processNextWorkItem() bool {
 		return false
 	}
 	defer ic.queue.Done(key)
+	defer ic.health.processed()
 
 	err := ic.syncEngineImage(key.(string))
 	ic.handleErr(err, key)
@@ -177,13 +193,13 @@ func (ic *EngineImageController) handleErr(err error, key interface{}) {
 	}
 
 	if ic.queue.NumRequeues(key) < maxRetries {
-		logrus.Warnf("Error syncing Longhorn engine image %v: %v", key, err)
+		ic.logger.WithField("engineImage", key).Warnf("Error syncing Longhorn engine image: %v", err)
 		ic.queue.AddRateLimited(key)
 		return
 	}
 
 	utilruntime.HandleError(err)
-	logrus.Warnf("Dropping Longhorn engine image %v out of the queue: %v", key, err)
+	ic.logger.WithField("engineImage", key).Warnf("Dropping Longhorn engine image out of the queue: %v", err)
 	ic.queue.Forget(key)
 }
 
@@ -203,27 +219,29 @@ func (ic *EngineImageController) syncEngineImage(key string) (err error) {
 	engineImage, err := ic.ds.GetEngineImage(name)
 	if err != nil {
 		if datastore.ErrorIsNotFound(err) {
-			logrus.Infof("Longhorn engine image %v has been deleted", key)
+			ic.logger.WithField("engineImage", key).Infof("Longhorn engine image has been deleted")
 			return nil
 		}
 		return err
 	}
 
-	if engineImage.Spec.OwnerID == "" {
-		// Claim it
+	// the engine images are cluster wide, so they're all owned by the
+	// leader, which takes them over from the previous leader
+	if !ic.isLeaderHandler() {
+		return nil
+	}
+	if engineImage.Spec.OwnerID != ic.controllerID {
+		previousOwner := engineImage.Spec.OwnerID
 		engineImage.Spec.OwnerID = ic.controllerID
 		engineImage, err = ic.ds.UpdateEngineImage(engineImage)
 		if err != nil {
-			// we don't mind others coming first
+			// the update event requeues it
 			if apierrors.IsConflict(errors.Cause(err)) {
 				return nil
 			}
 			return err
 		}
-		logrus.Debugf("Engine Image Controller %v picked up %v (%v)", ic.controllerID, engineImage.Name, engineImage.Spec.Image)
-	} else if engineImage.Spec.OwnerID != ic.controllerID {
-		// Not ours
-		return nil
+		getLoggerForEngineImage(ic.logger, engineImage).Debugf("Engine Image Controller %v picked up the engine image from %q", ic.controllerID, previousOwner)
 	}
 
 	checksumName := types.GetEngineImageChecksumName(engineImage.Spec.Image)
@@ -231,12 +249,19 @@ func (ic *EngineImageController) syncEngineImage(key string) (err error) {
 		return fmt.Errorf("Image %v checksum %v doesn't match engine image name %v", engineImage.Spec.Image, checksumName, engineImage.Name)
 	}
 
-	dsName := getEngineImageDaemonSetName(engineImage.Name)
+	dsName := GetEngineImageDaemonSetName(engineImage.Name)
 	if engineImage.DeletionTimestamp != nil {
+		// the finalizer holds the default or referenced image, including
+		// its daemon set, until it's genuinely allowed to go
+		if err := ic.ds.CheckEngineImageDeletable(engineImage); err != nil {
+			ic.eventRecorder.Eventf(engineImage, v1.EventTypeWarning, EventReasonFailedDeleting,
+				"Cannot delete engine image %v: %v", engineImage.Name, err)
+			return nil
+		}
 		if err := ic.ds.DeleteEngineImageDaemonSet(dsName); err != nil {
 			return errors.Wrapf(err, "cannot cleanup daemonset of engine image %v", engineImage.Name)
 		}
-		logrus.Infof("Removed daemon set %v for engine image %v (%v)", dsName, engineImage.Name, engineImage.Spec.Image)
+		getLoggerForEngineImage(ic.logger, engineImage).Infof("Removed daemon set %v for engine image", dsName)
 		return ic.ds.RemoveFinalizerForEngineImage(engineImage)
 	}
 
@@ -244,82 +269,215 @@ func (ic *EngineImageController) syncEngineImage(key string) (err error) {
 	existingEngineImage := engineImage.DeepCopy()
 	defer func() {
 		if err == nil && !reflect.DeepEqual(existingEngineImage, engineImage) {
-			_, err = ic.ds.UpdateEngineImage(engineImage)
+			// the spec is written by update and the status through the
+			// status subresource
+			status := engineImage.Status
+			updated := engineImage
+			if isSpecOrMetaChanged(&existingEngineImage.ObjectMeta, &engineImage.ObjectMeta, existingEngineImage.Spec, engineImage.Spec) {
+				updated, err = ic.ds.UpdateEngineImage(engineImage)
+			}
+			if err == nil && !reflect.DeepEqual(existingEngineImage.Status, status) {
+				updated.Status = status
+				_, err = ic.ds.UpdateEngineImageStatus(updated)
+			}
 		}
 		if apierrors.IsConflict(errors.Cause(err)) {
-			logrus.Debugf("Requeue %v due to conflict", key)
+			getLoggerForEngineImage(ic.logger, engineImage).Debugf("Requeue engine image due to conflict")
 			ic.enqueueEngineImage(engineImage)
 			err = nil
 		}
 	}()
 
+	// the references are counted whatever the state of the image is, so the
+	// image failing to deploy is cleaned up as well
+	if err := ic.updateEngineImageRefCount(engineImage); err != nil {
+		return err
+	}
+	if cleaned, err := ic.cleanupExpiredEngineImage(engineImage); err != nil || cleaned {
+		return err
+	}
+
 	ds, err := ic.ds.GetEngineImageDaemonSet(dsName)
 	if err != nil {
 		return errors.Wrapf(err, "cannot get daemonset for engine image %v", engineImage.Name)
 	}
 	if ds == nil {
-		dsSpec := ic.createEngineImageDaemonSetSpec(engineImage)
+		tolerations, err := ic.ds.GetSettingTaintToleration()
+		if err != nil {
+			return err
+		}
+		dsSpec := ic.createEngineImageDaemonSetSpec(engineImage, tolerations)
 		if err = ic.ds.CreateEngineImageDaemonSet(dsSpec); err != nil {
 			return errors.Wrapf(err, "fail to create daemonset for engine image %v", engineImage.Name)
 		}
-		logrus.Infof("Created daemon set %v for engine image %v (%v)", dsSpec.Name, engineImage.Name, engineImage.Spec.Image)
-		engineImage.Status.State = types.EngineImageStateDeploying
-		return nil
-	}
-
-	if ds.Status.DesiredNumberScheduled == 0 {
+		getLoggerForEngineImage(ic.logger, engineImage).Infof("Created daemon set %v for engine image", dsSpec.Name)
 		engineImage.Status.State = types.EngineImageStateDeploying
+		ic.setEngineImageCondition(engineImage, types.EngineImageConditionTypeReady, types.ConditionStatusFalse,
+			types.EngineImageConditionReasonDaemonSetNotReady, fmt.Sprintf("daemon set %v has just been created", dsSpec.Name))
 		return nil
 	}
 
-	nodes, err := ic.ds.ListNodes()
+	undeployedNodes, err := ic.updateNodeDeploymentMap(engineImage, ds)
 	if err != nil {
 		return err
 	}
-	readyNodeCount := int32(0)
-	for _, node := range nodes {
-		condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
-		if condition.Status == types.ConditionStatusTrue {
-			readyNodeCount++
-		}
-	}
-	if ds.Status.NumberAvailable < readyNodeCount {
-		engineImage.Status.State = types.EngineImageStateDeploying
-		return nil
+	switch {
+	case ds.Status.DesiredNumberScheduled == 0:
+		ic.setEngineImageCondition(engineImage, types.EngineImageConditionTypeReady, types.ConditionStatusFalse,
+			types.EngineImageConditionReasonDaemonSetNotReady, fmt.Sprintf("no pod of daemon set %v has been scheduled", ds.Name))
+	case len(undeployedNodes) != 0:
+		reason, message := getEngineImageUndeployedReason(engineImage, undeployedNodes)
+		ic.setEngineImageCondition(engineImage, types.EngineImageConditionTypeReady, types.ConditionStatusFalse, reason, message)
+	default:
+		ic.setEngineImageCondition(engineImage, types.EngineImageConditionTypeReady, types.ConditionStatusTrue, "", "")
 	}
 
+	// the version is checked with the binaries on this node, which may be
+	// deployed before the other nodes
 	if !types.EngineBinaryExistOnHostForImage(engineImage.Spec.Image) {
 		engineImage.Status.State = types.EngineImageStateDeploying
 		return nil
 	}
-
-	// will only become ready for the first time if all the following functions succeed
-	engineImage.Status.State = types.EngineImageStateReady
-
 	if err := ic.updateEngineImageVersion(engineImage); err != nil {
 		return err
 	}
 
 	if err := engineapi.CheckCLICompatibilty(engineImage.Status.CLIAPIVersion, engineImage.Status.CLIAPIMinVersion); err != nil {
-		logrus.Errorf("Engine image %v isn't compatible with current manager: %v", engineImage.Spec.Image, err)
+		if types.GetEngineImageConditionFromStatus(engineImage.Status, types.EngineImageConditionTypeIncompatible).Status != types.ConditionStatusTrue {
+			getLoggerForEngineImage(ic.logger, engineImage).Errorf("Engine image isn't compatible with current manager: %v", err)
+		}
 		engineImage.Status.State = types.EngineImageStateIncompatible
-		// Allow update reference count and clean up even it's incompatible since engines may have been upgraded
+		ic.setEngineImageCondition(engineImage, types.EngineImageConditionTypeIncompatible, types.ConditionStatusTrue,
+			types.EngineImageConditionReasonAPIVersionMismatch, err.Error())
+		return nil
 	}
+	ic.setEngineImageCondition(engineImage, types.EngineImageConditionTypeIncompatible, types.ConditionStatusFalse, "", "")
 
-	if err := ic.updateEngineImageRefCount(engineImage); err != nil {
-		return err
+	if types.GetEngineImageConditionFromStatus(engineImage.Status, types.EngineImageConditionTypeReady).Status != types.ConditionStatusTrue {
+		engineImage.Status.State = types.EngineImageStateDeploying
+		return nil
+	}
+	engineImage.Status.State = types.EngineImageStateReady
+	if oldImageState != types.EngineImageStateReady {
+		getLoggerForEngineImage(ic.logger, engineImage).Infof("Engine image become ready")
 	}
+	return nil
+}
 
-	if err := ic.cleanupExpiredEngineImage(engineImage); err != nil {
-		return err
+// updateNodeDeploymentMap records whether the pod of the daemon set is ready
+// on each node and the progress of pulling the image there, and returns the
+// ready nodes not deployed yet, sorted
+func (ic *EngineImageController) updateNodeDeploymentMap(ei *longhorn.EngineImage, ds *appsv1beta2.DaemonSet) ([]string, error) {
+	nodes, err := ic.ds.ListNodes()
+	if err != nil {
+		return nil, err
 	}
+	pods, err := ic.ds.ListEngineImageDaemonSetPodsRO(ds)
+	if err != nil {
+		return nil, err
+	}
+	nodePods := map[string]*v1.Pod{}
+	for _, pod := range pods {
+		nodePods[pod.Spec.NodeName] = pod
+	}
+
+	oldPullStatus := ei.Status.NodePullStatus
+	ei.Status.NodeDeploymentMap = map[string]bool{}
+	ei.Status.NodePullStatus = map[string]types.EngineImageNodePullStatus{}
+	undeployedNodes := []string{}
+	for name, node := range nodes {
+		deployed, pullStatus := getEngineImagePodPullStatus(nodePods[name])
+		ei.Status.NodeDeploymentMap[name] = deployed
+		ei.Status.NodePullStatus[name] = pullStatus
+		if pullStatus.State == types.EngineImagePullStateError && oldPullStatus[name] != pullStatus {
+			ic.eventRecorder.Eventf(ei, v1.EventTypeWarning, EventReasonFailedPulling,
+				"Failed to pull engine image %v on node %v: %v", ei.Spec.Image, name, pullStatus.Message)
+		}
+		if deployed {
+			continue
+		}
+		condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
+		if condition.Status == types.ConditionStatusTrue {
+			undeployedNodes = append(undeployedNodes, name)
+		}
+	}
+	sort.Strings(undeployedNodes)
+	return undeployedNodes, nil
+}
 
-	if oldImageState != types.EngineImageStateReady && engineImage.Status.State == types.EngineImageStateReady &&
-		engineImage.DeletionTimestamp == nil {
-		logrus.Infof("Engine image %v (%v) become ready", engineImage.Name, engineImage.Spec.Image)
+// getEngineImageUndeployedReason tells whether the undeployed nodes failed
+// to pull the image, are still pulling it, or haven't started the binaries
+func getEngineImageUndeployedReason(ei *longhorn.EngineImage, undeployedNodes []string) (string, string) {
+	failedNodes := []string{}
+	pullingNodes := []string{}
+	for _, name := range undeployedNodes {
+		switch ei.Status.NodePullStatus[name].State {
+		case types.EngineImagePullStateError:
+			failedNodes = append(failedNodes, name)
+		case types.EngineImagePullStateWaiting, types.EngineImagePullStatePulling:
+			pullingNodes = append(pullingNodes, name)
+		}
 	}
+	if len(failedNodes) != 0 {
+		return types.EngineImageConditionReasonImagePullFailed,
+			fmt.Sprintf("failed to pull the image on nodes %v", strings.Join(failedNodes, ", "))
+	}
+	if len(pullingNodes) != 0 {
+		return types.EngineImageConditionReasonImagePulling,
+			fmt.Sprintf("the image is still being pulled on nodes %v", strings.Join(pullingNodes, ", "))
+	}
+	return types.EngineImageConditionReasonBinaryNotDeployed,
+		fmt.Sprintf("the binaries haven't been deployed on nodes %v", strings.Join(undeployedNodes, ", "))
+}
 
-	return nil
+// getEngineImagePodPullStatus returns whether the binaries have been
+// deployed by the pod of the daemon set, and the pull state of the image on
+// the node of the pod. The pod is deployed once passed the readiness probe,
+// which may be a while after the image pulled.
+func getEngineImagePodPullStatus(pod *v1.Pod) (bool, types.EngineImageNodePullStatus) {
+	if pod == nil {
+		return false, types.EngineImageNodePullStatus{State: types.EngineImagePullStateWaiting}
+	}
+	deployed := false
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+			deployed = true
+		}
+	}
+	if deployed {
+		return true, types.EngineImageNodePullStatus{State: types.EngineImagePullStateReady}
+	}
+	for _, st := range pod.Status.ContainerStatuses {
+		if st.State.Waiting != nil {
+			if _, ok := imagePullFailureReasons[st.State.Waiting.Reason]; ok {
+				return false, types.EngineImageNodePullStatus{
+					State:   types.EngineImagePullStateError,
+					Message: fmt.Sprintf("%v: %v", st.State.Waiting.Reason, st.State.Waiting.Message),
+				}
+			}
+			continue
+		}
+		// the container has been created from the pulled image
+		return false, types.EngineImageNodePullStatus{State: types.EngineImagePullStateReady}
+	}
+	return false, types.EngineImageNodePullStatus{State: types.EngineImagePullStatePulling}
+}
+
+func (ic *EngineImageController) setEngineImageCondition(ei *longhorn.EngineImage, conditionType types.EngineImageConditionType, status types.ConditionStatus, reason, message string) {
+	condition := types.GetEngineImageConditionFromStatus(ei.Status, conditionType)
+	if condition.Status != status || condition.Reason != reason {
+		condition.LastTransitionTime = util.Now()
+		if status == types.ConditionStatusTrue && conditionType == types.EngineImageConditionTypeIncompatible {
+			ic.eventRecorder.Eventf(ei, v1.EventTypeWarning, reason, "Engine image %v is incompatible: %v", ei.Spec.Image, message)
+		}
+	}
+	condition.Status = status
+	condition.Reason = reason
+	condition.Message = message
+	if ei.Status.Conditions == nil {
+		ei.Status.Conditions = map[types.EngineImageConditionType]types.Condition{}
+	}
+	ei.Status.Conditions[conditionType] = condition
 }
 
 func (ic *EngineImageController) updateEngineImageVersion(ei *longhorn.EngineImage) error {
@@ -335,7 +493,7 @@ func (ic *EngineImageController) updateEngineImageVersion(ei *longhorn.EngineIma
 	}
 	version, err := client.Version(true)
 	if err != nil {
-		logrus.Warnf("cannot get engine version for %v (%v): %v", ei.Name, ei.Spec.Image, err)
+		getLoggerForEngineImage(ic.logger, ei).Warnf("cannot get engine version: %v", err)
 		version = &engineapi.EngineVersion{
 			ClientVersion: &types.EngineVersionDetails{},
 			ServerVersion: nil,
@@ -348,25 +506,22 @@ func (ic *EngineImageController) updateEngineImageVersion(ei *longhorn.EngineIma
 		version.ClientVersion.ControllerAPIVersion = types.InvalidEngineVersion
 		version.ClientVersion.DataFormatVersion = types.InvalidEngineVersion
 		version.ClientVersion.DataFormatMinVersion = types.InvalidEngineVersion
+		version.ClientVersion.InstanceManagerAPIVersion = types.InvalidEngineVersion
+		version.ClientVersion.InstanceManagerAPIMinVersion = types.InvalidEngineVersion
 	}
 
 	ei.Status.EngineVersionDetails = *version.ClientVersion
 	return nil
 }
 
+// updateEngineImageRefCount counts the volumes referring to the image by
+// themselves, their engines or their replicas
 func (ic *EngineImageController) updateEngineImageRefCount(ei *longhorn.EngineImage) error {
-	volumes, err := ic.ds.ListVolumes()
+	volumes, err := ic.ds.ListEngineImageReferences(ei.Spec.Image)
 	if err != nil {
-		return errors.Wrap(err, "cannot list volumes when updateEngineImageRefCount")
+		return errors.Wrap(err, "cannot list the references when updateEngineImageRefCount")
 	}
-	image := ei.Spec.Image
-	refCount := 0
-	for _, v := range volumes {
-		if v.Spec.EngineImage == image || v.Status.CurrentImage == image {
-			refCount++
-		}
-	}
-	ei.Status.RefCount = refCount
+	ei.Status.RefCount = len(volumes)
 	if ei.Status.RefCount == 0 {
 		if ei.Status.NoRefSince == "" {
 			ei.Status.NoRefSince = util.Now()
@@ -375,40 +530,47 @@ func (ic *EngineImageController) updateEngineImageRefCount(ei *longhorn.EngineIm
 		ei.Status.NoRefSince = ""
 	}
 	return nil
-
 }
 
-func (ic *EngineImageController) cleanupExpiredEngineImage(ei *longhorn.EngineImage) (err error) {
+// cleanupExpiredEngineImage deletes the image without references for the
+// grace period if the automatic cleanup is enabled, except the default image
+func (ic *EngineImageController) cleanupExpiredEngineImage(ei *longhorn.EngineImage) (cleaned bool, err error) {
 	defer func() {
 		err = errors.Wrapf(err, "cannot cleanup engine image %v (%v)", ei.Name, ei.Spec.Image)
 	}()
 
-	if ei.Status.RefCount != 0 {
-		return nil
+	if ei.Status.RefCount != 0 || ei.Status.NoRefSince == "" {
+		return false, nil
 	}
-	if ei.Status.NoRefSince == "" {
-		return nil
+	enabled, err := ic.ds.GetSettingAsBool(types.SettingNameAutoCleanupUnusedEngineImages)
+	if err != nil || !enabled {
+		return false, err
+	}
+	gracePeriod, err := ic.ds.GetSettingAsInt(types.SettingNameUnusedEngineImageGracePeriod)
+	if err != nil {
+		return false, err
+	}
+	if !util.TimestampAfterTimeout(ei.Status.NoRefSince, time.Duration(gracePeriod)*time.Minute) {
+		return false, nil
+	}
+	defaultEngineImage, err := ic.ds.GetDefaultEngineImage()
+	if err != nil {
+		return false, err
+	}
+	if defaultEngineImage == "" {
+		return false, fmt.Errorf("default engine image not set")
+	}
+	// Don't delete the default image
+	if ei.Spec.Image == defaultEngineImage {
+		return false, nil
 	}
-	if util.TimestampAfterTimeout(ei.Status.NoRefSince, ExpiredEngineImageTimeout) {
-		defaultEngineImage, err := ic.ds.GetSetting(types.SettingNameDefaultEngineImage)
-		if err != nil {
-			return err
-		}
-		if defaultEngineImage.Value == "" {
-			return fmt.Errorf("default engine image not set")
-		}
-		// Don't delete the default image
-		if ei.Spec.Image == defaultEngineImage.Value {
-			return nil
-		}
 
-		logrus.Infof("Engine image %v (%v) expired, clean it up", ei.Name, ei.Spec.Image)
-		if err := ic.ds.DeleteEngineImage(ei.Name); err != nil {
-			return err
-		}
-		return nil
+	getLoggerForEngineImage(ic.logger, ei).Infof("Engine image has been unused since %v, clean it up", ei.Status.NoRefSince)
+	if err := ic.ds.DeleteEngineImage(ei.Name); err != nil {
+		return false, err
 	}
-	return nil
+	ic.eventRecorder.Eventf(ei, v1.EventTypeNormal, EventReasonDelete, "Cleaned up engine image %v unused since %v", ei.Spec.Image, ei.Status.NoRefSince)
+	return true, nil
 }
 
 func (ic *EngineImageController) enqueueEngineImage(engineImage *longhorn.EngineImage) {
@@ -450,7 +612,7 @@ func (ic *EngineImageController) enqueueVolumes(volumes ...*longhorn.Volume) {
 func (ic *EngineImageController) enqueueControlleeChange(obj interface{}) {
 	metaObj, err := meta.Accessor(obj)
 	if err != nil {
-		logrus.Warnf("BUG: %v cannot be convert to metav1.Object: %v", obj, err)
+		ic.logger.Warnf("BUG: %v cannot be convert to metav1.Object: %v", obj, err)
 		return
 	}
 	ownerRefs := metaObj.GetOwnerReferences()
@@ -484,12 +646,12 @@ func (ic *EngineImageController) ResolveRefAndEnqueue(namespace string, ref *met
 	ic.enqueueEngineImage(engineImage)
 }
 
-func getEngineImageDaemonSetName(engineImageName string) string {
+func GetEngineImageDaemonSetName(engineImageName string) string {
 	return "engine-image-" + engineImageName
 }
 
-func (ic *EngineImageController) createEngineImageDaemonSetSpec(ei *longhorn.EngineImage) *appsv1beta2.DaemonSet {
-	dsName := getEngineImageDaemonSetName(ei.Name)
+func (ic *EngineImageController) createEngineImageDaemonSetSpec(ei *longhorn.EngineImage, tolerations []v1.Toleration) *appsv1beta2.DaemonSet {
+	dsName := GetEngineImageDaemonSetName(ei.Name)
 	image := ei.Spec.Image
 	cmd := []string{
 		"/bin/bash",
@@ -512,6 +674,7 @@ func (ic *EngineImageController) createEngineImageDaemonSetSpec(ei *longhorn.Eng
 					Labels: types.GetEngineImageLabel(),
 				},
 				Spec: v1.PodSpec{
+					Tolerations: tolerations,
 					Containers: []v1.Container{
 						{
 							Name:            dsName,
@@ -9,16 +9,39 @@ const (
 	EventReasonFailedStarting = "FailedStarting"
 	EventReasonStop           = "Stop"
 	EventReasonFailedStopping = "FailedStopping"
+	EventReasonFailedPulling  = "FailedPulling"
+
+	EventReasonScheduled        = "Scheduled"
+	EventReasonFailedScheduling = "FailedScheduling"
 
 	EventReasonRebuilded        = "Rebuilded"
 	EventReasonRebuilding       = "Rebuilding"
 	EventReasonFailedRebuilding = "FailedRebuilding"
 
-	EventReasonAttached = "Attached"
-	EventReasonDetached = "Detached"
-	EventReasonHealthy  = "Healthy"
-	EventReasonFaulted  = "Faulted"
-	EventReasonDegraded = "Degraded"
+	EventReasonAttached        = "Attached"
+	EventReasonFailedAttaching = "FailedAttaching"
+	EventReasonDetached        = "Detached"
+	EventReasonHealthy         = "Healthy"
+	EventReasonFaulted         = "Faulted"
+	EventReasonDegraded        = "Degraded"
 
 	EventReasonRebooted = "Rebooted"
+
+	EventReasonOrphaned = "Orphaned"
+
+	EventReasonEvicting       = "Evicting"
+	EventReasonEvicted        = "Evicted"
+	EventReasonFailedEvicting = "FailedEvicting"
+
+	EventReasonMaintenance = "Maintenance"
+
+	EventReasonTagsChanged = "TagsChanged"
+
+	EventReasonTrashed = "Trashed"
+
+	EventReasonQoSApplied     = "QoSApplied"
+	EventReasonQoSUnsupported = "QoSUnsupported"
+
+	EventReasonSkippedRecurringJob  = "SkippedRecurringJob"
+	EventReasonCaughtUpRecurringJob = "CaughtUpRecurringJob"
 )
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+var (
+	// the controller is considered stuck if it has items queued but
+	// hasn't finished processing any item for this long
+	QueueStallThreshold = 2 * time.Minute
+)
+
+// queueHealth tracks the progress of the workqueue of a controller
+type queueHealth struct {
+	name  string
+	queue workqueue.Interface
+	// unix nano of when the last item was processed
+	lastProcessed int64
+}
+
+func newQueueHealth(name string, queue workqueue.Interface) *queueHealth {
+	return &queueHealth{
+		name:          name,
+		queue:         queue,
+		lastProcessed: time.Now().UnixNano(),
+	}
+}
+
+func (q *queueHealth) processed() {
+	atomic.StoreInt64(&q.lastProcessed, time.Now().UnixNano())
+}
+
+func (q *queueHealth) check(now time.Time) ControllerHealthStatus {
+	lastProcessed := time.Unix(0, atomic.LoadInt64(&q.lastProcessed))
+	status := ControllerHealthStatus{
+		Name:          q.name,
+		QueueLength:   q.queue.Len(),
+		LastProcessed: util.FormatTimeZ(lastProcessed),
+		Healthy:       true,
+	}
+	if status.QueueLength != 0 && now.Sub(lastProcessed) > QueueStallThreshold {
+		status.Healthy = false
+		status.Message = "no item was processed in " + now.Sub(lastProcessed).Round(time.Second).String()
+	}
+	return status
+}
+
+type ControllerHealthStatus struct {
+	Name          string `json:"name"`
+	QueueLength   int    `json:"queueLength"`
+	LastProcessed string `json:"lastProcessed"`
+	Healthy       bool   `json:"healthy"`
+	Message       string `json:"message"`
+}
+
+type HealthStatus struct {
+	Ready          bool                     `json:"ready"`
+	CacheSynced    bool                     `json:"cacheSynced"`
+	DatastoreError string                   `json:"datastoreError"`
+	Controllers    []ControllerHealthStatus `json:"controllers"`
+}
+
+// Health checks if the manager is ready to serve, which requires the caches
+// of the datastore synced, the Kubernetes API server reachable and the
+// controllers making progress
+type Health struct {
+	ds     *datastore.DataStore
+	queues []*queueHealth
+}
+
+func NewHealth(ds *datastore.DataStore) *Health {
+	return &Health{
+		ds: ds,
+	}
+}
+
+func (h *Health) addQueue(q *queueHealth) {
+	h.queues = append(h.queues, q)
+}
+
+func (h *Health) Check() *HealthStatus {
+	status := &HealthStatus{
+		Ready:       true,
+		CacheSynced: h.ds.IsSynced(),
+		Controllers: []ControllerHealthStatus{},
+	}
+	if !status.CacheSynced {
+		status.Ready = false
+	}
+	if err := h.ds.CheckAPIServer(); err != nil {
+		status.Ready = false
+		status.DatastoreError = err.Error()
+	}
+	status.Controllers = h.CheckControllers()
+	for _, queueStatus := range status.Controllers {
+		if !queueStatus.Healthy {
+			status.Ready = false
+		}
+	}
+	return status
+}
+
+// CheckControllers reports the progress of the workqueue of each controller
+func (h *Health) CheckControllers() []ControllerHealthStatus {
+	now := time.Now()
+	statuses := []ControllerHealthStatus{}
+	for _, q := range h.queues {
+		statuses = append(statuses, q.check(now))
+	}
+	return statuses
+}
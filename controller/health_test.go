@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestQueueHealthCheck(c *C) {
+	queue := workqueue.New()
+	defer queue.ShutDown()
+	q := newQueueHealth("test", queue)
+	now := time.Now()
+
+	// an idle queue is healthy no matter when the last item was processed
+	status := q.check(now.Add(QueueStallThreshold * 2))
+	c.Assert(status.Healthy, Equals, true)
+	c.Assert(status.QueueLength, Equals, 0)
+
+	queue.Add("item")
+	status = q.check(now)
+	c.Assert(status.Healthy, Equals, true)
+	c.Assert(status.QueueLength, Equals, 1)
+
+	// nothing was processed while the item is waiting
+	status = q.check(now.Add(QueueStallThreshold * 2))
+	c.Assert(status.Healthy, Equals, false)
+	c.Assert(status.Message, Not(Equals), "")
+
+	q.processed()
+	status = q.check(time.Now())
+	c.Assert(status.Healthy, Equals, true)
+}
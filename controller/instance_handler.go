@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
 
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -15,7 +16,11 @@ import (
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/record"
 
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
 )
 
 const (
@@ -23,30 +28,60 @@ const (
 )
 
 // InstanceHandler can handle the state transition of correlated instance and
-// engine/replica object. It assumed the pod it's going to operate with is using
-// the SAME NAME from the engine/replica object
+// engine/replica object. The instance runs as a process in the instance
+// manager pod of its node, or in a pod of its own using the SAME NAME from the
+// engine/replica object. The instances started in the pods before the
+// instance managers were introduced keep running there until they're stopped,
+// so upgrading the manager doesn't interrupt the attached volumes.
 type InstanceHandler struct {
 	namespace     string
+	ds            *datastore.DataStore
 	kubeClient    clientset.Interface
 	pLister       corelisters.PodLister
-	podCreator    PodCreatorInterface
 	eventRecorder record.EventRecorder
+	logger        logrus.FieldLogger
+
+	instanceManagerType types.InstanceManagerType
+	instanceCreator     InstanceCreatorInterface
+	instanceManagers    engineapi.InstanceManagerClientCollection
 }
 
-type PodCreatorInterface interface {
+type InstanceCreatorInterface interface {
 	CreatePodSpec(obj interface{}) (*v1.Pod, error)
+	// CreateProcessSpec returns nil if the instance cannot run as a process
+	// in the instance manager, and has to run in a pod of its own
+	CreateProcessSpec(obj interface{}) (*engineapi.ProcessSpec, error)
 }
 
-func NewInstanceHandler(podInformer coreinformers.PodInformer, kubeClient clientset.Interface, namespace string, podCreator PodCreatorInterface, eventRecorder record.EventRecorder) *InstanceHandler {
+func NewInstanceHandler(ds *datastore.DataStore, podInformer coreinformers.PodInformer, kubeClient clientset.Interface, namespace string,
+	instanceManagerType types.InstanceManagerType, instanceCreator InstanceCreatorInterface, instanceManagers engineapi.InstanceManagerClientCollection,
+	eventRecorder record.EventRecorder, logger logrus.FieldLogger) *InstanceHandler {
 	return &InstanceHandler{
 		namespace:     namespace,
+		ds:            ds,
 		kubeClient:    kubeClient,
 		pLister:       podInformer.Lister(),
-		podCreator:    podCreator,
 		eventRecorder: eventRecorder,
+		logger:        logger,
+
+		instanceManagerType: instanceManagerType,
+		instanceCreator:     instanceCreator,
+		instanceManagers:    instanceManagers,
 	}
 }
 
+// getLoggerForObj returns the logger with the fields of the engine or the
+// replica the instance belongs to
+func (h *InstanceHandler) getLoggerForObj(obj interface{}) logrus.FieldLogger {
+	switch o := obj.(type) {
+	case *longhorn.Engine:
+		return getLoggerForEngine(h.logger, o)
+	case *longhorn.Replica:
+		return getLoggerForReplica(h.logger, o)
+	}
+	return h.logger
+}
+
 func (h *InstanceHandler) syncStatusWithPod(pod *v1.Pod, spec *types.InstanceSpec, status *types.InstanceStatus) {
 	if pod == nil {
 		if status.Started {
@@ -86,7 +121,7 @@ func (h *InstanceHandler) syncStatusWithPod(pod *v1.Pod, spec *types.InstanceSpe
 		status.CurrentState = types.InstanceStateRunning
 		if status.IP != pod.Status.PodIP {
 			status.IP = pod.Status.PodIP
-			logrus.Debugf("Instance %v starts running, IP %v", pod.Name, status.IP)
+			h.logger.WithField("instance", pod.Name).Debugf("Instance starts running, IP %v", status.IP)
 		}
 		// only set CurrentImage when first started, since later we may specify
 		// different spec.EngineImage for upgrade
@@ -95,13 +130,12 @@ func (h *InstanceHandler) syncStatusWithPod(pod *v1.Pod, spec *types.InstanceSpe
 		}
 		nodeBootID, err := h.GetNodeBootIDForPod(pod)
 		if err != nil {
-			logrus.Warnf("cannot get node BootID for instance %v", pod.Name)
+			h.logger.WithField("instance", pod.Name).Warnf("cannot get node BootID for instance: %v", err)
 		} else {
 			status.NodeBootID = nodeBootID
 		}
 	default:
-		logrus.Warnf("instance %v state is failed/unknown, pod state %v",
-			pod.Name, pod.Status.Phase)
+		h.logger.WithField("instance", pod.Name).Warnf("instance state is failed/unknown, pod state %v", pod.Status.Phase)
 		status.CurrentState = types.InstanceStateError
 		status.IP = ""
 		status.CurrentImage = ""
@@ -137,6 +171,19 @@ func (h *InstanceHandler) ReconcileInstanceState(obj interface{}, spec *types.In
 		pod = nil
 	}
 
+	if pod == nil {
+		// the instance manager is decided on the start, and kept until
+		// the instance is stopped
+		if status.InstanceManagerName == "" && spec.DesireState == types.InstanceStateRunning && status.CurrentState == types.InstanceStateStopped {
+			if err := h.assignInstanceManager(obj, spec, status); err != nil {
+				return err
+			}
+		}
+		if status.InstanceManagerName != "" {
+			return h.reconcileProcessState(runtimeObj, podName, spec, status)
+		}
+	}
+
 	switch spec.DesireState {
 	case types.InstanceStateRunning:
 		if pod != nil && pod.DeletionTimestamp == nil {
@@ -146,7 +193,7 @@ func (h *InstanceHandler) ReconcileInstanceState(obj interface{}, spec *types.In
 		if status.CurrentState != types.InstanceStateStopped {
 			break
 		}
-		podSpec, err := h.podCreator.CreatePodSpec(obj)
+		podSpec, err := h.instanceCreator.CreatePodSpec(obj)
 		if err != nil {
 			return err
 		}
@@ -178,20 +225,242 @@ func (h *InstanceHandler) ReconcileInstanceState(obj interface{}, spec *types.In
 			status.IP = ""
 			status.NodeBootID = ""
 			err := fmt.Errorf("BUG: instance %v wasn't pin down to the host %v", pod.Name, spec.NodeID)
-			logrus.Errorf("%v", err)
+			h.getLoggerForObj(obj).Error(err)
 			return err
 		}
 	} else if status.CurrentState == types.InstanceStateError && pod != nil {
 		logs, err := h.getPodLogs(pod.Name, CrashLogsTaillines)
 		if err == nil {
-			logrus.Warnf("instance %v crashed, log: \n%v", pod.Name, logs)
+			h.getLoggerForObj(obj).Warnf("instance crashed, log: \n%v", logs)
 		} else {
-			logrus.Warnf("instance %v crashed, but cannot get log, error %v", pod.Name, err)
+			h.getLoggerForObj(obj).Warnf("instance crashed, but cannot get log, error %v", err)
 		}
 	}
 	return nil
 }
 
+// assignInstanceManager picks the instance manager on the node of the
+// instance to run it as a process, and creates the instance manager if it
+// doesn't exist. The instance is left to run in a pod of its own if it
+// cannot run as a process.
+func (h *InstanceHandler) assignInstanceManager(obj interface{}, spec *types.InstanceSpec, status *types.InstanceStatus) error {
+	// the pod handling reports the instance not scheduled yet
+	if spec.NodeID == "" {
+		return nil
+	}
+	ei, err := getInstanceManagerEngineImage(h.ds, spec.EngineImage)
+	if err != nil || ei == nil {
+		return err
+	}
+	processSpec, err := h.instanceCreator.CreateProcessSpec(obj)
+	if err != nil || processSpec == nil {
+		return err
+	}
+
+	imName := types.GetInstanceManagerName(h.instanceManagerType, spec.NodeID, spec.EngineImage)
+	if _, err := h.getPod(imName); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		tolerations, err := h.ds.GetSettingTaintToleration()
+		if err != nil {
+			return err
+		}
+		imPod := newInstanceManagerPodSpec(h.instanceManagerType, imName, h.namespace, spec.NodeID, ei, tolerations)
+		if _, err := h.kubeClient.CoreV1().Pods(h.namespace).Create(imPod); err != nil && !apierrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to create instance manager %v", imName)
+		}
+		h.getLoggerForObj(obj).Infof("Created instance manager %v on node %v", imName, spec.NodeID)
+	}
+	status.InstanceManagerName = imName
+	return nil
+}
+
+func (h *InstanceHandler) getInstanceManagerClient(im *v1.Pod) (engineapi.InstanceManagerClient, error) {
+	return h.instanceManagers.NewInstanceManagerClient(&engineapi.InstanceManagerClientRequest{
+		EngineImage: im.Spec.Containers[0].Image,
+		IP:          im.Status.PodIP,
+	})
+}
+
+// getProcess returns the process of the instance in the instance manager, or
+// nil if there is none
+func (h *InstanceHandler) getProcess(client engineapi.InstanceManagerClient, name string) (*engineapi.Process, error) {
+	processes, err := client.ProcessList()
+	if err != nil {
+		return nil, err
+	}
+	return processes[name], nil
+}
+
+func isProcessAlive(process *engineapi.Process) bool {
+	return process != nil && process.Status.State != engineapi.ProcessStateStopping && process.Status.State != engineapi.ProcessStateStopped
+}
+
+func (h *InstanceHandler) reconcileProcessState(obj runtime.Object, name string, spec *types.InstanceSpec, status *types.InstanceStatus) error {
+	im, err := h.getPod(status.InstanceManagerName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if apierrors.IsNotFound(err) {
+		im = nil
+	}
+
+	// the processes are gone with the instance manager, so the process of
+	// the instance manager not ready is taken as none
+	var (
+		client  engineapi.InstanceManagerClient
+		process *engineapi.Process
+	)
+	if isInstanceManagerReady(im) {
+		client, err = h.getInstanceManagerClient(im)
+		if err != nil {
+			return err
+		}
+		process, err = h.getProcess(client, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch spec.DesireState {
+	case types.InstanceStateRunning:
+		if isProcessAlive(process) {
+			status.Started = true
+			break
+		}
+		// wait for the instance manager to create the process
+		if status.Started || client == nil {
+			break
+		}
+		processSpec, err := h.instanceCreator.CreateProcessSpec(obj)
+		if err != nil {
+			return err
+		}
+		if processSpec == nil {
+			return fmt.Errorf("BUG: instance %v assigned to instance manager %v cannot run as a process", name, status.InstanceManagerName)
+		}
+		processSpec.Name = name
+		process, err = h.createProcessForObject(obj, client, processSpec)
+		if err != nil {
+			return err
+		}
+	case types.InstanceStateStopped:
+		if isProcessAlive(process) {
+			process, err = h.deleteProcessForObject(obj, client, name)
+			if err != nil {
+				return err
+			}
+		}
+		status.Started = false
+		status.NodeBootID = ""
+	default:
+		return fmt.Errorf("BUG: unknown instance desire state: desire %v", spec.DesireState)
+	}
+
+	h.syncStatusWithProcess(im, process, spec, status)
+
+	if status.CurrentState == types.InstanceStateRunning {
+		if spec.NodeID != im.Spec.NodeName {
+			status.CurrentState = types.InstanceStateError
+			status.IP = ""
+			status.Port = 0
+			status.NodeBootID = ""
+			err := fmt.Errorf("BUG: instance %v wasn't pin down to the host %v", name, spec.NodeID)
+			h.getLoggerForObj(obj).Error(err)
+			return err
+		}
+	} else if status.CurrentState == types.InstanceStateError && process != nil {
+		logs, err := client.ProcessLog(name, CrashLogsTaillines)
+		if err == nil {
+			h.getLoggerForObj(obj).Warnf("instance crashed, log: \n%v", logs)
+		} else {
+			h.getLoggerForObj(obj).Warnf("instance crashed, but cannot get log, error %v", err)
+		}
+	} else if status.CurrentState == types.InstanceStateStopped {
+		// the next start picks the instance manager again, which may
+		// be of another engine image
+		status.InstanceManagerName = ""
+	}
+	return nil
+}
+
+func (h *InstanceHandler) syncStatusWithProcess(im *v1.Pod, process *engineapi.Process, spec *types.InstanceSpec, status *types.InstanceStatus) {
+	state := types.InstanceStateStopped
+	if process == nil {
+		if status.Started {
+			state = types.InstanceStateError
+		} else if spec.DesireState == types.InstanceStateRunning {
+			// waiting for the instance manager
+			state = types.InstanceStateStarting
+		}
+	} else {
+		switch process.Status.State {
+		case engineapi.ProcessStateStarting:
+			state = types.InstanceStateStarting
+		case engineapi.ProcessStateRunning:
+			state = types.InstanceStateRunning
+		case engineapi.ProcessStateStopping:
+			state = types.InstanceStateStopping
+		case engineapi.ProcessStateStopped:
+			// the process exited by itself
+			if status.Started {
+				state = types.InstanceStateError
+			}
+		default:
+			h.logger.WithField("instance", process.Spec.Name).Warnf("instance state is failed/unknown, process state %v: %v",
+				process.Status.State, process.Status.ErrorMsg)
+			state = types.InstanceStateError
+		}
+	}
+
+	status.CurrentState = state
+	if state != types.InstanceStateRunning {
+		status.IP = ""
+		status.Port = 0
+		status.CurrentImage = ""
+		// Don't reset status.NodeBootID, we need it to identify a node reboot
+		return
+	}
+
+	if status.IP != im.Status.PodIP || status.Port != process.Status.PortStart {
+		status.IP = im.Status.PodIP
+		status.Port = process.Status.PortStart
+		h.logger.WithField("instance", process.Spec.Name).Debugf("Instance starts running, address %v:%v", status.IP, status.Port)
+	}
+	// only set CurrentImage when first started, since later we may specify
+	// different spec.EngineImage for upgrade
+	if status.CurrentImage == "" {
+		status.CurrentImage = spec.EngineImage
+	}
+	nodeBootID, err := h.GetNodeBootIDForPod(im)
+	if err != nil {
+		h.logger.WithField("instance", process.Spec.Name).Warnf("cannot get node BootID for instance: %v", err)
+	} else {
+		status.NodeBootID = nodeBootID
+	}
+}
+
+func (h *InstanceHandler) createProcessForObject(obj runtime.Object, client engineapi.InstanceManagerClient, spec *engineapi.ProcessSpec) (*engineapi.Process, error) {
+	p, err := client.ProcessCreate(spec)
+	if err != nil {
+		h.eventRecorder.Eventf(obj, v1.EventTypeWarning, EventReasonFailedStarting, "Error starting %v: %v", spec.Name, err)
+		return nil, err
+	}
+	h.eventRecorder.Eventf(obj, v1.EventTypeNormal, EventReasonStart, "Starts %v", spec.Name)
+	return p, nil
+}
+
+func (h *InstanceHandler) deleteProcessForObject(obj runtime.Object, client engineapi.InstanceManagerClient, name string) (*engineapi.Process, error) {
+	p, err := client.ProcessDelete(name)
+	if err != nil {
+		h.eventRecorder.Eventf(obj, v1.EventTypeWarning, EventReasonFailedStopping, "Error stopping %v: %v", name, err)
+		return nil, err
+	}
+	h.eventRecorder.Eventf(obj, v1.EventTypeNormal, EventReasonStop, "Stops %v", name)
+	return p, nil
+}
+
 func (h *InstanceHandler) getPod(podName string) (*v1.Pod, error) {
 	return h.pLister.Pods(h.namespace).Get(podName)
 }
@@ -237,12 +506,16 @@ func (h *InstanceHandler) deletePodForObject(obj runtime.Object) error {
 	return nil
 }
 
-func (h *InstanceHandler) DeleteInstanceForObject(obj runtime.Object) (err error) {
+func (h *InstanceHandler) DeleteInstanceForObject(obj runtime.Object, status *types.InstanceStatus) (err error) {
 	podName, err := h.getNameFromObj(obj)
 	if err != nil {
 		return err
 	}
 
+	if status.InstanceManagerName != "" {
+		return h.deleteProcessOfInstanceManager(obj, podName, status.InstanceManagerName)
+	}
+
 	pod, err := h.getPod(podName)
 	if err != nil && !apierrors.IsNotFound(err) {
 		return err
@@ -258,6 +531,31 @@ func (h *InstanceHandler) DeleteInstanceForObject(obj runtime.Object) (err error
 	return h.deletePodForObject(obj)
 }
 
+func (h *InstanceHandler) deleteProcessOfInstanceManager(obj runtime.Object, name, imName string) error {
+	im, err := h.getPod(imName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	// the processes are gone with the instance manager
+	if !isInstanceManagerReady(im) {
+		return nil
+	}
+	client, err := h.getInstanceManagerClient(im)
+	if err != nil {
+		return err
+	}
+	process, err := h.getProcess(client, name)
+	if err != nil {
+		return err
+	}
+	// process already stopped or has been already asked to stop
+	if !isProcessAlive(process) {
+		return nil
+	}
+	_, err = h.deleteProcessForObject(obj, client, name)
+	return err
+}
+
 func (h *InstanceHandler) GetNodeBootIDForPod(pod *v1.Pod) (string, error) {
 	nodeName := pod.Spec.NodeName
 	node, err := h.kubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
@@ -5,13 +5,20 @@ import (
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/controller"
 
+	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/types"
 
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -75,5 +82,178 @@ func (s *TestSuite) TestSyncStatusWithPod(c *C) {
 func newTestInstanceHandler(kubeInformerFactory informers.SharedInformerFactory, kubeClient *fake.Clientset) *InstanceHandler {
 	podInformer := kubeInformerFactory.Core().V1().Pods()
 	fakeRecorder := record.NewFakeRecorder(100)
-	return NewInstanceHandler(podInformer, kubeClient, TestNamespace, nil, fakeRecorder)
+	return NewInstanceHandler(nil, podInformer, kubeClient, TestNamespace, types.InstanceManagerTypeReplica, nil, nil,
+		fakeRecorder, newControllerLogger("longhorn-test"))
+}
+
+func newInstanceManagerEngineImage(image string, cliAPIVersion int) *longhorn.EngineImage {
+	return &longhorn.EngineImage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      types.GetEngineImageChecksumName(image),
+			Namespace: TestNamespace,
+			UID:       uuid.NewUUID(),
+		},
+		Spec: types.EngineImageSpec{
+			Image: image,
+		},
+		Status: types.EngineImageStatus{
+			State: types.EngineImageStateReady,
+			EngineVersionDetails: types.EngineVersionDetails{
+				CLIAPIVersion:                cliAPIVersion,
+				InstanceManagerAPIVersion:    engineapi.CurrentInstanceManagerAPIVersion,
+				InstanceManagerAPIMinVersion: engineapi.CurrentInstanceManagerAPIVersion,
+			},
+		},
+	}
+}
+
+// setInstanceManagerReady marks the instance manager pod created by the
+// handler running on the IP
+func setInstanceManagerReady(c *C, kubeClient *fake.Clientset, pIndexer cache.Indexer, name, ip string) *v1.Pod {
+	pod, err := kubeClient.CoreV1().Pods(TestNamespace).Get(name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	pod.Status.Phase = v1.PodRunning
+	pod.Status.PodIP = ip
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: instanceManagerContainerName, Ready: true}}
+	c.Assert(pIndexer.Add(pod), IsNil)
+	return pod
+}
+
+func (s *TestSuite) TestReconcileInstanceStateWithInstanceManager(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+	pIndexer := kubeInformerFactory.Core().V1().Pods().Informer().GetIndexer()
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	eiIndexer := lhInformerFactory.Longhorn().V1alpha1().EngineImages().Informer().GetIndexer()
+
+	rc := newTestReplicaController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+	h := rc.instanceHandler
+	ims := h.instanceManagers.(*engineapi.InstanceManagerSimulatorCollection)
+
+	ei := newInstanceManagerEngineImage(TestEngineImage, engineapi.CurrentCLIVersion)
+	c.Assert(eiIndexer.Add(ei), IsNil)
+
+	r := newReplica(types.InstanceStateRunning, types.InstanceStateStopped, "")
+	r.Spec.NodeID = TestNode1
+	r.Spec.DataPath = TestDefaultDataPath
+	r.Spec.EngineImage = TestEngineImage
+
+	// the instance manager is created on the node, and the replica waits
+	// for it
+	c.Assert(h.ReconcileInstanceState(r, &r.Spec.InstanceSpec, &r.Status.InstanceStatus), IsNil)
+	imName := types.GetInstanceManagerName(types.InstanceManagerTypeReplica, TestNode1, TestEngineImage)
+	c.Assert(r.Status.InstanceManagerName, Equals, imName)
+	c.Assert(r.Status.CurrentState, Equals, types.InstanceStateStarting)
+	im, err := kubeClient.CoreV1().Pods(TestNamespace).Get(imName, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(im.Spec.NodeName, Equals, TestNode1)
+	c.Assert(im.Spec.Containers[0].Image, Equals, TestEngineImage)
+	c.Assert(im.OwnerReferences[0].UID, Equals, ei.UID)
+	c.Assert(types.IsInstanceManagerPod(im.Labels), Equals, true)
+
+	// the process is started once the instance manager is ready
+	setInstanceManagerReady(c, kubeClient, pIndexer, imName, TestIP2)
+	c.Assert(h.ReconcileInstanceState(r, &r.Spec.InstanceSpec, &r.Status.InstanceStatus), IsNil)
+	c.Assert(h.ReconcileInstanceState(r, &r.Spec.InstanceSpec, &r.Status.InstanceStatus), IsNil)
+	c.Assert(r.Status.CurrentState, Equals, types.InstanceStateRunning)
+	c.Assert(r.Status.Started, Equals, true)
+	c.Assert(r.Status.IP, Equals, TestIP2)
+	c.Assert(r.Status.Port, Not(Equals), 0)
+	c.Assert(r.Status.CurrentImage, Equals, TestEngineImage)
+	process, err := ims.GetInstanceManagerSimulator(TestIP2).ProcessGet(r.Name)
+	c.Assert(err, IsNil)
+	c.Assert(process.Spec.Args[1], Equals, replicaProcessHostMountPath+TestDefaultDataPath)
+	c.Assert(process.Spec.PortCount, Equals, engineapi.ReplicaProcessPortCount)
+	podList, err := kubeClient.CoreV1().Pods(TestNamespace).List(metav1.ListOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(podList.Items, HasLen, 1)
+
+	// the crashed process is reported in error
+	c.Assert(ims.GetInstanceManagerSimulator(TestIP2).SetProcessState(r.Name, engineapi.ProcessStateError, "crashed"), IsNil)
+	c.Assert(h.ReconcileInstanceState(r, &r.Spec.InstanceSpec, &r.Status.InstanceStatus), IsNil)
+	c.Assert(r.Status.CurrentState, Equals, types.InstanceStateError)
+	c.Assert(r.Status.IP, Equals, "")
+	c.Assert(r.Status.Port, Equals, 0)
+
+	// the stopped process releases the instance manager
+	r.Spec.DesireState = types.InstanceStateStopped
+	c.Assert(h.ReconcileInstanceState(r, &r.Spec.InstanceSpec, &r.Status.InstanceStatus), IsNil)
+	c.Assert(r.Status.CurrentState, Equals, types.InstanceStateStopped)
+	c.Assert(r.Status.InstanceManagerName, Equals, "")
+	processes, err := ims.GetInstanceManagerSimulator(TestIP2).ProcessList()
+	c.Assert(err, IsNil)
+	c.Assert(processes, HasLen, 0)
+}
+
+func (s *TestSuite) TestReconcileInstanceStateInPod(c *C) {
+	testCases := map[string]struct {
+		imAPIVersion    int
+		imAPIMinVersion int
+		baseImage       string
+		existingPod     bool
+	}{
+		"engine image without instance manager": {
+			imAPIVersion:    0,
+			imAPIMinVersion: 0,
+		},
+		"engine image version unknown": {
+			imAPIVersion:    types.InvalidEngineVersion,
+			imAPIMinVersion: types.InvalidEngineVersion,
+		},
+		"instance manager API no longer compatible": {
+			imAPIVersion:    engineapi.CurrentInstanceManagerAPIVersion + 1,
+			imAPIMinVersion: engineapi.CurrentInstanceManagerAPIVersion + 1,
+		},
+		"replica with base image": {
+			imAPIVersion:    engineapi.CurrentInstanceManagerAPIVersion,
+			imAPIMinVersion: engineapi.CurrentInstanceManagerAPIVersion,
+			baseImage:       "base-image:latest",
+		},
+		// the instance started before the upgrade keeps running
+		"replica running in pod": {
+			imAPIVersion:    engineapi.CurrentInstanceManagerAPIVersion,
+			imAPIMinVersion: engineapi.CurrentInstanceManagerAPIVersion,
+			existingPod:     true,
+		},
+	}
+	for name, tc := range testCases {
+		fmt.Printf("testing %v\n", name)
+
+		kubeClient := fake.NewSimpleClientset()
+		kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+		pIndexer := kubeInformerFactory.Core().V1().Pods().Informer().GetIndexer()
+		lhClient := lhfake.NewSimpleClientset()
+		lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+		eiIndexer := lhInformerFactory.Longhorn().V1alpha1().EngineImages().Informer().GetIndexer()
+
+		rc := newTestReplicaController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+		ei := newInstanceManagerEngineImage(TestEngineImage, engineapi.CurrentCLIVersion)
+		ei.Status.InstanceManagerAPIVersion = tc.imAPIVersion
+		ei.Status.InstanceManagerAPIMinVersion = tc.imAPIMinVersion
+		c.Assert(eiIndexer.Add(ei), IsNil)
+
+		currentState := types.InstanceStateStopped
+		if tc.existingPod {
+			currentState = types.InstanceStateRunning
+		}
+		r := newReplica(types.InstanceStateRunning, currentState, "")
+		r.Spec.NodeID = TestNode1
+		r.Spec.DataPath = TestDefaultDataPath
+		r.Spec.EngineImage = TestEngineImage
+		r.Spec.BaseImage = tc.baseImage
+		if tc.existingPod {
+			pod := newPod(v1.PodRunning, r.Name, r.Namespace, r.Spec.NodeID)
+			c.Assert(pIndexer.Add(pod), IsNil)
+			_, err := kubeClient.CoreV1().Pods(r.Namespace).Create(pod)
+			c.Assert(err, IsNil)
+		}
+
+		c.Assert(rc.instanceHandler.ReconcileInstanceState(r, &r.Spec.InstanceSpec, &r.Status.InstanceStatus), IsNil)
+		c.Assert(r.Status.InstanceManagerName, Equals, "")
+		podList, err := kubeClient.CoreV1().Pods(r.Namespace).List(metav1.ListOptions{})
+		c.Assert(err, IsNil)
+		c.Assert(podList.Items, HasLen, 1)
+		c.Assert(podList.Items[0].Name, Equals, r.Name)
+	}
 }
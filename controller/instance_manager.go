@@ -0,0 +1,165 @@
+package controller
+
+import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	instanceManagerContainerName = "instance-manager"
+
+	instanceManagerReadinessProbeInitialDelay  = 1
+	instanceManagerReadinessProbePeriodSeconds = 1
+
+	// replicaProcessHostMountPath is where the replica instance manager
+	// mounts the root of the host, so the processes can reach the data
+	// path on any disk
+	replicaProcessHostMountPath = "/host"
+)
+
+// getInstanceManagerEngineImage returns the engine image if the instance
+// managers can be deployed with it, or nil. The engine image not ready, or
+// not shipping an instance manager of a compatible API version, runs the
+// instances in the pods of their own.
+func getInstanceManagerEngineImage(ds *datastore.DataStore, image string) (*longhorn.EngineImage, error) {
+	ei, err := ds.GetEngineImage(types.GetEngineImageChecksumName(image))
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if ei.Status.State != types.EngineImageStateReady {
+		return nil, nil
+	}
+	if err := engineapi.CheckInstanceManagerCompatibility(ei.Status.InstanceManagerAPIVersion, ei.Status.InstanceManagerAPIMinVersion); err != nil {
+		return nil, nil
+	}
+	return ei, nil
+}
+
+// isInstanceManagerReady returns true if the instance manager pod is ready to
+// manage the processes
+func isInstanceManagerReady(pod *v1.Pod) bool {
+	if pod == nil || pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" {
+		return false
+	}
+	for _, st := range pod.Status.ContainerStatuses {
+		if !st.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// newInstanceManagerPodSpec returns the instance manager pod of the type for
+// the engine image on the node. It's owned by the engine image, so it's
+// cleaned up once the engine image is no longer used.
+func newInstanceManagerPodSpec(imType types.InstanceManagerType, name, namespace, nodeID string, ei *longhorn.EngineImage, tolerations []v1.Toleration) *v1.Pod {
+	privileged := true
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    types.GetInstanceManagerLabels(imType, nodeID, ei.Spec.Image),
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: longhorn.SchemeGroupVersion.String(),
+					Kind:       ownerKindEngineImage,
+					UID:        ei.UID,
+					Name:       ei.Name,
+				},
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName: nodeID,
+			// the processes are gone with the container, and the instances
+			// are found in error by their controllers
+			RestartPolicy: v1.RestartPolicyAlways,
+			Tolerations:   tolerations,
+			Containers: []v1.Container{
+				{
+					Name:  instanceManagerContainerName,
+					Image: ei.Spec.Image,
+					Command: []string{
+						"longhorn-instance-manager", "daemon",
+						"--listen", "0.0.0.0:" + engineapi.InstanceManagerDefaultPort,
+					},
+					SecurityContext: &v1.SecurityContext{
+						Privileged: &privileged,
+					},
+					ReadinessProbe: &v1.Probe{
+						Handler: v1.Handler{
+							TCPSocket: &v1.TCPSocketAction{
+								Port: intstr.Parse(engineapi.InstanceManagerDefaultPort),
+							},
+						},
+						InitialDelaySeconds: instanceManagerReadinessProbeInitialDelay,
+						PeriodSeconds:       instanceManagerReadinessProbePeriodSeconds,
+					},
+				},
+			},
+		},
+	}
+
+	switch imType {
+	case types.InstanceManagerTypeEngine:
+		// the frontend of the engines is served from the host
+		pod.Spec.Containers[0].VolumeMounts = []v1.VolumeMount{
+			{
+				Name:      "dev",
+				MountPath: "/host/dev",
+			},
+			{
+				Name:      "proc",
+				MountPath: "/host/proc",
+			},
+		}
+		pod.Spec.Volumes = []v1.Volume{
+			{
+				Name: "dev",
+				VolumeSource: v1.VolumeSource{
+					HostPath: &v1.HostPathVolumeSource{
+						Path: "/dev",
+					},
+				},
+			},
+			{
+				Name: "proc",
+				VolumeSource: v1.VolumeSource{
+					HostPath: &v1.HostPathVolumeSource{
+						Path: "/proc",
+					},
+				},
+			},
+		}
+	case types.InstanceManagerTypeReplica:
+		// the disks mounted after the pod started are propagated
+		hostToContainer := v1.MountPropagationHostToContainer
+		pod.Spec.Containers[0].VolumeMounts = []v1.VolumeMount{
+			{
+				Name:             "host",
+				MountPath:        replicaProcessHostMountPath,
+				MountPropagation: &hostToContainer,
+			},
+		}
+		pod.Spec.Volumes = []v1.Volume{
+			{
+				Name: "host",
+				VolumeSource: v1.VolumeSource{
+					HostPath: &v1.HostPathVolumeSource{
+						Path: "/",
+					},
+				},
+			},
+		}
+	}
+	return pod
+}
@@ -0,0 +1,443 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/kubernetes/pkg/controller"
+
+	"github.com/rancher/longhorn-manager/csi"
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhinformers "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions/longhorn/v1alpha1"
+)
+
+// KubernetesPodController deletes the workload pods using the Longhorn
+// volumes which cannot recover by themselves, so their controllers recreate
+// them and the volumes are attached again cleanly:
+//
+// 1. The pod on the node which is down. It's stuck, since the kubelet is
+// gone, and it keeps the StatefulSet from recreating it elsewhere. It's
+// force deleted, and the VolumeAttachments of its volumes on the node are
+// deleted as well if the policy says so.
+// 2. The pod started before its volume was detached unexpectedly, e.g. the
+// engine crashed. It keeps running against the dead mount.
+//
+// The pods not managed by a controller are left alone, since nothing would
+// recreate them. Only the leader deletes the pods.
+type KubernetesPodController struct {
+	// which namespace controller is running with
+	namespace string
+	// use as the OwnerID of the controller
+	controllerID string
+
+	kubeClient    clientset.Interface
+	eventRecorder record.EventRecorder
+
+	ds *datastore.DataStore
+
+	pStoreSynced cache.InformerSynced
+	vStoreSynced cache.InformerSynced
+	nStoreSynced cache.InformerSynced
+
+	queue  workqueue.RateLimitingInterface
+	health *queueHealth
+	logger logrus.FieldLogger
+
+	isLeaderHandler IsLeaderHandler
+}
+
+func NewKubernetesPodController(
+	ds *datastore.DataStore,
+	scheme *runtime.Scheme,
+	config ControllerConfig,
+	podInformer coreinformers.PodInformer,
+	volumeInformer lhinformers.VolumeInformer,
+	nodeInformer lhinformers.NodeInformer,
+	kubeClient clientset.Interface,
+	namespace string, controllerID string) *KubernetesPodController {
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(logrus.Infof)
+	// TODO: remove the wrapper when every clients have moved to use the clientset.
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(kubeClient.CoreV1().RESTClient()).Events("")})
+
+	kc := &KubernetesPodController{
+		namespace:    namespace,
+		controllerID: controllerID,
+
+		kubeClient:    kubeClient,
+		eventRecorder: eventBroadcaster.NewRecorder(scheme, v1.EventSource{Component: "longhorn-kubernetes-pod-controller"}),
+
+		ds: ds,
+
+		pStoreSynced: podInformer.Informer().HasSynced,
+		vStoreSynced: volumeInformer.Informer().HasSynced,
+		nStoreSynced: nodeInformer.Informer().HasSynced,
+
+		queue:  config.newQueue("longhorn-kubernetes-pod"),
+		logger: newControllerLogger("longhorn-kubernetes-pod"),
+
+		isLeaderHandler: alwaysLeader,
+	}
+	kc.health = newQueueHealth("longhorn-kubernetes-pod", kc.queue)
+
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pod := obj.(*v1.Pod)
+			kc.enqueuePod(pod)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			curPod := cur.(*v1.Pod)
+			kc.enqueuePod(curPod)
+		},
+	})
+
+	volumeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, cur interface{}) {
+			oldV := old.(*longhorn.Volume)
+			curV := cur.(*longhorn.Volume)
+			if oldV.Status.RemountRequestedAt != curV.Status.RemountRequestedAt {
+				kc.enqueueVolumePods(curV)
+			}
+		},
+	})
+
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, cur interface{}) {
+			oldNode := old.(*longhorn.Node)
+			curNode := cur.(*longhorn.Node)
+			if isNodeDown(oldNode) != isNodeDown(curNode) {
+				kc.enqueueNodePods(curNode)
+			}
+		},
+	})
+
+	return kc
+}
+
+func (kc *KubernetesPodController) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer kc.queue.ShutDown()
+
+	kc.logger.Infof("Start Longhorn Kubernetes pod controller")
+	defer kc.logger.Infof("Shutting down Longhorn Kubernetes pod controller")
+
+	// the pods left alone by the previous policy are checked again
+	kc.ds.OnSettingChange(func(name types.SettingName) {
+		kc.enqueuePodsIf(func(pod *v1.Pod) bool {
+			return true
+		})
+	}, types.SettingNameWorkloadPodDeletionPolicy)
+
+	if !controller.WaitForCacheSync("longhorn kubernetes pods", stopCh, kc.pStoreSynced, kc.vStoreSynced, kc.nStoreSynced) {
+		return
+	}
+
+	runWorkers(workers, kc.worker, kc.queue, stopCh)
+}
+
+func (kc *KubernetesPodController) worker() {
+	for kc.processNextWorkItem() {
+	}
+}
+
+func (kc *KubernetesPodController) processNextWorkItem() bool {
+	key, quit := kc.queue.Get()
+
+	if quit {
+		return false
+	}
+	defer kc.queue.Done(key)
+	defer kc.health.processed()
+
+	err := kc.syncPod(key.(string))
+	kc.handleErr(err, key)
+
+	return true
+}
+
+func (kc *KubernetesPodController) handleErr(err error, key interface{}) {
+	if err == nil {
+		kc.queue.Forget(key)
+		return
+	}
+
+	if kc.queue.NumRequeues(key) < maxRetries {
+		kc.logger.WithField("pod", key).Warnf("Error syncing Kubernetes pod: %v", err)
+		kc.queue.AddRateLimited(key)
+		return
+	}
+
+	utilruntime.HandleError(err)
+	kc.logger.WithField("pod", key).Warnf("Dropping Kubernetes pod out of the queue: %v", err)
+	kc.queue.Forget(key)
+}
+
+func (kc *KubernetesPodController) syncPod(key string) (err error) {
+	defer func() {
+		err = errors.Wrapf(err, "fail to sync Kubernetes pod %v", key)
+	}()
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	policy, err := kc.ds.GetSettingValue(types.SettingNameWorkloadPodDeletionPolicy)
+	if err != nil {
+		return err
+	}
+	if policy == types.WorkloadPodDeletionPolicyDoNothing {
+		return nil
+	}
+	if !kc.isLeaderHandler() {
+		return nil
+	}
+
+	pod, err := kc.ds.GetWorkloadPodRO(namespace, name)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	// nothing would recreate it
+	if metav1.GetControllerOf(pod) == nil {
+		return nil
+	}
+	pvVolumes, err := kc.getPodLonghornVolumes(pod)
+	if err != nil {
+		return err
+	}
+	if len(pvVolumes) == 0 {
+		return nil
+	}
+	logger := kc.logger.WithField("pod", key)
+
+	nodeDown := false
+	if pod.Spec.NodeName != "" {
+		node, err := kc.ds.GetNodeRO(pod.Spec.NodeName)
+		if err != nil && !datastore.ErrorIsNotFound(err) {
+			return err
+		}
+		nodeDown = node != nil && isNodeDown(node)
+	}
+	if nodeDown {
+		// the pod stuck in terminating is deleted as well, since the
+		// kubelet won't confirm it
+		if policy == types.WorkloadPodDeletionPolicyDeletePodAndVolumeAttachment {
+			if err := kc.deleteVolumeAttachments(pvVolumes, pod.Spec.NodeName); err != nil {
+				return err
+			}
+		}
+		if err := kc.ds.DeleteWorkloadPod(pod, true); err != nil {
+			if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+				return nil
+			}
+			return err
+		}
+		logger.Warnf("Force deleted pod on down node %v, so it's recreated and attaches the Longhorn volumes elsewhere", pod.Spec.NodeName)
+		kc.eventRecorder.Eventf(pod, v1.EventTypeWarning, EventReasonDelete,
+			"Force deleted pod on down node %v, so it's recreated and attaches the Longhorn volumes elsewhere", pod.Spec.NodeName)
+		return nil
+	}
+
+	if pod.DeletionTimestamp != nil || pod.Status.StartTime == nil {
+		return nil
+	}
+	for _, volumeName := range pvVolumes {
+		v, err := kc.ds.GetVolumeRO(volumeName)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if v.Status.RemountRequestedAt == "" {
+			continue
+		}
+		remountRequestedAt, err := util.ParseTime(v.Status.RemountRequestedAt)
+		if err != nil {
+			return errors.Wrapf(err, "invalid remount request time of volume %v", v.Name)
+		}
+		if !pod.Status.StartTime.Time.Before(remountRequestedAt) {
+			continue
+		}
+		if err := kc.ds.DeleteWorkloadPod(pod, false); err != nil {
+			if apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+				return nil
+			}
+			return err
+		}
+		logger.Warnf("Deleted pod since volume %v was detached unexpectedly at %v, so it's recreated and mounts the volume again",
+			v.Name, v.Status.RemountRequestedAt)
+		kc.eventRecorder.Eventf(pod, v1.EventTypeWarning, EventReasonDelete,
+			"Deleted pod since Longhorn volume %v was detached unexpectedly at %v, so it's recreated and mounts the volume again",
+			v.Name, v.Status.RemountRequestedAt)
+		return nil
+	}
+	return nil
+}
+
+// getPodLonghornVolumes returns the Longhorn volumes of the PVCs of the pod,
+// keyed by the PV
+func (kc *KubernetesPodController) getPodLonghornVolumes(pod *v1.Pod) (map[string]string, error) {
+	pvVolumes := map[string]string{}
+	for _, podVolume := range pod.Spec.Volumes {
+		if podVolume.PersistentVolumeClaim == nil {
+			continue
+		}
+		pvc, err := kc.ds.GetPersistentVolumeClaimRO(pod.Namespace, podVolume.PersistentVolumeClaim.ClaimName)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if pvc.Spec.VolumeName == "" {
+			continue
+		}
+		pv, err := kc.ds.GetPersistentVolumeRO(pvc.Spec.VolumeName)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if volumeName := getLonghornVolumeName(pv); volumeName != "" {
+			pvVolumes[pv.Name] = volumeName
+		}
+	}
+	return pvVolumes, nil
+}
+
+// deleteVolumeAttachments deletes the VolumeAttachments of the PVs on the
+// node, which are only cleaned up by Kubernetes after the node is gone for a
+// while, and keep the volumes from being attached elsewhere until then
+func (kc *KubernetesPodController) deleteVolumeAttachments(pvVolumes map[string]string, nodeName string) error {
+	vas, err := kc.ds.ListVolumeAttachmentsRO()
+	if err != nil {
+		return err
+	}
+	for _, va := range vas {
+		pvName := va.Spec.Source.PersistentVolumeName
+		if pvName == nil || va.Spec.NodeName != nodeName {
+			continue
+		}
+		if _, ok := pvVolumes[*pvName]; !ok {
+			continue
+		}
+		if err := kc.ds.DeleteVolumeAttachment(va.Name); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "fail to delete VolumeAttachment %v", va.Name)
+		}
+		kc.logger.WithField("volume", pvVolumes[*pvName]).Warnf("Deleted VolumeAttachment %v on down node %v", va.Name, nodeName)
+	}
+	return nil
+}
+
+// getLonghornVolumeName returns the Longhorn volume of the PV, or empty if
+// the PV isn't provided by Longhorn
+func getLonghornVolumeName(pv *v1.PersistentVolume) string {
+	if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == csi.DefaultCSIDriverName {
+		return pv.Spec.CSI.VolumeHandle
+	}
+	// the flexvolume PV is named after the volume by the provisioner
+	if pv.Spec.FlexVolume != nil && pv.Spec.FlexVolume.Driver == LonghornDriver {
+		return pv.Name
+	}
+	return ""
+}
+
+// isNodeDown returns true if the Kubernetes node is gone or not ready, in
+// which case its pods are stuck
+func isNodeDown(node *longhorn.Node) bool {
+	condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
+	return condition.Status == types.ConditionStatusFalse &&
+		(condition.Reason == types.NodeConditionReasonKubernetesNodeDown ||
+			condition.Reason == types.NodeConditionReasonKubernetesNodeNotReady)
+}
+
+func (kc *KubernetesPodController) enqueuePod(pod *v1.Pod) {
+	hasClaim := false
+	for _, podVolume := range pod.Spec.Volumes {
+		if podVolume.PersistentVolumeClaim != nil {
+			hasClaim = true
+			break
+		}
+	}
+	if !hasClaim {
+		return
+	}
+
+	key, err := controller.KeyFunc(pod)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Couldn't get key for object %#v: %v", pod, err))
+		return
+	}
+
+	kc.queue.AddRateLimited(key)
+}
+
+func (kc *KubernetesPodController) enqueueVolumePods(v *longhorn.Volume) {
+	pvs, err := kc.ds.ListPersistentVolumesRO()
+	if err != nil {
+		kc.logger.Warnf("Fail to list PVs for volume %v: %v", v.Name, err)
+		return
+	}
+	claims := map[string]struct{}{}
+	for _, pv := range pvs {
+		if pv.Spec.ClaimRef == nil || getLonghornVolumeName(pv) != v.Name {
+			continue
+		}
+		claims[pv.Spec.ClaimRef.Namespace+"/"+pv.Spec.ClaimRef.Name] = struct{}{}
+	}
+	if len(claims) == 0 {
+		return
+	}
+	kc.enqueuePodsIf(func(pod *v1.Pod) bool {
+		for _, podVolume := range pod.Spec.Volumes {
+			if podVolume.PersistentVolumeClaim == nil {
+				continue
+			}
+			if _, ok := claims[pod.Namespace+"/"+podVolume.PersistentVolumeClaim.ClaimName]; ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (kc *KubernetesPodController) enqueueNodePods(node *longhorn.Node) {
+	kc.enqueuePodsIf(func(pod *v1.Pod) bool {
+		return pod.Spec.NodeName == node.Name
+	})
+}
+
+func (kc *KubernetesPodController) enqueuePodsIf(match func(pod *v1.Pod) bool) {
+	pods, err := kc.ds.ListWorkloadPodsRO()
+	if err != nil {
+		kc.logger.Warnf("Fail to list pods: %v", err)
+		return
+	}
+	for _, pod := range pods {
+		if match(pod) {
+			kc.enqueuePod(pod)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"time"
+
+	"k8s.io/api/core/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/controller"
+
+	"github.com/rancher/longhorn-manager/csi"
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+
+	. "gopkg.in/check.v1"
+)
+
+const (
+	TestWorkloadNamespace = "workload"
+)
+
+type kubernetesPodFixture struct {
+	lhClient            *lhfake.Clientset
+	kubeClient          *fake.Clientset
+	lhInformerFactory   lhinformerfactory.SharedInformerFactory
+	kubeInformerFactory informers.SharedInformerFactory
+}
+
+func newKubernetesPodFixture(c *C, policy string) (*kubernetesPodFixture, *KubernetesPodController) {
+	lhClient := lhfake.NewSimpleClientset()
+	kubeClient := fake.NewSimpleClientset()
+	f := &kubernetesPodFixture{
+		lhClient:            lhClient,
+		kubeClient:          kubeClient,
+		lhInformerFactory:   lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc()),
+		kubeInformerFactory: informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc()),
+	}
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer().Add(&longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      string(types.SettingNameWorkloadPodDeletionPolicy),
+			Namespace: TestNamespace,
+		},
+		Setting: types.Setting{Value: policy},
+	}), IsNil)
+
+	ds := datastore.NewDataStore(
+		f.lhInformerFactory.Longhorn().V1alpha1().Volumes(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Engines(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Replicas(),
+		f.lhInformerFactory.Longhorn().V1alpha1().EngineImages(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Nodes(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Settings(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Snapshots(),
+		lhClient,
+		f.kubeInformerFactory.Core().V1().Pods(),
+		f.kubeInformerFactory.Batch().V1beta1().CronJobs(),
+		f.kubeInformerFactory.Apps().V1beta2().DaemonSets(),
+		f.kubeInformerFactory.Core().V1().Events(),
+		f.kubeInformerFactory.Core().V1().PersistentVolumes(),
+		f.kubeInformerFactory.Core().V1().PersistentVolumeClaims(),
+		f.kubeInformerFactory.Storage().V1beta1().VolumeAttachments(),
+		kubeClient, TestNamespace)
+	kc := NewKubernetesPodController(ds, scheme.Scheme, DefaultControllerConfig(),
+		f.kubeInformerFactory.Core().V1().Pods(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Volumes(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Nodes(),
+		kubeClient, TestNamespace, TestNode1)
+	kc.eventRecorder = record.NewFakeRecorder(100)
+	return f, kc
+}
+
+func (f *kubernetesPodFixture) addNode(c *C, node *longhorn.Node) {
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer().Add(node), IsNil)
+}
+
+func (f *kubernetesPodFixture) addVolume(c *C, v *longhorn.Volume) {
+	v.Namespace = TestNamespace
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer().Add(v), IsNil)
+}
+
+// addClaim adds the PVC bound to the PV of the volume. The PV is provided by
+// the CSI driver, or by the other driver if volumeName is empty
+func (f *kubernetesPodFixture) addClaim(c *C, claimName, pvName, volumeName string) {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Namespace: TestWorkloadNamespace, Name: claimName},
+		},
+	}
+	if volumeName != "" {
+		pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: csi.DefaultCSIDriverName, VolumeHandle: volumeName}
+	} else {
+		pv.Spec.HostPath = &v1.HostPathVolumeSource{Path: "/data"}
+	}
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: claimName, Namespace: TestWorkloadNamespace},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: pvName},
+	}
+	c.Assert(f.kubeInformerFactory.Core().V1().PersistentVolumes().Informer().GetIndexer().Add(pv), IsNil)
+	c.Assert(f.kubeInformerFactory.Core().V1().PersistentVolumeClaims().Informer().GetIndexer().Add(pvc), IsNil)
+}
+
+func (f *kubernetesPodFixture) addPod(c *C, name, nodeName, claimName string, controlled bool, startTime time.Time) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: TestWorkloadNamespace},
+		Spec: v1.PodSpec{
+			NodeName: nodeName,
+			Volumes: []v1.Volume{
+				{
+					Name: "data",
+					VolumeSource: v1.VolumeSource{
+						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+					},
+				},
+			},
+		},
+		Status: v1.PodStatus{
+			StartTime: &metav1.Time{Time: startTime},
+		},
+	}
+	if controlled {
+		isController := true
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "workload", Controller: &isController},
+		}
+	}
+	pod, err := f.kubeClient.CoreV1().Pods(TestWorkloadNamespace).Create(pod)
+	c.Assert(err, IsNil)
+	c.Assert(f.kubeInformerFactory.Core().V1().Pods().Informer().GetIndexer().Add(pod), IsNil)
+}
+
+func (f *kubernetesPodFixture) addVolumeAttachment(c *C, name, pvName, nodeName string) {
+	va := &storagev1beta1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storagev1beta1.VolumeAttachmentSpec{
+			Attacher: csi.DefaultCSIDriverName,
+			Source:   storagev1beta1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+			NodeName: nodeName,
+		},
+	}
+	va, err := f.kubeClient.StorageV1beta1().VolumeAttachments().Create(va)
+	c.Assert(err, IsNil)
+	c.Assert(f.kubeInformerFactory.Storage().V1beta1().VolumeAttachments().Informer().GetIndexer().Add(va), IsNil)
+}
+
+func (f *kubernetesPodFixture) podExists(c *C, name string) bool {
+	_, err := f.kubeClient.CoreV1().Pods(TestWorkloadNamespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false
+	}
+	c.Assert(err, IsNil)
+	return true
+}
+
+func (f *kubernetesPodFixture) volumeAttachmentExists(c *C, name string) bool {
+	_, err := f.kubeClient.StorageV1beta1().VolumeAttachments().Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false
+	}
+	c.Assert(err, IsNil)
+	return true
+}
+
+func (f *kubernetesPodFixture) syncPods(c *C, kc *KubernetesPodController, names ...string) {
+	for _, name := range names {
+		c.Assert(kc.syncPod(TestWorkloadNamespace+"/"+name), IsNil)
+	}
+}
+
+func (s *TestSuite) TestKubernetesPodControllerNodeDown(c *C) {
+	f, kc := newKubernetesPodFixture(c, types.WorkloadPodDeletionPolicyDeletePodAndVolumeAttachment)
+	f.addNode(c, newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, ""))
+	f.addNode(c, newNode(TestNode2, TestNamespace, true, types.ConditionStatusFalse, types.NodeConditionReasonKubernetesNodeNotReady))
+	f.addVolume(c, newVolume(TestVolumeName, 2))
+	f.addClaim(c, "longhorn-claim", "longhorn-pv", TestVolumeName)
+	f.addClaim(c, "other-claim", "other-pv", "")
+
+	now := time.Now()
+	f.addPod(c, "stuck", TestNode2, "longhorn-claim", true, now)
+	f.addPod(c, "standalone", TestNode2, "longhorn-claim", false, now)
+	f.addPod(c, "other", TestNode2, "other-claim", true, now)
+	f.addPod(c, "healthy", TestNode1, "longhorn-claim", true, now)
+	f.addVolumeAttachment(c, "va-down", "longhorn-pv", TestNode2)
+	f.addVolumeAttachment(c, "va-up", "longhorn-pv", TestNode1)
+	f.addVolumeAttachment(c, "va-other", "other-pv", TestNode2)
+
+	f.syncPods(c, kc, "stuck", "standalone", "other", "healthy")
+
+	// only the pod recreated by its controller, and using the Longhorn
+	// volume on the down node is deleted
+	c.Assert(f.podExists(c, "stuck"), Equals, false)
+	c.Assert(f.podExists(c, "standalone"), Equals, true)
+	c.Assert(f.podExists(c, "other"), Equals, true)
+	c.Assert(f.podExists(c, "healthy"), Equals, true)
+	c.Assert(f.volumeAttachmentExists(c, "va-down"), Equals, false)
+	c.Assert(f.volumeAttachmentExists(c, "va-up"), Equals, true)
+	c.Assert(f.volumeAttachmentExists(c, "va-other"), Equals, true)
+}
+
+func (s *TestSuite) TestKubernetesPodControllerNodeDownKeepVolumeAttachment(c *C) {
+	f, kc := newKubernetesPodFixture(c, types.WorkloadPodDeletionPolicyDeletePod)
+	f.addNode(c, newNode(TestNode2, TestNamespace, true, types.ConditionStatusFalse, types.NodeConditionReasonKubernetesNodeDown))
+	f.addVolume(c, newVolume(TestVolumeName, 2))
+	f.addClaim(c, "longhorn-claim", "longhorn-pv", TestVolumeName)
+	f.addPod(c, "stuck", TestNode2, "longhorn-claim", true, time.Now())
+	f.addVolumeAttachment(c, "va-down", "longhorn-pv", TestNode2)
+
+	f.syncPods(c, kc, "stuck")
+
+	c.Assert(f.podExists(c, "stuck"), Equals, false)
+	c.Assert(f.volumeAttachmentExists(c, "va-down"), Equals, true)
+}
+
+func (s *TestSuite) TestKubernetesPodControllerRemount(c *C) {
+	f, kc := newKubernetesPodFixture(c, types.WorkloadPodDeletionPolicyDeletePod)
+	f.addNode(c, newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, ""))
+	v := newVolume(TestVolumeName, 2)
+	v.Status.RemountRequestedAt = TestTimeNow
+	f.addVolume(c, v)
+	f.addClaim(c, "longhorn-claim", "longhorn-pv", TestVolumeName)
+
+	remountRequestedAt, err := time.Parse(time.RFC3339, TestTimeNow)
+	c.Assert(err, IsNil)
+	f.addPod(c, "dead-mount", TestNode1, "longhorn-claim", true, remountRequestedAt.Add(-time.Minute))
+	f.addPod(c, "remounted", TestNode1, "longhorn-claim", true, remountRequestedAt.Add(time.Minute))
+
+	f.syncPods(c, kc, "dead-mount", "remounted")
+
+	c.Assert(f.podExists(c, "dead-mount"), Equals, false)
+	c.Assert(f.podExists(c, "remounted"), Equals, true)
+}
+
+func (s *TestSuite) TestKubernetesPodControllerDoNothing(c *C) {
+	f, kc := newKubernetesPodFixture(c, types.WorkloadPodDeletionPolicyDoNothing)
+	f.addNode(c, newNode(TestNode2, TestNamespace, true, types.ConditionStatusFalse, types.NodeConditionReasonKubernetesNodeDown))
+	v := newVolume(TestVolumeName, 2)
+	v.Status.RemountRequestedAt = TestTimeNow
+	f.addVolume(c, v)
+	f.addClaim(c, "longhorn-claim", "longhorn-pv", TestVolumeName)
+	f.addPod(c, "stuck", TestNode2, "longhorn-claim", true, time.Time{})
+	f.addVolumeAttachment(c, "va-down", "longhorn-pv", TestNode2)
+
+	f.syncPods(c, kc, "stuck")
+
+	c.Assert(f.podExists(c, "stuck"), Equals, true)
+	c.Assert(f.volumeAttachmentExists(c, "va-down"), Equals, true)
+}
@@ -0,0 +1,323 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/kubernetes/pkg/controller"
+)
+
+const (
+	LeaderElectionLeaseName = "longhorn-manager-leader"
+
+	// the leader is replaced in LeaderElectionLeaseDuration if its pod
+	// dies, or right away if the pod is shut down gracefully
+	LeaderElectionLeaseDuration = 15 * time.Second
+	LeaderElectionRenewDeadline = 10 * time.Second
+	LeaderElectionRetryPeriod   = 2 * time.Second
+)
+
+// IsLeaderHandler tells whether the manager runs the cluster wide work. The
+// controllers lead by default, and are given LeaderElection.IsLeader by
+// StartControllers.
+type IsLeaderHandler func() bool
+
+func alwaysLeader() bool {
+	return true
+}
+
+var leaderGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "longhorn_manager",
+	Name:      "leader",
+	Help:      "Whether the manager is the leader running the cluster wide controllers, 1 for the leader",
+}, []string{"node"})
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
+
+// LeaderElection elects the single manager running the cluster wide
+// controllers through a coordination.k8s.io lease in the Longhorn
+// namespace. The identity of each manager is the name of its node. The node
+// local work keeps running on every manager regardless of the leadership.
+type LeaderElection struct {
+	namespace    string
+	controllerID string
+	kubeClient   clientset.Interface
+
+	lock     sync.RWMutex
+	isLeader bool
+	leader   string
+	// startedLeadingHandlers are called when the manager becomes the
+	// leader, to pick up the objects skipped while not leading
+	startedLeadingHandlers []func()
+
+	stopped chan struct{}
+}
+
+func NewLeaderElection(kubeClient clientset.Interface, namespace, controllerID string) *LeaderElection {
+	return &LeaderElection{
+		namespace:    namespace,
+		controllerID: controllerID,
+		kubeClient:   kubeClient,
+
+		stopped: make(chan struct{}),
+	}
+}
+
+// IsLeader returns true if the manager is the leader at the moment
+func (l *LeaderElection) IsLeader() bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.isLeader
+}
+
+// GetLeader returns the identity of the current leader as last observed
+func (l *LeaderElection) GetLeader() string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.leader
+}
+
+// Stopped returns the channel closed once Run has returned and the lease
+// has been released
+func (l *LeaderElection) Stopped() <-chan struct{} {
+	return l.stopped
+}
+
+// AddStartedLeadingHandler registers the handler called each time the
+// manager becomes the leader. It must be called before Run.
+func (l *LeaderElection) AddStartedLeadingHandler(handler func()) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.startedLeadingHandlers = append(l.startedLeadingHandlers, handler)
+}
+
+// Run campaigns for the leadership until the stop channel is closed. The
+// manager which lost the leadership campaigns again, and the lease is
+// released on stop so another manager takes over without waiting for it to
+// expire.
+func (l *LeaderElection) Run(stopCh <-chan struct{}) {
+	defer close(l.stopped)
+
+	lock := &leaseLock{
+		namespace: l.namespace,
+		name:      LeaderElectionLeaseName,
+		identity:  l.controllerID,
+		client:    l.kubeClient.CoordinationV1beta1(),
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: LeaderElectionLeaseDuration,
+		RenewDeadline: LeaderElectionRenewDeadline,
+		RetryPeriod:   LeaderElectionRetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) { l.setLeading(true) },
+			OnStoppedLeading: func() { l.setLeading(false) },
+			OnNewLeader:      l.setLeader,
+		},
+	})
+	if err != nil {
+		logrus.Errorf("BUG: invalid leader election config: %v", err)
+		return
+	}
+
+	logrus.Infof("Start Longhorn leader election with lease %v/%v", l.namespace, LeaderElectionLeaseName)
+	defer logrus.Infof("Shutting down Longhorn leader election")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	wait.Until(func() {
+		elector.Run(ctx)
+	}, LeaderElectionRetryPeriod, stopCh)
+
+	if err := lock.release(); err != nil {
+		logrus.Warnf("Fail to release the leader election lease: %v", err)
+	}
+}
+
+func (l *LeaderElection) setLeading(isLeader bool) {
+	l.lock.Lock()
+	wasLeader := l.isLeader
+	l.isLeader = isLeader
+	handlers := l.startedLeadingHandlers
+	l.lock.Unlock()
+
+	if isLeader == wasLeader {
+		return
+	}
+	if isLeader {
+		leaderGauge.WithLabelValues(l.controllerID).Set(1)
+		logrus.Infof("Longhorn manager %v became the leader", l.controllerID)
+		for _, handler := range handlers {
+			handler()
+		}
+		return
+	}
+	leaderGauge.WithLabelValues(l.controllerID).Set(0)
+	logrus.Warnf("Longhorn manager %v stopped leading", l.controllerID)
+}
+
+func (l *LeaderElection) setLeader(identity string) {
+	l.lock.Lock()
+	l.leader = identity
+	l.lock.Unlock()
+	logrus.Infof("The leader of the Longhorn managers is %v", identity)
+}
+
+// enqueueAllObjects returns the handler adding all the objects of the
+// informer to the queue, so the new leader picks up the objects skipped
+// before without waiting for the resync
+func enqueueAllObjects(informer cache.SharedIndexInformer, queue workqueue.Interface) func() {
+	return func() {
+		for _, obj := range informer.GetStore().List() {
+			key, err := controller.KeyFunc(obj)
+			if err != nil {
+				utilruntime.HandleError(fmt.Errorf("Couldn't get key for object %#v: %v", obj, err))
+				continue
+			}
+			queue.Add(key)
+		}
+	}
+}
+
+// leaseLock implements the resource lock of the leader election on a
+// coordination.k8s.io lease, which isn't provided by the client-go in use
+type leaseLock struct {
+	namespace string
+	name      string
+	identity  string
+	client    coordinationclient.LeasesGetter
+
+	lease *coordinationv1beta1.Lease
+}
+
+func (ll *leaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	lease, err := ll.client.Leases(ll.namespace).Get(ll.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ll.lease = lease
+	return leaseSpecToRecord(&lease.Spec), nil
+}
+
+func (ll *leaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	lease, err := ll.client.Leases(ll.namespace).Create(&coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ll.name,
+			Namespace: ll.namespace,
+		},
+		Spec: recordToLeaseSpec(&ler),
+	})
+	if err != nil {
+		return err
+	}
+	ll.lease = lease
+	return nil
+}
+
+func (ll *leaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if ll.lease == nil {
+		return fmt.Errorf("lease %v not initialized, call get or create first", ll.Describe())
+	}
+	lease := ll.lease.DeepCopy()
+	lease.Spec = recordToLeaseSpec(&ler)
+	lease, err := ll.client.Leases(ll.namespace).Update(lease)
+	if err != nil {
+		return err
+	}
+	ll.lease = lease
+	return nil
+}
+
+func (ll *leaseLock) RecordEvent(s string) {
+	logrus.Infof("Leader election: %v %v", ll.identity, s)
+}
+
+func (ll *leaseLock) Identity() string {
+	return ll.identity
+}
+
+func (ll *leaseLock) Describe() string {
+	return fmt.Sprintf("%v/%v", ll.namespace, ll.name)
+}
+
+// release deletes the lease if it's still held by the manager, so the other
+// managers can create it right away. Clearing the holder isn't enough since
+// the client-go in use waits for the whole lease duration after observing
+// any change.
+func (ll *leaseLock) release() error {
+	lease, err := ll.client.Leases(ll.namespace).Get(ll.name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != ll.identity {
+		return nil
+	}
+	uid := lease.UID
+	if err := ll.client.Leases(ll.namespace).Delete(ll.name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid},
+	}); err != nil && !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "cannot delete lease %v", ll.Describe())
+	}
+	logrus.Infof("Released the leader election lease %v", ll.Describe())
+	return nil
+}
+
+func leaseSpecToRecord(spec *coordinationv1beta1.LeaseSpec) *resourcelock.LeaderElectionRecord {
+	record := &resourcelock.LeaderElectionRecord{}
+	if spec.HolderIdentity != nil {
+		record.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		record.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.LeaseTransitions != nil {
+		record.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	if spec.AcquireTime != nil {
+		record.AcquireTime = metav1.NewTime(spec.AcquireTime.Time)
+	}
+	if spec.RenewTime != nil {
+		record.RenewTime = metav1.NewTime(spec.RenewTime.Time)
+	}
+	return record
+}
+
+func recordToLeaseSpec(record *resourcelock.LeaderElectionRecord) coordinationv1beta1.LeaseSpec {
+	holderIdentity := record.HolderIdentity
+	leaseDurationSeconds := int32(record.LeaseDurationSeconds)
+	leaseTransitions := int32(record.LeaderTransitions)
+	acquireTime := metav1.NewMicroTime(record.AcquireTime.Time)
+	renewTime := metav1.NewMicroTime(record.RenewTime.Time)
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &holderIdentity,
+		LeaseDurationSeconds: &leaseDurationSeconds,
+		AcquireTime:          &acquireTime,
+		RenewTime:            &renewTime,
+		LeaseTransitions:     &leaseTransitions,
+	}
+}
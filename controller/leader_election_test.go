@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/rancher/longhorn-manager/datastore"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestLeaseLock(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	newLock := func(identity string) *leaseLock {
+		return &leaseLock{
+			namespace: TestNamespace,
+			name:      LeaderElectionLeaseName,
+			identity:  identity,
+			client:    kubeClient.CoordinationV1beta1(),
+		}
+	}
+	lock1 := newLock(TestNode1)
+	lock2 := newLock(TestNode2)
+
+	_, err := lock1.Get()
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+
+	now := metav1.NewTime(time.Now().Truncate(time.Second))
+	c.Assert(lock1.Create(resourcelock.LeaderElectionRecord{
+		HolderIdentity:       TestNode1,
+		LeaseDurationSeconds: 15,
+		AcquireTime:          now,
+		RenewTime:            now,
+	}), IsNil)
+
+	record, err := lock2.Get()
+	c.Assert(err, IsNil)
+	c.Assert(record.HolderIdentity, Equals, TestNode1)
+	c.Assert(record.LeaseDurationSeconds, Equals, 15)
+	c.Assert(record.RenewTime.Equal(&now), Equals, true)
+
+	// the lease held by another manager isn't released
+	c.Assert(lock2.release(), IsNil)
+	_, err = lock1.Get()
+	c.Assert(err, IsNil)
+
+	record.HolderIdentity = TestNode2
+	record.LeaderTransitions = 1
+	c.Assert(lock2.Update(*record), IsNil)
+	record, err = lock1.Get()
+	c.Assert(err, IsNil)
+	c.Assert(record.HolderIdentity, Equals, TestNode2)
+	c.Assert(record.LeaderTransitions, Equals, 1)
+
+	c.Assert(lock2.release(), IsNil)
+	_, err = lock1.Get()
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+}
+
+func (s *TestSuite) TestLeaderElectionHandlers(c *C) {
+	l := NewLeaderElection(fake.NewSimpleClientset(), TestNamespace, TestNode1)
+	started := 0
+	l.AddStartedLeadingHandler(func() { started++ })
+
+	c.Assert(l.IsLeader(), Equals, false)
+	l.setLeading(true)
+	c.Assert(l.IsLeader(), Equals, true)
+	c.Assert(started, Equals, 1)
+	// the handlers are called once per leadership
+	l.setLeading(true)
+	c.Assert(started, Equals, 1)
+
+	l.setLeading(false)
+	c.Assert(l.IsLeader(), Equals, false)
+	l.setLeading(true)
+	c.Assert(started, Equals, 2)
+
+	l.setLeader(TestNode2)
+	c.Assert(l.GetLeader(), Equals, TestNode2)
+}
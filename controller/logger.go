@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"github.com/Sirupsen/logrus"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+// newControllerLogger returns the logger of the controller. It's derived
+// from the standard logger, so the level and the format set at runtime apply
+func newControllerLogger(name string) *logrus.Entry {
+	return logrus.StandardLogger().WithField("controller", name)
+}
+
+// getLoggerForVolume returns the logger with the fields of the volume, so the
+// activity of a single volume can be filtered
+func getLoggerForVolume(logger logrus.FieldLogger, v *longhorn.Volume) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"volume":  v.Name,
+		"ownerID": v.Spec.OwnerID,
+		"nodeID":  v.Spec.NodeID,
+		"state":   v.Status.State,
+	})
+}
+
+func getLoggerForEngine(logger logrus.FieldLogger, e *longhorn.Engine) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"engine":  e.Name,
+		"volume":  e.Spec.VolumeName,
+		"ownerID": e.Spec.OwnerID,
+		"nodeID":  e.Spec.NodeID,
+		"image":   e.Spec.EngineImage,
+	})
+}
+
+func getLoggerForReplica(logger logrus.FieldLogger, r *longhorn.Replica) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"replica": r.Name,
+		"volume":  r.Spec.VolumeName,
+		"ownerID": r.Spec.OwnerID,
+		"nodeID":  r.Spec.NodeID,
+		"diskID":  r.Spec.DiskID,
+	})
+}
+
+func getLoggerForNode(logger logrus.FieldLogger, n *longhorn.Node) *logrus.Entry {
+	return logger.WithField("node", n.Name)
+}
+
+func getLoggerForEngineImage(logger logrus.FieldLogger, ei *longhorn.EngineImage) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"engineImage": ei.Name,
+		"image":       ei.Spec.Image,
+		"ownerID":     ei.Spec.OwnerID,
+	})
+}
+
+func getLoggerForSnapshot(logger logrus.FieldLogger, snap *longhorn.Snapshot) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"snapshot": snap.Name,
+		"volume":   snap.Spec.Volume,
+	})
+}
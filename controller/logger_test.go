@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"github.com/Sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestLoggerFields(c *C) {
+	logger := newControllerLogger("longhorn-test")
+	c.Assert(logger.Data["controller"], Equals, "longhorn-test")
+
+	v := newVolume(TestVolumeName, 2)
+	v.Spec.NodeID = TestNode1
+	log := getLoggerForVolume(logger, v)
+	c.Assert(log.Data["controller"], Equals, "longhorn-test")
+	c.Assert(log.Data["volume"], Equals, TestVolumeName)
+	c.Assert(log.Data["nodeID"], Equals, TestNode1)
+
+	e := newEngineForVolume(v)
+	log = getLoggerForEngine(logger, e)
+	c.Assert(log.Data["engine"], Equals, e.Name)
+	c.Assert(log.Data["volume"], Equals, TestVolumeName)
+
+	r := newReplicaForVolume(v, e, TestNode2, TestDiskID1)
+	log = getLoggerForReplica(logger, r)
+	c.Assert(log.Data["replica"], Equals, r.Name)
+	c.Assert(log.Data["volume"], Equals, TestVolumeName)
+	c.Assert(log.Data["nodeID"], Equals, TestNode2)
+	c.Assert(log.Data["diskID"], Equals, TestDiskID1)
+
+	// the instance handler logs with the fields of the owner object
+	h := &InstanceHandler{logger: logger}
+	log = h.getLoggerForObj(r).(*logrus.Entry)
+	c.Assert(log.Data["replica"], Equals, r.Name)
+	log = h.getLoggerForObj(e).(*logrus.Entry)
+	c.Assert(log.Data["engine"], Equals, e.Name)
+}
@@ -2,7 +2,9 @@ package controller
 
 import (
 	"fmt"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -35,6 +37,15 @@ var (
 	ownerKindNode = longhorn.SchemeGroupVersion.WithKind("Node").String()
 )
 
+const (
+	OrphanScanInterval = 5 * time.Minute
+	// DiskMonitorInterval is how often the disks on the node are checked,
+	// regardless of any change to the node object
+	DiskMonitorInterval = 30 * time.Second
+	// the packages on the host rarely change
+	EnvironmentCheckInterval = 5 * time.Minute
+)
+
 type NodeController struct {
 	// which namespace controller is running with
 	namespace    string
@@ -51,18 +62,47 @@ type NodeController struct {
 	rStoreSynced  cache.InformerSynced
 	knStoreSynced cache.InformerSynced
 
-	queue workqueue.RateLimitingInterface
-
-	getDiskInfoHandler GetDiskInfoHandler
+	queue  workqueue.RateLimitingInterface
+	health *queueHealth
+	logger logrus.FieldLogger
+
+	getDiskInfoHandler           GetDiskInfoHandler
+	getDiskConfigHandler         GetDiskConfigHandler
+	generateDiskConfigHandler    GenerateDiskConfigHandler
+	listReplicaDirsHandler       ListReplicaDirsHandler
+	deleteReplicaDirHandler      DeleteReplicaDirHandler
+	checkEnvironmentHandler      CheckEnvironmentHandler
+	checkMountPropagationHandler CheckMountPropagationHandler
+	probeDiskHealthHandler       ProbeDiskHealthHandler
+	isLeaderHandler              IsLeaderHandler
+
+	lastOrphanScan            time.Time
+	lastEnvironmentCheck      time.Time
+	lastMountPropagationCheck time.Time
+	// the results of the disk health probes, keyed by the disk ID
+	diskHealthProbes map[string]*diskHealthProbe
 
 	scheduler *scheduler.ReplicaScheduler
 }
 
 type GetDiskInfoHandler func(string) (*util.DiskInfo, error)
+type GetDiskConfigHandler func(string) (*util.DiskConfig, error)
+type GenerateDiskConfigHandler func(string) (*util.DiskConfig, error)
+type ListReplicaDirsHandler func(string) ([]util.ReplicaDirectory, error)
+type DeleteReplicaDirHandler func(string, string) error
+type CheckEnvironmentHandler func() *util.NodeEnvironment
+type CheckMountPropagationHandler func(string) error
+type ProbeDiskHealthHandler func(string) error
+
+type diskHealthProbe struct {
+	lastProbe time.Time
+	err       error
+}
 
 func NewNodeController(
 	ds *datastore.DataStore,
 	scheme *runtime.Scheme,
+	config ControllerConfig,
 	nodeInformer lhinformers.NodeInformer,
 	settingInformer lhinformers.SettingInformer,
 	podInformer coreinformers.PodInformer,
@@ -91,10 +131,23 @@ func NewNodeController(
 		rStoreSynced:  replicaInformer.Informer().HasSynced,
 		knStoreSynced: kubeNodeInformer.Informer().HasSynced,
 
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "longhorn-node"),
+		queue:  config.newQueue("longhorn-node"),
+		logger: newControllerLogger("longhorn-node"),
 
-		getDiskInfoHandler: util.GetDiskInfo,
+		getDiskInfoHandler:        util.GetDiskInfo,
+		getDiskConfigHandler:      util.GetDiskConfig,
+		generateDiskConfigHandler: util.GenerateDiskConfig,
+		listReplicaDirsHandler:    util.ListReplicaDirectories,
+		deleteReplicaDirHandler:   util.DeleteReplicaDirectory,
+		checkEnvironmentHandler:   util.CheckNodeEnvironment,
+
+		checkMountPropagationHandler: util.CheckMountPropagation,
+		probeDiskHealthHandler:       util.ProbeDiskHealth,
+		isLeaderHandler:              alwaysLeader,
+
+		diskHealthProbes: map[string]*diskHealthProbe{},
 	}
+	nc.health = newQueueHealth("longhorn-node", nc.queue)
 
 	nc.scheduler = scheduler.NewReplicaScheduler(ds)
 
@@ -113,29 +166,14 @@ func NewNodeController(
 		},
 	})
 
-	settingInformer.Informer().AddEventHandler(
-		cache.FilteringResourceEventHandler{
-			FilterFunc: func(obj interface{}) bool {
-				switch t := obj.(type) {
-				case *longhorn.Setting:
-					return filterSettings(t)
-				default:
-					utilruntime.HandleError(fmt.Errorf("unable to handle object in %T: %T", nc, obj))
-					return false
-				}
-			},
-			Handler: cache.ResourceEventHandlerFuncs{
-				AddFunc: func(obj interface{}) {
-					s := obj.(*longhorn.Setting)
-					nc.enqueueSetting(s)
-				},
-				UpdateFunc: func(oldObj, newObj interface{}) {
-					cur := newObj.(*longhorn.Setting)
-					nc.enqueueSetting(cur)
-				},
-			},
-		},
-	)
+	// the settings deciding whether the disks are schedulable, and the ones
+	// changing the disks of the nodes
+	ds.OnSettingChange(nc.enqueueSettingChange,
+		types.SettingNameStorageMinimalAvailablePercentage,
+		types.SettingNameStorageOverProvisioningPercentage,
+		types.SettingNameStorageActualUsageWeight,
+		types.SettingNameCreateDefaultDiskLabeledNodes,
+		types.SettingNameDiskHealthProbe)
 
 	replicaInformer.Informer().AddEventHandler(
 		cache.FilteringResourceEventHandler{
@@ -143,6 +181,11 @@ func NewNodeController(
 				switch t := obj.(type) {
 				case *longhorn.Replica:
 					return nc.filterReplica(t)
+				case cache.DeletedFinalStateUnknown:
+					// the replica deletion is missed, use the last
+					// known state to account the disk again
+					r, ok := t.Obj.(*longhorn.Replica)
+					return ok && nc.filterReplica(r)
 				default:
 					utilruntime.HandleError(fmt.Errorf("unable to handle object in %T: %T", nc, obj))
 					return false
@@ -158,7 +201,10 @@ func NewNodeController(
 					nc.enqueueReplica(cur)
 				},
 				DeleteFunc: func(obj interface{}) {
-					r := obj.(*longhorn.Replica)
+					r, ok := obj.(*longhorn.Replica)
+					if !ok {
+						r = obj.(cache.DeletedFinalStateUnknown).Obj.(*longhorn.Replica)
+					}
 					nc.enqueueReplica(r)
 				},
 			},
@@ -199,7 +245,20 @@ func NewNodeController(
 			nc.enqueueKubernetesNode(cur)
 		},
 		DeleteFunc: func(obj interface{}) {
-			n := obj.(*v1.Node)
+			n, ok := obj.(*v1.Node)
+			if !ok {
+				deletedState, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					utilruntime.HandleError(fmt.Errorf("unable to handle object in %T: %T", nc, obj))
+					return
+				}
+				// use the last known state to find the Longhorn node
+				n, ok = deletedState.Obj.(*v1.Node)
+				if !ok {
+					utilruntime.HandleError(fmt.Errorf("DeletedFinalStateUnknown contained invalid object: %#v", deletedState.Obj))
+					return
+				}
+			}
 			nc.enqueueKubernetesNode(n)
 		},
 	})
@@ -207,14 +266,6 @@ func NewNodeController(
 	return nc
 }
 
-func filterSettings(s *longhorn.Setting) bool {
-	// filter that only StorageMinimalAvailablePercentage will impact disk status
-	if types.SettingName(s.Name) == types.SettingNameStorageMinimalAvailablePercentage {
-		return true
-	}
-	return false
-}
-
 func (nc *NodeController) filterReplica(r *longhorn.Replica) bool {
 	// only sync replica running on current node
 	if r.Spec.NodeID == nc.controllerID {
@@ -241,18 +292,15 @@ func (nc *NodeController) Run(workers int, stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
 	defer nc.queue.ShutDown()
 
-	logrus.Infof("Start Longhorn node controller")
-	defer logrus.Infof("Shutting down Longhorn node controller")
+	nc.logger.Infof("Start Longhorn node controller")
+	defer nc.logger.Infof("Shutting down Longhorn node controller")
 
 	if !controller.WaitForCacheSync("longhorn node", stopCh, nc.pStoreSynced, nc.nStoreSynced) {
 		return
 	}
 
-	for i := 0; i < workers; i++ {
-		go wait.Until(nc.worker, time.Second, stopCh)
-	}
-
-	<-stopCh
+	go wait.Until(nc.enqueueControllerNode, DiskMonitorInterval, stopCh)
+	runWorkers(workers, nc.worker, nc.queue, stopCh)
 }
 
 func (nc *NodeController) worker() {
@@ -267,6 +315,7 @@ func (nc *NodeController) processNextWorkItem() bool {
 		return false
 	}
 	defer nc.queue.Done(key)
+	defer nc.health.processed()
 
 	err := nc.syncNode(key.(string))
 	nc.handleErr(err, key)
@@ -281,13 +330,13 @@ func (nc *NodeController) handleErr(err error, key interface{}) {
 	}
 
 	if nc.queue.NumRequeues(key) < maxRetries {
-		logrus.Warnf("Error syncing Longhorn node %v: %v", key, err)
+		nc.logger.WithField("node", key).Warnf("Error syncing Longhorn node: %v", err)
 		nc.queue.AddRateLimited(key)
 		return
 	}
 
 	utilruntime.HandleError(err)
-	logrus.Warnf("Dropping Longhorn node %v out of the queue: %v", key, err)
+	nc.logger.WithField("node", key).Warnf("Dropping Longhorn node out of the queue: %v", err)
 	nc.queue.Forget(key)
 }
 
@@ -307,14 +356,37 @@ func (nc *NodeController) syncNode(key string) (err error) {
 	node, err := nc.ds.GetNode(name)
 	if err != nil {
 		if datastore.ErrorIsNotFound(err) {
-			logrus.Errorf("BUG: Longhorn node %v has been deleted", key)
+			nc.logger.WithField("node", key).Errorf("BUG: Longhorn node has been deleted")
 			return nil
 		}
 		return err
 	}
 
+	isLeader := nc.isLeaderHandler()
+	if !isLeader && node.Name != nc.controllerID {
+		// the other nodes are synced by the leader
+		return nil
+	}
+
 	if node.DeletionTimestamp != nil {
-		nc.eventRecorder.Eventf(node, v1.EventTypeWarning, EventReasonDelete, "BUG: Deleting node %v", node.Name)
+		if !isLeader {
+			return nil
+		}
+		// wait for the volume controllers to clean up the replicas and
+		// engines on the node
+		replicas, err := nc.ds.ListReplicasByNodeRO(node.Name)
+		if err != nil {
+			return err
+		}
+		engines, err := nc.ds.ListEnginesByNodeRO(node.Name)
+		if err != nil {
+			return err
+		}
+		if len(replicas) > 0 || len(engines) > 0 {
+			getLoggerForNode(nc.logger, node).Debugf("Waiting for the replicas and engines on node to be removed before deleting the node")
+			return nil
+		}
+		nc.eventRecorder.Eventf(node, v1.EventTypeNormal, EventReasonDelete, "Deleting node %v", node.Name)
 		return nc.ds.RemoveFinalizerForNode(node)
 	}
 
@@ -322,21 +394,83 @@ func (nc *NodeController) syncNode(key string) (err error) {
 	defer func() {
 		// we're going to update volume assume things changes
 		if err == nil && !reflect.DeepEqual(existingNode, node) {
-			_, err = nc.ds.UpdateNode(node)
+			// the spec is written by update and the status through the
+			// status subresource, so writing the status won't clobber the
+			// spec changed by others in the meantime
+			status := node.Status
+			updated := node
+			if isSpecOrMetaChanged(&existingNode.ObjectMeta, &node.ObjectMeta, existingNode.Spec, node.Spec) {
+				updated, err = nc.ds.UpdateNode(node)
+			}
+			if err == nil && !reflect.DeepEqual(existingNode.Status, status) {
+				// the status is owned by the controller, so it can be
+				// applied on top of the changes by others
+				_, err = nc.ds.UpdateNodeStatusWithRetry(updated, func(n *longhorn.Node) {
+					n.Status = status
+				})
+			}
 		}
 		// requeue if it's conflict
 		if apierrors.IsConflict(errors.Cause(err)) {
-			logrus.Debugf("Requeue %v due to conflict", key)
+			getLoggerForNode(nc.logger, node).Debugf("Requeue node due to conflict")
 			nc.enqueueNode(node)
 			err = nil
 		}
 	}()
 
-	// sync node state by manager pod
 	managerPods, err := nc.ds.ListManagerPods()
 	if err != nil {
 		return err
 	}
+	kubeNode, err := nc.ds.GetKubernetesNode(name)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		kubeNode = nil
+	}
+
+	// the readiness of all the nodes is judged by the leader alone, so the
+	// managers don't duplicate the events or fight over the conditions
+	if isLeader {
+		if err := nc.syncNodeReadyCondition(node, managerPods, kubeNode); err != nil {
+			return err
+		}
+	}
+
+	if nc.controllerID != node.Name {
+		return nil
+	}
+
+	if err := nc.createDefaultDisks(node, kubeNode); err != nil {
+		return err
+	}
+	// sync disks status on current node
+	if err := nc.syncDiskStatus(node); err != nil {
+		return err
+	}
+	if err := nc.syncNodeMaintenance(node); err != nil {
+		return err
+	}
+	nc.syncNodeTags(node)
+	nc.syncNodeEnvironment(node)
+	// sync mount propagation status on current node
+	for _, pod := range managerPods {
+		if pod.Spec.NodeName == node.Name {
+			if err := nc.syncNodeStatus(pod, node); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// syncNodeReadyCondition judges the readiness of the node by its manager
+// pod and the Kubernetes node, which is nil if it has been removed from the
+// cluster
+func (nc *NodeController) syncNodeReadyCondition(node *longhorn.Node, managerPods []*v1.Pod, kubeNode *v1.Node) error {
+	// sync node state by manager pod
 	nodeManagerFound := false
 	for _, pod := range managerPods {
 		if pod.Spec.NodeName == node.Name {
@@ -384,25 +518,26 @@ func (nc *NodeController) syncNode(key string) (err error) {
 	}
 
 	// sync node state with kuberentes node status
-	kubeNode, err := nc.ds.GetKubernetesNode(name)
-	if err != nil {
-		// if kubernetes node has been removed from cluster
-		if apierrors.IsNotFound(err) {
-			condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
-			if condition.Status != types.ConditionStatusFalse {
-				condition.LastTransitionTime = util.Now()
-				nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.NodeConditionReasonKubernetesNodeDown, "Kubernetes node missing: node %v has been removed from the cluster and there is no manager pod running on it", node.Name)
-			}
-			condition.Status = types.ConditionStatusFalse
-			condition.Reason = string(types.NodeConditionReasonKubernetesNodeDown)
-			condition.Message = fmt.Sprintf("Kubernetes node missing: node %v has been removed from the cluster and there is no manager pod running on it", node.Name)
-			node.Status.Conditions[types.NodeConditionTypeReady] = condition
-			// set node unschedulable
-			node.Spec.AllowScheduling = false
-		} else {
+	// if kubernetes node has been removed from cluster
+	if kubeNode == nil {
+		condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
+		// the transition time is when the node was removed, used
+		// for the deletion grace period
+		if condition.Status != types.ConditionStatusFalse || condition.Reason != types.NodeConditionReasonKubernetesNodeDown {
+			condition.LastTransitionTime = util.Now()
+			nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.NodeConditionReasonKubernetesNodeDown, "Kubernetes node missing: node %v has been removed from the cluster and there is no manager pod running on it", node.Name)
+		}
+		condition.Status = types.ConditionStatusFalse
+		condition.Reason = string(types.NodeConditionReasonKubernetesNodeDown)
+		condition.Message = fmt.Sprintf("Kubernetes node missing: node %v has been removed from the cluster and there is no manager pod running on it", node.Name)
+		node.Status.Conditions[types.NodeConditionTypeReady] = condition
+		// set node unschedulable
+		node.Spec.AllowScheduling = false
+		if err := nc.cleanupRemovedNode(node); err != nil {
 			return err
 		}
 	} else {
+		node.Status.Zone = types.GetZoneFromKubeNodeLabels(kubeNode.Labels)
 		kubeConditions := kubeNode.Status.Conditions
 		condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
 		for _, con := range kubeConditions {
@@ -436,32 +571,206 @@ func (nc *NodeController) syncNode(key string) (err error) {
 					break
 				}
 			default:
-				logrus.Debugf("Unknown condition of kubernetes node %v: condition type is %v, reason is %v, message is %v", node.Name, con.Type, con.Reason, con.Message)
+				getLoggerForNode(nc.logger, node).Debugf("Unknown condition of kubernetes node: condition type is %v, reason is %v, message is %v", con.Type, con.Reason, con.Message)
 				break
 			}
 		}
 	}
 
-	if nc.controllerID != node.Name {
+	return nil
+}
+
+// createDefaultDisks adds the default disks to the new node according to the
+// label of the Kubernetes node, if the setting
+// create-default-disk-labeled-nodes is enabled. The node is new if its disks
+// have never been synced. The disks are keyed by placeholder IDs here, and
+// then validated and keyed by the file system IDs in syncDiskStatus.
+func (nc *NodeController) createDefaultDisks(node *longhorn.Node, kubeNode *v1.Node) error {
+	if kubeNode == nil || len(node.Spec.Disks) != 0 || node.Status.DiskStatus != nil {
+		return nil
+	}
+	labelValue, ok := kubeNode.Labels[types.KubeNodeCreateDefaultDiskLabel]
+	if !ok {
+		return nil
+	}
+	enabled, err := nc.ds.GetSettingAsBool(types.SettingNameCreateDefaultDiskLabeledNodes)
+	if err != nil {
+		return err
+	}
+	if !enabled {
 		return nil
 	}
 
-	// sync disks status on current node
-	if err := nc.syncDiskStatus(node); err != nil {
+	disks := []types.DiskSpec{}
+	switch labelValue {
+	case types.KubeNodeCreateDefaultDiskLabelValueTrue:
+		diskInfo, err := nc.getDiskInfoHandler(types.DefaultLonghornDirectory)
+		if err != nil {
+			nc.eventRecorder.Eventf(node, v1.EventTypeWarning, EventReasonFailedCreating,
+				"Failed to create the default disk on node %v: %v", node.Name, err)
+			return nil
+		}
+		disks = append(disks, types.DiskSpec{
+			Path:            diskInfo.Path,
+			AllowScheduling: true,
+			StorageReserved: diskInfo.StorageMaximum * 30 / 100,
+		})
+	case types.KubeNodeCreateDefaultDiskLabelValueConfig:
+		disks, err = types.GetDefaultDisksFromKubeNodeAnnotations(kubeNode.Annotations)
+		if err != nil {
+			nc.eventRecorder.Eventf(node, v1.EventTypeWarning, EventReasonFailedCreating,
+				"Failed to create the default disks on node %v: %v", node.Name, err)
+			return nil
+		}
+	default:
+		nc.eventRecorder.Eventf(node, v1.EventTypeWarning, EventReasonFailedCreating,
+			"Failed to create the default disks on node %v: invalid value %v of label %v", node.Name, labelValue, types.KubeNodeCreateDefaultDiskLabel)
+		return nil
+	}
+
+	node.Spec.Disks = map[string]types.DiskSpec{}
+	paths := []string{}
+	for i, disk := range disks {
+		node.Spec.Disks[fmt.Sprintf("default-disk-%d", i)] = disk
+		paths = append(paths, disk.Path)
+	}
+	nc.eventRecorder.Eventf(node, v1.EventTypeNormal, EventReasonCreate,
+		"Created default disks %v on node %v", paths, node.Name)
+	return nil
+}
+
+// syncNodeEnvironment checks the host for the packages and kernel modules
+// required by Longhorn periodically, and sets the RequiredPackages condition
+// accordingly. The replicas and engines won't be placed on the node missing
+// any of them.
+func (nc *NodeController) syncNodeEnvironment(node *longhorn.Node) {
+	if !time.Now().After(nc.lastEnvironmentCheck.Add(EnvironmentCheckInterval)) {
+		return
+	}
+	nc.lastEnvironmentCheck = time.Now()
+	env := nc.checkEnvironmentHandler()
+
+	reason := ""
+	problems := []string{}
+	if len(env.MissingBinaries) != 0 {
+		reason = types.NodeConditionReasonBinariesMissing
+		problems = append(problems, fmt.Sprintf("missing binaries %v", strings.Join(env.MissingBinaries, ", ")))
+	}
+	if len(env.MissingModules) != 0 {
+		if reason == "" {
+			reason = types.NodeConditionReasonKernelModulesMissing
+		}
+		problems = append(problems, fmt.Sprintf("cannot load kernel modules %v", strings.Join(env.MissingModules, ", ")))
+	}
+	if env.ISCSIDError != "" {
+		if reason == "" {
+			reason = types.NodeConditionReasonISCSIDUnreachable
+		}
+		problems = append(problems, fmt.Sprintf("cannot reach iscsid: %v", env.ISCSIDError))
+	}
+
+	condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeRequiredPackages)
+	if reason == "" {
+		if condition.Status != types.ConditionStatusTrue {
+			condition.LastTransitionTime = util.Now()
+			nc.eventRecorder.Eventf(node, v1.EventTypeNormal, types.NodeConditionTypeRequiredPackages,
+				"Node %v has all the required packages", node.Name)
+		}
+		condition.Status = types.ConditionStatusTrue
+		condition.Reason = ""
+		condition.Message = ""
+	} else {
+		message := fmt.Sprintf("node %v is not ready for Longhorn: %v", node.Name, strings.Join(problems, "; "))
+		if condition.Status != types.ConditionStatusFalse || condition.Reason != reason {
+			condition.LastTransitionTime = util.Now()
+			nc.eventRecorder.Eventf(node, v1.EventTypeWarning, reason, "%v", message)
+		}
+		condition.Status = types.ConditionStatusFalse
+		condition.Reason = reason
+		condition.Message = message
+	}
+	node.Status.Conditions[types.NodeConditionTypeRequiredPackages] = condition
+}
+
+// syncNodeTags reflects the valid tags in the spec in the status. The invalid
+// ones can only be added by editing the node object directly, and are ignored.
+func (nc *NodeController) syncNodeTags(node *longhorn.Node) {
+	foundTags := map[string]struct{}{}
+	for _, tag := range node.Spec.Tags {
+		if err := util.ValidateTag(tag); err != nil {
+			getLoggerForNode(nc.logger, node).Warnf("Ignoring tag of node: %v", err)
+			continue
+		}
+		foundTags[tag] = struct{}{}
+	}
+	tags := []string{}
+	for tag := range foundTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	if len(tags) > util.MaxTagCount {
+		getLoggerForNode(nc.logger, node).Warnf("Ignoring tags of node beyond the first %v", util.MaxTagCount)
+		tags = tags[:util.MaxTagCount]
+	}
+	if reflect.DeepEqual(tags, node.Status.Tags) {
+		return
+	}
+	if node.Status.Tags != nil || len(tags) != 0 {
+		nc.eventRecorder.Eventf(node, v1.EventTypeNormal, EventReasonTagsChanged,
+			"Tags of node %v changed from %v to %v", node.Name, node.Status.Tags, tags)
+	}
+	node.Status.Tags = tags
+}
+
+// cleanupRemovedNode force deletes the engine, replica and instance manager
+// pods left on the node removed from the Kubernetes cluster, and deletes the
+// Longhorn node once the grace period has passed. The deletion completes after the volume
+// controllers have removed the replicas on the node.
+func (nc *NodeController) cleanupRemovedNode(node *longhorn.Node) error {
+	pods, err := nc.ds.ListPodsByNode(node.Name)
+	if err != nil {
 		return err
 	}
-	// sync mount propagation status on current node
-	for _, pod := range managerPods {
-		if pod.Spec.NodeName == node.Name {
-			if err := nc.syncNodeStatus(pod, node); err != nil {
-				return err
-			}
+	for _, pod := range pods {
+		if !isInstancePod(pod) || (pod.DeletionGracePeriodSeconds != nil && *pod.DeletionGracePeriodSeconds == 0) {
+			continue
 		}
+		if err := nc.ds.ForceDeletePod(pod.Name); err != nil {
+			return err
+		}
+		getLoggerForNode(nc.logger, node).Infof("Force deleted pod %v on node removed from the cluster", pod.Name)
 	}
 
+	gracePeriod, err := nc.ds.GetSettingAsInt(types.SettingNameRemovedNodeDeletionGracePeriod)
+	if err != nil {
+		return err
+	}
+	condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
+	if !util.TimestampAfterTimeout(condition.LastTransitionTime, time.Duration(gracePeriod)*time.Minute) {
+		return nil
+	}
+	nc.eventRecorder.Eventf(node, v1.EventTypeNormal, EventReasonDelete,
+		"Deleting node %v removed from the Kubernetes cluster at %v", node.Name, condition.LastTransitionTime)
+	if err := nc.ds.DeleteNode(node.Name); err != nil && !datastore.ErrorIsNotFound(err) {
+		return err
+	}
 	return nil
 }
 
+// isInstancePod returns true if the pod runs an engine or a replica, or is an
+// instance manager running them as the processes
+func isInstancePod(pod *v1.Pod) bool {
+	if types.IsInstanceManagerPod(pod.Labels) {
+		return true
+	}
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == ownerKindEngine || ref.Kind == ownerKindReplica {
+			return true
+		}
+	}
+	return false
+}
+
 func (nc *NodeController) enqueueNode(node *longhorn.Node) {
 	key, err := controller.KeyFunc(node)
 	if err != nil {
@@ -472,8 +781,21 @@ func (nc *NodeController) enqueueNode(node *longhorn.Node) {
 	nc.queue.AddRateLimited(key)
 }
 
-func (nc *NodeController) enqueueSetting(setting *longhorn.Setting) {
-	nodeList, err := nc.ds.ListNodes()
+// enqueueControllerNode requeues the node of this controller so the disk
+// status and conditions get refreshed periodically
+func (nc *NodeController) enqueueControllerNode() {
+	node, err := nc.ds.GetNodeRO(nc.controllerID)
+	if err != nil {
+		if !datastore.ErrorIsNotFound(err) {
+			utilruntime.HandleError(fmt.Errorf("Couldn't get node %v: %v ", nc.controllerID, err))
+		}
+		return
+	}
+	nc.enqueueNode(node)
+}
+
+func (nc *NodeController) enqueueSettingChange(name types.SettingName) {
+	nodeList, err := nc.ds.ListNodesRO()
 	if err != nil {
 		utilruntime.HandleError(fmt.Errorf("Couldn't get all nodes: %v ", err))
 		return
@@ -485,7 +807,7 @@ func (nc *NodeController) enqueueSetting(setting *longhorn.Setting) {
 }
 
 func (nc *NodeController) enqueueReplica(replica *longhorn.Replica) {
-	node, err := nc.ds.GetNode(replica.Spec.NodeID)
+	node, err := nc.ds.GetNodeRO(replica.Spec.NodeID)
 	if err != nil {
 		utilruntime.HandleError(fmt.Errorf("Couldn't get node %v: %v ", replica.Spec.NodeID, err))
 		return
@@ -494,7 +816,7 @@ func (nc *NodeController) enqueueReplica(replica *longhorn.Replica) {
 }
 
 func (nc *NodeController) enqueueManagerPod(pod *v1.Pod) {
-	nodeList, err := nc.ds.ListNodes()
+	nodeList, err := nc.ds.ListNodesRO()
 	if err != nil {
 		utilruntime.HandleError(fmt.Errorf("Couldn't get all nodes: %v ", err))
 		return
@@ -505,7 +827,7 @@ func (nc *NodeController) enqueueManagerPod(pod *v1.Pod) {
 }
 
 func (nc *NodeController) enqueueKubernetesNode(n *v1.Node) {
-	node, err := nc.ds.GetNode(n.Name)
+	node, err := nc.ds.GetNodeRO(n.Name)
 	if err != nil {
 		utilruntime.HandleError(fmt.Errorf("Couldn't get node %v: %v ", n.Name, err))
 		return
@@ -517,24 +839,64 @@ func (nc *NodeController) syncDiskStatus(node *longhorn.Node) error {
 	diskMap := node.Spec.Disks
 	diskStatusMap := map[string]types.DiskStatus{}
 
-	// get all replicas which have been assigned to current node
-	replicaDiskMap, err := nc.ds.ListReplicasByNode(node.Name)
+	// get all replicas which have been assigned to current node, which are
+	// only read here
+	replicaDiskMap, err := nc.ds.ListReplicasByDiskRO(node.Name)
 	if err != nil {
 		return err
 	}
 
 	// get settings of StorageMinimalAvailablePercentage
-	minimalAvailablePercentage, err := nc.ds.GetSettingAsInt(types.SettingNameStorageMinimalAvailablePercentage)
+	minimalAvailablePercentage, err := nc.ds.GetStorageMinimalAvailablePercentage()
+	if err != nil {
+		return err
+	}
+
+	// the orphan scan lists the whole replica directories on the host, so
+	// don't do it on every sync
+	scanOrphans := time.Now().After(nc.lastOrphanScan.Add(OrphanScanInterval))
+	orphanAutoDeletion := false
+	if scanOrphans {
+		if orphanAutoDeletion, err = nc.ds.GetSettingAsBool(types.SettingNameOrphanAutoDeletion); err != nil {
+			return err
+		}
+	}
+
+	// the disk health probe is disabled with the interval 0
+	diskHealthProbeInterval := time.Duration(0)
+	diskHealthProbeEnabled, err := nc.ds.GetSettingAsBool(types.SettingNameDiskHealthProbe)
 	if err != nil {
 		return err
 	}
+	if diskHealthProbeEnabled {
+		interval, err := nc.ds.GetSettingAsInt(types.SettingNameDiskHealthProbeInterval)
+		if err != nil {
+			return err
+		}
+		diskHealthProbeInterval = time.Duration(interval) * time.Second
+	}
 
 	updateDiskMap := map[string]types.DiskSpec{}
 	originDiskStatus := node.Status.DiskStatus
 	if originDiskStatus == nil {
 		originDiskStatus = map[string]types.DiskStatus{}
 	}
+	nodeReplicas := []*longhorn.Replica{}
+	for _, replicas := range replicaDiskMap {
+		nodeReplicas = append(nodeReplicas, replicas...)
+	}
+	if err := nc.syncNodeEviction(node, nodeReplicas); err != nil {
+		return err
+	}
+
+	diskMap, removalRejectedDisks := nc.restoreRemovedDisks(node, diskMap, originDiskStatus, replicaDiskMap)
+	diskMap, invalidDiskStatus := nc.validateNewDisks(node, diskMap, originDiskStatus, replicaDiskMap)
 	for diskID, disk := range diskMap {
+		if diskStatus, ok := invalidDiskStatus[diskID]; ok {
+			diskStatusMap[diskID] = diskStatus
+			updateDiskMap[diskID] = disk
+			continue
+		}
 		diskConditions := map[types.DiskConditionType]types.Condition{}
 		updateDisk := disk
 		diskStatus := types.DiskStatus{}
@@ -542,23 +904,18 @@ func (nc *NodeController) syncDiskStatus(node *longhorn.Node) error {
 		if ok {
 			diskStatus = originDiskStatus[diskID]
 		}
-		scheduledReplica := map[string]int64{}
-		// if there's no replica assigned to this disk
-		if _, ok := replicaDiskMap[diskID]; !ok {
-			diskStatus.StorageScheduled = 0
-			scheduledReplica = map[string]int64{}
-		} else {
-			// calculate storage scheduled
-			replicaArray := replicaDiskMap[diskID]
-			var storageScheduled int64
-			for _, replica := range replicaArray {
-				storageScheduled += replica.Spec.VolumeSize
-				scheduledReplica[replica.Name] = replica.Spec.VolumeSize
-			}
-			diskStatus.StorageScheduled = storageScheduled
-			delete(replicaDiskMap, diskID)
+		// recompute the storage from the replicas on the disk rather than
+		// the last status, so the removed replicas are never left behind
+		diskReplicas := replicaDiskMap[diskID]
+		usage := scheduler.NewDiskStorageUsage(types.DiskStatus{})
+		for _, replica := range diskReplicas {
+			usage.AddReplica(replica)
 		}
-		diskStatus.ScheduledReplica = scheduledReplica
+		delete(replicaDiskMap, diskID)
+		diskStatus.ScheduledReplica = usage.ScheduledReplica
+		diskStatus.ReplicaStorageUsed = usage.ReplicaStorageUsed
+		diskStatus.StorageScheduled = usage.StorageScheduled
+		diskStatus.StorageUsed = usage.StorageUsed
 		// get disk available size
 		diskInfo, err := nc.getDiskInfoHandler(disk.Path)
 		readyCondition := types.GetDiskConditionFromStatus(diskStatus, types.DiskConditionTypeReady)
@@ -589,6 +946,43 @@ func (nc *NodeController) syncDiskStatus(node *longhorn.Node) error {
 			updateDisk.AllowScheduling = false
 			diskStatus.StorageMaximum = 0
 			diskStatus.StorageAvailable = 0
+		} else if diskInfo.ReadOnly {
+			if readyCondition.Status != types.ConditionStatusFalse || readyCondition.Reason != types.DiskConditionReasonDiskReadOnly {
+				readyCondition.LastTransitionTime = util.Now()
+				nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.DiskConditionReasonDiskReadOnly,
+					"Disk %v on node %v is not ready: file system is read-only", disk.Path, node.Name)
+			}
+			readyCondition.Status = types.ConditionStatusFalse
+			readyCondition.Reason = types.DiskConditionReasonDiskReadOnly
+			readyCondition.Message = fmt.Sprintf("disk %v on node %v has a read-only file system", disk.Path, node.Name)
+			// the statistics are still valid, but nothing can be written
+			diskStatus.StorageMaximum = diskInfo.StorageMaximum
+			diskStatus.StorageAvailable = diskInfo.StorageAvailable
+		} else if err := nc.syncDiskConfig(disk.Path, &diskStatus); err != nil {
+			// the disk mounted on the path is not the one we've recorded
+			if readyCondition.Status != types.ConditionStatusFalse {
+				readyCondition.LastTransitionTime = util.Now()
+				nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.DiskConditionReasonDiskUUIDMismatch,
+					"Disk %v on node %v is not ready: %v", disk.Path, node.Name, err)
+			}
+			readyCondition.Status = types.ConditionStatusFalse
+			readyCondition.Reason = types.DiskConditionReasonDiskUUIDMismatch
+			readyCondition.Message = fmt.Sprintf("disk %v on node %v failed identity check: %v", disk.Path, node.Name, err)
+			// disable invalid disk
+			updateDisk.AllowScheduling = false
+			diskStatus.StorageMaximum = 0
+			diskStatus.StorageAvailable = 0
+		} else if err := nc.probeDiskHealth(diskID, disk.Path, diskHealthProbeInterval); err != nil {
+			if readyCondition.Status != types.ConditionStatusFalse || readyCondition.Reason != types.DiskConditionReasonDiskHealthProbeFailed {
+				readyCondition.LastTransitionTime = util.Now()
+				nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.DiskConditionReasonDiskHealthProbeFailed,
+					"Disk %v on node %v is not ready: %v", disk.Path, node.Name, err)
+			}
+			readyCondition.Status = types.ConditionStatusFalse
+			readyCondition.Reason = types.DiskConditionReasonDiskHealthProbeFailed
+			readyCondition.Message = fmt.Sprintf("disk %v on node %v failed the health probe: %v", disk.Path, node.Name, err)
+			diskStatus.StorageMaximum = diskInfo.StorageMaximum
+			diskStatus.StorageAvailable = diskInfo.StorageAvailable
 		} else {
 			if readyCondition.Status != types.ConditionStatusTrue {
 				readyCondition.LastTransitionTime = util.Now()
@@ -600,6 +994,9 @@ func (nc *NodeController) syncDiskStatus(node *longhorn.Node) error {
 			readyCondition.Message = ""
 			diskStatus.StorageMaximum = diskInfo.StorageMaximum
 			diskStatus.StorageAvailable = diskInfo.StorageAvailable
+			if scanOrphans {
+				nc.syncOrphanedReplicaDirectories(node, disk.Path, &diskStatus, diskReplicas, orphanAutoDeletion)
+			}
 		}
 		diskConditions[types.DiskConditionTypeReady] = readyCondition
 
@@ -610,15 +1007,57 @@ func (nc *NodeController) syncDiskStatus(node *longhorn.Node) error {
 		if err != nil {
 			return err
 		}
-		if !nc.scheduler.IsSchedulableToDisk(0, info) {
+		if replicaCount, ok := removalRejectedDisks[diskID]; ok {
+			if condition.Status != types.ConditionStatusFalse || condition.Reason != types.DiskConditionReasonRemovalRejected {
+				condition.LastTransitionTime = util.Now()
+			}
+			condition.Status = types.ConditionStatusFalse
+			condition.Reason = types.DiskConditionReasonRemovalRejected
+			condition.Message = fmt.Sprintf("the disk %v on the node %v cannot be removed before the %v replicas scheduled on it are removed", disk.Path, node.Name, replicaCount)
+		} else if readyCondition.Status != types.ConditionStatusTrue {
+			if condition.Status != types.ConditionStatusFalse || condition.Reason != types.DiskConditionReasonDiskNotReady {
+				condition.LastTransitionTime = util.Now()
+				nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.DiskConditionReasonDiskNotReady,
+					"unable to schedule any replica to disk %v on node %v: disk is not ready", disk.Path, node.Name)
+			}
+			condition.Status = types.ConditionStatusFalse
+			condition.Reason = types.DiskConditionReasonDiskNotReady
+			condition.Message = fmt.Sprintf("the disk %v on the node %v is not ready: %v", disk.Path, node.Name, readyCondition.Reason)
+		} else if disk.EvictionRequested || node.Spec.EvictionRequested {
+			detachedVolumes, err := nc.getDetachedVolumesOfReplicas(diskReplicas)
+			if err != nil {
+				return err
+			}
+			if len(detachedVolumes) > 0 {
+				msg := fmt.Sprintf("volumes %v are detached, attach them to move the replicas off the disk %v on the node %v", strings.Join(detachedVolumes, ", "), disk.Path, node.Name)
+				if condition.Status != types.ConditionStatusFalse || condition.Reason != types.DiskConditionReasonEvictionBlocked {
+					condition.LastTransitionTime = util.Now()
+					nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.DiskConditionReasonEvictionBlocked,
+						"Eviction of disk %v on node %v is blocked: %v", disk.Path, node.Name, msg)
+				}
+				condition.Status = types.ConditionStatusFalse
+				condition.Reason = types.DiskConditionReasonEvictionBlocked
+				condition.Message = msg
+			} else {
+				if condition.Status != types.ConditionStatusFalse || condition.Reason != types.DiskConditionReasonEvictionRequested {
+					condition.LastTransitionTime = util.Now()
+					nc.eventRecorder.Eventf(node, v1.EventTypeNormal, types.DiskConditionReasonEvictionRequested,
+						"Evicting disk %v on node %v: %v replicas to move", disk.Path, node.Name, len(diskReplicas))
+				}
+				condition.Status = types.ConditionStatusFalse
+				condition.Reason = types.DiskConditionReasonEvictionRequested
+				condition.Message = fmt.Sprintf("the disk %v on the node %v is being evicted, %v replicas remaining", disk.Path, node.Name, len(diskReplicas))
+			}
+		} else if !nc.scheduler.IsSchedulableToDisk(0, info) {
+			msg := fmt.Sprintf("the disk %v on the node %v has %v available, but requires reserved %v, minimal %v%s to schedule more replicas", disk.Path, node.Name, diskStatus.StorageAvailable, disk.StorageReserved, minimalAvailablePercentage, "%")
 			if condition.Status != types.ConditionStatusFalse {
 				condition.LastTransitionTime = util.Now()
 				nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.DiskConditionReasonDiskPressure,
-					"unable to schedule any replica to disk %v on node %v", disk.Path, node.Name)
+					"unable to schedule any replica to disk %v on node %v: %v", disk.Path, node.Name, msg)
 			}
 			condition.Status = types.ConditionStatusFalse
 			condition.Reason = string(types.DiskConditionReasonDiskPressure)
-			condition.Message = fmt.Sprintf("the disk %v on the node %v has %v available, but requires reserved %v, minimal %v%s to schedule more replicas", disk.Path, node.Name, diskStatus.StorageAvailable, disk.StorageReserved, minimalAvailablePercentage, "%")
+			condition.Message = msg
 		} else {
 			if condition.Status != types.ConditionStatusTrue {
 				condition.LastTransitionTime = util.Now()
@@ -631,6 +1070,10 @@ func (nc *NodeController) syncDiskStatus(node *longhorn.Node) error {
 		}
 		diskConditions[types.DiskConditionTypeSchedulable] = condition
 
+		diskStatus.EvictionRemainingReplicas = 0
+		if disk.EvictionRequested || node.Spec.EvictionRequested {
+			diskStatus.EvictionRemainingReplicas = len(diskReplicas)
+		}
 		diskStatus.Conditions = diskConditions
 		diskStatusMap[diskID] = diskStatus
 		updateDiskMap[diskID] = updateDisk
@@ -644,12 +1087,423 @@ func (nc *NodeController) syncDiskStatus(node *longhorn.Node) error {
 				eReplicas = append(eReplicas, replica.Name)
 			}
 		}
-		logrus.Errorf("Warning: These replicas have been assigned to a disk no longer exist: %v", strings.Join(eReplicas, ", "))
+		getLoggerForNode(nc.logger, node).Errorf("Warning: These replicas have been assigned to a disk no longer exist: %v", strings.Join(eReplicas, ", "))
 	}
 
 	node.Status.DiskStatus = diskStatusMap
 	node.Spec.Disks = updateDiskMap
+	for diskID := range nc.diskHealthProbes {
+		if _, ok := diskStatusMap[diskID]; !ok || diskHealthProbeInterval == 0 {
+			delete(nc.diskHealthProbes, diskID)
+		}
+	}
+	if scanOrphans {
+		nc.lastOrphanScan = time.Now()
+	}
+
+	return nil
+}
+
+// probeDiskHealth returns the result of the last health probe of the disk,
+// and probes the disk again once the interval has passed. The probe is
+// skipped if the interval is 0.
+func (nc *NodeController) probeDiskHealth(diskID, diskPath string, interval time.Duration) error {
+	if interval == 0 {
+		return nil
+	}
+	probe, ok := nc.diskHealthProbes[diskID]
+	if !ok {
+		probe = &diskHealthProbe{}
+		nc.diskHealthProbes[diskID] = probe
+	}
+	if time.Now().After(probe.lastProbe.Add(interval)) {
+		probe.lastProbe = time.Now()
+		probe.err = nc.probeDiskHealthHandler(diskPath)
+	}
+	return probe.err
+}
+
+// getDetachedVolumesOfReplicas returns the sorted names of the volumes of the
+// replicas which are not attached. The replicas of those volumes cannot be
+// moved, since the replacement replica is rebuilt by the running engine.
+func (nc *NodeController) getDetachedVolumesOfReplicas(replicas []*longhorn.Replica) ([]string, error) {
+	detachedVolumes := []string{}
+	checkedVolumes := map[string]struct{}{}
+	for _, r := range replicas {
+		if _, ok := checkedVolumes[r.Spec.VolumeName]; ok {
+			continue
+		}
+		checkedVolumes[r.Spec.VolumeName] = struct{}{}
+		v, err := nc.ds.GetVolume(r.Spec.VolumeName)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if v.Status.State != types.VolumeStateAttached {
+			detachedVolumes = append(detachedVolumes, v.Name)
+		}
+	}
+	sort.Strings(detachedVolumes)
+	return detachedVolumes, nil
+}
+
+// syncNodeEviction reports the progress of the node eviction. The eviction is
+// blocked by the detached volumes without any healthy replica on the other
+// nodes, since the replicas can only be rebuilt when the volume is attached,
+// and the volumes would be lost if the node is deleted.
+func (nc *NodeController) syncNodeEviction(node *longhorn.Node, replicas []*longhorn.Replica) error {
+	if !node.Spec.EvictionRequested {
+		node.Status.EvictionRemainingReplicas = 0
+		delete(node.Status.Conditions, types.NodeConditionTypeEvicted)
+		return nil
+	}
+	node.Status.EvictionRemainingReplicas = len(replicas)
+
+	blockingVolumes := []string{}
+	checkedVolumes := map[string]struct{}{}
+	for _, r := range replicas {
+		if _, ok := checkedVolumes[r.Spec.VolumeName]; ok {
+			continue
+		}
+		checkedVolumes[r.Spec.VolumeName] = struct{}{}
+		v, err := nc.ds.GetVolume(r.Spec.VolumeName)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if v.Status.State == types.VolumeStateAttached {
+			continue
+		}
+		volumeReplicas, err := nc.ds.ListReplicasByVolumeRO(v.Name)
+		if err != nil {
+			return err
+		}
+		hasHealthyReplica := false
+		for _, vr := range volumeReplicas {
+			if vr.Spec.NodeID != node.Name && vr.Spec.FailedAt == "" && vr.Spec.HealthyAt != "" {
+				hasHealthyReplica = true
+				break
+			}
+		}
+		if !hasHealthyReplica {
+			blockingVolumes = append(blockingVolumes, v.Name)
+		}
+	}
+	sort.Strings(blockingVolumes)
+
+	condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeEvicted)
+	if len(blockingVolumes) > 0 {
+		msg := fmt.Sprintf("volumes %v are detached and have no healthy replica on the other nodes, attach them to move the replicas off the node", strings.Join(blockingVolumes, ", "))
+		if condition.Status != types.ConditionStatusFalse || condition.Reason != types.NodeConditionReasonEvictionBlocked {
+			condition.LastTransitionTime = util.Now()
+			nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.NodeConditionReasonEvictionBlocked, "Eviction of node %v is blocked: %v", node.Name, msg)
+		}
+		condition.Status = types.ConditionStatusFalse
+		condition.Reason = types.NodeConditionReasonEvictionBlocked
+		condition.Message = msg
+	} else if len(replicas) > 0 {
+		if condition.Status != types.ConditionStatusFalse || condition.Reason != types.NodeConditionReasonEvictionInProgress {
+			condition.LastTransitionTime = util.Now()
+			nc.eventRecorder.Eventf(node, v1.EventTypeNormal, types.NodeConditionReasonEvictionInProgress, "Evicting node %v: %v replicas to move", node.Name, len(replicas))
+		}
+		condition.Status = types.ConditionStatusFalse
+		condition.Reason = types.NodeConditionReasonEvictionInProgress
+		condition.Message = fmt.Sprintf("%v replicas remaining on node %v", len(replicas), node.Name)
+	} else {
+		if condition.Status != types.ConditionStatusTrue {
+			condition.LastTransitionTime = util.Now()
+			nc.eventRecorder.Eventf(node, v1.EventTypeNormal, types.NodeConditionTypeEvicted, "Node %v has been evicted", node.Name)
+		}
+		condition.Status = types.ConditionStatusTrue
+		condition.Reason = ""
+		condition.Message = ""
+	}
+	node.Status.Conditions[types.NodeConditionTypeEvicted] = condition
+	return nil
+}
+
+// syncNodeMaintenance reports whether the volumes have been detached from the
+// node in the maintenance mode. The volumes without any healthy replica on
+// the other nodes won't be detached by the volume controller.
+func (nc *NodeController) syncNodeMaintenance(node *longhorn.Node) error {
+	if !node.Spec.MaintenanceMode {
+		delete(node.Status.Conditions, types.NodeConditionTypeMaintenance)
+		return nil
+	}
+
+	volumes, err := nc.ds.ListVolumesByNodeRO(node.Name)
+	if err != nil {
+		return err
+	}
+	attachedVolumes := []string{}
+	blockingVolumes := []string{}
+	for _, v := range volumes {
+		ok, err := nc.ds.HasHealthyReplicaOnOtherNodes(v.Name, node.Name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			attachedVolumes = append(attachedVolumes, v.Name)
+		} else {
+			blockingVolumes = append(blockingVolumes, v.Name)
+		}
+	}
+	sort.Strings(attachedVolumes)
+	sort.Strings(blockingVolumes)
 
+	condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeMaintenance)
+	if len(blockingVolumes) > 0 {
+		msg := fmt.Sprintf("volumes %v have no healthy replica on the other nodes, detach them manually", strings.Join(blockingVolumes, ", "))
+		if condition.Status != types.ConditionStatusFalse || condition.Reason != types.NodeConditionReasonMaintenanceBlocked {
+			condition.LastTransitionTime = util.Now()
+			nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.NodeConditionReasonMaintenanceBlocked, "Maintenance of node %v is blocked: %v", node.Name, msg)
+		}
+		condition.Status = types.ConditionStatusFalse
+		condition.Reason = types.NodeConditionReasonMaintenanceBlocked
+		condition.Message = msg
+	} else if len(attachedVolumes) > 0 {
+		if condition.Status != types.ConditionStatusFalse || condition.Reason != types.NodeConditionReasonDetachingVolumes {
+			condition.LastTransitionTime = util.Now()
+		}
+		condition.Status = types.ConditionStatusFalse
+		condition.Reason = types.NodeConditionReasonDetachingVolumes
+		condition.Message = fmt.Sprintf("detaching volumes %v from node %v", strings.Join(attachedVolumes, ", "), node.Name)
+	} else {
+		if condition.Status != types.ConditionStatusTrue {
+			condition.LastTransitionTime = util.Now()
+			nc.eventRecorder.Eventf(node, v1.EventTypeNormal, types.NodeConditionTypeMaintenance, "Node %v is ready for maintenance", node.Name)
+		}
+		condition.Status = types.ConditionStatusTrue
+		condition.Reason = ""
+		condition.Message = ""
+	}
+	node.Status.Conditions[types.NodeConditionTypeMaintenance] = condition
+	return nil
+}
+
+// restoreRemovedDisks puts the disks removed from the node spec back if there
+// are still replicas scheduled on them, with the scheduling disabled. It
+// returns the disks whose removal is rejected, with the number of the replicas
+// blocking the removal.
+func (nc *NodeController) restoreRemovedDisks(node *longhorn.Node, diskMap map[string]types.DiskSpec, originDiskStatus map[string]types.DiskStatus, replicaDiskMap map[string][]*longhorn.Replica) (map[string]types.DiskSpec, map[string]int) {
+	updateDiskMap := map[string]types.DiskSpec{}
+	removalRejectedDisks := map[string]int{}
+	for diskID, disk := range diskMap {
+		updateDiskMap[diskID] = disk
+		// keep the removal rejected until the user enables the disk again
+		// or all the replicas are removed from the disk
+		condition := types.GetDiskConditionFromStatus(originDiskStatus[diskID], types.DiskConditionTypeSchedulable)
+		if condition.Reason == types.DiskConditionReasonRemovalRejected && !disk.AllowScheduling && len(replicaDiskMap[diskID]) > 0 {
+			removalRejectedDisks[diskID] = len(replicaDiskMap[diskID])
+		}
+	}
+	for diskID, replicas := range replicaDiskMap {
+		if _, ok := diskMap[diskID]; ok {
+			continue
+		}
+		if _, ok := originDiskStatus[diskID]; !ok {
+			continue
+		}
+		// the spec of the removed disk is gone, but the disk path can
+		// be found in the data path of the replicas on it
+		path := ""
+		replicaNames := []string{}
+		for _, replica := range replicas {
+			if path == "" && replica.Spec.DataPath != "" {
+				path = filepath.Dir(filepath.Dir(replica.Spec.DataPath))
+			}
+			replicaNames = append(replicaNames, replica.Name)
+		}
+		if path == "" {
+			continue
+		}
+		sort.Strings(replicaNames)
+		nc.eventRecorder.Eventf(node, v1.EventTypeWarning, EventReasonFailedDeleting,
+			"Cannot remove disk %v from node %v: replicas %v are still scheduled on the disk", path, node.Name, strings.Join(replicaNames, ", "))
+		updateDiskMap[diskID] = types.DiskSpec{
+			Path:            path,
+			AllowScheduling: false,
+		}
+		removalRejectedDisks[diskID] = len(replicas)
+	}
+	return updateDiskMap, removalRejectedDisks
+}
+
+// validateNewDisks validates the disks newly added to the node spec. A valid
+// disk is keyed by the file system ID of its path, as the rest of the system
+// expects. An invalid disk is left under the key given by the user, with the
+// failure recorded in its conditions, so the user can fix or remove it.
+func (nc *NodeController) validateNewDisks(node *longhorn.Node, diskMap map[string]types.DiskSpec, originDiskStatus map[string]types.DiskStatus, replicaDiskMap map[string][]*longhorn.Replica) (map[string]types.DiskSpec, map[string]types.DiskStatus) {
+	updateDiskMap := map[string]types.DiskSpec{}
+	newDiskIDs := []string{}
+	for diskID, disk := range diskMap {
+		if isNewDisk(diskID, originDiskStatus, replicaDiskMap) {
+			newDiskIDs = append(newDiskIDs, diskID)
+		} else {
+			updateDiskMap[diskID] = disk
+		}
+	}
+	// validate the new disks in a fixed order, so the same one of the
+	// conflicting disks is always accepted
+	sort.Strings(newDiskIDs)
+
+	invalidDiskStatus := map[string]types.DiskStatus{}
+	for _, diskID := range newDiskIDs {
+		disk := diskMap[diskID]
+		fsid, reason, msg := nc.validateNewDisk(diskID, disk, diskMap, updateDiskMap)
+		if reason == "" {
+			updateDiskMap[fsid] = disk
+			continue
+		}
+
+		diskStatus := originDiskStatus[diskID]
+		readyCondition := types.GetDiskConditionFromStatus(diskStatus, types.DiskConditionTypeReady)
+		if readyCondition.Status != types.ConditionStatusFalse || readyCondition.Reason != reason {
+			readyCondition.LastTransitionTime = util.Now()
+			nc.eventRecorder.Eventf(node, v1.EventTypeWarning, reason,
+				"Disk %v on node %v is not ready: %v", disk.Path, node.Name, msg)
+		}
+		readyCondition.Status = types.ConditionStatusFalse
+		readyCondition.Reason = reason
+		readyCondition.Message = msg
+		condition := types.GetDiskConditionFromStatus(diskStatus, types.DiskConditionTypeSchedulable)
+		if condition.Status != types.ConditionStatusFalse || condition.Reason != reason {
+			condition.LastTransitionTime = util.Now()
+		}
+		condition.Status = types.ConditionStatusFalse
+		condition.Reason = reason
+		condition.Message = msg
+		invalidDiskStatus[diskID] = types.DiskStatus{
+			Conditions: map[types.DiskConditionType]types.Condition{
+				types.DiskConditionTypeReady:       readyCondition,
+				types.DiskConditionTypeSchedulable: condition,
+			},
+			ScheduledReplica:   map[string]int64{},
+			ReplicaStorageUsed: map[string]int64{},
+		}
+		updateDiskMap[diskID] = disk
+	}
+	return updateDiskMap, invalidDiskStatus
+}
+
+// validateNewDisk returns the file system ID of the new disk if it's valid,
+// otherwise the reason and the message of the failure. The disk is checked
+// against the disks already accepted in validDisks.
+func (nc *NodeController) validateNewDisk(diskID string, disk types.DiskSpec, diskMap, validDisks map[string]types.DiskSpec) (string, string, string) {
+	diskInfo, err := nc.getDiskInfoHandler(disk.Path)
+	if err != nil {
+		return "", types.DiskConditionReasonInvalidDiskPath, fmt.Sprintf("cannot get the information of disk %v: %v", disk.Path, err)
+	}
+	if util.IsVirtualFilesystem(diskInfo.Type) {
+		return "", types.DiskConditionReasonInvalidFilesystem, fmt.Sprintf("disk %v is on %v file system, which is not backed by a storage device", disk.Path, diskInfo.Type)
+	}
+	for _, validDisk := range validDisks {
+		if util.IsPathNested(validDisk.Path, disk.Path) {
+			return "", types.DiskConditionReasonDiskNested, fmt.Sprintf("disk %v overlaps with disk %v", disk.Path, validDisk.Path)
+		}
+	}
+	if validDisk, ok := validDisks[diskInfo.Fsid]; ok {
+		return "", types.DiskConditionReasonDuplicatedFilesystem, fmt.Sprintf("disk %v is on the same file system %v as disk %v", disk.Path, diskInfo.Fsid, validDisk.Path)
+	}
+	if _, ok := diskMap[diskInfo.Fsid]; ok && diskInfo.Fsid != diskID {
+		return "", types.DiskConditionReasonDuplicatedFilesystem, fmt.Sprintf("disk %v is on file system %v, which is used as the ID of another disk", disk.Path, diskInfo.Fsid)
+	}
+	return diskInfo.Fsid, "", ""
+}
+
+// isNewDisk returns true if the disk is just added to the node spec, or it
+// failed the validation previously
+func isNewDisk(diskID string, originDiskStatus map[string]types.DiskStatus, replicaDiskMap map[string][]*longhorn.Replica) bool {
+	if len(replicaDiskMap[diskID]) > 0 {
+		return false
+	}
+	diskStatus, ok := originDiskStatus[diskID]
+	if !ok {
+		return true
+	}
+	switch types.GetDiskConditionFromStatus(diskStatus, types.DiskConditionTypeReady).Reason {
+	case types.DiskConditionReasonInvalidDiskPath,
+		types.DiskConditionReasonInvalidFilesystem,
+		types.DiskConditionReasonDiskNested,
+		types.DiskConditionReasonDuplicatedFilesystem:
+		return true
+	}
+	return false
+}
+
+// syncOrphanedReplicaDirectories records the replica directories on the disk
+// which no replica scheduled to the disk refers to. If auto deletion is
+// enabled, the directories found orphaned by the previous scan as well would
+// be deleted.
+func (nc *NodeController) syncOrphanedReplicaDirectories(node *longhorn.Node, path string, diskStatus *types.DiskStatus, replicas []*longhorn.Replica, autoDeletion bool) {
+	dirs, err := nc.listReplicaDirsHandler(path)
+	if err != nil {
+		// keep the previous records until next scan
+		getLoggerForNode(nc.logger, node).Errorf("Fail to scan orphaned replica directories of disk %v: %v", path, err)
+		return
+	}
+
+	replicaDirs := map[string]struct{}{}
+	for _, r := range replicas {
+		if r.Spec.DataPath != "" {
+			replicaDirs[filepath.Base(r.Spec.DataPath)] = struct{}{}
+		}
+	}
+
+	orphans := map[string]types.OrphanedReplicaDirectory{}
+	for _, dir := range dirs {
+		if _, ok := replicaDirs[dir.Name]; ok {
+			continue
+		}
+		if _, ok := diskStatus.OrphanedReplicaDirectories[dir.Name]; ok && autoDeletion {
+			if err := nc.deleteReplicaDirHandler(path, dir.Name); err != nil {
+				getLoggerForNode(nc.logger, node).Errorf("Fail to delete orphaned replica directory %v of disk %v: %v", dir.Name, path, err)
+			} else {
+				nc.eventRecorder.Eventf(node, v1.EventTypeNormal, EventReasonDelete,
+					"Deleted orphaned replica directory %v of disk %v on node %v", dir.Name, path, node.Name)
+				continue
+			}
+		}
+		if _, ok := diskStatus.OrphanedReplicaDirectories[dir.Name]; !ok {
+			nc.eventRecorder.Eventf(node, v1.EventTypeWarning, EventReasonOrphaned,
+				"Found orphaned replica directory %v of disk %v on node %v", dir.Name, path, node.Name)
+		}
+		orphans[dir.Name] = types.OrphanedReplicaDirectory{
+			Name:             dir.Name,
+			Size:             dir.Size,
+			ModificationTime: dir.ModificationTime,
+		}
+	}
+	if len(orphans) == 0 {
+		orphans = nil
+	}
+	diskStatus.OrphanedReplicaDirectories = orphans
+}
+
+// syncDiskConfig makes sure the disk config file on the path carries the
+// UUID recorded in the disk status. The config file will be created if it's
+// a new disk.
+func (nc *NodeController) syncDiskConfig(path string, diskStatus *types.DiskStatus) error {
+	cfg, err := nc.getDiskConfigHandler(path)
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		if diskStatus.DiskUUID != "" {
+			return fmt.Errorf("cannot find disk config file %v, expect disk UUID %v", util.DiskConfigFile, diskStatus.DiskUUID)
+		}
+		if cfg, err = nc.generateDiskConfigHandler(path); err != nil {
+			return err
+		}
+	}
+	if diskStatus.DiskUUID != "" && diskStatus.DiskUUID != cfg.DiskUUID {
+		return fmt.Errorf("found disk UUID %v, expect %v", cfg.DiskUUID, diskStatus.DiskUUID)
+	}
+	diskStatus.DiskUUID = cfg.DiskUUID
 	return nil
 }
 
@@ -665,12 +1519,33 @@ func (nc *NodeController) syncNodeStatus(pod *v1.Pod, node *longhorn.Node) error
 				mountPropagationStr = string(*mount.MountPropagation)
 			}
 			if mount.MountPropagation == nil || *mount.MountPropagation != v1.MountPropagationBidirectional {
-				if condition.Status != types.ConditionStatusFalse {
+				message := fmt.Sprintf("The MountPropagation value %s is not detected from pod %s, node %s", mountPropagationStr, pod.ObjectMeta.Name, pod.Spec.NodeName)
+				if condition.Status != types.ConditionStatusFalse || condition.Reason != types.NodeConditionReasonNoMountPropagationSupport {
 					condition.LastTransitionTime = util.Now()
+					nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.NodeConditionReasonNoMountPropagationSupport,
+						"No engine can be placed on node %v: %v", node.Name, message)
 				}
 				condition.Status = types.ConditionStatusFalse
 				condition.Reason = types.NodeConditionReasonNoMountPropagationSupport
-				condition.Message = fmt.Sprintf("The MountPropagation value %s is not detected from pod %s, node %s", mountPropagationStr, pod.ObjectMeta.Name, pod.Spec.NodeName)
+				condition.Message = message
+				break
+			}
+			// the probe result stays valid until the next check
+			probed := condition.Status == types.ConditionStatusTrue || condition.Reason == types.NodeConditionReasonMountPropagationProbeFailed
+			if probed && !time.Now().After(nc.lastMountPropagationCheck.Add(EnvironmentCheckInterval)) {
+				break
+			}
+			nc.lastMountPropagationCheck = time.Now()
+			if err := nc.checkMountPropagationHandler(mount.MountPath); err != nil {
+				message := fmt.Sprintf("The mount in pod %s is not propagated to node %s: %v", pod.ObjectMeta.Name, pod.Spec.NodeName, err)
+				if condition.Status != types.ConditionStatusFalse || condition.Reason != types.NodeConditionReasonMountPropagationProbeFailed {
+					condition.LastTransitionTime = util.Now()
+					nc.eventRecorder.Eventf(node, v1.EventTypeWarning, types.NodeConditionReasonMountPropagationProbeFailed,
+						"No engine can be placed on node %v: %v", node.Name, message)
+				}
+				condition.Status = types.ConditionStatusFalse
+				condition.Reason = types.NodeConditionReasonMountPropagationProbeFailed
+				condition.Message = message
 			} else {
 				if condition.Status != types.ConditionStatusTrue {
 					condition.LastTransitionTime = util.Now()
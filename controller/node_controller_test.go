@@ -2,6 +2,8 @@ package controller
 
 import (
 	"fmt"
+	"path/filepath"
+	"time"
 
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -35,9 +37,11 @@ type NodeTestCase struct {
 	nodes     map[string]*longhorn.Node
 	pods      map[string]*v1.Pod
 	replicas  []*longhorn.Replica
+	volumes   []*longhorn.Volume
 	kubeNodes map[string]*v1.Node
 
 	expectNodeStatus map[string]types.NodeStatus
+	expectNodeDisks  map[string]map[string]types.DiskSpec
 }
 
 func newTestNodeController(lhInformerFactory lhinformerfactory.SharedInformerFactory, kubeInformerFactory informers.SharedInformerFactory,
@@ -48,23 +52,36 @@ func newTestNodeController(lhInformerFactory lhinformerfactory.SharedInformerFac
 	engineImageInformer := lhInformerFactory.Longhorn().V1alpha1().EngineImages()
 	nodeInformer := lhInformerFactory.Longhorn().V1alpha1().Nodes()
 	settingInformer := lhInformerFactory.Longhorn().V1alpha1().Settings()
+	snapshotInformer := lhInformerFactory.Longhorn().V1alpha1().Snapshots()
 
 	podInformer := kubeInformerFactory.Core().V1().Pods()
 	kubeNodeInformer := kubeInformerFactory.Core().V1().Nodes()
 	cronJobInformer := kubeInformerFactory.Batch().V1beta1().CronJobs()
 	daemonSetInformer := kubeInformerFactory.Apps().V1beta2().DaemonSets()
+	eventInformer := kubeInformerFactory.Core().V1().Events()
+	persistentVolumeInformer := kubeInformerFactory.Core().V1().PersistentVolumes()
+	persistentVolumeClaimInformer := kubeInformerFactory.Core().V1().PersistentVolumeClaims()
+	volumeAttachmentInformer := kubeInformerFactory.Storage().V1beta1().VolumeAttachments()
 
 	ds := datastore.NewDataStore(
 		volumeInformer, engineInformer, replicaInformer,
 		engineImageInformer, nodeInformer, settingInformer,
-		lhClient,
-		podInformer, cronJobInformer, daemonSetInformer,
+		snapshotInformer, lhClient,
+		podInformer, cronJobInformer, daemonSetInformer, eventInformer,
+		persistentVolumeInformer, persistentVolumeClaimInformer, volumeAttachmentInformer,
 		kubeClient, TestNamespace)
 
-	nc := NewNodeController(ds, scheme.Scheme, nodeInformer, settingInformer, podInformer, replicaInformer, kubeNodeInformer, kubeClient, TestNamespace, controllerID)
+	nc := NewNodeController(ds, scheme.Scheme, DefaultControllerConfig(), nodeInformer, settingInformer, podInformer, replicaInformer, kubeNodeInformer, kubeClient, TestNamespace, controllerID)
 	fakeRecorder := record.NewFakeRecorder(100)
 	nc.eventRecorder = fakeRecorder
 	nc.getDiskInfoHandler = fakeGetDiskInfo
+	nc.getDiskConfigHandler = fakeGetDiskConfig
+	nc.generateDiskConfigHandler = fakeGenerateDiskConfig
+	nc.listReplicaDirsHandler = fakeListReplicaDirs
+	nc.deleteReplicaDirHandler = fakeDeleteReplicaDir
+	nc.checkEnvironmentHandler = fakeCheckEnvironment
+	nc.checkMountPropagationHandler = fakeCheckMountPropagation
+	nc.probeDiskHealthHandler = fakeProbeDiskHealth
 
 	nc.nStoreSynced = alwaysReady
 	nc.pStoreSynced = alwaysReady
@@ -73,19 +90,76 @@ func newTestNodeController(lhInformerFactory lhinformerfactory.SharedInformerFac
 }
 
 func fakeGetDiskInfo(directory string) (*util.DiskInfo, error) {
+	fsid := TestDiskID1
+	fsType := "ext4"
+	readOnly := false
+	switch directory {
+	case TestDiskPath2:
+		fsid = TestDiskID2
+	case "/dev/shm":
+		fsType = "tmpfs"
+	case "/not-exist":
+		return nil, fmt.Errorf("path %v is not a directory", directory)
+	case TestDiskPathReadOnly:
+		readOnly = true
+	}
 	return &util.DiskInfo{
-		Fsid:       "fsid",
+		Fsid:       fsid,
 		Path:       directory,
-		Type:       "ext4",
+		Type:       fsType,
 		FreeBlock:  0,
 		TotalBlock: 0,
 		BlockSize:  0,
 
 		StorageMaximum:   0,
 		StorageAvailable: 0,
+		ReadOnly:         readOnly,
 	}, nil
 }
 
+func fakeCheckEnvironment() *util.NodeEnvironment {
+	return &util.NodeEnvironment{}
+}
+
+func fakeCheckMountPropagation(directory string) error {
+	return nil
+}
+
+func fakeProbeDiskHealth(directory string) error {
+	return nil
+}
+
+func fakeGetDiskConfig(directory string) (*util.DiskConfig, error) {
+	return &util.DiskConfig{
+		DiskUUID: TestDiskUUID,
+	}, nil
+}
+
+func fakeGenerateDiskConfig(directory string) (*util.DiskConfig, error) {
+	return &util.DiskConfig{
+		DiskUUID: TestDiskUUID,
+	}, nil
+}
+
+func fakeListReplicaDirs(directory string) ([]util.ReplicaDirectory, error) {
+	return []util.ReplicaDirectory{
+		{
+			Name:             TestReplicaDirName,
+			Size:             TestVolumeSize,
+			ModificationTime: TestTimeNow,
+		},
+		{
+			Name:             TestOrphanedReplicaDirName,
+			Size:             TestVolumeSize,
+			ModificationTime: TestTimeNow,
+		},
+	}, nil
+}
+
+func fakeDeleteReplicaDir(directory, name string) error {
+	return nil
+}
+
 func generateKubeNodes(testType string) map[string]*v1.Node {
 	var kubeNode1, kubeNode2 *v1.Node
 	switch testType {
@@ -139,6 +213,7 @@ func kubeObjStatusSyncTest(testType string) *NodeTestCase {
 				Conditions: map[types.NodeConditionType]types.Condition{
 					types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
 					types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+					types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
 				},
 			},
 			TestNode2: {
@@ -153,6 +228,7 @@ func kubeObjStatusSyncTest(testType string) *NodeTestCase {
 				Conditions: map[types.NodeConditionType]types.Condition{
 					types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusFalse, types.NodeConditionReasonManagerPodDown),
 					types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusFalse, types.NodeConditionReasonNoMountPropagationSupport),
+					types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
 				},
 			},
 			TestNode2: {
@@ -167,6 +243,7 @@ func kubeObjStatusSyncTest(testType string) *NodeTestCase {
 				Conditions: map[types.NodeConditionType]types.Condition{
 					types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusFalse, types.NodeConditionReasonKubernetesNodeNotReady),
 					types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+					types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
 				},
 			},
 			TestNode2: {
@@ -181,6 +258,7 @@ func kubeObjStatusSyncTest(testType string) *NodeTestCase {
 				Conditions: map[types.NodeConditionType]types.Condition{
 					types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusFalse, types.NodeConditionReasonKubernetesNodePressure),
 					types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+					types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
 				},
 			},
 			TestNode2: {
@@ -231,6 +309,7 @@ func (s *TestSuite) TestSyncNode(c *C) {
 	volume := newVolume(TestVolumeName, 2)
 	engine := newEngineForVolume(volume)
 	replica1 := newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+	replica1.Spec.DataPath = filepath.Join(TestDefaultDataPath, "replicas", TestReplicaDirName)
 	replica2 := newReplicaForVolume(volume, engine, TestNode2, TestDiskID1)
 	replicas := []*longhorn.Replica{replica1, replica2}
 	tc.replicas = replicas
@@ -240,6 +319,7 @@ func (s *TestSuite) TestSyncNode(c *C) {
 			Conditions: map[types.NodeConditionType]types.Condition{
 				types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
 				types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
 			},
 			DiskStatus: map[string]types.DiskStatus{
 				TestDiskID1: {
@@ -251,6 +331,17 @@ func (s *TestSuite) TestSyncNode(c *C) {
 					ScheduledReplica: map[string]int64{
 						replica1.Name: replica1.Spec.VolumeSize,
 					},
+					DiskUUID: TestDiskUUID,
+					ReplicaStorageUsed: map[string]int64{
+						replica1.Name: 0,
+					},
+					OrphanedReplicaDirectories: map[string]types.OrphanedReplicaDirectory{
+						TestOrphanedReplicaDirName: {
+							Name:             TestOrphanedReplicaDirName,
+							Size:             TestVolumeSize,
+							ModificationTime: TestTimeNow,
+						},
+					},
 				},
 			},
 		},
@@ -307,6 +398,7 @@ func (s *TestSuite) TestSyncNode(c *C) {
 			Conditions: map[types.NodeConditionType]types.Condition{
 				types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
 				types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
 			},
 			DiskStatus: map[string]types.DiskStatus{
 				TestDiskID1: {
@@ -316,7 +408,21 @@ func (s *TestSuite) TestSyncNode(c *C) {
 						types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse, string(types.DiskConditionReasonDiskPressure)),
 						types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusTrue, ""),
 					},
-					ScheduledReplica: map[string]int64{},
+					ScheduledReplica:   map[string]int64{},
+					ReplicaStorageUsed: map[string]int64{},
+					DiskUUID:           TestDiskUUID,
+					OrphanedReplicaDirectories: map[string]types.OrphanedReplicaDirectory{
+						TestReplicaDirName: {
+							Name:             TestReplicaDirName,
+							Size:             TestVolumeSize,
+							ModificationTime: TestTimeNow,
+						},
+						TestOrphanedReplicaDirName: {
+							Name:             TestOrphanedReplicaDirName,
+							Size:             TestVolumeSize,
+							ModificationTime: TestTimeNow,
+						},
+					},
 				},
 			},
 		},
@@ -372,16 +478,18 @@ func (s *TestSuite) TestSyncNode(c *C) {
 			Conditions: map[types.NodeConditionType]types.Condition{
 				types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
 				types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
 			},
 			DiskStatus: map[string]types.DiskStatus{
 				"changedId": {
 					StorageScheduled: 0,
 					StorageAvailable: 0,
 					Conditions: map[types.DiskConditionType]types.Condition{
-						types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse, string(types.DiskConditionReasonDiskPressure)),
+						types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse, string(types.DiskConditionReasonDiskNotReady)),
 						types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusFalse, string(types.DiskConditionReasonDiskFilesystemChanged)),
 					},
-					ScheduledReplica: map[string]int64{},
+					ScheduledReplica:   map[string]int64{},
+					ReplicaStorageUsed: map[string]int64{},
 				},
 			},
 		},
@@ -399,6 +507,404 @@ func (s *TestSuite) TestSyncNode(c *C) {
 	}
 	testCases["test disable disk when file system changed"] = tc
 
+	tc = &NodeTestCase{}
+	tc.kubeNodes = generateKubeNodes(ManagerPodUp)
+	tc.pods = generateManagerPod(ManagerPodUp)
+	node1 = newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node1.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			StorageScheduled: 0,
+			StorageAvailable: 0,
+			StorageMaximum:   TestDiskSize,
+			Conditions: map[types.DiskConditionType]types.Condition{
+				types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusTrue, ""),
+				types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusTrue, ""),
+			},
+			DiskUUID: "another-disk-uuid",
+		},
+	}
+	node2 = newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")
+	tc.nodes = map[string]*longhorn.Node{
+		TestNode1: node1,
+		TestNode2: node2,
+	}
+	tc.expectNodeStatus = map[string]types.NodeStatus{
+		TestNode1: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
+			},
+			DiskStatus: map[string]types.DiskStatus{
+				TestDiskID1: {
+					StorageScheduled: 0,
+					StorageAvailable: 0,
+					Conditions: map[types.DiskConditionType]types.Condition{
+						types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse, string(types.DiskConditionReasonDiskNotReady)),
+						types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusFalse, string(types.DiskConditionReasonDiskUUIDMismatch)),
+					},
+					ScheduledReplica:   map[string]int64{},
+					ReplicaStorageUsed: map[string]int64{},
+					DiskUUID:           "another-disk-uuid",
+				},
+			},
+		},
+		TestNode2: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady: newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+			},
+		},
+	}
+	testCases["test disable disk when disk UUID mismatch"] = tc
+
+	tc = &NodeTestCase{}
+	tc.kubeNodes = generateKubeNodes(ManagerPodUp)
+	tc.pods = generateManagerPod(ManagerPodUp)
+	node1 = newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node1.Spec.Disks = map[string]types.DiskSpec{
+		TestDiskID1: {
+			Path:            TestDiskPathReadOnly,
+			AllowScheduling: true,
+		},
+	}
+	node1.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			StorageMaximum: TestDiskSize,
+			Conditions: map[types.DiskConditionType]types.Condition{
+				types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusTrue, ""),
+				types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusTrue, ""),
+			},
+		},
+	}
+	node2 = newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")
+	tc.nodes = map[string]*longhorn.Node{
+		TestNode1: node1,
+		TestNode2: node2,
+	}
+	tc.expectNodeStatus = map[string]types.NodeStatus{
+		TestNode1: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
+			},
+			DiskStatus: map[string]types.DiskStatus{
+				TestDiskID1: {
+					Conditions: map[types.DiskConditionType]types.Condition{
+						types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse, string(types.DiskConditionReasonDiskNotReady)),
+						types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusFalse, string(types.DiskConditionReasonDiskReadOnly)),
+					},
+					ScheduledReplica:   map[string]int64{},
+					ReplicaStorageUsed: map[string]int64{},
+				},
+			},
+		},
+		TestNode2: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady: newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+			},
+		},
+	}
+	testCases["test disable disk when file system is read-only"] = tc
+
+	tc = &NodeTestCase{}
+	tc.kubeNodes = generateKubeNodes(ManagerPodUp)
+	tc.pods = generateManagerPod(ManagerPodUp)
+	node1 = newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node1.Spec.Disks = map[string]types.DiskSpec{
+		TestDiskID1: {
+			Path:            TestDefaultDataPath,
+			AllowScheduling: true,
+		},
+		"disk2": {
+			Path:            TestDiskPath2,
+			AllowScheduling: true,
+			Tags:            []string{"ssd"},
+		},
+		"nested": {
+			Path:            filepath.Join(TestDefaultDataPath, "nested"),
+			AllowScheduling: true,
+		},
+		"same-filesystem": {
+			Path:            "/mnt/same-filesystem",
+			AllowScheduling: true,
+		},
+		"tmpfs": {
+			Path:            "/dev/shm",
+			AllowScheduling: true,
+		},
+		"not-exist": {
+			Path:            "/not-exist",
+			AllowScheduling: true,
+		},
+	}
+	node1.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			DiskUUID: TestDiskUUID,
+		},
+	}
+	node2 = newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")
+	tc.nodes = map[string]*longhorn.Node{
+		TestNode1: node1,
+		TestNode2: node2,
+	}
+	validDiskStatus := types.DiskStatus{
+		Conditions: map[types.DiskConditionType]types.Condition{
+			types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse, string(types.DiskConditionReasonDiskPressure)),
+			types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusTrue, ""),
+		},
+		ScheduledReplica:   map[string]int64{},
+		ReplicaStorageUsed: map[string]int64{},
+		DiskUUID:           TestDiskUUID,
+		OrphanedReplicaDirectories: map[string]types.OrphanedReplicaDirectory{
+			TestReplicaDirName: {
+				Name:             TestReplicaDirName,
+				Size:             TestVolumeSize,
+				ModificationTime: TestTimeNow,
+			},
+			TestOrphanedReplicaDirName: {
+				Name:             TestOrphanedReplicaDirName,
+				Size:             TestVolumeSize,
+				ModificationTime: TestTimeNow,
+			},
+		},
+	}
+	invalidDiskStatus := func(reason string) types.DiskStatus {
+		return types.DiskStatus{
+			Conditions: map[types.DiskConditionType]types.Condition{
+				types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse, reason),
+				types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusFalse, reason),
+			},
+			ScheduledReplica:   map[string]int64{},
+			ReplicaStorageUsed: map[string]int64{},
+		}
+	}
+	tc.expectNodeStatus = map[string]types.NodeStatus{
+		TestNode1: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
+			},
+			DiskStatus: map[string]types.DiskStatus{
+				TestDiskID1:       validDiskStatus,
+				TestDiskID2:       validDiskStatus,
+				"nested":          invalidDiskStatus(types.DiskConditionReasonDiskNested),
+				"same-filesystem": invalidDiskStatus(types.DiskConditionReasonDuplicatedFilesystem),
+				"tmpfs":           invalidDiskStatus(types.DiskConditionReasonInvalidFilesystem),
+				"not-exist":       invalidDiskStatus(types.DiskConditionReasonInvalidDiskPath),
+			},
+		},
+		TestNode2: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady: newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+			},
+		},
+	}
+	tc.expectNodeDisks = map[string]map[string]types.DiskSpec{
+		TestNode1: {
+			TestDiskID1:       node1.Spec.Disks[TestDiskID1],
+			TestDiskID2:       node1.Spec.Disks["disk2"],
+			"nested":          node1.Spec.Disks["nested"],
+			"same-filesystem": node1.Spec.Disks["same-filesystem"],
+			"tmpfs":           node1.Spec.Disks["tmpfs"],
+			"not-exist":       node1.Spec.Disks["not-exist"],
+		},
+	}
+	testCases["validate disks added to the node spec"] = tc
+
+	tc = &NodeTestCase{}
+	tc.kubeNodes = generateKubeNodes(ManagerPodUp)
+	tc.pods = generateManagerPod(ManagerPodUp)
+	node1 = newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node1.Spec.Disks = map[string]types.DiskSpec{}
+	node1.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			DiskUUID: TestDiskUUID,
+		},
+	}
+	node2 = newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")
+	tc.nodes = map[string]*longhorn.Node{
+		TestNode1: node1,
+		TestNode2: node2,
+	}
+	volume = newVolume(TestVolumeName, 2)
+	engine = newEngineForVolume(volume)
+	replica1 = newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+	replica1.Spec.DataPath = filepath.Join(TestDefaultDataPath, "replicas", TestReplicaDirName)
+	tc.replicas = []*longhorn.Replica{replica1}
+	tc.expectNodeStatus = map[string]types.NodeStatus{
+		TestNode1: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
+			},
+			DiskStatus: map[string]types.DiskStatus{
+				TestDiskID1: {
+					StorageScheduled: TestVolumeSize,
+					Conditions: map[types.DiskConditionType]types.Condition{
+						types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse, string(types.DiskConditionReasonRemovalRejected)),
+						types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusTrue, ""),
+					},
+					ScheduledReplica: map[string]int64{
+						replica1.Name: replica1.Spec.VolumeSize,
+					},
+					ReplicaStorageUsed: map[string]int64{
+						replica1.Name: 0,
+					},
+					DiskUUID: TestDiskUUID,
+					OrphanedReplicaDirectories: map[string]types.OrphanedReplicaDirectory{
+						TestOrphanedReplicaDirName: {
+							Name:             TestOrphanedReplicaDirName,
+							Size:             TestVolumeSize,
+							ModificationTime: TestTimeNow,
+						},
+					},
+				},
+			},
+		},
+		TestNode2: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady: newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+			},
+		},
+	}
+	tc.expectNodeDisks = map[string]map[string]types.DiskSpec{
+		TestNode1: {
+			TestDiskID1: {
+				Path:            TestDefaultDataPath,
+				AllowScheduling: false,
+			},
+		},
+	}
+	testCases["reject disk removal when replicas scheduled on the disk"] = tc
+
+	for _, evictionCase := range []struct {
+		nodeEviction bool
+		attached     bool
+	}{
+		{nodeEviction: true, attached: true},
+		{nodeEviction: true, attached: false},
+		{nodeEviction: false, attached: true},
+		{nodeEviction: false, attached: false},
+	} {
+		attached := evictionCase.attached
+		tc = &NodeTestCase{}
+		tc.kubeNodes = generateKubeNodes(ManagerPodUp)
+		tc.pods = generateManagerPod(ManagerPodUp)
+		node1 = newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+		if evictionCase.nodeEviction {
+			node1.Spec.EvictionRequested = true
+		} else {
+			disk := node1.Spec.Disks[TestDiskID1]
+			disk.EvictionRequested = true
+			node1.Spec.Disks[TestDiskID1] = disk
+		}
+		node1.Status.DiskStatus = map[string]types.DiskStatus{
+			TestDiskID1: {
+				DiskUUID: TestDiskUUID,
+			},
+		}
+		node2 = newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")
+		tc.nodes = map[string]*longhorn.Node{
+			TestNode1: node1,
+			TestNode2: node2,
+		}
+		volume = newVolume(TestVolumeName, 1)
+		volume.Status.State = types.VolumeStateDetached
+		if attached {
+			volume.Status.State = types.VolumeStateAttached
+		}
+		tc.volumes = []*longhorn.Volume{volume}
+		engine = newEngineForVolume(volume)
+		replica1 = newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+		replica1.Spec.HealthyAt = TestTimeNow
+		replica1.Spec.DataPath = filepath.Join(TestDefaultDataPath, "replicas", TestReplicaDirName)
+		tc.replicas = []*longhorn.Replica{replica1}
+		nodeConditions := map[types.NodeConditionType]types.Condition{
+			types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+			types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+			types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
+		}
+		nodeEvictionRemainingReplicas := 0
+		if evictionCase.nodeEviction {
+			nodeConditions[types.NodeConditionTypeEvicted] = newNodeCondition(types.NodeConditionTypeEvicted, types.ConditionStatusFalse, types.NodeConditionReasonEvictionInProgress)
+			if !attached {
+				nodeConditions[types.NodeConditionTypeEvicted] = newNodeCondition(types.NodeConditionTypeEvicted, types.ConditionStatusFalse, types.NodeConditionReasonEvictionBlocked)
+			}
+			nodeEvictionRemainingReplicas = 1
+		}
+		// the replica of the detached volume cannot be moved off the disk
+		diskEvictionReason := types.DiskConditionReasonEvictionRequested
+		if !attached {
+			diskEvictionReason = types.DiskConditionReasonEvictionBlocked
+		}
+		tc.expectNodeStatus = map[string]types.NodeStatus{
+			TestNode1: {
+				Conditions: nodeConditions,
+				DiskStatus: map[string]types.DiskStatus{
+					TestDiskID1: {
+						StorageScheduled: TestVolumeSize,
+						Conditions: map[types.DiskConditionType]types.Condition{
+							types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse, diskEvictionReason),
+							types.DiskConditionTypeReady:       newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusTrue, ""),
+						},
+						ScheduledReplica: map[string]int64{
+							replica1.Name: replica1.Spec.VolumeSize,
+						},
+						ReplicaStorageUsed: map[string]int64{
+							replica1.Name: 0,
+						},
+						DiskUUID: TestDiskUUID,
+						OrphanedReplicaDirectories: map[string]types.OrphanedReplicaDirectory{
+							TestOrphanedReplicaDirName: {
+								Name:             TestOrphanedReplicaDirName,
+								Size:             TestVolumeSize,
+								ModificationTime: TestTimeNow,
+							},
+						},
+						EvictionRemainingReplicas: 1,
+					},
+				},
+				EvictionRemainingReplicas: nodeEvictionRemainingReplicas,
+			},
+			TestNode2: {
+				Conditions: map[types.NodeConditionType]types.Condition{
+					types.NodeConditionTypeReady: newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+				},
+			},
+		}
+		testCases[fmt.Sprintf("node eviction %v with attached volume %v", evictionCase.nodeEviction, attached)] = tc
+	}
+
+	tc = &NodeTestCase{}
+	tc.kubeNodes = generateKubeNodes(ManagerPodUp)
+	tc.pods = generateManagerPod(ManagerPodUp)
+	node1 = newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node1.Spec.EvictionRequested = true
+	node2 = newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")
+	tc.nodes = map[string]*longhorn.Node{
+		TestNode1: node1,
+		TestNode2: node2,
+	}
+	tc.expectNodeStatus = map[string]types.NodeStatus{
+		TestNode1: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady:            newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeMountPropagation: newNodeCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeRequiredPackages: newNodeCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusTrue, ""),
+				types.NodeConditionTypeEvicted:          newNodeCondition(types.NodeConditionTypeEvicted, types.ConditionStatusTrue, ""),
+			},
+		},
+		TestNode2: {
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady: newNodeCondition(types.NodeConditionTypeReady, types.ConditionStatusTrue, ""),
+			},
+		},
+	}
+	testCases["node evicted"] = tc
+
 	for name, tc := range testCases {
 		fmt.Printf("testing %v\n", name)
 		kubeClient := fake.NewSimpleClientset()
@@ -411,6 +917,7 @@ func (s *TestSuite) TestSyncNode(c *C) {
 		pIndexer := kubeInformerFactory.Core().V1().Pods().Informer().GetIndexer()
 
 		rIndexer := lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer()
+		vIndexer := lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer()
 		knIndexer := kubeInformerFactory.Core().V1().Nodes().Informer().GetIndexer()
 
 		// create kuberentes node
@@ -441,6 +948,13 @@ func (s *TestSuite) TestSyncNode(c *C) {
 			c.Assert(r, NotNil)
 			rIndexer.Add(r)
 		}
+		// create volumes
+		for _, volume := range tc.volumes {
+			v, err := lhClient.Longhorn().Volumes(TestNamespace).Create(volume)
+			c.Assert(err, IsNil)
+			c.Assert(v, NotNil)
+			vIndexer.Add(v)
+		}
 		// sync node status
 		for nodeName, node := range tc.nodes {
 			err := nc.syncNode(getKey(node, c))
@@ -460,6 +974,7 @@ func (s *TestSuite) TestSyncNode(c *C) {
 				n.Status.Conditions[ctype] = condition
 			}
 			c.Assert(n.Status.Conditions, DeepEquals, tc.expectNodeStatus[nodeName].Conditions)
+			c.Assert(n.Status.EvictionRemainingReplicas, Equals, tc.expectNodeStatus[nodeName].EvictionRemainingReplicas)
 			if len(tc.expectNodeStatus[nodeName].DiskStatus) > 0 {
 				diskConditions := n.Status.DiskStatus
 				for fsid, diskStatus := range diskConditions {
@@ -477,7 +992,312 @@ func (s *TestSuite) TestSyncNode(c *C) {
 				}
 				c.Assert(n.Status.DiskStatus, DeepEquals, tc.expectNodeStatus[nodeName].DiskStatus)
 			}
+			if disks, ok := tc.expectNodeDisks[nodeName]; ok {
+				c.Assert(n.Spec.Disks, DeepEquals, disks)
+			}
 		}
 
 	}
 }
+
+func (s *TestSuite) TestCleanupRemovedNode(c *C) {
+	var err error
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+	pIndexer := kubeInformerFactory.Core().V1().Pods().Informer().GetIndexer()
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+
+	nc := newTestNodeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestNode2)
+
+	node := newNode(TestNode1, TestNamespace, false, types.ConditionStatusFalse, types.NodeConditionReasonKubernetesNodeDown)
+	node, err = lhClient.LonghornV1alpha1().Nodes(TestNamespace).Create(node)
+	c.Assert(err, IsNil)
+
+	managerPod := newDaemonPod(v1.PodRunning, TestDaemon1, TestNamespace, TestNode1, TestIP1, nil)
+	replicaPod := newDaemonPod(v1.PodRunning, "replica-pod", TestNamespace, TestNode1, TestIP1, nil)
+	replicaPod.OwnerReferences = []metav1.OwnerReference{
+		{
+			Kind: ownerKindReplica,
+			Name: "replica",
+		},
+	}
+	for _, pod := range []*v1.Pod{managerPod, replicaPod} {
+		p, err := kubeClient.CoreV1().Pods(TestNamespace).Create(pod)
+		c.Assert(err, IsNil)
+		c.Assert(pIndexer.Add(p), IsNil)
+	}
+
+	// the instance pods are deleted right away, the node is kept during
+	// the grace period
+	condition := node.Status.Conditions[types.NodeConditionTypeReady]
+	condition.LastTransitionTime = util.Now()
+	node.Status.Conditions[types.NodeConditionTypeReady] = condition
+	err = nc.cleanupRemovedNode(node)
+	c.Assert(err, IsNil)
+	_, err = kubeClient.CoreV1().Pods(TestNamespace).Get(replicaPod.Name, metav1.GetOptions{})
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+	_, err = kubeClient.CoreV1().Pods(TestNamespace).Get(managerPod.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	_, err = lhClient.LonghornV1alpha1().Nodes(TestNamespace).Get(node.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+
+	condition.LastTransitionTime = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	node.Status.Conditions[types.NodeConditionTypeReady] = condition
+	err = nc.cleanupRemovedNode(node)
+	c.Assert(err, IsNil)
+	_, err = lhClient.LonghornV1alpha1().Nodes(TestNamespace).Get(node.Name, metav1.GetOptions{})
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+}
+
+func (s *TestSuite) TestCreateDefaultDisks(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+
+	nc := newTestNodeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestNode1)
+
+	kubeNode := newKubernetesNode(TestNode1, v1.ConditionTrue, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionTrue)
+	kubeNode.Labels = map[string]string{
+		types.KubeNodeCreateDefaultDiskLabel: types.KubeNodeCreateDefaultDiskLabelValueTrue,
+	}
+
+	// the label is ignored unless the setting is enabled
+	node := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node.Spec.Disks = nil
+	c.Assert(nc.createDefaultDisks(node, kubeNode), IsNil)
+	c.Assert(node.Spec.Disks, HasLen, 0)
+
+	setting := &longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      string(types.SettingNameCreateDefaultDiskLabeledNodes),
+			Namespace: TestNamespace,
+		},
+		Setting: types.Setting{
+			Value: "true",
+		},
+	}
+	c.Assert(sIndexer.Add(setting), IsNil)
+
+	c.Assert(nc.createDefaultDisks(node, kubeNode), IsNil)
+	c.Assert(node.Spec.Disks, DeepEquals, map[string]types.DiskSpec{
+		"default-disk-0": {
+			Path:            types.DefaultLonghornDirectory,
+			AllowScheduling: true,
+		},
+	})
+
+	// the disks are created from the annotation
+	kubeNode.Labels[types.KubeNodeCreateDefaultDiskLabel] = types.KubeNodeCreateDefaultDiskLabelValueConfig
+	kubeNode.Annotations = map[string]string{
+		types.KubeNodeDefaultDisksConfigAnnotation: `[{"path":"` + TestDefaultDataPath + `","storageReserved":1024},` +
+			`{"path":"` + TestDiskPath2 + `","allowScheduling":false,"tags":["ssd","fast"]}]`,
+	}
+	node.Spec.Disks = nil
+	c.Assert(nc.createDefaultDisks(node, kubeNode), IsNil)
+	c.Assert(node.Spec.Disks, DeepEquals, map[string]types.DiskSpec{
+		"default-disk-0": {
+			Path:            TestDefaultDataPath,
+			AllowScheduling: true,
+			StorageReserved: 1024,
+			Tags:            []string{},
+		},
+		"default-disk-1": {
+			Path:            TestDiskPath2,
+			AllowScheduling: false,
+			Tags:            []string{"fast", "ssd"},
+		},
+	})
+
+	// nothing is created from an invalid annotation
+	kubeNode.Annotations[types.KubeNodeDefaultDisksConfigAnnotation] = `[{"path":"relative/path"}]`
+	node.Spec.Disks = nil
+	c.Assert(nc.createDefaultDisks(node, kubeNode), IsNil)
+	c.Assert(node.Spec.Disks, HasLen, 0)
+
+	// the disks of the existing node are never touched
+	kubeNode.Labels[types.KubeNodeCreateDefaultDiskLabel] = types.KubeNodeCreateDefaultDiskLabelValueTrue
+	node.Status.DiskStatus = map[string]types.DiskStatus{}
+	c.Assert(nc.createDefaultDisks(node, kubeNode), IsNil)
+	c.Assert(node.Spec.Disks, HasLen, 0)
+}
+
+func (s *TestSuite) TestSyncDiskStorageScheduled(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	rIndexer := lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer()
+
+	nc := newTestNodeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestNode1)
+
+	volume := newVolume(TestVolumeName, 2)
+	engine := newEngineForVolume(volume)
+	replica := newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+	replica.Namespace = TestNamespace
+	replica.Status.FileStats.TotalSize = TestVolumeSize / 2
+	c.Assert(rIndexer.Add(replica), IsNil)
+
+	// the records of the removed replicas are dropped, regardless of the
+	// last status
+	node := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			StorageScheduled: TestVolumeSize * 3,
+			ScheduledReplica: map[string]int64{
+				"removed-replica": TestVolumeSize * 2,
+				replica.Name:      TestVolumeSize,
+			},
+		},
+	}
+	c.Assert(nc.syncDiskStatus(node), IsNil)
+	diskStatus := node.Status.DiskStatus[TestDiskID1]
+	c.Assert(diskStatus.StorageScheduled, Equals, int64(TestVolumeSize))
+	c.Assert(diskStatus.StorageUsed, Equals, int64(TestVolumeSize/2))
+	c.Assert(diskStatus.ScheduledReplica, DeepEquals, map[string]int64{replica.Name: TestVolumeSize})
+
+	c.Assert(rIndexer.Delete(replica), IsNil)
+	c.Assert(nc.syncDiskStatus(node), IsNil)
+	diskStatus = node.Status.DiskStatus[TestDiskID1]
+	c.Assert(diskStatus.StorageScheduled, Equals, int64(0))
+	c.Assert(diskStatus.StorageUsed, Equals, int64(0))
+	c.Assert(diskStatus.ScheduledReplica, HasLen, 0)
+}
+
+func (s *TestSuite) TestDiskHealthProbe(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+
+	nc := newTestNodeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestNode1)
+	var probeErr error
+	probeCount := 0
+	nc.probeDiskHealthHandler = func(directory string) error {
+		probeCount++
+		return probeErr
+	}
+
+	// the disks aren't probed unless the probe is enabled
+	node := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	c.Assert(nc.syncDiskStatus(node), IsNil)
+	c.Assert(probeCount, Equals, 0)
+
+	setting := &longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      string(types.SettingNameDiskHealthProbe),
+			Namespace: TestNamespace,
+		},
+		Setting: types.Setting{
+			Value: "true",
+		},
+	}
+	c.Assert(sIndexer.Add(setting), IsNil)
+
+	probeErr = fmt.Errorf("input/output error")
+	c.Assert(nc.syncDiskStatus(node), IsNil)
+	c.Assert(probeCount, Equals, 1)
+	diskStatus := node.Status.DiskStatus[TestDiskID1]
+	readyCondition := types.GetDiskConditionFromStatus(diskStatus, types.DiskConditionTypeReady)
+	c.Assert(readyCondition.Status, Equals, types.ConditionStatusFalse)
+	c.Assert(readyCondition.Reason, Equals, types.DiskConditionReasonDiskHealthProbeFailed)
+	schedulableCondition := types.GetDiskConditionFromStatus(diskStatus, types.DiskConditionTypeSchedulable)
+	c.Assert(schedulableCondition.Status, Equals, types.ConditionStatusFalse)
+	c.Assert(schedulableCondition.Reason, Equals, types.DiskConditionReasonDiskNotReady)
+
+	// the result is kept until the next probe
+	probeErr = nil
+	c.Assert(nc.syncDiskStatus(node), IsNil)
+	c.Assert(probeCount, Equals, 1)
+	readyCondition = types.GetDiskConditionFromStatus(node.Status.DiskStatus[TestDiskID1], types.DiskConditionTypeReady)
+	c.Assert(readyCondition.Reason, Equals, types.DiskConditionReasonDiskHealthProbeFailed)
+
+	nc.diskHealthProbes[TestDiskID1].lastProbe = time.Time{}
+	c.Assert(nc.syncDiskStatus(node), IsNil)
+	c.Assert(probeCount, Equals, 2)
+	readyCondition = types.GetDiskConditionFromStatus(node.Status.DiskStatus[TestDiskID1], types.DiskConditionTypeReady)
+	c.Assert(readyCondition.Status, Equals, types.ConditionStatusTrue)
+}
+
+func (s *TestSuite) TestSyncNodeEnvironment(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+
+	nc := newTestNodeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestNode1)
+	env := &util.NodeEnvironment{
+		MissingModules: []string{"iscsi_tcp"},
+		ISCSIDError:    "can not connect to iSCSI daemon",
+	}
+	nc.checkEnvironmentHandler = func() *util.NodeEnvironment {
+		return env
+	}
+
+	node := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	nc.syncNodeEnvironment(node)
+	condition := node.Status.Conditions[types.NodeConditionTypeRequiredPackages]
+	c.Assert(condition.Status, Equals, types.ConditionStatusFalse)
+	c.Assert(condition.Reason, Equals, types.NodeConditionReasonKernelModulesMissing)
+	c.Assert(condition.Message, Matches, ".*iscsi_tcp.*can not connect to iSCSI daemon")
+
+	// the result is kept until the next check
+	env = &util.NodeEnvironment{}
+	nc.syncNodeEnvironment(node)
+	c.Assert(node.Status.Conditions[types.NodeConditionTypeRequiredPackages].Status, Equals, types.ConditionStatusFalse)
+
+	nc.lastEnvironmentCheck = time.Time{}
+	nc.syncNodeEnvironment(node)
+	condition = node.Status.Conditions[types.NodeConditionTypeRequiredPackages]
+	c.Assert(condition.Status, Equals, types.ConditionStatusTrue)
+	c.Assert(condition.Reason, Equals, "")
+}
+
+func (s *TestSuite) TestSyncMountPropagation(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+
+	nc := newTestNodeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestNode1)
+	var probeErr error
+	nc.checkMountPropagationHandler = func(directory string) error {
+		return probeErr
+	}
+
+	node := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	pod := newDaemonPod(v1.PodRunning, TestDaemon1, TestNamespace, TestNode1, TestIP1, &MountPropagationBidirectional)
+
+	// the mount propagation is configured but doesn't work
+	probeErr = fmt.Errorf("mount is not visible on the host")
+	c.Assert(nc.syncNodeStatus(pod, node), IsNil)
+	condition := node.Status.Conditions[types.NodeConditionTypeMountPropagation]
+	c.Assert(condition.Status, Equals, types.ConditionStatusFalse)
+	c.Assert(condition.Reason, Equals, types.NodeConditionReasonMountPropagationProbeFailed)
+
+	// the probe result is kept until the next check
+	probeErr = nil
+	c.Assert(nc.syncNodeStatus(pod, node), IsNil)
+	c.Assert(node.Status.Conditions[types.NodeConditionTypeMountPropagation].Status, Equals, types.ConditionStatusFalse)
+
+	nc.lastMountPropagationCheck = time.Time{}
+	c.Assert(nc.syncNodeStatus(pod, node), IsNil)
+	c.Assert(node.Status.Conditions[types.NodeConditionTypeMountPropagation].Status, Equals, types.ConditionStatusTrue)
+
+	// the mount propagation is not configured
+	pod = newDaemonPod(v1.PodRunning, TestDaemon1, TestNamespace, TestNode1, TestIP1, nil)
+	c.Assert(nc.syncNodeStatus(pod, node), IsNil)
+	condition = node.Status.Conditions[types.NodeConditionTypeMountPropagation]
+	c.Assert(condition.Status, Equals, types.ConditionStatusFalse)
+	c.Assert(condition.Reason, Equals, types.NodeConditionReasonNoMountPropagationSupport)
+}
@@ -0,0 +1,271 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/rancher/longhorn-manager/datastore"
+)
+
+var (
+	OrphanSweepInterval = 5 * time.Minute
+
+	// the objects younger than the grace period are left alone, since the
+	// volume created along may not be in the cache yet
+	orphanGracePeriod = time.Minute
+)
+
+// OrphanSweeper completes the cleanup of the Longhorn CRs no controller
+// would finish, so they don't sit in Terminating forever:
+//   - the engines and replicas whose volume no longer exists are deleted
+//   - the volumes are deleted once the Longhorn namespace is terminating
+//   - the objects being deleted whose owner or node has gone are handed over
+//     to another controller, or have the finalizer removed if nothing is left
+//     to be cleaned up
+//
+// Only the leader sweeps, so the orphans are swept once in the cluster.
+type OrphanSweeper struct {
+	ds           *datastore.DataStore
+	controllerID string
+
+	nowHandler      func() time.Time
+	isLeaderHandler IsLeaderHandler
+}
+
+func NewOrphanSweeper(ds *datastore.DataStore, controllerID string) *OrphanSweeper {
+	return &OrphanSweeper{
+		ds:           ds,
+		controllerID: controllerID,
+		nowHandler:   time.Now,
+
+		isLeaderHandler: alwaysLeader,
+	}
+}
+
+func (sw *OrphanSweeper) Run(stopCh <-chan struct{}) {
+	logrus.Infof("Start Longhorn orphan sweeper")
+	defer logrus.Infof("Shutting down Longhorn orphan sweeper")
+
+	wait.Until(func() {
+		if _, err := sw.sweep(); err != nil {
+			logrus.Warnf("Fail to sweep the orphaned Longhorn objects: %v", err)
+		}
+	}, OrphanSweepInterval, stopCh)
+}
+
+// sweep returns what it has removed or changed, each of which is also logged
+func (sw *OrphanSweeper) sweep() ([]string, error) {
+	swept := []string{}
+
+	if !sw.isLeaderHandler() {
+		return swept, nil
+	}
+
+	record := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		logrus.Infof("Orphan sweeper: %v", msg)
+		swept = append(swept, msg)
+	}
+	if err := sw.sweepVolumes(record); err != nil {
+		return swept, err
+	}
+	if err := sw.sweepEngines(record); err != nil {
+		return swept, err
+	}
+	if err := sw.sweepReplicas(record); err != nil {
+		return swept, err
+	}
+	return swept, nil
+}
+
+// isNodeGone returns true if the node doesn't exist, or has been removed
+// from the cluster. The node which is only down may come back and finish the
+// cleanup by itself.
+func (sw *OrphanSweeper) isNodeGone(name string) (bool, error) {
+	if name == "" {
+		return true, nil
+	}
+	if _, err := sw.ds.GetNode(name); err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return sw.ds.IsNodeRemoved(name)
+}
+
+func (sw *OrphanSweeper) isVolumeMissing(name string) (bool, error) {
+	if _, err := sw.ds.GetVolume(name); err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+func (sw *OrphanSweeper) isInGracePeriod(creation time.Time) bool {
+	return sw.nowHandler().Sub(creation) < orphanGracePeriod
+}
+
+func (sw *OrphanSweeper) sweepVolumes(record func(format string, args ...interface{})) error {
+	terminating, err := sw.ds.IsNamespaceTerminating()
+	if err != nil {
+		return err
+	}
+	volumes, err := sw.ds.ListVolumes()
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		if v.DeletionTimestamp == nil {
+			if !terminating {
+				continue
+			}
+			if err := sw.ds.DeleteVolume(v.Name); err != nil {
+				if datastore.ErrorIsNotFound(err) {
+					continue
+				}
+				return err
+			}
+			record("deleted volume %v since the namespace is terminating", v.Name)
+			continue
+		}
+
+		// the volume controller of the owner deletes the engines and
+		// replicas, and then removes the finalizer. Release the volume
+		// whose owner has gone so it can be claimed by another one
+		if v.Spec.OwnerID == "" {
+			continue
+		}
+		ownerGone, err := sw.isNodeGone(v.Spec.OwnerID)
+		if err != nil {
+			return err
+		}
+		if !ownerGone {
+			continue
+		}
+		owner := v.Spec.OwnerID
+		v.Spec.OwnerID = ""
+		if _, err := sw.ds.UpdateVolume(v); err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		record("released volume %v being deleted from owner %v which has gone", v.Name, owner)
+	}
+	return nil
+}
+
+func (sw *OrphanSweeper) sweepEngines(record func(format string, args ...interface{})) error {
+	engines, err := sw.ds.ListEnginesRO()
+	if err != nil {
+		return err
+	}
+	for _, e := range engines {
+		if e.DeletionTimestamp == nil {
+			if sw.isInGracePeriod(e.CreationTimestamp.Time) {
+				continue
+			}
+			missing, err := sw.isVolumeMissing(e.Spec.VolumeName)
+			if err != nil {
+				return err
+			}
+			if !missing {
+				continue
+			}
+			if err := sw.ds.DeleteEngine(e.Name); err != nil {
+				if datastore.ErrorIsNotFound(err) {
+					continue
+				}
+				return err
+			}
+			record("deleted engine %v of volume %v which no longer exists", e.Name, e.Spec.VolumeName)
+			continue
+		}
+
+		// the engine controller of the owner deletes the instance and
+		// then removes the finalizer
+		ownerGone, err := sw.isNodeGone(e.Spec.OwnerID)
+		if err != nil {
+			return err
+		}
+		if !ownerGone {
+			continue
+		}
+		nodeGone, err := sw.isNodeGone(e.Spec.NodeID)
+		if err != nil {
+			return err
+		}
+		if !nodeGone {
+			// the instance can still be deleted on its node
+			engine := e.DeepCopy()
+			engine.Spec.OwnerID = e.Spec.NodeID
+			if _, err := sw.ds.UpdateEngine(engine); err != nil {
+				if datastore.ErrorIsNotFound(err) {
+					continue
+				}
+				return err
+			}
+			record("handed engine %v being deleted over to node %v since owner %v has gone",
+				e.Name, e.Spec.NodeID, e.Spec.OwnerID)
+			continue
+		}
+		if err := sw.ds.RemoveFinalizerForEngine(e.DeepCopy()); err != nil {
+			return err
+		}
+		record("removed finalizer of engine %v being deleted since owner %v and node %v have gone",
+			e.Name, e.Spec.OwnerID, e.Spec.NodeID)
+	}
+	return nil
+}
+
+func (sw *OrphanSweeper) sweepReplicas(record func(format string, args ...interface{})) error {
+	replicas, err := sw.ds.ListReplicasRO()
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		if r.DeletionTimestamp == nil {
+			if sw.isInGracePeriod(r.CreationTimestamp.Time) {
+				continue
+			}
+			missing, err := sw.isVolumeMissing(r.Spec.VolumeName)
+			if err != nil {
+				return err
+			}
+			if !missing {
+				continue
+			}
+			if err := sw.ds.DeleteReplica(r.Name); err != nil {
+				if datastore.ErrorIsNotFound(err) {
+					continue
+				}
+				return err
+			}
+			record("deleted replica %v of volume %v which no longer exists", r.Name, r.Spec.VolumeName)
+			continue
+		}
+
+		// the replica controller on the node of the replica deletes the
+		// instance and the data regardless of the owner. Nothing is left
+		// to be cleaned up if the node has gone
+		nodeGone, err := sw.isNodeGone(r.Spec.NodeID)
+		if err != nil {
+			return err
+		}
+		if !nodeGone {
+			continue
+		}
+		if err := sw.ds.RemoveFinalizerForReplica(r.DeepCopy()); err != nil {
+			return err
+		}
+		record("removed finalizer of replica %v being deleted since node %v has gone", r.Name, r.Spec.NodeID)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package controller
+
+import (
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/controller"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+
+	. "gopkg.in/check.v1"
+)
+
+type orphanSweeperFixture struct {
+	lhClient          *lhfake.Clientset
+	kubeClient        *fake.Clientset
+	lhInformerFactory lhinformerfactory.SharedInformerFactory
+}
+
+func newOrphanSweeperFixture() *orphanSweeperFixture {
+	kubeClient := fake.NewSimpleClientset()
+	lhClient := lhfake.NewSimpleClientset()
+	return &orphanSweeperFixture{
+		lhClient:          lhClient,
+		kubeClient:        kubeClient,
+		lhInformerFactory: lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc()),
+	}
+}
+
+func (f *orphanSweeperFixture) newDataStore() *datastore.DataStore {
+	kubeInformerFactory := informers.NewSharedInformerFactory(f.kubeClient, controller.NoResyncPeriodFunc())
+	return datastore.NewDataStore(
+		f.lhInformerFactory.Longhorn().V1alpha1().Volumes(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Engines(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Replicas(),
+		f.lhInformerFactory.Longhorn().V1alpha1().EngineImages(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Nodes(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Settings(),
+		f.lhInformerFactory.Longhorn().V1alpha1().Snapshots(),
+		f.lhClient,
+		kubeInformerFactory.Core().V1().Pods(),
+		kubeInformerFactory.Batch().V1beta1().CronJobs(),
+		kubeInformerFactory.Apps().V1beta2().DaemonSets(),
+		kubeInformerFactory.Core().V1().Events(),
+		kubeInformerFactory.Core().V1().PersistentVolumes(),
+		kubeInformerFactory.Core().V1().PersistentVolumeClaims(),
+		kubeInformerFactory.Storage().V1beta1().VolumeAttachments(),
+		f.kubeClient, TestNamespace)
+}
+
+func (f *orphanSweeperFixture) newSweeper(controllerID string) *OrphanSweeper {
+	sw := NewOrphanSweeper(f.newDataStore(), controllerID)
+	sw.nowHandler = func() time.Time {
+		now, _ := time.Parse(time.RFC3339, TestTimeNow)
+		return now
+	}
+	return sw
+}
+
+func (f *orphanSweeperFixture) addNode(c *C, node *longhorn.Node) {
+	node, err := f.lhClient.LonghornV1alpha1().Nodes(TestNamespace).Create(node)
+	c.Assert(err, IsNil)
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer().Add(node), IsNil)
+}
+
+func (f *orphanSweeperFixture) addVolume(c *C, v *longhorn.Volume) {
+	v, err := f.lhClient.LonghornV1alpha1().Volumes(TestNamespace).Create(v)
+	c.Assert(err, IsNil)
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer().Add(v), IsNil)
+}
+
+func (f *orphanSweeperFixture) addEngine(c *C, e *longhorn.Engine) {
+	e, err := f.lhClient.LonghornV1alpha1().Engines(TestNamespace).Create(e)
+	c.Assert(err, IsNil)
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Engines().Informer().GetIndexer().Add(e), IsNil)
+}
+
+func (f *orphanSweeperFixture) addReplica(c *C, r *longhorn.Replica) {
+	r, err := f.lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(r)
+	c.Assert(err, IsNil)
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer().Add(r), IsNil)
+}
+
+func markDeleting(meta *metav1.ObjectMeta) {
+	meta.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	meta.Finalizers = []string{longhornFinalizerKey}
+}
+
+func (s *TestSuite) TestOrphanSweeperHalfDeletedVolume(c *C) {
+	f := newOrphanSweeperFixture()
+	f.addNode(c, newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, ""))
+	f.addNode(c, newNode(TestNode2, TestNamespace, true, types.ConditionStatusFalse, types.NodeConditionReasonKubernetesNodeDown))
+
+	// the volume owned by the removed node has gone, but its engines and
+	// replicas are left behind in various states
+	volume := newVolume(TestVolumeName, 3)
+	volume.Spec.OwnerID = TestNode2
+
+	// the engine on the removed node
+	e1 := newEngineForVolume(volume)
+	e1.Spec.NodeID = TestNode2
+	markDeleting(&e1.ObjectMeta)
+	f.addEngine(c, e1)
+	// the engine on the ready node, but owned by the removed one
+	e2 := newEngineForVolume(volume)
+	e2.Spec.NodeID = TestNode1
+	markDeleting(&e2.ObjectMeta)
+	f.addEngine(c, e2)
+
+	// the replica whose deletion has never been started
+	r1 := newReplicaForVolume(volume, e1, TestNode1, TestDiskID1)
+	r1.Finalizers = []string{longhornFinalizerKey}
+	f.addReplica(c, r1)
+	// the replica on the removed node
+	r2 := newReplicaForVolume(volume, e1, TestNode2, TestDiskID1)
+	markDeleting(&r2.ObjectMeta)
+	f.addReplica(c, r2)
+	// the replica on the ready node will be cleaned up by its replica
+	// controller
+	r3 := newReplicaForVolume(volume, e1, TestNode1, TestDiskID1)
+	markDeleting(&r3.ObjectMeta)
+	f.addReplica(c, r3)
+	// the replica created just now, whose volume may not be in the cache
+	r4 := newReplicaForVolume(volume, e1, TestNode1, TestDiskID1)
+	now, err := time.Parse(time.RFC3339, TestTimeNow)
+	c.Assert(err, IsNil)
+	r4.CreationTimestamp = metav1.Time{Time: now.Add(-time.Second)}
+	f.addReplica(c, r4)
+
+	// the healthy volume is left alone
+	healthyVolume := newVolume("healthy-volume", 1)
+	f.addVolume(c, healthyVolume)
+	healthyEngine := newEngineForVolume(healthyVolume)
+	healthyEngine.Spec.NodeID = TestNode1
+	f.addEngine(c, healthyEngine)
+	f.addReplica(c, newReplicaForVolume(healthyVolume, healthyEngine, TestNode1, TestDiskID1))
+
+	// only the leader sweeps
+	follower := f.newSweeper(TestNode2)
+	follower.isLeaderHandler = func() bool { return false }
+	swept, err := follower.sweep()
+	c.Assert(err, IsNil)
+	c.Assert(swept, HasLen, 0)
+
+	swept, err = f.newSweeper(TestNode1).sweep()
+	c.Assert(err, IsNil)
+	sort.Strings(swept)
+	expected := []string{
+		"deleted replica " + r1.Name + " of volume " + TestVolumeName + " which no longer exists",
+		"handed engine " + e2.Name + " being deleted over to node " + TestNode1 + " since owner " + TestNode2 + " has gone",
+		"removed finalizer of engine " + e1.Name + " being deleted since owner " + TestNode2 + " and node " + TestNode2 + " have gone",
+		"removed finalizer of replica " + r2.Name + " being deleted since node " + TestNode2 + " has gone",
+	}
+	sort.Strings(expected)
+	c.Assert(swept, DeepEquals, expected)
+
+	engines := f.lhClient.LonghornV1alpha1().Engines(TestNamespace)
+	replicas := f.lhClient.LonghornV1alpha1().Replicas(TestNamespace)
+
+	e, err := engines.Get(e1.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(e.Finalizers, HasLen, 0)
+	e, err = engines.Get(e2.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(e.Spec.OwnerID, Equals, TestNode1)
+	c.Assert(e.Finalizers, DeepEquals, []string{longhornFinalizerKey})
+
+	_, err = replicas.Get(r1.Name, metav1.GetOptions{})
+	c.Assert(apierrors.IsNotFound(err), Equals, true)
+	r, err := replicas.Get(r2.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(r.Finalizers, HasLen, 0)
+	r, err = replicas.Get(r3.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(r.Finalizers, DeepEquals, []string{longhornFinalizerKey})
+	_, err = replicas.Get(r4.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+
+	_, err = engines.Get(healthyEngine.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	healthyReplicas, err := replicas.List(metav1.ListOptions{})
+	c.Assert(err, IsNil)
+	// r2, r3, r4 and the healthy one
+	c.Assert(healthyReplicas.Items, HasLen, 4)
+}
+
+func (s *TestSuite) TestOrphanSweeperTerminatingNamespace(c *C) {
+	f := newOrphanSweeperFixture()
+	f.addNode(c, newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, ""))
+
+	_, err := f.kubeClient.CoreV1().Namespaces().Create(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              TestNamespace,
+			DeletionTimestamp: &metav1.Time{Time: time.Now()},
+		},
+		Status: v1.NamespaceStatus{
+			Phase: v1.NamespaceTerminating,
+		},
+	})
+	c.Assert(err, IsNil)
+
+	volume1 := newVolume("volume-1", 1)
+	f.addVolume(c, volume1)
+	// the volume being deleted was owned by the node which doesn't exist
+	volume2 := newVolume("volume-2", 1)
+	volume2.Spec.OwnerID = TestNode2
+	markDeleting(&volume2.ObjectMeta)
+	f.addVolume(c, volume2)
+
+	swept, err := f.newSweeper(TestNode1).sweep()
+	c.Assert(err, IsNil)
+	sort.Strings(swept)
+	c.Assert(swept, DeepEquals, []string{
+		"deleted volume volume-1 since the namespace is terminating",
+		"released volume volume-2 being deleted from owner " + TestNode2 + " which has gone",
+	})
+
+	volumes := f.lhClient.LonghornV1alpha1().Volumes(TestNamespace)
+	_, err = volumes.Get(volume1.Name, metav1.GetOptions{})
+	c.Assert(apierrors.IsNotFound(err), Equals, true)
+	v, err := volumes.Get(volume2.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(v.Spec.OwnerID, Equals, "")
+	c.Assert(v.Finalizers, DeepEquals, []string{longhornFinalizerKey})
+}
@@ -70,6 +70,10 @@ func (p *Provisioner) Provision(opts pvController.VolumeOptions) (*v1.Persistent
 	if frontend == "" {
 		frontend = types.VolumeFrontendBlockDev
 	}
+	qos, err := types.GetVolumeQoSFromOptions(opts.Parameters)
+	if err != nil {
+		return nil, err
+	}
 	sizeGiB := volumeutil.RoundUpToGiB(resourceStorage)
 	volReq := &longhornclient.Volume{
 		Name:                opts.PVName,
@@ -80,6 +84,14 @@ func (p *Provisioner) Provision(opts pvController.VolumeOptions) (*v1.Persistent
 		StaleReplicaTimeout: int64(staleReplicaTimeout),
 		BaseImage:           baseImage,
 	}
+	if qos != (types.VolumeQoS{}) {
+		volReq.Qos = &longhornclient.VolumeQoS{
+			ReadIOPS:       int64(qos.ReadIOPS),
+			WriteIOPS:      int64(qos.WriteIOPS),
+			ReadBandwidth:  int64(qos.ReadBandwidth),
+			WriteBandwidth: int64(qos.WriteBandwidth),
+		}
+	}
 	v, err := p.apiClient.Volume.Create(volReq)
 	if err != nil {
 		return nil, err
@@ -127,6 +139,6 @@ func (p *Provisioner) Delete(pv *v1.PersistentVolume) error {
 		return p.apiClient.Volume.Delete(volume)
 	}
 	logrus.Infof("provisioner: detach volume %v", volume.Name)
-	_, err = p.apiClient.Volume.ActionDetach(volume)
+	_, err = p.apiClient.Volume.ActionDetach(volume, &longhornclient.DetachInput{})
 	return err
 }
@@ -3,10 +3,10 @@ package controller
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
@@ -18,7 +18,6 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -28,6 +27,7 @@ import (
 	"k8s.io/kubernetes/pkg/controller"
 
 	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 
@@ -59,6 +59,9 @@ const (
 	replicaReadinessProbeMinimalRestoreRate = 10 * 1024 * 1024
 	// if replica won't start restoring, this will be the default
 	replicaReadinessProbeFailureThresholdDefault = 10
+
+	replicaDiskCheckContainerName = "check-disk"
+	replicaDiskMountPath          = "/disk"
 )
 
 type ReplicaController struct {
@@ -75,7 +78,9 @@ type ReplicaController struct {
 	rStoreSynced cache.InformerSynced
 	pStoreSynced cache.InformerSynced
 
-	queue workqueue.RateLimitingInterface
+	queue  workqueue.RateLimitingInterface
+	health *queueHealth
+	logger logrus.FieldLogger
 
 	instanceHandler *InstanceHandler
 }
@@ -83,9 +88,11 @@ type ReplicaController struct {
 func NewReplicaController(
 	ds *datastore.DataStore,
 	scheme *runtime.Scheme,
+	config ControllerConfig,
 	replicaInformer lhinformers.ReplicaInformer,
 	podInformer coreinformers.PodInformer,
 	kubeClient clientset.Interface,
+	instanceManagers engineapi.InstanceManagerClientCollection,
 	namespace string, controllerID string) *ReplicaController {
 
 	eventBroadcaster := record.NewBroadcaster()
@@ -105,9 +112,12 @@ func NewReplicaController(
 		rStoreSynced: replicaInformer.Informer().HasSynced,
 		pStoreSynced: podInformer.Informer().HasSynced,
 
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "longhorn-replica"),
+		queue:  config.newQueue("longhorn-replica"),
+		logger: newControllerLogger("longhorn-replica"),
 	}
-	rc.instanceHandler = NewInstanceHandler(podInformer, kubeClient, namespace, rc, rc.eventRecorder)
+	rc.health = newQueueHealth("longhorn-replica", rc.queue)
+	rc.instanceHandler = NewInstanceHandler(ds, podInformer, kubeClient, namespace,
+		types.InstanceManagerTypeReplica, rc, instanceManagers, rc.eventRecorder, rc.logger)
 
 	replicaInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -142,18 +152,14 @@ func (rc *ReplicaController) Run(workers int, stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
 	defer rc.queue.ShutDown()
 
-	logrus.Infof("Start Longhorn replica controller")
-	defer logrus.Infof("Shutting down Longhorn replica controller")
+	rc.logger.Infof("Start Longhorn replica controller")
+	defer rc.logger.Infof("Shutting down Longhorn replica controller")
 
 	if !controller.WaitForCacheSync("longhorn replicas", stopCh, rc.rStoreSynced, rc.pStoreSynced) {
 		return
 	}
 
-	for i := 0; i < workers; i++ {
-		go wait.Until(rc.worker, time.Second, stopCh)
-	}
-
-	<-stopCh
+	runWorkers(workers, rc.worker, rc.queue, stopCh)
 }
 
 func (rc *ReplicaController) worker() {
@@ -168,6 +174,7 @@ func (rc *ReplicaController) processNextWorkItem() bool {
 		return false
 	}
 	defer rc.queue.Done(key)
+	defer rc.health.processed()
 
 	err := rc.syncReplica(key.(string))
 	rc.handleErr(err, key)
@@ -182,13 +189,13 @@ func (rc *ReplicaController) handleErr(err error, key interface{}) {
 	}
 
 	if rc.queue.NumRequeues(key) < maxRetries {
-		logrus.Warnf("Error syncing Longhorn replica %v: %v", key, err)
+		rc.logger.WithField("replica", key).Warnf("Error syncing Longhorn replica: %v", err)
 		rc.queue.AddRateLimited(key)
 		return
 	}
 
 	utilruntime.HandleError(err)
-	logrus.Warnf("Dropping Longhorn replica %v out of the queue: %v", key, err)
+	rc.logger.WithField("replica", key).Warnf("Dropping Longhorn replica out of the queue: %v", err)
 	rc.queue.Forget(key)
 }
 
@@ -208,7 +215,7 @@ func (rc *ReplicaController) syncReplica(key string) (err error) {
 	replica, err := rc.ds.GetReplica(name)
 	if err != nil {
 		if datastore.ErrorIsNotFound(err) {
-			logrus.Infof("Longhorn replica %v has been deleted", key)
+			rc.logger.WithField("replica", key).Infof("Longhorn replica has been deleted")
 			return nil
 		}
 		return err
@@ -216,7 +223,7 @@ func (rc *ReplicaController) syncReplica(key string) (err error) {
 
 	if replica.DeletionTimestamp != nil {
 		if replica.Spec.NodeID == rc.controllerID {
-			if err := rc.instanceHandler.DeleteInstanceForObject(replica); err != nil {
+			if err := rc.instanceHandler.DeleteInstanceForObject(replica, &replica.Status.InstanceStatus); err != nil {
 				return err
 			}
 			if replica.Spec.Active {
@@ -227,8 +234,17 @@ func (rc *ReplicaController) syncReplica(key string) (err error) {
 			return rc.ds.RemoveFinalizerForReplica(replica)
 		}
 
-		if replica.Spec.NodeID == "" && replica.Spec.OwnerID == rc.controllerID {
-			return rc.ds.RemoveFinalizerForReplica(replica)
+		if replica.Spec.OwnerID == rc.controllerID {
+			// nothing can be cleaned up on the node removed from the
+			// cluster, the pod has been force deleted by the node
+			// controller
+			removed, err := rc.ds.IsNodeRemoved(replica.Spec.NodeID)
+			if err != nil {
+				return err
+			}
+			if replica.Spec.NodeID == "" || removed {
+				return rc.ds.RemoveFinalizerForReplica(replica)
+			}
 		}
 	}
 
@@ -241,16 +257,32 @@ func (rc *ReplicaController) syncReplica(key string) (err error) {
 	defer func() {
 		// we're going to update replica assume things changes
 		if err == nil && !reflect.DeepEqual(existingReplica, replica) {
-			_, err = rc.ds.UpdateReplica(replica)
+			// the spec is written by update and the status through the
+			// status subresource, so writing the status won't clobber the
+			// spec changed by others in the meantime
+			status := replica.Status
+			updated := replica
+			if isSpecOrMetaChanged(&existingReplica.ObjectMeta, &replica.ObjectMeta, existingReplica.Spec, replica.Spec) {
+				updated, err = rc.ds.UpdateReplica(replica)
+			}
+			if err == nil && !reflect.DeepEqual(existingReplica.Status, status) {
+				// the status is owned by the controller, so it can be
+				// applied on top of the changes by others
+				_, err = rc.ds.UpdateReplicaStatusWithRetry(updated, func(r *longhorn.Replica) {
+					r.Status = status
+				})
+			}
 		}
 		// requeue if it's conflict
 		if apierrors.IsConflict(errors.Cause(err)) {
-			logrus.Debugf("Requeue %v due to conflict", key)
+			getLoggerForReplica(rc.logger, replica).Debugf("Requeue replica due to conflict")
 			rc.enqueueReplica(replica)
 			err = nil
 		}
 	}()
 
+	reconcileVolumeLabel(&replica.ObjectMeta, replica.Spec.VolumeName)
+
 	// we need to stop the replica when replica failed connection with controller
 	if replica.Spec.FailedAt != "" {
 		if replica.Spec.DesireState != types.InstanceStateStopped {
@@ -260,7 +292,31 @@ func (rc *ReplicaController) syncReplica(key string) (err error) {
 		}
 	}
 
-	return rc.instanceHandler.ReconcileInstanceState(replica, &replica.Spec.InstanceSpec, &replica.Status.InstanceStatus)
+	if err := rc.instanceHandler.ReconcileInstanceState(replica, &replica.Spec.InstanceSpec, &replica.Status.InstanceStatus); err != nil {
+		return err
+	}
+
+	if replica.Status.CurrentState == types.InstanceStateError && existingReplica.Status.CurrentState != types.InstanceStateError {
+		rc.checkDiskIdentityFailure(replica)
+	}
+	return nil
+}
+
+// checkDiskIdentityFailure records an event if the replica failed to start
+// because the disk on the host is not the one it was scheduled to
+func (rc *ReplicaController) checkDiskIdentityFailure(r *longhorn.Replica) {
+	pod, err := rc.instanceHandler.getPod(r.Name)
+	if err != nil {
+		return
+	}
+	for _, st := range pod.Status.InitContainerStatuses {
+		if st.Name != replicaDiskCheckContainerName || st.State.Terminated == nil || st.State.Terminated.ExitCode == 0 {
+			continue
+		}
+		rc.eventRecorder.Eventf(r, v1.EventTypeWarning, EventReasonFailedStarting,
+			"Replica %v failed to start: disk %v on node %v failed identity check: %v",
+			r.Name, r.Spec.DiskID, r.Spec.NodeID, strings.TrimSpace(st.State.Terminated.Message))
+	}
 }
 
 func (rc *ReplicaController) enqueueReplica(replica *longhorn.Replica) {
@@ -291,6 +347,10 @@ func (rc *ReplicaController) CreatePodSpec(obj interface{}) (*v1.Pod, error) {
 	if !ok {
 		return nil, fmt.Errorf("BUG: invalid object for engine pod spec creation: %v", r)
 	}
+	tolerations, err := rc.ds.GetSettingTaintToleration()
+	if err != nil {
+		return nil, err
+	}
 
 	cmd := []string{
 		"longhorn", "replica",
@@ -325,6 +385,7 @@ func (rc *ReplicaController) CreatePodSpec(obj interface{}) (*v1.Pod, error) {
 		},
 		Spec: v1.PodSpec{
 			RestartPolicy: v1.RestartPolicyNever,
+			Tolerations:   tolerations,
 			Containers: []v1.Container{
 				{
 					Name:    r.Name,
@@ -370,6 +431,38 @@ func (rc *ReplicaController) CreatePodSpec(obj interface{}) (*v1.Pod, error) {
 		return nil, fmt.Errorf("BUG: nodeID or datapath or diskID wasn't set for replica %v", r.Name)
 	}
 
+	// verify the disk mounted on the host is the one replica was scheduled
+	// to, before writing anything into it. Replicas scheduled before disk
+	// identity was introduced have no UUID recorded.
+	if r.Spec.DiskUUID != "" {
+		// DataPath is <disk path>/replicas/<replica directory>
+		diskPath := filepath.Dir(filepath.Dir(r.Spec.DataPath))
+		cfgPath := filepath.Join(replicaDiskMountPath, util.DiskConfigFile)
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{
+			Name:  replicaDiskCheckContainerName,
+			Image: r.Spec.EngineImage,
+			Command: []string{"/bin/sh", "-c", fmt.Sprintf(
+				"grep -q '\"diskUUID\":\"%s\"' %s || { echo \"disk %s doesn't have the expected UUID %s\"; exit 1; }",
+				r.Spec.DiskUUID, cfgPath, diskPath, r.Spec.DiskUUID)},
+			TerminationMessagePolicy: v1.TerminationMessageFallbackToLogsOnError,
+			VolumeMounts: []v1.VolumeMount{
+				{
+					Name:      "disk",
+					ReadOnly:  true,
+					MountPath: replicaDiskMountPath,
+				},
+			},
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			Name: "disk",
+			VolumeSource: v1.VolumeSource{
+				HostPath: &v1.HostPathVolumeSource{
+					Path: diskPath,
+				},
+			},
+		})
+	}
+
 	if r.Spec.BaseImage != "" {
 		// Ensure base image is present before executing main containers
 		pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{
@@ -427,12 +520,14 @@ func (rc *ReplicaController) CreatePodSpec(obj interface{}) (*v1.Pod, error) {
 	pod.Spec.NodeName = r.Spec.NodeID
 
 	if r.Spec.RestoreName != "" && r.Spec.RestoreFrom != "" {
-		secret, err := rc.ds.GetSetting(types.SettingNameBackupTargetCredentialSecret)
+		// the replicas created before the secret was recorded use the
+		// global one
+		secret, err := rc.ds.ResolveBackupTargetCredentialSecret(r.Spec.RestoreCredentialSecret)
 		if err != nil {
 			return nil, err
 		}
-		if secret.Value != "" {
-			err := util.ConfigEnvWithCredential(r.Spec.RestoreFrom, secret.Value, &pod.Spec.Containers[0])
+		if secret != "" {
+			err := util.ConfigEnvWithCredential(r.Spec.RestoreFrom, secret, &pod.Spec.Containers[0])
 			if err != nil {
 				return nil, err
 			}
@@ -441,10 +536,85 @@ func (rc *ReplicaController) CreatePodSpec(obj interface{}) (*v1.Pod, error) {
 	return pod, nil
 }
 
+// CreateProcessSpec returns the replica process started by the replica
+// instance manager, or nil for the replica with the base image, which is bind
+// mounted by the sidecar of the replica pod, and for the replica restoring
+// with the credential, which is passed by the environment of the pod
+func (rc *ReplicaController) CreateProcessSpec(obj interface{}) (*engineapi.ProcessSpec, error) {
+	r, ok := obj.(*longhorn.Replica)
+	if !ok {
+		return nil, fmt.Errorf("BUG: invalid object for replica process spec creation: %v", obj)
+	}
+	if r.Spec.BaseImage != "" {
+		return nil, nil
+	}
+	restoring := r.Spec.RestoreFrom != "" && r.Spec.RestoreName != ""
+	if restoring {
+		secret, err := rc.ds.ResolveBackupTargetCredentialSecret(r.Spec.RestoreCredentialSecret)
+		if err != nil {
+			return nil, err
+		}
+		if secret != "" {
+			return nil, nil
+		}
+	}
+
+	// error out if NodeID and DataPath wasn't filled in scheduler
+	if r.Spec.NodeID == "" || r.Spec.DataPath == "" || r.Spec.DiskID == "" {
+		return nil, fmt.Errorf("BUG: nodeID or datapath or diskID wasn't set for replica %v", r.Name)
+	}
+	if err := rc.checkDiskIdentity(r); err != nil {
+		rc.eventRecorder.Eventf(r, v1.EventTypeWarning, EventReasonFailedStarting,
+			"Replica %v failed to start: %v", r.Name, err)
+		return nil, err
+	}
+
+	args := []string{
+		"replica", filepath.Join(replicaProcessHostMountPath, r.Spec.DataPath),
+		"--size", strconv.FormatInt(r.Spec.VolumeSize, 10),
+	}
+	if restoring {
+		args = append(args, "--restore-from", r.Spec.RestoreFrom, "--restore-name", r.Spec.RestoreName)
+	}
+	return &engineapi.ProcessSpec{
+		Binary:    types.DefaultEngineBinaryPath,
+		Args:      args,
+		PortCount: engineapi.ReplicaProcessPortCount,
+		PortArgs:  []string{"--listen,0.0.0.0:"},
+	}, nil
+}
+
+// checkDiskIdentity verifies the disk the replica was scheduled to is still
+// mounted on the host, as checked by the node controller of the node, before
+// the process writes anything into it. Replicas scheduled before disk
+// identity was introduced have no UUID recorded.
+func (rc *ReplicaController) checkDiskIdentity(r *longhorn.Replica) error {
+	if r.Spec.DiskUUID == "" {
+		return nil
+	}
+	node, err := rc.ds.GetNodeRO(r.Spec.NodeID)
+	if err != nil {
+		return err
+	}
+	diskStatus, ok := node.Status.DiskStatus[r.Spec.DiskID]
+	if !ok {
+		return fmt.Errorf("cannot find disk %v on node %v", r.Spec.DiskID, r.Spec.NodeID)
+	}
+	condition := types.GetDiskConditionFromStatus(diskStatus, types.DiskConditionTypeReady)
+	if diskStatus.DiskUUID != r.Spec.DiskUUID || condition.Reason == types.DiskConditionReasonDiskUUIDMismatch {
+		return fmt.Errorf("disk %v on node %v failed identity check, expect disk UUID %v", r.Spec.DiskID, r.Spec.NodeID, r.Spec.DiskUUID)
+	}
+	return nil
+}
+
 func (rc *ReplicaController) enqueueControlleeChange(obj interface{}) {
 	metaObj, err := meta.Accessor(obj)
 	if err != nil {
-		logrus.Warnf("BUG: %v cannot be convert to metav1.Object: %v", obj, err)
+		rc.logger.Warnf("BUG: %v cannot be convert to metav1.Object: %v", obj, err)
+		return
+	}
+	if types.IsInstanceManagerPod(metaObj.GetLabels()) {
+		rc.enqueueInstanceManagerChange(metaObj)
 		return
 	}
 	ownerRefs := metaObj.GetOwnerReferences()
@@ -458,6 +628,24 @@ func (rc *ReplicaController) enqueueControlleeChange(obj interface{}) {
 	}
 }
 
+// enqueueInstanceManagerChange enqueues the replicas running as the processes
+// of the replica instance manager
+func (rc *ReplicaController) enqueueInstanceManagerChange(im metav1.Object) {
+	if im.GetLabels()[types.LonghornInstanceManagerTypeKey] != string(types.InstanceManagerTypeReplica) {
+		return
+	}
+	replicas, err := rc.ds.ListReplicasRO()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Couldn't list replicas for instance manager %v: %v", im.GetName(), err))
+		return
+	}
+	for _, r := range replicas {
+		if r.Status.InstanceManagerName == im.GetName() && r.Spec.OwnerID == rc.controllerID {
+			rc.enqueueReplica(r)
+		}
+	}
+}
+
 func (rc *ReplicaController) ResolveRefAndEnqueue(namespace string, ref *metav1.OwnerReference) {
 	if ref.Kind != ownerKindReplica {
 		return
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/types"
 
 	"k8s.io/api/core/v1"
@@ -84,6 +85,12 @@ func getReplica(name string, lister lhlisters.ReplicaLister) (*longhorn.Replica,
 func newTestReplicaController(lhInformerFactory lhinformerfactory.SharedInformerFactory, kubeInformerFactory informers.SharedInformerFactory,
 	lhClient *lhfake.Clientset, kubeClient *fake.Clientset,
 	controllerID string) *ReplicaController {
+	return newTestReplicaControllerWithConfig(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, controllerID, DefaultControllerConfig())
+}
+
+func newTestReplicaControllerWithConfig(lhInformerFactory lhinformerfactory.SharedInformerFactory, kubeInformerFactory informers.SharedInformerFactory,
+	lhClient *lhfake.Clientset, kubeClient *fake.Clientset,
+	controllerID string, config ControllerConfig) *ReplicaController {
 
 	volumeInformer := lhInformerFactory.Longhorn().V1alpha1().Volumes()
 	engineInformer := lhInformerFactory.Longhorn().V1alpha1().Engines()
@@ -91,19 +98,26 @@ func newTestReplicaController(lhInformerFactory lhinformerfactory.SharedInformer
 	engineImageInformer := lhInformerFactory.Longhorn().V1alpha1().EngineImages()
 	nodeInformer := lhInformerFactory.Longhorn().V1alpha1().Nodes()
 	settingInformer := lhInformerFactory.Longhorn().V1alpha1().Settings()
+	snapshotInformer := lhInformerFactory.Longhorn().V1alpha1().Snapshots()
 
 	podInformer := kubeInformerFactory.Core().V1().Pods()
 	cronJobInformer := kubeInformerFactory.Batch().V1beta1().CronJobs()
 	daemonSetInformer := kubeInformerFactory.Apps().V1beta2().DaemonSets()
+	eventInformer := kubeInformerFactory.Core().V1().Events()
+	persistentVolumeInformer := kubeInformerFactory.Core().V1().PersistentVolumes()
+	persistentVolumeClaimInformer := kubeInformerFactory.Core().V1().PersistentVolumeClaims()
+	volumeAttachmentInformer := kubeInformerFactory.Storage().V1beta1().VolumeAttachments()
 
 	ds := datastore.NewDataStore(
 		volumeInformer, engineInformer, replicaInformer,
 		engineImageInformer, nodeInformer, settingInformer,
-		lhClient,
-		podInformer, cronJobInformer, daemonSetInformer,
+		snapshotInformer, lhClient,
+		podInformer, cronJobInformer, daemonSetInformer, eventInformer,
+		persistentVolumeInformer, persistentVolumeClaimInformer, volumeAttachmentInformer,
 		kubeClient, TestNamespace)
 
-	rc := NewReplicaController(ds, scheme.Scheme, replicaInformer, podInformer, kubeClient, TestNamespace, controllerID)
+	rc := NewReplicaController(ds, scheme.Scheme, config, replicaInformer, podInformer, kubeClient,
+		engineapi.NewInstanceManagerSimulatorCollection(), TestNamespace, controllerID)
 
 	fakeRecorder := record.NewFakeRecorder(100)
 	rc.eventRecorder = fakeRecorder
@@ -214,3 +228,29 @@ func (s *TestSuite) TestSyncReplica(c *C) {
 	}
 
 }
+
+func (s *TestSuite) TestSyncReplicaResetsVolumeLabel(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	rIndexer := lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer()
+
+	rc := newTestReplicaController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	// the label was modified by the user
+	replica := newReplica(types.InstanceStateStopped, types.InstanceStateStopped, "")
+	replica.Spec.EngineName = "engine-e"
+	replica.Spec.NodeID = TestNode1
+	replica.Spec.DataPath = TestDefaultDataPath
+	replica.Labels = map[string]string{datastore.LonghornVolumeKey: "other-volume"}
+	c.Assert(rIndexer.Add(replica), IsNil)
+	_, err := lhClient.LonghornV1alpha1().Replicas(replica.Namespace).Create(replica)
+	c.Assert(err, IsNil)
+
+	c.Assert(rc.syncReplica(getKey(replica, c)), IsNil)
+
+	updatedReplica, err := lhClient.LonghornV1alpha1().Replicas(replica.Namespace).Get(replica.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(updatedReplica.Labels[datastore.LonghornVolumeKey], Equals, TestVolumeName)
+}
@@ -0,0 +1,488 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientset "k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/kubernetes/pkg/controller"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhinformers "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions/longhorn/v1alpha1"
+)
+
+// SnapshotController applies the creation and the deletion of the snapshot
+// objects to the engine of the volume. The state of the snapshots in the
+// engine is brought back to the objects by the engine monitor.
+type SnapshotController struct {
+	// which namespace controller is running with
+	namespace string
+	// use as the OwnerID of the controller
+	controllerID string
+
+	kubeClient    clientset.Interface
+	eventRecorder record.EventRecorder
+
+	ds *datastore.DataStore
+
+	snStoreSynced cache.InformerSynced
+	vStoreSynced  cache.InformerSynced
+	eStoreSynced  cache.InformerSynced
+
+	queue  workqueue.RateLimitingInterface
+	health *queueHealth
+	logger logrus.FieldLogger
+
+	engines engineapi.EngineClientCollection
+
+	isLeaderHandler IsLeaderHandler
+}
+
+func NewSnapshotController(
+	ds *datastore.DataStore,
+	scheme *runtime.Scheme,
+	config ControllerConfig,
+	snapshotInformer lhinformers.SnapshotInformer,
+	volumeInformer lhinformers.VolumeInformer,
+	engineInformer lhinformers.EngineInformer,
+	kubeClient clientset.Interface,
+	engines engineapi.EngineClientCollection,
+	namespace string, controllerID string) *SnapshotController {
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(logrus.Infof)
+	// TODO: remove the wrapper when every clients have moved to use the clientset.
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(kubeClient.CoreV1().RESTClient()).Events("")})
+
+	sc := &SnapshotController{
+		namespace:    namespace,
+		controllerID: controllerID,
+
+		kubeClient:    kubeClient,
+		eventRecorder: eventBroadcaster.NewRecorder(scheme, v1.EventSource{Component: "longhorn-snapshot-controller"}),
+
+		ds: ds,
+
+		snStoreSynced: snapshotInformer.Informer().HasSynced,
+		vStoreSynced:  volumeInformer.Informer().HasSynced,
+		eStoreSynced:  engineInformer.Informer().HasSynced,
+
+		queue:  config.newQueue("longhorn-snapshot"),
+		logger: newControllerLogger("longhorn-snapshot"),
+
+		engines: engines,
+
+		isLeaderHandler: alwaysLeader,
+	}
+	sc.health = newQueueHealth("longhorn-snapshot", sc.queue)
+
+	snapshotInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			snap := obj.(*longhorn.Snapshot)
+			sc.enqueueSnapshot(snap)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			curSnap := cur.(*longhorn.Snapshot)
+			sc.enqueueSnapshot(curSnap)
+		},
+		DeleteFunc: func(obj interface{}) {
+			snap := obj.(*longhorn.Snapshot)
+			sc.enqueueSnapshot(snap)
+		},
+	})
+
+	// the pending creations and deletions are retried once the engine of
+	// the volume becomes available, and the finalizers are released once
+	// the volume is gone
+	volumeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, cur interface{}) {
+			oldV := old.(*longhorn.Volume)
+			curV := cur.(*longhorn.Volume)
+			if oldV.Status.State != curV.Status.State ||
+				oldV.Spec.OwnerID != curV.Spec.OwnerID ||
+				oldV.Spec.MigrationNodeID != curV.Spec.MigrationNodeID ||
+				(oldV.DeletionTimestamp == nil) != (curV.DeletionTimestamp == nil) {
+				sc.enqueueVolumeSnapshots(curV.Name)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			v := obj.(*longhorn.Volume)
+			sc.enqueueVolumeSnapshots(v.Name)
+		},
+	})
+
+	engineInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			e := obj.(*longhorn.Engine)
+			sc.enqueueVolumeSnapshots(e.Spec.VolumeName)
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			oldE := old.(*longhorn.Engine)
+			curE := cur.(*longhorn.Engine)
+			if oldE.Status.CurrentState != curE.Status.CurrentState ||
+				oldE.Status.CurrentImage != curE.Status.CurrentImage ||
+				oldE.Spec.OwnerID != curE.Spec.OwnerID {
+				sc.enqueueVolumeSnapshots(curE.Spec.VolumeName)
+			}
+		},
+	})
+
+	return sc
+}
+
+func (sc *SnapshotController) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer sc.queue.ShutDown()
+
+	sc.logger.Infof("Start Longhorn Snapshot controller")
+	defer sc.logger.Infof("Shutting down Longhorn Snapshot controller")
+
+	if !controller.WaitForCacheSync("longhorn snapshots", stopCh, sc.snStoreSynced, sc.vStoreSynced, sc.eStoreSynced) {
+		return
+	}
+
+	runWorkers(workers, sc.worker, sc.queue, stopCh)
+}
+
+func (sc *SnapshotController) worker() {
+	for sc.processNextWorkItem() {
+	}
+}
+
+func (sc *SnapshotController) processNextWorkItem() bool {
+	key, quit := sc.queue.Get()
+
+	if quit {
+		return false
+	}
+	defer sc.queue.Done(key)
+	defer sc.health.processed()
+
+	err := sc.syncSnapshot(key.(string))
+	sc.handleErr(err, key)
+
+	return true
+}
+
+func (sc *SnapshotController) handleErr(err error, key interface{}) {
+	if err == nil {
+		sc.queue.Forget(key)
+		return
+	}
+
+	if sc.queue.NumRequeues(key) < maxRetries {
+		sc.logger.WithField("snapshot", key).Warnf("Error syncing Longhorn snapshot: %v", err)
+		sc.queue.AddRateLimited(key)
+		return
+	}
+
+	utilruntime.HandleError(err)
+	sc.logger.WithField("snapshot", key).Warnf("Dropping Longhorn snapshot out of the queue: %v", err)
+	sc.queue.Forget(key)
+}
+
+func (sc *SnapshotController) syncSnapshot(key string) (err error) {
+	defer func() {
+		err = errors.Wrapf(err, "fail to sync snapshot for %v", key)
+	}()
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	if namespace != sc.namespace {
+		// Not ours, don't do anything
+		return nil
+	}
+
+	snapshot, err := sc.ds.GetSnapshot(name)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			sc.logger.WithField("snapshot", key).Debugf("Longhorn snapshot has been deleted")
+			return nil
+		}
+		return err
+	}
+	log := getLoggerForSnapshot(sc.logger, snapshot)
+
+	v, err := sc.ds.GetVolumeRO(snapshot.Spec.Volume)
+	if err != nil {
+		if !datastore.ErrorIsNotFound(err) {
+			return err
+		}
+		v = nil
+	}
+	// the snapshots are gone with the volume, which is cleaning up the
+	// engine already, so there's nothing to delete from the engine. The
+	// snapshots of the volume gone have no owner, and are released by the
+	// leader.
+	if v == nil || v.DeletionTimestamp != nil {
+		if v == nil && !sc.isLeaderHandler() {
+			return nil
+		}
+		if v != nil && v.Spec.OwnerID != sc.controllerID {
+			return nil
+		}
+		if snapshot.DeletionTimestamp == nil {
+			log.Debugf("Waiting for the snapshot to be cleaned up with the volume")
+			return nil
+		}
+		log.Infof("Released the snapshot of the deleted volume")
+		return sc.ds.RemoveFinalizerForSnapshot(snapshot)
+	}
+
+	e, err := sc.getVolumeEngine(v)
+	if err != nil {
+		return err
+	}
+	// the snapshots are operated by the manager running the engine, which
+	// monitors the snapshots of the engine as well
+	ownerID := v.Spec.OwnerID
+	if e != nil && e.Spec.OwnerID != "" {
+		ownerID = e.Spec.OwnerID
+	}
+	if ownerID != sc.controllerID {
+		return nil
+	}
+
+	client, reason, message := sc.getEngineClient(v, e)
+
+	if snapshot.DeletionTimestamp != nil {
+		return sc.deleteSnapshot(snapshot, client, reason, message)
+	}
+
+	existingSnapshot := snapshot.DeepCopy()
+	defer func() {
+		if err == nil && !reflect.DeepEqual(existingSnapshot, snapshot) {
+			// the spec is written by update and the status through the
+			// status subresource
+			status := snapshot.Status
+			updated := snapshot
+			if isSpecOrMetaChanged(&existingSnapshot.ObjectMeta, &snapshot.ObjectMeta, existingSnapshot.Spec, snapshot.Spec) {
+				updated, err = sc.ds.UpdateSnapshot(snapshot)
+			}
+			if err == nil && !reflect.DeepEqual(existingSnapshot.Status, status) {
+				updated.Status = status
+				_, err = sc.ds.UpdateSnapshotStatus(updated)
+			}
+		}
+		if apierrors.IsConflict(errors.Cause(err)) {
+			log.Debugf("Requeue snapshot due to conflict")
+			sc.enqueueSnapshot(snapshot)
+			err = nil
+		}
+	}()
+
+	// the snapshot is garbage collected with the volume
+	if len(snapshot.OwnerReferences) == 0 {
+		snapshot.OwnerReferences = getOwnerReferencesForVolume(v)
+	}
+	reconcileVolumeLabel(&snapshot.ObjectMeta, snapshot.Spec.Volume)
+
+	if client == nil {
+		sc.setSnapshotCondition(snapshot, types.SnapshotConditionTypeSynced, types.ConditionStatusFalse, reason, message)
+		return nil
+	}
+
+	engineSnapshot, err := client.SnapshotGet(snapshot.Name)
+	if err != nil {
+		// the condition is written before the retry
+		if err := sc.updateSnapshotCondition(existingSnapshot, types.ConditionStatusFalse, types.SnapshotConditionReasonEngineUnavailable, err.Error()); err != nil {
+			log.Warnf("Cannot update the condition of the snapshot: %v", err)
+		}
+		return err
+	}
+	if engineSnapshot == nil {
+		if snapshot.Status.CreationTime != "" {
+			// the snapshot has been removed from the engine behind the
+			// object, e.g. purged by the recurring job
+			log.Infof("Deleting the snapshot which no longer exists in the engine")
+			if err := sc.ds.DeleteSnapshot(snapshot.Name); err != nil && !datastore.ErrorIsNotFound(err) {
+				return err
+			}
+			return nil
+		}
+		if !snapshot.Spec.CreateSnapshot {
+			return nil
+		}
+		if _, err := client.SnapshotCreate(snapshot.Name, snapshot.Spec.Labels); err != nil {
+			sc.eventRecorder.Eventf(snapshot, v1.EventTypeWarning, EventReasonFailedCreating, "Failed to create snapshot %v of volume %v: %v", snapshot.Name, v.Name, err)
+			if err := sc.updateSnapshotCondition(existingSnapshot, types.ConditionStatusFalse, types.SnapshotConditionReasonCreationFailed, err.Error()); err != nil {
+				log.Warnf("Cannot update the condition of the snapshot: %v", err)
+			}
+			return err
+		}
+		sc.eventRecorder.Eventf(snapshot, v1.EventTypeNormal, EventReasonCreate, "Created snapshot %v of volume %v", snapshot.Name, v.Name)
+		if engineSnapshot, err = client.SnapshotGet(snapshot.Name); err != nil {
+			return err
+		}
+		if engineSnapshot == nil {
+			return fmt.Errorf("cannot find snapshot %v in the engine after creation", snapshot.Name)
+		}
+	}
+	syncSnapshotStatus(&snapshot.Status, engineSnapshot)
+	sc.setSnapshotCondition(snapshot, types.SnapshotConditionTypeSynced, types.ConditionStatusTrue, "", "")
+	return nil
+}
+
+// deleteSnapshot deletes and purges the snapshot from the engine before
+// releasing the object. The snapshot never created in the engine is released
+// at once.
+func (sc *SnapshotController) deleteSnapshot(snapshot *longhorn.Snapshot, client engineapi.EngineClient, reason, message string) error {
+	log := getLoggerForSnapshot(sc.logger, snapshot)
+	if snapshot.Status.CreationTime == "" {
+		return sc.ds.RemoveFinalizerForSnapshot(snapshot)
+	}
+
+	if client == nil {
+		return sc.updateSnapshotCondition(snapshot, types.ConditionStatusFalse, reason, message)
+	}
+
+	err := func() error {
+		engineSnapshot, err := client.SnapshotGet(snapshot.Name)
+		if err != nil {
+			return err
+		}
+		if engineSnapshot == nil {
+			return nil
+		}
+		if !engineSnapshot.Removed {
+			if err := client.SnapshotDelete(snapshot.Name); err != nil {
+				return err
+			}
+		}
+		// the snapshot is marked as removed at least, even if it cannot
+		// be coalesced by the purge yet, e.g. it's the latest one
+		return client.SnapshotPurge()
+	}()
+	if err != nil {
+		sc.eventRecorder.Eventf(snapshot, v1.EventTypeWarning, EventReasonFailedDeleting, "Failed to delete snapshot %v of volume %v: %v", snapshot.Name, snapshot.Spec.Volume, err)
+		if err := sc.updateSnapshotCondition(snapshot, types.ConditionStatusFalse, types.SnapshotConditionReasonDeletionFailed, err.Error()); err != nil {
+			log.Warnf("Cannot update the condition of the snapshot: %v", err)
+		}
+		return err
+	}
+	sc.eventRecorder.Eventf(snapshot, v1.EventTypeNormal, EventReasonDelete, "Deleted snapshot %v of volume %v", snapshot.Name, snapshot.Spec.Volume)
+	return sc.ds.RemoveFinalizerForSnapshot(snapshot)
+}
+
+// getVolumeEngine returns the engine of the volume, or nil if there is none
+// or more than one during the migration
+func (sc *SnapshotController) getVolumeEngine(v *longhorn.Volume) (*longhorn.Engine, error) {
+	es, err := sc.ds.ListEnginesByVolumeRO(v.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(es) != 1 {
+		return nil, nil
+	}
+	return es[0], nil
+}
+
+// getEngineClient returns the client of the engine if the snapshots of the
+// volume can be operated, or the reason why they cannot be
+func (sc *SnapshotController) getEngineClient(v *longhorn.Volume, e *longhorn.Engine) (engineapi.EngineClient, string, string) {
+	if v.Status.State != types.VolumeStateAttached {
+		return nil, types.SnapshotConditionReasonVolumeDetached, fmt.Sprintf("volume %v is %v", v.Name, v.Status.State)
+	}
+	if v.Spec.MigrationNodeID != "" {
+		return nil, types.SnapshotConditionReasonEngineUnavailable, fmt.Sprintf("volume %v is migrating", v.Name)
+	}
+	if e == nil {
+		return nil, types.SnapshotConditionReasonEngineUnavailable, fmt.Sprintf("cannot find the engine of volume %v", v.Name)
+	}
+	if e.Status.CurrentImage != e.Spec.EngineImage {
+		return nil, types.SnapshotConditionReasonEngineUnavailable, fmt.Sprintf("engine %v is upgrading", e.Name)
+	}
+	client, err := GetClientForEngine(e, sc.engines, e.Status.CurrentImage)
+	if err != nil {
+		return nil, types.SnapshotConditionReasonEngineUnavailable, err.Error()
+	}
+	return client, "", ""
+}
+
+func (sc *SnapshotController) setSnapshotCondition(snapshot *longhorn.Snapshot, conditionType types.SnapshotConditionType, status types.ConditionStatus, reason, message string) {
+	condition := types.GetSnapshotConditionFromStatus(snapshot.Status, conditionType)
+	if condition.Status != status || condition.Reason != reason {
+		condition.LastTransitionTime = util.Now()
+	}
+	condition.Status = status
+	condition.Reason = reason
+	condition.Message = message
+	if snapshot.Status.Conditions == nil {
+		snapshot.Status.Conditions = map[types.SnapshotConditionType]types.Condition{}
+	}
+	snapshot.Status.Conditions[conditionType] = condition
+}
+
+// updateSnapshotCondition writes the synced condition of the snapshot at once,
+// e.g. before the failed operation is retried, leaving the metadata untouched
+func (sc *SnapshotController) updateSnapshotCondition(snapshot *longhorn.Snapshot, status types.ConditionStatus, reason, message string) error {
+	existing := types.GetSnapshotConditionFromStatus(snapshot.Status, types.SnapshotConditionTypeSynced)
+	if existing.Status == status && existing.Reason == reason && existing.Message == message {
+		return nil
+	}
+	_, err := sc.ds.UpdateSnapshotStatusWithRetry(snapshot, func(snapshot *longhorn.Snapshot) {
+		sc.setSnapshotCondition(snapshot, types.SnapshotConditionTypeSynced, status, reason, message)
+	})
+	if datastore.ErrorIsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (sc *SnapshotController) enqueueSnapshot(snapshot *longhorn.Snapshot) {
+	key, err := controller.KeyFunc(snapshot)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("Couldn't get key for object %#v: %v", snapshot, err))
+		return
+	}
+
+	sc.queue.AddRateLimited(key)
+}
+
+func (sc *SnapshotController) enqueueVolumeSnapshots(volumeName string) {
+	snapshots, err := sc.ds.ListSnapshotsByVolumeRO(volumeName)
+	if err != nil {
+		sc.logger.Warnf("Fail to list snapshots of volume %v: %v", volumeName, err)
+		return
+	}
+	for _, snapshot := range snapshots {
+		sc.enqueueSnapshot(snapshot)
+	}
+}
+
+// syncSnapshotStatus copies the state of the snapshot in the engine to the
+// status of the snapshot object
+func syncSnapshotStatus(status *types.SnapshotStatus, engineSnapshot *engineapi.Snapshot) {
+	children := map[string]bool{}
+	for child := range engineSnapshot.Children {
+		children[child] = true
+	}
+	status.Parent = engineSnapshot.Parent
+	status.Children = children
+	status.MarkRemoved = engineSnapshot.Removed
+	status.UserCreated = engineSnapshot.UserCreated
+	status.CreationTime = engineSnapshot.Created
+	status.Labels = engineSnapshot.Labels
+	if size, err := strconv.ParseInt(engineSnapshot.Size, 10, 64); err == nil {
+		status.Size = size
+	}
+	status.ReadyToUse = !engineSnapshot.Removed
+}
@@ -0,0 +1,286 @@
+package controller
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/kubernetes/pkg/controller"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+
+	. "gopkg.in/check.v1"
+)
+
+const (
+	TestSnapshotName = "test-snapshot"
+)
+
+type snapshotFixture struct {
+	lhClient          *lhfake.Clientset
+	lhInformerFactory lhinformerfactory.SharedInformerFactory
+	engines           *engineapi.EngineSimulatorCollection
+	ds                *datastore.DataStore
+}
+
+func newSnapshotFixture(c *C) (*snapshotFixture, *SnapshotController) {
+	lhClient := lhfake.NewSimpleClientset()
+	kubeClient := fake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+	f := &snapshotFixture{
+		lhClient:          lhClient,
+		lhInformerFactory: lhInformerFactory,
+		engines:           engineapi.NewEngineSimulatorCollection(),
+	}
+
+	f.ds = datastore.NewDataStore(
+		lhInformerFactory.Longhorn().V1alpha1().Volumes(),
+		lhInformerFactory.Longhorn().V1alpha1().Engines(),
+		lhInformerFactory.Longhorn().V1alpha1().Replicas(),
+		lhInformerFactory.Longhorn().V1alpha1().EngineImages(),
+		lhInformerFactory.Longhorn().V1alpha1().Nodes(),
+		lhInformerFactory.Longhorn().V1alpha1().Settings(),
+		lhInformerFactory.Longhorn().V1alpha1().Snapshots(),
+		lhClient,
+		kubeInformerFactory.Core().V1().Pods(),
+		kubeInformerFactory.Batch().V1beta1().CronJobs(),
+		kubeInformerFactory.Apps().V1beta2().DaemonSets(),
+		kubeInformerFactory.Core().V1().Events(),
+		kubeInformerFactory.Core().V1().PersistentVolumes(),
+		kubeInformerFactory.Core().V1().PersistentVolumeClaims(),
+		kubeInformerFactory.Storage().V1beta1().VolumeAttachments(),
+		kubeClient, TestNamespace)
+	sc := NewSnapshotController(f.ds, scheme.Scheme, DefaultControllerConfig(),
+		lhInformerFactory.Longhorn().V1alpha1().Snapshots(),
+		lhInformerFactory.Longhorn().V1alpha1().Volumes(),
+		lhInformerFactory.Longhorn().V1alpha1().Engines(),
+		kubeClient, f.engines, TestNamespace, TestNode1)
+	sc.eventRecorder = record.NewFakeRecorder(100)
+	return f, sc
+}
+
+// addAttachedVolume adds the volume attached to the node, with the engine
+// running in the simulator
+func (f *snapshotFixture) addAttachedVolume(c *C) (*longhorn.Volume, *longhorn.Engine) {
+	v := newVolume(TestVolumeName, 2)
+	v.Namespace = TestNamespace
+	v.UID = "test-volume-uid"
+	v.Spec.NodeID = TestNode1
+	v.Status.State = types.VolumeStateAttached
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer().Add(v), IsNil)
+
+	e := newEngineForVolume(v)
+	e.Namespace = TestNamespace
+	e.Spec.NodeID = TestNode1
+	e.Spec.DesireState = types.InstanceStateRunning
+	e.Status.CurrentState = types.InstanceStateRunning
+	e.Status.CurrentImage = TestEngineImage
+	e.Status.IP = TestIP1
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Engines().Informer().GetIndexer().Add(e), IsNil)
+
+	c.Assert(f.engines.CreateEngineSimulator(&engineapi.EngineSimulatorRequest{
+		VolumeName:     v.Name,
+		VolumeSize:     TestVolumeSize,
+		ControllerAddr: TestIP1,
+	}), IsNil)
+	return v, e
+}
+
+// addSnapshot creates the snapshot object through the datastore, and adds
+// it to the cache
+func (f *snapshotFixture) addSnapshot(c *C, snapshot *longhorn.Snapshot) *longhorn.Snapshot {
+	snapshot.Namespace = TestNamespace
+	snapshot, err := f.ds.CreateSnapshot(snapshot)
+	c.Assert(err, IsNil)
+	f.updateCache(c, snapshot)
+	return snapshot
+}
+
+func (f *snapshotFixture) updateCache(c *C, snapshot *longhorn.Snapshot) {
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Snapshots().Informer().GetIndexer().Update(snapshot), IsNil)
+}
+
+func (f *snapshotFixture) getSnapshot(c *C, name string) *longhorn.Snapshot {
+	snapshot, err := f.lhClient.LonghornV1alpha1().Snapshots(TestNamespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	c.Assert(err, IsNil)
+	return snapshot
+}
+
+func (f *snapshotFixture) getEngineSimulator(c *C) *engineapi.EngineSimulator {
+	sim, err := f.engines.GetEngineSimulator(TestVolumeName)
+	c.Assert(err, IsNil)
+	return sim
+}
+
+func newSnapshot(name string, createSnapshot bool) *longhorn.Snapshot {
+	return &longhorn.Snapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: types.SnapshotSpec{
+			Volume:         TestVolumeName,
+			CreateSnapshot: createSnapshot,
+			Labels:         map[string]string{"key": "value"},
+		},
+	}
+}
+
+func (s *TestSuite) TestSyncSnapshotCreate(c *C) {
+	f, sc := newSnapshotFixture(c)
+	v, _ := f.addAttachedVolume(c)
+	f.addSnapshot(c, newSnapshot(TestSnapshotName, true))
+
+	c.Assert(sc.syncSnapshot(TestNamespace+"/"+TestSnapshotName), IsNil)
+
+	engineSnapshot, err := f.getEngineSimulator(c).SnapshotGet(TestSnapshotName)
+	c.Assert(err, IsNil)
+	c.Assert(engineSnapshot, NotNil)
+	c.Assert(engineSnapshot.Labels, DeepEquals, map[string]string{"key": "value"})
+
+	snapshot := f.getSnapshot(c, TestSnapshotName)
+	c.Assert(snapshot.Status.ReadyToUse, Equals, true)
+	c.Assert(snapshot.Status.CreationTime, Equals, engineSnapshot.Created)
+	c.Assert(snapshot.Status.UserCreated, Equals, true)
+	c.Assert(types.GetSnapshotConditionFromStatus(snapshot.Status, types.SnapshotConditionTypeSynced).Status, Equals, types.ConditionStatusTrue)
+	c.Assert(snapshot.OwnerReferences, HasLen, 1)
+	c.Assert(snapshot.OwnerReferences[0].UID, Equals, v.UID)
+
+	// the snapshot is taken once
+	f.updateCache(c, snapshot)
+	c.Assert(sc.syncSnapshot(TestNamespace+"/"+TestSnapshotName), IsNil)
+	engineSnapshots, err := f.getEngineSimulator(c).SnapshotList()
+	c.Assert(err, IsNil)
+	c.Assert(engineSnapshots, HasLen, 1)
+
+	// the snapshot not asked for is left alone
+	f.addSnapshot(c, newSnapshot("not-requested", false))
+	c.Assert(sc.syncSnapshot(TestNamespace+"/not-requested"), IsNil)
+	engineSnapshots, err = f.getEngineSimulator(c).SnapshotList()
+	c.Assert(err, IsNil)
+	c.Assert(engineSnapshots, HasLen, 1)
+}
+
+func (s *TestSuite) TestSyncSnapshotVolumeDetached(c *C) {
+	f, sc := newSnapshotFixture(c)
+	v, _ := f.addAttachedVolume(c)
+	v.Status.State = types.VolumeStateDetached
+	c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer().Update(v), IsNil)
+	f.addSnapshot(c, newSnapshot(TestSnapshotName, true))
+
+	c.Assert(sc.syncSnapshot(TestNamespace+"/"+TestSnapshotName), IsNil)
+
+	snapshot := f.getSnapshot(c, TestSnapshotName)
+	c.Assert(snapshot.Status.ReadyToUse, Equals, false)
+	condition := types.GetSnapshotConditionFromStatus(snapshot.Status, types.SnapshotConditionTypeSynced)
+	c.Assert(condition.Status, Equals, types.ConditionStatusFalse)
+	c.Assert(condition.Reason, Equals, types.SnapshotConditionReasonVolumeDetached)
+	engineSnapshots, err := f.getEngineSimulator(c).SnapshotList()
+	c.Assert(err, IsNil)
+	c.Assert(engineSnapshots, HasLen, 0)
+
+	// the snapshot being deleted is held until it can be deleted from the
+	// engine
+	markDeleting(&snapshot.ObjectMeta)
+	snapshot.Status.CreationTime = TestTimeNow
+	f.updateCache(c, snapshot)
+	c.Assert(sc.syncSnapshot(TestNamespace+"/"+TestSnapshotName), IsNil)
+	c.Assert(f.getSnapshot(c, TestSnapshotName).Finalizers, DeepEquals, []string{longhornFinalizerKey})
+}
+
+func (s *TestSuite) TestSyncSnapshotDelete(c *C) {
+	f, sc := newSnapshotFixture(c)
+	f.addAttachedVolume(c)
+	sim := f.getEngineSimulator(c)
+	for _, name := range []string{TestSnapshotName, "latest"} {
+		_, err := sim.SnapshotCreate(name, nil)
+		c.Assert(err, IsNil)
+	}
+
+	for _, name := range []string{TestSnapshotName, "latest"} {
+		snapshot := f.addSnapshot(c, newSnapshot(name, false))
+		c.Assert(sc.syncSnapshot(TestNamespace+"/"+name), IsNil)
+		snapshot = f.getSnapshot(c, name)
+		c.Assert(snapshot.Status.ReadyToUse, Equals, true)
+
+		markDeleting(&snapshot.ObjectMeta)
+		f.updateCache(c, snapshot)
+		_, err := f.lhClient.LonghornV1alpha1().Snapshots(TestNamespace).Update(snapshot)
+		c.Assert(err, IsNil)
+		c.Assert(sc.syncSnapshot(TestNamespace+"/"+name), IsNil)
+		c.Assert(f.getSnapshot(c, name).Finalizers, HasLen, 0)
+	}
+
+	// the latest snapshot cannot be purged, but is marked as removed
+	engineSnapshots, err := sim.SnapshotList()
+	c.Assert(err, IsNil)
+	c.Assert(engineSnapshots, HasLen, 1)
+	c.Assert(engineSnapshots["latest"].Removed, Equals, true)
+}
+
+func (s *TestSuite) TestSyncSnapshotVolumeDeleted(c *C) {
+	f, sc := newSnapshotFixture(c)
+	snapshot := newSnapshot(TestSnapshotName, true)
+	markDeleting(&snapshot.ObjectMeta)
+	snapshot = f.addSnapshot(c, snapshot)
+
+	// released by the leader without the engine
+	sc.isLeaderHandler = func() bool { return false }
+	c.Assert(sc.syncSnapshot(TestNamespace+"/"+TestSnapshotName), IsNil)
+	c.Assert(f.getSnapshot(c, TestSnapshotName).Finalizers, HasLen, 1)
+
+	sc.isLeaderHandler = alwaysLeader
+	c.Assert(sc.syncSnapshot(TestNamespace+"/"+TestSnapshotName), IsNil)
+	c.Assert(f.getSnapshot(c, TestSnapshotName).Finalizers, HasLen, 0)
+}
+
+func (s *TestSuite) TestEngineMonitorRefreshSnapshots(c *C) {
+	f, _ := newSnapshotFixture(c)
+	_, e := f.addAttachedVolume(c)
+	sim := f.getEngineSimulator(c)
+	for _, name := range []string{"recurring-c-1", "Invalid_Name"} {
+		_, err := sim.SnapshotCreate(name, map[string]string{"RecurringJob": "c"})
+		c.Assert(err, IsNil)
+	}
+	// the snapshot to be taken is not the one purged
+	f.addSnapshot(c, newSnapshot("pending", true))
+
+	m := &EngineMonitor{
+		Name:    e.Name,
+		ds:      f.ds,
+		logger:  newControllerLogger("longhorn-engine"),
+		engines: f.engines,
+	}
+	c.Assert(m.refreshSnapshots(e), IsNil)
+
+	snapshot := f.getSnapshot(c, "recurring-c-1")
+	c.Assert(snapshot, NotNil)
+	c.Assert(snapshot.Spec.CreateSnapshot, Equals, false)
+	c.Assert(snapshot.Spec.Volume, Equals, TestVolumeName)
+	c.Assert(snapshot.Labels[datastore.LonghornVolumeKey], Equals, TestVolumeName)
+	c.Assert(snapshot.Status.ReadyToUse, Equals, true)
+	c.Assert(snapshot.Status.Labels, DeepEquals, map[string]string{"RecurringJob": "c"})
+	c.Assert(f.getSnapshot(c, "pending"), NotNil)
+	objs, err := f.lhClient.LonghornV1alpha1().Snapshots(TestNamespace).List(metav1.ListOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(objs.Items, HasLen, 2)
+
+	// the object of the snapshot purged from the engine is deleted
+	f.updateCache(c, snapshot)
+	c.Assert(sim.SnapshotDelete("recurring-c-1"), IsNil)
+	c.Assert(sim.SnapshotPurge(), IsNil)
+	c.Assert(m.refreshSnapshots(e), IsNil)
+	c.Assert(f.getSnapshot(c, "recurring-c-1"), IsNil)
+	c.Assert(f.getSnapshot(c, "pending"), NotNil)
+}
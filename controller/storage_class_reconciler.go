@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	StorageClassReconcileInterval = time.Minute
+)
+
+// StorageClassReconciler keeps the default StorageClass in sync with the
+// template and the default settings. The template is the StorageClass in
+// the ConfigMap longhorn-storageclass, or the built-in one if the ConfigMap
+// doesn't exist. The parameters not in the template are filled from the
+// defaults.
+//
+// The StorageClass parameters are immutable, so the StorageClass is deleted
+// and created again once it drifts from the template. Only the StorageClass
+// carrying the managed-by annotation is touched, the one created by the user
+// is left alone.
+//
+// Only the leader reconciles, the same as the orphan sweeper.
+type StorageClassReconciler struct {
+	ds           *datastore.DataStore
+	controllerID string
+
+	isLeaderHandler IsLeaderHandler
+}
+
+func NewStorageClassReconciler(ds *datastore.DataStore, controllerID string) *StorageClassReconciler {
+	return &StorageClassReconciler{
+		ds:           ds,
+		controllerID: controllerID,
+
+		isLeaderHandler: alwaysLeader,
+	}
+}
+
+func (r *StorageClassReconciler) Run(stopCh <-chan struct{}) {
+	logrus.Infof("Start Longhorn default StorageClass reconciler")
+	defer logrus.Infof("Shutting down Longhorn default StorageClass reconciler")
+
+	// the changed defaults are applied right away
+	settingCh := make(chan struct{}, 1)
+	r.ds.OnSettingChange(func(name types.SettingName) {
+		select {
+		case settingCh <- struct{}{}:
+		default:
+		}
+	}, types.SettingNameManageDefaultStorageClass, types.SettingNameDefaultReplicaCount)
+
+	ticker := time.NewTicker(StorageClassReconcileInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.reconcile(); err != nil {
+			logrus.Warnf("Fail to reconcile the default StorageClass: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-settingCh:
+		}
+	}
+}
+
+func (r *StorageClassReconciler) reconcile() error {
+	manage, err := r.ds.GetSettingAsBool(types.SettingNameManageDefaultStorageClass)
+	if err != nil {
+		return err
+	}
+	if !manage {
+		return nil
+	}
+	if !r.isLeaderHandler() {
+		return nil
+	}
+
+	desired, err := r.desiredStorageClass()
+	if err != nil {
+		return err
+	}
+
+	existing, err := r.ds.GetStorageClass(desired.Name)
+	if err != nil {
+		if !datastore.ErrorIsNotFound(err) {
+			return err
+		}
+		if _, err := r.ds.CreateStorageClass(desired); err != nil {
+			return errors.Wrapf(err, "fail to create StorageClass %v", desired.Name)
+		}
+		logrus.Infof("Created the default StorageClass %v", desired.Name)
+		return nil
+	}
+	if existing.Annotations[types.StorageClassManagedByAnnotation] != types.StorageClassManagedByLonghorn {
+		logrus.Debugf("StorageClass %v is not created by Longhorn, leave it alone", existing.Name)
+		return nil
+	}
+	if !isStorageClassDrifted(existing, desired) {
+		return nil
+	}
+
+	if err := r.ds.DeleteStorageClass(existing.Name, existing.UID); err != nil {
+		if datastore.ErrorIsNotFound(err) || apierrors.IsConflict(err) {
+			// replaced by someone else, check it again next time
+			return nil
+		}
+		return errors.Wrapf(err, "fail to delete StorageClass %v for the update", existing.Name)
+	}
+	if _, err := r.ds.CreateStorageClass(desired); err != nil {
+		return errors.Wrapf(err, "fail to recreate StorageClass %v for the update", desired.Name)
+	}
+	logrus.Infof("Recreated the default StorageClass %v since the template or the defaults changed", desired.Name)
+	return nil
+}
+
+// desiredStorageClass builds the StorageClass from the template and the
+// defaults. An invalid template is an error, so the existing StorageClass is
+// kept until the template is fixed.
+func (r *StorageClassReconciler) desiredStorageClass() (*storagev1.StorageClass, error) {
+	sc := &storagev1.StorageClass{}
+	cm, err := r.ds.GetConfigMap(types.DefaultStorageClassConfigMapName)
+	if err != nil && !datastore.ErrorIsNotFound(err) {
+		return nil, err
+	}
+	if cm != nil && err == nil {
+		template, ok := cm.Data[types.DefaultStorageClassConfigMapKey]
+		if !ok {
+			return nil, fmt.Errorf("ConfigMap %v doesn't have the StorageClass template in %v",
+				cm.Name, types.DefaultStorageClassConfigMapKey)
+		}
+		if err := yaml.Unmarshal([]byte(template), sc); err != nil {
+			return nil, errors.Wrapf(err, "invalid StorageClass template in ConfigMap %v", cm.Name)
+		}
+	}
+
+	defaultReplicaCount, err := r.ds.GetSettingAsInt(types.SettingNameDefaultReplicaCount)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the fields kept by the StorageClass are taken from the template
+	desired := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        types.DefaultStorageClassName,
+			Labels:      sc.Labels,
+			Annotations: map[string]string{},
+		},
+		Provisioner:          sc.Provisioner,
+		Parameters:           map[string]string{},
+		ReclaimPolicy:        sc.ReclaimPolicy,
+		MountOptions:         sc.MountOptions,
+		AllowVolumeExpansion: sc.AllowVolumeExpansion,
+		VolumeBindingMode:    sc.VolumeBindingMode,
+		AllowedTopologies:    sc.AllowedTopologies,
+	}
+	for k, v := range sc.Annotations {
+		desired.Annotations[k] = v
+	}
+	desired.Annotations[types.StorageClassManagedByAnnotation] = types.StorageClassManagedByLonghorn
+	for k, v := range sc.Parameters {
+		desired.Parameters[k] = v
+	}
+	if desired.Provisioner == "" {
+		desired.Provisioner = LonghornProvisionerName
+	}
+	if _, ok := desired.Parameters[types.OptionNumberOfReplicas]; !ok {
+		desired.Parameters[types.OptionNumberOfReplicas] = strconv.FormatInt(defaultReplicaCount, 10)
+	}
+	if _, ok := desired.Parameters[types.OptionStaleReplicaTimeout]; !ok {
+		desired.Parameters[types.OptionStaleReplicaTimeout] = types.DefaultStaleReplicaTimeout
+	}
+	return desired, nil
+}
+
+// isStorageClassDrifted compares the fields set by the reconciler. The fields
+// defaulted by Kubernetes on creation are compared only if the template sets
+// them.
+func isStorageClassDrifted(existing, desired *storagev1.StorageClass) bool {
+	for k, v := range desired.Annotations {
+		if existing.Annotations[k] != v {
+			return true
+		}
+	}
+	for k, v := range desired.Labels {
+		if existing.Labels[k] != v {
+			return true
+		}
+	}
+	if existing.Provisioner != desired.Provisioner ||
+		!reflect.DeepEqual(existing.Parameters, desired.Parameters) ||
+		!reflect.DeepEqual(existing.MountOptions, desired.MountOptions) ||
+		!reflect.DeepEqual(existing.AllowedTopologies, desired.AllowedTopologies) {
+		return true
+	}
+	if desired.ReclaimPolicy != nil && !reflect.DeepEqual(existing.ReclaimPolicy, desired.ReclaimPolicy) {
+		return true
+	}
+	if desired.VolumeBindingMode != nil && !reflect.DeepEqual(existing.VolumeBindingMode, desired.VolumeBindingMode) {
+		return true
+	}
+	if desired.AllowVolumeExpansion != nil && !reflect.DeepEqual(existing.AllowVolumeExpansion, desired.AllowVolumeExpansion) {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+
+	. "gopkg.in/check.v1"
+)
+
+const (
+	TestStorageClassTemplate = `
+kind: StorageClass
+apiVersion: storage.k8s.io/v1
+metadata:
+  name: whatever
+  annotations:
+    storageclass.kubernetes.io/is-default-class: "true"
+provisioner: rancher.io/longhorn
+reclaimPolicy: Retain
+parameters:
+  staleReplicaTimeout: "60"
+`
+)
+
+func newStorageClassReconcilerFixture(c *C, settings ...*longhorn.Setting) (*orphanSweeperFixture, *StorageClassReconciler) {
+	f := newOrphanSweeperFixture()
+	f.addNode(c, newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, ""))
+	for _, setting := range settings {
+		setting.Namespace = TestNamespace
+		c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer().Add(setting), IsNil)
+	}
+	return f, NewStorageClassReconciler(f.newDataStore(), TestNode1)
+}
+
+func newStorageClassTemplate(c *C, f *orphanSweeperFixture, template string) {
+	_, err := f.kubeClient.CoreV1().ConfigMaps(TestNamespace).Create(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: types.DefaultStorageClassConfigMapName},
+		Data:       map[string]string{types.DefaultStorageClassConfigMapKey: template},
+	})
+	c.Assert(err, IsNil)
+}
+
+func (f *orphanSweeperFixture) getStorageClass(c *C) *storagev1.StorageClass {
+	sc, err := f.kubeClient.StorageV1().StorageClasses().Get(types.DefaultStorageClassName, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	return sc
+}
+
+func (s *TestSuite) TestStorageClassReconcilerCreate(c *C) {
+	f, r := newStorageClassReconcilerFixture(c, &longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{Name: string(types.SettingNameDefaultReplicaCount)},
+		Setting:    types.Setting{Value: "2"},
+	})
+
+	// the built-in template without the ConfigMap
+	c.Assert(r.reconcile(), IsNil)
+	sc := f.getStorageClass(c)
+	c.Assert(sc.Provisioner, Equals, LonghornProvisionerName)
+	c.Assert(sc.Annotations[types.StorageClassManagedByAnnotation], Equals, types.StorageClassManagedByLonghorn)
+	c.Assert(sc.Parameters, DeepEquals, map[string]string{
+		types.OptionNumberOfReplicas:    "2",
+		types.OptionStaleReplicaTimeout: types.DefaultStaleReplicaTimeout,
+	})
+
+	// nothing changed
+	c.Assert(r.reconcile(), IsNil)
+	c.Assert(f.getStorageClass(c), DeepEquals, sc)
+
+	// recreated once deleted
+	c.Assert(f.kubeClient.StorageV1().StorageClasses().Delete(sc.Name, &metav1.DeleteOptions{}), IsNil)
+	c.Assert(r.reconcile(), IsNil)
+	c.Assert(f.getStorageClass(c).Parameters, DeepEquals, sc.Parameters)
+
+	// replaced once the template changed
+	newStorageClassTemplate(c, f, TestStorageClassTemplate)
+	c.Assert(r.reconcile(), IsNil)
+	sc = f.getStorageClass(c)
+	c.Assert(sc.Name, Equals, types.DefaultStorageClassName)
+	c.Assert(sc.Annotations["storageclass.kubernetes.io/is-default-class"], Equals, "true")
+	c.Assert(sc.Annotations[types.StorageClassManagedByAnnotation], Equals, types.StorageClassManagedByLonghorn)
+	c.Assert(*sc.ReclaimPolicy, Equals, v1.PersistentVolumeReclaimRetain)
+	c.Assert(sc.Parameters, DeepEquals, map[string]string{
+		types.OptionNumberOfReplicas:    "2",
+		types.OptionStaleReplicaTimeout: "60",
+	})
+}
+
+func (s *TestSuite) TestStorageClassReconcilerInvalidTemplate(c *C) {
+	f, r := newStorageClassReconcilerFixture(c)
+	c.Assert(r.reconcile(), IsNil)
+	sc := f.getStorageClass(c)
+
+	// the existing StorageClass is kept until the template is fixed
+	newStorageClassTemplate(c, f, "parameters: [")
+	c.Assert(r.reconcile(), NotNil)
+	c.Assert(f.getStorageClass(c), DeepEquals, sc)
+}
+
+func (s *TestSuite) TestStorageClassReconcilerUserCreated(c *C) {
+	f, r := newStorageClassReconcilerFixture(c)
+	userSC := &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: types.DefaultStorageClassName},
+		Provisioner: LonghornProvisionerName,
+		Parameters:  map[string]string{types.OptionNumberOfReplicas: "1"},
+	}
+	userSC, err := f.kubeClient.StorageV1().StorageClasses().Create(userSC)
+	c.Assert(err, IsNil)
+
+	c.Assert(r.reconcile(), IsNil)
+	c.Assert(f.getStorageClass(c), DeepEquals, userSC)
+}
+
+func (s *TestSuite) TestStorageClassReconcilerOptOut(c *C) {
+	f, r := newStorageClassReconcilerFixture(c, &longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{Name: string(types.SettingNameManageDefaultStorageClass)},
+		Setting:    types.Setting{Value: "false"},
+	})
+
+	c.Assert(r.reconcile(), IsNil)
+	_, err := f.kubeClient.StorageV1().StorageClasses().Get(types.DefaultStorageClassName, metav1.GetOptions{})
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+}
+
+func (s *TestSuite) TestStorageClassReconcilerNotLeader(c *C) {
+	f, _ := newStorageClassReconcilerFixture(c)
+	r := NewStorageClassReconciler(f.newDataStore(), TestNode2)
+	r.isLeaderHandler = func() bool { return false }
+
+	c.Assert(r.reconcile(), IsNil)
+	_, err := f.kubeClient.StorageV1().StorageClasses().Get(types.DefaultStorageClassName, metav1.GetOptions{})
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+}
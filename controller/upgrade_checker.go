@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/meta"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	// UpgradeCheckerLoopInterval is how often the checker looks whether a
+	// check is due. The checks are spaced by the interval setting in hours.
+	UpgradeCheckerLoopInterval = time.Minute
+
+	upgradeCheckerTimeout = 30 * time.Second
+)
+
+const (
+	upgradeCheckerLatestTag = "latest"
+)
+
+// CheckUpgradeRequest is all sent to the upgrade checker URL
+type CheckUpgradeRequest struct {
+	AppVersion string            `json:"appVersion"`
+	ExtraInfo  map[string]string `json:"extraInfo"`
+}
+
+type CheckUpgradeResponse struct {
+	Versions []ReleaseVersion `json:"versions"`
+}
+
+type ReleaseVersion struct {
+	Name        string   `json:"name"`
+	ReleaseDate string   `json:"releaseDate"`
+	Tags        []string `json:"tags"`
+}
+
+// UpgradeChecker queries the upgrade checker URL for the latest Longhorn
+// release periodically if enabled, and records it in the setting
+// latest-longhorn-version. Only the current version and the number of nodes
+// are sent.
+//
+// The query runs in its own goroutine with a timeout, so an unreachable
+// endpoint delays nothing but the next check. Only the leader checks.
+type UpgradeChecker struct {
+	ds           *datastore.DataStore
+	controllerID string
+
+	httpClient *http.Client
+	lastCheck  time.Time
+	nowHandler func() time.Time
+
+	isLeaderHandler IsLeaderHandler
+}
+
+func NewUpgradeChecker(ds *datastore.DataStore, controllerID string) *UpgradeChecker {
+	return &UpgradeChecker{
+		ds:           ds,
+		controllerID: controllerID,
+		httpClient:   &http.Client{Timeout: upgradeCheckerTimeout},
+		nowHandler:   time.Now,
+
+		isLeaderHandler: alwaysLeader,
+	}
+}
+
+func (uc *UpgradeChecker) Run(stopCh <-chan struct{}) {
+	logrus.Infof("Start Longhorn upgrade checker")
+	defer logrus.Infof("Shutting down Longhorn upgrade checker")
+
+	// enabling the checker or changing the URL checks right away
+	settingCh := make(chan struct{}, 1)
+	uc.ds.OnSettingChange(func(name types.SettingName) {
+		select {
+		case settingCh <- struct{}{}:
+		default:
+		}
+	}, types.SettingNameUpgradeChecker, types.SettingNameUpgradeCheckerURL)
+
+	ticker := time.NewTicker(UpgradeCheckerLoopInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-settingCh:
+			uc.lastCheck = time.Time{}
+		}
+		if err := uc.checkIfDue(); err != nil {
+			logrus.Warnf("Fail to check the latest Longhorn version: %v", err)
+		}
+	}
+}
+
+func (uc *UpgradeChecker) checkIfDue() error {
+	enabled, err := uc.ds.GetSettingAsBool(types.SettingNameUpgradeChecker)
+	if err != nil || !enabled {
+		return err
+	}
+	interval, err := uc.ds.GetSettingAsInt(types.SettingNameUpgradeCheckerInterval)
+	if err != nil {
+		return err
+	}
+	now := uc.nowHandler()
+	if now.Sub(uc.lastCheck) < time.Duration(interval)*time.Hour {
+		return nil
+	}
+	if !uc.isLeaderHandler() {
+		return nil
+	}
+	// the failed check is retried after the interval as well, so the
+	// endpoint is not hammered
+	uc.lastCheck = now
+
+	checkerURL, err := uc.ds.GetSettingValue(types.SettingNameUpgradeCheckerURL)
+	if err != nil {
+		return err
+	}
+	latest, err := uc.queryLatestVersion(checkerURL)
+	if err != nil {
+		return err
+	}
+	return uc.recordLatestVersion(latest)
+}
+
+func (uc *UpgradeChecker) queryLatestVersion(checkerURL string) (string, error) {
+	nodes, err := uc.ds.ListNodes()
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(&CheckUpgradeRequest{
+		AppVersion: meta.Version,
+		ExtraInfo: map[string]string{
+			"nodeCount": strconv.Itoa(len(nodes)),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := uc.httpClient.Post(checkerURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", errors.Wrapf(err, "fail to query %v", checkerURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fail to query %v: %v", checkerURL, resp.Status)
+	}
+	response := &CheckUpgradeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return "", errors.Wrapf(err, "invalid response from %v", checkerURL)
+	}
+	for _, v := range response.Versions {
+		for _, tag := range v.Tags {
+			if tag == upgradeCheckerLatestTag {
+				return v.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no version tagged %v in the response from %v", upgradeCheckerLatestTag, checkerURL)
+}
+
+func (uc *UpgradeChecker) recordLatestVersion(latest string) error {
+	setting, err := uc.ds.GetSetting(types.SettingNameLatestLonghornVersion)
+	if err != nil {
+		return err
+	}
+	if setting.Value == latest {
+		return nil
+	}
+	setting.Value = latest
+	if _, err := uc.ds.UpdateSetting(setting); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		if _, err := uc.ds.CreateSetting(setting); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("The latest Longhorn version is %v, the current one is %v", latest, meta.Version)
+	return nil
+}
@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/meta"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+
+	. "gopkg.in/check.v1"
+)
+
+func newUpgradeCheckerFixture(c *C, settings map[types.SettingName]string) (*orphanSweeperFixture, *UpgradeChecker) {
+	f := newOrphanSweeperFixture()
+	f.addNode(c, newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, ""))
+	f.addNode(c, newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, ""))
+	for name, value := range settings {
+		setting := &longhorn.Setting{
+			ObjectMeta: metav1.ObjectMeta{Name: string(name), Namespace: TestNamespace},
+			Setting:    types.Setting{Value: value},
+		}
+		c.Assert(f.lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer().Add(setting), IsNil)
+	}
+	uc := NewUpgradeChecker(f.newDataStore(), TestNode1)
+	uc.nowHandler = func() time.Time {
+		now, _ := time.Parse(time.RFC3339, TestTimeNow)
+		return now
+	}
+	return f, uc
+}
+
+func (f *orphanSweeperFixture) getLatestVersion(c *C) string {
+	setting, err := f.lhClient.LonghornV1alpha1().Settings(TestNamespace).Get(string(types.SettingNameLatestLonghornVersion), metav1.GetOptions{})
+	if err != nil {
+		return ""
+	}
+	return setting.Value
+}
+
+func newUpgradeResponder(c *C, requests *[]CheckUpgradeRequest, response *CheckUpgradeResponse) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		request := CheckUpgradeRequest{}
+		c.Assert(json.NewDecoder(req.Body).Decode(&request), IsNil)
+		*requests = append(*requests, request)
+		c.Assert(json.NewEncoder(w).Encode(response), IsNil)
+	}))
+}
+
+func (s *TestSuite) TestUpgradeChecker(c *C) {
+	requests := []CheckUpgradeRequest{}
+	server := newUpgradeResponder(c, &requests, &CheckUpgradeResponse{
+		Versions: []ReleaseVersion{
+			{Name: "v0.2.1", Tags: []string{"stable"}},
+			{Name: "v0.3.0", Tags: []string{"latest"}},
+		},
+	})
+	defer server.Close()
+
+	f, uc := newUpgradeCheckerFixture(c, map[types.SettingName]string{
+		types.SettingNameUpgradeChecker:    "true",
+		types.SettingNameUpgradeCheckerURL: server.URL,
+	})
+	c.Assert(uc.checkIfDue(), IsNil)
+	c.Assert(f.getLatestVersion(c), Equals, "v0.3.0")
+	// only the coarse information is sent
+	c.Assert(requests, DeepEquals, []CheckUpgradeRequest{{
+		AppVersion: meta.Version,
+		ExtraInfo:  map[string]string{"nodeCount": "2"},
+	}})
+
+	// not due until the interval passes
+	c.Assert(uc.checkIfDue(), IsNil)
+	c.Assert(requests, HasLen, 1)
+	uc.lastCheck = uc.lastCheck.Add(-25 * time.Hour)
+	c.Assert(uc.checkIfDue(), IsNil)
+	c.Assert(requests, HasLen, 2)
+}
+
+func (s *TestSuite) TestUpgradeCheckerDisabled(c *C) {
+	requests := []CheckUpgradeRequest{}
+	server := newUpgradeResponder(c, &requests, &CheckUpgradeResponse{})
+	defer server.Close()
+
+	// disabled by default
+	f, uc := newUpgradeCheckerFixture(c, map[types.SettingName]string{
+		types.SettingNameUpgradeCheckerURL: server.URL,
+	})
+	c.Assert(uc.checkIfDue(), IsNil)
+	c.Assert(requests, HasLen, 0)
+	c.Assert(f.getLatestVersion(c), Equals, "")
+
+	// only the leader checks
+	f, uc = newUpgradeCheckerFixture(c, map[types.SettingName]string{
+		types.SettingNameUpgradeChecker:    "true",
+		types.SettingNameUpgradeCheckerURL: server.URL,
+	})
+	uc.isLeaderHandler = func() bool { return false }
+	c.Assert(uc.checkIfDue(), IsNil)
+	c.Assert(requests, HasLen, 0)
+}
+
+func (s *TestSuite) TestUpgradeCheckerUnreachable(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	f, uc := newUpgradeCheckerFixture(c, map[types.SettingName]string{
+		types.SettingNameUpgradeChecker:    "true",
+		types.SettingNameUpgradeCheckerURL: server.URL,
+	})
+	c.Assert(uc.checkIfDue(), NotNil)
+	c.Assert(f.getLatestVersion(c), Equals, "")
+
+	// the endpoint gone entirely fails without waiting for the timeout
+	server.Close()
+	uc.lastCheck = time.Time{}
+	start := time.Now()
+	c.Assert(uc.checkIfDue(), NotNil)
+	c.Assert(time.Since(start) < upgradeCheckerTimeout, Equals, true)
+}
@@ -3,6 +3,7 @@ package controller
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"time"
 
@@ -17,7 +18,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
 	clientset "k8s.io/client-go/kubernetes"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
@@ -26,6 +26,7 @@ import (
 	"k8s.io/kubernetes/pkg/controller"
 
 	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/scheduler"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
@@ -39,9 +40,11 @@ var (
 )
 
 const (
-	LabelRecurringJob = "RecurringJob"
-
 	CronJobBackoffLimit = 3
+	// CronJobStartingDeadlineSeconds skips the runs Kubernetes missed, e.g.
+	// while the CronJob was suspended, rather than starting them late. The
+	// volume controller records them and catches up if it's configured.
+	CronJobStartingDeadlineSeconds = 60
 )
 
 type VolumeController struct {
@@ -60,21 +63,27 @@ type VolumeController struct {
 	vStoreSynced cache.InformerSynced
 	eStoreSynced cache.InformerSynced
 	rStoreSynced cache.InformerSynced
+	nStoreSynced cache.InformerSynced
 
-	queue workqueue.RateLimitingInterface
+	queue  workqueue.RateLimitingInterface
+	health *queueHealth
+	logger logrus.FieldLogger
 
 	scheduler *scheduler.ReplicaScheduler
 
 	// for unit test
-	nowHandler func() string
+	nowHandler      func() string
+	isLeaderHandler IsLeaderHandler
 }
 
 func NewVolumeController(
 	ds *datastore.DataStore,
 	scheme *runtime.Scheme,
+	config ControllerConfig,
 	volumeInformer lhinformers.VolumeInformer,
 	engineInformer lhinformers.EngineInformer,
 	replicaInformer lhinformers.ReplicaInformer,
+	nodeInformer lhinformers.NodeInformer,
 	kubeClient clientset.Interface,
 	namespace, controllerID, serviceAccount string,
 	managerImage string) *VolumeController {
@@ -97,11 +106,15 @@ func NewVolumeController(
 		vStoreSynced: volumeInformer.Informer().HasSynced,
 		eStoreSynced: engineInformer.Informer().HasSynced,
 		rStoreSynced: replicaInformer.Informer().HasSynced,
+		nStoreSynced: nodeInformer.Informer().HasSynced,
 
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "longhorn-volume"),
+		queue:  config.newQueue("longhorn-volume"),
+		logger: newControllerLogger("longhorn-volume"),
 
-		nowHandler: util.Now,
+		nowHandler:      util.Now,
+		isLeaderHandler: alwaysLeader,
 	}
+	vc.health = newQueueHealth("longhorn-volume", vc.queue)
 
 	vc.scheduler = scheduler.NewReplicaScheduler(ds)
 
@@ -117,6 +130,8 @@ func NewVolumeController(
 		DeleteFunc: func(obj interface{}) {
 			v := obj.(*longhorn.Volume)
 			vc.enqueueVolume(v)
+			// the space used by the volume may be freed
+			vc.enqueueUnscheduledVolumes()
 		},
 	})
 	engineInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -139,8 +154,35 @@ func NewVolumeController(
 		},
 		DeleteFunc: func(obj interface{}) {
 			vc.enqueueControlleeChange(obj)
+			vc.enqueueUnscheduledVolumes()
 		},
 	})
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			vc.enqueueUnscheduledVolumes()
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			oldN := old.(*longhorn.Node)
+			curN := cur.(*longhorn.Node)
+			if isNodeSchedulingChanged(oldN, curN) {
+				vc.enqueueUnscheduledVolumes()
+			}
+			vc.enqueueEvictingVolumes(oldN, curN)
+			vc.enqueueVolumesOnUnhealthyDisks(oldN, curN)
+			if oldN.Spec.MaintenanceMode != curN.Spec.MaintenanceMode {
+				vc.enqueueVolumesAttachedToNode(curN.Name)
+			}
+		},
+	})
+
+	// the settings of the eviction, the rebuilding, and the recurring jobs
+	ds.OnSettingChange(vc.enqueueSettingChange,
+		types.SettingNameConcurrentDiskEvictionLimit,
+		types.SettingNameDiskHealthProbeReplicaRebuild,
+		types.SettingNameBackupTarget,
+		types.SettingNameTaintToleration,
+		types.SettingNameVolumeDeletionGracePeriod,
+		types.SettingNameRecurringJobCatchUpWindow)
 	return vc
 }
 
@@ -148,18 +190,14 @@ func (vc *VolumeController) Run(workers int, stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
 	defer vc.queue.ShutDown()
 
-	logrus.Infof("Start Longhorn volume controller")
-	defer logrus.Infof("Shutting down Longhorn volume controller")
+	vc.logger.Infof("Start Longhorn volume controller")
+	defer vc.logger.Infof("Shutting down Longhorn volume controller")
 
-	if !controller.WaitForCacheSync("longhorn engines", stopCh, vc.vStoreSynced, vc.eStoreSynced, vc.rStoreSynced) {
+	if !controller.WaitForCacheSync("longhorn engines", stopCh, vc.vStoreSynced, vc.eStoreSynced, vc.rStoreSynced, vc.nStoreSynced) {
 		return
 	}
 
-	for i := 0; i < workers; i++ {
-		go wait.Until(vc.worker, time.Second, stopCh)
-	}
-
-	<-stopCh
+	runWorkers(workers, vc.worker, vc.queue, stopCh)
 }
 
 func (vc *VolumeController) worker() {
@@ -174,6 +212,7 @@ func (vc *VolumeController) processNextWorkItem() bool {
 		return false
 	}
 	defer vc.queue.Done(key)
+	defer vc.health.processed()
 
 	err := vc.syncVolume(key.(string))
 	vc.handleErr(err, key)
@@ -188,13 +227,13 @@ func (vc *VolumeController) handleErr(err error, key interface{}) {
 	}
 
 	if vc.queue.NumRequeues(key) < maxRetries {
-		logrus.Warnf("Error syncing Longhorn volume %v: %v", key, err)
+		vc.logger.WithField("volume", key).Warnf("Error syncing Longhorn volume: %v", err)
 		vc.queue.AddRateLimited(key)
 		return
 	}
 
 	utilruntime.HandleError(err)
-	logrus.Warnf("Dropping Longhorn volume %v out of the queue: %v", key, err)
+	vc.logger.WithField("volume", key).Warnf("Dropping Longhorn volume out of the queue: %v", err)
 	vc.queue.Forget(key)
 }
 
@@ -214,12 +253,18 @@ func (vc *VolumeController) syncVolume(key string) (err error) {
 	volume, err := vc.ds.GetVolume(name)
 	if err != nil {
 		if datastore.ErrorIsNotFound(err) {
-			logrus.Infof("Longhorn volume %v has been deleted", key)
+			vc.logger.WithField("volume", key).Infof("Longhorn volume has been deleted")
 		}
 		return nil
 	}
 
 	if volume.Spec.OwnerID == "" {
+		// the volume not attached is cluster wide, claimed by the leader
+		// alone so the managers don't race for it. The attached volume is
+		// owned by the manager on its node.
+		if !vc.isLeaderHandler() {
+			return nil
+		}
 		// Claim it
 		volume.Spec.OwnerID = vc.controllerID
 		volume, err = vc.ds.UpdateVolume(volume)
@@ -230,7 +275,7 @@ func (vc *VolumeController) syncVolume(key string) (err error) {
 			}
 			return err
 		}
-		logrus.Debugf("Volume Controller %v picked up %v", vc.controllerID, volume.Name)
+		getLoggerForVolume(vc.logger, volume).Debugf("Volume Controller %v picked up the volume", vc.controllerID)
 	} else if volume.Spec.OwnerID != vc.controllerID {
 		// Not mines
 		return nil
@@ -247,8 +292,9 @@ func (vc *VolumeController) syncVolume(key string) (err error) {
 
 	if volume.DeletionTimestamp != nil {
 		if volume.Status.State != types.VolumeStateDeleting {
-			volume.Status.State = types.VolumeStateDeleting
-			volume, err = vc.ds.UpdateVolume(volume)
+			volume, err = vc.ds.UpdateVolumeStatusWithRetry(volume, func(v *longhorn.Volume) {
+				v.Status.State = types.VolumeStateDeleting
+			})
 			if err != nil {
 				return err
 			}
@@ -291,15 +337,33 @@ func (vc *VolumeController) syncVolume(key string) (err error) {
 		return vc.ds.RemoveFinalizerForVolume(volume)
 	}
 
+	if cleaned, err := vc.cleanupExpiredTrashedVolume(volume); err != nil || cleaned {
+		return err
+	}
+
 	existingVolume := volume.DeepCopy()
 	defer func() {
 		// we're going to update volume assume things changes
 		if err == nil && !reflect.DeepEqual(existingVolume, volume) {
-			_, err = vc.ds.UpdateVolume(volume)
+			// the spec is written by update and the status through the
+			// status subresource, so writing the status won't clobber the
+			// spec changed by others in the meantime
+			status := volume.Status
+			updated := volume
+			if isSpecOrMetaChanged(&existingVolume.ObjectMeta, &volume.ObjectMeta, existingVolume.Spec, volume.Spec) {
+				updated, err = vc.ds.UpdateVolume(volume)
+			}
+			if err == nil && !reflect.DeepEqual(existingVolume.Status, status) {
+				// the status is owned by the controller, so it can be
+				// applied on top of the changes by others
+				_, err = vc.ds.UpdateVolumeStatusWithRetry(updated, func(v *longhorn.Volume) {
+					v.Status = status
+				})
+			}
 		}
 		// requeue if it's conflict
 		if apierrors.IsConflict(errors.Cause(err)) {
-			logrus.Debugf("Requeue %v due to conflict", key)
+			getLoggerForVolume(vc.logger, volume).Debugf("Requeue volume due to conflict")
 			vc.enqueueVolume(volume)
 			err = nil
 		}
@@ -317,6 +381,13 @@ func (vc *VolumeController) syncVolume(key string) (err error) {
 		}
 	}
 
+	if err := vc.cleanupReplicasOnRemovedNodes(volume, replicas); err != nil {
+		return err
+	}
+	if err := vc.failReplicasOnUnhealthyDisks(volume, replicas); err != nil {
+		return err
+	}
+
 	if len(engines) <= 1 {
 		if err := vc.ReconcileEngineReplicaState(volume, engine, replicas); err != nil {
 			return err
@@ -331,6 +402,12 @@ func (vc *VolumeController) syncVolume(key string) (err error) {
 		return err
 	}
 
+	if len(engines) <= 1 {
+		if err := vc.evictReplicas(volume, engine, replicas); err != nil {
+			return err
+		}
+	}
+
 	if len(engines) <= 1 {
 		if err := vc.updateRecurringJobs(volume); err != nil {
 			return err
@@ -389,8 +466,7 @@ func (vc *VolumeController) ReconcileEngineReplicaState(v *longhorn.Volume, e *l
 		r := rs[rName]
 		if mode == types.ReplicaModeERR {
 			if r != nil {
-				r.Spec.FailedAt = vc.nowHandler()
-				r, err = vc.ds.UpdateReplica(r)
+				r, err = vc.markReplicaFailed(v, r, vc.getReplicaFailureReason(r))
 				if err != nil {
 					return err
 				}
@@ -462,9 +538,8 @@ func (vc *VolumeController) cleanupCorruptedOrStaleReplicas(v *longhorn.Volume,
 				continue
 			} else if r.Spec.EngineImage != v.Spec.EngineImage {
 				// r.Spec.Active shouldn't be set for the leftover replicas, something must wrong
-				logrus.Errorf("BUG: replica %v engine image %v is different from volume %v engine image %v, "+
-					"but replica spec.Active has been set",
-					r.Name, r.Spec.EngineImage, v.Name, v.Spec.EngineImage)
+				getLoggerForReplica(vc.logger, r).Errorf("BUG: replica engine image is different from volume engine image %v, "+
+					"but replica spec.Active has been set", v.Spec.EngineImage)
 			}
 		}
 
@@ -484,9 +559,9 @@ func (vc *VolumeController) cleanupCorruptedOrStaleReplicas(v *longhorn.Volume,
 		// 1. failed before ever became healthy (RW), mostly failed during rebuilding
 		// 2. failed too long ago, became stale and unnecessary to keep
 		// around, unless we don't any healthy replicas
-		if r.Spec.HealthyAt == "" || (hasHealthyReplicas && staled) {
+		if isReplicaRebuildFailed(r) || (hasHealthyReplicas && staled) {
 
-			logrus.Infof("Cleaning up corrupted or staled replica %v", r.Name)
+			getLoggerForReplica(vc.logger, r).Infof("Cleaning up corrupted or staled replica")
 			if err := vc.ds.DeleteReplica(r.Name); err != nil {
 				return errors.Wrap(err, "cannot cleanup stale replicas")
 			}
@@ -496,6 +571,248 @@ func (vc *VolumeController) cleanupCorruptedOrStaleReplicas(v *longhorn.Volume,
 	return nil
 }
 
+// markReplicaFailed records when, why and where the replica failed
+func (vc *VolumeController) markReplicaFailed(v *longhorn.Volume, r *longhorn.Replica, reason types.ReplicaFailureReason) (*longhorn.Replica, error) {
+	r.Spec.FailedAt = vc.nowHandler()
+	r, err := vc.ds.UpdateReplica(r)
+	if err != nil {
+		return nil, err
+	}
+	r, err = vc.ds.UpdateReplicaStatusWithRetry(r, func(r *longhorn.Replica) {
+		r.Status.FailedAt = r.Spec.FailedAt
+		r.Status.FailureReason = reason
+		r.Status.FailedNodeID = r.Spec.NodeID
+		r.Status.FailedDiskID = r.Spec.DiskID
+	})
+	if err != nil {
+		return nil, err
+	}
+	vc.eventRecorder.Eventf(v, v1.EventTypeWarning, EventReasonFaulted,
+		"replica %v of volume %v failed at %v due to %v, on node %v disk %v",
+		r.Name, v.Name, r.Status.FailedAt, reason, r.Status.FailedNodeID, r.Status.FailedDiskID)
+	return r, nil
+}
+
+// cleanupReplicasOnRemovedNodes fails the replicas on the nodes removed from
+// the Kubernetes cluster so the rebuilding can start, and deletes them once the
+// Longhorn node is being deleted
+func (vc *VolumeController) cleanupReplicasOnRemovedNodes(v *longhorn.Volume, rs map[string]*longhorn.Replica) error {
+	for _, r := range rs {
+		if r.DeletionTimestamp != nil {
+			continue
+		}
+		removed, err := vc.ds.IsNodeRemoved(r.Spec.NodeID)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			continue
+		}
+		if r.Spec.FailedAt == "" {
+			r, err = vc.markReplicaFailed(v, r, types.ReplicaFailureReasonNodeRemoved)
+			if err != nil {
+				return err
+			}
+			rs[r.Name] = r
+			continue
+		}
+		node, err := vc.ds.GetNodeRO(r.Spec.NodeID)
+		if err != nil {
+			return err
+		}
+		if node.DeletionTimestamp == nil {
+			continue
+		}
+		getLoggerForReplica(vc.logger, r).Infof("Cleaning up replica on node being deleted")
+		if err := vc.ds.DeleteReplica(r.Name); err != nil {
+			return err
+		}
+		delete(rs, r.Name)
+	}
+	return nil
+}
+
+// failReplicasOnUnhealthyDisks fails the replicas on the disks failing the
+// health probe so they would be rebuilt on the other disks, if the setting
+// disk-health-probe-replica-rebuild is enabled. The replicas are only failed
+// while the volume has another healthy replica.
+func (vc *VolumeController) failReplicasOnUnhealthyDisks(v *longhorn.Volume, rs map[string]*longhorn.Replica) error {
+	rebuild, err := vc.ds.GetSettingAsBool(types.SettingNameDiskHealthProbeReplicaRebuild)
+	if err != nil {
+		return err
+	}
+	if !rebuild {
+		return nil
+	}
+
+	unhealthyReplicas := []*longhorn.Replica{}
+	healthyCount := 0
+	for _, r := range rs {
+		if r.DeletionTimestamp != nil || r.Spec.FailedAt != "" || r.Spec.NodeID == "" {
+			continue
+		}
+		node, err := vc.ds.GetNodeRO(r.Spec.NodeID)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		diskStatus := node.Status.DiskStatus[r.Spec.DiskID]
+		readyCondition := types.GetDiskConditionFromStatus(diskStatus, types.DiskConditionTypeReady)
+		if readyCondition.Reason == types.DiskConditionReasonDiskHealthProbeFailed {
+			unhealthyReplicas = append(unhealthyReplicas, r)
+		} else if r.Spec.HealthyAt != "" {
+			healthyCount++
+		}
+	}
+	if len(unhealthyReplicas) == 0 {
+		return nil
+	}
+	if healthyCount == 0 {
+		getLoggerForVolume(vc.logger, v).Warnf("Cannot rebuild the replicas on the unhealthy disks: no other healthy replica")
+		return nil
+	}
+	for _, r := range unhealthyReplicas {
+		r, err = vc.markReplicaFailed(v, r, types.ReplicaFailureReasonDiskUnhealthy)
+		if err != nil {
+			return err
+		}
+		rs[r.Name] = r
+	}
+	return nil
+}
+
+// detachForNodeMaintenance detaches the volume from the node in the
+// maintenance mode, so it can be attached to another node. The volume stays
+// if it has no healthy replica accessible on the other nodes.
+func (vc *VolumeController) detachForNodeMaintenance(v *longhorn.Volume) error {
+	if v.Spec.NodeID == "" || v.Spec.MigrationNodeID != "" {
+		return nil
+	}
+	node, err := vc.ds.GetNodeRO(v.Spec.NodeID)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !node.Spec.MaintenanceMode {
+		return nil
+	}
+	ok, err := vc.ds.HasHealthyReplicaOnOtherNodes(v.Name, node.Name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		getLoggerForVolume(vc.logger, v).Warnf("Cannot detach volume from node in maintenance mode: no healthy replica on the other nodes")
+		return nil
+	}
+	vc.eventRecorder.Eventf(v, v1.EventTypeNormal, EventReasonMaintenance,
+		"Detach volume %v from node %v in maintenance mode", v.Name, node.Name)
+	v.Spec.NodeID = ""
+	if v.Spec.PendingNodeID == node.Name {
+		v.Spec.PendingNodeID = ""
+	}
+	return nil
+}
+
+// unscheduleReplicasOnRemovedDisks clears the scheduling result of the
+// replicas which have never been healthy but whose disks have been removed,
+// so the disk selection would run again for them. The replicas have to be
+// stopped first, the ones still stopping are returned.
+func (vc *VolumeController) unscheduleReplicasOnRemovedDisks(v *longhorn.Volume, rs map[string]*longhorn.Replica) (map[string]struct{}, error) {
+	stoppingReplicas := map[string]struct{}{}
+	for _, r := range rs {
+		if r.Spec.NodeID == "" || r.Spec.HealthyAt != "" || r.Spec.FailedAt != "" || r.DeletionTimestamp != nil {
+			continue
+		}
+		node, err := vc.ds.GetNodeRO(r.Spec.NodeID)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if _, exists := node.Spec.Disks[r.Spec.DiskID]; exists {
+			continue
+		}
+		if r.Spec.DesireState != types.InstanceStateStopped {
+			r.Spec.DesireState = types.InstanceStateStopped
+			r, err = vc.ds.UpdateReplica(r)
+			if err != nil {
+				return nil, err
+			}
+			rs[r.Name] = r
+		}
+		if r.Status.CurrentState != types.InstanceStateStopped {
+			stoppingReplicas[r.Name] = struct{}{}
+			continue
+		}
+		getLoggerForReplica(vc.logger, r).Infof("Disk of replica has been removed, reschedule the replica")
+		r.Spec.NodeID = ""
+		r.Spec.DiskID = ""
+		r.Spec.DiskUUID = ""
+		r.Spec.DataPath = ""
+		r, err = vc.ds.UpdateReplica(r)
+		if err != nil {
+			return nil, err
+		}
+		r, err = vc.ds.UpdateReplicaStatusWithRetry(r, func(r *longhorn.Replica) {
+			r.Status.Zone = ""
+			r.Status.SchedulingDecision = ""
+		})
+		if err != nil {
+			return nil, err
+		}
+		rs[r.Name] = r
+	}
+	return stoppingReplicas, nil
+}
+
+// getReplicaFailureReason decides why the engine has marked the replica as ERR
+func (vc *VolumeController) getReplicaFailureReason(r *longhorn.Replica) types.ReplicaFailureReason {
+	// there is no complete data on the replica anyway
+	if r.Spec.HealthyAt == "" {
+		return types.ReplicaFailureReasonRebuildFailed
+	}
+	if r.Spec.NodeID != "" {
+		node, err := vc.ds.GetNodeRO(r.Spec.NodeID)
+		if err != nil {
+			getLoggerForReplica(vc.logger, r).Warnf("Cannot get node to decide failure reason of replica: %v", err)
+		} else {
+			readyCondition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
+			if readyCondition.Reason == types.NodeConditionReasonKubernetesNodeDown {
+				return types.ReplicaFailureReasonNodeRemoved
+			}
+			if readyCondition.Status != types.ConditionStatusTrue {
+				return types.ReplicaFailureReasonNodeDown
+			}
+			if _, exists := node.Spec.Disks[r.Spec.DiskID]; !exists {
+				return types.ReplicaFailureReasonDiskUnschedulable
+			}
+			diskStatus := node.Status.DiskStatus[r.Spec.DiskID]
+			if types.GetDiskConditionFromStatus(diskStatus, types.DiskConditionTypeReady).Status == types.ConditionStatusFalse {
+				return types.ReplicaFailureReasonDiskUnschedulable
+			}
+		}
+	}
+	if r.Status.CurrentState == types.InstanceStateError {
+		return types.ReplicaFailureReasonCrashLoop
+	}
+	return types.ReplicaFailureReasonEngineMarkedERR
+}
+
+// isReplicaRebuildFailed returns true if the replica failed before it ever
+// became healthy (RW)
+func isReplicaRebuildFailed(r *longhorn.Replica) bool {
+	if r.Status.FailureReason != "" {
+		return r.Status.FailureReason == types.ReplicaFailureReasonRebuildFailed
+	}
+	// replicas failed before the failure reason was recorded
+	return r.Spec.HealthyAt == ""
+}
+
 // ReconcileVolumeState handles the attaching and detaching of volume
 func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn.Engine, rs map[string]*longhorn.Replica) (err error) {
 	defer func() {
@@ -539,29 +856,56 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 		if e.Status.NodeBootID != "" && e.Status.NodeBootID != node.Status.NodeInfo.BootID {
 			v.Spec.PendingNodeID = v.Spec.NodeID
 			msg := fmt.Sprintf("Reboot of volume %v attached node %v detected, reattach the volume", v.Name, v.Spec.NodeID)
-			logrus.Errorf(msg)
+			getLoggerForVolume(vc.logger, v).Error(msg)
 			vc.eventRecorder.Event(v, v1.EventTypeWarning, EventReasonRebooted, msg)
 		} else {
 			// Engine dead unexpected, force detaching the volume
 			msg := fmt.Sprintf("Engine of volume %v dead unexpectedly, detach the volume", v.Name)
-			logrus.Errorf(msg)
-			vc.eventRecorder.Eventf(v, v1.EventTypeWarning, EventReasonFaulted, msg)
+			getLoggerForVolume(vc.logger, v).Error(msg)
+			vc.eventRecorder.Event(v, v1.EventTypeWarning, EventReasonFaulted, msg)
 		}
 		v.Spec.NodeID = ""
+		v.Status.RemountRequestedAt = vc.nowHandler()
+	}
+
+	if err := vc.detachForNodeMaintenance(v); err != nil {
+		return err
 	}
 
+	reschedulingReplicas, err := vc.unscheduleReplicasOnRemovedDisks(v, rs)
+	if err != nil {
+		return err
+	}
+
+	// the replica being evicted is going away, it shouldn't keep its
+	// replacement off the node or the zone
+	schedulingReplicas := rs
+	if v.Status.EvictingReplica != "" {
+		schedulingReplicas = map[string]*longhorn.Replica{}
+		for name, r := range rs {
+			if name != v.Status.EvictingReplica {
+				schedulingReplicas[name] = r
+			}
+		}
+	}
 	allScheduled := true
 	for _, r := range rs {
 		// check whether the replica need to be scheduled
 		if r.Spec.NodeID != "" {
 			continue
 		}
-		scheduledReplica, err := vc.scheduler.ScheduleReplica(r, rs)
+		if v.Spec.TrashedAt != "" {
+			// no more space is taken by the volume in the trash, the
+			// replica is scheduled once the volume is restored
+			allScheduled = false
+			break
+		}
+		scheduledReplica, failure, err := vc.scheduler.ScheduleReplica(r, schedulingReplicas, v)
 		if err != nil {
 			return err
 		}
 		if scheduledReplica == nil {
-			logrus.Errorf("unable to schedule replica %v of volume %v", r.Name, v.Name)
+			getLoggerForReplica(vc.logger, r).Errorf("unable to schedule replica")
 			condition := types.GetVolumeConditionFromStatus(v.Status, types.VolumeConditionTypeScheduled)
 			if condition.Status != types.ConditionStatusFalse {
 				condition.Status = types.ConditionStatusFalse
@@ -569,17 +913,41 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 			}
 			//condition.LastProbeTime = util.Now()
 			condition.Reason = types.VolumeConditionReasonReplicaSchedulingFailure
+			msg := failure.Message()
+			if msg != condition.Message {
+				if r.Name == v.Status.ReplacementReplica {
+					vc.eventRecorder.Eventf(v, v1.EventTypeWarning, EventReasonFailedEvicting,
+						"eviction of replica %v of volume %v paused: unable to schedule the replacement replica %v: %v", v.Status.EvictingReplica, v.Name, r.Name, msg)
+				} else {
+					vc.eventRecorder.Eventf(v, v1.EventTypeWarning, EventReasonFailedScheduling,
+						"unable to schedule replica %v of volume %v: %v", r.Name, v.Name, msg)
+				}
+			}
+			condition.Message = msg
 			v.Status.Conditions[types.VolumeConditionTypeScheduled] = condition
 			allScheduled = false
 			// no need to continue, since we won't able to schedule
 			// more replicas if we failed this one
 			break
 		} else {
+			// the scheduler decides both the location in the spec and the
+			// zone in the status
+			zone, decision := scheduledReplica.Status.Zone, scheduledReplica.Status.SchedulingDecision
 			scheduledReplica, err = vc.ds.UpdateReplica(scheduledReplica)
 			if err != nil {
 				return err
 			}
+			scheduledReplica, err = vc.ds.UpdateReplicaStatusWithRetry(scheduledReplica, func(r *longhorn.Replica) {
+				r.Status.Zone = zone
+				r.Status.SchedulingDecision = decision
+			})
+			if err != nil {
+				return err
+			}
 			rs[r.Name] = scheduledReplica
+			vc.eventRecorder.Eventf(v, v1.EventTypeNormal, EventReasonScheduled,
+				"replica %v of volume %v has been scheduled to disk %v on node %v: %v",
+				r.Name, v.Name, scheduledReplica.Spec.DiskID, scheduledReplica.Spec.NodeID, scheduledReplica.Status.SchedulingDecision)
 		}
 	}
 	if allScheduled {
@@ -594,8 +962,22 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 		v.Status.Conditions[types.VolumeConditionTypeScheduled] = condition
 	}
 
+	if v.Spec.TrashedAt != "" {
+		// the volume in the trash stays detached until restored
+		v.Spec.NodeID = ""
+		v.Spec.PendingNodeID = ""
+	}
+
+	v.Status.CurrentQoS = e.Status.CurrentQoS
+	vc.syncQoSCondition(v)
+
 	oldState := v.Status.State
 	if v.Spec.NodeID == "" {
+		// the read-only attachment is gone with the engine, unless the
+		// volume is going to be reattached after the reboot
+		if v.Spec.PendingNodeID == "" {
+			v.Spec.ReadOnlyNodeIDs = nil
+		}
 		// the final state will be determined at the end of the clause
 		if newVolume {
 			v.Status.State = types.VolumeStateCreating
@@ -618,8 +1000,7 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 		if dataExists {
 			for _, r := range rs {
 				if r.Spec.HealthyAt == "" && r.Spec.FailedAt == "" {
-					r.Spec.FailedAt = vc.nowHandler()
-					r, err = vc.ds.UpdateReplica(r)
+					r, err = vc.markReplicaFailed(v, r, types.ReplicaFailureReasonRebuildFailed)
 					if err != nil {
 						return err
 					}
@@ -657,20 +1038,33 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 			return nil
 		}
 
+		if v.Spec.TrashedAt != "" {
+			v.Status.State = types.VolumeStateTrashed
+			if oldState != v.Status.State {
+				vc.eventRecorder.Eventf(v, v1.EventTypeNormal, EventReasonTrashed, "volume %v has been detached and kept in the trash since %v", v.Name, v.Spec.TrashedAt)
+			}
+			return nil
+		}
 		v.Status.State = types.VolumeStateDetached
-		if oldState != v.Status.State {
+		if oldState != v.Status.State && oldState != types.VolumeStateTrashed {
 			vc.eventRecorder.Eventf(v, v1.EventTypeNormal, EventReasonDetached, "volume %v has been detached", v.Name)
 		}
 		// Automatic reattach the volume if PendingNodeID was set, it's for reboot
 		if v.Spec.PendingNodeID != "" {
-			v.Spec.NodeID = v.Spec.PendingNodeID
+			// the node wasn't requested by the user this time
+			if err := vc.scheduler.CheckEngineNode(v.Spec.PendingNodeID, false); err != nil {
+				vc.eventRecorder.Eventf(v, v1.EventTypeWarning, EventReasonFailedAttaching,
+					"Cancel reattaching volume %v to node %v: %v", v.Name, v.Spec.PendingNodeID, err)
+			} else {
+				v.Spec.NodeID = v.Spec.PendingNodeID
+			}
 			v.Spec.PendingNodeID = ""
 		}
 
 	} else {
 		// wait for offline engine upgrade to finish
 		if v.Status.State == types.VolumeStateDetached && v.Status.CurrentImage != v.Spec.EngineImage {
-			logrus.Debugf("Wait for offline upgrade of volume %v to finish", v.Name)
+			getLoggerForVolume(vc.logger, v).Debugf("Wait for offline upgrade of volume to finish")
 			return nil
 		}
 		// if engine was running, then we are attached already
@@ -682,6 +1076,10 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 
 		replicaUpdated := false
 		for _, r := range rs {
+			// wait for the disk selection to run again
+			if _, ok := reschedulingReplicas[r.Name]; ok {
+				continue
+			}
 			if r.Spec.FailedAt == "" &&
 				r.Spec.DesireState != types.InstanceStateRunning &&
 				r.Spec.EngineImage == v.Status.CurrentImage {
@@ -715,10 +1113,10 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 				return nil
 			}
 			if r.Status.IP == "" {
-				logrus.Errorf("BUG: replica %v is running but IP is empty", r.Name)
+				getLoggerForReplica(vc.logger, r).Errorf("BUG: replica is running but IP is empty")
 				continue
 			}
-			replicaAddressMap[r.Name] = r.Status.IP
+			replicaAddressMap[r.Name] = engineapi.GetReplicaAddress(r.Status.IP, r.Status.Port)
 		}
 
 		engineUpdated := false
@@ -728,6 +1126,10 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 					e.Spec.NodeID, v.Spec.NodeID)
 			}
 			e.Spec.NodeID = v.Spec.NodeID
+			e.Spec.DisableFrontend = v.Spec.DisableFrontend
+			// the engine of the volume attached read-only never takes
+			// writes, the read-write attachment waits for it to detach
+			e.Spec.FrontendReadOnly = len(v.Spec.ReadOnlyNodeIDs) != 0
 			e.Spec.ReplicaAddressMap = replicaAddressMap
 			e.Spec.DesireState = types.InstanceStateRunning
 			engineUpdated = true
@@ -738,6 +1140,11 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 				engineUpdated = true
 			}
 		}
+		// the limits are applied to the running engine
+		if e.Spec.QoS != v.Spec.QoS {
+			e.Spec.QoS = v.Spec.QoS
+			engineUpdated = true
+		}
 		if engineUpdated {
 			e, err = vc.ds.UpdateEngine(e)
 			if err != nil {
@@ -757,6 +1164,174 @@ func (vc *VolumeController) ReconcileVolumeState(v *longhorn.Volume, e *longhorn
 	return nil
 }
 
+// cleanupExpiredTrashedVolume deletes the volume kept in the trash for the
+// volume deletion grace period. The volume is deleted as usual from then on.
+func (vc *VolumeController) cleanupExpiredTrashedVolume(v *longhorn.Volume) (cleaned bool, err error) {
+	if v.Spec.TrashedAt == "" {
+		return false, nil
+	}
+	gracePeriod, err := vc.ds.GetSettingAsInt(types.SettingNameVolumeDeletionGracePeriod)
+	if err != nil {
+		return false, err
+	}
+	if !util.TimestampAfterTimeout(v.Spec.TrashedAt, time.Duration(gracePeriod)*time.Minute) {
+		return false, nil
+	}
+
+	getLoggerForVolume(vc.logger, v).Infof("Volume has been in the trash since %v, clean it up", v.Spec.TrashedAt)
+	if err := vc.ds.DeleteVolume(v.Name); err != nil && !datastore.ErrorIsNotFound(err) {
+		return false, err
+	}
+	vc.eventRecorder.Eventf(v, v1.EventTypeNormal, EventReasonDelete, "Cleaned up volume %v in the trash since %v", v.Name, v.Spec.TrashedAt)
+	return true, nil
+}
+
+// evictReplicas moves the replicas off the disks requested eviction, one
+// replica at a time. A replacement replica is rebuilt on another disk first,
+// then the original one is removed, so the volume never loses redundancy.
+// The eviction only starts when the volume is attached and healthy, since
+// the rebuilding needs the engine running. The node controller reports the
+// eviction of the disk blocked by the detached volumes.
+func (vc *VolumeController) evictReplicas(v *longhorn.Volume, e *longhorn.Engine, rs map[string]*longhorn.Replica) error {
+	if e == nil || vc.isVolumeUpgrading(v) || vc.isVolumeMigrating(v) {
+		return nil
+	}
+	if v.Status.EvictingReplica != "" {
+		return vc.processReplicaEviction(v, rs)
+	}
+	if v.Status.State != types.VolumeStateAttached || v.Status.Robustness != types.VolumeRobustnessHealthy {
+		return nil
+	}
+
+	names := []string{}
+	for name := range rs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var evictingReplica *longhorn.Replica
+	for _, name := range names {
+		r := rs[name]
+		if r.Spec.NodeID == "" || r.Spec.FailedAt != "" || r.DeletionTimestamp != nil {
+			continue
+		}
+		requested, err := vc.isReplicaEvictionRequested(r)
+		if err != nil {
+			return err
+		}
+		if requested {
+			evictingReplica = r
+			break
+		}
+	}
+	if evictingReplica == nil {
+		return nil
+	}
+
+	limit, err := vc.ds.GetSettingAsInt(types.SettingNameConcurrentDiskEvictionLimit)
+	if err != nil {
+		return err
+	}
+	volumes, err := vc.ds.ListEvictingVolumesRO()
+	if err != nil {
+		return err
+	}
+	evictingCount := int64(0)
+	for _, volume := range volumes {
+		if volume.Name != v.Name && volume.Status.EvictingReplica != "" {
+			evictingCount++
+		}
+	}
+	if evictingCount >= limit {
+		getLoggerForVolume(vc.logger, v).Debugf("Volume waits for the other %v volumes to finish evicting replicas", evictingCount)
+		return nil
+	}
+
+	replacement, err := vc.createReplica(v, e, rs)
+	if err != nil {
+		return err
+	}
+	rs[replacement.Name] = replacement
+	v.Status.EvictingReplica = evictingReplica.Name
+	v.Status.ReplacementReplica = replacement.Name
+	vc.eventRecorder.Eventf(v, v1.EventTypeNormal, EventReasonEvicting,
+		"start moving replica %v of volume %v off disk %v on node %v",
+		evictingReplica.Name, v.Name, evictingReplica.Spec.DiskID, evictingReplica.Spec.NodeID)
+	return nil
+}
+
+// processReplicaEviction removes the evicting replica once its replacement
+// became healthy. The replacement still rebuilding is removed if the eviction
+// is no longer requested.
+func (vc *VolumeController) processReplicaEviction(v *longhorn.Volume, rs map[string]*longhorn.Replica) error {
+	r := rs[v.Status.EvictingReplica]
+	replacement := rs[v.Status.ReplacementReplica]
+	if r == nil || r.Spec.FailedAt != "" || r.DeletionTimestamp != nil {
+		// nothing left to move, the replacement would take the place of
+		// the replica anyway
+		v.Status.EvictingReplica = ""
+		v.Status.ReplacementReplica = ""
+		return nil
+	}
+
+	requested, err := vc.isReplicaEvictionRequested(r)
+	if err != nil {
+		return err
+	}
+	if !requested {
+		if replacement != nil && replacement.Spec.HealthyAt == "" && replacement.DeletionTimestamp == nil {
+			if err := vc.ds.DeleteReplica(replacement.Name); err != nil {
+				return err
+			}
+			delete(rs, replacement.Name)
+		}
+		vc.eventRecorder.Eventf(v, v1.EventTypeNormal, EventReasonEvicting,
+			"stop moving replica %v of volume %v since the eviction of disk %v on node %v has been canceled",
+			r.Name, v.Name, r.Spec.DiskID, r.Spec.NodeID)
+		v.Status.EvictingReplica = ""
+		v.Status.ReplacementReplica = ""
+		return nil
+	}
+
+	if replacement == nil || replacement.Spec.FailedAt != "" {
+		// the failed replacement would be cleaned up, and another one
+		// would be created by the next sync
+		vc.eventRecorder.Eventf(v, v1.EventTypeWarning, EventReasonFailedEvicting,
+			"failed to rebuild replacement replica %v for replica %v of volume %v, will retry",
+			v.Status.ReplacementReplica, r.Name, v.Name)
+		v.Status.EvictingReplica = ""
+		v.Status.ReplacementReplica = ""
+		return nil
+	}
+	// wait for the replacement to be scheduled and rebuilt
+	if replacement.Spec.HealthyAt == "" {
+		return nil
+	}
+
+	if err := vc.ds.DeleteReplica(r.Name); err != nil {
+		return err
+	}
+	delete(rs, r.Name)
+	vc.eventRecorder.Eventf(v, v1.EventTypeNormal, EventReasonEvicted,
+		"replica %v of volume %v has been moved off disk %v on node %v, replaced by replica %v on disk %v on node %v",
+		r.Name, v.Name, r.Spec.DiskID, r.Spec.NodeID, replacement.Name, replacement.Spec.DiskID, replacement.Spec.NodeID)
+	v.Status.EvictingReplica = ""
+	v.Status.ReplacementReplica = ""
+	return nil
+}
+
+// isReplicaEvictionRequested returns true if the eviction has been requested
+// for the disk or the node of the replica
+func (vc *VolumeController) isReplicaEvictionRequested(r *longhorn.Replica) (bool, error) {
+	node, err := vc.ds.GetNodeRO(r.Spec.NodeID)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return node.Spec.EvictionRequested || node.Spec.Disks[r.Spec.DiskID].EvictionRequested, nil
+}
+
 // replenishReplicas will keep replicas count to v.Spec.NumberOfReplicas
 // It will count all the potentially usable replicas, since some replicas maybe
 // blank or in rebuilding state
@@ -793,6 +1368,7 @@ func (vc *VolumeController) getReplenishReplicasCount(v *longhorn.Volume, rs map
 
 func (vc *VolumeController) upgradeEngineForVolume(v *longhorn.Volume, e *longhorn.Engine, rs map[string]*longhorn.Replica) error {
 	var err error
+	log := getLoggerForVolume(vc.logger, v).WithField("upgrade", "live")
 
 	if !vc.isVolumeUpgrading(v) {
 		// it must be a rollback
@@ -838,31 +1414,36 @@ func (vc *VolumeController) upgradeEngineForVolume(v *longhorn.Volume, e *longho
 
 	oldImage, err := vc.getEngineImage(v.Status.CurrentImage)
 	if err != nil {
-		logrus.Warnf("live upgrade: cannot get engine image %v: %v", v.Status.CurrentImage, err)
+		log.Warnf("Cannot get engine image %v: %v", v.Status.CurrentImage, err)
 		return nil
 	}
-	if oldImage.Status.State != types.EngineImageStateReady {
-		logrus.Warnf("live upgrade: volume %v engine upgrade from %v requests, but the image wasn't ready", v.Name, oldImage.Spec.Image)
+	if err := vc.ds.CheckEngineImageReadiness(oldImage.Spec.Image, e.Spec.NodeID); err != nil {
+		log.Warnf("Engine upgrade from %v requests, but the image wasn't ready: %v", oldImage.Spec.Image, err)
 		return nil
 	}
 	newImage, err := vc.getEngineImage(v.Spec.EngineImage)
 	if err != nil {
-		logrus.Warnf("live upgrade: cannot get engine image %v: %v", v.Spec.EngineImage, err)
+		log.Warnf("Cannot get engine image %v: %v", v.Spec.EngineImage, err)
 		return nil
 	}
-	if newImage.Status.State != types.EngineImageStateReady {
-		logrus.Warnf("live upgrade: volume %v engine upgrade from %v requests, but the image wasn't ready", v.Name, newImage.Spec.Image)
+	// the new replicas are started next to the old ones
+	nodeIDs := []string{e.Spec.NodeID}
+	for _, r := range rs {
+		nodeIDs = append(nodeIDs, r.Spec.NodeID)
+	}
+	if err := vc.ds.CheckEngineImageReadiness(newImage.Spec.Image, nodeIDs...); err != nil {
+		log.Warnf("Engine upgrade to %v requests, but the image wasn't ready: %v", newImage.Spec.Image, err)
 		return nil
 	}
 
 	if oldImage.Status.GitCommit == newImage.Status.GitCommit {
-		logrus.Infof("live upgrade: Engine image %v and %v are identical, delay upgrade until detach for %v", oldImage.Spec.Image, newImage.Spec.Image, v.Name)
+		log.Infof("Engine image %v and %v are identical, delay upgrade until detach", oldImage.Spec.Image, newImage.Spec.Image)
 		return nil
 	}
 
 	if oldImage.Status.ControllerAPIVersion > newImage.Status.ControllerAPIVersion ||
 		oldImage.Status.ControllerAPIVersion < newImage.Status.ControllerAPIMinVersion {
-		logrus.Warnf("live upgrade: unable to live upgrade from %v to %v: the old controller version %v "+
+		log.Warnf("Unable to live upgrade from %v to %v: the old controller version %v "+
 			"is not compatible with the new controller version %v and the new controller minimal version %v",
 			oldImage.Spec.Image, newImage.Spec.Image,
 			oldImage.Status.ControllerAPIVersion, newImage.Status.ControllerAPIVersion, newImage.Status.ControllerAPIMinVersion)
@@ -878,8 +1459,7 @@ func (vc *VolumeController) upgradeEngineForVolume(v *longhorn.Volume, e *longho
 		} else if r.Spec.EngineImage == v.Spec.EngineImage {
 			dataPathToNewReplica[r.Spec.DataPath] = r
 		} else {
-			logrus.Warnf("live upgrade: found unknown replica with image %v of volume %v",
-				r.Spec.EngineImage, v.Name)
+			log.WithField("replica", r.Name).Warnf("Found unknown replica with image %v", r.Spec.EngineImage)
 			unknownReplicas[r.Name] = r
 		}
 	}
@@ -898,10 +1478,10 @@ func (vc *VolumeController) upgradeEngineForVolume(v *longhorn.Volume, e *longho
 				return nil
 			}
 			if r.Status.IP == "" {
-				logrus.Errorf("BUG: replica %v is running but IP is empty", r.Name)
+				log.WithField("replica", r.Name).Errorf("BUG: replica is running but IP is empty")
 				continue
 			}
-			replicaAddressMap[r.Name] = r.Status.IP
+			replicaAddressMap[r.Name] = engineapi.GetReplicaAddress(r.Status.IP, r.Status.Port)
 		}
 		e.Spec.UpgradedReplicaAddressMap = replicaAddressMap
 		e.Spec.EngineImage = v.Spec.EngineImage
@@ -922,7 +1502,7 @@ func (vc *VolumeController) upgradeEngineForVolume(v *longhorn.Volume, e *longho
 	}
 
 	// cleanupCorruptedOrStaleReplicas() will take care of old replicas
-	logrus.Infof("Engine %v of volume %s has been upgraded from %v to %v", e.Name, v.Name, v.Status.CurrentImage, v.Spec.EngineImage)
+	log.WithField("engine", e.Name).Infof("Engine has been upgraded from %v to %v", v.Status.CurrentImage, v.Spec.EngineImage)
 	v.Status.CurrentImage = v.Spec.EngineImage
 
 	return nil
@@ -932,7 +1512,7 @@ func (vc *VolumeController) createEngine(v *longhorn.Volume) (*longhorn.Engine,
 	engine := &longhorn.Engine{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            types.GenerateEngineNameForVolume(v.Name),
-			OwnerReferences: vc.getOwnerReferencesForVolume(v),
+			OwnerReferences: getOwnerReferencesForVolume(v),
 		},
 		Spec: types.EngineSpec{
 			InstanceSpec: types.InstanceSpec{
@@ -955,7 +1535,7 @@ func (vc *VolumeController) createReplica(v *longhorn.Volume, e *longhorn.Engine
 	replica := &longhorn.Replica{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            types.GenerateReplicaNameForVolume(v.Name),
-			OwnerReferences: vc.getOwnerReferencesForVolume(v),
+			OwnerReferences: getOwnerReferencesForVolume(v),
 		},
 		Spec: types.ReplicaSpec{
 			InstanceSpec: types.InstanceSpec{
@@ -977,6 +1557,10 @@ func (vc *VolumeController) createReplica(v *longhorn.Volume, e *longhorn.Engine
 		}
 		replica.Spec.RestoreFrom = v.Spec.FromBackup
 		replica.Spec.RestoreName = backupID
+		replica.Spec.RestoreCredentialSecret, err = vc.ds.ResolveBackupTargetCredentialSecret(v.Spec.BackupTargetCredentialSecret)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return vc.ds.CreateReplica(replica)
@@ -986,7 +1570,7 @@ func (vc *VolumeController) duplicateReplica(r *longhorn.Replica, v *longhorn.Vo
 	replica := &longhorn.Replica{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            types.GenerateReplicaNameForVolume(r.Spec.VolumeName),
-			OwnerReferences: vc.getOwnerReferencesForVolume(v),
+			OwnerReferences: getOwnerReferencesForVolume(v),
 		},
 		Spec: r.DeepCopy().Spec,
 	}
@@ -1003,10 +1587,150 @@ func (vc *VolumeController) enqueueVolume(v *longhorn.Volume) {
 	vc.queue.AddRateLimited(key)
 }
 
+// enqueueSettingChange enqueues the volumes owned by this manager, so the
+// setting change takes effect without waiting for the resync
+func (vc *VolumeController) enqueueSettingChange(name types.SettingName) {
+	volumes, err := vc.ds.ListVolumesByOwnerRO(vc.controllerID)
+	if err != nil {
+		vc.logger.Warnf("Failed to list volumes for the change of setting %v: %v", name, err)
+		return
+	}
+	for _, v := range volumes {
+		vc.enqueueVolume(v)
+	}
+}
+
+// enqueueUnscheduledVolumes enqueues the volumes having replicas failed to be
+// scheduled immediately, rather than waiting for the periodic resync
+func (vc *VolumeController) enqueueUnscheduledVolumes() {
+	volumes, err := vc.ds.ListVolumesByOwnerRO(vc.controllerID)
+	if err != nil {
+		vc.logger.Warnf("Failed to list volumes for rescheduling: %v", err)
+		return
+	}
+	for _, v := range volumes {
+		condition := types.GetVolumeConditionFromStatus(v.Status, types.VolumeConditionTypeScheduled)
+		if condition.Status != types.ConditionStatusFalse {
+			continue
+		}
+		key, err := controller.KeyFunc(v)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("Couldn't get key for object %#v: %v", v, err))
+			continue
+		}
+		vc.queue.Add(key)
+	}
+}
+
+// enqueueEvictingVolumes enqueues the volumes having replicas on the disks or
+// the node whose eviction is requested or canceled. The volumes waiting for the
+// others to finish the eviction are enqueued as well once the replicas on
+// the disks changed.
+func (vc *VolumeController) enqueueEvictingVolumes(old, cur *longhorn.Node) {
+	nodeEviction := cur.Spec.EvictionRequested || old.Spec.EvictionRequested
+	diskIDs := []string{}
+	for diskID, disk := range cur.Spec.Disks {
+		if nodeEviction || disk.EvictionRequested || old.Spec.Disks[diskID].EvictionRequested {
+			diskIDs = append(diskIDs, diskID)
+		}
+	}
+	vc.enqueueVolumesOnDisks(cur.Name, diskIDs)
+}
+
+// enqueueVolumesOnUnhealthyDisks enqueues the volumes with replicas on the
+// disks which have just failed the health probe
+func (vc *VolumeController) enqueueVolumesOnUnhealthyDisks(old, cur *longhorn.Node) {
+	diskIDs := []string{}
+	for diskID, curStatus := range cur.Status.DiskStatus {
+		curReady := types.GetDiskConditionFromStatus(curStatus, types.DiskConditionTypeReady)
+		oldReady := types.GetDiskConditionFromStatus(old.Status.DiskStatus[diskID], types.DiskConditionTypeReady)
+		if curReady.Reason == types.DiskConditionReasonDiskHealthProbeFailed && oldReady.Reason != curReady.Reason {
+			diskIDs = append(diskIDs, diskID)
+		}
+	}
+	vc.enqueueVolumesOnDisks(cur.Name, diskIDs)
+}
+
+// enqueueVolumesOnDisks enqueues the volumes with replicas on the disks of the
+// node
+func (vc *VolumeController) enqueueVolumesOnDisks(nodeName string, diskIDs []string) {
+	if len(diskIDs) == 0 {
+		return
+	}
+	replicaDiskMap, err := vc.ds.ListReplicasByDiskRO(nodeName)
+	if err != nil {
+		vc.logger.WithField("node", nodeName).Warnf("Failed to list replicas on node: %v", err)
+		return
+	}
+	volumeNames := map[string]struct{}{}
+	for _, diskID := range diskIDs {
+		for _, r := range replicaDiskMap[diskID] {
+			volumeNames[r.Spec.VolumeName] = struct{}{}
+		}
+	}
+	for name := range volumeNames {
+		v, err := vc.ds.GetVolumeRO(name)
+		if err != nil {
+			continue
+		}
+		if v.Spec.OwnerID != vc.controllerID {
+			continue
+		}
+		vc.enqueueVolume(v)
+	}
+}
+
+// enqueueVolumesAttachedToNode enqueues the volumes whose engines are on the
+// node
+func (vc *VolumeController) enqueueVolumesAttachedToNode(nodeName string) {
+	volumes, err := vc.ds.ListVolumesByNodeRO(nodeName)
+	if err != nil {
+		vc.logger.WithField("node", nodeName).Warnf("Failed to list volumes attached to node: %v", err)
+		return
+	}
+	for _, v := range volumes {
+		if v.Spec.OwnerID != vc.controllerID {
+			continue
+		}
+		vc.enqueueVolume(v)
+	}
+}
+
+// isNodeSchedulingChanged returns true if the change of the node may make
+// the pending replicas schedulable
+func isNodeSchedulingChanged(old, cur *longhorn.Node) bool {
+	// disks added, scheduling enabled or tags changed
+	if !reflect.DeepEqual(old.Spec, cur.Spec) || old.Status.Zone != cur.Status.Zone {
+		return true
+	}
+	oldReady := types.GetNodeConditionFromStatus(old.Status, types.NodeConditionTypeReady)
+	curReady := types.GetNodeConditionFromStatus(cur.Status, types.NodeConditionTypeReady)
+	if oldReady.Status != curReady.Status {
+		return true
+	}
+	for diskID, curStatus := range cur.Status.DiskStatus {
+		oldStatus, ok := old.Status.DiskStatus[diskID]
+		if !ok {
+			return true
+		}
+		oldSchedulable := types.GetDiskConditionFromStatus(oldStatus, types.DiskConditionTypeSchedulable)
+		curSchedulable := types.GetDiskConditionFromStatus(curStatus, types.DiskConditionTypeSchedulable)
+		if oldSchedulable.Status != curSchedulable.Status {
+			return true
+		}
+		// the replicas or the snapshots on the disk have been removed
+		if curStatus.StorageScheduled < oldStatus.StorageScheduled ||
+			curStatus.StorageUsed < oldStatus.StorageUsed {
+			return true
+		}
+	}
+	return false
+}
+
 func (vc *VolumeController) enqueueControlleeChange(obj interface{}) {
 	metaObj, err := meta.Accessor(obj)
 	if err != nil {
-		logrus.Warnf("BUG: %v cannot be convert to metav1.Object: %v", obj, err)
+		vc.logger.Warnf("BUG: %v cannot be convert to metav1.Object: %v", obj, err)
 		return
 	}
 	ownerRefs := metaObj.GetOwnerReferences()
@@ -1040,7 +1764,7 @@ func (vc *VolumeController) ResolveRefAndEnqueue(namespace string, ref *metav1.O
 	vc.enqueueVolume(volume)
 }
 
-func (vc *VolumeController) getOwnerReferencesForVolume(v *longhorn.Volume) []metav1.OwnerReference {
+func getOwnerReferencesForVolume(v *longhorn.Volume) []metav1.OwnerReference {
 	return []metav1.OwnerReference{
 		{
 			APIVersion: longhorn.SchemeGroupVersion.String(),
@@ -1051,31 +1775,50 @@ func (vc *VolumeController) getOwnerReferencesForVolume(v *longhorn.Volume) []me
 	}
 }
 
-func (vc *VolumeController) createCronJob(v *longhorn.Volume, job *types.RecurringJob, suspend bool, backupTarget string, credentialSecret string) *batchv1beta1.CronJob {
+func (vc *VolumeController) createCronJob(v *longhorn.Volume, job *types.RecurringJob, suspend bool, backupTarget string, credentialSecret string, tolerations []v1.Toleration) *batchv1beta1.CronJob {
 	backoffLimit := int32(CronJobBackoffLimit)
+	startingDeadlineSeconds := int64(CronJobStartingDeadlineSeconds)
 	cmd := []string{
 		"longhorn-manager", "-d",
 		"snapshot", v.Name,
 		"--snapshot-name", job.Name,
-		"--labels", LabelRecurringJob + "=" + job.Name,
+		"--labels", types.RecurringJobLabel + "=" + job.Name,
 		"--retain", strconv.Itoa(job.Retain),
 	}
+	// sorted to keep the cron job unchanged
+	labelKeys := []string{}
+	for key := range job.Labels {
+		labelKeys = append(labelKeys, key)
+	}
+	sort.Strings(labelKeys)
+	for _, key := range labelKeys {
+		cmd = append(cmd, "--labels", key+"="+job.Labels[key])
+	}
 	if job.Type == types.RecurringJobTypeBackup {
 		cmd = append(cmd, "--backuptarget", backupTarget)
 	}
+	if job.Jitter > 0 {
+		cmd = append(cmd, "--jitter", strconv.Itoa(job.Jitter))
+	}
 	// for mounting inside container
 	privilege := true
 	cronJob := &batchv1beta1.CronJob{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            types.GetCronJobNameForVolumeAndJob(v.Name, job.Name),
 			Namespace:       vc.namespace,
-			OwnerReferences: vc.getOwnerReferencesForVolume(v),
+			OwnerReferences: getOwnerReferencesForVolume(v),
 		},
 		Spec: batchv1beta1.CronJobSpec{
-			Schedule:          job.Cron,
-			ConcurrencyPolicy: batchv1beta1.ForbidConcurrent,
-			Suspend:           &suspend,
+			Schedule:                job.Cron,
+			ConcurrencyPolicy:       batchv1beta1.ForbidConcurrent,
+			StartingDeadlineSeconds: &startingDeadlineSeconds,
+			Suspend:                 &suspend,
 			JobTemplate: batchv1beta1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						types.LonghornCronJobKey: types.GetCronJobNameForVolumeAndJob(v.Name, job.Name),
+					},
+				},
 				Spec: batchv1.JobSpec{
 					BackoffLimit: &backoffLimit,
 					Template: v1.PodTemplateSpec{
@@ -1083,7 +1826,8 @@ func (vc *VolumeController) createCronJob(v *longhorn.Volume, job *types.Recurri
 							Name: types.GetCronJobNameForVolumeAndJob(v.Name, job.Name),
 						},
 						Spec: v1.PodSpec{
-							NodeName: v.Spec.NodeID,
+							NodeName:    v.Spec.NodeID,
+							Tolerations: tolerations,
 							Containers: []v1.Container{
 								{
 									Name:    types.GetCronJobNameForVolumeAndJob(v.Name, job.Name),
@@ -1140,21 +1884,18 @@ func (vc *VolumeController) updateRecurringJobs(v *longhorn.Volume) (err error)
 	}()
 
 	suspended := false
-	if v.Status.State != types.VolumeStateAttached {
+	if v.Status.State != types.VolumeStateAttached || v.Status.Robustness == types.VolumeRobustnessFaulted {
 		suspended = true
 	}
 
-	settingBackupTarget, err := vc.ds.GetSetting(types.SettingNameBackupTarget)
+	backupTarget, err := vc.ds.GetSettingValue(types.SettingNameBackupTarget)
 	if err != nil {
 		return err
 	}
-	backupTarget := settingBackupTarget.Value
-
-	settingBackupCredentialSecret, err := vc.ds.GetSetting(types.SettingNameBackupTargetCredentialSecret)
+	tolerations, err := vc.ds.GetSettingTaintToleration()
 	if err != nil {
 		return err
 	}
-	backupCredentialSecret := settingBackupCredentialSecret.Value
 
 	// the cronjobs are RO in the map, but not the map itself
 	appliedCronJobROs, err := vc.ds.ListVolumeCronJobROs(v.Name)
@@ -1168,21 +1909,30 @@ func (vc *VolumeController) updateRecurringJobs(v *longhorn.Volume) (err error)
 			return fmt.Errorf("cannot backup with empty backup target")
 		}
 
-		cronJob := vc.createCronJob(v, &job, suspended, backupTarget, backupCredentialSecret)
+		backupCredentialSecret, err := vc.ds.ResolveBackupTargetCredentialSecret(job.BackupTargetCredentialSecret, v.Spec.BackupTargetCredentialSecret)
+		if err != nil {
+			return err
+		}
+		// Kubernetes evaluates the cron in the time zone of the controller
+		// manager, so the jobs with the time zone are started by the
+		// volume controller from the CronJob kept suspended
+		cronJob := vc.createCronJob(v, &job, suspended || job.Timezone != "", backupTarget, backupCredentialSecret, tolerations)
 		currentCronJobs[cronJob.Name] = cronJob
 	}
 
 	for name, cronJob := range currentCronJobs {
 		if appliedCronJobROs[name] == nil {
-			_, err := vc.ds.CreateVolumeCronJob(v.Name, cronJob)
+			created, err := vc.ds.CreateVolumeCronJob(v.Name, cronJob)
 			if err != nil {
 				return err
 			}
+			appliedCronJobROs[name] = created
 		} else if !reflect.DeepEqual(appliedCronJobROs[name].Spec, cronJob) {
-			_, err := vc.ds.UpdateVolumeCronJob(v.Name, cronJob)
+			updated, err := vc.ds.UpdateVolumeCronJob(v.Name, cronJob)
 			if err != nil {
 				return err
 			}
+			appliedCronJobROs[name] = updated
 		}
 	}
 	for name := range appliedCronJobROs {
@@ -1193,9 +1943,187 @@ func (vc *VolumeController) updateRecurringJobs(v *longhorn.Volume) (err error)
 		}
 	}
 
+	return vc.reconcileRecurringJobRuns(v, appliedCronJobROs)
+}
+
+// reconcileRecurringJobRuns follows the schedules of the recurring jobs in
+// their time zones. At every scheduled time, the run is recorded as skipped
+// if it cannot execute, or started by the controller for the job with the
+// time zone. The runs of the other jobs are started by Kubernetes, which
+// skips them in the same cases since their CronJobs are suspended or forbid
+// the concurrent runs.
+func (vc *VolumeController) reconcileRecurringJobRuns(v *longhorn.Volume, cronJobs map[string]*batchv1beta1.CronJob) error {
+	// the schedules are picked up again once the volume is restored
+	if v.Spec.TrashedAt != "" {
+		return nil
+	}
+	now, err := util.ParseTime(vc.nowHandler())
+	if err != nil {
+		return err
+	}
+	catchUpWindow, err := vc.ds.GetSettingAsInt(types.SettingNameRecurringJobCatchUpWindow)
+	if err != nil {
+		return err
+	}
+
+	var status map[string]types.RecurringJobStatus
+	if len(v.Spec.RecurringJobs) != 0 {
+		status = map[string]types.RecurringJobStatus{}
+	}
+	nextRun := time.Time{}
+	for _, job := range v.Spec.RecurringJobs {
+		schedule, loc, err := types.ParseRecurringJobSchedule(&job)
+		if err != nil {
+			// rejected by the API, but the volume may be changed directly
+			getLoggerForVolume(vc.logger, v).Warnf("Cannot follow the schedule of recurring job %v: %v", job.Name, err)
+			continue
+		}
+		cronJob := cronJobs[types.GetCronJobNameForVolumeAndJob(v.Name, job.Name)]
+
+		jobStatus := v.Status.RecurringJobStatus[job.Name]
+		last, err := util.ParseTime(jobStatus.LastScheduledTime)
+		if err != nil {
+			// none of the runs before are known to be due
+			last = now
+			jobStatus.LastScheduledTime = util.FormatTimeZ(now)
+		}
+		if scheduled := schedule.Latest(last.In(loc), now); !scheduled.IsZero() {
+			// only the latest one is handled if several are due, e.g.
+			// after the manager restarted
+			jobStatus.LastScheduledTime = util.FormatTimeZ(scheduled)
+			jobStatus.PendingCatchUpTime = ""
+			reason, message, err := vc.getRecurringJobSkipReason(v, cronJob, scheduled)
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				vc.recordSkippedRecurringJobRun(v, job.Name, scheduled, reason, message)
+				if reason != types.RecurringJobSkipReasonJobRunning && catchUpWindow > 0 {
+					jobStatus.PendingCatchUpTime = jobStatus.LastScheduledTime
+				}
+			} else if job.Timezone != "" {
+				if err := vc.startRecurringJobRun(cronJob, scheduled); err != nil {
+					return err
+				}
+			}
+		} else if jobStatus.PendingCatchUpTime != "" {
+			missed, err := util.ParseTime(jobStatus.PendingCatchUpTime)
+			if err != nil || now.Sub(missed) > time.Duration(catchUpWindow)*time.Minute {
+				jobStatus.PendingCatchUpTime = ""
+			} else if reason, _, err := vc.getRecurringJobSkipReason(v, cronJob, now); err != nil {
+				return err
+			} else if reason == "" {
+				// the run is named after the skipped one, so it's not
+				// caught up twice
+				if err := vc.startRecurringJobRun(cronJob, missed); err != nil {
+					return err
+				}
+				jobStatus.PendingCatchUpTime = ""
+				vc.eventRecorder.Eventf(v, v1.EventTypeNormal, EventReasonCaughtUpRecurringJob,
+					"Started recurring job %v to catch up on the run scheduled at %v", job.Name, missed.In(loc).Format(time.RFC3339))
+			}
+		}
+		status[job.Name] = jobStatus
+
+		if next := schedule.Next(now.In(loc)); !next.IsZero() && (nextRun.IsZero() || next.Before(nextRun)) {
+			nextRun = next
+		}
+	}
+	v.Status.RecurringJobStatus = status
+
+	if !nextRun.IsZero() {
+		key, err := controller.KeyFunc(v)
+		if err != nil {
+			return err
+		}
+		vc.queue.AddAfter(key, nextRun.Sub(now))
+	}
+	return nil
+}
+
+// getRecurringJobSkipReason returns why the run scheduled at the time cannot
+// execute, or empty if it can
+func (vc *VolumeController) getRecurringJobSkipReason(v *longhorn.Volume, cronJob *batchv1beta1.CronJob, scheduled time.Time) (reason, message string, err error) {
+	if v.Status.Robustness == types.VolumeRobustnessFaulted {
+		return types.RecurringJobSkipReasonVolumeFaulted, "volume is faulted", nil
+	}
+	if v.Status.State != types.VolumeStateAttached {
+		return types.RecurringJobSkipReasonVolumeDetached, fmt.Sprintf("volume is %v", v.Status.State), nil
+	}
+	if cronJob == nil {
+		return "", "", nil
+	}
+	jobs, err := vc.ds.ListCronJobJobs(cronJob.Name)
+	if err != nil {
+		return "", "", err
+	}
+	for _, job := range jobs {
+		// the one started after is the scheduled run itself
+		if !job.CreationTimestamp.Time.Before(scheduled) || isJobFinished(&job) {
+			continue
+		}
+		return types.RecurringJobSkipReasonJobRunning, fmt.Sprintf("job %v started at %v is still running", job.Name, job.CreationTimestamp.UTC().Format(time.RFC3339)), nil
+	}
+	return "", "", nil
+}
+
+func isJobFinished(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// startRecurringJobRun creates the Kubernetes job from the CronJob for the
+// run scheduled at the time. It's named after the time as the CronJob
+// controller does, so the run is started once.
+func (vc *VolumeController) startRecurringJobRun(cronJob *batchv1beta1.CronJob, scheduled time.Time) error {
+	if cronJob == nil {
+		return fmt.Errorf("cannot find the CronJob to run")
+	}
+	isController := true
+	template := cronJob.Spec.JobTemplate.DeepCopy()
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   fmt.Sprintf("%v-%d", cronJob.Name, scheduled.Unix()/60),
+			Labels: template.Labels,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: batchv1beta1.SchemeGroupVersion.String(),
+					Kind:       "CronJob",
+					Name:       cronJob.Name,
+					UID:        cronJob.UID,
+					Controller: &isController,
+				},
+			},
+		},
+		Spec: template.Spec,
+	}
+	if _, err := vc.ds.CreateJob(job); err != nil && !apierrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "fail to start job %v", job.Name)
+	}
 	return nil
 }
 
+// recordSkippedRecurringJobRun adds the skipped run to the volume status,
+// keeping the latest ones
+func (vc *VolumeController) recordSkippedRecurringJobRun(v *longhorn.Volume, jobName string, scheduled time.Time, reason, message string) {
+	v.Status.SkippedRecurringJobRuns = append(v.Status.SkippedRecurringJobRuns, types.SkippedRecurringJobRun{
+		Job:           jobName,
+		ScheduledTime: util.FormatTimeZ(scheduled),
+		Reason:        reason,
+		Message:       message,
+	})
+	if extra := len(v.Status.SkippedRecurringJobRuns) - types.MaxSkippedRecurringJobRuns; extra > 0 {
+		v.Status.SkippedRecurringJobRuns = v.Status.SkippedRecurringJobRuns[extra:]
+	}
+	getLoggerForVolume(vc.logger, v).Warnf("Skipped the run of recurring job %v scheduled at %v: %v", jobName, scheduled.Format(time.RFC3339), message)
+	vc.eventRecorder.Eventf(v, v1.EventTypeWarning, EventReasonSkippedRecurringJob,
+		"Skipped the run of recurring job %v scheduled at %v: %v", jobName, scheduled.Format(time.RFC3339), message)
+}
+
 func (vc *VolumeController) isVolumeUpgrading(v *longhorn.Volume) bool {
 	return v.Status.CurrentImage != v.Spec.EngineImage
 }
@@ -1204,6 +2132,40 @@ func (vc *VolumeController) isVolumeMigrating(v *longhorn.Volume) bool {
 	return v.Spec.MigrationNodeID != ""
 }
 
+// syncQoSCondition tells whether the engine image of the volume can apply the
+// QoS limits. The engine skips the limits before the CLI API version
+// engineapi.QoSMinCLIAPIVersion, which is warned once when the condition
+// turns false.
+func (vc *VolumeController) syncQoSCondition(v *longhorn.Volume) {
+	if v.Spec.QoS == (types.VolumeQoS{}) {
+		delete(v.Status.Conditions, types.VolumeConditionTypeQoSSupported)
+		return
+	}
+	ei, err := vc.getEngineImage(v.Status.CurrentImage)
+	if err != nil {
+		getLoggerForVolume(vc.logger, v).Warnf("Cannot check QoS support of engine image %v: %v", v.Status.CurrentImage, err)
+		return
+	}
+	condition := types.GetVolumeConditionFromStatus(v.Status, types.VolumeConditionTypeQoSSupported)
+	if ei.Status.CLIAPIVersion < engineapi.QoSMinCLIAPIVersion {
+		if condition.Status != types.ConditionStatusFalse {
+			condition.Status = types.ConditionStatusFalse
+			condition.LastTransitionTime = util.Now()
+			vc.eventRecorder.Eventf(v, v1.EventTypeWarning, EventReasonQoSUnsupported,
+				"QoS limits of volume %v are not applied: engine image %v has CLI API version %v, QoS requires %v",
+				v.Name, v.Status.CurrentImage, ei.Status.CLIAPIVersion, engineapi.QoSMinCLIAPIVersion)
+		}
+		condition.Reason = types.VolumeConditionReasonEngineImageUnsupported
+		condition.Message = fmt.Sprintf("engine image %v doesn't support QoS, the limits are not applied", v.Status.CurrentImage)
+	} else if condition.Status != types.ConditionStatusTrue {
+		condition.Status = types.ConditionStatusTrue
+		condition.Reason = ""
+		condition.Message = ""
+		condition.LastTransitionTime = util.Now()
+	}
+	v.Status.Conditions[types.VolumeConditionTypeQoSSupported] = condition
+}
+
 func (vc *VolumeController) getEngineImage(image string) (*longhorn.EngineImage, error) {
 	name := types.GetEngineImageChecksumName(image)
 	img, err := vc.ds.GetEngineImage(name)
@@ -1258,7 +2220,7 @@ func (vc *VolumeController) createAndStartMatchingReplicas(v *longhorn.Volume,
 	}
 
 	if len(pathToOldRs) != v.Spec.NumberOfReplicas {
-		logrus.Debugf("volume %v: createAndStartMatchingReplicas: healthy replica counts doesn't match", v.Name)
+		getLoggerForVolume(vc.logger, v).Debugf("createAndStartMatchingReplicas: healthy replica counts doesn't match")
 		return nil
 	}
 
@@ -1313,6 +2275,7 @@ func (vc *VolumeController) processMigration(v *longhorn.Volume, es map[string]*
 	defer func() {
 		err = errors.Wrapf(err, "fail to process migration for %v", v.Name)
 	}()
+	log := getLoggerForVolume(vc.logger, v).WithField("migrationNodeID", v.Spec.MigrationNodeID)
 	// only process if volume is attached
 	if v.Spec.NodeID == "" {
 		return nil
@@ -1360,7 +2323,7 @@ func (vc *VolumeController) processMigration(v *longhorn.Volume, es map[string]*
 		}
 
 		// cleanupCorruptedOrStaleReplicas() will take care of old replicas
-		logrus.Infof("volume %v: confirmMigration: migration to node %v has been confirmed", v.Name, v.Spec.NodeID)
+		log.Infof("Migration to node %v has been confirmed", v.Spec.NodeID)
 		return nil
 	}
 
@@ -1389,8 +2352,7 @@ func (vc *VolumeController) processMigration(v *longhorn.Volume, es map[string]*
 		} else if r.Spec.EngineName == migrationEngine.Name {
 			migrationReplicas[r.Spec.DataPath] = r
 		} else {
-			logrus.Warnf("migration: volume %v: found unknown replica with engine %v",
-				v.Name, r.Spec.EngineName)
+			log.WithField("replica", r.Name).Warnf("Found unknown replica with engine %v", r.Spec.EngineName)
 			unknownReplicas[r.Spec.DataPath] = r
 		}
 	}
@@ -1409,10 +2371,10 @@ func (vc *VolumeController) processMigration(v *longhorn.Volume, es map[string]*
 				return nil
 			}
 			if r.Status.IP == "" {
-				logrus.Errorf("BUG: replica %v is running but IP is empty", r.Name)
+				log.WithField("replica", r.Name).Errorf("BUG: replica is running but IP is empty")
 				continue
 			}
-			replicaAddressMap[r.Name] = r.Status.IP
+			replicaAddressMap[r.Name] = engineapi.GetReplicaAddress(r.Status.IP, r.Status.Port)
 		}
 		if migrationEngine.Spec.NodeID != "" && migrationEngine.Spec.NodeID != v.Spec.MigrationNodeID {
 			return fmt.Errorf("volume %v: engine is on node %v vs volume migration on %v",
@@ -1432,6 +2394,6 @@ func (vc *VolumeController) processMigration(v *longhorn.Volume, es map[string]*
 		return nil
 	}
 
-	logrus.Infof("volume %v: migration: migration node %v is ready", v.Name, v.Spec.MigrationNodeID)
+	log.Infof("Migration node is ready")
 	return nil
 }
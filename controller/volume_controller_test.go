@@ -3,17 +3,21 @@ package controller
 import (
 	"fmt"
 	"path/filepath"
+	"testing"
 	"time"
 
+	batchv1 "k8s.io/api/batch/v1"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/kubernetes/pkg/controller"
 
 	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 
@@ -50,20 +54,26 @@ func newTestVolumeController(lhInformerFactory lhinformerfactory.SharedInformerF
 	engineImageInformer := lhInformerFactory.Longhorn().V1alpha1().EngineImages()
 	nodeInformer := lhInformerFactory.Longhorn().V1alpha1().Nodes()
 	settingInformer := lhInformerFactory.Longhorn().V1alpha1().Settings()
+	snapshotInformer := lhInformerFactory.Longhorn().V1alpha1().Snapshots()
 
 	podInformer := kubeInformerFactory.Core().V1().Pods()
 	cronJobInformer := kubeInformerFactory.Batch().V1beta1().CronJobs()
 	daemonSetInformer := kubeInformerFactory.Apps().V1beta2().DaemonSets()
+	eventInformer := kubeInformerFactory.Core().V1().Events()
+	persistentVolumeInformer := kubeInformerFactory.Core().V1().PersistentVolumes()
+	persistentVolumeClaimInformer := kubeInformerFactory.Core().V1().PersistentVolumeClaims()
+	volumeAttachmentInformer := kubeInformerFactory.Storage().V1beta1().VolumeAttachments()
 
 	ds := datastore.NewDataStore(
 		volumeInformer, engineInformer, replicaInformer,
 		engineImageInformer, nodeInformer, settingInformer,
-		lhClient,
-		podInformer, cronJobInformer, daemonSetInformer,
+		snapshotInformer, lhClient,
+		podInformer, cronJobInformer, daemonSetInformer, eventInformer,
+		persistentVolumeInformer, persistentVolumeClaimInformer, volumeAttachmentInformer,
 		kubeClient, TestNamespace)
 	initSettings(ds)
 
-	vc := NewVolumeController(ds, scheme.Scheme, volumeInformer, engineInformer, replicaInformer, kubeClient, TestNamespace, controllerID, TestServiceAccount, TestManagerImage)
+	vc := NewVolumeController(ds, scheme.Scheme, DefaultControllerConfig(), volumeInformer, engineInformer, replicaInformer, nodeInformer, kubeClient, TestNamespace, controllerID, TestServiceAccount, TestManagerImage)
 
 	fakeRecorder := record.NewFakeRecorder(100)
 	vc.eventRecorder = fakeRecorder
@@ -71,6 +81,7 @@ func newTestVolumeController(lhInformerFactory lhinformerfactory.SharedInformerF
 	vc.vStoreSynced = alwaysReady
 	vc.rStoreSynced = alwaysReady
 	vc.eStoreSynced = alwaysReady
+	vc.nStoreSynced = alwaysReady
 	vc.nowHandler = getTestNow
 
 	return vc
@@ -121,9 +132,10 @@ func (s *TestSuite) TestVolumeLifeCycle(c *C) {
 	tc.expectVolume.Status.Robustness = types.VolumeRobustnessUnknown
 	tc.expectVolume.Status.Conditions = map[types.VolumeConditionType]types.Condition{
 		types.VolumeConditionTypeScheduled: {
-			Type:   string(types.VolumeConditionTypeScheduled),
-			Status: types.ConditionStatusFalse,
-			Reason: types.VolumeConditionReasonReplicaSchedulingFailure,
+			Type:    string(types.VolumeConditionTypeScheduled),
+			Status:  types.ConditionStatusFalse,
+			Reason:  types.VolumeConditionReasonReplicaSchedulingFailure,
+			Message: "0/2 nodes available: 2 cordoned",
 		},
 	}
 	testCases["volume create - replica scheduling failure"] = tc
@@ -645,6 +657,9 @@ func (s *TestSuite) runTestCases(c *C, testCases map[string]*VolumeTestCase) {
 					c.Assert(retR.Spec.NodeID, Not(Equals), "")
 					c.Assert(retR.Spec.DiskID, Not(Equals), "")
 					c.Assert(retR.Spec.NodeID, Equals, TestNode1)
+					// the decision depends on the order of replicas scheduled
+					c.Assert(retR.Status.SchedulingDecision, Not(Equals), types.ReplicaSchedulingDecision(""))
+					retR.Status.SchedulingDecision = ""
 				} else {
 					// not schedulable
 					c.Assert(retR.Spec.DataPath, Equals, "")
@@ -663,3 +678,1003 @@ func (s *TestSuite) runTestCases(c *C, testCases map[string]*VolumeTestCase) {
 func getTestNow() string {
 	return TestTimeNow
 }
+
+func (s *TestSuite) TestPendingReplicaRescheduling(c *C) {
+	var err error
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	vIndexer := lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer()
+	eIndexer := lhInformerFactory.Longhorn().V1alpha1().Engines().Informer().GetIndexer()
+	rIndexer := lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer()
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+
+	pIndexer := kubeInformerFactory.Core().V1().Pods().Informer().GetIndexer()
+	knIndexer := kubeInformerFactory.Core().V1().Nodes().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	kubeNode := newKubernetesNode(TestNode1, v1.ConditionTrue, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionTrue)
+	kn, err := kubeClient.CoreV1().Nodes().Create(kubeNode)
+	c.Assert(err, IsNil)
+	knIndexer.Add(kn)
+	daemon := newDaemonPod(v1.PodRunning, TestDaemon1, TestNamespace, TestNode1, TestIP1, nil)
+	p, err := kubeClient.CoreV1().Pods(TestNamespace).Create(daemon)
+	c.Assert(err, IsNil)
+	pIndexer.Add(p)
+
+	// the only disk is fully occupied by the replica of volume A
+	volumeA := newVolume(TestVolumeName+"-a", 1)
+	engineA := newEngineForVolume(volumeA)
+	replicaA := newReplicaForVolume(volumeA, engineA, TestNode1, TestDiskID1)
+	node := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			StorageAvailable: TestDiskAvailableSize,
+			StorageScheduled: TestDiskSize * 5,
+			StorageMaximum:   TestDiskSize,
+			Conditions: map[types.DiskConditionType]types.Condition{
+				types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusTrue, ""),
+			},
+			ScheduledReplica: map[string]int64{
+				replicaA.Name: TestDiskSize * 5,
+			},
+			StorageUsed: TestDiskSize * 5,
+			ReplicaStorageUsed: map[string]int64{
+				replicaA.Name: TestDiskSize * 5,
+			},
+		},
+	}
+	n, err := lhClient.Longhorn().Nodes(TestNamespace).Create(node)
+	c.Assert(err, IsNil)
+	nIndexer.Add(n)
+
+	vA, err := lhClient.LonghornV1alpha1().Volumes(TestNamespace).Create(volumeA)
+	c.Assert(err, IsNil)
+	c.Assert(vIndexer.Add(vA), IsNil)
+	rA, err := lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(replicaA)
+	c.Assert(err, IsNil)
+	c.Assert(rIndexer.Add(rA), IsNil)
+
+	// the replica of volume B cannot be scheduled
+	volumeB := newVolume(TestVolumeName+"-b", 1)
+	vB, err := lhClient.LonghornV1alpha1().Volumes(TestNamespace).Create(volumeB)
+	c.Assert(err, IsNil)
+	c.Assert(vIndexer.Add(vB), IsNil)
+	keyB := getKey(vB, c)
+
+	err = vc.syncVolume(keyB)
+	c.Assert(err, IsNil)
+
+	vB, err = lhClient.LonghornV1alpha1().Volumes(TestNamespace).Get(vB.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(vIndexer.Update(vB), IsNil)
+	condition := types.GetVolumeConditionFromStatus(vB.Status, types.VolumeConditionTypeScheduled)
+	c.Assert(condition.Status, Equals, types.ConditionStatusFalse)
+
+	retEs, err := lhClient.LonghornV1alpha1().Engines(TestNamespace).List(metav1.ListOptions{LabelSelector: getVolumeLabelSelector(vB.Name)})
+	c.Assert(err, IsNil)
+	c.Assert(retEs.Items, HasLen, 1)
+	c.Assert(eIndexer.Add(&retEs.Items[0]), IsNil)
+	retRs, err := lhClient.LonghornV1alpha1().Replicas(TestNamespace).List(metav1.ListOptions{LabelSelector: getVolumeLabelSelector(vB.Name)})
+	c.Assert(err, IsNil)
+	c.Assert(retRs.Items, HasLen, 1)
+	c.Assert(retRs.Items[0].Spec.NodeID, Equals, "")
+	c.Assert(rIndexer.Add(&retRs.Items[0]), IsNil)
+
+	// volume A is scheduled, so only volume B would be enqueued
+	vc.enqueueUnscheduledVolumes()
+	c.Assert(vc.queue.Len(), Equals, 1)
+	key, _ := vc.queue.Get()
+	c.Assert(key, Equals, keyB)
+	vc.queue.Done(key)
+
+	// delete volume A, then the node controller releases the space
+	c.Assert(lhClient.LonghornV1alpha1().Replicas(TestNamespace).Delete(rA.Name, &metav1.DeleteOptions{}), IsNil)
+	c.Assert(rIndexer.Delete(rA), IsNil)
+	c.Assert(lhClient.LonghornV1alpha1().Volumes(TestNamespace).Delete(vA.Name, &metav1.DeleteOptions{}), IsNil)
+	c.Assert(vIndexer.Delete(vA), IsNil)
+
+	oldNode := n.DeepCopy()
+	diskStatus := n.Status.DiskStatus[TestDiskID1]
+	diskStatus.StorageScheduled = 0
+	diskStatus.ScheduledReplica = map[string]int64{}
+	diskStatus.StorageUsed = 0
+	diskStatus.ReplicaStorageUsed = map[string]int64{}
+	n.Status.DiskStatus[TestDiskID1] = diskStatus
+	n, err = lhClient.Longhorn().Nodes(TestNamespace).Update(n)
+	c.Assert(err, IsNil)
+	c.Assert(nIndexer.Update(n), IsNil)
+	c.Assert(isNodeSchedulingChanged(oldNode, n), Equals, true)
+	c.Assert(isNodeSchedulingChanged(n, n.DeepCopy()), Equals, false)
+
+	// the volume deletion would enqueue volume B immediately
+	vc.enqueueUnscheduledVolumes()
+	c.Assert(vc.queue.Len(), Equals, 1)
+	key, _ = vc.queue.Get()
+	c.Assert(key, Equals, keyB)
+	vc.queue.Done(key)
+
+	err = vc.syncVolume(key.(string))
+	c.Assert(err, IsNil)
+
+	retR, err := lhClient.LonghornV1alpha1().Replicas(TestNamespace).Get(retRs.Items[0].Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(retR.Spec.NodeID, Equals, TestNode1)
+	c.Assert(retR.Spec.DiskID, Equals, TestDiskID1)
+	vB, err = lhClient.LonghornV1alpha1().Volumes(TestNamespace).Get(vB.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	condition = types.GetVolumeConditionFromStatus(vB.Status, types.VolumeConditionTypeScheduled)
+	c.Assert(condition.Status, Equals, types.ConditionStatusTrue)
+}
+
+func (s *TestSuite) TestRescheduleReplicaOnRemovedDisk(c *C) {
+	var err error
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	vIndexer := lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer()
+	eIndexer := lhInformerFactory.Longhorn().V1alpha1().Engines().Informer().GetIndexer()
+	rIndexer := lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer()
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+
+	knIndexer := kubeInformerFactory.Core().V1().Nodes().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	kubeNode := newKubernetesNode(TestNode1, v1.ConditionTrue, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionFalse, v1.ConditionTrue)
+	kn, err := kubeClient.CoreV1().Nodes().Create(kubeNode)
+	c.Assert(err, IsNil)
+	knIndexer.Add(kn)
+
+	// the disk the replica was scheduled to has been removed from the node
+	node := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			StorageAvailable: TestDiskAvailableSize,
+			StorageMaximum:   TestDiskSize,
+			Conditions: map[types.DiskConditionType]types.Condition{
+				types.DiskConditionTypeSchedulable: newNodeCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusTrue, ""),
+			},
+		},
+	}
+	n, err := lhClient.Longhorn().Nodes(TestNamespace).Create(node)
+	c.Assert(err, IsNil)
+	nIndexer.Add(n)
+
+	volume := newVolume(TestVolumeName, 1)
+	engine := newEngineForVolume(volume)
+	engine.Status.CurrentState = types.InstanceStateStopped
+	replica := newReplicaForVolume(volume, engine, TestNode1, "removed-disk")
+	replica.Status.CurrentState = types.InstanceStateStopped
+
+	v, err := lhClient.LonghornV1alpha1().Volumes(TestNamespace).Create(volume)
+	c.Assert(err, IsNil)
+	c.Assert(vIndexer.Add(v), IsNil)
+	e, err := lhClient.LonghornV1alpha1().Engines(TestNamespace).Create(engine)
+	c.Assert(err, IsNil)
+	c.Assert(eIndexer.Add(e), IsNil)
+	r, err := lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(replica)
+	c.Assert(err, IsNil)
+	c.Assert(rIndexer.Add(r), IsNil)
+
+	err = vc.syncVolume(getKey(v, c))
+	c.Assert(err, IsNil)
+
+	retR, err := lhClient.LonghornV1alpha1().Replicas(TestNamespace).Get(r.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(retR.Spec.NodeID, Equals, TestNode1)
+	c.Assert(retR.Spec.DiskID, Equals, TestDiskID1)
+	c.Assert(retR.Spec.DataPath, Not(Equals), r.Spec.DataPath)
+	c.Assert(retR.Status.SchedulingDecision, Equals, types.ReplicaSchedulingDecisionNewNode)
+
+	// the running replica would be stopped before disk selection
+	r = retR.DeepCopy()
+	r.Spec.DiskID = "removed-disk"
+	r.Spec.DesireState = types.InstanceStateRunning
+	r.Status.CurrentState = types.InstanceStateError
+	r, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Update(r)
+	c.Assert(err, IsNil)
+	c.Assert(rIndexer.Update(r), IsNil)
+
+	err = vc.syncVolume(getKey(v, c))
+	c.Assert(err, IsNil)
+
+	retR, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Get(r.Name, metav1.GetOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(retR.Spec.DiskID, Equals, "removed-disk")
+	c.Assert(retR.Spec.DesireState, Equals, types.InstanceStateStopped)
+}
+
+func (s *TestSuite) TestReplicaEviction(c *C) {
+	var err error
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	vIndexer := lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer()
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	node := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	disk := node.Spec.Disks[TestDiskID1]
+	disk.EvictionRequested = true
+	node.Spec.Disks[TestDiskID1] = disk
+	n, err := lhClient.Longhorn().Nodes(TestNamespace).Create(node)
+	c.Assert(err, IsNil)
+	c.Assert(nIndexer.Add(n), IsNil)
+
+	volume := newVolume(TestVolumeName, 2)
+	volume.Spec.NodeID = TestNode1
+	volume.Status.State = types.VolumeStateAttached
+	volume.Status.Robustness = types.VolumeRobustnessHealthy
+	volume.Status.CurrentImage = TestEngineImage
+	engine := newEngineForVolume(volume)
+	replica1 := newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+	replica1.Spec.HealthyAt = getTestNow()
+	replica2 := newReplicaForVolume(volume, engine, TestNode2, TestDiskID1)
+	replica2.Spec.HealthyAt = getTestNow()
+	for _, r := range []*longhorn.Replica{replica1, replica2} {
+		_, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(r)
+		c.Assert(err, IsNil)
+	}
+	rs := map[string]*longhorn.Replica{
+		replica1.Name: replica1,
+		replica2.Name: replica2,
+	}
+
+	// wait for the other volume to finish the eviction
+	otherVolume := newVolume("other-volume", 2)
+	otherVolume.Namespace = TestNamespace
+	otherVolume.Status.EvictingReplica = "other-volume-r-evicting"
+	c.Assert(vIndexer.Add(otherVolume), IsNil)
+	err = vc.evictReplicas(volume, engine, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs, HasLen, 2)
+	c.Assert(volume.Status.EvictingReplica, Equals, "")
+
+	// rebuild the replacement first
+	c.Assert(vIndexer.Delete(otherVolume), IsNil)
+	err = vc.evictReplicas(volume, engine, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs, HasLen, 3)
+	c.Assert(volume.Status.EvictingReplica, Equals, replica1.Name)
+	replacement := rs[volume.Status.ReplacementReplica]
+	c.Assert(replacement, NotNil)
+	c.Assert(replacement.Spec.NodeID, Equals, "")
+
+	// keep the evicting replica until the replacement becomes healthy
+	err = vc.evictReplicas(volume, engine, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs, HasLen, 3)
+
+	replacement.Spec.NodeID = TestNode2
+	replacement.Spec.DiskID = TestDiskID1
+	replacement.Spec.HealthyAt = getTestNow()
+	err = vc.evictReplicas(volume, engine, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs, HasLen, 2)
+	c.Assert(rs[replica1.Name], IsNil)
+	c.Assert(volume.Status.EvictingReplica, Equals, "")
+	c.Assert(volume.Status.ReplacementReplica, Equals, "")
+	_, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Get(replica1.Name, metav1.GetOptions{})
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+
+	// canceling the eviction removes the replacement still rebuilding
+	replica3 := newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+	replica3.Spec.HealthyAt = getTestNow()
+	_, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(replica3)
+	c.Assert(err, IsNil)
+	rs = map[string]*longhorn.Replica{
+		replica2.Name: replica2,
+		replica3.Name: replica3,
+	}
+	err = vc.evictReplicas(volume, engine, rs)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Status.EvictingReplica, Equals, replica3.Name)
+	replacementName := volume.Status.ReplacementReplica
+
+	disk.EvictionRequested = false
+	node.Spec.Disks[TestDiskID1] = disk
+	c.Assert(nIndexer.Update(node), IsNil)
+	err = vc.evictReplicas(volume, engine, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs, HasLen, 2)
+	c.Assert(rs[replica3.Name], NotNil)
+	c.Assert(volume.Status.EvictingReplica, Equals, "")
+	_, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Get(replacementName, metav1.GetOptions{})
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+
+	// the eviction of the node covers all the disks on it
+	node.Spec.EvictionRequested = true
+	c.Assert(nIndexer.Update(node), IsNil)
+	requested, err := vc.isReplicaEvictionRequested(replica3)
+	c.Assert(err, IsNil)
+	c.Assert(requested, Equals, true)
+}
+
+func (s *TestSuite) TestDetachForNodeMaintenance(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+	rIndexer := lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	node1 := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node1.Spec.MaintenanceMode = true
+	node2 := newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")
+	c.Assert(nIndexer.Add(node1), IsNil)
+	c.Assert(nIndexer.Add(node2), IsNil)
+
+	volume := newVolume(TestVolumeName, 2)
+	volume.Spec.NodeID = TestNode1
+	volume.Status.State = types.VolumeStateAttached
+	engine := newEngineForVolume(volume)
+	replica1 := newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+	replica1.Namespace = TestNamespace
+	replica1.Spec.HealthyAt = getTestNow()
+	replica2 := newReplicaForVolume(volume, engine, TestNode2, TestDiskID1)
+	replica2.Namespace = TestNamespace
+	c.Assert(rIndexer.Add(replica1), IsNil)
+	c.Assert(rIndexer.Add(replica2), IsNil)
+
+	// keep the volume attached if the only healthy replica is on the node
+	err := vc.detachForNodeMaintenance(volume)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Spec.NodeID, Equals, TestNode1)
+
+	replica2.Spec.HealthyAt = getTestNow()
+	c.Assert(rIndexer.Update(replica2), IsNil)
+	err = vc.detachForNodeMaintenance(volume)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Spec.NodeID, Equals, "")
+}
+
+func (s *TestSuite) TestCleanupReplicasOnRemovedNodes(c *C) {
+	var err error
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	node1 := newNode(TestNode1, TestNamespace, false, types.ConditionStatusFalse, types.NodeConditionReasonKubernetesNodeDown)
+	node2 := newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")
+	c.Assert(nIndexer.Add(node1), IsNil)
+	c.Assert(nIndexer.Add(node2), IsNil)
+
+	volume := newVolume(TestVolumeName, 2)
+	engine := newEngineForVolume(volume)
+	replica1 := newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+	replica2 := newReplicaForVolume(volume, engine, TestNode2, TestDiskID1)
+	for _, r := range []*longhorn.Replica{replica1, replica2} {
+		_, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(r)
+		c.Assert(err, IsNil)
+	}
+	rs := map[string]*longhorn.Replica{
+		replica1.Name: replica1,
+		replica2.Name: replica2,
+	}
+
+	// fail the replica on the removed node so it would be rebuilt
+	err = vc.cleanupReplicasOnRemovedNodes(volume, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs, HasLen, 2)
+	c.Assert(rs[replica1.Name].Spec.FailedAt, Not(Equals), "")
+	c.Assert(rs[replica1.Name].Status.FailureReason, Equals, types.ReplicaFailureReasonNodeRemoved)
+	c.Assert(rs[replica2.Name].Spec.FailedAt, Equals, "")
+
+	// delete it once the node is being deleted
+	now := metav1.Now()
+	node1.DeletionTimestamp = &now
+	c.Assert(nIndexer.Update(node1), IsNil)
+	err = vc.cleanupReplicasOnRemovedNodes(volume, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs, HasLen, 1)
+	c.Assert(rs[replica2.Name], NotNil)
+	_, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Get(replica1.Name, metav1.GetOptions{})
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+}
+
+func (s *TestSuite) TestFailReplicasOnUnhealthyDisks(c *C) {
+	var err error
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	node1 := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	node1.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			Conditions: map[types.DiskConditionType]types.Condition{
+				types.DiskConditionTypeReady: newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusFalse, types.DiskConditionReasonDiskHealthProbeFailed),
+			},
+		},
+	}
+	node2 := newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")
+	c.Assert(nIndexer.Add(node1), IsNil)
+	c.Assert(nIndexer.Add(node2), IsNil)
+
+	volume := newVolume(TestVolumeName, 2)
+	engine := newEngineForVolume(volume)
+	replica1 := newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+	replica2 := newReplicaForVolume(volume, engine, TestNode2, TestDiskID1)
+	for _, r := range []*longhorn.Replica{replica1, replica2} {
+		r.Spec.HealthyAt = getTestNow()
+		_, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(r)
+		c.Assert(err, IsNil)
+	}
+	rs := map[string]*longhorn.Replica{
+		replica1.Name: replica1,
+		replica2.Name: replica2,
+	}
+
+	// nothing happens unless the setting is enabled
+	err = vc.failReplicasOnUnhealthyDisks(volume, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs[replica1.Name].Spec.FailedAt, Equals, "")
+
+	setting := &longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      string(types.SettingNameDiskHealthProbeReplicaRebuild),
+			Namespace: TestNamespace,
+		},
+		Setting: types.Setting{
+			Value: "true",
+		},
+	}
+	c.Assert(sIndexer.Add(setting), IsNil)
+
+	// the replica on the unhealthy disk is kept if it's the last healthy one
+	rs[replica2.Name].Spec.FailedAt = getTestNow()
+	err = vc.failReplicasOnUnhealthyDisks(volume, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs[replica1.Name].Spec.FailedAt, Equals, "")
+
+	rs[replica2.Name].Spec.FailedAt = ""
+	err = vc.failReplicasOnUnhealthyDisks(volume, rs)
+	c.Assert(err, IsNil)
+	c.Assert(rs[replica1.Name].Spec.FailedAt, Not(Equals), "")
+	c.Assert(rs[replica1.Name].Status.FailureReason, Equals, types.ReplicaFailureReasonDiskUnhealthy)
+	c.Assert(rs[replica2.Name].Spec.FailedAt, Equals, "")
+}
+
+func (s *TestSuite) TestGetReplicaFailureReason(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	readyNode := newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")
+	readyNode.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			Conditions: map[types.DiskConditionType]types.Condition{
+				types.DiskConditionTypeReady: newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusTrue, ""),
+			},
+		},
+	}
+	removedNode := newNode(TestNode1, TestNamespace, true, types.ConditionStatusFalse, types.NodeConditionReasonKubernetesNodeDown)
+	downNode := newNode(TestNode1, TestNamespace, true, types.ConditionStatusFalse, types.NodeConditionReasonManagerPodDown)
+	diskRemovedNode := readyNode.DeepCopy()
+	diskRemovedNode.Spec.Disks = map[string]types.DiskSpec{}
+	diskNotReadyNode := readyNode.DeepCopy()
+	diskNotReadyNode.Status.DiskStatus[TestDiskID1] = types.DiskStatus{
+		Conditions: map[types.DiskConditionType]types.Condition{
+			types.DiskConditionTypeReady: newNodeCondition(types.DiskConditionTypeReady, types.ConditionStatusFalse, types.DiskConditionReasonNoDiskInfo),
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		node         *longhorn.Node
+		neverHealthy bool
+		currentState types.InstanceState
+		reason       types.ReplicaFailureReason
+	}{
+		{"rebuilding replica", readyNode, true, types.InstanceStateRunning, types.ReplicaFailureReasonRebuildFailed},
+		// the replica never healthy has no complete data, wherever it is
+		{"rebuilding replica on node down", downNode, true, types.InstanceStateRunning, types.ReplicaFailureReasonRebuildFailed},
+		{"node removed", removedNode, false, types.InstanceStateRunning, types.ReplicaFailureReasonNodeRemoved},
+		{"node down", downNode, false, types.InstanceStateRunning, types.ReplicaFailureReasonNodeDown},
+		{"disk removed", diskRemovedNode, false, types.InstanceStateRunning, types.ReplicaFailureReasonDiskUnschedulable},
+		{"disk not ready", diskNotReadyNode, false, types.InstanceStateRunning, types.ReplicaFailureReasonDiskUnschedulable},
+		{"process crashed", readyNode, false, types.InstanceStateError, types.ReplicaFailureReasonCrashLoop},
+		{"marked by engine", readyNode, false, types.InstanceStateRunning, types.ReplicaFailureReasonEngineMarkedERR},
+		// the failure is still recorded if the node cannot be found
+		{"node not found", nil, false, types.InstanceStateRunning, types.ReplicaFailureReasonEngineMarkedERR},
+	}
+	for _, tc := range testCases {
+		fmt.Printf("testing %v\n", tc.name)
+		for _, obj := range nIndexer.List() {
+			c.Assert(nIndexer.Delete(obj), IsNil)
+		}
+		if tc.node != nil {
+			c.Assert(nIndexer.Add(tc.node), IsNil)
+		}
+
+		volume := newVolume(TestVolumeName, 2)
+		engine := newEngineForVolume(volume)
+		r := newReplicaForVolume(volume, engine, TestNode1, TestDiskID1)
+		if !tc.neverHealthy {
+			r.Spec.HealthyAt = getTestNow()
+		}
+		r.Status.CurrentState = tc.currentState
+		c.Assert(vc.getReplicaFailureReason(r), Equals, tc.reason, Commentf(tc.name))
+	}
+}
+
+func (s *TestSuite) TestMarkReplicaFailed(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+	fakeRecorder := vc.eventRecorder.(*record.FakeRecorder)
+
+	for _, reason := range []types.ReplicaFailureReason{
+		types.ReplicaFailureReasonNodeDown,
+		types.ReplicaFailureReasonNodeRemoved,
+		types.ReplicaFailureReasonDiskUnschedulable,
+		types.ReplicaFailureReasonDiskUnhealthy,
+		types.ReplicaFailureReasonEngineMarkedERR,
+		types.ReplicaFailureReasonRebuildFailed,
+		types.ReplicaFailureReasonCrashLoop,
+	} {
+		fmt.Printf("testing %v\n", reason)
+		volume := newVolume(TestVolumeName, 2)
+		engine := newEngineForVolume(volume)
+		r := newReplicaForVolume(volume, engine, TestNode2, TestDiskID1)
+		r.Namespace = TestNamespace
+		r.Spec.HealthyAt = getTestNow()
+		r, err := lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(r)
+		c.Assert(err, IsNil)
+
+		r, err = vc.markReplicaFailed(volume, r, reason)
+		c.Assert(err, IsNil)
+
+		// the failure is kept in the status, where the salvage won't
+		// clear it
+		r, err = lhClient.LonghornV1alpha1().Replicas(TestNamespace).Get(r.Name, metav1.GetOptions{})
+		c.Assert(err, IsNil)
+		c.Assert(r.Spec.FailedAt, Equals, getTestNow())
+		c.Assert(r.Status.FailedAt, Equals, getTestNow())
+		c.Assert(r.Status.FailureReason, Equals, reason)
+		c.Assert(r.Status.FailedNodeID, Equals, TestNode2)
+		c.Assert(r.Status.FailedDiskID, Equals, TestDiskID1)
+
+		c.Assert(fakeRecorder.Events, HasLen, 1)
+		event := <-fakeRecorder.Events
+		c.Assert(event, Matches, "Warning "+EventReasonFaulted+" replica "+r.Name+" .* due to "+string(reason)+", on node "+TestNode2+" disk "+TestDiskID1)
+	}
+}
+
+func (s *TestSuite) TestIsReplicaRebuildFailed(c *C) {
+	r := &longhorn.Replica{}
+	// the replicas failed before the failure reason was recorded
+	c.Assert(isReplicaRebuildFailed(r), Equals, true)
+	r.Spec.HealthyAt = getTestNow()
+	c.Assert(isReplicaRebuildFailed(r), Equals, false)
+
+	// the recorded reason takes precedence, the salvaged replica may have
+	// been rebuilt before
+	r.Status.FailureReason = types.ReplicaFailureReasonRebuildFailed
+	c.Assert(isReplicaRebuildFailed(r), Equals, true)
+	r.Spec.HealthyAt = ""
+	r.Status.FailureReason = types.ReplicaFailureReasonNodeDown
+	c.Assert(isReplicaRebuildFailed(r), Equals, false)
+}
+
+func (s *TestSuite) TestBackupTargetCredentialSecretOverride(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+	cjIndexer := kubeInformerFactory.Batch().V1beta1().CronJobs().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	for name, value := range map[types.SettingName]string{
+		types.SettingNameBackupTarget:                 "s3://backupbucket@us-east-1/",
+		types.SettingNameBackupTargetCredentialSecret: "global-secret",
+	} {
+		c.Assert(sIndexer.Add(&longhorn.Setting{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      string(name),
+				Namespace: TestNamespace,
+			},
+			Setting: types.Setting{
+				Value: value,
+			},
+		}), IsNil)
+	}
+
+	volume := newVolume(TestVolumeName, 2)
+	volume.Spec.RecurringJobs = []types.RecurringJob{
+		{Name: "backup-global", Type: types.RecurringJobTypeBackup, Cron: "0 * * * *", Retain: 1},
+		{Name: "backup-job", Type: types.RecurringJobTypeBackup, Cron: "0 * * * *", Retain: 1, BackupTargetCredentialSecret: "job-secret"},
+	}
+	getCronJobSecret := func(jobName string) string {
+		cronJob, err := kubeClient.BatchV1beta1().CronJobs(TestNamespace).Get(types.GetCronJobNameForVolumeAndJob(volume.Name, jobName), metav1.GetOptions{})
+		c.Assert(err, IsNil)
+		for _, env := range cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Env {
+			if env.Name == util.AWSAccessKey {
+				return env.ValueFrom.SecretKeyRef.Name
+			}
+		}
+		c.Fatalf("no credential in cron job of %v", jobName)
+		return ""
+	}
+
+	// the job overrides the volume, which overrides the global secret
+	c.Assert(vc.updateRecurringJobs(volume), IsNil)
+	c.Assert(getCronJobSecret("backup-global"), Equals, "global-secret")
+	c.Assert(getCronJobSecret("backup-job"), Equals, "job-secret")
+
+	cronJobs, err := kubeClient.BatchV1beta1().CronJobs(TestNamespace).List(metav1.ListOptions{})
+	c.Assert(err, IsNil)
+	for i := range cronJobs.Items {
+		c.Assert(cjIndexer.Add(&cronJobs.Items[i]), IsNil)
+	}
+	volume.Spec.BackupTargetCredentialSecret = "volume-secret"
+	c.Assert(vc.updateRecurringJobs(volume), IsNil)
+	c.Assert(getCronJobSecret("backup-global"), Equals, "volume-secret")
+	c.Assert(getCronJobSecret("backup-job"), Equals, "job-secret")
+
+	// the restore records the secret of the volume, or the global one
+	engine := newEngineForVolume(volume)
+	volume.Spec.FromBackup = "s3://backupbucket@us-east-1/?backup=backup-1&volume=" + volume.Name
+	r, err := vc.createReplica(volume, engine, nil)
+	c.Assert(err, IsNil)
+	c.Assert(r.Spec.RestoreCredentialSecret, Equals, "volume-secret")
+
+	volume.Spec.BackupTargetCredentialSecret = ""
+	r, err = vc.createReplica(volume, engine, nil)
+	c.Assert(err, IsNil)
+	c.Assert(r.Spec.RestoreCredentialSecret, Equals, "global-secret")
+}
+
+func (s *TestSuite) TestTrashedVolume(c *C) {
+	var err error
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	c.Assert(sIndexer.Add(&longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      string(types.SettingNameVolumeDeletionGracePeriod),
+			Namespace: TestNamespace,
+		},
+		Setting: types.Setting{
+			Value: "60",
+		},
+	}), IsNil)
+	c.Assert(nIndexer.Add(newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue, "")), IsNil)
+	c.Assert(nIndexer.Add(newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue, "")), IsNil)
+
+	volume := newVolume(TestVolumeName, 2)
+	volume.Spec.TrashedAt = util.Now()
+	volume.Spec.PendingNodeID = TestNode1
+	volume.Status.State = types.VolumeStateDetached
+	volume.Status.CurrentImage = volume.Spec.EngineImage
+	engine := newEngineForVolume(volume)
+	engine.Status.CurrentState = types.InstanceStateStopped
+	rs := map[string]*longhorn.Replica{}
+	for _, nodeID := range []string{TestNode1, TestNode2} {
+		r := newReplicaForVolume(volume, engine, nodeID, TestDiskID1)
+		r.Spec.HealthyAt = getTestNow()
+		r.Status.CurrentState = types.InstanceStateStopped
+		rs[r.Name] = r
+	}
+
+	// the volume in the trash stays detached, rather than reattached
+	err = vc.ReconcileVolumeState(volume, engine, rs)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Status.State, Equals, types.VolumeStateTrashed)
+	c.Assert(volume.Spec.NodeID, Equals, "")
+	c.Assert(volume.Spec.PendingNodeID, Equals, "")
+
+	volume.Spec.TrashedAt = ""
+	err = vc.ReconcileVolumeState(volume, engine, rs)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Status.State, Equals, types.VolumeStateDetached)
+
+	// cleaned up once the grace period expires
+	volume.Spec.TrashedAt = util.Now()
+	volume, err = lhClient.LonghornV1alpha1().Volumes(TestNamespace).Create(volume)
+	c.Assert(err, IsNil)
+	cleaned, err := vc.cleanupExpiredTrashedVolume(volume)
+	c.Assert(err, IsNil)
+	c.Assert(cleaned, Equals, false)
+
+	volume.Spec.TrashedAt = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	cleaned, err = vc.cleanupExpiredTrashedVolume(volume)
+	c.Assert(err, IsNil)
+	c.Assert(cleaned, Equals, true)
+	_, err = lhClient.LonghornV1alpha1().Volumes(TestNamespace).Get(volume.Name, metav1.GetOptions{})
+	c.Assert(datastore.ErrorIsNotFound(err), Equals, true)
+}
+
+// newBenchmarkVolumeController returns the volume controller with the
+// detached volume of the test case template, and the informer cache filled
+// with the other volumes, their engines and replicas, which the sync of the
+// volume shouldn't go through
+func newBenchmarkVolumeController(b *testing.B, volumeCount int) (*VolumeController, string) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	vIndexer := lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer()
+	eIndexer := lhInformerFactory.Longhorn().V1alpha1().Engines().Informer().GetIndexer()
+	rIndexer := lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer()
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+	pIndexer := kubeInformerFactory.Core().V1().Pods().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+
+	mustAdd := func(indexer cache.Indexer, obj interface{}) {
+		if err := indexer.Add(obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+	mustAdd(pIndexer, newDaemonPod(v1.PodRunning, TestDaemon1, TestNamespace, TestNode1, TestIP1, nil))
+	mustAdd(pIndexer, newDaemonPod(v1.PodRunning, TestDaemon2, TestNamespace, TestNode2, TestIP2, nil))
+
+	tc := generateVolumeTestCaseTemplate()
+	for _, node := range tc.nodes {
+		mustAdd(nIndexer, node)
+	}
+	for _, e := range tc.engines {
+		e.Namespace = TestNamespace
+		e.Status.CurrentState = types.InstanceStateStopped
+		mustAdd(eIndexer, e)
+	}
+	for _, r := range tc.replicas {
+		r.Namespace = TestNamespace
+		r.Status.CurrentState = types.InstanceStateStopped
+		mustAdd(rIndexer, r)
+	}
+	v, err := lhClient.LonghornV1alpha1().Volumes(TestNamespace).Create(tc.volume)
+	if err != nil {
+		b.Fatal(err)
+	}
+	mustAdd(vIndexer, v)
+
+	for i := 0; i < volumeCount; i++ {
+		other := newVolume(fmt.Sprintf("other-volume-%v", i), 2)
+		other.Namespace = TestNamespace
+		if i%2 == 0 {
+			other.Spec.OwnerID = TestOwnerID2
+		}
+		e := newEngineForVolume(other)
+		e.Namespace = TestNamespace
+		mustAdd(eIndexer, e)
+		for _, nodeID := range []string{TestNode1, TestNode2} {
+			r := newReplicaForVolume(other, e, nodeID, TestDiskID1)
+			r.Namespace = TestNamespace
+			mustAdd(rIndexer, r)
+		}
+		mustAdd(vIndexer, other)
+	}
+
+	key, err := controller.KeyFunc(v)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return vc, key
+}
+
+// BenchmarkVolumeControllerSync measures the sync of one volume against the
+// size of the cluster, which the cost shouldn't grow with
+func BenchmarkVolumeControllerSync(b *testing.B) {
+	for _, volumeCount := range []int{100, 1000, 5000} {
+		b.Run(fmt.Sprintf("volumes-%v", volumeCount), func(b *testing.B) {
+			vc, key := newBenchmarkVolumeController(b, volumeCount)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := vc.syncVolume(key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func (s *TestSuite) TestQoSSupportedCondition(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	eiIndexer := lhInformerFactory.Longhorn().V1alpha1().EngineImages().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+	fakeRecorder := vc.eventRecorder.(*record.FakeRecorder)
+
+	qosEngineImage := "longhorn-engine:qos"
+	c.Assert(eiIndexer.Add(newInstanceManagerEngineImage(TestEngineImage, engineapi.QoSMinCLIAPIVersion-1)), IsNil)
+	c.Assert(eiIndexer.Add(newInstanceManagerEngineImage(qosEngineImage, engineapi.QoSMinCLIAPIVersion)), IsNil)
+
+	volume := newVolume(TestVolumeName, 2)
+	volume.Status.CurrentImage = TestEngineImage
+
+	// no limits, nothing to tell
+	vc.syncQoSCondition(volume)
+	_, exists := volume.Status.Conditions[types.VolumeConditionTypeQoSSupported]
+	c.Assert(exists, Equals, false)
+
+	// the limits the engine image cannot apply are warned once
+	volume.Spec.QoS = types.VolumeQoS{ReadIOPS: 1000}
+	for i := 0; i < 3; i++ {
+		vc.syncQoSCondition(volume)
+	}
+	condition := volume.Status.Conditions[types.VolumeConditionTypeQoSSupported]
+	c.Assert(condition.Status, Equals, types.ConditionStatusFalse)
+	c.Assert(condition.Reason, Equals, types.VolumeConditionReasonEngineImageUnsupported)
+	c.Assert(fakeRecorder.Events, HasLen, 1)
+	event := <-fakeRecorder.Events
+	c.Assert(event, Matches, "Warning "+EventReasonQoSUnsupported+" QoS limits of volume "+TestVolumeName+" are not applied: .*")
+
+	// and cleared once upgraded
+	volume.Status.CurrentImage = qosEngineImage
+	vc.syncQoSCondition(volume)
+	condition = volume.Status.Conditions[types.VolumeConditionTypeQoSSupported]
+	c.Assert(condition.Status, Equals, types.ConditionStatusTrue)
+	c.Assert(condition.Reason, Equals, "")
+	c.Assert(fakeRecorder.Events, HasLen, 0)
+
+	volume.Spec.QoS = types.VolumeQoS{}
+	vc.syncQoSCondition(volume)
+	_, exists = volume.Status.Conditions[types.VolumeConditionTypeQoSSupported]
+	c.Assert(exists, Equals, false)
+}
+
+func (s *TestSuite) TestRecurringJobSchedule(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+	cjIndexer := kubeInformerFactory.Batch().V1beta1().CronJobs().Informer().GetIndexer()
+
+	vc := newTestVolumeController(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient, TestOwnerID1)
+	now := ""
+	vc.nowHandler = func() string {
+		return now
+	}
+
+	c.Assert(sIndexer.Add(&longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      string(types.SettingNameRecurringJobCatchUpWindow),
+			Namespace: TestNamespace,
+		},
+		Setting: types.Setting{
+			Value: "60",
+		},
+	}), IsNil)
+
+	volume := newVolume(TestVolumeName, 2)
+	volume.Status.State = types.VolumeStateAttached
+	volume.Status.Robustness = types.VolumeRobustnessHealthy
+	volume.Spec.RecurringJobs = []types.RecurringJob{
+		{Name: "snap-ny", Type: types.RecurringJobTypeSnapshot, Cron: "0 2 * * *", Retain: 1, Timezone: "America/New_York"},
+		{Name: "snap-utc", Type: types.RecurringJobTypeSnapshot, Cron: "0 2 * * *", Retain: 1},
+	}
+	nyCronJobName := types.GetCronJobNameForVolumeAndJob(volume.Name, "snap-ny")
+	listJobNames := func() []string {
+		jobs, err := vc.ds.ListCronJobJobs(nyCronJobName)
+		c.Assert(err, IsNil)
+		names := []string{}
+		for _, job := range jobs {
+			names = append(names, job.Name)
+		}
+		return names
+	}
+
+	// the CronJob of the job with the time zone is run by the controller
+	now = "2019-03-01T06:00:00Z"
+	c.Assert(vc.updateRecurringJobs(volume), IsNil)
+	cronJobs, err := kubeClient.BatchV1beta1().CronJobs(TestNamespace).List(metav1.ListOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(cronJobs.Items, HasLen, 2)
+	for i := range cronJobs.Items {
+		cronJob := &cronJobs.Items[i]
+		c.Assert(*cronJob.Spec.Suspend, Equals, cronJob.Name == nyCronJobName)
+		c.Assert(cjIndexer.Add(cronJob), IsNil)
+	}
+	c.Assert(volume.Status.RecurringJobStatus["snap-ny"].LastScheduledTime, Equals, now)
+	c.Assert(listJobNames(), HasLen, 0)
+
+	// 2:00 in New York is 7:00 in UTC
+	now = "2019-03-01T07:00:20Z"
+	c.Assert(vc.updateRecurringJobs(volume), IsNil)
+	c.Assert(volume.Status.RecurringJobStatus["snap-ny"].LastScheduledTime, Equals, "2019-03-01T07:00:00Z")
+	c.Assert(volume.Status.RecurringJobStatus["snap-utc"].LastScheduledTime, Equals, "2019-03-01T06:00:00Z")
+	c.Assert(listJobNames(), DeepEquals, []string{fmt.Sprintf("%v-%d", nyCronJobName, time.Date(2019, 3, 1, 7, 0, 0, 0, time.UTC).Unix()/60)})
+	c.Assert(volume.Status.SkippedRecurringJobRuns, HasLen, 0)
+
+	jobs, err := vc.ds.ListCronJobJobs(nyCronJobName)
+	c.Assert(err, IsNil)
+	finished := jobs[0]
+	finished.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: v1.ConditionTrue}}
+	_, err = kubeClient.BatchV1().Jobs(TestNamespace).Update(&finished)
+	c.Assert(err, IsNil)
+
+	// the runs are skipped while the volume is detached, and caught up once
+	// it's attached again
+	volume.Status.State = types.VolumeStateDetached
+	now = "2019-03-02T07:10:00Z"
+	c.Assert(vc.updateRecurringJobs(volume), IsNil)
+	c.Assert(volume.Status.SkippedRecurringJobRuns, DeepEquals, []types.SkippedRecurringJobRun{
+		{Job: "snap-ny", ScheduledTime: "2019-03-02T07:00:00Z", Reason: types.RecurringJobSkipReasonVolumeDetached, Message: "volume is detached"},
+		{Job: "snap-utc", ScheduledTime: "2019-03-02T02:00:00Z", Reason: types.RecurringJobSkipReasonVolumeDetached, Message: "volume is detached"},
+	})
+	c.Assert(volume.Status.RecurringJobStatus["snap-ny"].PendingCatchUpTime, Equals, "2019-03-02T07:00:00Z")
+	c.Assert(listJobNames(), HasLen, 1)
+
+	volume.Status.State = types.VolumeStateAttached
+	now = "2019-03-02T07:30:00Z"
+	c.Assert(vc.updateRecurringJobs(volume), IsNil)
+	c.Assert(volume.Status.RecurringJobStatus["snap-ny"].PendingCatchUpTime, Equals, "")
+	c.Assert(listJobNames(), HasLen, 2)
+	// the UTC one is out of the window
+	c.Assert(volume.Status.RecurringJobStatus["snap-utc"].PendingCatchUpTime, Equals, "")
+
+	// skipped if the run before is still running
+	now = "2019-03-03T07:00:10Z"
+	c.Assert(vc.updateRecurringJobs(volume), IsNil)
+	c.Assert(volume.Status.SkippedRecurringJobRuns, HasLen, 3)
+	skipped := volume.Status.SkippedRecurringJobRuns[2]
+	c.Assert(skipped.Job, Equals, "snap-ny")
+	c.Assert(skipped.Reason, Equals, types.RecurringJobSkipReasonJobRunning)
+	c.Assert(volume.Status.RecurringJobStatus["snap-ny"].PendingCatchUpTime, Equals, "")
+	c.Assert(listJobNames(), HasLen, 2)
+
+	// only the latest skipped runs are kept
+	volume.Status.State = types.VolumeStateDetached
+	for day := 4; day < 20; day++ {
+		now = fmt.Sprintf("2019-03-%02dT08:00:00Z", day)
+		c.Assert(vc.updateRecurringJobs(volume), IsNil)
+	}
+	c.Assert(volume.Status.SkippedRecurringJobRuns, HasLen, types.MaxSkippedRecurringJobRuns)
+	// New York is on the daylight saving time since Mar 10
+	c.Assert(volume.Status.SkippedRecurringJobRuns[types.MaxSkippedRecurringJobRuns-2].ScheduledTime, Equals, "2019-03-19T06:00:00Z")
+	c.Assert(volume.Status.SkippedRecurringJobRuns[types.MaxSkippedRecurringJobRuns-1].ScheduledTime, Equals, "2019-03-19T02:00:00Z")
+}
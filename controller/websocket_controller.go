@@ -5,6 +5,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/kubernetes/pkg/controller"
 
@@ -31,6 +32,43 @@ func (w *Watcher) Close() {
 	close(w.eventChan)
 }
 
+// ChangeWatcherBufferSize is how many changes can be queued for a change
+// watcher before it's considered overflowed
+const ChangeWatcherBufferSize = 1024
+
+type ChangeType string
+
+const (
+	ChangeTypeCreated = ChangeType("created")
+	ChangeTypeUpdated = ChangeType("updated")
+	ChangeTypeDeleted = ChangeType("deleted")
+)
+
+// Change is an object of the resource created, updated or deleted. Obj is
+// the last known state of the object.
+type Change struct {
+	Resource string
+	Type     ChangeType
+	Obj      interface{}
+}
+
+// ChangeWatcher receives the changes of the resources it subscribes. If the
+// receiver falls too far behind, the changes are dropped and Overflowed() is
+// signaled, so the receiver must start over from the current state.
+type ChangeWatcher struct {
+	changeChan   chan Change
+	overflowChan chan struct{}
+	resources    map[string]struct{}
+}
+
+func (w *ChangeWatcher) Changes() <-chan Change {
+	return w.changeChan
+}
+
+func (w *ChangeWatcher) Overflowed() <-chan struct{} {
+	return w.overflowChan
+}
+
 type WebsocketController struct {
 	volumeSynced      cache.InformerSynced
 	engineSynced      cache.InformerSynced
@@ -39,8 +77,9 @@ type WebsocketController struct {
 	engineImageSynced cache.InformerSynced
 	nodeSynced        cache.InformerSynced
 
-	watchers    []*Watcher
-	watcherLock sync.Mutex
+	watchers       []*Watcher
+	changeWatchers []*ChangeWatcher
+	watcherLock    sync.Mutex
 }
 
 func NewWebsocketController(
@@ -68,6 +107,12 @@ func NewWebsocketController(
 	engineImageInformer.Informer().AddEventHandler(wc.notifyWatchersHandler("engineImage"))
 	nodeInformer.Informer().AddEventHandler(wc.notifyWatchersHandler("node"))
 
+	volumeInformer.Informer().AddEventHandler(wc.notifyChangeWatchersHandler("volume"))
+	engineInformer.Informer().AddEventHandler(wc.notifyChangeWatchersHandler("engine"))
+	replicaInformer.Informer().AddEventHandler(wc.notifyChangeWatchersHandler("replica"))
+	settingInformer.Informer().AddEventHandler(wc.notifyChangeWatchersHandler("setting"))
+	nodeInformer.Informer().AddEventHandler(wc.notifyChangeWatchersHandler("node"))
+
 	return wc
 }
 
@@ -84,6 +129,36 @@ func (wc *WebsocketController) NewWatcher(resources ...string) *Watcher {
 	return w
 }
 
+// NewChangeWatcher subscribes the changes of the resources. The watcher must
+// be removed by RemoveChangeWatcher once it's no longer used.
+func (wc *WebsocketController) NewChangeWatcher(resources ...string) *ChangeWatcher {
+	wc.watcherLock.Lock()
+	defer wc.watcherLock.Unlock()
+
+	w := &ChangeWatcher{
+		changeChan:   make(chan Change, ChangeWatcherBufferSize),
+		overflowChan: make(chan struct{}, 1),
+		resources:    map[string]struct{}{},
+	}
+	for _, r := range resources {
+		w.resources[r] = struct{}{}
+	}
+	wc.changeWatchers = append(wc.changeWatchers, w)
+	return w
+}
+
+func (wc *WebsocketController) RemoveChangeWatcher(w *ChangeWatcher) {
+	wc.watcherLock.Lock()
+	defer wc.watcherLock.Unlock()
+
+	for i, cw := range wc.changeWatchers {
+		if cw == w {
+			wc.changeWatchers = append(wc.changeWatchers[:i], wc.changeWatchers[i+1:]...)
+			return
+		}
+	}
+}
+
 func (wc *WebsocketController) Run(stopCh <-chan struct{}) {
 	defer wc.Close()
 
@@ -132,3 +207,50 @@ func (wc *WebsocketController) notifyWatchersFunc(resource string) func() {
 		}
 	}
 }
+
+func (wc *WebsocketController) notifyChangeWatchersHandler(resource string) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			wc.notifyChangeWatchers(Change{Resource: resource, Type: ChangeTypeCreated, Obj: obj})
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// nothing changed in the periodic resync
+			oldMeta, err := meta.Accessor(oldObj)
+			if err != nil {
+				return
+			}
+			newMeta, err := meta.Accessor(newObj)
+			if err != nil {
+				return
+			}
+			if oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+				return
+			}
+			wc.notifyChangeWatchers(Change{Resource: resource, Type: ChangeTypeUpdated, Obj: newObj})
+		},
+		DeleteFunc: func(obj interface{}) {
+			if deletedState, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = deletedState.Obj
+			}
+			wc.notifyChangeWatchers(Change{Resource: resource, Type: ChangeTypeDeleted, Obj: obj})
+		},
+	}
+}
+
+func (wc *WebsocketController) notifyChangeWatchers(change Change) {
+	wc.watcherLock.Lock()
+	defer wc.watcherLock.Unlock()
+	for _, w := range wc.changeWatchers {
+		if _, ok := w.resources[change.Resource]; !ok {
+			continue
+		}
+		select {
+		case w.changeChan <- change:
+		default:
+			select {
+			case w.overflowChan <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
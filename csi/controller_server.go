@@ -3,6 +3,9 @@ package csi
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -10,6 +13,7 @@ import (
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/validation"
 	volumeutil "k8s.io/kubernetes/pkg/volume/util"
 
 	longhornclient "github.com/rancher/longhorn-manager/client"
@@ -48,9 +52,16 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if len(req.GetName()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume Name cannot be empty")
 	}
+	if err := util.ValidateVolumeName(req.GetName()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities cannot be empty")
 	}
+	rox, err := getReadOnlyManyRequired(req.GetVolumeCapabilities())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	// check for already existing volume name
 	// ID and name are same in longhorn API
@@ -60,6 +71,9 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 	if existVol != nil && existVol.Name == req.GetName() {
 		logrus.Debugf("CreateVolume: got an exist volume: %s", existVol.Name)
+		if rox && existVol.AccessMode != string(types.VolumeAccessModeReadOnlyMany) {
+			return nil, status.Errorf(codes.AlreadyExists, "The volume %s exists without ReadOnlyMany support", existVol.Name)
+		}
 		exVolSize, err := util.ConvertSize(existVol.Size)
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
@@ -79,6 +93,24 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 
 	vol.Name = req.Name
+	if snapshot := req.GetVolumeContentSource().GetSnapshot(); snapshot != nil {
+		backupURL, err := cs.getSnapshotBackupURL(snapshot.GetId())
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("CreateVolume: restoring volume %s from snapshot %s", vol.Name, snapshot.GetId())
+		vol.FromBackup = backupURL
+	}
+	if rox {
+		// the nodes attached read-only log in the iSCSI target of the
+		// engine, instead of having the block device
+		vol.AccessMode = string(types.VolumeAccessModeReadOnlyMany)
+		vol.Frontend = string(types.VolumeFrontendISCSI)
+	}
+	// the replicas are placed in the zones the workload can be scheduled
+	// to. The volume itself is accessible from all the nodes, since the
+	// engine runs on the node it's attached to.
+	vol.ZoneSelector = getRequisiteZones(req.GetAccessibilityRequirements())
 
 	volSizeBytes := int64(volumeutil.GIB)
 	if req.GetCapacityRange() != nil {
@@ -98,6 +130,7 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			Id:            resVol.Id,
 			CapacityBytes: int64(volSizeGiB * volumeutil.GIB),
 			Attributes:    req.GetParameters(),
+			ContentSource: req.GetVolumeContentSource(),
 		},
 	}, nil
 }
@@ -129,10 +162,20 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 
 func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	logrus.Infof("ControllerServer ValidateVolumeCapabilities req: %v", req)
-	for _, cap := range req.GetVolumeCapabilities() {
-		if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-			return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: ""}, nil
-		}
+	existVol, err := cs.apiClient.Volume.ById(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if existVol == nil {
+		return nil, status.Errorf(codes.NotFound, "The volume %s not exists", req.GetVolumeId())
+	}
+	// ReadOnlyMany is only supported by the volume created for it
+	rox, err := getReadOnlyManyRequired(req.GetVolumeCapabilities())
+	if err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: err.Error()}, nil
+	}
+	if rox && existVol.AccessMode != string(types.VolumeAccessModeReadOnlyMany) {
+		return &csi.ValidateVolumeCapabilitiesResponse{Supported: false, Message: "The volume is not created with ReadOnlyMany support"}, nil
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{Supported: true, Message: ""}, nil
 }
@@ -140,59 +183,122 @@ func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 // ControllerPublishVolume will attach the volume to the specified node
 func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	logrus.Infof("ControllerServer ControllerPublishVolume req: %v", req)
-	existVol, err := cs.apiClient.Volume.ById(req.GetVolumeId())
+	volumeID := req.GetVolumeId()
+	nodeID := req.GetNodeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
+	if len(nodeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Node ID cannot be empty")
+	}
+
+	existVol, err := cs.apiClient.Volume.ById(volumeID)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if existVol == nil {
-		msg := fmt.Sprintf("ControllerPublishVolume: the volume %s not exists", req.GetVolumeId())
+		msg := fmt.Sprintf("ControllerPublishVolume: the volume %s not exists", volumeID)
 		logrus.Warn(msg)
 		return nil, status.Error(codes.NotFound, msg)
 	}
-	if existVol.State == string(types.VolumeStateAttaching) || existVol.State == string(types.VolumeStateDetaching) {
-		return nil, status.Errorf(codes.Aborted, "The volume %s is %s", req.GetVolumeId(), existVol.State)
+	existNode, err := cs.apiClient.Node.ById(nodeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if existNode == nil {
+		msg := fmt.Sprintf("ControllerPublishVolume: the node %s not exists", nodeID)
+		logrus.Warn(msg)
+		return nil, status.Error(codes.NotFound, msg)
 	}
 
-	needToAttach := true
-	if existVol.State == string(types.VolumeStateAttached) {
-		needToAttach = false
+	// the volume supporting ReadOnlyMany can be attached read-only to
+	// multiple nodes, in addition to the nodes it's attached to
+	readOnly := req.GetReadonly() && existVol.AccessMode == string(types.VolumeAccessModeReadOnlyMany)
+	joinReadOnly := readOnly && len(existVol.ReadOnlyNodeIDs) != 0 &&
+		(existVol.State == string(types.VolumeStateAttaching) || existVol.State == string(types.VolumeStateAttached))
+	if !joinReadOnly && isVolumeAttachedToOtherNode(existVol, nodeID) {
+		return nil, status.Errorf(codes.FailedPrecondition, "The volume %s is %s on the other node", volumeID, existVol.State)
 	}
 
-	logrus.Debugf("ControllerPublishVolume: current nodeID %s", req.GetNodeId())
-	if needToAttach {
-		// attach longhorn volume
-		input := &longhornclient.AttachInput{HostId: req.GetNodeId()}
-		existVol, err = cs.apiClient.Volume.ActionAttach(existVol, input)
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+	switch {
+	case existVol.State == string(types.VolumeStateDetached), joinReadOnly && !isReadOnlyNode(existVol, nodeID):
+		input := &longhornclient.AttachInput{HostId: nodeID, ReadOnly: readOnly}
+		if _, err = cs.apiClient.Volume.ActionAttach(existVol, input); err != nil {
+			// the attach request may have been applied anyway, in which
+			// case there is nothing left but to wait for it
+			vol, getErr := cs.apiClient.Volume.ById(volumeID)
+			if getErr != nil || vol == nil || vol.State == string(types.VolumeStateDetached) || !isVolumeOnNode(vol, nodeID) {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			logrus.Warnf("ControllerPublishVolume: volume %s is attaching to %s despite the error: %v", volumeID, nodeID, err)
 		}
-	} else {
-		logrus.Infof("ControllerPublishVolume: no need to attach volume %s", req.GetVolumeId())
+	case existVol.State == string(types.VolumeStateAttaching), existVol.State == string(types.VolumeStateAttached):
+		// left by the previous call, which may have failed after the
+		// attach request was accepted
+		logrus.Infof("ControllerPublishVolume: no need to attach volume %s, it's %s", volumeID, existVol.State)
+	default:
+		return nil, status.Errorf(codes.Aborted, "The volume %s is %s", volumeID, existVol.State)
 	}
 
-	if !cs.waitForAttach(req.GetVolumeId()) {
-		return nil, status.Errorf(codes.Aborted, "Attaching volume %s failed", req.GetVolumeId())
+	vol, attached := cs.waitForAttach(volumeID, nodeID)
+	if !attached {
+		return nil, status.Errorf(codes.Aborted, "Attaching volume %s failed", volumeID)
 	}
-	logrus.Debugf("Volume %s attached on %s", req.GetVolumeId(), req.GetNodeId())
+	logrus.Debugf("Volume %s attached on %s", volumeID, nodeID)
 
-	return &csi.ControllerPublishVolumeResponse{}, nil
+	return &csi.ControllerPublishVolumeResponse{PublishInfo: getPublishInfo(vol)}, nil
 }
 
-// ControllerUnpublishVolume will detach the volume
+// ControllerUnpublishVolume will detach the volume. The volume or the node no
+// longer exists, or the volume attached to the other node, is considered
+// detached from the node, as the CSI spec requires.
 func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	logrus.Infof("ControllerServer ControllerUnpublishVolume req: %v", req)
+	volumeID := req.GetVolumeId()
+	nodeID := req.GetNodeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID cannot be empty")
+	}
 
-	existVol, err := cs.apiClient.Volume.ById(req.GetVolumeId())
+	existVol, err := cs.apiClient.Volume.ById(volumeID)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if existVol == nil {
-		msg := fmt.Sprintf("ControllerPublishVolume: the volume %s not exists", req.GetVolumeId())
-		logrus.Warn(msg)
-		return nil, status.Error(codes.NotFound, msg)
+		logrus.Warnf("ControllerUnpublishVolume: the volume %s not exists, consider it detached", volumeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if isVolumeDetached(existVol) {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if nodeID != "" && isVolumeAttachedToOtherNode(existVol, nodeID) {
+		logrus.Infof("ControllerUnpublishVolume: volume %s is %s on the other node, no need to detach it from %s",
+			volumeID, existVol.State, nodeID)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	nodeExists := true
+	if nodeID != "" {
+		existNode, err := cs.apiClient.Node.ById(nodeID)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		nodeExists = existNode != nil
 	}
+	if !nodeExists {
+		// nothing can be done with the node any more. The detach request is
+		// best effort, so the volume can be attached elsewhere later.
+		logrus.Warnf("ControllerUnpublishVolume: the node %s not exists, consider volume %s detached", nodeID, volumeID)
+		if existVol.State == string(types.VolumeStateAttached) || existVol.State == string(types.VolumeStateAttaching) {
+			if _, err := cs.apiClient.Volume.ActionDetach(existVol, &longhornclient.DetachInput{HostId: nodeID}); err != nil {
+				logrus.Warnf("ControllerUnpublishVolume: failed to detach volume %s from the removed node %s: %v", volumeID, nodeID, err)
+			}
+		}
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
 	if existVol.State == string(types.VolumeStateDetaching) {
-		return nil, status.Errorf(codes.Aborted, "The volume %s is detaching", req.GetVolumeId())
+		return nil, status.Errorf(codes.Aborted, "The volume %s is detaching", volumeID)
 	}
 
 	needToDetach := false
@@ -202,7 +308,7 @@ func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 
 	if needToDetach {
 		// detach longhorn volume
-		_, err = cs.apiClient.Volume.ActionDetach(existVol)
+		_, err = cs.apiClient.Volume.ActionDetach(existVol, &longhornclient.DetachInput{HostId: nodeID})
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
@@ -210,22 +316,22 @@ func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
-	if !cs.waitForDetach(req.GetVolumeId()) {
-		return nil, status.Errorf(codes.Aborted, "Detaching volume %s failed", req.GetVolumeId())
+	if !cs.waitForDetach(volumeID, nodeID) {
+		return nil, status.Errorf(codes.Aborted, "Detaching volume %s failed", volumeID)
 	}
-	logrus.Debugf("Volume %s detached on %s", req.GetVolumeId(), req.GetNodeId())
+	logrus.Debugf("Volume %s detached on %s", volumeID, nodeID)
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-func (cs *ControllerServer) waitForAttach(volumeID string) (attached bool) {
+func (cs *ControllerServer) waitForAttach(volumeID, nodeID string) (vol *longhornclient.Volume, attached bool) {
 	timeout := time.After(timeoutAttachDetach)
 	tick := time.Tick(tickAttachDetach)
 	for {
 		select {
 		case <-timeout:
 			logrus.Warnf("waitForAttach: timeout to attach volume %s", volumeID)
-			return false
+			return nil, false
 		case <-tick:
 			logrus.Debugf("Trying to get %s attach status at %s", volumeID, time.Now().String())
 			existVol, err := cs.apiClient.Volume.ById(volumeID)
@@ -235,16 +341,22 @@ func (cs *ControllerServer) waitForAttach(volumeID string) (attached bool) {
 			}
 			if existVol == nil {
 				logrus.Warnf("waitForAttach: volume %s not exist", volumeID)
-				return false
+				return nil, false
 			}
-			if existVol.State == string(types.VolumeStateAttached) {
-				return true
+			if isVolumeAttachedToOtherNode(existVol, nodeID) {
+				logrus.Warnf("waitForAttach: volume %s is attached to the other node", volumeID)
+				return nil, false
+			}
+			// the iSCSI target is required for the node to log in
+			if existVol.State == string(types.VolumeStateAttached) &&
+				(existVol.Frontend != string(types.VolumeFrontendISCSI) || getPublishInfo(existVol) != nil) {
+				return existVol, true
 			}
 		}
 	}
 }
 
-func (cs *ControllerServer) waitForDetach(volumeID string) (attached bool) {
+func (cs *ControllerServer) waitForDetach(volumeID, nodeID string) (detached bool) {
 	timeout := time.After(timeoutAttachDetach)
 	tick := time.Tick(tickAttachDetach)
 	for {
@@ -264,9 +376,346 @@ func (cs *ControllerServer) waitForDetach(volumeID string) (attached bool) {
 				logrus.Warnf("waitForDetach: volume %s not exist", volumeID)
 				return true
 			}
-			if existVol.State == string(types.VolumeStateDetached) {
+			if isVolumeDetached(existVol) {
+				return true
+			}
+			if nodeID != "" && isVolumeAttachedToOtherNode(existVol, nodeID) {
 				return true
 			}
 		}
 	}
 }
+
+// CreateSnapshot takes the Longhorn snapshot named after the request, then
+// backs it up. The snapshot is ready to use once the backup is completed,
+// since the volumes are restored from the backup.
+func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	logrus.Infof("ControllerServer CreateSnapshot req: %v", req)
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		logrus.Errorf("CreateSnapshot: invalid create snapshot req: %v", req)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	volumeID := req.GetSourceVolumeId()
+	snapshotName := req.GetName()
+	if len(snapshotName) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot Name cannot be empty")
+	}
+	if errs := validation.IsDNS1123Subdomain(snapshotName); len(errs) != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid snapshot name %s: %s", snapshotName, strings.Join(errs, ", "))
+	}
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Source Volume ID cannot be empty")
+	}
+
+	existVol, err := cs.apiClient.Volume.ById(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if existVol == nil {
+		return nil, status.Errorf(codes.NotFound, "The volume %s not exists", volumeID)
+	}
+
+	backups, err := cs.getSnapshotBackups(existVol, volumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// the failed backup is requested again
+	if b, ok := backups[snapshotName]; ok && b.state != types.BackupTicketStateError {
+		logrus.Debugf("CreateSnapshot: got an exist snapshot %s of volume %s", snapshotName, volumeID)
+		return &csi.CreateSnapshotResponse{Snapshot: toCSISnapshot(volumeID, snapshotName, b)}, nil
+	}
+
+	// both the snapshot and the backup are taken by the engine
+	if existVol.State != string(types.VolumeStateAttached) {
+		return nil, status.Errorf(codes.FailedPrecondition, "The volume %s must be attached to take snapshot, it's %s", volumeID, existVol.State)
+	}
+	input := &longhornclient.SnapshotInput{Name: snapshotName}
+	if _, err := cs.apiClient.Volume.ActionSnapshotGet(existVol, input); err != nil {
+		logrus.Infof("CreateSnapshot: creating snapshot %s of volume %s", snapshotName, volumeID)
+		if _, err := cs.apiClient.Volume.ActionSnapshotCreate(existVol, input); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	logrus.Infof("CreateSnapshot: backing up snapshot %s of volume %s", snapshotName, volumeID)
+	backupStatus, err := cs.apiClient.Volume.ActionSnapshotBackup(existVol, input)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: toCSISnapshot(volumeID, snapshotName, &snapshotBackup{
+			state:   types.BackupTicketState(backupStatus.State),
+			error:   backupStatus.Error,
+			url:     backupStatus.Url,
+			created: backupStatus.Requested,
+			size:    existVol.Size,
+		}),
+	}, nil
+}
+
+// DeleteSnapshot deletes the backup from the backupstore, as well as the
+// Longhorn snapshot if the volume is attached. The snapshot left in the
+// detached volume is like the other snapshots of the volume, and can be
+// deleted by Longhorn afterwards.
+func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	logrus.Infof("ControllerServer DeleteSnapshot req: %v", req)
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		logrus.Errorf("DeleteSnapshot: invalid delete snapshot req: %v", req)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID cannot be empty")
+	}
+	volumeID, snapshotName, err := decodeSnapshotID(req.GetSnapshotId())
+	if err != nil {
+		// it cannot be created by the driver, so it's not existing
+		logrus.Warnf("DeleteSnapshot: %v", err)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	existVol, err := cs.apiClient.Volume.ById(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	backups, err := cs.getSnapshotBackups(existVol, volumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if b, ok := backups[snapshotName]; ok {
+		switch b.state {
+		case types.BackupTicketStatePending, types.BackupTicketStateInProgress:
+			return nil, status.Errorf(codes.Aborted, "The backup of snapshot %s of volume %s is in progress", snapshotName, volumeID)
+		case types.BackupTicketStateCompleted:
+			if err := cs.deleteBackup(volumeID, b); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+	}
+
+	if existVol != nil && existVol.State == string(types.VolumeStateAttached) {
+		input := &longhornclient.SnapshotInput{Name: snapshotName}
+		if _, err := cs.apiClient.Volume.ActionSnapshotGet(existVol, input); err == nil {
+			logrus.Infof("DeleteSnapshot: deleting snapshot %s of volume %s", snapshotName, volumeID)
+			if _, err := cs.apiClient.Volume.ActionSnapshotDelete(existVol, input); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots lists the snapshots backed up, of the volume or of all the
+// volumes in the backupstore. The starting token is the index of the entry
+// to start from.
+func (cs *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	logrus.Infof("ControllerServer ListSnapshots req: %v", req)
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		logrus.Errorf("ListSnapshots: invalid list snapshots req: %v", req)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volumeIDs := []string{}
+	snapshotName := ""
+	switch {
+	case req.GetSnapshotId() != "":
+		volumeID, name, err := decodeSnapshotID(req.GetSnapshotId())
+		if err != nil || (req.GetSourceVolumeId() != "" && req.GetSourceVolumeId() != volumeID) {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		volumeIDs = append(volumeIDs, volumeID)
+		snapshotName = name
+	case req.GetSourceVolumeId() != "":
+		volumeIDs = append(volumeIDs, req.GetSourceVolumeId())
+	default:
+		backupVolumes, err := cs.apiClient.BackupVolume.List(&longhornclient.ListOpts{})
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		for _, bv := range backupVolumes.Data {
+			volumeIDs = append(volumeIDs, bv.Name)
+		}
+	}
+
+	snapshots := []*csi.Snapshot{}
+	for _, volumeID := range volumeIDs {
+		existVol, err := cs.apiClient.Volume.ById(volumeID)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		backups, err := cs.getSnapshotBackups(existVol, volumeID)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		for name, b := range backups {
+			if snapshotName == "" || name == snapshotName {
+				snapshots = append(snapshots, toCSISnapshot(volumeID, name, b))
+			}
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Id < snapshots[j].Id })
+
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		var err error
+		if start, err = strconv.Atoi(token); err != nil || start < 0 || start > len(snapshots) {
+			return nil, status.Errorf(codes.Aborted, "Invalid starting token %s", token)
+		}
+	}
+	end := len(snapshots)
+	nextToken := ""
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+		nextToken = strconv.Itoa(end)
+	}
+	resp := &csi.ListSnapshotsResponse{NextToken: nextToken}
+	for _, snapshot := range snapshots[start:end] {
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+	return resp, nil
+}
+
+// getSnapshotBackups returns the backups of the snapshots of the volume by
+// the snapshot names. The backups in the backupstore are completed, the rest
+// are from the backup status of the volume, which is kept for a while after
+// the backup is finished. The volume is nil if it's deleted.
+func (cs *ControllerServer) getSnapshotBackups(vol *longhornclient.Volume, volumeID string) (map[string]*snapshotBackup, error) {
+	// the latest backup of the snapshot counts, e.g. the one retried after
+	// the failure
+	latest := map[string]*longhornclient.BackupStatus{}
+	if vol != nil {
+		statusList, err := cs.apiClient.Volume.ActionBackupStatusList(vol)
+		if err != nil {
+			return nil, err
+		}
+		for i := range statusList.Data {
+			s := &statusList.Data[i]
+			if l, ok := latest[s.Snapshot]; !ok || s.Requested >= l.Requested {
+				latest[s.Snapshot] = s
+			}
+		}
+	}
+
+	backupList, err := cs.listBackups(volumeID, false)
+	if err != nil {
+		return nil, err
+	}
+	// the backup just completed or deleted may not be in the cached listing
+	// of the backupstore yet
+	if !isBackupListingUpToDate(latest, backupList) {
+		if backupList, err = cs.listBackups(volumeID, true); err != nil {
+			return nil, err
+		}
+	}
+
+	backups := map[string]*snapshotBackup{}
+	for _, b := range backupList {
+		backups[b.SnapshotName] = &snapshotBackup{
+			name:    b.Name,
+			state:   types.BackupTicketStateCompleted,
+			url:     b.Url,
+			created: b.SnapshotCreated,
+			size:    b.VolumeSize,
+		}
+	}
+	for snapshotName, s := range latest {
+		// the completed backup not in the backupstore is deleted
+		if _, ok := backups[snapshotName]; ok || s.State == string(types.BackupTicketStateCompleted) {
+			continue
+		}
+		backups[snapshotName] = &snapshotBackup{
+			state:   types.BackupTicketState(s.State),
+			error:   s.Error,
+			url:     s.Url,
+			created: s.Requested,
+			size:    vol.Size,
+		}
+	}
+	return backups, nil
+}
+
+func isBackupListingUpToDate(latest map[string]*longhornclient.BackupStatus, backupList []longhornclient.Backup) bool {
+	listed := map[string]bool{}
+	for _, b := range backupList {
+		listed[b.SnapshotName] = true
+	}
+	for snapshotName, s := range latest {
+		if s.State == string(types.BackupTicketStateCompleted) && !listed[snapshotName] {
+			return false
+		}
+	}
+	return true
+}
+
+// getBackupVolume returns the backup volume for the backup actions, which
+// don't need the backup volume to be listed from the backupstore yet. The
+// listing cache of the backupstore is bypassed if refresh is set.
+func (cs *ControllerServer) getBackupVolume(volumeID string, refresh bool) (*longhornclient.BackupVolume, error) {
+	schema, ok := cs.apiClient.GetTypes()[longhornclient.BACKUP_VOLUME_TYPE]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema type %v", longhornclient.BACKUP_VOLUME_TYPE)
+	}
+	resourceURL := schema.Links[longhornclient.COLLECTION] + "/" + volumeID
+	query := ""
+	if refresh {
+		query = "&refresh=true"
+	}
+	return &longhornclient.BackupVolume{
+		Resource: longhornclient.Resource{
+			Id:   volumeID,
+			Type: longhornclient.BACKUP_VOLUME_TYPE,
+			Actions: map[string]string{
+				"backupList":   resourceURL + "?action=backupList" + query,
+				"backupDelete": resourceURL + "?action=backupDelete",
+			},
+		},
+		Name: volumeID,
+	}, nil
+}
+
+func (cs *ControllerServer) listBackups(volumeID string, refresh bool) ([]longhornclient.Backup, error) {
+	bv, err := cs.getBackupVolume(volumeID, refresh)
+	if err != nil {
+		return nil, err
+	}
+	backupList, err := cs.apiClient.BackupVolume.ActionBackupList(bv)
+	if err != nil {
+		return nil, err
+	}
+	return backupList.Data, nil
+}
+
+func (cs *ControllerServer) deleteBackup(volumeID string, b *snapshotBackup) error {
+	bv, err := cs.getBackupVolume(volumeID, false)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("DeleteSnapshot: deleting backup %s of volume %s", b.name, volumeID)
+	_, err = cs.apiClient.BackupVolume.ActionBackupDelete(bv, &longhornclient.BackupInput{Name: b.name})
+	return err
+}
+
+// getSnapshotBackupURL returns the backup of the snapshot for the volume to
+// be restored from
+func (cs *ControllerServer) getSnapshotBackupURL(snapshotID string) (string, error) {
+	volumeID, snapshotName, err := decodeSnapshotID(snapshotID)
+	if err != nil {
+		return "", status.Error(codes.NotFound, err.Error())
+	}
+	existVol, err := cs.apiClient.Volume.ById(volumeID)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	backups, err := cs.getSnapshotBackups(existVol, volumeID)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	b, ok := backups[snapshotName]
+	if !ok {
+		return "", status.Errorf(codes.NotFound, "The snapshot %s not exists", snapshotID)
+	}
+	if b.state != types.BackupTicketStateCompleted || b.url == "" {
+		return "", status.Errorf(codes.Unavailable, "The snapshot %s is not ready, the backup is %s", snapshotID, b.state)
+	}
+	return b.url, nil
+}
@@ -0,0 +1,804 @@
+package csi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+
+	longhornclient "github.com/rancher/longhorn-manager/client"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	TestVolumeName = "test-volume"
+	TestNode1      = "test-node-1"
+	TestNode2      = "test-node-2"
+)
+
+// fakeLonghornAPI serves the volumes and the nodes the way the Longhorn API
+// does, with the attach and the detach applied at once
+type fakeLonghornAPI struct {
+	server *httptest.Server
+	mutex  sync.Mutex
+
+	volumes map[string]*longhornclient.Volume
+	nodes   map[string]*longhornclient.Node
+
+	// snapshots are by the names, and the backup status and the backups in
+	// the backupstore are by the volume names
+	snapshots    map[string]*longhornclient.Snapshot
+	backupStatus map[string][]longhornclient.BackupStatus
+	backups      map[string][]longhornclient.Backup
+
+	// failAttachAfterApplied simulates the attach request accepted by
+	// the manager, but failed to be responded
+	failAttachAfterApplied bool
+	attachCount            int
+	detachCount            int
+	backupCount            int
+	backupListRefreshCount int
+}
+
+func newFakeLonghornAPI() *fakeLonghornAPI {
+	api := &fakeLonghornAPI{
+		volumes:      map[string]*longhornclient.Volume{},
+		nodes:        map[string]*longhornclient.Node{},
+		snapshots:    map[string]*longhornclient.Snapshot{},
+		backupStatus: map[string][]longhornclient.BackupStatus{},
+		backups:      map[string][]longhornclient.Backup{},
+	}
+	api.server = httptest.NewServer(http.HandlerFunc(api.serveHTTP))
+	return api
+}
+
+func (api *fakeLonghornAPI) url() string {
+	return api.server.URL + "/v1"
+}
+
+func (api *fakeLonghornAPI) addNode(name string) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	api.nodes[name] = &longhornclient.Node{
+		Resource: longhornclient.Resource{Id: name, Type: longhornclient.NODE_TYPE},
+		Name:     name,
+	}
+}
+
+func (api *fakeLonghornAPI) deleteNode(name string) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	delete(api.nodes, name)
+}
+
+func (api *fakeLonghornAPI) addVolume(name string, state types.VolumeState, nodeID string) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	url := api.url() + "/volumes/" + name
+	api.volumes[name] = &longhornclient.Volume{
+		Resource: longhornclient.Resource{
+			Id:   name,
+			Type: longhornclient.VOLUME_TYPE,
+			Actions: map[string]string{
+				"attach":           url + "?action=attach",
+				"detach":           url + "?action=detach",
+				"snapshotCreate":   url + "?action=snapshotCreate",
+				"snapshotGet":      url + "?action=snapshotGet",
+				"snapshotDelete":   url + "?action=snapshotDelete",
+				"snapshotBackup":   url + "?action=snapshotBackup",
+				"backupStatusList": url + "?action=backupStatusList",
+			},
+		},
+		Name:        name,
+		Size:        "2147483648",
+		State:       string(state),
+		Controllers: []longhornclient.Controller{{Name: name + "-e", HostId: nodeID}},
+	}
+}
+
+func (api *fakeLonghornAPI) addReadOnlyManyVolume(name string) {
+	api.addVolume(name, types.VolumeStateDetached, "")
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	api.volumes[name].AccessMode = string(types.VolumeAccessModeReadOnlyMany)
+	api.volumes[name].Frontend = string(types.VolumeFrontendISCSI)
+}
+
+func (api *fakeLonghornAPI) deleteVolume(name string) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	delete(api.volumes, name)
+}
+
+// finishBackups completes or fails the backups in progress. The completed
+// ones are added to the backupstore.
+func (api *fakeLonghornAPI) finishBackups(state types.BackupTicketState) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	for volumeName, statusList := range api.backupStatus {
+		for i := range statusList {
+			s := &statusList[i]
+			if s.State != string(types.BackupTicketStatePending) {
+				continue
+			}
+			s.State = string(state)
+			if state != types.BackupTicketStateCompleted {
+				s.Error = "backup target unavailable"
+				continue
+			}
+			backupName := fmt.Sprintf("backup-%d", api.backupCount)
+			s.Url = "s3://backupbucket@us-east-1/?backup=" + backupName + "&volume=" + volumeName
+			api.backups[volumeName] = append(api.backups[volumeName], longhornclient.Backup{
+				Name:            backupName,
+				SnapshotName:    s.Snapshot,
+				SnapshotCreated: s.Requested,
+				Url:             s.Url,
+				VolumeName:      volumeName,
+				VolumeSize:      "2147483648",
+			})
+		}
+	}
+}
+
+func (api *fakeLonghornAPI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1")
+	switch {
+	case path == "" || path == "/":
+		w.Header().Set("X-API-Schemas", api.url()+"/schemas")
+		api.writeJSON(w, map[string]interface{}{})
+	case path == "/schemas":
+		schemas := &longhornclient.Schemas{}
+		for _, t := range []string{longhornclient.VOLUME_TYPE, longhornclient.NODE_TYPE, longhornclient.BACKUP_VOLUME_TYPE} {
+			schemas.Data = append(schemas.Data, longhornclient.Schema{
+				Resource: longhornclient.Resource{
+					Id:    t,
+					Type:  "schema",
+					Links: map[string]string{"collection": api.url() + "/" + t + "s"},
+				},
+				CollectionMethods: []string{"GET", "POST"},
+				ResourceMethods:   []string{"GET", "DELETE"},
+			})
+		}
+		api.writeJSON(w, schemas)
+	case strings.HasPrefix(path, "/nodes/"):
+		node, ok := api.nodes[strings.TrimPrefix(path, "/nodes/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		api.writeJSON(w, node)
+	case path == "/volumes" && r.Method == http.MethodPost:
+		v := &longhornclient.Volume{}
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v.Id = v.Name
+		v.State = string(types.VolumeStateDetached)
+		api.volumes[v.Name] = v
+		api.writeJSON(w, v)
+	case strings.HasPrefix(path, "/volumes/"):
+		v, ok := api.volumes[strings.TrimPrefix(path, "/volumes/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.URL.Query().Get("action") {
+		case "attach":
+			input := &longhornclient.AttachInput{}
+			if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			api.attachCount++
+			if input.ReadOnly {
+				v.ReadOnlyNodeIDs = append(v.ReadOnlyNodeIDs, input.HostId)
+			}
+			if v.State != string(types.VolumeStateAttached) {
+				v.State = string(types.VolumeStateAttached)
+				v.Controllers[0].HostId = input.HostId
+				if v.Frontend == string(types.VolumeFrontendISCSI) {
+					v.Controllers[0].Endpoint = "iscsi://10.42.0.12:3260/iqn.2014-09.com.rancher:" + v.Name + "/1"
+				}
+			}
+			if api.failAttachAfterApplied {
+				http.Error(w, "connection reset", http.StatusInternalServerError)
+				return
+			}
+		case "detach":
+			input := &longhornclient.DetachInput{}
+			if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			api.detachCount++
+			readOnlyNodeIDs := []string{}
+			for _, id := range v.ReadOnlyNodeIDs {
+				if id != input.HostId {
+					readOnlyNodeIDs = append(readOnlyNodeIDs, id)
+				}
+			}
+			if len(readOnlyNodeIDs) != 0 {
+				v.ReadOnlyNodeIDs = readOnlyNodeIDs
+				break
+			}
+			v.State = string(types.VolumeStateDetached)
+			v.Controllers[0].HostId = ""
+			v.Controllers[0].Endpoint = ""
+			v.ReadOnlyNodeIDs = nil
+		case "snapshotCreate", "snapshotGet", "snapshotDelete", "snapshotBackup":
+			input := &longhornclient.SnapshotInput{}
+			if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			api.serveSnapshotAction(w, r, v, input)
+			return
+		case "backupStatusList":
+			api.writeJSON(w, &longhornclient.BackupStatusCollection{Data: api.backupStatus[v.Name]})
+			return
+		}
+		api.writeJSON(w, v)
+	case path == "/backupVolumes":
+		collection := &longhornclient.BackupVolumeCollection{}
+		for volumeName := range api.backups {
+			collection.Data = append(collection.Data, *api.getBackupVolume(volumeName))
+		}
+		api.writeJSON(w, collection)
+	case strings.HasPrefix(path, "/backupVolumes/"):
+		volumeName := strings.TrimPrefix(path, "/backupVolumes/")
+		switch r.URL.Query().Get("action") {
+		case "backupList":
+			if r.URL.Query().Get("refresh") == "true" {
+				api.backupListRefreshCount++
+			}
+			api.writeJSON(w, &longhornclient.BackupCollection{Data: api.backups[volumeName]})
+			return
+		case "backupDelete":
+			input := &longhornclient.BackupInput{}
+			if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			backups := []longhornclient.Backup{}
+			for _, b := range api.backups[volumeName] {
+				if b.Name != input.Name {
+					backups = append(backups, b)
+				}
+			}
+			api.backups[volumeName] = backups
+		}
+		api.writeJSON(w, api.getBackupVolume(volumeName))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (api *fakeLonghornAPI) serveSnapshotAction(w http.ResponseWriter, r *http.Request, v *longhornclient.Volume, input *longhornclient.SnapshotInput) {
+	snapshot, ok := api.snapshots[input.Name]
+	switch r.URL.Query().Get("action") {
+	case "snapshotCreate":
+		if ok {
+			http.Error(w, "snapshot already exists", http.StatusBadRequest)
+			return
+		}
+		snapshot = &longhornclient.Snapshot{Name: input.Name, ReadyToUse: true}
+		api.snapshots[input.Name] = snapshot
+	case "snapshotGet":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+	case "snapshotDelete":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(api.snapshots, input.Name)
+	case "snapshotBackup":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		api.backupCount++
+		backupStatus := longhornclient.BackupStatus{
+			Resource:  longhornclient.Resource{Id: fmt.Sprintf("ticket-%d", api.backupCount)},
+			Volume:    v.Name,
+			Snapshot:  input.Name,
+			State:     string(types.BackupTicketStatePending),
+			Requested: fmt.Sprintf("2019-03-01T10:00:%02dZ", api.backupCount),
+		}
+		api.backupStatus[v.Name] = append(api.backupStatus[v.Name], backupStatus)
+		api.writeJSON(w, backupStatus)
+		return
+	}
+	api.writeJSON(w, snapshot)
+}
+
+func (api *fakeLonghornAPI) getBackupVolume(volumeName string) *longhornclient.BackupVolume {
+	url := api.url() + "/backupVolumes/" + volumeName
+	return &longhornclient.BackupVolume{
+		Resource: longhornclient.Resource{
+			Id:   volumeName,
+			Type: longhornclient.BACKUP_VOLUME_TYPE,
+			Actions: map[string]string{
+				"backupList":   url + "?action=backupList",
+				"backupDelete": url + "?action=backupDelete",
+			},
+		},
+		Name: volumeName,
+	}
+}
+
+func (api *fakeLonghornAPI) writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+func newTestControllerServer(t *testing.T, api *fakeLonghornAPI) *ControllerServer {
+	apiClient, err := longhornclient.NewRancherClient(&longhornclient.ClientOpts{Url: api.url()})
+	require.NoError(t, err)
+	driver := csicommon.NewCSIDriver(DefaultCSIDriverName, "0.3.0", TestNode1)
+	driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	})
+	return NewControllerServer(driver, apiClient)
+}
+
+func errorCode(err error) codes.Code {
+	s, _ := status.FromError(err)
+	return s.Code()
+}
+
+func TestControllerUnpublishVolumeDeletedNode(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	api.addNode(TestNode1)
+	api.addVolume(TestVolumeName, types.VolumeStateAttached, TestNode1)
+	api.deleteNode(TestNode1)
+
+	req := &csi.ControllerUnpublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode1}
+	for i := 0; i < 3; i++ {
+		_, err := cs.ControllerUnpublishVolume(context.TODO(), req)
+		assert.NoError(err)
+	}
+	// the volume is released from the removed node once
+	assert.Equal(1, api.detachCount)
+	assert.Equal(string(types.VolumeStateDetached), api.volumes[TestVolumeName].State)
+
+	// the volume can be published to the other node afterwards
+	api.addNode(TestNode2)
+	_, err := cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode2})
+	assert.NoError(err)
+	assert.Equal(TestNode2, api.volumes[TestVolumeName].Controllers[0].HostId)
+}
+
+func TestControllerUnpublishVolumeDeletedVolume(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	api.addNode(TestNode1)
+	api.addVolume(TestVolumeName, types.VolumeStateAttached, TestNode1)
+
+	req := &csi.ControllerUnpublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode1}
+	_, err := cs.ControllerUnpublishVolume(context.TODO(), req)
+	assert.NoError(err)
+	assert.Equal(1, api.detachCount)
+
+	api.deleteVolume(TestVolumeName)
+	for i := 0; i < 3; i++ {
+		_, err := cs.ControllerUnpublishVolume(context.TODO(), req)
+		assert.NoError(err)
+	}
+	assert.Equal(1, api.detachCount)
+
+	// the volume and the node both gone
+	api.deleteNode(TestNode1)
+	_, err = cs.ControllerUnpublishVolume(context.TODO(), req)
+	assert.NoError(err)
+}
+
+func TestControllerUnpublishVolumeAttachedToOtherNode(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	api.addNode(TestNode1)
+	api.addNode(TestNode2)
+	api.addVolume(TestVolumeName, types.VolumeStateAttached, TestNode2)
+
+	_, err := cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode1})
+	assert.NoError(err)
+	assert.Equal(0, api.detachCount)
+	assert.Equal(string(types.VolumeStateAttached), api.volumes[TestVolumeName].State)
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	api.addNode(TestNode1)
+	api.addNode(TestNode2)
+
+	req := &csi.ControllerPublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode1}
+	_, err := cs.ControllerPublishVolume(context.TODO(), req)
+	assert.Equal(codes.NotFound, errorCode(err))
+
+	api.addVolume(TestVolumeName, types.VolumeStateDetached, "")
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{VolumeId: TestVolumeName, NodeId: "removed-node"})
+	assert.Equal(codes.NotFound, errorCode(err))
+	assert.Equal(0, api.attachCount)
+
+	// the attach is applied, but the response is lost
+	api.failAttachAfterApplied = true
+	_, err = cs.ControllerPublishVolume(context.TODO(), req)
+	assert.NoError(err)
+	assert.Equal(1, api.attachCount)
+
+	// the retry finds the volume attached to the node already
+	_, err = cs.ControllerPublishVolume(context.TODO(), req)
+	assert.NoError(err)
+	assert.Equal(1, api.attachCount)
+
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode2})
+	assert.Equal(codes.FailedPrecondition, errorCode(err))
+	assert.Equal(1, api.attachCount)
+}
+
+func TestControllerPublishVolumeReadOnlyMany(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	api.addNode(TestNode1)
+	api.addNode(TestNode2)
+	api.addReadOnlyManyVolume(TestVolumeName)
+
+	req1 := &csi.ControllerPublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode1, Readonly: true}
+	req2 := &csi.ControllerPublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode2, Readonly: true}
+	resp, err := cs.ControllerPublishVolume(context.TODO(), req1)
+	assert.NoError(err)
+	assert.Equal("iscsi://10.42.0.12:3260/iqn.2014-09.com.rancher:"+TestVolumeName+"/1", resp.GetPublishInfo()[publishInfoEndpoint])
+
+	// cannot be published read-write along with the read-only ones
+	_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode2})
+	assert.Equal(codes.FailedPrecondition, errorCode(err))
+
+	resp, err = cs.ControllerPublishVolume(context.TODO(), req2)
+	assert.NoError(err)
+	assert.NotEmpty(resp.GetPublishInfo()[publishInfoEndpoint])
+	assert.Equal([]string{TestNode1, TestNode2}, api.volumes[TestVolumeName].ReadOnlyNodeIDs)
+	assert.Equal(2, api.attachCount)
+
+	// the retry finds the volume attached to the node already
+	_, err = cs.ControllerPublishVolume(context.TODO(), req2)
+	assert.NoError(err)
+	assert.Equal(2, api.attachCount)
+
+	// the volume stays attached to the rest of the nodes
+	_, err = cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode1})
+	assert.NoError(err)
+	assert.Equal(string(types.VolumeStateAttached), api.volumes[TestVolumeName].State)
+	assert.Equal([]string{TestNode2}, api.volumes[TestVolumeName].ReadOnlyNodeIDs)
+
+	_, err = cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode2})
+	assert.NoError(err)
+	assert.Equal(string(types.VolumeStateDetached), api.volumes[TestVolumeName].State)
+	assert.Equal(2, api.detachCount)
+}
+
+func TestControllerPublishVolumeReadOnlyWithoutReadOnlyMany(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	api.addNode(TestNode1)
+	api.addNode(TestNode2)
+	api.addVolume(TestVolumeName, types.VolumeStateAttached, TestNode1)
+
+	_, err := cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{VolumeId: TestVolumeName, NodeId: TestNode2, Readonly: true})
+	assert.Equal(codes.FailedPrecondition, errorCode(err))
+	assert.Equal(0, api.attachCount)
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	rwo := []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}}
+	rox := []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY}}}
+	rwx := []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}}}
+
+	_, err := cs.ValidateVolumeCapabilities(context.TODO(), &csi.ValidateVolumeCapabilitiesRequest{VolumeId: TestVolumeName, VolumeCapabilities: rwo})
+	assert.Equal(codes.NotFound, errorCode(err))
+
+	api.addVolume(TestVolumeName, types.VolumeStateDetached, "")
+	api.addReadOnlyManyVolume(TestVolumeName + "-rox")
+	for _, tc := range []struct {
+		volumeID  string
+		caps      []*csi.VolumeCapability
+		supported bool
+	}{
+		{TestVolumeName, rwo, true},
+		{TestVolumeName, rox, false},
+		{TestVolumeName, rwx, false},
+		{TestVolumeName + "-rox", rwo, true},
+		{TestVolumeName + "-rox", rox, true},
+		{TestVolumeName + "-rox", rwx, false},
+	} {
+		resp, err := cs.ValidateVolumeCapabilities(context.TODO(), &csi.ValidateVolumeCapabilitiesRequest{VolumeId: tc.volumeID, VolumeCapabilities: tc.caps})
+		assert.NoError(err)
+		assert.Equal(tc.supported, resp.GetSupported(), "%v %v", tc.volumeID, tc.caps)
+	}
+}
+
+func TestCreateVolumeTopology(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	rwo := []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}}
+	zone := func(z string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{topologyKeyZone: z}}
+	}
+	for name, tc := range map[string]struct {
+		requirement *csi.TopologyRequirement
+		zones       []string
+	}{
+		"no requirement": {},
+		"requisite zones": {
+			requirement: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{zone("zone-2"), zone("zone-1"), zone("zone-2")},
+				Preferred: []*csi.Topology{zone("zone-2")},
+			},
+			zones: []string{"zone-1", "zone-2"},
+		},
+		"requisite without zone": {
+			requirement: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{zone("zone-1"), {Segments: map[string]string{}}},
+			},
+		},
+		"preferred only": {
+			requirement: &csi.TopologyRequirement{
+				Preferred: []*csi.Topology{zone("zone-1")},
+			},
+		},
+	} {
+		volumeName := strings.Replace(name, " ", "-", -1)
+		resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:                      volumeName,
+			VolumeCapabilities:        rwo,
+			AccessibilityRequirements: tc.requirement,
+		})
+		assert.NoError(err, name)
+		assert.Empty(resp.GetVolume().GetAccessibleTopology(), name)
+		assert.Equal(tc.zones, api.volumes[volumeName].ZoneSelector, name)
+	}
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	apiClient, err := longhornclient.NewRancherClient(&longhornclient.ClientOpts{Url: api.url()})
+	assert.NoError(err)
+	ns := NewNodeServer(csicommon.NewCSIDriver(DefaultCSIDriverName, "0.3.0", TestNode1), apiClient)
+
+	_, err = ns.NodeGetInfo(context.TODO(), &csi.NodeGetInfoRequest{})
+	assert.Equal(codes.Unavailable, errorCode(err))
+
+	api.addNode(TestNode1)
+	resp, err := ns.NodeGetInfo(context.TODO(), &csi.NodeGetInfoRequest{})
+	assert.NoError(err)
+	assert.Equal(TestNode1, resp.GetNodeId())
+	assert.Nil(resp.GetAccessibleTopology())
+
+	api.nodes[TestNode1].Zone = "zone-1"
+	resp, err = ns.NodeGetInfo(context.TODO(), &csi.NodeGetInfoRequest{})
+	assert.NoError(err)
+	assert.Equal(map[string]string{topologyKeyZone: "zone-1"}, resp.GetAccessibleTopology().GetSegments())
+}
+
+func TestControllerSnapshot(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	req := &csi.CreateSnapshotRequest{SourceVolumeId: TestVolumeName, Name: "snapshot-1"}
+	_, err := cs.CreateSnapshot(context.TODO(), &csi.CreateSnapshotRequest{SourceVolumeId: TestVolumeName})
+	assert.Equal(codes.InvalidArgument, errorCode(err))
+	_, err = cs.CreateSnapshot(context.TODO(), req)
+	assert.Equal(codes.NotFound, errorCode(err))
+
+	api.addVolume(TestVolumeName, types.VolumeStateDetached, "")
+	_, err = cs.CreateSnapshot(context.TODO(), req)
+	assert.Equal(codes.FailedPrecondition, errorCode(err))
+
+	api.volumes[TestVolumeName].State = string(types.VolumeStateAttached)
+	resp, err := cs.CreateSnapshot(context.TODO(), req)
+	assert.NoError(err)
+	snapshotID := resp.GetSnapshot().GetId()
+	assert.Equal(TestVolumeName+"/snapshot-1", snapshotID)
+	assert.Equal(TestVolumeName, resp.GetSnapshot().GetSourceVolumeId())
+	assert.Equal(csi.SnapshotStatus_UPLOADING, resp.GetSnapshot().GetStatus().GetType())
+	assert.Equal(int64(2147483648), resp.GetSnapshot().GetSizeBytes())
+	assert.NotZero(resp.GetSnapshot().GetCreatedAt())
+
+	// the retry doesn't take another backup
+	resp, err = cs.CreateSnapshot(context.TODO(), req)
+	assert.NoError(err)
+	assert.Equal(csi.SnapshotStatus_UPLOADING, resp.GetSnapshot().GetStatus().GetType())
+	assert.Equal(1, api.backupCount)
+
+	// the failed backup is taken again
+	api.finishBackups(types.BackupTicketStateError)
+	listResp, err := cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+	assert.NoError(err)
+	assert.Len(listResp.GetEntries(), 1)
+	assert.Equal(csi.SnapshotStatus_ERROR_UPLOADING, listResp.GetEntries()[0].GetSnapshot().GetStatus().GetType())
+	resp, err = cs.CreateSnapshot(context.TODO(), req)
+	assert.NoError(err)
+	assert.Equal(csi.SnapshotStatus_UPLOADING, resp.GetSnapshot().GetStatus().GetType())
+	assert.Equal(2, api.backupCount)
+
+	// the volume cannot be restored until the backup is completed
+	createReq := &csi.CreateVolumeRequest{
+		Name:               TestVolumeName + "-restored",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{Id: snapshotID}},
+		},
+	}
+	_, err = cs.CreateVolume(context.TODO(), createReq)
+	assert.Equal(codes.Unavailable, errorCode(err))
+
+	api.finishBackups(types.BackupTicketStateCompleted)
+	listResp, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{SourceVolumeId: TestVolumeName})
+	assert.NoError(err)
+	assert.Len(listResp.GetEntries(), 1)
+	assert.Equal(csi.SnapshotStatus_READY, listResp.GetEntries()[0].GetSnapshot().GetStatus().GetType())
+	listResp, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{SnapshotId: "invalid"})
+	assert.NoError(err)
+	assert.Len(listResp.GetEntries(), 0)
+
+	// the deleted volume can be restored from the snapshot as well
+	api.deleteVolume(TestVolumeName)
+	listResp, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{})
+	assert.NoError(err)
+	assert.Len(listResp.GetEntries(), 1)
+	assert.Equal(snapshotID, listResp.GetEntries()[0].GetSnapshot().GetId())
+	volResp, err := cs.CreateVolume(context.TODO(), createReq)
+	assert.NoError(err)
+	assert.Equal(snapshotID, volResp.GetVolume().GetContentSource().GetSnapshot().GetId())
+	assert.Equal("s3://backupbucket@us-east-1/?backup=backup-2&volume="+TestVolumeName, api.volumes[TestVolumeName+"-restored"].FromBackup)
+
+	api.addVolume(TestVolumeName, types.VolumeStateAttached, TestNode1)
+	for i := 0; i < 2; i++ {
+		_, err = cs.DeleteSnapshot(context.TODO(), &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+		assert.NoError(err)
+	}
+	assert.Len(api.backups[TestVolumeName], 0)
+	assert.Len(api.snapshots, 0)
+
+	// the completed backup status is kept after the backup is deleted, and
+	// the listing of the backupstore is refreshed to tell
+	refreshCount := api.backupListRefreshCount
+	assert.NotZero(refreshCount)
+	listResp, err = cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{SnapshotId: snapshotID})
+	assert.NoError(err)
+	assert.Len(listResp.GetEntries(), 0)
+	assert.Equal(refreshCount+1, api.backupListRefreshCount)
+}
+
+func TestListSnapshotsPaging(t *testing.T) {
+	assert := require.New(t)
+
+	api := newFakeLonghornAPI()
+	defer api.server.Close()
+	cs := newTestControllerServer(t, api)
+
+	api.addVolume(TestVolumeName, types.VolumeStateAttached, TestNode1)
+	for _, name := range []string{"snapshot-1", "snapshot-2", "snapshot-3"} {
+		_, err := cs.CreateSnapshot(context.TODO(), &csi.CreateSnapshotRequest{SourceVolumeId: TestVolumeName, Name: name})
+		assert.NoError(err)
+	}
+
+	ids := []string{}
+	req := &csi.ListSnapshotsRequest{SourceVolumeId: TestVolumeName, MaxEntries: 2}
+	for {
+		resp, err := cs.ListSnapshots(context.TODO(), req)
+		assert.NoError(err)
+		for _, entry := range resp.GetEntries() {
+			ids = append(ids, entry.GetSnapshot().GetId())
+		}
+		if resp.GetNextToken() == "" {
+			break
+		}
+		req.StartingToken = resp.GetNextToken()
+	}
+	assert.Equal([]string{TestVolumeName + "/snapshot-1", TestVolumeName + "/snapshot-2", TestVolumeName + "/snapshot-3"}, ids)
+
+	_, err := cs.ListSnapshots(context.TODO(), &csi.ListSnapshotsRequest{StartingToken: "4", SourceVolumeId: TestVolumeName})
+	assert.Equal(codes.Aborted, errorCode(err))
+}
+
+func TestParseISCSIEndpoint(t *testing.T) {
+	assert := require.New(t)
+
+	ip, target, lun, err := parseISCSIEndpoint("iscsi://10.42.0.12:3260/iqn.2014-09.com.rancher:vol-name/1")
+	assert.NoError(err)
+	assert.Equal("10.42.0.12", ip)
+	assert.Equal("iqn.2014-09.com.rancher:vol-name", target)
+	assert.Equal(1, lun)
+
+	for _, endpoint := range []string{"/dev/longhorn/vol-name", "iscsi://10.42.0.12:3260/iqn.2014-09.com.rancher:vol-name", "iscsi://10.42.0.12:3260/iqn.2014-09.com.rancher:vol-name/a"} {
+		_, _, _, err = parseISCSIEndpoint(endpoint)
+		assert.Error(err, endpoint)
+	}
+}
+
+func TestParseDeviceMounts(t *testing.T) {
+	assert := require.New(t)
+
+	mountInfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+25 22 0:6 / /dev rw,nosuid shared:2 - devtmpfs udev rw,size=4010772k,mode=755
+310 22 0:6 /longhorn/vol-1 /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod-1 rw,nosuid shared:2 - devtmpfs udev rw,size=4010772k,mode=755
+320 22 0:6 /sdb /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/pod-2 ro,nosuid shared:2 - devtmpfs udev rw,size=4010772k,mode=755
+330 22 0:6 /sdb /var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/pod-3 ro,nosuid shared:2 - devtmpfs udev rw,size=4010772k,mode=755
+340 22 8:16 / /var/lib/kubelet/pods/pod-4/volumes/kubernetes.io~csi/pvc-3/mount rw,relatime shared:3 - ext4 /dev/longhorn/vol-3 rw
+`
+	mounts, err := parseDeviceMounts(strings.NewReader(mountInfo))
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod-1": "/dev/longhorn/vol-1",
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/pod-2": "/dev/sdb",
+		"/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/pod-3": "/dev/sdb",
+	}, mounts)
+
+	assert.True(isDeviceMounted(mounts, "/dev/sdb", "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-2/pod-2"))
+	assert.False(isDeviceMounted(mounts, "/dev/longhorn/vol-1", "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices/publish/pvc-1/pod-1"))
+
+	_, err = parseDeviceMounts(strings.NewReader("22 1 8:1 / /\n"))
+	assert.Error(err)
+}
@@ -1,9 +1,7 @@
 package csi
 
 import (
-	"sync"
-
-	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
 	appsv1beta1 "k8s.io/api/apps/v1beta1"
 	appsv1beta2 "k8s.io/api/apps/v1beta2"
 	"k8s.io/api/core/v1"
@@ -16,9 +14,11 @@ import (
 
 const (
 	DefaultCSIAttacherImage        = "quay.io/k8scsi/csi-attacher:v0.4.0"
-	DefaultCSIProvisionerImage     = "quay.io/k8scsi/csi-provisioner:v0.3.1"
+	DefaultCSIProvisionerImage     = "quay.io/k8scsi/csi-provisioner:v0.4.1"
 	DefaultCSIDriverRegistrarImage = "quay.io/k8scsi/driver-registrar:v0.4.1"
+	DefaultCSISnapshotterImage     = "quay.io/k8scsi/csi-snapshotter:v0.4.1"
 	DefaultCSIProvisionerName      = "rancher.io/longhorn"
+	DefaultCSIDriverName           = "io.rancher.longhorn"
 )
 
 var (
@@ -27,12 +27,20 @@ var (
 	MountPropagationBidirectional = v1.MountPropagationBidirectional
 )
 
+// PodOptions are applied to the pods of all the CSI components, set by the
+// settings of the manager
+type PodOptions struct {
+	Tolerations       []v1.Toleration
+	NodeSelector      map[string]string
+	PriorityClassName string
+}
+
 type AttacherDeployment struct {
 	service     *v1.Service
 	statefulSet *appsv1beta1.StatefulSet
 }
 
-func NewAttacherDeployment(namespace, serviceAccount, attacherImage string) *AttacherDeployment {
+func NewAttacherDeployment(namespace, serviceAccount, attacherImage string, resources v1.ResourceRequirements, options PodOptions) *AttacherDeployment {
 	service := getCommonService("csi-attacher", namespace)
 
 	statefulSet := getCommondStatefulSet(
@@ -44,6 +52,8 @@ func NewAttacherDeployment(namespace, serviceAccount, attacherImage string) *Att
 			"--v=5",
 			"--csi-address=$(ADDRESS)",
 		},
+		resources,
+		options,
 	)
 
 	return &AttacherDeployment{
@@ -60,20 +70,15 @@ func (a *AttacherDeployment) Deploy(kubeClient *clientset.Clientset) error {
 	return deployStatefulSet(kubeClient, a.statefulSet)
 }
 
-func (a *AttacherDeployment) Cleanup(kubeClient *clientset.Clientset) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
-
-	util.RunAsync(&wg, func() {
-		if err := cleanupService(kubeClient, a.service); err != nil {
-			logrus.Warnf("Failed to cleanup Service in attacher deployment: %v", err)
-		}
-	})
-	util.RunAsync(&wg, func() {
-		if err := cleanupStatefulSet(kubeClient, a.statefulSet); err != nil {
-			logrus.Warnf("Failed to cleanup StatefulSet in attacher deployment: %v", err)
-		}
-	})
+func (a *AttacherDeployment) Cleanup(kubeClient *clientset.Clientset) error {
+	return util.RunConcurrent(
+		func() error {
+			return errors.Wrap(cleanupService(kubeClient, a.service), "failed to cleanup Service in attacher deployment")
+		},
+		func() error {
+			return errors.Wrap(cleanupStatefulSet(kubeClient, a.statefulSet), "failed to cleanup StatefulSet in attacher deployment")
+		},
+	)
 }
 
 type ProvisionerDeployment struct {
@@ -81,7 +86,7 @@ type ProvisionerDeployment struct {
 	statefulSet *appsv1beta1.StatefulSet
 }
 
-func NewProvisionerDeployment(namespace, serviceAccount, provisionerImage, provisionerName string) *ProvisionerDeployment {
+func NewProvisionerDeployment(namespace, serviceAccount, provisionerImage, provisionerName string, resources v1.ResourceRequirements, options PodOptions) *ProvisionerDeployment {
 	service := getCommonService("csi-provisioner", namespace)
 
 	statefulSet := getCommondStatefulSet(
@@ -93,7 +98,12 @@ func NewProvisionerDeployment(namespace, serviceAccount, provisionerImage, provi
 			"--provisioner=" + provisionerName,
 			"--csi-address=$(ADDRESS)",
 			"--v=5",
+			// pass the topology of the nodes the workload can be
+			// scheduled to, see NodeGetInfo
+			"--feature-gates=Topology=true",
 		},
+		resources,
+		options,
 	)
 
 	return &ProvisionerDeployment{
@@ -110,27 +120,69 @@ func (p *ProvisionerDeployment) Deploy(kubeClient *clientset.Clientset) error {
 	return deployStatefulSet(kubeClient, p.statefulSet)
 }
 
-func (p *ProvisionerDeployment) Cleanup(kubeClient *clientset.Clientset) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
-
-	util.RunAsync(&wg, func() {
-		if err := cleanupService(kubeClient, p.service); err != nil {
-			logrus.Warnf("Failed to cleanup Service in provisioner deployment: %v", err)
-		}
-	})
-	util.RunAsync(&wg, func() {
-		if err := cleanupStatefulSet(kubeClient, p.statefulSet); err != nil {
-			logrus.Warnf("Failed to cleanup StatefulSet in provisioner deployment: %v", err)
-		}
-	})
+func (p *ProvisionerDeployment) Cleanup(kubeClient *clientset.Clientset) error {
+	return util.RunConcurrent(
+		func() error {
+			return errors.Wrap(cleanupService(kubeClient, p.service), "failed to cleanup Service in provisioner deployment")
+		},
+		func() error {
+			return errors.Wrap(cleanupStatefulSet(kubeClient, p.statefulSet), "failed to cleanup StatefulSet in provisioner deployment")
+		},
+	)
+}
+
+type SnapshotterDeployment struct {
+	service     *v1.Service
+	statefulSet *appsv1beta1.StatefulSet
+}
+
+func NewSnapshotterDeployment(namespace, serviceAccount, snapshotterImage string, resources v1.ResourceRequirements, options PodOptions) *SnapshotterDeployment {
+	service := getCommonService("csi-snapshotter", namespace)
+
+	statefulSet := getCommondStatefulSet(
+		"csi-snapshotter",
+		namespace,
+		serviceAccount,
+		snapshotterImage,
+		[]string{
+			"--connection-timeout=15s",
+			"--csi-address=$(ADDRESS)",
+			"--v=5",
+		},
+		resources,
+		options,
+	)
+
+	return &SnapshotterDeployment{
+		service:     service,
+		statefulSet: statefulSet,
+	}
+}
+
+func (s *SnapshotterDeployment) Deploy(kubeClient *clientset.Clientset) error {
+	if err := deployService(kubeClient, s.service); err != nil {
+		return err
+	}
+
+	return deployStatefulSet(kubeClient, s.statefulSet)
+}
+
+func (s *SnapshotterDeployment) Cleanup(kubeClient *clientset.Clientset) error {
+	return util.RunConcurrent(
+		func() error {
+			return errors.Wrap(cleanupService(kubeClient, s.service), "failed to cleanup Service in snapshotter deployment")
+		},
+		func() error {
+			return errors.Wrap(cleanupStatefulSet(kubeClient, s.statefulSet), "failed to cleanup StatefulSet in snapshotter deployment")
+		},
+	)
 }
 
 type PluginDeployment struct {
 	daemonSet *appsv1beta2.DaemonSet
 }
 
-func NewPluginDeployment(namespace, serviceAccount, driverRegistrarImage, managerImage, managerURL string, kubeletPluginWatcherEnabled bool) *PluginDeployment {
+func NewPluginDeployment(namespace, serviceAccount, driverRegistrarImage, managerImage, managerURL string, kubeletPluginWatcherEnabled bool, driverRegistrarResources, pluginResources v1.ResourceRequirements, options PodOptions) *PluginDeployment {
 	args := []string{
 		"--v=5",
 		"--csi-address=$(ADDRESS)",
@@ -160,6 +212,16 @@ func NewPluginDeployment(namespace, serviceAccount, driverRegistrarImage, manage
 				},
 			},
 		},
+		{
+			// kubelet publishes the raw block volumes here
+			Name: "block-devices-dir",
+			VolumeSource: v1.VolumeSource{
+				HostPath: &v1.HostPathVolumeSource{
+					Path: "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices",
+					Type: &HostPathDirectoryOrCreate,
+				},
+			},
+		},
 		{
 			Name: "socket-dir",
 			VolumeSource: v1.VolumeSource{
@@ -193,6 +255,14 @@ func NewPluginDeployment(namespace, serviceAccount, driverRegistrarImage, manage
 				},
 			},
 		},
+		{
+			Name: "host-proc",
+			VolumeSource: v1.VolumeSource{
+				HostPath: &v1.HostPathVolumeSource{
+					Path: "/proc",
+				},
+			},
+		},
 	}
 
 	// for Kubernetes v1.12+
@@ -233,6 +303,9 @@ func NewPluginDeployment(namespace, serviceAccount, driverRegistrarImage, manage
 				},
 				Spec: v1.PodSpec{
 					ServiceAccountName: serviceAccount,
+					Tolerations:        options.Tolerations,
+					NodeSelector:       options.NodeSelector,
+					PriorityClassName:  options.PriorityClassName,
 					Containers: []v1.Container{
 						{
 							Name:  "driver-registrar",
@@ -254,6 +327,7 @@ func NewPluginDeployment(namespace, serviceAccount, driverRegistrarImage, manage
 							},
 							//ImagePullPolicy: v1.PullAlways,
 							VolumeMounts: volumeMounts,
+							Resources:    driverRegistrarResources,
 						},
 						{
 							Name: "longhorn-csi-plugin",
@@ -273,7 +347,7 @@ func NewPluginDeployment(namespace, serviceAccount, driverRegistrarImage, manage
 								"csi",
 								"--nodeid=$(NODE_ID)",
 								"--endpoint=$(CSI_ENDPOINT)",
-								"--drivername=io.rancher.longhorn",
+								"--drivername=" + DefaultCSIDriverName,
 								"--manager-url=" + managerURL,
 							},
 							Env: []v1.EnvVar{
@@ -300,6 +374,11 @@ func NewPluginDeployment(namespace, serviceAccount, driverRegistrarImage, manage
 									MountPath:        "/var/lib/kubelet/pods",
 									MountPropagation: &MountPropagationBidirectional,
 								},
+								{
+									Name:             "block-devices-dir",
+									MountPath:        "/var/lib/kubelet/plugins/kubernetes.io/csi/volumeDevices",
+									MountPropagation: &MountPropagationBidirectional,
+								},
 								{
 									Name:      "host-dev",
 									MountPath: "/dev",
@@ -313,7 +392,14 @@ func NewPluginDeployment(namespace, serviceAccount, driverRegistrarImage, manage
 									MountPath: "/lib/modules",
 									ReadOnly:  true,
 								},
+								{
+									// for logging in the iSCSI targets
+									// in the namespaces of the host
+									Name:      "host-proc",
+									MountPath: "/host/proc",
+								},
 							},
+							Resources: pluginResources,
 						},
 					},
 					Volumes: volumes,
@@ -331,8 +417,6 @@ func (p *PluginDeployment) Deploy(kubeClient *clientset.Clientset) error {
 	return deployDaemonSet(kubeClient, p.daemonSet)
 }
 
-func (p *PluginDeployment) Cleanup(kubeClient *clientset.Clientset) {
-	if err := cleanupDaemonSet(kubeClient, p.daemonSet); err != nil {
-		logrus.Warnf("Failed to cleanup DaemonSet in plugin deployment: %v", err)
-	}
+func (p *PluginDeployment) Cleanup(kubeClient *clientset.Clientset) error {
+	return errors.Wrap(cleanupDaemonSet(kubeClient, p.daemonSet), "failed to cleanup DaemonSet in plugin deployment")
 }
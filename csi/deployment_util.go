@@ -46,7 +46,7 @@ func getCommonService(commonName, namespace string) *v1.Service {
 	}
 }
 
-func getCommondStatefulSet(commonName, namespace, serviceAccount, image string, args []string) *appsv1beta1.StatefulSet {
+func getCommondStatefulSet(commonName, namespace, serviceAccount, image string, args []string, resources v1.ResourceRequirements, options PodOptions) *appsv1beta1.StatefulSet {
 	return &appsv1beta1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      commonName,
@@ -62,6 +62,9 @@ func getCommondStatefulSet(commonName, namespace, serviceAccount, image string,
 				},
 				Spec: v1.PodSpec{
 					ServiceAccountName: serviceAccount,
+					Tolerations:        options.Tolerations,
+					NodeSelector:       options.NodeSelector,
+					PriorityClassName:  options.PriorityClassName,
 					Containers: []v1.Container{
 						v1.Container{
 							Name:  commonName,
@@ -80,6 +83,7 @@ func getCommondStatefulSet(commonName, namespace, serviceAccount, image string,
 									MountPath: "/var/lib/kubelet/plugins/io.rancher.longhorn",
 								},
 							},
+							Resources: resources,
 						},
 					},
 					Volumes: []v1.Volume{
@@ -0,0 +1,101 @@
+package csi
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-iscsi-helper/iscsi"
+	iscsi_util "github.com/rancher/go-iscsi-helper/util"
+
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	publishInfoEndpoint = "endpoint"
+
+	iscsiEndpointPrefix = "iscsi://"
+	// the engine names the iSCSI target after the volume
+	iscsiTargetPrefix = "iqn.2014-09.com.rancher:"
+)
+
+// parseISCSIEndpoint parses the endpoint looks like
+// iscsi://10.42.0.12:3260/iqn.2014-09.com.rancher:vol-name/1
+func parseISCSIEndpoint(endpoint string) (ip, target string, lun int, err error) {
+	if !strings.HasPrefix(endpoint, iscsiEndpointPrefix) {
+		return "", "", 0, fmt.Errorf("invalid iSCSI endpoint %v", endpoint)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", 0, errors.Wrapf(err, "invalid iSCSI endpoint %v", endpoint)
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "", "", 0, fmt.Errorf("invalid iSCSI endpoint %v", endpoint)
+	}
+	lun, err = strconv.Atoi(path[i+1:])
+	if err != nil {
+		return "", "", 0, errors.Wrapf(err, "invalid LUN of iSCSI endpoint %v", endpoint)
+	}
+	return u.Hostname(), path[:i], lun, nil
+}
+
+func getInitiatorNamespaceExecutor() (*iscsi_util.NamespaceExecutor, error) {
+	return iscsi_util.NewNamespaceExecutor(util.GetInitiatorNSPath())
+}
+
+// loginISCSITarget logs in the iSCSI target on the host and returns the
+// device of it. The engine of the volume attached read-only rejects the
+// writes already, and the device is set read-only as well if readOnly, so
+// the writes fail early on the node.
+func loginISCSITarget(endpoint string, readOnly bool) (string, error) {
+	ip, target, lun, err := parseISCSIEndpoint(endpoint)
+	if err != nil {
+		return "", err
+	}
+	ne, err := getInitiatorNamespaceExecutor()
+	if err != nil {
+		return "", err
+	}
+	if !iscsi.IsTargetLoggedIn(ip, target, ne) {
+		if err := iscsi.DiscoverTarget(ip, target, ne); err != nil {
+			return "", err
+		}
+		if err := iscsi.LoginTarget(ip, target, ne); err != nil {
+			return "", err
+		}
+	}
+	dev, err := iscsi.GetDevice(ip, target, lun, ne)
+	if err != nil {
+		return "", err
+	}
+	if readOnly {
+		if _, err := ne.Execute("blockdev", []string{"--setro", dev}); err != nil {
+			return "", errors.Wrapf(err, "failed to set device %v of target %v read-only", dev, target)
+		}
+	}
+	logrus.Debugf("Logged in iSCSI target %v on %v as %v", target, ip, dev)
+	return dev, nil
+}
+
+// logoutISCSITarget logs out all the sessions of the iSCSI target of the
+// volume on the host, if any
+func logoutISCSITarget(volumeID string) error {
+	target := iscsiTargetPrefix + volumeID
+	ne, err := getInitiatorNamespaceExecutor()
+	if err != nil {
+		return err
+	}
+	if !iscsi.IsTargetLoggedIn("", target, ne) {
+		return nil
+	}
+	if err := iscsi.LogoutTarget("", target, ne); err != nil {
+		return err
+	}
+	logrus.Debugf("Logged out iSCSI target %v", target)
+	return nil
+}
@@ -39,9 +39,15 @@ func (m *Manager) Run(driverName, nodeID, endpoint, csiVersion, identityVersion,
 	driver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 	})
 
-	driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	driver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	})
 
 	// Longhorn API Client
 	clientOpts := &longhornclient.ClientOpts{Url: managerURL}
@@ -52,7 +58,7 @@ func (m *Manager) Run(driverName, nodeID, endpoint, csiVersion, identityVersion,
 
 	// Create GRPC servers
 	m.ids = NewIdentityServer(driverName, identityVersion)
-	m.ns = NewNodeServer(driver)
+	m.ns = NewNodeServer(driver, apiClient)
 	m.cs = NewControllerServer(driver, apiClient)
 	s := csicommon.NewNonBlockingGRPCServer()
 	s.Start(endpoint, m.ids, m.cs, m.ns)
@@ -3,6 +3,8 @@ package csi
 import (
 	"context"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
@@ -11,27 +13,61 @@ import (
 	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
 	volumeutil "k8s.io/kubernetes/pkg/volume/util"
+
+	longhornclient "github.com/rancher/longhorn-manager/client"
 )
 
 type NodeServer struct {
 	*csicommon.DefaultNodeServer
+	apiClient *longhornclient.RancherClient
 }
 
-func NewNodeServer(d *csicommon.CSIDriver) *NodeServer {
+func NewNodeServer(d *csicommon.CSIDriver, apiClient *longhornclient.RancherClient) *NodeServer {
 	return &NodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
+		apiClient:         apiClient,
+	}
+}
+
+// NodeGetInfo returns the zone of the Longhorn node as the topology, for the
+// provisioner to pass the zones the workload can be scheduled to when
+// creating the volume. It's only called by kubelet when the plugin is
+// registered, so the zone changed later is picked up after the plugin
+// restarts.
+func (ns *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	node, err := ns.apiClient.Node.ById(resp.GetNodeId())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	// the Longhorn node is created once the manager on the node is up
+	if node == nil {
+		return nil, status.Errorf(codes.Unavailable, "Longhorn node %s not found", resp.GetNodeId())
 	}
+	if node.Zone != "" {
+		resp.AccessibleTopology = &csi.Topology{
+			Segments: map[string]string{
+				topologyKeyZone: node.Zone,
+			},
+		}
+	}
+	return resp, nil
 }
 
-// NodePublishVolume will mount the volume /dev/longhorn/<volume_name> to target_path
+// NodePublishVolume will mount the volume /dev/longhorn/<volume_name>, or the
+// device of the iSCSI target in the publish info, to target_path. The device
+// of the raw block volume is bind mounted to target_path instead.
 func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	logrus.Infof("NodeServer NodePublishVolume req: %v", req)
 
-	readOnly := req.GetReadonly()
-	if readOnly {
-		return nil, status.Error(codes.FailedPrecondition, "Not support readOnly")
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return ns.nodePublishBlockVolume(req)
 	}
 
+	readOnly := req.GetReadonly()
 	targetPath := req.GetTargetPath()
 
 	notMnt, err := isLikelyNotMountPointAttach(targetPath)
@@ -44,11 +80,17 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
-	devicePath := fmt.Sprintf("/dev/longhorn/%s", req.GetVolumeId())
+	devicePath, err := getVolumeDevicePath(req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	options := []string{}
 	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 	options = append(options, mountFlags...)
+	if readOnly {
+		options = append(options, "ro")
+	}
 
 	diskMounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: mount.NewOsExec()}
 	if err := diskMounter.FormatAndMount(devicePath, targetPath, fsType, options); err != nil {
@@ -59,11 +101,60 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// nodePublishBlockVolume bind mounts the device to target_path, which is a
+// file rather than a directory, for kubelet to expose the device to the pod
+func (ns *NodeServer) nodePublishBlockVolume(req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+
+	mounts, err := getDeviceMounts()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if _, ok := mounts[targetPath]; ok {
+		logrus.Debugf("NodePublishVolume: the block volume %s has been published", req.GetVolumeId())
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	devicePath, err := getVolumeDevicePath(req)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := makeFile(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	if err := mount.New("").Mount(devicePath, targetPath, "", options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	logrus.Debugf("NodePublishVolume: done block volume %s", req.GetVolumeId())
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// getVolumeDevicePath returns /dev/longhorn/<volume_name>, or logs in the
+// iSCSI target in the publish info and returns its device for the volume
+// exported by iSCSI, e.g. the one attached read-only to multiple nodes
+func getVolumeDevicePath(req *csi.NodePublishVolumeRequest) (string, error) {
+	endpoint := req.GetPublishInfo()[publishInfoEndpoint]
+	if endpoint == "" {
+		return fmt.Sprintf("/dev/longhorn/%s", req.GetVolumeId()), nil
+	}
+	return loginISCSITarget(endpoint, req.GetReadonly())
+}
+
 func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	logrus.Infof("NodeServer NodeUnpublishVolume req: %v", req)
 
 	targetPath := req.GetTargetPath()
 
+	// the target of the raw block volume is the device file
+	if info, err := os.Stat(targetPath); err == nil && !info.IsDir() {
+		return ns.nodeUnpublishBlockVolume(req)
+	}
+
 	notMnt, err := isLikelyNotMountPointDetach(targetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -72,15 +163,57 @@ func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.NotFound, "Volume not mounted")
 	}
 
-	err = volumeutil.UnmountPath(req.GetTargetPath(), mount.New(""))
+	mounter := mount.New("")
+	device, refCount, err := mount.GetDeviceNameFromMount(mounter, targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = volumeutil.UnmountPath(req.GetTargetPath(), mounter)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+
+	// log out the iSCSI target once the device is no longer mounted
+	if !strings.HasPrefix(device, "/dev/longhorn/") && refCount <= 1 {
+		if err := logoutISCSITarget(req.GetVolumeId()); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
 	logrus.Debugf("NodeUnpublishVolume: done %s", req.GetVolumeId())
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+func (ns *NodeServer) nodeUnpublishBlockVolume(req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+
+	mounts, err := getDeviceMounts()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	device, mounted := mounts[targetPath]
+	if mounted {
+		if err := mount.New("").Unmount(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// log out the iSCSI target once the device is no longer published to
+	// any pod on the node
+	if mounted && !strings.HasPrefix(device, "/dev/longhorn/") && !isDeviceMounted(mounts, device, targetPath) {
+		if err := logoutISCSITarget(req.GetVolumeId()); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	logrus.Debugf("NodeUnpublishVolume: done block volume %s", req.GetVolumeId())
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
 func (ns *NodeServer) NodeStageVolume(
 	ctx context.Context,
 	req *csi.NodeStageVolumeRequest) (
@@ -1,19 +1,35 @@
 package csi
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/pkg/errors"
 	"k8s.io/kubernetes/pkg/util/mount"
 
 	longhornclient "github.com/rancher/longhorn-manager/client"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
 )
 
 const (
 	defaultStaleReplicaTimeout = 20
 	defaultNumberOfReplicas    = 2
+
+	snapshotIDSeparator = "/"
+
+	procMountInfoPath = "/proc/self/mountinfo"
+
+	// topologyKeyZone is the topology segment of the zone of the node,
+	// read from the Kubernetes node label by Longhorn
+	topologyKeyZone = DefaultCSIDriverName + "/zone"
 )
 
 func getVolumeOptions(volOptions map[string]string) (*longhornclient.Volume, error) {
@@ -49,9 +65,26 @@ func getVolumeOptions(volOptions map[string]string) (*longhornclient.Volume, err
 		vol.BaseImage = baseImage
 	}
 
+	qos, err := types.GetVolumeQoSFromOptions(volOptions)
+	if err != nil {
+		return nil, err
+	}
+	if qos != (types.VolumeQoS{}) {
+		vol.Qos = toClientVolumeQoS(qos)
+	}
+
 	return vol, nil
 }
 
+func toClientVolumeQoS(qos types.VolumeQoS) *longhornclient.VolumeQoS {
+	return &longhornclient.VolumeQoS{
+		ReadIOPS:       int64(qos.ReadIOPS),
+		WriteIOPS:      int64(qos.WriteIOPS),
+		ReadBandwidth:  int64(qos.ReadBandwidth),
+		WriteBandwidth: int64(qos.WriteBandwidth),
+	}
+}
+
 func isLikelyNotMountPointAttach(targetpath string) (bool, error) {
 	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetpath)
 	if err != nil {
@@ -74,3 +107,217 @@ func isLikelyNotMountPointDetach(targetpath string) (bool, error) {
 	}
 	return notMnt, err
 }
+
+// makeFile creates the empty file as the target to bind mount the device of
+// the raw block volume to
+func makeFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// getDeviceMounts returns the devices bind mounted, e.g. as the raw block
+// volumes, keyed by the mount point
+func getDeviceMounts() (map[string]string, error) {
+	f, err := os.Open(procMountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseDeviceMounts(f)
+}
+
+// parseDeviceMounts parses the mountinfo. The device bind mounted is the
+// root of the mount of devtmpfs, e.g. /sdb for /dev/sdb.
+func parseDeviceMounts(r io.Reader) (map[string]string, error) {
+	mounts := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+1 >= len(fields) {
+			return nil, fmt.Errorf("invalid mountinfo line %q", scanner.Text())
+		}
+		if fields[sep+1] != "devtmpfs" || fields[3] == "/" {
+			continue
+		}
+		mounts[fields[4]] = "/dev" + fields[3]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// isDeviceMounted returns true if the device is bind mounted to any mount
+// point other than the excluded one
+func isDeviceMounted(mounts map[string]string, device, excludedMountPoint string) bool {
+	for mountPoint, dev := range mounts {
+		if dev == device && mountPoint != excludedMountPoint {
+			return true
+		}
+	}
+	return false
+}
+
+// getRequisiteZones returns the zones of the requisite topologies, or nil for
+// any zone if the requisite is empty or any of the topologies has no zone
+func getRequisiteZones(requirement *csi.TopologyRequirement) []string {
+	foundZones := map[string]struct{}{}
+	for _, topology := range requirement.GetRequisite() {
+		zone := topology.GetSegments()[topologyKeyZone]
+		if zone == "" {
+			return nil
+		}
+		foundZones[zone] = struct{}{}
+	}
+	if len(foundZones) == 0 {
+		return nil
+	}
+	zones := []string{}
+	for zone := range foundZones {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// isVolumeOnNode returns true if the engine of the volume is on the node, or
+// the volume attached read-only to multiple nodes is attached to the node
+func isVolumeOnNode(vol *longhornclient.Volume, nodeID string) bool {
+	if len(vol.ReadOnlyNodeIDs) != 0 {
+		return isReadOnlyNode(vol, nodeID)
+	}
+	for _, controller := range vol.Controllers {
+		if controller.HostId == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// isVolumeDetached returns true if the volume is detached, including the one
+// detached and moved to the trash on deletion
+func isVolumeDetached(vol *longhornclient.Volume) bool {
+	return vol.State == string(types.VolumeStateDetached) || vol.State == string(types.VolumeStateTrashed)
+}
+
+// isReadOnlyNode returns true if the volume is attached read-only to the node
+func isReadOnlyNode(vol *longhornclient.Volume, nodeID string) bool {
+	for _, id := range vol.ReadOnlyNodeIDs {
+		if id == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// isVolumeAttachedToOtherNode returns true if the volume is attaching or
+// attached with the engine on the other node than nodeID, or attached
+// read-only to the other nodes only
+func isVolumeAttachedToOtherNode(vol *longhornclient.Volume, nodeID string) bool {
+	if vol.State != string(types.VolumeStateAttaching) && vol.State != string(types.VolumeStateAttached) {
+		return false
+	}
+	if len(vol.ReadOnlyNodeIDs) != 0 {
+		return !isReadOnlyNode(vol, nodeID)
+	}
+	for _, controller := range vol.Controllers {
+		if controller.HostId != "" && controller.HostId != nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// getReadOnlyManyRequired returns true if any of the capabilities asks for
+// ReadOnlyMany, or error if any of them asks for the access mode unsupported
+func getReadOnlyManyRequired(caps []*csi.VolumeCapability) (bool, error) {
+	rox := false
+	for _, cap := range caps {
+		switch mode := cap.GetAccessMode().GetMode(); mode {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+			rox = true
+		default:
+			return false, fmt.Errorf("access mode %v is not supported", mode)
+		}
+	}
+	return rox, nil
+}
+
+// getPublishInfo returns the iSCSI target of the volume for the nodes to log
+// in, if the volume is exported by iSCSI instead of the block device
+func getPublishInfo(vol *longhornclient.Volume) map[string]string {
+	for _, controller := range vol.Controllers {
+		if strings.HasPrefix(controller.Endpoint, iscsiEndpointPrefix) {
+			return map[string]string{publishInfoEndpoint: controller.Endpoint}
+		}
+	}
+	return nil
+}
+
+// snapshotBackup is the backup of the Longhorn snapshot taken for the CSI
+// snapshot, either in the backupstore or still tracked by the backup status
+type snapshotBackup struct {
+	// name is the backup in the backupstore, empty if the backup is not
+	// completed
+	name    string
+	state   types.BackupTicketState
+	error   string
+	url     string
+	created string
+	size    string
+}
+
+// encodeSnapshotID returns the ID of the CSI snapshot, which is the Longhorn
+// snapshot of the volume. The snapshot is found by the ID alone, even after
+// the volume is deleted.
+func encodeSnapshotID(volumeName, snapshotName string) string {
+	return volumeName + snapshotIDSeparator + snapshotName
+}
+
+func decodeSnapshotID(snapshotID string) (volumeName, snapshotName string, err error) {
+	parts := strings.Split(snapshotID, snapshotIDSeparator)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid snapshot ID %v", snapshotID)
+	}
+	return parts[0], parts[1], nil
+}
+
+func toCSISnapshot(volumeName, snapshotName string, b *snapshotBackup) *csi.Snapshot {
+	snapshot := &csi.Snapshot{
+		Id:             encodeSnapshotID(volumeName, snapshotName),
+		SourceVolumeId: volumeName,
+		Status:         &csi.SnapshotStatus{},
+	}
+	if size, err := util.ConvertSize(b.size); err == nil {
+		snapshot.SizeBytes = size
+	}
+	if created, err := util.ParseTime(b.created); err == nil {
+		snapshot.CreatedAt = created.UnixNano()
+	}
+	switch b.state {
+	case types.BackupTicketStateCompleted:
+		snapshot.Status.Type = csi.SnapshotStatus_READY
+	case types.BackupTicketStatePending, types.BackupTicketStateInProgress:
+		snapshot.Status.Type = csi.SnapshotStatus_UPLOADING
+	case types.BackupTicketStateError:
+		snapshot.Status.Type = csi.SnapshotStatus_ERROR_UPLOADING
+		snapshot.Status.Details = b.error
+	default:
+		snapshot.Status.Type = csi.SnapshotStatus_UNKNOWN
+	}
+	return snapshot
+}
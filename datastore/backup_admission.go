@@ -0,0 +1,409 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+
+	lhclientset "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned"
+)
+
+const (
+	// BackupAdmissionConfigMapName is the config map keeping the tickets of
+	// the backups waiting or in progress
+	BackupAdmissionConfigMapName = "longhorn-backup-admission"
+	backupAdmissionTicketsKey    = "tickets"
+
+	// BackupTicketTimeout marks the ticket no longer renewed as error, e.g.
+	// of the recurring job pod killed, so the slot won't leak
+	BackupTicketTimeout = 2 * time.Minute
+	// BackupStatusRetention is how long the finished tickets are kept for
+	// the status of the backups
+	BackupStatusRetention = time.Hour
+
+	defaultBackupAdmissionPollPeriod     = 10 * time.Second
+	defaultBackupTicketHeartbeatPeriod   = 30 * time.Second
+	backupAdmissionUpdateConflictRetries = 10
+)
+
+// BackupLimits are the limits of the concurrent backups. 0 means unlimited.
+type BackupLimits struct {
+	PerNode int64
+	Cluster int64
+}
+
+// BackupAdmission queues the backups over the limits of the concurrent
+// backups. The tickets are kept in a config map shared by the managers and
+// the recurring job pods, and every change is a conflict-checked update of
+// it, so the limits hold across the cluster. The tickets are also the status
+// of the backups, kept for a while after the backups are finished.
+type BackupAdmission struct {
+	kubeClient clientset.Interface
+	namespace  string
+	limits     func() (BackupLimits, error)
+
+	pollPeriod      time.Duration
+	heartbeatPeriod time.Duration
+}
+
+func NewBackupAdmission(kubeClient clientset.Interface, namespace string, limits func() (BackupLimits, error)) *BackupAdmission {
+	return &BackupAdmission{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		limits:     limits,
+
+		pollPeriod:      defaultBackupAdmissionPollPeriod,
+		heartbeatPeriod: defaultBackupTicketHeartbeatPeriod,
+	}
+}
+
+// NewBackupAdmission returns the backup admission with the limits of the
+// settings
+func (s *DataStore) NewBackupAdmission() *BackupAdmission {
+	return NewBackupAdmission(s.kubeClient, s.namespace, s.GetBackupLimits)
+}
+
+func (s *DataStore) GetBackupLimits() (BackupLimits, error) {
+	perNode, err := s.GetSettingAsInt(types.SettingNameConcurrentBackupLimitPerNode)
+	if err != nil {
+		return BackupLimits{}, err
+	}
+	cluster, err := s.GetSettingAsInt(types.SettingNameConcurrentBackupLimit)
+	if err != nil {
+		return BackupLimits{}, err
+	}
+	return BackupLimits{PerNode: perNode, Cluster: cluster}, nil
+}
+
+// GetBackupLimitsFromClient reads the limits of the concurrent backups from
+// the API server, for the recurring job pods without the informers
+func GetBackupLimitsFromClient(lhClient lhclientset.Interface, namespace string) (BackupLimits, error) {
+	getLimit := func(name types.SettingName) (int64, error) {
+		value := types.SettingDefinitions[name].Default
+		setting, err := lhClient.LonghornV1alpha1().Settings(namespace).Get(string(name), metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return 0, err
+		}
+		if err == nil {
+			value = setting.Value
+		}
+		return strconv.ParseInt(value, 10, 64)
+	}
+	perNode, err := getLimit(types.SettingNameConcurrentBackupLimitPerNode)
+	if err != nil {
+		return BackupLimits{}, err
+	}
+	cluster, err := getLimit(types.SettingNameConcurrentBackupLimit)
+	if err != nil {
+		return BackupLimits{}, err
+	}
+	return BackupLimits{PerNode: perNode, Cluster: cluster}, nil
+}
+
+// Queue records the backup as pending, so it can be followed since it's
+// requested. The ticket returned is to be waited for by Acquire.
+func (a *BackupAdmission) Queue(ticket types.BackupTicket) (types.BackupTicket, error) {
+	now := util.Now()
+	ticket.ID = util.RandomID()
+	ticket.State = types.BackupTicketStatePending
+	ticket.Requested = now
+	ticket.Heartbeat = now
+	if err := a.update(func(tickets []types.BackupTicket) []types.BackupTicket {
+		return append(tickets, ticket)
+	}); err != nil {
+		return types.BackupTicket{}, errors.Wrapf(err, "cannot queue the backup of volume %v", ticket.Volume)
+	}
+	return ticket, nil
+}
+
+// Acquire waits until the queued backup is admitted under the limits, or
+// stopCh is closed. The finish returned must be called with the result once
+// the backup is done, to free the slot and record the result.
+func (a *BackupAdmission) Acquire(ticket types.BackupTicket, stopCh <-chan struct{}) (finish func(url string, backupErr error), err error) {
+	lastHeartbeat := time.Now()
+	for {
+		admitted := false
+		limits, err := a.limits()
+		if err != nil {
+			logrus.Warnf("Fail to get the limits of the concurrent backups, retry later: %v", err)
+		} else if err = a.update(func(tickets []types.BackupTicket) []types.BackupTicket {
+			restored := false
+			if own := findBackupTicket(tickets, ticket.ID); own == nil || own.State != types.BackupTicketStatePending {
+				// dropped or marked as error after the timeout, e.g.
+				// the API server was unreachable for a while
+				tickets = append(removeBackupTicket(tickets, ticket.ID), ticket)
+				restored = true
+			}
+			own := findBackupTicket(tickets, ticket.ID)
+			if admittableBackupTickets(tickets, limits)[ticket.ID] {
+				own.State = types.BackupTicketStateInProgress
+				admitted = true
+			} else if !restored && time.Since(lastHeartbeat) < a.heartbeatPeriod {
+				// nothing to write
+				return nil
+			}
+			own.Heartbeat = util.Now()
+			return tickets
+		}); err != nil {
+			logrus.Warnf("Fail to check the admission of the backup of volume %v, retry later: %v", ticket.Volume, err)
+		} else if admitted {
+			break
+		} else if time.Since(lastHeartbeat) >= a.heartbeatPeriod {
+			lastHeartbeat = time.Now()
+		}
+
+		select {
+		case <-stopCh:
+			err := fmt.Errorf("stopped waiting for the backup slot of volume %v", ticket.Volume)
+			a.finish(ticket, "", err)
+			return nil, err
+		case <-time.After(a.pollPeriod):
+		}
+	}
+
+	ticket.State = types.BackupTicketStateInProgress
+	done := make(chan struct{})
+	go a.renew(ticket, done)
+	return func(url string, backupErr error) {
+		close(done)
+		a.finish(ticket, url, backupErr)
+	}, nil
+}
+
+// finish records the result of the backup in the ticket
+func (a *BackupAdmission) finish(ticket types.BackupTicket, url string, backupErr error) {
+	if err := a.update(func(tickets []types.BackupTicket) []types.BackupTicket {
+		if findBackupTicket(tickets, ticket.ID) == nil {
+			tickets = append(tickets, ticket)
+		}
+		own := findBackupTicket(tickets, ticket.ID)
+		own.Finished = util.Now()
+		own.Heartbeat = own.Finished
+		if backupErr != nil {
+			own.State = types.BackupTicketStateError
+			own.Error = backupErr.Error()
+			return tickets
+		}
+		own.State = types.BackupTicketStateCompleted
+		own.Progress = 100
+		own.URL = url
+		own.Error = ""
+		return tickets
+	}); err != nil {
+		logrus.Warnf("Fail to record the result of the backup ticket %v of volume %v, it will be marked as error after %v: %v",
+			ticket.ID, ticket.Volume, BackupTicketTimeout, err)
+	}
+}
+
+// renew keeps the ticket of the backup in progress from timing out
+func (a *BackupAdmission) renew(ticket types.BackupTicket, done <-chan struct{}) {
+	ticker := time.NewTicker(a.heartbeatPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := a.update(func(tickets []types.BackupTicket) []types.BackupTicket {
+			if own := findBackupTicket(tickets, ticket.ID); own == nil || own.IsFinished() {
+				// marked as error after the timeout while the backup
+				// is still in progress
+				tickets = append(removeBackupTicket(tickets, ticket.ID), ticket)
+			}
+			findBackupTicket(tickets, ticket.ID).Heartbeat = util.Now()
+			return tickets
+		}); err != nil {
+			logrus.Warnf("Fail to renew the backup ticket %v: %v", ticket.ID, err)
+		}
+	}
+}
+
+// ListBackupTickets returns the tickets of the backups waiting or in
+// progress, and of the ones finished within the retention
+func (a *BackupAdmission) ListBackupTickets() ([]types.BackupTicket, error) {
+	cm, err := a.kubeClient.CoreV1().ConfigMaps(a.namespace).Get(BackupAdmissionConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return []types.BackupTicket{}, nil
+		}
+		return nil, err
+	}
+	tickets, err := decodeBackupTickets(cm)
+	if err != nil {
+		return nil, err
+	}
+	tickets, _ = expireBackupTickets(tickets, time.Now())
+	return tickets, nil
+}
+
+// update applies mutate to the tickets after the expiration, and writes them back
+// unless mutate returns nil. It's retried on conflict.
+func (a *BackupAdmission) update(mutate func(tickets []types.BackupTicket) []types.BackupTicket) error {
+	var err error
+	for i := 0; i < backupAdmissionUpdateConflictRetries; i++ {
+		err = a.tryUpdate(mutate)
+		if err == nil || !(apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)) {
+			return err
+		}
+	}
+	return err
+}
+
+func (a *BackupAdmission) tryUpdate(mutate func(tickets []types.BackupTicket) []types.BackupTicket) error {
+	configMaps := a.kubeClient.CoreV1().ConfigMaps(a.namespace)
+	cm, err := configMaps.Get(BackupAdmissionConfigMapName, metav1.GetOptions{})
+	exists := err == nil
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: BackupAdmissionConfigMapName,
+			},
+		}
+	}
+	tickets, err := decodeBackupTickets(cm)
+	if err != nil {
+		return err
+	}
+	current, expired := expireBackupTickets(tickets, time.Now())
+	for _, t := range tickets {
+		if c := findBackupTicket(current, t.ID); !t.IsFinished() && c != nil && c.IsFinished() {
+			logrus.Warnf("Mark the backup ticket %v of volume %v as error, last heartbeat at %v", t.ID, t.Volume, t.Heartbeat)
+		}
+	}
+
+	updated := mutate(current)
+	if updated == nil {
+		if !expired {
+			return nil
+		}
+		// still written for the expiration
+		updated = current
+	}
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[backupAdmissionTicketsKey] = string(data)
+	if !exists {
+		_, err = configMaps.Create(cm)
+		return err
+	}
+	_, err = configMaps.Update(cm)
+	return err
+}
+
+func decodeBackupTickets(cm *v1.ConfigMap) ([]types.BackupTicket, error) {
+	tickets := []types.BackupTicket{}
+	data := cm.Data[backupAdmissionTicketsKey]
+	if data == "" {
+		return tickets, nil
+	}
+	if err := json.Unmarshal([]byte(data), &tickets); err != nil {
+		return nil, errors.Wrapf(err, "invalid backup tickets in config map %v", cm.Name)
+	}
+	return tickets, nil
+}
+
+// expireBackupTickets marks the tickets not renewed within the timeout as
+// error, and drops the finished ones after the retention. It returns
+// whether anything is changed.
+func expireBackupTickets(tickets []types.BackupTicket, now time.Time) ([]types.BackupTicket, bool) {
+	result := []types.BackupTicket{}
+	changed := false
+	for _, t := range tickets {
+		if t.IsFinished() {
+			finished, err := util.ParseTime(t.Finished)
+			if err != nil || now.Sub(finished) > BackupStatusRetention {
+				changed = true
+				continue
+			}
+		} else if heartbeat, err := util.ParseTime(t.Heartbeat); err != nil || now.Sub(heartbeat) > BackupTicketTimeout {
+			t.State = types.BackupTicketStateError
+			t.Error = fmt.Sprintf("lost track of the backup, no heartbeat since %v", t.Heartbeat)
+			t.Finished = now.UTC().Format(time.RFC3339)
+			changed = true
+		}
+		result = append(result, t)
+	}
+	return result, changed
+}
+
+func findBackupTicket(tickets []types.BackupTicket, id string) *types.BackupTicket {
+	for i := range tickets {
+		if tickets[i].ID == id {
+			return &tickets[i]
+		}
+	}
+	return nil
+}
+
+func removeBackupTicket(tickets []types.BackupTicket, id string) []types.BackupTicket {
+	result := []types.BackupTicket{}
+	for _, t := range tickets {
+		if t.ID != id {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// admittableBackupTickets returns the pending tickets which can start under
+// the limits. The tickets are admitted in the order of the priority then of
+// the request, and the one waiting for its node doesn't block the others on
+// the other nodes.
+func admittableBackupTickets(tickets []types.BackupTicket, limits BackupLimits) map[string]bool {
+	clusterCount := int64(0)
+	nodeCount := map[string]int64{}
+	pending := []types.BackupTicket{}
+	for _, t := range tickets {
+		if t.IsFinished() {
+			continue
+		}
+		if t.State == types.BackupTicketStateInProgress {
+			clusterCount++
+			nodeCount[t.Node]++
+			continue
+		}
+		pending = append(pending, t)
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		if pending[i].Priority != pending[j].Priority {
+			return pending[i].Priority
+		}
+		return pending[i].Requested < pending[j].Requested
+	})
+
+	admittable := map[string]bool{}
+	for _, t := range pending {
+		if limits.Cluster != 0 && clusterCount >= limits.Cluster {
+			break
+		}
+		if limits.PerNode != 0 && nodeCount[t.Node] >= limits.PerNode {
+			continue
+		}
+		admittable[t.ID] = true
+		clusterCount++
+		nodeCount[t.Node]++
+	}
+	return admittable
+}
@@ -0,0 +1,216 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+func newTestBackupTicket(id, node string, state types.BackupTicketState, requested string, priority bool) types.BackupTicket {
+	return types.BackupTicket{
+		ID:        id,
+		Volume:    id + "-volume",
+		Node:      node,
+		Priority:  priority,
+		State:     state,
+		Requested: requested,
+		Heartbeat: util.Now(),
+	}
+}
+
+func newTestBackupAdmission(kubeClient *fake.Clientset, limits BackupLimits) *BackupAdmission {
+	a := NewBackupAdmission(kubeClient, testNamespace, func() (BackupLimits, error) {
+		return limits, nil
+	})
+	a.pollPeriod = 10 * time.Millisecond
+	return a
+}
+
+func TestAdmittableBackupTickets(t *testing.T) {
+	assert := require.New(t)
+
+	pending := types.BackupTicketStatePending
+	inProgress := types.BackupTicketStateInProgress
+	tickets := []types.BackupTicket{
+		newTestBackupTicket("running", "node-1", inProgress, "2019-01-01T00:00:00Z", false),
+		newTestBackupTicket("oldest", "node-1", pending, "2019-01-01T00:00:01Z", false),
+		newTestBackupTicket("older", "node-2", pending, "2019-01-01T00:00:02Z", false),
+		newTestBackupTicket("newer", "node-2", pending, "2019-01-01T00:00:03Z", false),
+		newTestBackupTicket("priority", "node-3", pending, "2019-01-01T00:00:04Z", true),
+		newTestBackupTicket("completed", "node-2", types.BackupTicketStateCompleted, "2018-01-01T00:00:00Z", false),
+		newTestBackupTicket("error", "node-3", types.BackupTicketStateError, "2018-01-01T00:00:00Z", false),
+	}
+
+	admittable := admittableBackupTickets(tickets, BackupLimits{})
+	assert.Equal(map[string]bool{"oldest": true, "older": true, "newer": true, "priority": true}, admittable)
+
+	// the ticket waiting for node-1 doesn't block the others
+	admittable = admittableBackupTickets(tickets, BackupLimits{PerNode: 1})
+	assert.Equal(map[string]bool{"older": true, "priority": true}, admittable)
+
+	// the priority jumps the queue
+	admittable = admittableBackupTickets(tickets, BackupLimits{Cluster: 3})
+	assert.Equal(map[string]bool{"priority": true, "oldest": true}, admittable)
+
+	admittable = admittableBackupTickets(tickets, BackupLimits{PerNode: 1, Cluster: 2})
+	assert.Equal(map[string]bool{"priority": true}, admittable)
+
+	admittable = admittableBackupTickets(tickets, BackupLimits{Cluster: 1})
+	assert.Len(admittable, 0)
+}
+
+func TestExpireBackupTickets(t *testing.T) {
+	assert := require.New(t)
+
+	now := time.Now()
+	expiredTime := now.Add(-BackupStatusRetention - time.Minute).UTC().Format(time.RFC3339)
+	fresh := newTestBackupTicket("fresh", testNode, types.BackupTicketStateInProgress, util.Now(), false)
+	lost := fresh
+	lost.ID = "lost"
+	lost.Heartbeat = now.Add(-BackupTicketTimeout - time.Minute).UTC().Format(time.RFC3339)
+	completed := fresh
+	completed.ID = "completed"
+	completed.State = types.BackupTicketStateCompleted
+	completed.Finished = util.Now()
+	expired := completed
+	expired.ID = "expired"
+	expired.Finished = expiredTime
+
+	tickets, changed := expireBackupTickets([]types.BackupTicket{fresh, completed}, now)
+	assert.False(changed)
+	assert.Equal([]types.BackupTicket{fresh, completed}, tickets)
+
+	tickets, changed = expireBackupTickets([]types.BackupTicket{fresh, lost, completed, expired}, now)
+	assert.True(changed)
+	assert.Len(tickets, 3)
+	assert.Equal("fresh", tickets[0].ID)
+	assert.Equal("lost", tickets[1].ID)
+	assert.Equal(types.BackupTicketStateError, tickets[1].State)
+	assert.NotEqual("", tickets[1].Error)
+	assert.NotEqual("", tickets[1].Finished)
+	assert.Equal("completed", tickets[2].ID)
+}
+
+func TestBackupAdmissionUnlimited(t *testing.T) {
+	assert := require.New(t)
+
+	kubeClient := fake.NewSimpleClientset()
+	a := newTestBackupAdmission(kubeClient, BackupLimits{})
+
+	ticket, err := a.Queue(types.BackupTicket{Volume: testVolume, Node: testNode})
+	assert.Nil(err)
+	assert.Equal(types.BackupTicketStatePending, ticket.State)
+	finish, err := a.Acquire(ticket, nil)
+	assert.Nil(err)
+	finish("s3://backupbucket@us-east-1/backupstore?backup=backup-1&volume="+testVolume, nil)
+
+	tickets, err := a.ListBackupTickets()
+	assert.Nil(err)
+	assert.Len(tickets, 1)
+	assert.Equal(ticket.ID, tickets[0].ID)
+	assert.Equal(types.BackupTicketStateCompleted, tickets[0].State)
+	assert.Equal(100, tickets[0].Progress)
+	assert.Equal("s3://backupbucket@us-east-1/backupstore?backup=backup-1&volume="+testVolume, tickets[0].URL)
+	assert.NotEqual("", tickets[0].Finished)
+}
+
+func TestBackupAdmissionAcquire(t *testing.T) {
+	assert := require.New(t)
+
+	kubeClient := fake.NewSimpleClientset()
+	a := newTestBackupAdmission(kubeClient, BackupLimits{Cluster: 1})
+
+	ticket1, err := a.Queue(types.BackupTicket{Volume: "volume-1", Node: testNode})
+	assert.Nil(err)
+	finish1, err := a.Acquire(ticket1, nil)
+	assert.Nil(err)
+
+	ticket2, err := a.Queue(types.BackupTicket{Volume: "volume-2", Node: testNode})
+	assert.Nil(err)
+	acquired := make(chan func(string, error))
+	go func() {
+		finish, err := a.Acquire(ticket2, nil)
+		if err != nil {
+			close(acquired)
+			return
+		}
+		acquired <- finish
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("the second backup is admitted over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(map[string]types.BackupTicketState{
+		"volume-1": types.BackupTicketStateInProgress,
+		"volume-2": types.BackupTicketStatePending,
+	}, getBackupTicketStates(assert, a))
+
+	finish1("", fmt.Errorf("cannot connect to the backupstore"))
+	select {
+	case finish2, ok := <-acquired:
+		assert.True(ok)
+		finish2("", nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second backup isn't admitted after the first is finished")
+	}
+
+	assert.Equal(map[string]types.BackupTicketState{
+		"volume-1": types.BackupTicketStateError,
+		"volume-2": types.BackupTicketStateCompleted,
+	}, getBackupTicketStates(assert, a))
+	tickets, err := a.ListBackupTickets()
+	assert.Nil(err)
+	for _, t := range tickets {
+		if t.Volume == "volume-1" {
+			assert.Equal("cannot connect to the backupstore", t.Error)
+		}
+	}
+}
+
+func TestBackupAdmissionStop(t *testing.T) {
+	assert := require.New(t)
+
+	kubeClient := fake.NewSimpleClientset()
+	a := newTestBackupAdmission(kubeClient, BackupLimits{PerNode: 1})
+
+	ticket1, err := a.Queue(types.BackupTicket{Volume: "volume-1", Node: testNode})
+	assert.Nil(err)
+	finish, err := a.Acquire(ticket1, nil)
+	assert.Nil(err)
+	defer finish("", nil)
+
+	ticket2, err := a.Queue(types.BackupTicket{Volume: "volume-2", Node: testNode})
+	assert.Nil(err)
+	stopCh := make(chan struct{})
+	result := make(chan error)
+	go func() {
+		_, err := a.Acquire(ticket2, stopCh)
+		result <- err
+	}()
+	close(stopCh)
+	assert.NotNil(<-result)
+
+	assert.Equal(map[string]types.BackupTicketState{
+		"volume-1": types.BackupTicketStateInProgress,
+		"volume-2": types.BackupTicketStateError,
+	}, getBackupTicketStates(assert, a))
+}
+
+func getBackupTicketStates(assert *require.Assertions, a *BackupAdmission) map[string]types.BackupTicketState {
+	tickets, err := a.ListBackupTickets()
+	assert.Nil(err)
+	states := map[string]types.BackupTicketState{}
+	for _, t := range tickets {
+		states[t.Volume] = t.State
+	}
+	return states
+}
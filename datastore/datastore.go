@@ -2,13 +2,17 @@ package datastore
 
 import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	appsinformers_v1beta2 "k8s.io/client-go/informers/apps/v1beta2"
 	batchinformers_v1beta1 "k8s.io/client-go/informers/batch/v1beta1"
 	coreinformers "k8s.io/client-go/informers/core/v1"
+	storageinformers_v1beta1 "k8s.io/client-go/informers/storage/v1beta1"
 	clientset "k8s.io/client-go/kubernetes"
 	appslisters_v1beta2 "k8s.io/client-go/listers/apps/v1beta2"
 	batchlisters_v1beta1 "k8s.io/client-go/listers/batch/v1beta1"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters_v1beta1 "k8s.io/client-go/listers/storage/v1beta1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/kubernetes/pkg/controller"
 
@@ -20,27 +24,44 @@ import (
 type DataStore struct {
 	namespace string
 
-	lhClient     lhclientset.Interface
-	vLister      lhlisters.VolumeLister
-	vStoreSynced cache.InformerSynced
-	eLister      lhlisters.EngineLister
-	eStoreSynced cache.InformerSynced
-	rLister      lhlisters.ReplicaLister
-	rStoreSynced cache.InformerSynced
-	iLister      lhlisters.EngineImageLister
-	iStoreSynced cache.InformerSynced
-	nLister      lhlisters.NodeLister
-	nStoreSynced cache.InformerSynced
-	sLister      lhlisters.SettingLister
-	sStoreSynced cache.InformerSynced
-
-	kubeClient    clientset.Interface
-	pLister       corelisters.PodLister
-	pStoreSynced  cache.InformerSynced
-	cjLister      batchlisters_v1beta1.CronJobLister
-	cjStoreSynced cache.InformerSynced
-	dsLister      appslisters_v1beta2.DaemonSetLister
-	dsStoreSynced cache.InformerSynced
+	lhClient      lhclientset.Interface
+	vLister       lhlisters.VolumeLister
+	vIndexer      cache.Indexer
+	vStoreSynced  cache.InformerSynced
+	eLister       lhlisters.EngineLister
+	eIndexer      cache.Indexer
+	eStoreSynced  cache.InformerSynced
+	rLister       lhlisters.ReplicaLister
+	rIndexer      cache.Indexer
+	rStoreSynced  cache.InformerSynced
+	iLister       lhlisters.EngineImageLister
+	iStoreSynced  cache.InformerSynced
+	nLister       lhlisters.NodeLister
+	nStoreSynced  cache.InformerSynced
+	sLister       lhlisters.SettingLister
+	sStoreSynced  cache.InformerSynced
+	snLister      lhlisters.SnapshotLister
+	snIndexer     cache.Indexer
+	snStoreSynced cache.InformerSynced
+
+	kubeClient     clientset.Interface
+	pLister        corelisters.PodLister
+	pStoreSynced   cache.InformerSynced
+	cjLister       batchlisters_v1beta1.CronJobLister
+	cjStoreSynced  cache.InformerSynced
+	dsLister       appslisters_v1beta2.DaemonSetLister
+	dsStoreSynced  cache.InformerSynced
+	evLister       corelisters.EventLister
+	evStoreSynced  cache.InformerSynced
+	pvLister       corelisters.PersistentVolumeLister
+	pvStoreSynced  cache.InformerSynced
+	pvcLister      corelisters.PersistentVolumeClaimLister
+	pvcStoreSynced cache.InformerSynced
+	vaLister       storagelisters_v1beta1.VolumeAttachmentLister
+	vaStoreSynced  cache.InformerSynced
+
+	statusSubresources *statusSubresources
+	settingCache       *settingCache
 }
 
 func NewDataStore(
@@ -50,38 +71,65 @@ func NewDataStore(
 	engineImageInformer lhinformers.EngineImageInformer,
 	nodeInformer lhinformers.NodeInformer,
 	settingInformer lhinformers.SettingInformer,
+	snapshotInformer lhinformers.SnapshotInformer,
 	lhClient lhclientset.Interface,
 
 	podInformer coreinformers.PodInformer,
 	cronJobInformer batchinformers_v1beta1.CronJobInformer,
 	daemonSetInformer appsinformers_v1beta2.DaemonSetInformer,
+	eventInformer coreinformers.EventInformer,
+	persistentVolumeInformer coreinformers.PersistentVolumeInformer,
+	persistentVolumeClaimInformer coreinformers.PersistentVolumeClaimInformer,
+	volumeAttachmentInformer storageinformers_v1beta1.VolumeAttachmentInformer,
 	kubeClient clientset.Interface,
 	namespace string) *DataStore {
 
+	addIndexers(volumeInformer.Informer(), volumeIndexers())
+	addIndexers(engineInformer.Informer(), engineIndexers())
+	addIndexers(replicaInformer.Informer(), replicaIndexers())
+	addIndexers(snapshotInformer.Informer(), snapshotIndexers())
+
 	return &DataStore{
 		namespace: namespace,
 
-		lhClient:     lhClient,
-		vLister:      volumeInformer.Lister(),
-		vStoreSynced: volumeInformer.Informer().HasSynced,
-		eLister:      engineInformer.Lister(),
-		eStoreSynced: engineInformer.Informer().HasSynced,
-		rLister:      replicaInformer.Lister(),
-		rStoreSynced: replicaInformer.Informer().HasSynced,
-		iLister:      engineImageInformer.Lister(),
-		iStoreSynced: engineImageInformer.Informer().HasSynced,
-		nLister:      nodeInformer.Lister(),
-		nStoreSynced: nodeInformer.Informer().HasSynced,
-		sLister:      settingInformer.Lister(),
-		sStoreSynced: settingInformer.Informer().HasSynced,
-
-		kubeClient:    kubeClient,
-		pLister:       podInformer.Lister(),
-		pStoreSynced:  podInformer.Informer().HasSynced,
-		cjLister:      cronJobInformer.Lister(),
-		cjStoreSynced: cronJobInformer.Informer().HasSynced,
-		dsLister:      daemonSetInformer.Lister(),
-		dsStoreSynced: daemonSetInformer.Informer().HasSynced,
+		lhClient:      lhClient,
+		vLister:       volumeInformer.Lister(),
+		vIndexer:      volumeInformer.Informer().GetIndexer(),
+		vStoreSynced:  volumeInformer.Informer().HasSynced,
+		eLister:       engineInformer.Lister(),
+		eIndexer:      engineInformer.Informer().GetIndexer(),
+		eStoreSynced:  engineInformer.Informer().HasSynced,
+		rLister:       replicaInformer.Lister(),
+		rIndexer:      replicaInformer.Informer().GetIndexer(),
+		rStoreSynced:  replicaInformer.Informer().HasSynced,
+		iLister:       engineImageInformer.Lister(),
+		iStoreSynced:  engineImageInformer.Informer().HasSynced,
+		nLister:       nodeInformer.Lister(),
+		nStoreSynced:  nodeInformer.Informer().HasSynced,
+		sLister:       settingInformer.Lister(),
+		sStoreSynced:  settingInformer.Informer().HasSynced,
+		snLister:      snapshotInformer.Lister(),
+		snIndexer:     snapshotInformer.Informer().GetIndexer(),
+		snStoreSynced: snapshotInformer.Informer().HasSynced,
+
+		kubeClient:     kubeClient,
+		pLister:        podInformer.Lister(),
+		pStoreSynced:   podInformer.Informer().HasSynced,
+		cjLister:       cronJobInformer.Lister(),
+		cjStoreSynced:  cronJobInformer.Informer().HasSynced,
+		dsLister:       daemonSetInformer.Lister(),
+		dsStoreSynced:  daemonSetInformer.Informer().HasSynced,
+		evLister:       eventInformer.Lister(),
+		evStoreSynced:  eventInformer.Informer().HasSynced,
+		pvLister:       persistentVolumeInformer.Lister(),
+		pvStoreSynced:  persistentVolumeInformer.Informer().HasSynced,
+		pvcLister:      persistentVolumeClaimInformer.Lister(),
+		pvcStoreSynced: persistentVolumeClaimInformer.Informer().HasSynced,
+		vaLister:       volumeAttachmentInformer.Lister(),
+		vaStoreSynced:  volumeAttachmentInformer.Informer().HasSynced,
+
+		statusSubresources: newStatusSubresources(lhClient.Discovery()),
+		settingCache:       newSettingCache(settingInformer),
 	}
 }
 
@@ -89,7 +137,82 @@ func (s *DataStore) Sync(stopCh <-chan struct{}) bool {
 	return controller.WaitForCacheSync("longhorn datastore", stopCh,
 		s.vStoreSynced, s.eStoreSynced, s.rStoreSynced,
 		s.iStoreSynced, s.nStoreSynced, s.sStoreSynced,
-		s.pStoreSynced, s.cjStoreSynced, s.dsStoreSynced)
+		s.snStoreSynced, s.pStoreSynced, s.cjStoreSynced,
+		s.dsStoreSynced, s.evStoreSynced, s.pvStoreSynced,
+		s.pvcStoreSynced, s.vaStoreSynced)
+}
+
+// IsSynced returns true if all the caches of the datastore have synced
+func (s *DataStore) IsSynced() bool {
+	for _, synced := range []cache.InformerSynced{
+		s.vStoreSynced, s.eStoreSynced, s.rStoreSynced,
+		s.iStoreSynced, s.nStoreSynced, s.sStoreSynced,
+		s.snStoreSynced, s.pStoreSynced, s.cjStoreSynced,
+		s.dsStoreSynced, s.evStoreSynced, s.pvStoreSynced,
+		s.pvcStoreSynced, s.vaStoreSynced,
+	} {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckAPIServer verifies the Kubernetes API server and the Longhorn CRDs are
+// reachable, bypassing the caches
+func (s *DataStore) CheckAPIServer() error {
+	_, err := s.lhClient.LonghornV1alpha1().Settings(s.namespace).List(metav1.ListOptions{Limit: 1})
+	return err
+}
+
+// GetCacheSizes returns the number of objects in the cache of each informer,
+// keyed by the resource
+func (s *DataStore) GetCacheSizes() map[string]int {
+	sizes := map[string]int{}
+	everything := labels.Everything()
+	if list, err := s.vLister.List(everything); err == nil {
+		sizes["volumes"] = len(list)
+	}
+	if list, err := s.eLister.List(everything); err == nil {
+		sizes["engines"] = len(list)
+	}
+	if list, err := s.rLister.List(everything); err == nil {
+		sizes["replicas"] = len(list)
+	}
+	if list, err := s.iLister.List(everything); err == nil {
+		sizes["engineimages"] = len(list)
+	}
+	if list, err := s.nLister.List(everything); err == nil {
+		sizes["nodes"] = len(list)
+	}
+	if list, err := s.sLister.List(everything); err == nil {
+		sizes["settings"] = len(list)
+	}
+	if list, err := s.snLister.List(everything); err == nil {
+		sizes["snapshots"] = len(list)
+	}
+	if list, err := s.pLister.List(everything); err == nil {
+		sizes["pods"] = len(list)
+	}
+	if list, err := s.cjLister.List(everything); err == nil {
+		sizes["cronjobs"] = len(list)
+	}
+	if list, err := s.dsLister.List(everything); err == nil {
+		sizes["daemonsets"] = len(list)
+	}
+	if list, err := s.evLister.List(everything); err == nil {
+		sizes["events"] = len(list)
+	}
+	if list, err := s.pvLister.List(everything); err == nil {
+		sizes["persistentvolumes"] = len(list)
+	}
+	if list, err := s.pvcLister.List(everything); err == nil {
+		sizes["persistentvolumeclaims"] = len(list)
+	}
+	if list, err := s.vaLister.List(everything); err == nil {
+		sizes["volumeattachments"] = len(list)
+	}
+	return sizes
 }
 
 func ErrorIsNotFound(err error) bool {
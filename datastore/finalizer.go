@@ -0,0 +1,212 @@
+package datastore
+
+import (
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/rancher/longhorn-manager/util"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+// finalizerClient gets and updates the objects of a kind for the finalizer
+// helpers
+type finalizerClient struct {
+	kind   string
+	get    func(name string) (runtime.Object, error)
+	update func(obj runtime.Object) error
+}
+
+// updateFinalizer adds or removes the longhorn finalizer of the object. It's
+// idempotent, and re-fetches the object and retries on conflict. Removing the
+// finalizer of the object which has gone already is not an error.
+func updateFinalizer(c finalizerClient, obj runtime.Object, add bool) error {
+	metadata, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	name := metadata.GetName()
+	deleting := metadata.GetDeletionTimestamp() != nil
+
+	err = retryOnConflict(func() error {
+		if util.FinalizerExists(longhornFinalizerKey, obj) == add {
+			return nil
+		}
+		if add {
+			if err := util.AddFinalizer(longhornFinalizerKey, obj); err != nil {
+				return err
+			}
+		} else {
+			if err := util.RemoveFinalizer(longhornFinalizerKey, obj); err != nil {
+				return err
+			}
+		}
+		return c.update(obj)
+	}, func() error {
+		latest, err := c.get(name)
+		if err != nil {
+			return err
+		}
+		obj = latest
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+	if add {
+		return errors.Wrapf(err, "unable to add finalizer for %v %v", c.kind, name)
+	}
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	// workaround `StorageError: invalid object, Code: 4` due to empty object
+	if deleting && !apierrors.IsConflict(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "unable to remove finalizer for %v %v", c.kind, name)
+}
+
+func (s *DataStore) volumeFinalizerClient() finalizerClient {
+	return finalizerClient{
+		kind: "volume",
+		get: func(name string) (runtime.Object, error) {
+			return s.lhClient.LonghornV1alpha1().Volumes(s.namespace).Get(name, metav1.GetOptions{})
+		},
+		update: func(obj runtime.Object) error {
+			_, err := s.lhClient.LonghornV1alpha1().Volumes(s.namespace).Update(obj.(*longhorn.Volume))
+			return err
+		},
+	}
+}
+
+func (s *DataStore) engineFinalizerClient() finalizerClient {
+	return finalizerClient{
+		kind: "engine",
+		get: func(name string) (runtime.Object, error) {
+			return s.lhClient.LonghornV1alpha1().Engines(s.namespace).Get(name, metav1.GetOptions{})
+		},
+		update: func(obj runtime.Object) error {
+			_, err := s.lhClient.LonghornV1alpha1().Engines(s.namespace).Update(obj.(*longhorn.Engine))
+			return err
+		},
+	}
+}
+
+func (s *DataStore) replicaFinalizerClient() finalizerClient {
+	return finalizerClient{
+		kind: "replica",
+		get: func(name string) (runtime.Object, error) {
+			return s.lhClient.LonghornV1alpha1().Replicas(s.namespace).Get(name, metav1.GetOptions{})
+		},
+		update: func(obj runtime.Object) error {
+			_, err := s.lhClient.LonghornV1alpha1().Replicas(s.namespace).Update(obj.(*longhorn.Replica))
+			return err
+		},
+	}
+}
+
+func (s *DataStore) engineImageFinalizerClient() finalizerClient {
+	return finalizerClient{
+		kind: "engine image",
+		get: func(name string) (runtime.Object, error) {
+			return s.lhClient.LonghornV1alpha1().EngineImages(s.namespace).Get(name, metav1.GetOptions{})
+		},
+		update: func(obj runtime.Object) error {
+			_, err := s.lhClient.LonghornV1alpha1().EngineImages(s.namespace).Update(obj.(*longhorn.EngineImage))
+			return err
+		},
+	}
+}
+
+func (s *DataStore) nodeFinalizerClient() finalizerClient {
+	return finalizerClient{
+		kind: "node",
+		get: func(name string) (runtime.Object, error) {
+			return s.lhClient.LonghornV1alpha1().Nodes(s.namespace).Get(name, metav1.GetOptions{})
+		},
+		update: func(obj runtime.Object) error {
+			_, err := s.lhClient.LonghornV1alpha1().Nodes(s.namespace).Update(obj.(*longhorn.Node))
+			return err
+		},
+	}
+}
+
+func (s *DataStore) snapshotFinalizerClient() finalizerClient {
+	return finalizerClient{
+		kind: "snapshot",
+		get: func(name string) (runtime.Object, error) {
+			return s.lhClient.LonghornV1alpha1().Snapshots(s.namespace).Get(name, metav1.GetOptions{})
+		},
+		update: func(obj runtime.Object) error {
+			_, err := s.lhClient.LonghornV1alpha1().Snapshots(s.namespace).Update(obj.(*longhorn.Snapshot))
+			return err
+		},
+	}
+}
+
+// AddFinalizerForVolume adds the longhorn finalizer to the volume if missing
+func (s *DataStore) AddFinalizerForVolume(obj *longhorn.Volume) error {
+	return updateFinalizer(s.volumeFinalizerClient(), obj, true)
+}
+
+// RemoveFinalizerForVolume will result in deletion if DeletionTimestamp was set
+func (s *DataStore) RemoveFinalizerForVolume(obj *longhorn.Volume) error {
+	return updateFinalizer(s.volumeFinalizerClient(), obj, false)
+}
+
+// AddFinalizerForEngine adds the longhorn finalizer to the engine if missing
+func (s *DataStore) AddFinalizerForEngine(obj *longhorn.Engine) error {
+	return updateFinalizer(s.engineFinalizerClient(), obj, true)
+}
+
+// RemoveFinalizerForEngine will result in deletion if DeletionTimestamp was set
+func (s *DataStore) RemoveFinalizerForEngine(obj *longhorn.Engine) error {
+	return updateFinalizer(s.engineFinalizerClient(), obj, false)
+}
+
+// AddFinalizerForReplica adds the longhorn finalizer to the replica if missing
+func (s *DataStore) AddFinalizerForReplica(obj *longhorn.Replica) error {
+	return updateFinalizer(s.replicaFinalizerClient(), obj, true)
+}
+
+// RemoveFinalizerForReplica will result in deletion if DeletionTimestamp was set
+func (s *DataStore) RemoveFinalizerForReplica(obj *longhorn.Replica) error {
+	return updateFinalizer(s.replicaFinalizerClient(), obj, false)
+}
+
+// AddFinalizerForEngineImage adds the longhorn finalizer to the engine image
+// if missing
+func (s *DataStore) AddFinalizerForEngineImage(obj *longhorn.EngineImage) error {
+	return updateFinalizer(s.engineImageFinalizerClient(), obj, true)
+}
+
+// RemoveFinalizerForEngineImage will result in deletion if DeletionTimestamp was set
+func (s *DataStore) RemoveFinalizerForEngineImage(obj *longhorn.EngineImage) error {
+	return updateFinalizer(s.engineImageFinalizerClient(), obj, false)
+}
+
+// AddFinalizerForNode adds the longhorn finalizer to the node if missing
+func (s *DataStore) AddFinalizerForNode(obj *longhorn.Node) error {
+	return updateFinalizer(s.nodeFinalizerClient(), obj, true)
+}
+
+// RemoveFinalizerForNode will result in deletion if DeletionTimestamp was set
+func (s *DataStore) RemoveFinalizerForNode(obj *longhorn.Node) error {
+	return updateFinalizer(s.nodeFinalizerClient(), obj, false)
+}
+
+// AddFinalizerForSnapshot adds the longhorn finalizer to the snapshot if
+// missing
+func (s *DataStore) AddFinalizerForSnapshot(obj *longhorn.Snapshot) error {
+	return updateFinalizer(s.snapshotFinalizerClient(), obj, true)
+}
+
+// RemoveFinalizerForSnapshot will result in deletion if DeletionTimestamp was
+// set
+func (s *DataStore) RemoveFinalizerForSnapshot(obj *longhorn.Snapshot) error {
+	return updateFinalizer(s.snapshotFinalizerClient(), obj, false)
+}
@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/util"
+
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+)
+
+func TestAddFinalizer(t *testing.T) {
+	assert := require.New(t)
+
+	lhClient := lhfake.NewSimpleClientset(newTestVolume())
+	ds := newTestDataStore(lhClient)
+
+	v, err := lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+
+	updates := injectConflicts(lhClient, "volumes", 2)
+	assert.Nil(ds.AddFinalizerForVolume(v))
+	assert.Equal(3, *updates)
+
+	v, err = lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal([]string{longhornFinalizerKey}, v.Finalizers)
+
+	// adding it again doesn't update the volume
+	assert.Nil(ds.AddFinalizerForVolume(v))
+	assert.Equal(3, *updates)
+}
+
+func TestRemoveFinalizer(t *testing.T) {
+	assert := require.New(t)
+
+	volume := newTestVolume()
+	volume.Finalizers = []string{longhornFinalizerKey, "others"}
+	lhClient := lhfake.NewSimpleClientset(volume)
+	ds := newTestDataStore(lhClient)
+
+	v, err := lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+
+	updates := injectConflicts(lhClient, "volumes", 1)
+	assert.Nil(ds.RemoveFinalizerForVolume(v))
+	assert.Equal(2, *updates)
+
+	v, err = lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal([]string{"others"}, v.Finalizers)
+
+	// removing it again doesn't update the volume
+	assert.Nil(ds.RemoveFinalizerForVolume(v))
+	assert.Equal(2, *updates)
+
+	// the volume has gone after the conflict
+	v.Finalizers = []string{longhornFinalizerKey}
+	assert.Nil(lhClient.LonghornV1alpha1().Volumes(testNamespace).Delete(testVolume, &metav1.DeleteOptions{}))
+	injectConflicts(lhClient, "volumes", 1)
+	assert.Nil(ds.RemoveFinalizerForVolume(v))
+
+	// the conflicts are given up eventually
+	volume = newTestVolume()
+	volume.Finalizers = []string{longhornFinalizerKey}
+	lhClient = lhfake.NewSimpleClientset(volume)
+	ds = newTestDataStore(lhClient)
+	v, err = lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+	injectConflicts(lhClient, "volumes", StatusUpdateRetryCounts)
+	err = ds.RemoveFinalizerForVolume(v)
+	assert.NotNil(err)
+	assert.True(apierrors.IsConflict(errors.Cause(err)))
+
+	v, err = lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.True(util.FinalizerExists(longhornFinalizerKey, v))
+}
@@ -0,0 +1,289 @@
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+
+	"k8s.io/client-go/tools/cache"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	// IndexByNode indexes the engines and the replicas by spec.NodeID
+	IndexByNode = "node"
+	// IndexByVolume indexes the engines, the replicas and the snapshots by
+	// the label of the volume they belong to
+	IndexByVolume = "volume"
+	// IndexByOwner indexes the volumes by spec.OwnerID
+	IndexByOwner = "owner"
+	// IndexByEviction indexes the volumes evicting a replica, by the
+	// namespace only
+	IndexByEviction = "eviction"
+)
+
+// the index keys contain the namespace since the informers aren't limited to
+// the namespace of Longhorn
+func indexKey(namespace, value string) string {
+	return namespace + "/" + value
+}
+
+func replicaIndexers() cache.Indexers {
+	return cache.Indexers{
+		IndexByNode: func(obj interface{}) ([]string, error) {
+			r, ok := obj.(*longhorn.Replica)
+			if !ok {
+				return nil, fmt.Errorf("BUG: cannot index %T as replica", obj)
+			}
+			if r.Spec.NodeID == "" {
+				return []string{}, nil
+			}
+			return []string{indexKey(r.Namespace, r.Spec.NodeID)}, nil
+		},
+		IndexByVolume: func(obj interface{}) ([]string, error) {
+			r, ok := obj.(*longhorn.Replica)
+			if !ok {
+				return nil, fmt.Errorf("BUG: cannot index %T as replica", obj)
+			}
+			return volumeIndexKeys(r.Namespace, r.Labels), nil
+		},
+	}
+}
+
+func engineIndexers() cache.Indexers {
+	return cache.Indexers{
+		IndexByNode: func(obj interface{}) ([]string, error) {
+			e, ok := obj.(*longhorn.Engine)
+			if !ok {
+				return nil, fmt.Errorf("BUG: cannot index %T as engine", obj)
+			}
+			if e.Spec.NodeID == "" {
+				return []string{}, nil
+			}
+			return []string{indexKey(e.Namespace, e.Spec.NodeID)}, nil
+		},
+		IndexByVolume: func(obj interface{}) ([]string, error) {
+			e, ok := obj.(*longhorn.Engine)
+			if !ok {
+				return nil, fmt.Errorf("BUG: cannot index %T as engine", obj)
+			}
+			return volumeIndexKeys(e.Namespace, e.Labels), nil
+		},
+	}
+}
+
+func volumeIndexers() cache.Indexers {
+	return cache.Indexers{
+		IndexByNode: func(obj interface{}) ([]string, error) {
+			v, ok := obj.(*longhorn.Volume)
+			if !ok {
+				return nil, fmt.Errorf("BUG: cannot index %T as volume", obj)
+			}
+			if v.Spec.NodeID == "" {
+				return []string{}, nil
+			}
+			return []string{indexKey(v.Namespace, v.Spec.NodeID)}, nil
+		},
+		IndexByOwner: func(obj interface{}) ([]string, error) {
+			v, ok := obj.(*longhorn.Volume)
+			if !ok {
+				return nil, fmt.Errorf("BUG: cannot index %T as volume", obj)
+			}
+			if v.Spec.OwnerID == "" {
+				return []string{}, nil
+			}
+			return []string{indexKey(v.Namespace, v.Spec.OwnerID)}, nil
+		},
+		IndexByEviction: func(obj interface{}) ([]string, error) {
+			v, ok := obj.(*longhorn.Volume)
+			if !ok {
+				return nil, fmt.Errorf("BUG: cannot index %T as volume", obj)
+			}
+			if v.Status.EvictingReplica == "" {
+				return []string{}, nil
+			}
+			return []string{v.Namespace}, nil
+		},
+	}
+}
+
+func snapshotIndexers() cache.Indexers {
+	return cache.Indexers{
+		IndexByVolume: func(obj interface{}) ([]string, error) {
+			snap, ok := obj.(*longhorn.Snapshot)
+			if !ok {
+				return nil, fmt.Errorf("BUG: cannot index %T as snapshot", obj)
+			}
+			return volumeIndexKeys(snap.Namespace, snap.Labels), nil
+		},
+	}
+}
+
+func volumeIndexKeys(namespace string, labels map[string]string) []string {
+	volumeName := labels[LonghornVolumeKey]
+	if volumeName == "" {
+		return []string{}
+	}
+	return []string{indexKey(namespace, volumeName)}
+}
+
+// addIndexers adds the indexers to the informer unless they have been added,
+// e.g. by another datastore sharing the informer
+func addIndexers(informer cache.SharedIndexInformer, indexers cache.Indexers) {
+	existing := informer.GetIndexer().GetIndexers()
+	missing := cache.Indexers{}
+	for name, f := range indexers {
+		if _, ok := existing[name]; !ok {
+			missing[name] = f
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	if err := informer.AddIndexers(missing); err != nil {
+		logrus.Errorf("BUG: cannot add indexers to the informer: %v", err)
+	}
+}
+
+// ListReplicasByNodeRO returns the replicas scheduled to the node. The objects
+// are from the informer cache and must not be modified
+func (s *DataStore) ListReplicasByNodeRO(nodeName string) ([]*longhorn.Replica, error) {
+	objs, err := s.rIndexer.ByIndex(IndexByNode, indexKey(s.namespace, nodeName))
+	if err != nil {
+		return nil, err
+	}
+	return toReplicas(objs)
+}
+
+// ListReplicasByDiskRO returns the replicas scheduled to the node, grouped by
+// the disk. The objects are from the informer cache and must not be modified
+func (s *DataStore) ListReplicasByDiskRO(nodeName string) (map[string][]*longhorn.Replica, error) {
+	replicas, err := s.ListReplicasByNodeRO(nodeName)
+	if err != nil {
+		return nil, err
+	}
+	replicaDiskMap := map[string][]*longhorn.Replica{}
+	for _, r := range replicas {
+		replicaDiskMap[r.Spec.DiskID] = append(replicaDiskMap[r.Spec.DiskID], r)
+	}
+	return replicaDiskMap, nil
+}
+
+// ListReplicasByVolumeRO returns the replicas of the volume. The objects are
+// from the informer cache and must not be modified
+func (s *DataStore) ListReplicasByVolumeRO(volumeName string) ([]*longhorn.Replica, error) {
+	objs, err := s.rIndexer.ByIndex(IndexByVolume, indexKey(s.namespace, volumeName))
+	if err != nil {
+		return nil, err
+	}
+	return toReplicas(objs)
+}
+
+// ListEnginesByNodeRO returns the engines on the node. The objects are from
+// the informer cache and must not be modified
+func (s *DataStore) ListEnginesByNodeRO(nodeName string) ([]*longhorn.Engine, error) {
+	objs, err := s.eIndexer.ByIndex(IndexByNode, indexKey(s.namespace, nodeName))
+	if err != nil {
+		return nil, err
+	}
+	return toEngines(objs)
+}
+
+// ListEnginesByVolumeRO returns the engines of the volume. The objects are
+// from the informer cache and must not be modified
+func (s *DataStore) ListEnginesByVolumeRO(volumeName string) ([]*longhorn.Engine, error) {
+	objs, err := s.eIndexer.ByIndex(IndexByVolume, indexKey(s.namespace, volumeName))
+	if err != nil {
+		return nil, err
+	}
+	return toEngines(objs)
+}
+
+// ListVolumesByNodeRO returns the volumes attached or being attached to the
+// node. The objects are from the informer cache and must not be modified
+func (s *DataStore) ListVolumesByNodeRO(nodeName string) ([]*longhorn.Volume, error) {
+	objs, err := s.vIndexer.ByIndex(IndexByNode, indexKey(s.namespace, nodeName))
+	if err != nil {
+		return nil, err
+	}
+	return toVolumes(objs)
+}
+
+// ListSnapshotsByVolumeRO returns the snapshots of the volume. The objects
+// are from the informer cache and must not be modified
+func (s *DataStore) ListSnapshotsByVolumeRO(volumeName string) ([]*longhorn.Snapshot, error) {
+	objs, err := s.snIndexer.ByIndex(IndexByVolume, indexKey(s.namespace, volumeName))
+	if err != nil {
+		return nil, err
+	}
+	return toSnapshots(objs)
+}
+
+// ListVolumesByOwnerRO returns the volumes owned by the manager on the node.
+// The objects are from the informer cache and must not be modified
+func (s *DataStore) ListVolumesByOwnerRO(ownerID string) ([]*longhorn.Volume, error) {
+	objs, err := s.vIndexer.ByIndex(IndexByOwner, indexKey(s.namespace, ownerID))
+	if err != nil {
+		return nil, err
+	}
+	return toVolumes(objs)
+}
+
+// ListEvictingVolumesRO returns the volumes evicting a replica. The objects
+// are from the informer cache and must not be modified
+func (s *DataStore) ListEvictingVolumesRO() ([]*longhorn.Volume, error) {
+	objs, err := s.vIndexer.ByIndex(IndexByEviction, s.namespace)
+	if err != nil {
+		return nil, err
+	}
+	return toVolumes(objs)
+}
+
+func toVolumes(objs []interface{}) ([]*longhorn.Volume, error) {
+	volumes := make([]*longhorn.Volume, 0, len(objs))
+	for _, obj := range objs {
+		v, ok := obj.(*longhorn.Volume)
+		if !ok {
+			return nil, fmt.Errorf("BUG: cannot convert %T to volume", obj)
+		}
+		volumes = append(volumes, v)
+	}
+	return volumes, nil
+}
+
+func toReplicas(objs []interface{}) ([]*longhorn.Replica, error) {
+	replicas := make([]*longhorn.Replica, 0, len(objs))
+	for _, obj := range objs {
+		r, ok := obj.(*longhorn.Replica)
+		if !ok {
+			return nil, fmt.Errorf("BUG: cannot convert %T to replica", obj)
+		}
+		replicas = append(replicas, r)
+	}
+	return replicas, nil
+}
+
+func toEngines(objs []interface{}) ([]*longhorn.Engine, error) {
+	engines := make([]*longhorn.Engine, 0, len(objs))
+	for _, obj := range objs {
+		e, ok := obj.(*longhorn.Engine)
+		if !ok {
+			return nil, fmt.Errorf("BUG: cannot convert %T to engine", obj)
+		}
+		engines = append(engines, e)
+	}
+	return engines, nil
+}
+
+func toSnapshots(objs []interface{}) ([]*longhorn.Snapshot, error) {
+	snapshots := make([]*longhorn.Snapshot, 0, len(objs))
+	for _, obj := range objs {
+		snap, ok := obj.(*longhorn.Snapshot)
+		if !ok {
+			return nil, fmt.Errorf("BUG: cannot convert %T to snapshot", obj)
+		}
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, nil
+}
@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+)
+
+const (
+	benchmarkNodeCount         = 50
+	benchmarkVolumeCount       = 1000
+	benchmarkReplicasPerVolume = 5
+)
+
+// newTestDataStoreWithReplicas fills the informer cache with the volumes,
+// the engines and the replicas spread over the nodes. One in five volumes is
+// evicting a replica.
+func newTestDataStoreWithReplicas(t testing.TB, volumeCount, replicasPerVolume, nodeCount int) *DataStore {
+	ds := newTestDataStore(lhfake.NewSimpleClientset())
+	for i := 0; i < volumeCount; i++ {
+		volumeName := fmt.Sprintf("volume-%v", i)
+		v := &longhorn.Volume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      volumeName,
+				Namespace: testNamespace,
+			},
+			Spec: types.VolumeSpec{
+				OwnerID:     fmt.Sprintf("node-%v", i%nodeCount),
+				NodeID:      fmt.Sprintf("node-%v", i%nodeCount),
+				Size:        1073741824,
+				Frontend:    types.VolumeFrontendBlockDev,
+				EngineImage: "longhornio/longhorn-engine:test",
+			},
+		}
+		if i%5 == 0 {
+			v.Status.EvictingReplica = volumeName + "-r-0"
+		}
+		if err := ds.vIndexer.Add(v); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < replicasPerVolume; j++ {
+			nodeName := fmt.Sprintf("node-%v", (i+j)%nodeCount)
+			r := &longhorn.Replica{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      fmt.Sprintf("%v-r-%v", volumeName, j),
+					Namespace: testNamespace,
+					Labels: map[string]string{
+						LonghornVolumeKey:     volumeName,
+						types.LonghornNodeKey: nodeName,
+					},
+				},
+				Spec: types.ReplicaSpec{
+					InstanceSpec: types.InstanceSpec{
+						VolumeName: volumeName,
+						NodeID:     nodeName,
+					},
+					EngineName: volumeName + "-e",
+					DiskID:     fmt.Sprintf("disk-%v", j%2),
+				},
+			}
+			if err := ds.rIndexer.Add(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		e := &longhorn.Engine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      volumeName + "-e",
+				Namespace: testNamespace,
+				Labels: map[string]string{
+					LonghornVolumeKey:     volumeName,
+					types.LonghornNodeKey: fmt.Sprintf("node-%v", i%nodeCount),
+				},
+			},
+			Spec: types.EngineSpec{
+				InstanceSpec: types.InstanceSpec{
+					VolumeName:  volumeName,
+					VolumeSize:  1073741824,
+					NodeID:      fmt.Sprintf("node-%v", i%nodeCount),
+					EngineImage: "longhornio/longhorn-engine:test",
+				},
+				Frontend: types.VolumeFrontendBlockDev,
+			},
+		}
+		if err := ds.eIndexer.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ds
+}
+
+func TestIndexers(t *testing.T) {
+	assert := require.New(t)
+
+	ds := newTestDataStoreWithReplicas(t, 10, 3, 4)
+
+	replicas, err := ds.ListReplicasByNodeRO("node-1")
+	assert.Nil(err)
+	// volume i has replicas on node (i+j)%4 for j in 0..2
+	assert.Len(replicas, 8)
+	for _, r := range replicas {
+		assert.Equal("node-1", r.Spec.NodeID)
+	}
+
+	replicaDiskMap, err := ds.ListReplicasByDiskRO("node-1")
+	assert.Nil(err)
+	count := 0
+	for diskID, replicas := range replicaDiskMap {
+		for _, r := range replicas {
+			assert.Equal(diskID, r.Spec.DiskID)
+			count++
+		}
+	}
+	assert.Equal(8, count)
+
+	replicas, err = ds.ListReplicasByVolumeRO("volume-3")
+	assert.Nil(err)
+	assert.Len(replicas, 3)
+
+	engines, err := ds.ListEnginesByVolumeRO("volume-3")
+	assert.Nil(err)
+	assert.Len(engines, 1)
+	assert.Equal("volume-3-e", engines[0].Name)
+
+	engines, err = ds.ListEnginesByNodeRO("node-2")
+	assert.Nil(err)
+	assert.Len(engines, 2)
+
+	// the index follows the update of the object
+	r := replicas[0].DeepCopy()
+	r.Spec.NodeID = "node-new"
+	assert.Nil(ds.rIndexer.Update(r))
+	replicas, err = ds.ListReplicasByNodeRO("node-new")
+	assert.Nil(err)
+	assert.Len(replicas, 1)
+
+	replicas, err = ds.ListReplicasByNodeRO("node-not-exist")
+	assert.Nil(err)
+	assert.Len(replicas, 0)
+
+	volumes, err := ds.ListVolumesByNodeRO("node-1")
+	assert.Nil(err)
+	assert.Len(volumes, 3)
+	for _, v := range volumes {
+		assert.Equal("node-1", v.Spec.NodeID)
+	}
+
+	volumes, err = ds.ListVolumesByOwnerRO("node-2")
+	assert.Nil(err)
+	assert.Len(volumes, 2)
+
+	volumes, err = ds.ListEvictingVolumesRO()
+	assert.Nil(err)
+	assert.Len(volumes, 2)
+	v := volumes[0].DeepCopy()
+	v.Status.EvictingReplica = ""
+	assert.Nil(ds.vIndexer.Update(v))
+	volumes, err = ds.ListEvictingVolumesRO()
+	assert.Nil(err)
+	assert.Len(volumes, 1)
+
+	// the deep copies are returned for modification
+	volumeReplicas, err := ds.ListVolumeReplicas("volume-3")
+	assert.Nil(err)
+	assert.Len(volumeReplicas, 3)
+}
+
+func TestGetCacheSizes(t *testing.T) {
+	assert := require.New(t)
+
+	ds := newTestDataStoreWithReplicas(t, 4, 3, 2)
+	sizes := ds.GetCacheSizes()
+	assert.Equal(4, sizes["volumes"])
+	assert.Equal(4, sizes["engines"])
+	assert.Equal(12, sizes["replicas"])
+	assert.Equal(0, sizes["nodes"])
+	assert.Equal(0, sizes["pods"])
+}
+
+// BenchmarkListReplicasByNodeSelector is the listing by the label selector
+// before the indexers, which goes through all the replicas
+func BenchmarkListReplicasByNodeSelector(b *testing.B) {
+	ds := newTestDataStoreWithReplicas(b, benchmarkVolumeCount, benchmarkReplicasPerVolume, benchmarkNodeCount)
+	selector := labels.SelectorFromSet(labels.Set{types.LonghornNodeKey: "node-1"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ds.rLister.Replicas(testNamespace).List(selector); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListReplicasByNodeIndex(b *testing.B) {
+	ds := newTestDataStoreWithReplicas(b, benchmarkVolumeCount, benchmarkReplicasPerVolume, benchmarkNodeCount)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ds.ListReplicasByNodeRO("node-1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListReplicasByVolumeSelector(b *testing.B) {
+	ds := newTestDataStoreWithReplicas(b, benchmarkVolumeCount, benchmarkReplicasPerVolume, benchmarkNodeCount)
+	selector := labels.SelectorFromSet(labels.Set{LonghornVolumeKey: "volume-1"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ds.rLister.Replicas(testNamespace).List(selector); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListReplicasByVolumeIndex(b *testing.B) {
+	ds := newTestDataStoreWithReplicas(b, benchmarkVolumeCount, benchmarkReplicasPerVolume, benchmarkNodeCount)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ds.ListReplicasByVolumeRO("volume-1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkListVolumesByOwnerCopy is the listing of the volumes owned by a
+// manager before the indexers, which copies all the volumes
+func BenchmarkListVolumesByOwnerCopy(b *testing.B) {
+	ds := newTestDataStoreWithReplicas(b, benchmarkVolumeCount, benchmarkReplicasPerVolume, benchmarkNodeCount)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		volumes, err := ds.ListVolumes()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for name, v := range volumes {
+			if v.Spec.OwnerID != "node-1" {
+				delete(volumes, name)
+			}
+		}
+	}
+}
+
+func BenchmarkListVolumesByOwnerIndex(b *testing.B) {
+	ds := newTestDataStoreWithReplicas(b, benchmarkVolumeCount, benchmarkReplicasPerVolume, benchmarkNodeCount)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ds.ListVolumesByOwnerRO("node-1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
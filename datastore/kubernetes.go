@@ -3,14 +3,25 @@ package datastore
 import (
 	"fmt"
 
+	"github.com/Sirupsen/logrus"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	batchv1 "k8s.io/api/batch/v1"
 	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	storagev1beta1 "k8s.io/api/storage/v1beta1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/rancher/longhorn-manager/types"
+
+	lhscheme "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/scheme"
 )
 
 func (s *DataStore) getManagerLabel() map[string]string {
@@ -54,7 +65,7 @@ func (s *DataStore) GetManagerNodeIPMap() (map[string]string, error) {
 
 // ListVolumeCronJobROs returns a map of read-only CronJobs for the volume
 func (s *DataStore) ListVolumeCronJobROs(volumeName string) (map[string]*batchv1beta1.CronJob, error) {
-	selector, err := getVolumeSelector(volumeName)
+	selector, err := GetVolumeSelector(volumeName)
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +106,22 @@ func (s *DataStore) DeleteCronJob(cronJobName string) error {
 	return nil
 }
 
+// ListCronJobJobs returns the Kubernetes jobs run from the CronJob, either
+// by the CronJob controller or by the volume controller
+func (s *DataStore) ListCronJobJobs(cronJobName string) ([]batchv1.Job, error) {
+	list, err := s.kubeClient.BatchV1().Jobs(s.namespace).List(metav1.ListOptions{
+		LabelSelector: types.LonghornCronJobKey + "=" + cronJobName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (s *DataStore) CreateJob(job *batchv1.Job) (*batchv1.Job, error) {
+	return s.kubeClient.BatchV1().Jobs(s.namespace).Create(job)
+}
+
 func getEngineImageSelector() (labels.Selector, error) {
 	return metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
 		MatchLabels: types.GetEngineImageLabel(),
@@ -126,6 +153,28 @@ func (s *DataStore) GetEngineImageDaemonSet(name string) (*appsv1beta2.DaemonSet
 	return resultRO.DeepCopy(), nil
 }
 
+// ListEngineImageDaemonSetPodsRO returns the pods controlled by the daemon
+// set of the engine image. The objects are from the informer cache and must
+// not be modified
+func (s *DataStore) ListEngineImageDaemonSetPodsRO(ds *appsv1beta2.DaemonSet) ([]*corev1.Pod, error) {
+	selector, err := getEngineImageSelector()
+	if err != nil {
+		return nil, err
+	}
+	podList, err := s.pLister.Pods(s.namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	// the daemon sets of all the engine images share the label
+	pods := []*corev1.Pod{}
+	for _, pod := range podList {
+		if ref := metav1.GetControllerOf(pod); ref != nil && ref.UID == ds.UID {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
 func (s *DataStore) DeleteEngineImageDaemonSet(name string) error {
 	propagation := metav1.DeletePropagationForeground
 	err := s.kubeClient.AppsV1beta2().DaemonSets(s.namespace).Delete(name, &metav1.DeleteOptions{PropagationPolicy: &propagation})
@@ -153,6 +202,79 @@ func (s *DataStore) ListManagerPods() ([]*corev1.Pod, error) {
 	return pList, nil
 }
 
+// ListPodsByNode returns the pods in the Longhorn namespace bound to the node
+func (s *DataStore) ListPodsByNode(name string) ([]*corev1.Pod, error) {
+	podList, err := s.pLister.Pods(s.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	pList := []*corev1.Pod{}
+	for _, item := range podList {
+		if item.Spec.NodeName == name {
+			pList = append(pList, item.DeepCopy())
+		}
+	}
+	return pList, nil
+}
+
+// ForceDeletePod deletes the pod without waiting for the kubelet to confirm,
+// for the pod on a node which is gone
+func (s *DataStore) ForceDeletePod(name string) error {
+	gracePeriod := int64(0)
+	err := s.kubeClient.CoreV1().Pods(s.namespace).Delete(name, &metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// ListPodsRO returns all pods in the Longhorn namespace, including the pods
+// of the manager, the instances and the CSI components. The objects are from
+// the informer cache and must not be modified
+func (s *DataStore) ListPodsRO() ([]*corev1.Pod, error) {
+	return s.pLister.Pods(s.namespace).List(labels.Everything())
+}
+
+// GetPodContainerLog returns the log of the container of the pod in the
+// Longhorn namespace, truncated to limitBytes
+func (s *DataStore) GetPodContainerLog(podName, containerName string, limitBytes int64) ([]byte, error) {
+	return s.kubeClient.CoreV1().Pods(s.namespace).GetLogs(podName, &corev1.PodLogOptions{
+		Container:  containerName,
+		Timestamps: true,
+		LimitBytes: &limitBytes,
+	}).DoRaw()
+}
+
+// IsNamespaceTerminating returns true if the Longhorn namespace is being
+// deleted
+func (s *DataStore) IsNamespaceTerminating() (bool, error) {
+	ns, err := s.kubeClient.CoreV1().Namespaces().Get(s.namespace, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return ns.DeletionTimestamp != nil || ns.Status.Phase == corev1.NamespaceTerminating, nil
+}
+
+// ListNamespaceEvents returns all events in the Longhorn namespace, not only
+// the ones of the Longhorn objects
+func (s *DataStore) ListNamespaceEvents() ([]corev1.Event, error) {
+	eventList, err := s.kubeClient.CoreV1().Events(s.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return eventList.Items, nil
+}
+
+// ListEventsRO returns the events in the Longhorn namespace from the informer
+// cache. The objects must not be modified
+func (s *DataStore) ListEventsRO() ([]*corev1.Event, error) {
+	return s.evLister.Events(s.namespace).List(labels.Everything())
+}
+
 func (s *DataStore) ListEvents() ([]*corev1.Event, error) {
 	// just get event generated by longhorn manager
 	eventList, err := s.kubeClient.CoreV1().Events(s.namespace).List(metav1.ListOptions{FieldSelector: "involvedObject.apiVersion=longhorn.rancher.io"})
@@ -166,6 +288,141 @@ func (s *DataStore) ListEvents() ([]*corev1.Event, error) {
 	return eList, nil
 }
 
+func (s *DataStore) GetPersistentVolume(name string) (*corev1.PersistentVolume, error) {
+	return s.kubeClient.CoreV1().PersistentVolumes().Get(name, metav1.GetOptions{})
+}
+
+func (s *DataStore) CreatePersistentVolume(pv *corev1.PersistentVolume) (*corev1.PersistentVolume, error) {
+	return s.kubeClient.CoreV1().PersistentVolumes().Create(pv)
+}
+
+func (s *DataStore) DeletePersistentVolume(name string) error {
+	return s.kubeClient.CoreV1().PersistentVolumes().Delete(name, &metav1.DeleteOptions{})
+}
+
+func (s *DataStore) GetPersistentVolumeClaim(namespace, name string) (*corev1.PersistentVolumeClaim, error) {
+	return s.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (s *DataStore) CreatePersistentVolumeClaim(namespace string, pvc *corev1.PersistentVolumeClaim) (*corev1.PersistentVolumeClaim, error) {
+	return s.kubeClient.CoreV1().PersistentVolumeClaims(namespace).Create(pvc)
+}
+
+// GetPersistentVolumeRO returns the PV from the informer cache. The object
+// must not be modified
+func (s *DataStore) GetPersistentVolumeRO(name string) (*corev1.PersistentVolume, error) {
+	return s.pvLister.Get(name)
+}
+
+// ListPersistentVolumesRO returns the PVs from the informer cache. The
+// objects must not be modified
+func (s *DataStore) ListPersistentVolumesRO() ([]*corev1.PersistentVolume, error) {
+	return s.pvLister.List(labels.Everything())
+}
+
+// GetPersistentVolumeClaimRO returns the PVC from the informer cache. The
+// object must not be modified
+func (s *DataStore) GetPersistentVolumeClaimRO(namespace, name string) (*corev1.PersistentVolumeClaim, error) {
+	return s.pvcLister.PersistentVolumeClaims(namespace).Get(name)
+}
+
+// GetWorkloadPodRO returns the pod in any namespace from the informer cache.
+// The object must not be modified
+func (s *DataStore) GetWorkloadPodRO(namespace, name string) (*corev1.Pod, error) {
+	return s.pLister.Pods(namespace).Get(name)
+}
+
+// ListWorkloadPodsRO returns the pods in all namespaces from the informer
+// cache. The objects must not be modified
+func (s *DataStore) ListWorkloadPodsRO() ([]*corev1.Pod, error) {
+	return s.pLister.List(labels.Everything())
+}
+
+// DeleteWorkloadPod deletes the pod only if it's still the one of the UID,
+// so the StatefulSet pod recreated with the same name meanwhile won't be
+// deleted. The pod is deleted without waiting for the kubelet to confirm if
+// force is set, for the pod on the node which is down.
+func (s *DataStore) DeleteWorkloadPod(pod *corev1.Pod, force bool) error {
+	options := &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &pod.UID},
+	}
+	if force {
+		gracePeriod := int64(0)
+		options.GracePeriodSeconds = &gracePeriod
+	}
+	return s.kubeClient.CoreV1().Pods(pod.Namespace).Delete(pod.Name, options)
+}
+
+// ListVolumeAttachmentsRO returns the VolumeAttachments from the informer
+// cache. The objects must not be modified
+func (s *DataStore) ListVolumeAttachmentsRO() ([]*storagev1beta1.VolumeAttachment, error) {
+	return s.vaLister.List(labels.Everything())
+}
+
+func (s *DataStore) DeleteVolumeAttachment(name string) error {
+	return s.kubeClient.StorageV1beta1().VolumeAttachments().Delete(name, &metav1.DeleteOptions{})
+}
+
 func (s *DataStore) GetKubernetesNode(name string) (*corev1.Node, error) {
 	return s.kubeClient.CoreV1().Nodes().Get(name, metav1.GetOptions{})
 }
+
+func (s *DataStore) GetStorageClass(name string) (*storagev1.StorageClass, error) {
+	return s.kubeClient.StorageV1().StorageClasses().Get(name, metav1.GetOptions{})
+}
+
+func (s *DataStore) CreateStorageClass(sc *storagev1.StorageClass) (*storagev1.StorageClass, error) {
+	return s.kubeClient.StorageV1().StorageClasses().Create(sc)
+}
+
+// DeleteStorageClass deletes the StorageClass only if it's still the one of
+// the UID, so the one recreated by someone else meanwhile won't be deleted
+func (s *DataStore) DeleteStorageClass(name string, uid apitypes.UID) error {
+	return s.kubeClient.StorageV1().StorageClasses().Delete(name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid},
+	})
+}
+
+// GetConfigMap returns the ConfigMap in the Longhorn namespace
+func (s *DataStore) GetConfigMap(name string) (*corev1.ConfigMap, error) {
+	return s.kubeClient.CoreV1().ConfigMaps(s.namespace).Get(name, metav1.GetOptions{})
+}
+
+// GetNamespace returns the Longhorn namespace
+func (s *DataStore) GetNamespace() (*corev1.Namespace, error) {
+	return s.kubeClient.CoreV1().Namespaces().Get(s.namespace, metav1.GetOptions{})
+}
+
+// GetSecret returns the secret in the Longhorn namespace
+func (s *DataStore) GetSecret(name string) (*corev1.Secret, error) {
+	return s.kubeClient.CoreV1().Secrets(s.namespace).Get(name, metav1.GetOptions{})
+}
+
+func (s *DataStore) CreateSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	return s.kubeClient.CoreV1().Secrets(s.namespace).Create(secret)
+}
+
+func (s *DataStore) UpdateSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	return s.kubeClient.CoreV1().Secrets(s.namespace).Update(secret)
+}
+
+func (s *DataStore) GetValidatingWebhookConfiguration(name string) (*admissionregistrationv1beta1.ValidatingWebhookConfiguration, error) {
+	return s.kubeClient.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Get(name, metav1.GetOptions{})
+}
+
+func (s *DataStore) CreateValidatingWebhookConfiguration(config *admissionregistrationv1beta1.ValidatingWebhookConfiguration) (*admissionregistrationv1beta1.ValidatingWebhookConfiguration, error) {
+	return s.kubeClient.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Create(config)
+}
+
+func (s *DataStore) UpdateValidatingWebhookConfiguration(config *admissionregistrationv1beta1.ValidatingWebhookConfiguration) (*admissionregistrationv1beta1.ValidatingWebhookConfiguration, error) {
+	return s.kubeClient.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations().Update(config)
+}
+
+// NewEventRecorder returns the recorder of the events of the Longhorn objects
+// for the component not running as a controller, e.g. the API server
+func (s *DataStore) NewEventRecorder(component string) record.EventRecorder {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(logrus.Infof)
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(s.kubeClient.CoreV1().RESTClient()).Events("")})
+	return eventBroadcaster.NewRecorder(lhscheme.Scheme, corev1.EventSource{Component: component})
+}
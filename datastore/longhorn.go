@@ -2,11 +2,13 @@ package datastore
 
 import (
 	"fmt"
-	"path/filepath"
-	"strconv"
+	"sort"
+	"strings"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -22,7 +24,9 @@ import (
 const (
 	LonghornVolumeKey = "longhornvolume"
 	// NameMaximumLength restricted the length due to Kubernetes name limitation
-	NameMaximumLength = 40
+	NameMaximumLength = util.VolumeNameMaximumLength
+
+	maxEngineImageReferenceSamples = 5
 )
 
 var (
@@ -94,6 +98,44 @@ func (s *DataStore) ListSettings() (map[types.SettingName]*longhorn.Setting, err
 	return itemMap, nil
 }
 
+// InitSettings creates the missing settings with the defaults at startup,
+// so all the settings exist in Kubernetes with valid values. The read-only
+// ones are set by the manager itself, and the existing settings with invalid
+// values are left for the user to fix.
+func (s *DataStore) InitSettings() error {
+	// the settings of the older versions are carried over first, so the
+	// renamed ones won't be created with the defaults
+	if err := s.MigrateSettings(); err != nil {
+		return err
+	}
+	for sName, definition := range types.SettingDefinitions {
+		if definition.ReadOnly {
+			continue
+		}
+		setting, err := s.lhClient.LonghornV1alpha1().Settings(s.namespace).Get(string(sName), metav1.GetOptions{})
+		if err == nil {
+			if err := types.ValidateSettingValue(sName, setting.Value); err != nil {
+				logrus.Warnf("Existing setting needs to be fixed: %v", err)
+			}
+			continue
+		}
+		if !ErrorIsNotFound(err) {
+			return errors.Wrapf(err, "failed to get setting %v", sName)
+		}
+		if _, err := s.CreateSetting(&longhorn.Setting{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: string(sName),
+			},
+			Setting: types.Setting{
+				Value: definition.Default,
+			},
+		}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to create setting %v", sName)
+		}
+	}
+	return nil
+}
+
 func (s *DataStore) GetCredentialFromSecret(secretName string) (map[string]string, error) {
 	secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(secretName, metav1.GetOptions{})
 	if err != nil {
@@ -101,13 +143,25 @@ func (s *DataStore) GetCredentialFromSecret(secretName string) (map[string]strin
 	}
 	credentialSecret := make(map[string]string)
 	if secret.Data != nil {
-		credentialSecret[types.AWSAccessKey] = string(secret.Data[types.AWSAccessKey])
-		credentialSecret[types.AWSSecretKey] = string(secret.Data[types.AWSSecretKey])
-		credentialSecret[types.AWSEndPoint] = string(secret.Data[types.AWSEndPoint])
+		for _, key := range util.BackupCredentialKeys {
+			credentialSecret[key] = string(secret.Data[key])
+		}
 	}
 	return credentialSecret, nil
 }
 
+// ResolveBackupTargetCredentialSecret returns the first of the secrets
+// overriding the global backup target credential secret, e.g. of the
+// recurring job then of the volume, or the global one if none is set
+func (s *DataStore) ResolveBackupTargetCredentialSecret(overrides ...string) (string, error) {
+	for _, secret := range overrides {
+		if secret != "" {
+			return secret, nil
+		}
+	}
+	return s.GetSettingValue(types.SettingNameBackupTargetCredentialSecret)
+}
+
 func getVolumeLabels(volumeName string) map[string]string {
 	return map[string]string{
 		LonghornVolumeKey: volumeName,
@@ -143,9 +197,9 @@ func tagVolumeLabel(volumeName string, obj runtime.Object) error {
 	if labels == nil {
 		labels = map[string]string{}
 	}
-	if labels[LonghornVolumeKey] == "" {
-		labels[LonghornVolumeKey] = volumeName
-	}
+	// the label is always set back since the objects of the volume are
+	// listed by it
+	labels[LonghornVolumeKey] = volumeName
 	metadata.SetLabels(labels)
 	return nil
 }
@@ -160,7 +214,9 @@ func fixupMetadata(volumeName string, obj runtime.Object) error {
 	return nil
 }
 
-func getVolumeSelector(volumeName string) (labels.Selector, error) {
+// GetVolumeSelector returns the selector of the objects labeled with the
+// volume, e.g. the engines, the replicas and the recurring jobs of it
+func GetVolumeSelector(volumeName string) (labels.Selector, error) {
 	return metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
 		MatchLabels: getVolumeLabels(volumeName),
 	})
@@ -191,28 +247,8 @@ func (s *DataStore) DeleteVolume(name string) error {
 	return s.lhClient.LonghornV1alpha1().Volumes(s.namespace).Delete(name, &metav1.DeleteOptions{})
 }
 
-// RemoveFinalizerForVolume will result in deletion if DeletionTimestamp was set
-func (s *DataStore) RemoveFinalizerForVolume(obj *longhorn.Volume) error {
-	if !util.FinalizerExists(longhornFinalizerKey, obj) {
-		// finalizer already removed
-		return nil
-	}
-	if err := util.RemoveFinalizer(longhornFinalizerKey, obj); err != nil {
-		return err
-	}
-	_, err := s.lhClient.LonghornV1alpha1().Volumes(s.namespace).Update(obj)
-	if err != nil {
-		// workaround `StorageError: invalid object, Code: 4` due to empty object
-		if obj.DeletionTimestamp != nil {
-			return nil
-		}
-		return errors.Wrapf(err, "unable to remove finalizer for volume %v", obj.Name)
-	}
-	return nil
-}
-
 func (s *DataStore) GetVolume(name string) (*longhorn.Volume, error) {
-	resultRO, err := s.getVolumeRO(name)
+	resultRO, err := s.GetVolumeRO(name)
 	if err != nil {
 		return nil, err
 	}
@@ -220,7 +256,9 @@ func (s *DataStore) GetVolume(name string) (*longhorn.Volume, error) {
 	return s.fixupVolume(resultRO.DeepCopy())
 }
 
-func (s *DataStore) getVolumeRO(name string) (*longhorn.Volume, error) {
+// GetVolumeRO returns the volume from the informer cache, which must not be
+// modified
+func (s *DataStore) GetVolumeRO(name string) (*longhorn.Volume, error) {
 	resultRO, err := s.vLister.Volumes(s.namespace).Get(name)
 	if err != nil {
 		return nil, err
@@ -246,28 +284,19 @@ func (s *DataStore) ListVolumes() (map[string]*longhorn.Volume, error) {
 	return itemMap, nil
 }
 
+// ListVolumesRO returns all volumes in the namespace. The objects are from
+// the informer cache and must not be modified
+func (s *DataStore) ListVolumesRO() ([]*longhorn.Volume, error) {
+	return s.vLister.Volumes(s.namespace).List(labels.Everything())
+}
+
+// fixupVolume fills in the fields omitted by the API server. The fields
+// missing in the objects of the older versions are filled in by the resource
+// migrations instead.
 func (s *DataStore) fixupVolume(volume *longhorn.Volume) (*longhorn.Volume, error) {
 	if volume.Status.Conditions == nil {
 		volume.Status.Conditions = map[types.VolumeConditionType]types.Condition{}
 	}
-	// v0.3
-	if volume.Spec.Frontend == "" {
-		volume.Spec.Frontend = types.VolumeFrontendBlockDev
-	}
-	// v0.3
-	if volume.Spec.EngineImage == "" {
-		engines, err := s.ListVolumeEngines(volume.Name)
-		if err != nil || len(engines) == 0 {
-			return nil, fmt.Errorf("cannot fix up volume object, engine of %v cannot be found: %v", volume.Name, err)
-		}
-		if len(engines) != 1 {
-			return nil, fmt.Errorf("cannot fix up volume object, detected multiple engines")
-		}
-		for _, e := range engines {
-			volume.Spec.EngineImage = e.Spec.EngineImage
-			break
-		}
-	}
 	return volume, nil
 }
 
@@ -309,66 +338,39 @@ func (s *DataStore) DeleteEngine(name string) error {
 	return s.lhClient.LonghornV1alpha1().Engines(s.namespace).Delete(name, &metav1.DeleteOptions{})
 }
 
-// RemoveFinalizerForEngine will result in deletion if DeletionTimestamp was set
-func (s *DataStore) RemoveFinalizerForEngine(obj *longhorn.Engine) error {
-	if !util.FinalizerExists(longhornFinalizerKey, obj) {
-		// finalizer already removed
-		return nil
-	}
-	if err := util.RemoveFinalizer(longhornFinalizerKey, obj); err != nil {
-		return err
-	}
-	_, err := s.lhClient.LonghornV1alpha1().Engines(s.namespace).Update(obj)
-	if err != nil {
-		// workaround `StorageError: invalid object, Code: 4` due to empty object
-		if obj.DeletionTimestamp != nil {
-			return nil
-		}
-		return errors.Wrapf(err, "unable to remove finalizer for engine %v", obj.Name)
-	}
-	return nil
-}
-
 func (s *DataStore) GetEngine(name string) (*longhorn.Engine, error) {
 	resultRO, err := s.eLister.Engines(s.namespace).Get(name)
 	if err != nil {
 		return nil, err
 	}
 	// Cannot use cached object from lister
-	return s.fixupEngine(resultRO.DeepCopy())
+	return resultRO.DeepCopy(), nil
 }
 
 func (s *DataStore) ListVolumeEngines(volumeName string) (map[string]*longhorn.Engine, error) {
-	selector, err := getVolumeSelector(volumeName)
-	if err != nil {
-		return nil, err
-	}
-	list, err := s.eLister.Engines(s.namespace).List(selector)
+	list, err := s.ListEnginesByVolumeRO(volumeName)
 	if err != nil {
 		return nil, err
 	}
 	engines := map[string]*longhorn.Engine{}
 	for _, e := range list {
 		// Cannot use cached object from lister
-		engines[e.Name], err = s.fixupEngine(e.DeepCopy())
-		if err != nil {
-			return nil, err
-		}
+		engines[e.Name] = e.DeepCopy()
 	}
 	return engines, nil
 }
 
-func (s *DataStore) fixupEngine(engine *longhorn.Engine) (*longhorn.Engine, error) {
-	// v0.3
-	if engine.Spec.VolumeSize == 0 || engine.Spec.Frontend == "" {
-		volume, err := s.getVolumeRO(engine.Spec.VolumeName)
-		if err != nil {
-			return nil, fmt.Errorf("BUG: cannot fix up engine object, volume %v cannot be found", engine.Spec.VolumeName)
-		}
-		engine.Spec.VolumeSize = volume.Spec.Size
-		engine.Spec.Frontend = volume.Spec.Frontend
-	}
-	return engine, nil
+// ListEnginesRO returns all engines in the namespace. The objects are from
+// the informer cache and must not be modified
+func (s *DataStore) ListEnginesRO() ([]*longhorn.Engine, error) {
+	return s.eLister.Engines(s.namespace).List(labels.Everything())
+}
+
+// ListEnginesBySelectorRO returns the engines in the namespace matching the
+// label selector. The objects are from the informer cache and must not be
+// modified
+func (s *DataStore) ListEnginesBySelectorRO(selector labels.Selector) ([]*longhorn.Engine, error) {
+	return s.eLister.Engines(s.namespace).List(selector)
 }
 
 func checkReplica(r *longhorn.Replica) error {
@@ -415,26 +417,6 @@ func (s *DataStore) DeleteReplica(name string) error {
 	return s.lhClient.LonghornV1alpha1().Replicas(s.namespace).Delete(name, &metav1.DeleteOptions{})
 }
 
-// RemoveFinalizerForReplica will result in deletion if DeletionTimestamp was set
-func (s *DataStore) RemoveFinalizerForReplica(obj *longhorn.Replica) error {
-	if !util.FinalizerExists(longhornFinalizerKey, obj) {
-		// finalizer already removed
-		return nil
-	}
-	if err := util.RemoveFinalizer(longhornFinalizerKey, obj); err != nil {
-		return err
-	}
-	_, err := s.lhClient.LonghornV1alpha1().Replicas(s.namespace).Update(obj)
-	if err != nil {
-		// workaround `StorageError: invalid object, Code: 4` due to empty object
-		if obj.DeletionTimestamp != nil {
-			return nil
-		}
-		return errors.Wrapf(err, "unable to remove finalizer for replica %v", obj.Name)
-	}
-	return nil
-}
-
 func (s *DataStore) GetReplica(name string) (*longhorn.Replica, error) {
 	resultRO, err := s.getReplicaRO(name)
 	if err != nil {
@@ -452,13 +434,22 @@ func (s *DataStore) getReplicaRO(name string) (*longhorn.Replica, error) {
 	return resultRO, nil
 }
 
+// ListReplicasRO returns all replicas in the namespace. The objects are from
+// the informer cache and must not be modified
+func (s *DataStore) ListReplicasRO() ([]*longhorn.Replica, error) {
+	return s.rLister.Replicas(s.namespace).List(labels.Everything())
+}
+
+// ListReplicasBySelectorRO returns the replicas in the namespace matching the
+// label selector. The objects are from the informer cache and must not be
+// modified
+func (s *DataStore) ListReplicasBySelectorRO(selector labels.Selector) ([]*longhorn.Replica, error) {
+	return s.rLister.Replicas(s.namespace).List(selector)
+}
+
 func (s *DataStore) ListVolumeReplicas(volumeName string) (map[string]*longhorn.Replica, error) {
 	itemMap := map[string]*longhorn.Replica{}
-	selector, err := getVolumeSelector(volumeName)
-	if err != nil {
-		return nil, err
-	}
-	list, err := s.rLister.Replicas(s.namespace).List(selector)
+	list, err := s.ListReplicasByVolumeRO(volumeName)
 	if err != nil {
 		return nil, err
 	}
@@ -473,21 +464,10 @@ func (s *DataStore) ListVolumeReplicas(volumeName string) (map[string]*longhorn.
 	return itemMap, nil
 }
 
+// fixupReplica fills in the disk of the v0.3 replica, which isn't done by the
+// resource migration since the node may not have been registered by its
+// manager at that time
 func (s *DataStore) fixupReplica(replica *longhorn.Replica) (*longhorn.Replica, error) {
-	// v0.3
-	if replica.Spec.EngineName == "" {
-		engines, err := s.ListVolumeEngines(replica.Spec.VolumeName)
-		if err != nil {
-			return nil, err
-		}
-		if len(engines) != 1 {
-			return nil, fmt.Errorf("cannot find the default engine the replica %v belong to", replica.Name)
-		}
-		for name := range engines {
-			replica.Spec.EngineName = name
-			break
-		}
-	}
 	if replica.Spec.NodeID == "" {
 		// allow scheduler to continue
 		return replica, nil
@@ -511,12 +491,6 @@ func (s *DataStore) fixupReplica(replica *longhorn.Replica) (*longhorn.Replica,
 			return nil, fmt.Errorf("cannot find default disk on node %v for replica %v", replica.Spec.NodeID, replica.Name)
 		}
 	}
-	if replica.Spec.DataPath == "" {
-		replica.Spec.DataPath = filepath.Join(types.DefaultLonghornDirectory, "/replicas/", replica.Name)
-		// We cannot tell if the field `Active` exists in the object since it's a bool
-		// so if it's old version, we will set it
-		replica.Spec.Active = true
-	}
 	return replica, nil
 }
 
@@ -539,26 +513,6 @@ func (s *DataStore) DeleteEngineImage(name string) error {
 	return s.lhClient.LonghornV1alpha1().EngineImages(s.namespace).Delete(name, &metav1.DeleteOptions{})
 }
 
-// RemoveFinalizerForEngineImage will result in deletion if DeletionTimestamp was set
-func (s *DataStore) RemoveFinalizerForEngineImage(obj *longhorn.EngineImage) error {
-	if !util.FinalizerExists(longhornFinalizerKey, obj) {
-		// finalizer already removed
-		return nil
-	}
-	if err := util.RemoveFinalizer(longhornFinalizerKey, obj); err != nil {
-		return err
-	}
-	_, err := s.lhClient.LonghornV1alpha1().EngineImages(s.namespace).Update(obj)
-	if err != nil {
-		// workaround `StorageError: invalid object, Code: 4` due to empty object
-		if obj.DeletionTimestamp != nil {
-			return nil
-		}
-		return errors.Wrapf(err, "unable to remove finalizer for engine image %v", obj.Name)
-	}
-	return nil
-}
-
 func (s *DataStore) GetEngineImage(name string) (*longhorn.EngineImage, error) {
 	resultRO, err := s.iLister.EngineImages(s.namespace).Get(name)
 	if err != nil {
@@ -583,6 +537,132 @@ func (s *DataStore) ListEngineImages() (map[string]*longhorn.EngineImage, error)
 	return itemMap, nil
 }
 
+// CheckEngineImageReadiness returns error if the engine image cannot be
+// used on the nodes: it's incompatible with the manager, or the binaries
+// haven't been deployed on any of the nodes. Without the nodes, the image
+// has to be deployed on all the ready nodes.
+func (s *DataStore) CheckEngineImageReadiness(image string, nodeIDs ...string) error {
+	ei, err := s.GetEngineImage(types.GetEngineImageChecksumName(image))
+	if err != nil {
+		return errors.Wrapf(err, "unable to get engine image %v", image)
+	}
+	incompatible := types.GetEngineImageConditionFromStatus(ei.Status, types.EngineImageConditionTypeIncompatible)
+	if incompatible.Status == types.ConditionStatusTrue {
+		return fmt.Errorf("engine image %v (%v) is incompatible: %v", ei.Name, image, incompatible.Message)
+	}
+	if incompatible.Status != types.ConditionStatusFalse {
+		return fmt.Errorf("engine image %v (%v) is not ready, its version hasn't been checked", ei.Name, image)
+	}
+	if len(nodeIDs) == 0 {
+		if ei.Status.State != types.EngineImageStateReady {
+			return fmt.Errorf("engine image %v (%v) is not ready, it's %v", ei.Name, image, ei.Status.State)
+		}
+		return nil
+	}
+	undeployed := []string{}
+	for _, nodeID := range nodeIDs {
+		if nodeID != "" && !ei.Status.NodeDeploymentMap[nodeID] {
+			undeployed = append(undeployed, nodeID)
+		}
+	}
+	if len(undeployed) != 0 {
+		return fmt.Errorf("engine image %v (%v) is not deployed on nodes %v yet", ei.Name, image, strings.Join(undeployed, ", "))
+	}
+	return nil
+}
+
+// CheckEngineImageDeletable returns error telling what has to be changed
+// before the engine image can be deleted: the default engine image setting
+// cannot point at it, and no volume can refer to it. At most
+// maxEngineImageReferenceSamples referring volumes are listed in the error.
+func (s *DataStore) CheckEngineImageDeletable(ei *longhorn.EngineImage) error {
+	defaultImage, err := s.GetDefaultEngineImage()
+	if err != nil {
+		return errors.Wrap(err, "unable to get the default engine image")
+	}
+	if ei.Spec.Image == defaultImage {
+		return fmt.Errorf("engine image %v is the default engine image, change setting %v to another image first",
+			ei.Spec.Image, types.SettingNameDefaultEngineImage)
+	}
+	// check the references directly since the count in the status may lag
+	volumes, err := s.ListEngineImageReferences(ei.Spec.Image)
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the references of engine image %v", ei.Spec.Image)
+	}
+	if len(volumes) == 0 {
+		return nil
+	}
+	sample := strings.Join(volumes, ", ")
+	if len(volumes) > maxEngineImageReferenceSamples {
+		sample = fmt.Sprintf("%v and %d more", strings.Join(volumes[:maxEngineImageReferenceSamples], ", "),
+			len(volumes)-maxEngineImageReferenceSamples)
+	}
+	return fmt.Errorf("engine image %v is still used by %d volumes (%v), upgrade their engines to another image or delete them first",
+		ei.Spec.Image, len(volumes), sample)
+}
+
+// CheckNodeDeletable returns error unless the node is gone from the
+// Kubernetes cluster, disabled for scheduling and has no engine or replica on
+// it
+func (s *DataStore) CheckNodeDeletable(node *longhorn.Node) error {
+	replicas, err := s.ListReplicasByNodeRO(node.Name)
+	if err != nil {
+		return err
+	}
+	engines, err := s.ListEnginesByNodeRO(node.Name)
+	if err != nil {
+		return err
+	}
+	condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
+	if condition.Status == types.ConditionStatusTrue || condition.Reason != types.NodeConditionReasonKubernetesNodeDown ||
+		node.Spec.AllowScheduling || len(replicas) > 0 || len(engines) > 0 {
+		return fmt.Errorf("Could not delete node %v with node ready condition is %v, reason is %v, node schedulable %v, and %v replica, %v engine running on it", node.Name,
+			condition.Status, condition.Reason, node.Spec.AllowScheduling, len(replicas), len(engines))
+	}
+	return nil
+}
+
+// ListEngineImageReferences returns the names of the volumes referring to
+// the image, sorted. A volume refers to the image if the spec or the status
+// of itself, its engines or its replicas does.
+func (s *DataStore) ListEngineImageReferences(image string) ([]string, error) {
+	volumes := map[string]struct{}{}
+	vs, err := s.vLister.Volumes(s.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vs {
+		if v.Spec.EngineImage == image || v.Status.CurrentImage == image {
+			volumes[v.Name] = struct{}{}
+		}
+	}
+	engines, err := s.ListEnginesRO()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range engines {
+		if e.Spec.EngineImage == image || e.Status.CurrentImage == image {
+			volumes[e.Spec.VolumeName] = struct{}{}
+		}
+	}
+	replicas, err := s.ListReplicasRO()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range replicas {
+		if r.Spec.EngineImage == image || r.Status.CurrentImage == image {
+			volumes[r.Spec.VolumeName] = struct{}{}
+		}
+	}
+
+	names := make([]string, 0, len(volumes))
+	for name := range volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 func (s *DataStore) CreateNode(node *longhorn.Node) (*longhorn.Node, error) {
 	if err := util.AddFinalizer(longhornFinalizerKey, node); err != nil {
 		return nil, err
@@ -601,6 +681,16 @@ func (s *DataStore) CreateDefaultNode(name string) (*longhorn.Node, error) {
 			AllowScheduling: true,
 		},
 	}
+	// the node controller decides the default disks according to the
+	// label of the Kubernetes node
+	createDefaultDiskLabeledNodes, err := s.GetSettingAsBool(types.SettingNameCreateDefaultDiskLabeledNodes)
+	if err != nil {
+		return nil, err
+	}
+	if createDefaultDiskLabeledNodes {
+		return s.CreateNode(node)
+	}
+
 	diskInfo, err := util.GetDiskInfo(types.DefaultLonghornDirectory)
 	if err != nil {
 		return nil, err
@@ -630,6 +720,12 @@ func (s *DataStore) GetNode(name string) (*longhorn.Node, error) {
 	return node, nil
 }
 
+// GetNodeRO returns the node from the informer cache, which must not be
+// modified. The conditions may be nil.
+func (s *DataStore) GetNodeRO(name string) (*longhorn.Node, error) {
+	return s.nLister.Nodes(s.namespace).Get(name)
+}
+
 func (s *DataStore) UpdateNode(node *longhorn.Node) (*longhorn.Node, error) {
 	return s.lhClient.LonghornV1alpha1().Nodes(s.namespace).Update(node)
 }
@@ -653,49 +749,80 @@ func (s *DataStore) ListNodes() (map[string]*longhorn.Node, error) {
 	return itemMap, nil
 }
 
-// RemoveFinalizerForNode will result in deletion if DeletionTimestamp was set
-func (s *DataStore) RemoveFinalizerForNode(obj *longhorn.Node) error {
-	if !util.FinalizerExists(longhornFinalizerKey, obj) {
-		// finalizer already removed
-		return nil
+// ListNodesRO returns all nodes in the namespace, indexed by the name. The
+// objects are from the informer cache and must not be modified. The
+// conditions may be nil.
+func (s *DataStore) ListNodesRO() (map[string]*longhorn.Node, error) {
+	itemMap := make(map[string]*longhorn.Node)
+
+	nodeList, err := s.nLister.Nodes(s.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
 	}
-	if err := util.RemoveFinalizer(longhornFinalizerKey, obj); err != nil {
-		return err
+	for _, node := range nodeList {
+		itemMap[node.Name] = node
 	}
-	_, err := s.lhClient.LonghornV1alpha1().Nodes(s.namespace).Update(obj)
+	return itemMap, nil
+}
+
+func (s *DataStore) ListReplicasByNode(name string) (map[string][]*longhorn.Replica, error) {
+	replicaDiskMap, err := s.ListReplicasByDiskRO(name)
 	if err != nil {
-		// workaround `StorageError: invalid object, Code: 4` due to empty object
-		if obj.DeletionTimestamp != nil {
-			return nil
+		return nil, err
+	}
+	for _, replicas := range replicaDiskMap {
+		for i, replica := range replicas {
+			replicas[i] = replica.DeepCopy()
 		}
-		return errors.Wrapf(err, "unable to remove finalizer for node %v", obj.Name)
 	}
-	return nil
+	return replicaDiskMap, nil
 }
 
-func getNodeSelector(nodeName string) (labels.Selector, error) {
-	return metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
-		MatchLabels: map[string]string{
-			types.LonghornNodeKey: nodeName,
-		},
-	})
+// IsNodeRemoved returns true if the Kubernetes node has been removed from the
+// cluster, or the Longhorn node is being deleted
+func (s *DataStore) IsNodeRemoved(name string) (bool, error) {
+	if name == "" {
+		return false, nil
+	}
+	node, err := s.GetNode(name)
+	if err != nil {
+		if ErrorIsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if node.DeletionTimestamp != nil {
+		return true, nil
+	}
+	return types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady).Reason == types.NodeConditionReasonKubernetesNodeDown, nil
 }
 
-func (s *DataStore) ListReplicasByNode(name string) (map[string][]*longhorn.Replica, error) {
-	nodeSelector, err := getNodeSelector(name)
-	replicaList, err := s.rLister.Replicas(s.namespace).List(nodeSelector)
+// HasHealthyReplicaOnOtherNodes returns true if the volume has a healthy
+// replica on a ready node other than the given one
+func (s *DataStore) HasHealthyReplicaOnOtherNodes(volumeName, nodeName string) (bool, error) {
+	replicas, err := s.ListVolumeReplicas(volumeName)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-
-	replicaDiskMap := map[string][]*longhorn.Replica{}
-	for _, replica := range replicaList {
-		if _, ok := replicaDiskMap[replica.Spec.DiskID]; !ok {
-			replicaDiskMap[replica.Spec.DiskID] = []*longhorn.Replica{}
+	for _, r := range replicas {
+		if r.Spec.NodeID == "" || r.Spec.NodeID == nodeName {
+			continue
+		}
+		if r.Spec.FailedAt != "" || r.Spec.HealthyAt == "" {
+			continue
+		}
+		node, err := s.GetNode(r.Spec.NodeID)
+		if err != nil {
+			if ErrorIsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		if types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady).Status == types.ConditionStatusTrue {
+			return true, nil
 		}
-		replicaDiskMap[replica.Spec.DiskID] = append(replicaDiskMap[replica.Spec.DiskID], replica.DeepCopy())
 	}
-	return replicaDiskMap, nil
+	return false, nil
 }
 
 func tagNodeLabel(nodeID string, obj runtime.Object) error {
@@ -714,28 +841,6 @@ func tagNodeLabel(nodeID string, obj runtime.Object) error {
 	return nil
 }
 
-func (s *DataStore) GetSettingAsInt(settingName types.SettingName) (int64, error) {
-	definition, ok := types.SettingDefinitions[settingName]
-	if !ok {
-		return 0, fmt.Errorf("setting %v is not supported", settingName)
-	}
-	settings, err := s.GetSetting(settingName)
-	if err != nil {
-		return 0, err
-	}
-	value := settings.Value
-
-	if definition.Type == types.SettingTypeInt {
-		result, err := strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			return 0, err
-		}
-		return result, nil
-	}
-
-	return 0, fmt.Errorf("The %v setting value couldn't change to integer, value is %v ", string(settingName), value)
-}
-
 func (s *DataStore) UpdateVolumeAndOwner(v *longhorn.Volume) (*longhorn.Volume, error) {
 	engines, err := s.ListVolumeEngines(v.Name)
 	if err != nil {
@@ -770,14 +875,17 @@ func (s *DataStore) UpdateVolumeAndOwner(v *longhorn.Volume) (*longhorn.Volume,
 	return v, nil
 }
 
+// ResetEngineMonitoringStatus clears the status recorded by the engine
+// monitor once it stops
 func (s *DataStore) ResetEngineMonitoringStatus(e *longhorn.Engine) (*longhorn.Engine, error) {
-	e.Status.Endpoint = ""
-	e.Status.ReplicaModeMap = nil
-	e, err := s.UpdateEngine(e)
+	result, err := s.UpdateEngineStatusWithRetry(e, func(e *longhorn.Engine) {
+		e.Status.Endpoint = ""
+		e.Status.ReplicaModeMap = nil
+	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to reste engine status for %v", e.Name)
+		return nil, errors.Wrapf(err, "failed to reset engine status for %v", e.Name)
 	}
-	return e, nil
+	return result, nil
 }
 
 func (s *DataStore) DeleteNode(name string) error {
@@ -785,10 +893,58 @@ func (s *DataStore) DeleteNode(name string) error {
 }
 
 func (s *DataStore) ListEnginesByNode(name string) ([]*longhorn.Engine, error) {
-	nodeSelector, err := getNodeSelector(name)
-	engineList, err := s.eLister.Engines(s.namespace).List(nodeSelector)
+	return s.ListEnginesByNodeRO(name)
+}
+
+func checkSnapshot(snap *longhorn.Snapshot) error {
+	if snap.Name == "" || snap.Spec.Volume == "" {
+		return fmt.Errorf("BUG: missing required field %+v", snap)
+	}
+	errs := validation.IsDNS1123Subdomain(snap.Name)
+	if len(errs) != 0 {
+		return fmt.Errorf("Invalid snapshot name: %+v", errs)
+	}
+	return nil
+}
+
+func (s *DataStore) CreateSnapshot(snap *longhorn.Snapshot) (*longhorn.Snapshot, error) {
+	if err := checkSnapshot(snap); err != nil {
+		return nil, err
+	}
+	if err := fixupMetadata(snap.Spec.Volume, snap); err != nil {
+		return nil, err
+	}
+	return s.lhClient.LonghornV1alpha1().Snapshots(s.namespace).Create(snap)
+}
+
+func (s *DataStore) UpdateSnapshot(snap *longhorn.Snapshot) (*longhorn.Snapshot, error) {
+	if err := checkSnapshot(snap); err != nil {
+		return nil, err
+	}
+	if err := fixupMetadata(snap.Spec.Volume, snap); err != nil {
+		return nil, err
+	}
+	return s.lhClient.LonghornV1alpha1().Snapshots(s.namespace).Update(snap)
+}
+
+// DeleteSnapshot won't result in immediately deletion since finalizer was
+// set by default. The snapshot is deleted from the engine before the
+// finalizer is removed.
+func (s *DataStore) DeleteSnapshot(name string) error {
+	return s.lhClient.LonghornV1alpha1().Snapshots(s.namespace).Delete(name, &metav1.DeleteOptions{})
+}
+
+func (s *DataStore) GetSnapshot(name string) (*longhorn.Snapshot, error) {
+	resultRO, err := s.GetSnapshotRO(name)
 	if err != nil {
 		return nil, err
 	}
-	return engineList, nil
+	// Cannot use cached object from lister
+	return resultRO.DeepCopy(), nil
+}
+
+// GetSnapshotRO returns the snapshot from the informer cache, which must not
+// be modified
+func (s *DataStore) GetSnapshotRO(name string) (*longhorn.Snapshot, error) {
+	return s.snLister.Snapshots(s.namespace).Get(name)
 }
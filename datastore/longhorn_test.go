@@ -0,0 +1,169 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+)
+
+func newTestReplica(name, volumeName string, labels map[string]string) *longhorn.Replica {
+	return &longhorn.Replica{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    labels,
+		},
+		Spec: types.ReplicaSpec{
+			InstanceSpec: types.InstanceSpec{
+				VolumeName: volumeName,
+			},
+		},
+	}
+}
+
+func TestUpdateReplicaRestoresVolumeLabel(t *testing.T) {
+	assert := require.New(t)
+
+	replica := newTestReplica(testVolume+"-r-1", testVolume, getVolumeLabels(testVolume))
+	lhClient := lhfake.NewSimpleClientset(replica)
+	ds := newTestDataStore(lhClient)
+
+	r, err := lhClient.LonghornV1alpha1().Replicas(testNamespace).Get(replica.Name, metav1.GetOptions{})
+	assert.Nil(err)
+	r.Labels[LonghornVolumeKey] = "other-volume"
+	r, err = ds.UpdateReplica(r)
+	assert.Nil(err)
+	assert.Equal(testVolume, r.Labels[LonghornVolumeKey])
+}
+
+func TestListEngineImageReferences(t *testing.T) {
+	assert := require.New(t)
+
+	const (
+		oldImage = "longhornio/longhorn-engine:old"
+		newImage = "longhornio/longhorn-engine:new"
+	)
+	ds, lhInformerFactory := newTestDataStoreWithInformers(lhfake.NewSimpleClientset())
+
+	// upgrading from the old image to the new one
+	upgrading := &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{Name: "upgrading", Namespace: testNamespace},
+		Spec:       types.VolumeSpec{EngineImage: newImage},
+		Status:     types.VolumeStatus{CurrentImage: oldImage},
+	}
+	upgraded := &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{Name: "upgraded", Namespace: testNamespace},
+		Spec:       types.VolumeSpec{EngineImage: newImage},
+		Status:     types.VolumeStatus{CurrentImage: newImage},
+	}
+	assert.Nil(lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer().Add(upgrading))
+	assert.Nil(lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer().Add(upgraded))
+	// the replica left running on the old image
+	staleReplica := newTestReplica("upgraded-r-1", "upgraded", getVolumeLabels("upgraded"))
+	staleReplica.Spec.EngineImage = newImage
+	staleReplica.Status.CurrentImage = oldImage
+	assert.Nil(ds.rIndexer.Add(staleReplica))
+
+	volumes, err := ds.ListEngineImageReferences(oldImage)
+	assert.Nil(err)
+	assert.Equal([]string{"upgraded", "upgrading"}, volumes)
+
+	volumes, err = ds.ListEngineImageReferences(newImage)
+	assert.Nil(err)
+	assert.Equal([]string{"upgraded", "upgrading"}, volumes)
+
+	volumes, err = ds.ListEngineImageReferences("longhornio/longhorn-engine:unused")
+	assert.Nil(err)
+	assert.Len(volumes, 0)
+}
+
+func TestCheckEngineImageDeletable(t *testing.T) {
+	assert := require.New(t)
+
+	const image = "longhornio/longhorn-engine:test"
+	ds, lhInformerFactory := newTestDataStoreWithInformers(lhfake.NewSimpleClientset())
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+	vIndexer := lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer()
+
+	ei := &longhorn.EngineImage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      types.GetEngineImageChecksumName(image),
+			Namespace: testNamespace,
+		},
+		Spec: types.EngineImageSpec{Image: image},
+	}
+
+	assert.Nil(sIndexer.Add(newTestSetting(types.SettingNameDefaultEngineImage, image)))
+	err := ds.CheckEngineImageDeletable(ei)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "change setting "+string(types.SettingNameDefaultEngineImage))
+
+	assert.Nil(sIndexer.Update(newTestSetting(types.SettingNameDefaultEngineImage, "longhornio/longhorn-engine:default")))
+	assert.Nil(ds.CheckEngineImageDeletable(ei))
+
+	for i := 0; i < maxEngineImageReferenceSamples+2; i++ {
+		assert.Nil(vIndexer.Add(&longhorn.Volume{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("volume-%d", i), Namespace: testNamespace},
+			Spec:       types.VolumeSpec{EngineImage: image},
+		}))
+	}
+	err = ds.CheckEngineImageDeletable(ei)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "used by 7 volumes (volume-0, volume-1, volume-2, volume-3, volume-4 and 2 more)")
+}
+
+func TestCheckEngineImageReadiness(t *testing.T) {
+	assert := require.New(t)
+
+	const image = "longhornio/longhorn-engine:test"
+	ds, lhInformerFactory := newTestDataStoreWithInformers(lhfake.NewSimpleClientset())
+
+	// deployed on node-1 but still pulling on node-2 which has just joined
+	ei := &longhorn.EngineImage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      types.GetEngineImageChecksumName(image),
+			Namespace: testNamespace,
+		},
+		Spec: types.EngineImageSpec{Image: image},
+		Status: types.EngineImageStatus{
+			State: types.EngineImageStateDeploying,
+			Conditions: map[types.EngineImageConditionType]types.Condition{
+				types.EngineImageConditionTypeIncompatible: {
+					Type:   types.EngineImageConditionTypeIncompatible,
+					Status: types.ConditionStatusFalse,
+				},
+			},
+			NodeDeploymentMap: map[string]bool{"node-1": true, "node-2": false},
+		},
+	}
+	indexer := lhInformerFactory.Longhorn().V1alpha1().EngineImages().Informer().GetIndexer()
+	assert.Nil(indexer.Add(ei))
+
+	assert.Nil(ds.CheckEngineImageReadiness(image, "node-1"))
+	err := ds.CheckEngineImageReadiness(image, "node-1", "node-2")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "not deployed on nodes node-2")
+	// not deployed on all the nodes
+	assert.NotNil(ds.CheckEngineImageReadiness(image))
+
+	ei = ei.DeepCopy()
+	ei.Status.Conditions[types.EngineImageConditionTypeIncompatible] = types.Condition{
+		Type:    types.EngineImageConditionTypeIncompatible,
+		Status:  types.ConditionStatusTrue,
+		Message: "CLI API version 1 is below the minimum 3",
+	}
+	assert.Nil(indexer.Update(ei))
+	err = ds.CheckEngineImageReadiness(image, "node-1")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "incompatible")
+
+	assert.NotNil(ds.CheckEngineImageReadiness("longhornio/longhorn-engine:unknown", "node-1"))
+}
@@ -0,0 +1,312 @@
+package datastore
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+// resourceMigration rewrites the objects of an older version to the current
+// shape, e.g. filling in the new fields or backfilling the labels. It must be
+// idempotent, since the interrupted migration is run again.
+type resourceMigration struct {
+	description string
+	migrate     func(s *DataStore) error
+}
+
+// resourceMigrations are applied in order, each once. The applied number is
+// recorded in the setting resource-migration-level after each migration, so
+// the interrupted ones resume from the first not recorded. Only append to the
+// list.
+var resourceMigrations = []resourceMigration{
+	{
+		description: "label the engines and the replicas with the volume and the node",
+		migrate:     migrateObjectLabels,
+	},
+	{
+		description: "fill in the frontend and the engine image of the v0.3 volumes",
+		migrate:     migrateV03Volumes,
+	},
+	{
+		description: "fill in the size and the frontend of the v0.3 engines",
+		migrate:     migrateV03Engines,
+	},
+	{
+		description: "fill in the engine and the data path of the v0.3 replicas",
+		migrate:     migrateV03Replicas,
+	},
+}
+
+// MigrateResources applies the resource migrations not applied yet. It runs
+// before the controllers start, which must not see the objects of the older
+// versions.
+func (s *DataStore) MigrateResources() error {
+	return s.migrateResources(resourceMigrations)
+}
+
+func (s *DataStore) migrateResources(migrations []resourceMigration) error {
+	level, err := s.getResourceMigrationLevel()
+	if err != nil {
+		return err
+	}
+	for ; level < len(migrations); level++ {
+		m := migrations[level]
+		if err := m.migrate(s); err != nil {
+			return errors.Wrapf(err, "failed resource migration %v: %v", level+1, m.description)
+		}
+		logrus.Infof("Applied resource migration %v: %v", level+1, m.description)
+		if err := s.recordResourceMigrationLevel(level + 1); err != nil {
+			return errors.Wrap(err, "failed to record the resource migration level")
+		}
+	}
+	return nil
+}
+
+func (s *DataStore) getResourceMigrationLevel() (int, error) {
+	setting, err := s.lhClient.LonghornV1alpha1().Settings(s.namespace).Get(string(types.SettingNameResourceMigrationLevel), metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "failed to get the resource migration level")
+	}
+	level, err := strconv.Atoi(setting.Value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid resource migration level %v", setting.Value)
+	}
+	return level, nil
+}
+
+// recordResourceMigrationLevel records the level unless a higher one has been
+// recorded. The managers starting at the same time migrate concurrently,
+// which is fine since the migrations are idempotent.
+func (s *DataStore) recordResourceMigrationLevel(level int) error {
+	var err error
+	for i := 0; i < StatusUpdateRetryCounts; i++ {
+		var setting *longhorn.Setting
+		setting, err = s.lhClient.LonghornV1alpha1().Settings(s.namespace).Get(string(types.SettingNameResourceMigrationLevel), metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err != nil {
+			_, err = s.CreateSetting(&longhorn.Setting{
+				ObjectMeta: metav1.ObjectMeta{Name: string(types.SettingNameResourceMigrationLevel)},
+				Setting:    types.Setting{Value: strconv.Itoa(level)},
+			})
+		} else {
+			if recorded, err := strconv.Atoi(setting.Value); err == nil && recorded >= level {
+				return nil
+			}
+			setting.Value = strconv.Itoa(level)
+			_, err = s.UpdateSetting(setting)
+		}
+		if err == nil || !(apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)) {
+			return err
+		}
+	}
+	return err
+}
+
+// migrateVolumes applies migrate to the volumes, and updates the ones
+// changed. The volume updated by others in the meantime is re-fetched and
+// migrated again. The ones being deleted are left alone.
+func (s *DataStore) migrateVolumes(migrate func(v *longhorn.Volume) error) error {
+	list, err := s.lhClient.LonghornV1alpha1().Volumes(s.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		v := &list.Items[i]
+		name := v.Name
+		err := retryOnConflict(func() error {
+			if v.DeletionTimestamp != nil {
+				return nil
+			}
+			existing := v.DeepCopy()
+			if err := migrate(v); err != nil {
+				return err
+			}
+			if reflect.DeepEqual(existing, v) {
+				return nil
+			}
+			_, err := s.UpdateVolume(v)
+			return err
+		}, func() (err error) {
+			v, err = s.lhClient.LonghornV1alpha1().Volumes(s.namespace).Get(name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to migrate volume %v", name)
+		}
+	}
+	return nil
+}
+
+func (s *DataStore) migrateEngines(migrate func(e *longhorn.Engine) error) error {
+	list, err := s.lhClient.LonghornV1alpha1().Engines(s.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		e := &list.Items[i]
+		name := e.Name
+		err := retryOnConflict(func() error {
+			if e.DeletionTimestamp != nil {
+				return nil
+			}
+			existing := e.DeepCopy()
+			if err := migrate(e); err != nil {
+				return err
+			}
+			if reflect.DeepEqual(existing, e) {
+				return nil
+			}
+			_, err := s.UpdateEngine(e)
+			return err
+		}, func() (err error) {
+			e, err = s.lhClient.LonghornV1alpha1().Engines(s.namespace).Get(name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to migrate engine %v", name)
+		}
+	}
+	return nil
+}
+
+func (s *DataStore) migrateReplicas(migrate func(r *longhorn.Replica) error) error {
+	list, err := s.lhClient.LonghornV1alpha1().Replicas(s.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range list.Items {
+		r := &list.Items[i]
+		name := r.Name
+		err := retryOnConflict(func() error {
+			if r.DeletionTimestamp != nil {
+				return nil
+			}
+			existing := r.DeepCopy()
+			if err := migrate(r); err != nil {
+				return err
+			}
+			if reflect.DeepEqual(existing, r) {
+				return nil
+			}
+			_, err := s.UpdateReplica(r)
+			return err
+		}, func() (err error) {
+			r, err = s.lhClient.LonghornV1alpha1().Replicas(s.namespace).Get(name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to migrate replica %v", name)
+		}
+	}
+	return nil
+}
+
+// migrateObjectLabels labels the engines and the replicas created before the
+// volume and the node labels were introduced, since they're invisible to the
+// listing by volume or node otherwise. It goes first, so the later
+// migrations can list the objects of the volume.
+func migrateObjectLabels(s *DataStore) error {
+	if err := s.migrateEngines(func(e *longhorn.Engine) error {
+		if err := tagVolumeLabel(e.Spec.VolumeName, e); err != nil {
+			return err
+		}
+		return tagNodeLabel(e.Spec.NodeID, e)
+	}); err != nil {
+		return err
+	}
+	return s.migrateReplicas(func(r *longhorn.Replica) error {
+		if err := tagVolumeLabel(r.Spec.VolumeName, r); err != nil {
+			return err
+		}
+		return tagNodeLabel(r.Spec.NodeID, r)
+	})
+}
+
+func (s *DataStore) listVolumeEnginesForMigration(volumeName string) ([]longhorn.Engine, error) {
+	selector, err := GetVolumeSelector(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	list, err := s.lhClient.LonghornV1alpha1().Engines(s.namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func migrateV03Volumes(s *DataStore) error {
+	return s.migrateVolumes(func(v *longhorn.Volume) error {
+		if v.Spec.Frontend == "" {
+			v.Spec.Frontend = types.VolumeFrontendBlockDev
+		}
+		if v.Spec.EngineImage == "" {
+			engines, err := s.listVolumeEnginesForMigration(v.Name)
+			if err != nil {
+				return err
+			}
+			if len(engines) != 1 {
+				return fmt.Errorf("cannot find the engine image of volume %v, found %v engines", v.Name, len(engines))
+			}
+			v.Spec.EngineImage = engines[0].Spec.EngineImage
+		}
+		return nil
+	})
+}
+
+func migrateV03Engines(s *DataStore) error {
+	return s.migrateEngines(func(e *longhorn.Engine) error {
+		if e.Spec.VolumeSize != 0 && e.Spec.Frontend != "" {
+			return nil
+		}
+		v, err := s.lhClient.LonghornV1alpha1().Volumes(s.namespace).Get(e.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "cannot find volume %v of engine %v", e.Spec.VolumeName, e.Name)
+		}
+		e.Spec.VolumeSize = v.Spec.Size
+		e.Spec.Frontend = v.Spec.Frontend
+		return nil
+	})
+}
+
+// migrateV03Replicas fills in the fields known without the node. The disk
+// is filled in when the replica is read, since the node may not have been
+// registered by its manager yet.
+func migrateV03Replicas(s *DataStore) error {
+	return s.migrateReplicas(func(r *longhorn.Replica) error {
+		if r.Spec.EngineName == "" {
+			engines, err := s.listVolumeEnginesForMigration(r.Spec.VolumeName)
+			if err != nil {
+				return err
+			}
+			if len(engines) != 1 {
+				return fmt.Errorf("cannot find the engine of replica %v, found %v engines of volume %v", r.Name, len(engines), r.Spec.VolumeName)
+			}
+			r.Spec.EngineName = engines[0].Name
+		}
+		// unscheduled replica gets the data path from the scheduler
+		if r.Spec.NodeID != "" && r.Spec.DataPath == "" {
+			r.Spec.DataPath = filepath.Join(types.DefaultLonghornDirectory, "/replicas/", r.Name)
+			// the field didn't exist, and the data of the replica is in use
+			r.Spec.Active = true
+		}
+		return nil
+	})
+}
@@ -0,0 +1,178 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+)
+
+// loadFixture reads the object of an older version kept in testdata, as it
+// was stored by that version
+func loadFixture(t *testing.T, version, name string, obj runtime.Object) runtime.Object {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", version, name))
+	require.Nil(t, err)
+	require.Nil(t, json.Unmarshal(data, obj))
+	return obj
+}
+
+func getResourceMigrationLevel(t *testing.T, lhClient *lhfake.Clientset) string {
+	setting, err := lhClient.LonghornV1alpha1().Settings(testNamespace).Get(string(types.SettingNameResourceMigrationLevel), metav1.GetOptions{})
+	require.Nil(t, err)
+	return setting.Value
+}
+
+func TestMigrateResourcesV03(t *testing.T) {
+	assert := require.New(t)
+
+	const (
+		volumeName  = "pvc-v03"
+		engineName  = "pvc-v03-e-6f7a9c1b"
+		scheduled   = "pvc-v03-r-0b4e7d2a"
+		unscheduled = "pvc-v03-r-9d21c6f0"
+		engineImage = "rancher/longhorn-engine:v0.3.0"
+	)
+	// created by the current version, and left alone
+	current := newTestReplica("current-r-1", "current", getVolumeLabels("current"))
+	current.Labels[types.LonghornNodeKey] = ""
+	current.Spec.EngineName = "current-e"
+
+	lhClient := lhfake.NewSimpleClientset(
+		loadFixture(t, "v0.3", "volume.json", &longhorn.Volume{}),
+		loadFixture(t, "v0.3", "engine.json", &longhorn.Engine{}),
+		loadFixture(t, "v0.3", "replica-scheduled.json", &longhorn.Replica{}),
+		loadFixture(t, "v0.3", "replica-unscheduled.json", &longhorn.Replica{}),
+		current,
+	)
+	ds := newTestDataStore(lhClient)
+	// the replicas updated by others meanwhile are migrated again
+	replicaUpdates := injectConflicts(lhClient, "replicas", 1)
+
+	assert.Nil(ds.MigrateResources())
+	level := strconv.Itoa(len(resourceMigrations))
+	assert.Equal(level, getResourceMigrationLevel(t, lhClient))
+	// 1 conflict, then the label and the field migrations of the 2 v0.3
+	// replicas
+	assert.Equal(5, *replicaUpdates)
+
+	v, err := lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(volumeName, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal(types.VolumeFrontendBlockDev, v.Spec.Frontend)
+	assert.Equal(engineImage, v.Spec.EngineImage)
+
+	e, err := lhClient.LonghornV1alpha1().Engines(testNamespace).Get(engineName, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal(volumeName, e.Labels[LonghornVolumeKey])
+	assert.Equal("node-1", e.Labels[types.LonghornNodeKey])
+	assert.Equal(v.Spec.Size, e.Spec.VolumeSize)
+	assert.Equal(types.VolumeFrontendBlockDev, e.Spec.Frontend)
+
+	r, err := lhClient.LonghornV1alpha1().Replicas(testNamespace).Get(scheduled, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal(volumeName, r.Labels[LonghornVolumeKey])
+	assert.Equal("node-1", r.Labels[types.LonghornNodeKey])
+	assert.Equal(engineName, r.Spec.EngineName)
+	assert.Equal(filepath.Join(types.DefaultLonghornDirectory, "replicas", scheduled), r.Spec.DataPath)
+	assert.True(r.Spec.Active)
+
+	r, err = lhClient.LonghornV1alpha1().Replicas(testNamespace).Get(unscheduled, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal(volumeName, r.Labels[LonghornVolumeKey])
+	assert.Equal(engineName, r.Spec.EngineName)
+	// left to the scheduler
+	assert.Equal("", r.Spec.DataPath)
+	assert.False(r.Spec.Active)
+
+	// run once per upgrade
+	*replicaUpdates = 0
+	engineUpdates := injectConflicts(lhClient, "engines", 0)
+	assert.Nil(ds.MigrateResources())
+	assert.Equal(0, *replicaUpdates)
+	assert.Equal(0, *engineUpdates)
+}
+
+func TestMigrateResourcesResume(t *testing.T) {
+	assert := require.New(t)
+
+	runs := []int{0, 0, 0}
+	fail := true
+	migrations := []resourceMigration{
+		{
+			description: "first",
+			migrate: func(s *DataStore) error {
+				runs[0]++
+				return nil
+			},
+		},
+		{
+			description: "interrupted",
+			migrate: func(s *DataStore) error {
+				runs[1]++
+				if fail {
+					return fmt.Errorf("interrupted")
+				}
+				return nil
+			},
+		},
+		{
+			description: "last",
+			migrate: func(s *DataStore) error {
+				runs[2]++
+				return nil
+			},
+		},
+	}
+
+	lhClient := lhfake.NewSimpleClientset()
+	ds := newTestDataStore(lhClient)
+
+	err := ds.migrateResources(migrations)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "failed resource migration 2: interrupted")
+	assert.Equal("1", getResourceMigrationLevel(t, lhClient))
+	assert.Equal([]int{1, 1, 0}, runs)
+
+	// resumed from the interrupted one
+	fail = false
+	assert.Nil(ds.migrateResources(migrations))
+	assert.Equal("3", getResourceMigrationLevel(t, lhClient))
+	assert.Equal([]int{1, 2, 1}, runs)
+
+	// the migrations appended by the next version run alone
+	migrations = append(migrations, resourceMigration{
+		description: "next version",
+		migrate: func(s *DataStore) error {
+			runs = append(runs, 1)
+			return nil
+		},
+	})
+	assert.Nil(ds.migrateResources(migrations))
+	assert.Equal("4", getResourceMigrationLevel(t, lhClient))
+	assert.Equal([]int{1, 2, 1, 1}, runs)
+}
+
+func TestMigrateResourcesFailsLoudly(t *testing.T) {
+	assert := require.New(t)
+
+	// the v0.3 volume whose engine is gone can't be migrated
+	lhClient := lhfake.NewSimpleClientset(loadFixture(t, "v0.3", "volume.json", &longhorn.Volume{}))
+	ds := newTestDataStore(lhClient)
+
+	err := ds.MigrateResources()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "failed resource migration 2")
+	assert.Contains(err.Error(), "pvc-v03")
+	assert.Equal("1", getResourceMigrationLevel(t, lhClient))
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	// StatusUpdateRetryCounts is the maximum number of the attempts of the
+	// status update if it keeps conflicting
+	StatusUpdateRetryCounts = 5
+)
+
+// retryOnConflict calls update until it doesn't conflict, and calls refetch
+// to get the latest object from the API server before retrying, since the
+// object in the informer cache may still be stale
+func retryOnConflict(update func() error, refetch func() error) error {
+	var err error
+	for i := 0; i < StatusUpdateRetryCounts; i++ {
+		if i > 0 {
+			if err := refetch(); err != nil {
+				return err
+			}
+		}
+		if err = update(); err == nil || !apierrors.IsConflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// UpdateVolumeStatusWithRetry applies mutate to the volume and updates its
+// status. If the volume was changed by others in the meantime, the latest
+// volume is re-fetched and mutate is re-applied to it, so mutate should only
+// change the status.
+func (s *DataStore) UpdateVolumeStatusWithRetry(v *longhorn.Volume, mutate func(v *longhorn.Volume)) (*longhorn.Volume, error) {
+	name := v.Name
+	obj := v.DeepCopy()
+	var result *longhorn.Volume
+	err := retryOnConflict(func() (err error) {
+		mutate(obj)
+		result, err = s.UpdateVolumeStatus(obj)
+		return err
+	}, func() (err error) {
+		obj, err = s.lhClient.LonghornV1alpha1().Volumes(s.namespace).Get(name, metav1.GetOptions{})
+		return err
+	})
+	return result, err
+}
+
+// UpdateEngineStatusWithRetry applies mutate to the engine and updates its
+// status, re-fetching the engine and re-applying mutate on conflict
+func (s *DataStore) UpdateEngineStatusWithRetry(e *longhorn.Engine, mutate func(e *longhorn.Engine)) (*longhorn.Engine, error) {
+	name := e.Name
+	obj := e.DeepCopy()
+	var result *longhorn.Engine
+	err := retryOnConflict(func() (err error) {
+		mutate(obj)
+		result, err = s.UpdateEngineStatus(obj)
+		return err
+	}, func() (err error) {
+		obj, err = s.lhClient.LonghornV1alpha1().Engines(s.namespace).Get(name, metav1.GetOptions{})
+		return err
+	})
+	return result, err
+}
+
+// UpdateReplicaStatusWithRetry applies mutate to the replica and updates its
+// status, re-fetching the replica and re-applying mutate on conflict
+func (s *DataStore) UpdateReplicaStatusWithRetry(r *longhorn.Replica, mutate func(r *longhorn.Replica)) (*longhorn.Replica, error) {
+	name := r.Name
+	obj := r.DeepCopy()
+	var result *longhorn.Replica
+	err := retryOnConflict(func() (err error) {
+		mutate(obj)
+		result, err = s.UpdateReplicaStatus(obj)
+		return err
+	}, func() (err error) {
+		obj, err = s.lhClient.LonghornV1alpha1().Replicas(s.namespace).Get(name, metav1.GetOptions{})
+		return err
+	})
+	return result, err
+}
+
+// UpdateNodeStatusWithRetry applies mutate to the node and updates its
+// status, re-fetching the node and re-applying mutate on conflict
+func (s *DataStore) UpdateNodeStatusWithRetry(node *longhorn.Node, mutate func(node *longhorn.Node)) (*longhorn.Node, error) {
+	name := node.Name
+	obj := node.DeepCopy()
+	var result *longhorn.Node
+	err := retryOnConflict(func() (err error) {
+		mutate(obj)
+		result, err = s.UpdateNodeStatus(obj)
+		return err
+	}, func() (err error) {
+		obj, err = s.lhClient.LonghornV1alpha1().Nodes(s.namespace).Get(name, metav1.GetOptions{})
+		return err
+	})
+	return result, err
+}
+
+// UpdateSnapshotStatusWithRetry applies mutate to the snapshot and updates
+// its status, re-fetching the snapshot and re-applying mutate on conflict
+func (s *DataStore) UpdateSnapshotStatusWithRetry(snap *longhorn.Snapshot, mutate func(snap *longhorn.Snapshot)) (*longhorn.Snapshot, error) {
+	name := snap.Name
+	obj := snap.DeepCopy()
+	var result *longhorn.Snapshot
+	err := retryOnConflict(func() (err error) {
+		mutate(obj)
+		result, err = s.UpdateSnapshotStatus(obj)
+		return err
+	}, func() (err error) {
+		obj, err = s.lhClient.LonghornV1alpha1().Snapshots(s.namespace).Get(name, metav1.GetOptions{})
+		return err
+	})
+	return result, err
+}
+
+// UpdateSettingStatusWithRetry applies mutate to the setting and updates it,
+// re-fetching the setting and re-applying mutate on conflict. The setting has
+// no status subresource, so mutate should only change the status to leave
+// the value updated by others untouched.
+func (s *DataStore) UpdateSettingStatusWithRetry(setting *longhorn.Setting, mutate func(setting *longhorn.Setting)) (*longhorn.Setting, error) {
+	name := setting.Name
+	obj := setting.DeepCopy()
+	var result *longhorn.Setting
+	err := retryOnConflict(func() (err error) {
+		mutate(obj)
+		result, err = s.UpdateSetting(obj)
+		return err
+	}, func() (err error) {
+		obj, err = s.lhClient.LonghornV1alpha1().Settings(s.namespace).Get(name, metav1.GetOptions{})
+		return err
+	})
+	return result, err
+}
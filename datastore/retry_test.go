@@ -0,0 +1,215 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+)
+
+const (
+	testNamespace = "default"
+	testVolume    = "test-volume"
+	testNode      = "test-node"
+)
+
+func newTestDataStore(lhClient *lhfake.Clientset) *DataStore {
+	ds, _ := newTestDataStoreWithInformers(lhClient)
+	return ds
+}
+
+// newTestDataStoreWithInformers returns the informer factory of the Longhorn
+// objects as well, which can be started for the tests relying on the events
+func newTestDataStoreWithInformers(lhClient *lhfake.Clientset) (*DataStore, lhinformerfactory.SharedInformerFactory) {
+	kubeClient := fake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, 0)
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	ds := NewDataStore(
+		lhInformerFactory.Longhorn().V1alpha1().Volumes(),
+		lhInformerFactory.Longhorn().V1alpha1().Engines(),
+		lhInformerFactory.Longhorn().V1alpha1().Replicas(),
+		lhInformerFactory.Longhorn().V1alpha1().EngineImages(),
+		lhInformerFactory.Longhorn().V1alpha1().Nodes(),
+		lhInformerFactory.Longhorn().V1alpha1().Settings(),
+		lhInformerFactory.Longhorn().V1alpha1().Snapshots(),
+		lhClient,
+		kubeInformerFactory.Core().V1().Pods(),
+		kubeInformerFactory.Batch().V1beta1().CronJobs(),
+		kubeInformerFactory.Apps().V1beta2().DaemonSets(),
+		kubeInformerFactory.Core().V1().Events(),
+		kubeInformerFactory.Core().V1().PersistentVolumes(),
+		kubeInformerFactory.Core().V1().PersistentVolumeClaims(),
+		kubeInformerFactory.Storage().V1beta1().VolumeAttachments(),
+		kubeClient, testNamespace)
+	return ds, lhInformerFactory
+}
+
+// injectConflicts fails the first conflicts updates of the resource with
+// conflict, and returns the number of the updates attempted
+func injectConflicts(lhClient *lhfake.Clientset, resource string, conflicts int) *int {
+	updates := 0
+	lhClient.PrependReactor("update", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates > conflicts {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewConflict(longhorn.Resource(resource), "", nil)
+	})
+	return &updates
+}
+
+func newTestVolume() *longhorn.Volume {
+	return &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testVolume,
+			Namespace: testNamespace,
+		},
+		Spec: types.VolumeSpec{
+			Size:             1073741824,
+			NumberOfReplicas: 3,
+		},
+	}
+}
+
+func TestUpdateVolumeStatusWithRetry(t *testing.T) {
+	assert := require.New(t)
+
+	lhClient := lhfake.NewSimpleClientset(newTestVolume())
+	ds := newTestDataStore(lhClient)
+
+	v, err := lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+
+	// others attached the volume between the read and the write of the
+	// status, which is only seen by re-fetching the volume
+	refetches := 0
+	lhClient.PrependReactor("get", "volumes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		refetches++
+		latest := newTestVolume()
+		latest.Spec.NodeID = testNode
+		return true, latest, nil
+	})
+	updates := injectConflicts(lhClient, "volumes", 2)
+	updated, err := ds.UpdateVolumeStatusWithRetry(v, func(v *longhorn.Volume) {
+		v.Status.State = types.VolumeStateDetached
+	})
+	assert.Nil(err)
+	assert.Equal(3, *updates)
+	assert.Equal(2, refetches)
+
+	// the status is applied on top of the change by others
+	assert.Equal(types.VolumeStateDetached, updated.Status.State)
+	assert.Equal(testNode, updated.Spec.NodeID)
+}
+
+func TestUpdateVolumeStatusWithRetryExhausted(t *testing.T) {
+	assert := require.New(t)
+
+	lhClient := lhfake.NewSimpleClientset(newTestVolume())
+	ds := newTestDataStore(lhClient)
+
+	v, err := lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+
+	updates := injectConflicts(lhClient, "volumes", StatusUpdateRetryCounts)
+	_, err = ds.UpdateVolumeStatusWithRetry(v, func(v *longhorn.Volume) {
+		v.Status.State = types.VolumeStateDetached
+	})
+	assert.True(apierrors.IsConflict(err))
+	assert.Equal(StatusUpdateRetryCounts, *updates)
+
+	v, err = lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal(types.VolumeState(""), v.Status.State)
+}
+
+func TestUpdateStatusWithRetry(t *testing.T) {
+	assert := require.New(t)
+
+	engine := &longhorn.Engine{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-engine", Namespace: testNamespace},
+		Spec:       types.EngineSpec{InstanceSpec: types.InstanceSpec{VolumeName: testVolume}},
+	}
+	replica := &longhorn.Replica{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-replica", Namespace: testNamespace},
+		Spec:       types.ReplicaSpec{InstanceSpec: types.InstanceSpec{VolumeName: testVolume}},
+	}
+	node := &longhorn.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: testNode, Namespace: testNamespace},
+	}
+	lhClient := lhfake.NewSimpleClientset(engine, replica, node)
+	ds := newTestDataStore(lhClient)
+
+	engineUpdates := injectConflicts(lhClient, "engines", 1)
+	e, err := ds.UpdateEngineStatusWithRetry(engine, func(e *longhorn.Engine) {
+		e.Status.CurrentState = types.InstanceStateStopped
+	})
+	assert.Nil(err)
+	assert.Equal(2, *engineUpdates)
+	assert.Equal(types.InstanceStateStopped, e.Status.CurrentState)
+
+	replicaUpdates := injectConflicts(lhClient, "replicas", 1)
+	r, err := ds.UpdateReplicaStatusWithRetry(replica, func(r *longhorn.Replica) {
+		r.Status.CurrentState = types.InstanceStateStopped
+	})
+	assert.Nil(err)
+	assert.Equal(2, *replicaUpdates)
+	assert.Equal(types.InstanceStateStopped, r.Status.CurrentState)
+
+	nodeUpdates := injectConflicts(lhClient, "nodes", 1)
+	n, err := ds.UpdateNodeStatusWithRetry(node, func(n *longhorn.Node) {
+		n.Status.Zone = "zone-1"
+	})
+	assert.Nil(err)
+	assert.Equal(2, *nodeUpdates)
+	assert.Equal("zone-1", n.Status.Zone)
+
+	// the error other than conflict isn't retried
+	lhClient.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewBadRequest("invalid node")
+	})
+	_, err = ds.UpdateNodeStatusWithRetry(node, func(n *longhorn.Node) {})
+	assert.True(apierrors.IsBadRequest(err))
+}
+
+func TestUpdateSettingStatusWithRetry(t *testing.T) {
+	assert := require.New(t)
+
+	newSetting := func(value string) *longhorn.Setting {
+		return &longhorn.Setting{
+			ObjectMeta: metav1.ObjectMeta{Name: string(types.SettingNameBackupTarget), Namespace: testNamespace},
+			Setting:    types.Setting{Value: value},
+		}
+	}
+	setting := newSetting("s3://backupbucket@us-east-1/backupstore")
+	lhClient := lhfake.NewSimpleClientset(setting)
+	ds := newTestDataStore(lhClient)
+
+	// the user changed the value between the read and the write of the
+	// status
+	lhClient.PrependReactor("get", "settings", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, newSetting("nfs://longhorn-test-nfs-svc:/opt/backupstore"), nil
+	})
+	updates := injectConflicts(lhClient, "settings", 1)
+	updated, err := ds.UpdateSettingStatusWithRetry(setting, func(s *longhorn.Setting) {
+		s.Status.BackupTarget = "s3://backupbucket@us-east-1/backupstore"
+	})
+	assert.Nil(err)
+	assert.Equal(2, *updates)
+
+	// the value by the user isn't overwritten
+	assert.Equal("nfs://longhorn-test-nfs-svc:/opt/backupstore", updated.Value)
+	assert.Equal("s3://backupbucket@us-east-1/backupstore", updated.Status.BackupTarget)
+}
@@ -0,0 +1,247 @@
+package datastore
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhinformers "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions/longhorn/v1alpha1"
+)
+
+// settingCache keeps the parsed values of the settings, so the hot paths
+// don't copy and parse the setting on every read. A value is kept along with
+// the object in the informer cache it was parsed from, and parsed again once
+// the informer replaces the object on update.
+type settingCache struct {
+	lock   sync.RWMutex
+	values map[types.SettingName]*cachedSetting
+
+	subscribersLock sync.RWMutex
+	subscribers     []settingSubscriber
+}
+
+type cachedSetting struct {
+	// source is nil if the setting doesn't exist and the default is used
+	source *longhorn.Setting
+
+	value         string
+	intValue      int64
+	boolValue     bool
+	durationValue time.Duration
+	// err is the failure of parsing the value as the type of the setting
+	err error
+}
+
+type settingSubscriber struct {
+	names   map[types.SettingName]struct{}
+	handler func(name types.SettingName)
+}
+
+func newSettingCache(settingInformer lhinformers.SettingInformer) *settingCache {
+	c := &settingCache{
+		values: map[types.SettingName]*cachedSetting{},
+	}
+	settingInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if s, ok := obj.(*longhorn.Setting); ok {
+				c.notify(types.SettingName(s.Name))
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, ok := oldObj.(*longhorn.Setting)
+			if !ok {
+				return
+			}
+			cur, ok := newObj.(*longhorn.Setting)
+			if !ok {
+				return
+			}
+			// the resync doesn't change anything
+			if old.Value != cur.Value {
+				c.notify(types.SettingName(cur.Name))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if s, ok := obj.(*longhorn.Setting); ok {
+				c.notify(types.SettingName(s.Name))
+			}
+		},
+	})
+	return c
+}
+
+func (c *settingCache) notify(name types.SettingName) {
+	c.subscribersLock.RLock()
+	defer c.subscribersLock.RUnlock()
+	for _, sub := range c.subscribers {
+		if _, ok := sub.names[name]; ok {
+			sub.handler(name)
+		}
+	}
+}
+
+func parseSetting(definition types.SettingDefinition, source *longhorn.Setting) *cachedSetting {
+	value := definition.Default
+	if source != nil {
+		value = source.Value
+	}
+	cached := &cachedSetting{
+		source: source,
+		value:  value,
+	}
+	switch definition.Type {
+	case types.SettingTypeInt:
+		cached.intValue, cached.err = strconv.ParseInt(value, 10, 64)
+	case types.SettingTypeBool:
+		cached.boolValue, cached.err = strconv.ParseBool(value)
+	case types.SettingTypeDuration:
+		cached.durationValue, cached.err = time.ParseDuration(value)
+	}
+	return cached
+}
+
+// OnSettingChange calls the handler when any of the settings is created,
+// changed or deleted, for the controllers which need to act on the change
+// immediately rather than in the next resync. The handler is called from the
+// informer and must not block.
+func (s *DataStore) OnSettingChange(handler func(name types.SettingName), names ...types.SettingName) {
+	sub := settingSubscriber{
+		names:   map[types.SettingName]struct{}{},
+		handler: handler,
+	}
+	for _, name := range names {
+		sub.names[name] = struct{}{}
+	}
+	s.settingCache.subscribersLock.Lock()
+	s.settingCache.subscribers = append(s.settingCache.subscribers, sub)
+	s.settingCache.subscribersLock.Unlock()
+}
+
+func (s *DataStore) getCachedSetting(name types.SettingName) (*cachedSetting, types.SettingDefinition, error) {
+	definition, ok := types.SettingDefinitions[name]
+	if !ok {
+		return nil, definition, fmt.Errorf("setting %v is not supported", name)
+	}
+	source, err := s.sLister.Settings(s.namespace).Get(string(name))
+	if err != nil {
+		if !ErrorIsNotFound(err) {
+			return nil, definition, err
+		}
+		source = nil
+	}
+
+	s.settingCache.lock.RLock()
+	cached, ok := s.settingCache.values[name]
+	s.settingCache.lock.RUnlock()
+	if ok && cached.source == source {
+		return cached, definition, nil
+	}
+
+	cached = parseSetting(definition, source)
+	if cached.err != nil {
+		logrus.Warnf("Invalid value %v of setting %v: %v", cached.value, name, cached.err)
+	}
+	s.settingCache.lock.Lock()
+	s.settingCache.values[name] = cached
+	s.settingCache.lock.Unlock()
+	return cached, definition, nil
+}
+
+// GetSettingValue returns the value of the setting, or the default if it
+// doesn't exist
+func (s *DataStore) GetSettingValue(settingName types.SettingName) (string, error) {
+	cached, _, err := s.getCachedSetting(settingName)
+	if err != nil {
+		return "", err
+	}
+	return cached.value, nil
+}
+
+func (s *DataStore) GetSettingAsInt(settingName types.SettingName) (int64, error) {
+	cached, definition, err := s.getCachedSetting(settingName)
+	if err != nil {
+		return 0, err
+	}
+	if definition.Type != types.SettingTypeInt {
+		return 0, fmt.Errorf("The %v setting value couldn't change to integer, value is %v ", string(settingName), cached.value)
+	}
+	if cached.err != nil {
+		return 0, cached.err
+	}
+	return cached.intValue, nil
+}
+
+func (s *DataStore) GetSettingAsBool(settingName types.SettingName) (bool, error) {
+	cached, definition, err := s.getCachedSetting(settingName)
+	if err != nil {
+		return false, err
+	}
+	if definition.Type != types.SettingTypeBool {
+		return false, fmt.Errorf("The %v setting value couldn't change to bool, value is %v ", string(settingName), cached.value)
+	}
+	if cached.err != nil {
+		return false, cached.err
+	}
+	return cached.boolValue, nil
+}
+
+func (s *DataStore) GetSettingAsDuration(settingName types.SettingName) (time.Duration, error) {
+	cached, definition, err := s.getCachedSetting(settingName)
+	if err != nil {
+		return 0, err
+	}
+	if definition.Type != types.SettingTypeDuration {
+		return 0, fmt.Errorf("The %v setting value couldn't change to duration, value is %v ", string(settingName), cached.value)
+	}
+	if cached.err != nil {
+		return 0, cached.err
+	}
+	return cached.durationValue, nil
+}
+
+func (s *DataStore) GetStorageOverProvisioningPercentage() (int64, error) {
+	return s.GetSettingAsInt(types.SettingNameStorageOverProvisioningPercentage)
+}
+
+func (s *DataStore) GetStorageMinimalAvailablePercentage() (int64, error) {
+	return s.GetSettingAsInt(types.SettingNameStorageMinimalAvailablePercentage)
+}
+
+func (s *DataStore) GetStorageActualUsageWeight() (int64, error) {
+	return s.GetSettingAsInt(types.SettingNameStorageActualUsageWeight)
+}
+
+func (s *DataStore) GetReplicaZoneSoftAntiAffinity() (bool, error) {
+	return s.GetSettingAsBool(types.SettingNameReplicaZoneSoftAntiAffinity)
+}
+
+func (s *DataStore) GetKubernetesNodeCordonPolicy() (string, error) {
+	return s.GetSettingValue(types.SettingNameKubernetesNodeCordonPolicy)
+}
+
+func (s *DataStore) GetDefaultEngineImage() (string, error) {
+	return s.GetSettingValue(types.SettingNameDefaultEngineImage)
+}
+
+// GetSettingTaintToleration returns the taint tolerations of the pods
+// created by Longhorn
+func (s *DataStore) GetSettingTaintToleration() ([]v1.Toleration, error) {
+	value, err := s.GetSettingValue(types.SettingNameTaintToleration)
+	if err != nil {
+		return nil, err
+	}
+	return util.UnmarshalTolerations(value)
+}
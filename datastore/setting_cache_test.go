@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+)
+
+func newTestSetting(name types.SettingName, value string) *longhorn.Setting {
+	return &longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      string(name),
+			Namespace: testNamespace,
+		},
+		Setting: types.Setting{
+			Value: value,
+		},
+	}
+}
+
+func TestSettingCache(t *testing.T) {
+	assert := require.New(t)
+
+	ds, lhInformerFactory := newTestDataStoreWithInformers(lhfake.NewSimpleClientset())
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+	cachedValue := func(name types.SettingName) *cachedSetting {
+		ds.settingCache.lock.RLock()
+		defer ds.settingCache.lock.RUnlock()
+		return ds.settingCache.values[name]
+	}
+
+	// the default is used if the setting doesn't exist
+	percentage, err := ds.GetStorageOverProvisioningPercentage()
+	assert.Nil(err)
+	assert.Equal(int64(500), percentage)
+
+	// the parsed value is reused until the object is replaced
+	setting := newTestSetting(types.SettingNameStorageOverProvisioningPercentage, "200")
+	assert.Nil(sIndexer.Add(setting))
+	percentage, err = ds.GetStorageOverProvisioningPercentage()
+	assert.Nil(err)
+	assert.Equal(int64(200), percentage)
+	cached := cachedValue(types.SettingNameStorageOverProvisioningPercentage)
+	_, err = ds.GetStorageOverProvisioningPercentage()
+	assert.Nil(err)
+	assert.True(cached == cachedValue(types.SettingNameStorageOverProvisioningPercentage))
+
+	assert.Nil(sIndexer.Update(newTestSetting(types.SettingNameStorageOverProvisioningPercentage, "300")))
+	percentage, err = ds.GetStorageOverProvisioningPercentage()
+	assert.Nil(err)
+	assert.Equal(int64(300), percentage)
+
+	// back to the default once deleted
+	assert.Nil(sIndexer.Delete(setting))
+	percentage, err = ds.GetStorageOverProvisioningPercentage()
+	assert.Nil(err)
+	assert.Equal(int64(500), percentage)
+
+	// the invalid value fails the reads until it's fixed
+	assert.Nil(sIndexer.Add(newTestSetting(types.SettingNameReplicaZoneSoftAntiAffinity, "maybe")))
+	_, err = ds.GetReplicaZoneSoftAntiAffinity()
+	assert.NotNil(err)
+	assert.Nil(sIndexer.Update(newTestSetting(types.SettingNameReplicaZoneSoftAntiAffinity, "false")))
+	antiAffinity, err := ds.GetReplicaZoneSoftAntiAffinity()
+	assert.Nil(err)
+	assert.False(antiAffinity)
+
+	// the type of the setting is checked
+	_, err = ds.GetSettingAsInt(types.SettingNameReplicaZoneSoftAntiAffinity)
+	assert.NotNil(err)
+	_, err = ds.GetSettingAsBool("unknown-setting")
+	assert.NotNil(err)
+}
+
+func TestOnSettingChange(t *testing.T) {
+	assert := require.New(t)
+
+	lhClient := lhfake.NewSimpleClientset()
+	ds, lhInformerFactory := newTestDataStoreWithInformers(lhClient)
+
+	changes := make(chan types.SettingName, 10)
+	ds.OnSettingChange(func(name types.SettingName) {
+		changes <- name
+	}, types.SettingNameStorageMinimalAvailablePercentage)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	lhInformerFactory.Start(stopCh)
+	lhInformerFactory.WaitForCacheSync(stopCh)
+
+	waitForChange := func() types.SettingName {
+		select {
+		case name := <-changes:
+			return name
+		case <-time.After(5 * time.Second):
+			assert.FailNow("no notification of the setting change")
+		}
+		return ""
+	}
+
+	settings := lhClient.LonghornV1alpha1().Settings(testNamespace)
+	// the settings not subscribed are ignored
+	_, err := settings.Create(newTestSetting(types.SettingNameStorageActualUsageWeight, "50"))
+	assert.Nil(err)
+	setting, err := settings.Create(newTestSetting(types.SettingNameStorageMinimalAvailablePercentage, "10"))
+	assert.Nil(err)
+	assert.Equal(types.SettingNameStorageMinimalAvailablePercentage, waitForChange())
+
+	setting.Value = "20"
+	_, err = settings.Update(setting)
+	assert.Nil(err)
+	assert.Equal(types.SettingNameStorageMinimalAvailablePercentage, waitForChange())
+	// the value is up to date once notified
+	percentage, err := ds.GetStorageMinimalAvailablePercentage()
+	assert.Nil(err)
+	assert.Equal(int64(20), percentage)
+
+	assert.Nil(settings.Delete(setting.Name, &metav1.DeleteOptions{}))
+	assert.Equal(types.SettingNameStorageMinimalAvailablePercentage, waitForChange())
+
+	select {
+	case name := <-changes:
+		assert.FailNow("unexpected notification", "setting %v", name)
+	default:
+	}
+}
+
+func TestInitSettings(t *testing.T) {
+	assert := require.New(t)
+
+	lhClient := lhfake.NewSimpleClientset(newTestSetting(types.SettingNameBackupstorePollInterval, "60"))
+	ds := newTestDataStore(lhClient)
+
+	assert.Nil(ds.InitSettings())
+	// twice is fine
+	assert.Nil(ds.InitSettings())
+
+	settings, err := lhClient.LonghornV1alpha1().Settings(testNamespace).List(metav1.ListOptions{})
+	assert.Nil(err)
+	values := map[types.SettingName]string{}
+	for _, s := range settings.Items {
+		values[types.SettingName(s.Name)] = s.Value
+	}
+	// the read-only settings, e.g. the default engine image, are set by the
+	// manager, except the migration level recorded by the migration
+	readOnly := 0
+	for name, definition := range types.SettingDefinitions {
+		if definition.ReadOnly && name != types.SettingNameSettingMigrationLevel {
+			readOnly++
+			_, ok := values[name]
+			assert.False(ok, string(name))
+		}
+	}
+	assert.Len(values, len(types.SettingDefinitions)-readOnly)
+	_, ok := values[types.SettingNameDefaultEngineImage]
+	assert.False(ok)
+	assert.Equal(strconv.Itoa(len(settingMigrations)), values[types.SettingNameSettingMigrationLevel])
+	// the existing setting is kept
+	assert.Equal("60", values[types.SettingNameBackupstorePollInterval])
+	for name, value := range values {
+		if name != types.SettingNameBackupstorePollInterval && name != types.SettingNameSettingMigrationLevel {
+			assert.Equal(types.SettingDefinitions[name].Default, value, string(name))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+// settingMigration carries the settings of an older version over to the
+// current ones. It changes the values by the setting name in place: adding
+// the new settings, changing the values, or deleting the ones no longer
+// used. The values include the settings unknown to the current version.
+type settingMigration struct {
+	description string
+	migrate     func(values map[types.SettingName]string) error
+}
+
+// settingMigrations are applied in order, each once. The applied number is
+// recorded in the setting setting-migration-level, so only the new ones run
+// after an upgrade. Only append to the list.
+var settingMigrations = []settingMigration{
+	{
+		description: "rename disk-eviction-concurrent-limit to concurrent-disk-eviction-limit",
+		migrate:     renameSetting("disk-eviction-concurrent-limit", types.SettingNameConcurrentDiskEvictionLimit),
+	},
+}
+
+// renameSetting carries the value of the old setting over to the new one,
+// unless the new one has been set to other than the default
+func renameSetting(oldName, newName types.SettingName) func(values map[types.SettingName]string) error {
+	return transformSetting(oldName, newName, func(value string) (string, error) {
+		return value, nil
+	})
+}
+
+// transformSetting replaces the old setting with the new one, converting
+// the value. The same name can be used for both to change the value format
+// only.
+func transformSetting(oldName, newName types.SettingName, transform func(value string) (string, error)) func(values map[types.SettingName]string) error {
+	return func(values map[types.SettingName]string) error {
+		oldValue, ok := values[oldName]
+		if !ok {
+			return nil
+		}
+		newValue, err := transform(oldValue)
+		if err != nil {
+			return errors.Wrapf(err, "cannot convert value %v of setting %v", oldValue, oldName)
+		}
+		if oldName != newName {
+			delete(values, oldName)
+			if existing, ok := values[newName]; ok && existing != types.SettingDefinitions[newName].Default {
+				logrus.Warnf("Setting %v has been set to %v, drop value %v of the old setting %v",
+					newName, existing, oldValue, oldName)
+				return nil
+			}
+		}
+		values[newName] = newValue
+		return nil
+	}
+}
+
+// migrateSettingValues applies the migrations from the level on to the
+// values, and returns the new level
+func migrateSettingValues(migrations []settingMigration, level int, values map[types.SettingName]string) (int, error) {
+	for ; level < len(migrations); level++ {
+		m := migrations[level]
+		if err := m.migrate(values); err != nil {
+			return level, errors.Wrapf(err, "failed setting migration %v: %v", level+1, m.description)
+		}
+		logrus.Infof("Applied setting migration %v: %v", level+1, m.description)
+	}
+	return level, nil
+}
+
+// MigrateSettings applies the setting migrations not applied yet. The new
+// values are written before the old settings are deleted and the level is
+// recorded last, so the interrupted migration is run again from the start.
+func (s *DataStore) MigrateSettings() error {
+	return s.migrateSettings(settingMigrations)
+}
+
+func (s *DataStore) migrateSettings(migrations []settingMigration) error {
+	list, err := s.lhClient.LonghornV1alpha1().Settings(s.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list settings for the migration")
+	}
+	existing := map[types.SettingName]*longhorn.Setting{}
+	values := map[types.SettingName]string{}
+	for i := range list.Items {
+		setting := &list.Items[i]
+		existing[types.SettingName(setting.Name)] = setting
+		values[types.SettingName(setting.Name)] = setting.Value
+	}
+
+	level := 0
+	if setting, ok := existing[types.SettingNameSettingMigrationLevel]; ok {
+		if level, err = strconv.Atoi(setting.Value); err != nil {
+			return fmt.Errorf("invalid setting migration level %v", setting.Value)
+		}
+	}
+	if level >= len(migrations) {
+		return nil
+	}
+	newLevel, err := migrateSettingValues(migrations, level, values)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range values {
+		setting, ok := existing[name]
+		if !ok {
+			if _, err := s.CreateSetting(&longhorn.Setting{
+				ObjectMeta: metav1.ObjectMeta{Name: string(name)},
+				Setting:    types.Setting{Value: value},
+			}); err != nil {
+				return errors.Wrapf(err, "failed to create setting %v for the migration", name)
+			}
+			continue
+		}
+		if setting.Value == value {
+			continue
+		}
+		setting.Value = value
+		if _, err := s.UpdateSetting(setting); err != nil {
+			return errors.Wrapf(err, "failed to update setting %v for the migration", name)
+		}
+	}
+	for name := range existing {
+		if _, ok := values[name]; ok {
+			continue
+		}
+		if err := s.lhClient.LonghornV1alpha1().Settings(s.namespace).Delete(string(name), &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete the old setting %v for the migration", name)
+		}
+		logrus.Infof("Deleted the old setting %v", name)
+	}
+
+	levelValue := strconv.Itoa(newLevel)
+	if setting, ok := existing[types.SettingNameSettingMigrationLevel]; ok {
+		setting.Value = levelValue
+		_, err = s.UpdateSetting(setting)
+	} else {
+		_, err = s.CreateSetting(&longhorn.Setting{
+			ObjectMeta: metav1.ObjectMeta{Name: string(types.SettingNameSettingMigrationLevel)},
+			Setting:    types.Setting{Value: levelValue},
+		})
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to record the setting migration level")
+	}
+	return nil
+}
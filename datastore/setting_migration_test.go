@@ -0,0 +1,189 @@
+package datastore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+)
+
+func TestMigrateSettingValues(t *testing.T) {
+	assert := require.New(t)
+
+	// the chain exercising the kinds of migrations: rename, format change,
+	// split and merge
+	migrations := []settingMigration{
+		{
+			description: "rename a to b",
+			migrate:     renameSetting("a", "b"),
+		},
+		{
+			description: "seconds to duration",
+			migrate: transformSetting("b", "b", func(value string) (string, error) {
+				seconds, err := strconv.Atoi(value)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("%vs", seconds), nil
+			}),
+		},
+		{
+			description: "split c into c-key and c-value",
+			migrate: func(values map[types.SettingName]string) error {
+				value, ok := values["c"]
+				if !ok {
+					return nil
+				}
+				parts := strings.SplitN(value, "=", 2)
+				if len(parts) != 2 {
+					return fmt.Errorf("invalid value %v", value)
+				}
+				delete(values, "c")
+				values["c-key"] = parts[0]
+				values["c-value"] = parts[1]
+				return nil
+			},
+		},
+		{
+			description: "merge c-key and c-value into d",
+			migrate: func(values map[types.SettingName]string) error {
+				key, ok := values["c-key"]
+				if !ok {
+					return nil
+				}
+				values["d"] = key + ":" + values["c-value"]
+				delete(values, "c-key")
+				delete(values, "c-value")
+				return nil
+			},
+		},
+	}
+
+	testCases := map[string]struct {
+		level    int
+		values   map[types.SettingName]string
+		expected map[types.SettingName]string
+		err      bool
+	}{
+		"fresh install": {
+			values:   map[types.SettingName]string{},
+			expected: map[types.SettingName]string{},
+		},
+		"oldest version": {
+			values:   map[types.SettingName]string{"a": "30", "c": "k=v", "other": "x"},
+			expected: map[types.SettingName]string{"b": "30s", "d": "k:v", "other": "x"},
+		},
+		"version after the rename": {
+			level:    1,
+			values:   map[types.SettingName]string{"b": "30", "c-key": "k", "c-value": "v"},
+			expected: map[types.SettingName]string{"b": "30s", "d": "k:v"},
+		},
+		"up to date": {
+			level:    4,
+			values:   map[types.SettingName]string{"a": "30", "b": "10s"},
+			expected: map[types.SettingName]string{"a": "30", "b": "10s"},
+		},
+		"invalid old value": {
+			values: map[types.SettingName]string{"a": "thirty"},
+			err:    true,
+		},
+	}
+	for name, tc := range testCases {
+		level, err := migrateSettingValues(migrations, tc.level, tc.values)
+		if tc.err {
+			assert.NotNil(err, name)
+			continue
+		}
+		assert.Nil(err, name)
+		assert.Equal(len(migrations), level, name)
+		assert.Equal(tc.expected, tc.values, name)
+	}
+}
+
+func TestMigrateSettings(t *testing.T) {
+	assert := require.New(t)
+
+	const oldDiskEvictionLimit = "disk-eviction-concurrent-limit"
+	level := strconv.Itoa(len(settingMigrations))
+
+	testCases := map[string]struct {
+		settings []*longhorn.Setting
+		expected map[types.SettingName]string
+		removed  []types.SettingName
+	}{
+		"fresh install": {
+			expected: map[types.SettingName]string{
+				types.SettingNameConcurrentDiskEvictionLimit: "1",
+				types.SettingNameSettingMigrationLevel:       level,
+			},
+		},
+		"version before the disk eviction limit rename": {
+			settings: []*longhorn.Setting{
+				newTestSetting(oldDiskEvictionLimit, "3"),
+				newTestSetting(types.SettingNameBackupTarget, "s3://backupbucket@us-east-1/"),
+			},
+			expected: map[types.SettingName]string{
+				types.SettingNameConcurrentDiskEvictionLimit: "3",
+				types.SettingNameBackupTarget:                "s3://backupbucket@us-east-1/",
+				types.SettingNameSettingMigrationLevel:       level,
+			},
+			removed: []types.SettingName{oldDiskEvictionLimit},
+		},
+		"new setting already set": {
+			settings: []*longhorn.Setting{
+				newTestSetting(oldDiskEvictionLimit, "3"),
+				newTestSetting(types.SettingNameConcurrentDiskEvictionLimit, "5"),
+			},
+			expected: map[types.SettingName]string{
+				types.SettingNameConcurrentDiskEvictionLimit: "5",
+				types.SettingNameSettingMigrationLevel:       level,
+			},
+			removed: []types.SettingName{oldDiskEvictionLimit},
+		},
+		"already migrated": {
+			settings: []*longhorn.Setting{
+				newTestSetting(oldDiskEvictionLimit, "3"),
+				newTestSetting(types.SettingNameSettingMigrationLevel, level),
+			},
+			expected: map[types.SettingName]string{
+				oldDiskEvictionLimit:                         "3",
+				types.SettingNameConcurrentDiskEvictionLimit: "1",
+				types.SettingNameSettingMigrationLevel:       level,
+			},
+		},
+	}
+	for name, tc := range testCases {
+		lhClient := lhfake.NewSimpleClientset()
+		for _, setting := range tc.settings {
+			_, err := lhClient.LonghornV1alpha1().Settings(testNamespace).Create(setting)
+			assert.Nil(err, name)
+		}
+		ds := newTestDataStore(lhClient)
+		assert.Nil(ds.InitSettings(), name)
+		// run once per upgrade
+		assert.Nil(ds.InitSettings(), name)
+
+		settings, err := lhClient.LonghornV1alpha1().Settings(testNamespace).List(metav1.ListOptions{})
+		assert.Nil(err, name)
+		values := map[types.SettingName]string{}
+		for _, s := range settings.Items {
+			values[types.SettingName(s.Name)] = s.Value
+		}
+		for sName, value := range tc.expected {
+			assert.Equal(value, values[sName], "%v: %v", name, sName)
+		}
+		for _, sName := range tc.removed {
+			_, ok := values[sName]
+			assert.False(ok, "%v: %v", name, sName)
+		}
+	}
+}
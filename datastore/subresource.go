@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"k8s.io/client-go/discovery"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	// the CRDs without the status subresource are checked again after the
+	// interval, in case they have been upgraded while the manager is running
+	statusSubresourceRecheckInterval = time.Minute
+)
+
+// statusSubresources tracks which Longhorn CRDs have the status subresource
+// enabled. The CRDs created by the older deployments don't have it, and the
+// status has to be written along with the spec by update until they are
+// upgraded.
+type statusSubresources struct {
+	discovery discovery.DiscoveryInterface
+
+	lock      sync.Mutex
+	enabled   map[string]bool
+	checkedAt time.Time
+}
+
+func newStatusSubresources(discovery discovery.DiscoveryInterface) *statusSubresources {
+	return &statusSubresources{
+		discovery: discovery,
+		enabled:   map[string]bool{},
+	}
+}
+
+// isEnabled returns if the status subresource of the resource is enabled.
+// Once enabled, the subresource won't be disabled by the upgrade, so only the
+// negative result is rechecked.
+func (ss *statusSubresources) isEnabled(resource string) bool {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ss.enabled[resource] || time.Since(ss.checkedAt) < statusSubresourceRecheckInterval {
+		return ss.enabled[resource]
+	}
+
+	ss.checkedAt = time.Now()
+	resourceList, err := ss.discovery.ServerResourcesForGroupVersion(longhorn.SchemeGroupVersion.String())
+	if err != nil {
+		// the update would fail anyway if the API server is unreachable,
+		// so don't bother to fail the status update for it
+		logrus.Warnf("Fail to discover the status subresources of %v, fall back to update: %v",
+			longhorn.SchemeGroupVersion, err)
+		return false
+	}
+	for _, r := range resourceList.APIResources {
+		if strings.HasSuffix(r.Name, "/status") {
+			ss.enabled[strings.TrimSuffix(r.Name, "/status")] = true
+		}
+	}
+	return ss.enabled[resource]
+}
+
+// UpdateVolumeStatus updates the status of the volume. The changes of the
+// spec and the metadata are ignored unless the CRD hasn't enabled the status
+// subresource yet
+func (s *DataStore) UpdateVolumeStatus(v *longhorn.Volume) (*longhorn.Volume, error) {
+	if !s.statusSubresources.isEnabled("volumes") {
+		return s.UpdateVolume(v)
+	}
+	return s.lhClient.LonghornV1alpha1().Volumes(s.namespace).UpdateStatus(v)
+}
+
+// UpdateEngineStatus updates the status of the engine. The changes of the
+// spec and the metadata are ignored unless the CRD hasn't enabled the status
+// subresource yet
+func (s *DataStore) UpdateEngineStatus(e *longhorn.Engine) (*longhorn.Engine, error) {
+	if !s.statusSubresources.isEnabled("engines") {
+		return s.UpdateEngine(e)
+	}
+	return s.lhClient.LonghornV1alpha1().Engines(s.namespace).UpdateStatus(e)
+}
+
+// UpdateReplicaStatus updates the status of the replica. The changes of the
+// spec and the metadata are ignored unless the CRD hasn't enabled the status
+// subresource yet
+func (s *DataStore) UpdateReplicaStatus(r *longhorn.Replica) (*longhorn.Replica, error) {
+	if !s.statusSubresources.isEnabled("replicas") {
+		return s.UpdateReplica(r)
+	}
+	return s.lhClient.LonghornV1alpha1().Replicas(s.namespace).UpdateStatus(r)
+}
+
+// UpdateEngineImageStatus updates the status of the engine image. The
+// changes of the spec and the metadata are ignored unless the CRD hasn't
+// enabled the status subresource yet
+func (s *DataStore) UpdateEngineImageStatus(img *longhorn.EngineImage) (*longhorn.EngineImage, error) {
+	if !s.statusSubresources.isEnabled("engineimages") {
+		return s.UpdateEngineImage(img)
+	}
+	return s.lhClient.LonghornV1alpha1().EngineImages(s.namespace).UpdateStatus(img)
+}
+
+// UpdateNodeStatus updates the status of the node. The changes of the spec
+// and the metadata are ignored unless the CRD hasn't enabled the status
+// subresource yet
+func (s *DataStore) UpdateNodeStatus(node *longhorn.Node) (*longhorn.Node, error) {
+	if !s.statusSubresources.isEnabled("nodes") {
+		return s.UpdateNode(node)
+	}
+	return s.lhClient.LonghornV1alpha1().Nodes(s.namespace).UpdateStatus(node)
+}
+
+// UpdateSnapshotStatus updates the status of the snapshot. The changes of the
+// spec and the metadata are ignored unless the CRD hasn't enabled the status
+// subresource yet
+func (s *DataStore) UpdateSnapshotStatus(snap *longhorn.Snapshot) (*longhorn.Snapshot, error) {
+	if !s.statusSubresources.isEnabled("snapshots") {
+		return s.UpdateSnapshot(snap)
+	}
+	return s.lhClient.LonghornV1alpha1().Snapshots(s.namespace).UpdateStatus(snap)
+}
@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhscheme "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/scheme"
+)
+
+// volumeUpdateSubresources returns the subresources of the volume updates
+// issued to the client
+func volumeUpdateSubresources(lhClient *lhfake.Clientset) []string {
+	subresources := []string{}
+	for _, action := range lhClient.Actions() {
+		if action.GetVerb() == "update" && action.GetResource().Resource == "volumes" {
+			subresources = append(subresources, action.(k8stesting.UpdateAction).GetSubresource())
+		}
+	}
+	return subresources
+}
+
+// setLonghornResources sets the resources of the Longhorn API group served
+// by the discovery of the client
+func setLonghornResources(lhClient *lhfake.Clientset, resources ...string) {
+	apiResources := []metav1.APIResource{}
+	for _, r := range resources {
+		apiResources = append(apiResources, metav1.APIResource{Name: r})
+	}
+	lhClient.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: longhorn.SchemeGroupVersion.String(),
+			APIResources: apiResources,
+		},
+	}
+}
+
+func TestUpdateVolumeStatusSubresource(t *testing.T) {
+	assert := require.New(t)
+
+	lhClient := lhfake.NewSimpleClientset(newTestVolume())
+	setLonghornResources(lhClient, "volumes", "volumes/status", "engines")
+	ds := newTestDataStore(lhClient)
+
+	v, err := lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+
+	v.Spec.NodeID = testNode
+	v, err = ds.UpdateVolume(v)
+	assert.Nil(err)
+	v.Status.State = types.VolumeStateAttached
+	_, err = ds.UpdateVolumeStatus(v)
+	assert.Nil(err)
+	assert.Equal([]string{"", "status"}, volumeUpdateSubresources(lhClient))
+
+	assert.True(ds.statusSubresources.isEnabled("volumes"))
+	assert.False(ds.statusSubresources.isEnabled("engines"))
+}
+
+func TestUpdateVolumeStatusWithoutSubresource(t *testing.T) {
+	assert := require.New(t)
+
+	// the CRDs created before the status subresource was enabled
+	lhClient := lhfake.NewSimpleClientset(newTestVolume())
+	setLonghornResources(lhClient, "volumes")
+	ds := newTestDataStore(lhClient)
+
+	v, err := lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+
+	// the status is written along with the spec by update
+	v.Status.State = types.VolumeStateAttached
+	_, err = ds.UpdateVolumeStatus(v)
+	assert.Nil(err)
+	assert.Equal([]string{""}, volumeUpdateSubresources(lhClient))
+
+	v, err = lhClient.LonghornV1alpha1().Volumes(testNamespace).Get(testVolume, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal(types.VolumeStateAttached, v.Status.State)
+}
+
+// newEngineStatusSubresourceClient returns the client whose update of the
+// engine leaves the status untouched, as the API server does once the status
+// subresource is enabled. The status is only written through the subresource.
+func newEngineStatusSubresourceClient(engine *longhorn.Engine) *lhfake.Clientset {
+	lhClient := lhfake.NewSimpleClientset()
+	setLonghornResources(lhClient, "engines", "engines/status")
+
+	tracker := k8stesting.NewObjectTracker(lhscheme.Scheme, lhscheme.Codecs.UniversalDecoder())
+	if err := tracker.Add(engine); err != nil {
+		panic(err)
+	}
+	react := k8stesting.ObjectReaction(tracker)
+	lhClient.PrependReactor("*", "engines", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if update, ok := action.(k8stesting.UpdateAction); ok && update.GetSubresource() == "" {
+			e := update.GetObject().(*longhorn.Engine)
+			existing, err := tracker.Get(update.GetResource(), update.GetNamespace(), e.Name)
+			if err != nil {
+				return true, nil, err
+			}
+			e.Status = existing.(*longhorn.Engine).Status
+		}
+		return react(action)
+	})
+	return lhClient
+}
+
+func TestResetEngineMonitoringStatusSubresource(t *testing.T) {
+	assert := require.New(t)
+
+	engine := &longhorn.Engine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-engine",
+			Namespace: testNamespace,
+		},
+		Spec: types.EngineSpec{
+			InstanceSpec: types.InstanceSpec{
+				VolumeName: testVolume,
+			},
+		},
+		Status: types.EngineStatus{
+			Endpoint:       "/dev/longhorn/" + testVolume,
+			ReplicaModeMap: map[string]types.ReplicaMode{"test-replica": types.ReplicaModeRW},
+		},
+	}
+	lhClient := newEngineStatusSubresourceClient(engine)
+	ds := newTestDataStore(lhClient)
+
+	e, err := lhClient.LonghornV1alpha1().Engines(testNamespace).Get(engine.Name, metav1.GetOptions{})
+	assert.Nil(err)
+	_, err = ds.ResetEngineMonitoringStatus(e)
+	assert.Nil(err)
+
+	e, err = lhClient.LonghornV1alpha1().Engines(testNamespace).Get(engine.Name, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal("", e.Status.Endpoint)
+	assert.Len(e.Status.ReplicaModeMap, 0)
+}
@@ -26,6 +26,7 @@ remove_crd_instances() {
   remove_and_wait replicas.longhorn.rancher.io
   remove_and_wait engineimages.longhorn.rancher.io
   remove_and_wait settings.longhorn.rancher.io
+  remove_and_wait snapshots.longhorn.rancher.io
   # do this one last; manager crashes
   remove_and_wait nodes.longhorn.rancher.io
 }
@@ -38,6 +39,8 @@ remove_driver() {
   kubectl -n ${NAMESPACE} delete service/csi-attacher
   kubectl -n ${NAMESPACE} delete statefulset.apps/csi-provisioner
   kubectl -n ${NAMESPACE} delete service/csi-provisioner
+  kubectl -n ${NAMESPACE} delete statefulset.apps/csi-snapshotter
+  kubectl -n ${NAMESPACE} delete service/csi-snapshotter
   kubectl -n ${NAMESPACE} delete daemonset.apps/longhorn-flexvolume-driver
 }
 
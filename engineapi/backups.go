@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 
+	"k8s.io/apimachinery/pkg/labels"
+
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 )
@@ -46,7 +49,8 @@ func (b *BackupTarget) ExecuteEngineBinary(args ...string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return util.Execute(b.LonghornEngineBinary(), args...)
+	env := util.GetBackupProxyEnv(b.URL, b.Credential)
+	return util.ExecuteWithEnv(env, b.LonghornEngineBinary(), args...)
 }
 
 func parseBackup(v interface{}) (*Backup, error) {
@@ -167,6 +171,115 @@ func (b *BackupTarget) DeleteBackup(backupURL string) error {
 	return nil
 }
 
+// DeleteVolume removes the backup volume with all its backups from the
+// backupstore
+func (b *BackupTarget) DeleteVolume(volumeName string) error {
+	_, err := b.ExecuteEngineBinary("backup", "rm", "--volume", volumeName, b.URL)
+	if err != nil {
+		if strings.Contains(err.Error(), "msg=\"cannot find ") {
+			logrus.Warnf("delete: could not find the backup volume: '%s'", volumeName)
+			return nil
+		}
+		return errors.Wrapf(err, "error deleting backup volume")
+	}
+	return nil
+}
+
+// BackupFilter selects the backups by the labels and the creation time. The
+// zero value selects everything.
+type BackupFilter struct {
+	Selector      labels.Selector
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+func (f BackupFilter) Match(b *Backup) bool {
+	if f.Selector != nil && !f.Selector.Matches(labels.Set(b.Labels)) {
+		return false
+	}
+	if f.CreatedAfter.IsZero() && f.CreatedBefore.IsZero() {
+		return true
+	}
+	created, err := util.ParseTime(b.Created)
+	if err != nil {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && !created.After(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !created.Before(f.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+func FilterBackups(backups []*Backup, f BackupFilter) []*Backup {
+	result := []*Backup{}
+	for _, b := range backups {
+		if f.Match(b) {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
 func GetBackupURL(backupTarget, backupName, volName string) string {
 	return fmt.Sprintf("%s?backup=%s&volume=%s", backupTarget, backupName, volName)
 }
+
+type BackupTargetErrorType string
+
+const (
+	BackupTargetErrorTypeDNSFailure        = BackupTargetErrorType("DNSFailure")
+	BackupTargetErrorTypeAccessDenied      = BackupTargetErrorType("AccessDenied")
+	BackupTargetErrorTypeBucketMissing     = BackupTargetErrorType("BucketMissing")
+	BackupTargetErrorTypeTLSError          = BackupTargetErrorType("TLSError")
+	BackupTargetErrorTypeConnectionFailure = BackupTargetErrorType("ConnectionFailure")
+	BackupTargetErrorTypeCredentialMissing = BackupTargetErrorType("CredentialMissing")
+	BackupTargetErrorTypeCredentialInvalid = BackupTargetErrorType("CredentialInvalid")
+	BackupTargetErrorTypeRegionMismatch    = BackupTargetErrorType("RegionMismatch")
+	BackupTargetErrorTypeUnknown           = BackupTargetErrorType("Unknown")
+)
+
+// backupTargetErrorPatterns are matched in order against the output of the
+// engine binary, which carries the errors of the S3 SDK or the NFS mount
+var backupTargetErrorPatterns = []struct {
+	errorType BackupTargetErrorType
+	patterns  []string
+}{
+	{BackupTargetErrorTypeTLSError, []string{"x509:", "tls:", "certificate"}},
+	{BackupTargetErrorTypeRegionMismatch, []string{"AuthorizationHeaderMalformed", "PermanentRedirect", "IllegalLocationConstraintException"}},
+	{BackupTargetErrorTypeDNSFailure, []string{"no such host", "server misbehaving", "Temporary failure in name resolution"}},
+	{BackupTargetErrorTypeAccessDenied, []string{"AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "Forbidden", "access denied", "permission denied"}},
+	{BackupTargetErrorTypeBucketMissing, []string{"NoSuchBucket", "no such file or directory"}},
+	{BackupTargetErrorTypeConnectionFailure, []string{"connection refused", "i/o timeout", "no route to host", "connection timed out"}},
+}
+
+// ClassifyBackupTargetError categorizes the failure of accessing the backup
+// target, so the user can tell a typo in the endpoint from a wrong credential
+func ClassifyBackupTargetError(err error) BackupTargetErrorType {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	for _, p := range backupTargetErrorPatterns {
+		for _, pattern := range p.patterns {
+			if strings.Contains(msg, pattern) {
+				return p.errorType
+			}
+		}
+	}
+	return BackupTargetErrorTypeUnknown
+}
+
+// Test probes the backup target by listing the root of the backupstore.
+// An empty backupstore is not an error.
+func (b *BackupTarget) Test() error {
+	if _, err := b.ExecuteEngineBinary("backup", "ls", "--volume-only", b.URL); err != nil {
+		if strings.Contains(err.Error(), "msg=\"cannot find ") {
+			return nil
+		}
+		return errors.Wrapf(err, "error accessing backup target %v", b.URL)
+	}
+	return nil
+}
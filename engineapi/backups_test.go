@@ -1,9 +1,13 @@
 package engineapi
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/labels"
 )
 
 const oneBackupText = `
@@ -82,3 +86,58 @@ func TestParseBackupsList(t *testing.T) {
 	assert.NotNil(snapshots["volume-snap-snap1.img"])
 	assert.NotNil(snapshots["volume-snap-snap4.img"])
 }
+
+func TestClassifyBackupTargetError(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := map[string]BackupTargetErrorType{
+		"dial tcp: lookup s3.us-est-1.amazonaws.com on 10.43.0.10:53: no such host":                        BackupTargetErrorTypeDNSFailure,
+		"AccessDenied: Access Denied\n\tstatus code: 403":                                                  BackupTargetErrorTypeAccessDenied,
+		"InvalidAccessKeyId: The AWS Access Key Id you provided does not exist in our records.":            BackupTargetErrorTypeAccessDenied,
+		"NoSuchBucket: The specified bucket does not exist":                                                BackupTargetErrorTypeBucketMissing,
+		"Get https://minio:9000/backupbucket: x509: certificate signed by unknown authority":               BackupTargetErrorTypeTLSError,
+		"dial tcp 10.0.0.1:9000: connect: connection refused":                                              BackupTargetErrorTypeConnectionFailure,
+		"mount.nfs: access denied by server while mounting longhorn-test-nfs-svc.default:/opt/backupstore": BackupTargetErrorTypeAccessDenied,
+		"AuthorizationHeaderMalformed: the region 'us-east-1' is wrong; expecting 'eu-west-1'":             BackupTargetErrorTypeRegionMismatch,
+		"unexpected error": BackupTargetErrorTypeUnknown,
+	}
+	for msg, errorType := range testCases {
+		assert.Equal(errorType, ClassifyBackupTargetError(errors.New(msg)), msg)
+	}
+	assert.Equal(BackupTargetErrorType(""), ClassifyBackupTargetError(nil))
+}
+
+func TestFilterBackups(t *testing.T) {
+	assert := require.New(t)
+
+	backups := []*Backup{
+		{Name: "backup-1", Created: "2019-01-01T00:00:00Z", Labels: map[string]string{"app": "mysql", "RecurringJob": "daily"}},
+		{Name: "backup-2", Created: "2019-01-02T00:00:00Z", Labels: map[string]string{"app": "mysql"}},
+		{Name: "backup-3", Created: "2019-01-03T00:00:00Z", Labels: map[string]string{"app": "nginx"}},
+		{Name: "backup-4", Created: "", Labels: map[string]string{"app": "mysql"}},
+	}
+	names := func(backups []*Backup) []string {
+		result := []string{}
+		for _, b := range backups {
+			result = append(result, b.Name)
+		}
+		return result
+	}
+
+	assert.Equal([]string{"backup-1", "backup-2", "backup-3", "backup-4"}, names(FilterBackups(backups, BackupFilter{})))
+
+	selector, err := labels.Parse("app=mysql,RecurringJob!=daily")
+	assert.Nil(err)
+	assert.Equal([]string{"backup-2", "backup-4"}, names(FilterBackups(backups, BackupFilter{Selector: selector})))
+
+	day2, err := time.Parse(time.RFC3339, "2019-01-02T00:00:00Z")
+	assert.Nil(err)
+	// the bounds are exclusive and the backups without a valid creation time
+	// are left out
+	assert.Equal([]string{"backup-3"}, names(FilterBackups(backups, BackupFilter{CreatedAfter: day2})))
+	assert.Equal([]string{"backup-1"}, names(FilterBackups(backups, BackupFilter{CreatedBefore: day2})))
+	assert.Equal([]string{"backup-2"}, names(FilterBackups(backups, BackupFilter{
+		CreatedAfter:  day2.Add(-time.Hour),
+		CreatedBefore: day2.Add(time.Hour),
+	})))
+}
@@ -3,7 +3,9 @@ package engineapi
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +22,7 @@ type Engine struct {
 	name  string
 	image string
 	ip    string
+	port  int
 	cURL  string
 	lURL  string
 }
@@ -36,7 +39,8 @@ func (c *EngineCollection) NewEngineClient(request *EngineClientRequest) (Engine
 		name:  request.VolumeName,
 		image: request.EngineImage,
 		ip:    request.IP,
-		cURL:  GetControllerDefaultURL(request.IP),
+		port:  request.Port,
+		cURL:  GetControllerURL(request.IP, request.Port),
 		lURL:  GetEngineLauncherDefaultURL(request.IP),
 	}, nil
 }
@@ -63,6 +67,30 @@ func (e *Engine) ExecuteEngineBinaryWithTimeout(timeout time.Duration, args ...s
 	return util.ExecuteWithTimeout(timeout, e.LonghornEngineBinary(), args...)
 }
 
+func (e *Engine) ExecuteEngineBinaryWithTimeoutAndEnv(timeout time.Duration, env []string, args ...string) (string, error) {
+	args = append([]string{"--url", e.cURL}, args...)
+	return util.ExecuteWithTimeoutAndEnv(timeout, env, e.LonghornEngineBinary(), args...)
+}
+
+// getAddressHosts returns the hosts of the engine and its replicas
+func (e *Engine) getAddressHosts() ([]string, error) {
+	replicas, err := e.ReplicaList()
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{e.cURL}
+	for addr := range replicas {
+		addrs = append(addrs, addr)
+	}
+	hosts := []string{}
+	for _, addr := range addrs {
+		if u, err := url.Parse(addr); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return hosts, nil
+}
+
 func (e *Engine) ExecuteEngineLauncherBinary(args ...string) (string, error) {
 	args = append([]string{"--url", e.lURL}, args...)
 	return util.Execute(e.LonghornEngineLauncherBinary(), args...)
@@ -107,11 +135,19 @@ func (e *Engine) ReplicaList() (map[string]*Replica, error) {
 	return replicas, nil
 }
 
-func (e *Engine) ReplicaAdd(url string) error {
+func (e *Engine) ReplicaAdd(url, sourceURL string) error {
 	if err := ValidateReplicaURL(url); err != nil {
 		return err
 	}
-	if _, err := e.ExecuteEngineBinaryWithTimeout(rebuildTimeout, "add", url); err != nil {
+	args := []string{"add"}
+	if sourceURL != "" {
+		if err := ValidateReplicaURL(sourceURL); err != nil {
+			return err
+		}
+		args = append(args, "--source", sourceURL)
+	}
+	args = append(args, url)
+	if _, err := e.ExecuteEngineBinaryWithTimeout(rebuildTimeout, args...); err != nil {
 		return errors.Wrapf(err, "failed to add replica address='%s' to controller '%s'", url, e.name)
 	}
 	return nil
@@ -127,7 +163,54 @@ func (e *Engine) ReplicaRemove(url string) error {
 	return nil
 }
 
+func (e *Engine) ReplicaInfo(url string) (*ReplicaInfo, error) {
+	if err := ValidateReplicaURL(url); err != nil {
+		return nil, err
+	}
+	output, err := e.ExecuteEngineBinary("replica-info", url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get replica info of address='%s' from controller '%s'", url, e.name)
+	}
+	info := &ReplicaInfo{}
+	if err := json.Unmarshal([]byte(output), info); err != nil {
+		return nil, errors.Wrapf(err, "error parsing replica info of address='%s'", url)
+	}
+	return info, nil
+}
+
+// GetReplicaFileStats summarizes the files of the replica. All the files
+// except the volume head are counted as snapshots.
+func GetReplicaFileStats(info *ReplicaInfo) (*types.ReplicaFileStats, error) {
+	stats := &types.ReplicaFileStats{}
+	for name, disk := range info.Disks {
+		size, err := strconv.ParseInt(disk.Size, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid size %v of replica file %v", disk.Size, name)
+		}
+		stats.TotalSize += size
+		if name == info.Head {
+			stats.HeadSize = size
+			continue
+		}
+		stats.SnapshotCount++
+		if size > stats.LargestSnapshotSize {
+			stats.LargestSnapshot = name
+			stats.LargestSnapshotSize = size
+		}
+	}
+	return stats, nil
+}
+
+// isProcess returns true if the engine is a process in the instance manager,
+// which is started without the launcher
+func (e *Engine) isProcess() bool {
+	return e.port != 0
+}
+
 func (e *Engine) Endpoint() string {
+	if e.isProcess() {
+		return e.processEndpoint()
+	}
 	info, err := e.launcherInfo()
 	if err != nil {
 		logrus.Warn("Fail to get frontend info: ", err)
@@ -141,11 +224,28 @@ func (e *Engine) Endpoint() string {
 		return "iscsi://" + e.ip + ":" + DefaultISCSIPort + "/" + info.Endpoint + "/" + DefaultISCSILUN
 	case string(FrontendBlockDev):
 		return info.Endpoint
+	case "":
+		// the engine started with the frontend disabled
+		return ""
 	}
 	logrus.Errorf("Unknown frontend %v", info.Frontend)
 	return ""
 }
 
+// processEndpoint returns the endpoint of the frontend served by the engine
+// process, which is the block device or the iSCSI target
+func (e *Engine) processEndpoint() string {
+	info, err := e.info()
+	if err != nil {
+		logrus.Warn("Fail to get frontend info: ", err)
+		return ""
+	}
+	if strings.HasPrefix(info.Endpoint, "iqn.") {
+		return "iscsi://" + e.ip + ":" + DefaultISCSIPort + "/" + info.Endpoint + "/" + DefaultISCSILUN
+	}
+	return info.Endpoint
+}
+
 func (e *Engine) launcherInfo() (*LauncherVolumeInfo, error) {
 	output, err := e.ExecuteEngineLauncherBinary("info")
 	if err != nil {
@@ -181,6 +281,9 @@ func (e *Engine) BackupRestore(backup string) error {
 }
 
 func (e *Engine) Upgrade(binary string, replicaURLs []string) error {
+	if e.isProcess() {
+		return fmt.Errorf("cannot live upgrade engine %v running in the instance manager", e.name)
+	}
 	args := []string{
 		"upgrade", "--longhorn-binary", binary,
 	}
@@ -215,3 +318,15 @@ func (e *Engine) Version(clientOnly bool) (*EngineVersion, error) {
 	}
 	return version, nil
 }
+
+func (e *Engine) QoSSet(qos *types.VolumeQoS) error {
+	if _, err := e.ExecuteEngineBinary("qos", "set",
+		"--read-iops", strconv.Itoa(qos.ReadIOPS),
+		"--write-iops", strconv.Itoa(qos.WriteIOPS),
+		"--read-bandwidth", strconv.Itoa(qos.ReadBandwidth),
+		"--write-bandwidth", strconv.Itoa(qos.WriteBandwidth)); err != nil {
+		return errors.Wrapf(err, "failed to set QoS of controller '%s'", e.name)
+	}
+	logrus.Debugf("QoS %+v set for volume %v", *qos, e.Name())
+	return nil
+}
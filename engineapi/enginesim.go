@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
 )
 
 type EngineSimulatorRequest struct {
@@ -39,10 +40,11 @@ func (c *EngineSimulatorCollection) CreateEngineSimulator(request *EngineSimulat
 		controllerAddr: request.ControllerAddr,
 		running:        true,
 		replicas:       map[string]*Replica{},
+		snapshots:      map[string]*Snapshot{},
 		mutex:          &sync.RWMutex{},
 	}
 	for _, addr := range request.ReplicaAddrs {
-		if err := s.ReplicaAdd(addr); err != nil {
+		if err := s.ReplicaAdd(addr, ""); err != nil {
 			return err
 		}
 	}
@@ -87,7 +89,11 @@ type EngineSimulator struct {
 	controllerAddr string
 	running        bool
 	replicas       map[string]*Replica
-	mutex          *sync.RWMutex
+	snapshots      map[string]*Snapshot
+	// head is the parent of the volume head
+	head  string
+	qos   types.VolumeQoS
+	mutex *sync.RWMutex
 }
 
 func (e *EngineSimulator) Name() string {
@@ -116,10 +122,17 @@ func (e *EngineSimulator) ReplicaList() (map[string]*Replica, error) {
 	return ret, nil
 }
 
-func (e *EngineSimulator) ReplicaAdd(url string) error {
+func (e *EngineSimulator) ReplicaAdd(url, sourceURL string) error {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 
+	if sourceURL != "" {
+		source := e.replicas[sourceURL]
+		if source == nil || source.Mode != types.ReplicaModeRW {
+			return fmt.Errorf("rebuild source %v is not a healthy replica", sourceURL)
+		}
+	}
+
 	for name, replica := range e.replicas {
 		if replica.Mode == types.ReplicaModeERR {
 			return fmt.Errorf("replica %v is in ERR mode, cannot add new replica", name)
@@ -146,6 +159,10 @@ func (e *EngineSimulator) ReplicaRemove(addr string) error {
 	return nil
 }
 
+func (e *EngineSimulator) ReplicaInfo(url string) (*ReplicaInfo, error) {
+	return nil, fmt.Errorf("Not implemented")
+}
+
 func (e *EngineSimulator) SimulateStopReplica(addr string) error {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
@@ -158,31 +175,114 @@ func (e *EngineSimulator) SimulateStopReplica(addr string) error {
 }
 
 func (e *EngineSimulator) SnapshotCreate(name string, labels map[string]string) (string, error) {
-	return "", fmt.Errorf("Not implemented")
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if name == "" {
+		name = util.UUID()
+	}
+	if e.snapshots[name] != nil {
+		return "", fmt.Errorf("duplicate snapshot %v already exists", name)
+	}
+	snapshot := &Snapshot{
+		Name:        name,
+		Parent:      e.head,
+		Children:    map[string]struct{}{},
+		UserCreated: true,
+		Created:     util.Now(),
+		Size:        "0",
+		Labels:      labels,
+	}
+	if parent := e.snapshots[e.head]; parent != nil {
+		parent.Children[name] = struct{}{}
+	}
+	e.snapshots[name] = snapshot
+	e.head = name
+	return name, nil
+}
+
+func copySnapshot(snapshot *Snapshot) *Snapshot {
+	copied := *snapshot
+	copied.Children = map[string]struct{}{}
+	for child := range snapshot.Children {
+		copied.Children[child] = struct{}{}
+	}
+	return &copied
 }
 
 func (e *EngineSimulator) SnapshotList() (map[string]*Snapshot, error) {
-	return nil, fmt.Errorf("Not implemented")
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	ret := map[string]*Snapshot{}
+	for name, snapshot := range e.snapshots {
+		ret[name] = copySnapshot(snapshot)
+	}
+	return ret, nil
 }
 
 func (e *EngineSimulator) SnapshotGet(name string) (*Snapshot, error) {
-	return nil, fmt.Errorf("Not implemented")
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if e.snapshots[name] == nil {
+		return nil, nil
+	}
+	return copySnapshot(e.snapshots[name]), nil
 }
 
 func (e *EngineSimulator) SnapshotDelete(name string) error {
-	return fmt.Errorf("Not implemented")
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.snapshots[name] == nil {
+		return fmt.Errorf("unable to find snapshot %v", name)
+	}
+	e.snapshots[name].Removed = true
+	return nil
 }
 
 func (e *EngineSimulator) SnapshotRevert(name string) error {
-	return fmt.Errorf("Not implemented")
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.snapshots[name] == nil {
+		return fmt.Errorf("unable to find snapshot %v", name)
+	}
+	if e.snapshots[name].Removed {
+		return fmt.Errorf("cannot revert to removed snapshot %v", name)
+	}
+	e.head = name
+	return nil
 }
 
+// SnapshotPurge removes the snapshots marked as removed, except the parent
+// of the volume head, which cannot be coalesced as the engine does
 func (e *EngineSimulator) SnapshotPurge() error {
-	return fmt.Errorf("Not implemented")
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for name, snapshot := range e.snapshots {
+		if !snapshot.Removed || name == e.head {
+			continue
+		}
+		parent := e.snapshots[snapshot.Parent]
+		if parent != nil {
+			delete(parent.Children, name)
+		}
+		for child := range snapshot.Children {
+			e.snapshots[child].Parent = snapshot.Parent
+			if parent != nil {
+				parent.Children[child] = struct{}{}
+			}
+		}
+		delete(e.snapshots, name)
+	}
+	return nil
 }
 
-func (e *EngineSimulator) SnapshotBackup(snapName, backupTarget string, labels map[string]string, credential map[string]string) error {
-	return fmt.Errorf("Not implemented")
+func (e *EngineSimulator) SnapshotBackup(snapName, backupTarget string, labels map[string]string, credential map[string]string) (string, error) {
+	return "", fmt.Errorf("Not implemented")
 }
 
 func (e *EngineSimulator) Upgrade(binary string, replicaURLs []string) error {
@@ -192,3 +292,18 @@ func (e *EngineSimulator) Upgrade(binary string, replicaURLs []string) error {
 func (e *EngineSimulator) Version(clientOnly bool) (*EngineVersion, error) {
 	return nil, fmt.Errorf("Not implemented")
 }
+
+func (e *EngineSimulator) QoSSet(qos *types.VolumeQoS) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.qos = *qos
+	return nil
+}
+
+func (e *EngineSimulator) QoSGet() types.VolumeQoS {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	return e.qos
+}
@@ -66,7 +66,11 @@ func (s *TestSuite) TestBasic(c *C) {
 	c.Assert(replicas, HasLen, 1)
 	c.Assert(replicas[Replica1Addr].Mode, Equals, types.ReplicaModeRW)
 
-	err = sim.ReplicaAdd(Replica3Addr)
+	err = sim.ReplicaAdd(Replica2Addr, Replica3Addr)
+	c.Assert(err, ErrorMatches, "rebuild source .* is not a healthy replica")
+
+	err = sim.ReplicaAdd(Replica3Addr, Replica1Addr)
+	c.Assert(err, IsNil)
 	replicas, err = sim.ReplicaList()
 	c.Assert(err, IsNil)
 	c.Assert(replicas, HasLen, 2)
@@ -76,3 +80,25 @@ func (s *TestSuite) TestBasic(c *C) {
 	err = coll.DeleteEngineSimulator(VolumeName)
 	c.Assert(err, IsNil)
 }
+
+func (s *TestSuite) TestReplicaFileStats(c *C) {
+	info := &ReplicaInfo{
+		Head: "volume-head-002.img",
+		Disks: map[string]*ReplicaDiskInfo{
+			"volume-head-002.img": {Name: "volume-head-002.img", Size: "4096"},
+			"volume-snap-s1.img":  {Name: "volume-snap-s1.img", Size: "1048576"},
+			"volume-snap-s2.img":  {Name: "volume-snap-s2.img", Size: "8192", Removed: true},
+		},
+	}
+	stats, err := GetReplicaFileStats(info)
+	c.Assert(err, IsNil)
+	c.Assert(stats.SnapshotCount, Equals, 2)
+	c.Assert(stats.HeadSize, Equals, int64(4096))
+	c.Assert(stats.TotalSize, Equals, int64(4096+1048576+8192))
+	c.Assert(stats.LargestSnapshot, Equals, "volume-snap-s1.img")
+	c.Assert(stats.LargestSnapshotSize, Equals, int64(1048576))
+
+	info.Disks["volume-snap-s3.img"] = &ReplicaDiskInfo{Name: "volume-snap-s3.img", Size: "invalid"}
+	_, err = GetReplicaFileStats(info)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,226 @@
+// Package imrpc is the gRPC process management API of the instance manager,
+// as described by imrpc.proto. The messages are marshaled by the proto
+// package through their struct tags, so the tags must be kept in sync with
+// the field numbers in imrpc.proto.
+package imrpc
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+type ProcessSpec struct {
+	Name      string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Binary    string   `protobuf:"bytes,2,opt,name=binary,proto3" json:"binary,omitempty"`
+	Args      []string `protobuf:"bytes,3,rep,name=args,proto3" json:"args,omitempty"`
+	PortCount int32    `protobuf:"varint,4,opt,name=port_count,json=portCount,proto3" json:"port_count,omitempty"`
+	PortArgs  []string `protobuf:"bytes,5,rep,name=port_args,json=portArgs,proto3" json:"port_args,omitempty"`
+}
+
+func (m *ProcessSpec) Reset()         { *m = ProcessSpec{} }
+func (m *ProcessSpec) String() string { return proto.CompactTextString(m) }
+func (*ProcessSpec) ProtoMessage()    {}
+
+type ProcessStatus struct {
+	State     string `protobuf:"bytes,1,opt,name=state,proto3" json:"state,omitempty"`
+	ErrorMsg  string `protobuf:"bytes,2,opt,name=error_msg,json=errorMsg,proto3" json:"error_msg,omitempty"`
+	PortStart int32  `protobuf:"varint,3,opt,name=port_start,json=portStart,proto3" json:"port_start,omitempty"`
+	PortEnd   int32  `protobuf:"varint,4,opt,name=port_end,json=portEnd,proto3" json:"port_end,omitempty"`
+}
+
+func (m *ProcessStatus) Reset()         { *m = ProcessStatus{} }
+func (m *ProcessStatus) String() string { return proto.CompactTextString(m) }
+func (*ProcessStatus) ProtoMessage()    {}
+
+type ProcessCreateRequest struct {
+	Spec *ProcessSpec `protobuf:"bytes,1,opt,name=spec,proto3" json:"spec,omitempty"`
+}
+
+func (m *ProcessCreateRequest) Reset()         { *m = ProcessCreateRequest{} }
+func (m *ProcessCreateRequest) String() string { return proto.CompactTextString(m) }
+func (*ProcessCreateRequest) ProtoMessage()    {}
+
+type ProcessDeleteRequest struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+}
+
+func (m *ProcessDeleteRequest) Reset()         { *m = ProcessDeleteRequest{} }
+func (m *ProcessDeleteRequest) String() string { return proto.CompactTextString(m) }
+func (*ProcessDeleteRequest) ProtoMessage()    {}
+
+type ProcessGetRequest struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+}
+
+func (m *ProcessGetRequest) Reset()         { *m = ProcessGetRequest{} }
+func (m *ProcessGetRequest) String() string { return proto.CompactTextString(m) }
+func (*ProcessGetRequest) ProtoMessage()    {}
+
+type ProcessResponse struct {
+	Spec   *ProcessSpec   `protobuf:"bytes,1,opt,name=spec,proto3" json:"spec,omitempty"`
+	Status *ProcessStatus `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+}
+
+func (m *ProcessResponse) Reset()         { *m = ProcessResponse{} }
+func (m *ProcessResponse) String() string { return proto.CompactTextString(m) }
+func (*ProcessResponse) ProtoMessage()    {}
+
+type ProcessListRequest struct {
+}
+
+func (m *ProcessListRequest) Reset()         { *m = ProcessListRequest{} }
+func (m *ProcessListRequest) String() string { return proto.CompactTextString(m) }
+func (*ProcessListRequest) ProtoMessage()    {}
+
+type ProcessListResponse struct {
+	Processes map[string]*ProcessResponse `protobuf:"bytes,1,rep,name=processes,proto3" json:"processes,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *ProcessListResponse) Reset()         { *m = ProcessListResponse{} }
+func (m *ProcessListResponse) String() string { return proto.CompactTextString(m) }
+func (*ProcessListResponse) ProtoMessage()    {}
+
+type ProcessLogRequest struct {
+	Name      string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	TailLines int32  `protobuf:"varint,2,opt,name=tail_lines,json=tailLines,proto3" json:"tail_lines,omitempty"`
+}
+
+func (m *ProcessLogRequest) Reset()         { *m = ProcessLogRequest{} }
+func (m *ProcessLogRequest) String() string { return proto.CompactTextString(m) }
+func (*ProcessLogRequest) ProtoMessage()    {}
+
+type ProcessLogResponse struct {
+	Log string `protobuf:"bytes,1,opt,name=log,proto3" json:"log,omitempty"`
+}
+
+func (m *ProcessLogResponse) Reset()         { *m = ProcessLogResponse{} }
+func (m *ProcessLogResponse) String() string { return proto.CompactTextString(m) }
+func (*ProcessLogResponse) ProtoMessage()    {}
+
+const serviceName = "imrpc.ProcessManagerService"
+
+type ProcessManagerServiceClient interface {
+	ProcessCreate(ctx context.Context, in *ProcessCreateRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	ProcessDelete(ctx context.Context, in *ProcessDeleteRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	ProcessGet(ctx context.Context, in *ProcessGetRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	ProcessList(ctx context.Context, in *ProcessListRequest, opts ...grpc.CallOption) (*ProcessListResponse, error)
+	ProcessLog(ctx context.Context, in *ProcessLogRequest, opts ...grpc.CallOption) (*ProcessLogResponse, error)
+}
+
+type processManagerServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewProcessManagerServiceClient(cc *grpc.ClientConn) ProcessManagerServiceClient {
+	return &processManagerServiceClient{cc}
+}
+
+func (c *processManagerServiceClient) ProcessCreate(ctx context.Context, in *ProcessCreateRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	if err := grpc.Invoke(ctx, "/"+serviceName+"/ProcessCreate", in, out, c.cc, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *processManagerServiceClient) ProcessDelete(ctx context.Context, in *ProcessDeleteRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	if err := grpc.Invoke(ctx, "/"+serviceName+"/ProcessDelete", in, out, c.cc, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *processManagerServiceClient) ProcessGet(ctx context.Context, in *ProcessGetRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	if err := grpc.Invoke(ctx, "/"+serviceName+"/ProcessGet", in, out, c.cc, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *processManagerServiceClient) ProcessList(ctx context.Context, in *ProcessListRequest, opts ...grpc.CallOption) (*ProcessListResponse, error) {
+	out := new(ProcessListResponse)
+	if err := grpc.Invoke(ctx, "/"+serviceName+"/ProcessList", in, out, c.cc, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *processManagerServiceClient) ProcessLog(ctx context.Context, in *ProcessLogRequest, opts ...grpc.CallOption) (*ProcessLogResponse, error) {
+	out := new(ProcessLogResponse)
+	if err := grpc.Invoke(ctx, "/"+serviceName+"/ProcessLog", in, out, c.cc, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ProcessManagerServiceServer is implemented by the instance manager. It's
+// registered here for the tests of the client.
+type ProcessManagerServiceServer interface {
+	ProcessCreate(context.Context, *ProcessCreateRequest) (*ProcessResponse, error)
+	ProcessDelete(context.Context, *ProcessDeleteRequest) (*ProcessResponse, error)
+	ProcessGet(context.Context, *ProcessGetRequest) (*ProcessResponse, error)
+	ProcessList(context.Context, *ProcessListRequest) (*ProcessListResponse, error)
+	ProcessLog(context.Context, *ProcessLogRequest) (*ProcessLogResponse, error)
+}
+
+func RegisterProcessManagerServiceServer(s *grpc.Server, srv ProcessManagerServiceServer) {
+	s.RegisterService(&processManagerServiceDesc, srv)
+}
+
+// unaryHandler returns the gRPC handler of the method, which decodes the
+// request into newRequest() and passes it to call
+func unaryHandler(method string, newRequest func() interface{}, call func(srv ProcessManagerServiceServer, ctx context.Context, req interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := newRequest()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(ProcessManagerServiceServer), ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{
+				Server:     srv,
+				FullMethod: "/" + serviceName + "/" + method,
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(ProcessManagerServiceServer), ctx, req)
+			}
+			return interceptor(ctx, in, info, handler)
+		},
+	}
+}
+
+var processManagerServiceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*ProcessManagerServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("ProcessCreate", func() interface{} { return new(ProcessCreateRequest) },
+			func(srv ProcessManagerServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.ProcessCreate(ctx, req.(*ProcessCreateRequest))
+			}),
+		unaryHandler("ProcessDelete", func() interface{} { return new(ProcessDeleteRequest) },
+			func(srv ProcessManagerServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.ProcessDelete(ctx, req.(*ProcessDeleteRequest))
+			}),
+		unaryHandler("ProcessGet", func() interface{} { return new(ProcessGetRequest) },
+			func(srv ProcessManagerServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.ProcessGet(ctx, req.(*ProcessGetRequest))
+			}),
+		unaryHandler("ProcessList", func() interface{} { return new(ProcessListRequest) },
+			func(srv ProcessManagerServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.ProcessList(ctx, req.(*ProcessListRequest))
+			}),
+		unaryHandler("ProcessLog", func() interface{} { return new(ProcessLogRequest) },
+			func(srv ProcessManagerServiceServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.ProcessLog(ctx, req.(*ProcessLogRequest))
+			}),
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "imrpc.proto",
+}
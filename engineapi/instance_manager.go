@@ -0,0 +1,238 @@
+package engineapi
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+
+	"github.com/rancher/longhorn-manager/engineapi/imrpc"
+)
+
+const (
+	InstanceManagerDefaultPort = "8500"
+
+	// CurrentInstanceManagerAPIVersion is the version of the process
+	// management API the manager talks to the instance manager with. The
+	// engine images report the versions of the instance manager they ship,
+	// separately from the CLI API version, or 0 if they don't ship one.
+	CurrentInstanceManagerAPIVersion = 1
+
+	instanceManagerCallTimeout = 30 * time.Second
+
+	// ReplicaProcessPortCount covers the ports of the replica server, the
+	// data server and the sync agent, in order
+	ReplicaProcessPortCount = 3
+	EngineProcessPortCount  = 1
+)
+
+type ProcessState string
+
+const (
+	ProcessStateStarting = ProcessState("starting")
+	ProcessStateRunning  = ProcessState("running")
+	ProcessStateStopping = ProcessState("stopping")
+	ProcessStateStopped  = ProcessState("stopped")
+	ProcessStateError    = ProcessState("error")
+)
+
+// ProcessSpec describes the process started by the instance manager. The
+// instance manager allocates PortCount ports to the process, and appends the
+// first one to each of PortArgs, which are split by comma into the arguments
+// of the process, e.g. "--listen,0.0.0.0:" becomes "--listen 0.0.0.0:10000".
+type ProcessSpec struct {
+	Name      string   `json:"name"`
+	Binary    string   `json:"binary"`
+	Args      []string `json:"args"`
+	PortCount int      `json:"portCount"`
+	PortArgs  []string `json:"portArgs"`
+}
+
+type ProcessStatus struct {
+	State     ProcessState `json:"state"`
+	ErrorMsg  string       `json:"errorMsg"`
+	PortStart int          `json:"portStart"`
+	PortEnd   int          `json:"portEnd"`
+}
+
+type Process struct {
+	Spec   ProcessSpec   `json:"spec"`
+	Status ProcessStatus `json:"status"`
+}
+
+// InstanceManagerClient manages the engine or replica processes in an
+// instance manager pod
+type InstanceManagerClient interface {
+	ProcessCreate(spec *ProcessSpec) (*Process, error)
+	ProcessDelete(name string) (*Process, error)
+	ProcessGet(name string) (*Process, error)
+	ProcessList() (map[string]*Process, error)
+	// ProcessLog returns the last taillines lines of the output of the
+	// process, which is kept by the instance manager after it exited
+	ProcessLog(name string, taillines int) (string, error)
+}
+
+type InstanceManagerClientRequest struct {
+	EngineImage string
+	IP          string
+}
+
+type InstanceManagerClientCollection interface {
+	NewInstanceManagerClient(request *InstanceManagerClientRequest) (InstanceManagerClient, error)
+}
+
+// InstanceManagerCollection talks to the instance managers through their
+// gRPC process management API
+type InstanceManagerCollection struct{}
+
+type InstanceManager struct {
+	url string
+}
+
+func (c *InstanceManagerCollection) NewInstanceManagerClient(request *InstanceManagerClientRequest) (InstanceManagerClient, error) {
+	if request.EngineImage == "" {
+		return nil, fmt.Errorf("Invalid empty engine image from request")
+	}
+	if request.IP == "" {
+		return nil, fmt.Errorf("Invalid empty instance manager IP from request")
+	}
+	return &InstanceManager{
+		url: request.IP + ":" + InstanceManagerDefaultPort,
+	}, nil
+}
+
+// call connects to the instance manager for a single call, the same way the
+// engine binary is executed for each request
+func (im *InstanceManager) call(f func(ctx context.Context, client imrpc.ProcessManagerServiceClient) error) error {
+	conn, err := grpc.Dial(im.url, grpc.WithInsecure())
+	if err != nil {
+		return errors.Wrapf(err, "cannot connect to instance manager %v", im.url)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), instanceManagerCallTimeout)
+	defer cancel()
+	return f(ctx, imrpc.NewProcessManagerServiceClient(conn))
+}
+
+func processFromRPC(resp *imrpc.ProcessResponse) *Process {
+	process := &Process{}
+	if resp.Spec != nil {
+		process.Spec = ProcessSpec{
+			Name:      resp.Spec.Name,
+			Binary:    resp.Spec.Binary,
+			Args:      resp.Spec.Args,
+			PortCount: int(resp.Spec.PortCount),
+			PortArgs:  resp.Spec.PortArgs,
+		}
+	}
+	if resp.Status != nil {
+		process.Status = ProcessStatus{
+			State:     ProcessState(resp.Status.State),
+			ErrorMsg:  resp.Status.ErrorMsg,
+			PortStart: int(resp.Status.PortStart),
+			PortEnd:   int(resp.Status.PortEnd),
+		}
+	}
+	return process
+}
+
+func (im *InstanceManager) ProcessCreate(spec *ProcessSpec) (*Process, error) {
+	var process *Process
+	if err := im.call(func(ctx context.Context, client imrpc.ProcessManagerServiceClient) error {
+		resp, err := client.ProcessCreate(ctx, &imrpc.ProcessCreateRequest{
+			Spec: &imrpc.ProcessSpec{
+				Name:      spec.Name,
+				Binary:    spec.Binary,
+				Args:      spec.Args,
+				PortCount: int32(spec.PortCount),
+				PortArgs:  spec.PortArgs,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		process = processFromRPC(resp)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to create process %v", spec.Name)
+	}
+	return process, nil
+}
+
+func (im *InstanceManager) ProcessDelete(name string) (*Process, error) {
+	var process *Process
+	if err := im.call(func(ctx context.Context, client imrpc.ProcessManagerServiceClient) error {
+		resp, err := client.ProcessDelete(ctx, &imrpc.ProcessDeleteRequest{Name: name})
+		if err != nil {
+			return err
+		}
+		process = processFromRPC(resp)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to delete process %v", name)
+	}
+	return process, nil
+}
+
+func (im *InstanceManager) ProcessGet(name string) (*Process, error) {
+	var process *Process
+	if err := im.call(func(ctx context.Context, client imrpc.ProcessManagerServiceClient) error {
+		resp, err := client.ProcessGet(ctx, &imrpc.ProcessGetRequest{Name: name})
+		if err != nil {
+			return err
+		}
+		process = processFromRPC(resp)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to get process %v", name)
+	}
+	return process, nil
+}
+
+func (im *InstanceManager) ProcessList() (map[string]*Process, error) {
+	processes := map[string]*Process{}
+	if err := im.call(func(ctx context.Context, client imrpc.ProcessManagerServiceClient) error {
+		resp, err := client.ProcessList(ctx, &imrpc.ProcessListRequest{})
+		if err != nil {
+			return err
+		}
+		for name, p := range resp.Processes {
+			processes[name] = processFromRPC(p)
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "failed to list processes")
+	}
+	return processes, nil
+}
+
+func (im *InstanceManager) ProcessLog(name string, taillines int) (string, error) {
+	var log string
+	if err := im.call(func(ctx context.Context, client imrpc.ProcessManagerServiceClient) error {
+		resp, err := client.ProcessLog(ctx, &imrpc.ProcessLogRequest{Name: name, TailLines: int32(taillines)})
+		if err != nil {
+			return err
+		}
+		log = resp.Log
+		return nil
+	}); err != nil {
+		return "", errors.Wrapf(err, "failed to get log of process %v", name)
+	}
+	return log, nil
+}
+
+// CheckInstanceManagerCompatibility returns error if the engine image doesn't
+// ship an instance manager the current manager can talk to
+func CheckInstanceManagerCompatibility(apiVersion, apiMinVersion int) error {
+	if apiVersion <= 0 {
+		return fmt.Errorf("engine image doesn't ship the instance manager")
+	}
+	if CurrentInstanceManagerAPIVersion > apiVersion || CurrentInstanceManagerAPIVersion < apiMinVersion {
+		return fmt.Errorf("Current instance manager API version %v is not compatible with InstanceManagerAPIVersion %v and InstanceManagerAPIMinVersion %v",
+			CurrentInstanceManagerAPIVersion, apiVersion, apiMinVersion)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package engineapi
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	instanceManagerSimulatorPortStart = 10000
+)
+
+// InstanceManagerSimulatorCollection simulates the instance managers by
+// their IPs. The processes are running once created.
+type InstanceManagerSimulatorCollection struct {
+	simulators map[string]*InstanceManagerSimulator
+	mutex      *sync.Mutex
+}
+
+type InstanceManagerSimulator struct {
+	processes map[string]*Process
+	logs      map[string]string
+	nextPort  int
+	mutex     *sync.RWMutex
+}
+
+func NewInstanceManagerSimulatorCollection() *InstanceManagerSimulatorCollection {
+	return &InstanceManagerSimulatorCollection{
+		simulators: map[string]*InstanceManagerSimulator{},
+		mutex:      &sync.Mutex{},
+	}
+}
+
+// GetInstanceManagerSimulator returns the simulator of the instance manager
+// with the IP, which is created if it doesn't exist
+func (c *InstanceManagerSimulatorCollection) GetInstanceManagerSimulator(ip string) *InstanceManagerSimulator {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s, ok := c.simulators[ip]
+	if !ok {
+		s = &InstanceManagerSimulator{
+			processes: map[string]*Process{},
+			logs:      map[string]string{},
+			nextPort:  instanceManagerSimulatorPortStart,
+			mutex:     &sync.RWMutex{},
+		}
+		c.simulators[ip] = s
+	}
+	return s
+}
+
+func (c *InstanceManagerSimulatorCollection) NewInstanceManagerClient(request *InstanceManagerClientRequest) (InstanceManagerClient, error) {
+	if request.IP == "" {
+		return nil, fmt.Errorf("Invalid empty instance manager IP from request")
+	}
+	return c.GetInstanceManagerSimulator(request.IP), nil
+}
+
+// SetProcessState changes the state of the process, e.g. to simulate a crash
+// with the log left by the process
+func (s *InstanceManagerSimulator) SetProcessState(name string, state ProcessState, log string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, ok := s.processes[name]
+	if !ok {
+		return fmt.Errorf("cannot find process %v", name)
+	}
+	p.Status.State = state
+	s.logs[name] = log
+	return nil
+}
+
+func (s *InstanceManagerSimulator) ProcessCreate(spec *ProcessSpec) (*Process, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.processes[spec.Name]; ok {
+		return nil, fmt.Errorf("process %v already exists", spec.Name)
+	}
+	p := &Process{
+		Spec: *spec,
+		Status: ProcessStatus{
+			State:     ProcessStateRunning,
+			PortStart: s.nextPort,
+			PortEnd:   s.nextPort + spec.PortCount - 1,
+		},
+	}
+	s.nextPort += spec.PortCount
+	s.processes[spec.Name] = p
+	copied := *p
+	return &copied, nil
+}
+
+func (s *InstanceManagerSimulator) ProcessDelete(name string) (*Process, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, ok := s.processes[name]
+	if !ok {
+		return nil, fmt.Errorf("cannot find process %v", name)
+	}
+	delete(s.processes, name)
+	delete(s.logs, name)
+	copied := *p
+	copied.Status.State = ProcessStateStopped
+	return &copied, nil
+}
+
+func (s *InstanceManagerSimulator) ProcessGet(name string) (*Process, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	p, ok := s.processes[name]
+	if !ok {
+		return nil, fmt.Errorf("cannot find process %v", name)
+	}
+	copied := *p
+	return &copied, nil
+}
+
+func (s *InstanceManagerSimulator) ProcessList() (map[string]*Process, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	processes := map[string]*Process{}
+	for name, p := range s.processes {
+		copied := *p
+		processes[name] = &copied
+	}
+	return processes, nil
+}
+
+func (s *InstanceManagerSimulator) ProcessLog(name string, taillines int) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, ok := s.processes[name]; !ok {
+		return "", fmt.Errorf("cannot find process %v", name)
+	}
+	return s.logs[name], nil
+}
@@ -0,0 +1,132 @@
+package engineapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/rancher/longhorn-manager/engineapi/imrpc"
+)
+
+// fakeProcessManager serves the process management API in memory, allocating
+// the ports of the processes from 10000
+type fakeProcessManager struct {
+	processes map[string]*imrpc.ProcessResponse
+	nextPort  int32
+}
+
+func (pm *fakeProcessManager) ProcessCreate(ctx context.Context, req *imrpc.ProcessCreateRequest) (*imrpc.ProcessResponse, error) {
+	if _, ok := pm.processes[req.Spec.Name]; ok {
+		return nil, fmt.Errorf("process %v already exists", req.Spec.Name)
+	}
+	p := &imrpc.ProcessResponse{
+		Spec: req.Spec,
+		Status: &imrpc.ProcessStatus{
+			State:     string(ProcessStateStarting),
+			PortStart: pm.nextPort,
+			PortEnd:   pm.nextPort + req.Spec.PortCount - 1,
+		},
+	}
+	pm.nextPort += req.Spec.PortCount
+	pm.processes[req.Spec.Name] = p
+	return p, nil
+}
+
+func (pm *fakeProcessManager) ProcessDelete(ctx context.Context, req *imrpc.ProcessDeleteRequest) (*imrpc.ProcessResponse, error) {
+	p, ok := pm.processes[req.Name]
+	if !ok {
+		return nil, fmt.Errorf("cannot find process %v", req.Name)
+	}
+	delete(pm.processes, req.Name)
+	p.Status.State = string(ProcessStateStopping)
+	return p, nil
+}
+
+func (pm *fakeProcessManager) ProcessGet(ctx context.Context, req *imrpc.ProcessGetRequest) (*imrpc.ProcessResponse, error) {
+	p, ok := pm.processes[req.Name]
+	if !ok {
+		return nil, fmt.Errorf("cannot find process %v", req.Name)
+	}
+	return p, nil
+}
+
+func (pm *fakeProcessManager) ProcessList(ctx context.Context, req *imrpc.ProcessListRequest) (*imrpc.ProcessListResponse, error) {
+	return &imrpc.ProcessListResponse{Processes: pm.processes}, nil
+}
+
+func (pm *fakeProcessManager) ProcessLog(ctx context.Context, req *imrpc.ProcessLogRequest) (*imrpc.ProcessLogResponse, error) {
+	if _, ok := pm.processes[req.Name]; !ok {
+		return nil, fmt.Errorf("cannot find process %v", req.Name)
+	}
+	return &imrpc.ProcessLogResponse{Log: fmt.Sprintf("last %v lines of %v", req.TailLines, req.Name)}, nil
+}
+
+func TestInstanceManagerClient(t *testing.T) {
+	assert := require.New(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	server := grpc.NewServer()
+	imrpc.RegisterProcessManagerServiceServer(server, &fakeProcessManager{
+		processes: map[string]*imrpc.ProcessResponse{},
+		nextPort:  10000,
+	})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	im := &InstanceManager{url: listener.Addr().String()}
+
+	spec := &ProcessSpec{
+		Name:      "replica-1",
+		Binary:    "/engine-binaries/longhorn",
+		Args:      []string{"replica", "/host/var/lib/longhorn/replicas/replica-1"},
+		PortCount: ReplicaProcessPortCount,
+		PortArgs:  []string{"--listen,0.0.0.0:"},
+	}
+	process, err := im.ProcessCreate(spec)
+	assert.Nil(err)
+	assert.Equal(*spec, process.Spec)
+	assert.Equal(ProcessStateStarting, process.Status.State)
+	assert.Equal(10000, process.Status.PortStart)
+	assert.Equal(10002, process.Status.PortEnd)
+
+	_, err = im.ProcessCreate(&ProcessSpec{Name: "engine-1", Binary: "/engine-binaries/longhorn", PortCount: EngineProcessPortCount})
+	assert.Nil(err)
+
+	process, err = im.ProcessGet("replica-1")
+	assert.Nil(err)
+	assert.Equal(*spec, process.Spec)
+
+	processes, err := im.ProcessList()
+	assert.Nil(err)
+	assert.Len(processes, 2)
+	assert.Equal(10003, processes["engine-1"].Status.PortStart)
+
+	log, err := im.ProcessLog("replica-1", 10)
+	assert.Nil(err)
+	assert.Equal("last 10 lines of replica-1", log)
+
+	process, err = im.ProcessDelete("replica-1")
+	assert.Nil(err)
+	assert.Equal(ProcessStateStopping, process.Status.State)
+
+	// the errors of the instance manager are returned to the caller
+	_, err = im.ProcessGet("replica-1")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "cannot find process replica-1")
+}
+
+func TestCheckInstanceManagerCompatibility(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Nil(CheckInstanceManagerCompatibility(CurrentInstanceManagerAPIVersion, CurrentInstanceManagerAPIVersion))
+	assert.Nil(CheckInstanceManagerCompatibility(CurrentInstanceManagerAPIVersion+1, CurrentInstanceManagerAPIVersion))
+	// the engine image without the instance manager, or of unknown version
+	assert.NotNil(CheckInstanceManagerCompatibility(0, 0))
+	assert.NotNil(CheckInstanceManagerCompatibility(-1, -1))
+	assert.NotNil(CheckInstanceManagerCompatibility(CurrentInstanceManagerAPIVersion+1, CurrentInstanceManagerAPIVersion+1))
+}
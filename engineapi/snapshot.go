@@ -74,13 +74,13 @@ func (e *Engine) SnapshotPurge() error {
 	return nil
 }
 
-func (e *Engine) SnapshotBackup(snapName, backupTarget string, labels map[string]string, credential map[string]string) error {
+func (e *Engine) SnapshotBackup(snapName, backupTarget string, labels map[string]string, credential map[string]string) (string, error) {
 	snap, err := e.SnapshotGet(snapName)
 	if err != nil {
-		return errors.Wrapf(err, "error getting snapshot '%s', volume '%s'", snapName, e.name)
+		return "", errors.Wrapf(err, "error getting snapshot '%s', volume '%s'", snapName, e.name)
 	}
 	if snap == nil {
-		return errors.Errorf("could not find snapshot '%s' to backup, volume '%s'", snapName, e.name)
+		return "", errors.Errorf("could not find snapshot '%s' to backup, volume '%s'", snapName, e.name)
 	}
 	args := []string{"backup", "create", "--dest", backupTarget}
 	for k, v := range labels {
@@ -90,12 +90,20 @@ func (e *Engine) SnapshotBackup(snapName, backupTarget string, labels map[string
 	// set credential if backup for s3
 	err = util.ConfigBackupCredential(backupTarget, credential)
 	if err != nil {
-		return err
+		return "", err
 	}
-	backup, err := e.ExecuteEngineBinaryWithTimeout(backupTimeout, args...)
+	// the engine and the replicas it talks to bypass the proxy
+	noProxyHosts, err := e.getAddressHosts()
 	if err != nil {
-		return err
+		return "", err
 	}
+	env := util.GetBackupProxyEnv(backupTarget, credential, noProxyHosts...)
+	output, err := e.ExecuteEngineBinaryWithTimeoutAndEnv(backupTimeout, env, args...)
+	if err != nil {
+		return "", err
+	}
+	// the engine prints the URL of the backup created
+	backup := strings.TrimSpace(output)
 	logrus.Debugf("Backup %v created for volume %v snapshot %v", backup, e.Name(), snapName)
-	return nil
+	return backup, nil
 }
@@ -2,6 +2,8 @@ package engineapi
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 
 	"github.com/rancher/longhorn-manager/types"
@@ -12,6 +14,18 @@ const (
 	// engine, including `longhorn-engine` and `longhorn-engine-launcher`
 	CurrentCLIVersion = 1
 
+	// RebuildSourceMinCLIAPIVersion is the CLI API version since which the
+	// engine takes the replica to rebuild the new replica from
+	RebuildSourceMinCLIAPIVersion = 2
+
+	// QoSMinCLIAPIVersion is the CLI API version since which the engine
+	// limits the I/O of the volume
+	QoSMinCLIAPIVersion = 3
+
+	// FrontendReadOnlyMinCLIAPIVersion is the CLI API version since which
+	// the engine exports the frontend read-only, rejecting the writes
+	FrontendReadOnlyMinCLIAPIVersion = 4
+
 	ControllerDefaultPort     = "9501"
 	EngineLauncherDefaultPort = "9510"
 	ReplicaDefaultPort        = "9502"
@@ -28,6 +42,18 @@ type Replica struct {
 	Mode types.ReplicaMode
 }
 
+type ReplicaInfo struct {
+	Head  string                      `json:"head"`
+	Chain []string                    `json:"chain"`
+	Disks map[string]*ReplicaDiskInfo `json:"disks"`
+}
+
+type ReplicaDiskInfo struct {
+	Name    string `json:"name"`
+	Removed bool   `json:"removed"`
+	Size    string `json:"size"`
+}
+
 type Controller struct {
 	URL    string
 	NodeID string
@@ -40,8 +66,12 @@ type EngineClient interface {
 	Upgrade(binary string, replicaURLs []string) error
 
 	ReplicaList() (map[string]*Replica, error)
-	ReplicaAdd(url string) error
+	// ReplicaAdd adds the replica to the engine. If sourceURL is not empty,
+	// the engine will rebuild the new replica from it. The source is only
+	// supported since RebuildSourceMinCLIAPIVersion.
+	ReplicaAdd(url, sourceURL string) error
 	ReplicaRemove(url string) error
+	ReplicaInfo(url string) (*ReplicaInfo, error)
 
 	SnapshotCreate(name string, labels map[string]string) (string, error)
 	SnapshotList() (map[string]*Snapshot, error)
@@ -49,13 +79,19 @@ type EngineClient interface {
 	SnapshotDelete(name string) error
 	SnapshotRevert(name string) error
 	SnapshotPurge() error
-	SnapshotBackup(snapName, backupTarget string, labels map[string]string, credential map[string]string) error
+	SnapshotBackup(snapName, backupTarget string, labels map[string]string, credential map[string]string) (string, error)
+
+	// QoSSet applies the I/O limits to the volume, removing the zero ones
+	QoSSet(qos *types.VolumeQoS) error
 }
 
 type EngineClientRequest struct {
 	VolumeName  string
 	EngineImage string
 	IP          string
+	// Port is the port of the engine process in the instance manager, or 0
+	// for the engine in a pod of its own
+	Port int
 }
 
 type EngineClientCollection interface {
@@ -120,6 +156,15 @@ func GetControllerDefaultURL(ip string) string {
 	return "http://" + ip + ":" + ControllerDefaultPort
 }
 
+// GetControllerURL returns the URL of the engine listening on the port, or
+// on the default port if it's 0
+func GetControllerURL(ip string, port int) string {
+	if ip == "" || port == 0 {
+		return GetControllerDefaultURL(ip)
+	}
+	return "http://" + net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
 func GetEngineLauncherDefaultURL(ip string) string {
 	if ip == "" {
 		return ""
@@ -136,6 +181,38 @@ func GetIPFromURL(url string) string {
 	return strings.TrimPrefix(strings.Split(url, ":")[1], "//")
 }
 
+// GetReplicaAddress returns the address of the replica recorded by the
+// engine. The address of the replica listening on the default port is the
+// IP, which is how the replicas in the pods of their own have been recorded.
+func GetReplicaAddress(ip string, port int) string {
+	if port == 0 || strconv.Itoa(port) == ReplicaDefaultPort {
+		return ip
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// GetReplicaURL returns the URL of the replica with the address
+func GetReplicaURL(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return GetReplicaDefaultURL(address)
+	}
+	return "tcp://" + address
+}
+
+// GetReplicaAddressFromURL returns the address of the replica with the URL,
+// the reverse of GetReplicaURL
+func GetReplicaAddressFromURL(url string) string {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(url, "tcp://"))
+	if err != nil {
+		return GetIPFromURL(url)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return GetIPFromURL(url)
+	}
+	return GetReplicaAddress(host, p)
+}
+
 func ValidateReplicaURL(url string) error {
 	if !strings.HasPrefix(url, "tcp://") {
 		return fmt.Errorf("invalid replica url %v", url)
@@ -149,3 +226,22 @@ func CheckCLICompatibilty(cliVersion, cliMinVersion int) error {
 	}
 	return nil
 }
+
+// CheckDataFormatCompatibility returns error if the target engine cannot
+// serve the data written by the current one: the target is older than the
+// data format, which would be a downgrade, or no longer supports it
+func CheckDataFormatCompatibility(current, target *types.EngineVersionDetails) error {
+	if current.DataFormatVersion == types.InvalidEngineVersion || target.DataFormatVersion == types.InvalidEngineVersion {
+		return fmt.Errorf("unknown data format version of the engine, current %v, target %v",
+			current.DataFormatVersion, target.DataFormatVersion)
+	}
+	if target.DataFormatVersion < current.DataFormatVersion {
+		return fmt.Errorf("cannot downgrade data format version from %v to %v",
+			current.DataFormatVersion, target.DataFormatVersion)
+	}
+	if current.DataFormatVersion < target.DataFormatMinVersion {
+		return fmt.Errorf("data format version %v is below the minimum data format version %v of the target engine",
+			current.DataFormatVersion, target.DataFormatMinVersion)
+	}
+	return nil
+}
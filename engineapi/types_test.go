@@ -0,0 +1,70 @@
+package engineapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+func TestCheckDataFormatCompatibility(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := map[string]struct {
+		current  types.EngineVersionDetails
+		target   types.EngineVersionDetails
+		errorMsg string
+	}{
+		"same version": {
+			current: types.EngineVersionDetails{DataFormatVersion: 1, DataFormatMinVersion: 1},
+			target:  types.EngineVersionDetails{DataFormatVersion: 1, DataFormatMinVersion: 1},
+		},
+		"upgrade": {
+			current: types.EngineVersionDetails{DataFormatVersion: 1, DataFormatMinVersion: 1},
+			target:  types.EngineVersionDetails{DataFormatVersion: 2, DataFormatMinVersion: 1},
+		},
+		"downgrade": {
+			current:  types.EngineVersionDetails{DataFormatVersion: 2, DataFormatMinVersion: 1},
+			target:   types.EngineVersionDetails{DataFormatVersion: 1, DataFormatMinVersion: 1},
+			errorMsg: "cannot downgrade data format version from 2 to 1",
+		},
+		"format no longer supported": {
+			current:  types.EngineVersionDetails{DataFormatVersion: 1, DataFormatMinVersion: 1},
+			target:   types.EngineVersionDetails{DataFormatVersion: 3, DataFormatMinVersion: 2},
+			errorMsg: "data format version 1 is below the minimum data format version 2",
+		},
+		"unknown version": {
+			current:  types.EngineVersionDetails{DataFormatVersion: 1, DataFormatMinVersion: 1},
+			target:   types.EngineVersionDetails{DataFormatVersion: types.InvalidEngineVersion, DataFormatMinVersion: types.InvalidEngineVersion},
+			errorMsg: "unknown data format version",
+		},
+	}
+	for name, tc := range testCases {
+		err := CheckDataFormatCompatibility(&tc.current, &tc.target)
+		if tc.errorMsg == "" {
+			assert.Nil(err, name)
+			continue
+		}
+		assert.NotNil(err, name)
+		assert.Contains(err.Error(), tc.errorMsg, name)
+	}
+}
+
+func TestReplicaAddress(t *testing.T) {
+	assert := require.New(t)
+
+	// the replica in a pod of its own is recorded by the IP
+	assert.Equal("1.2.3.4", GetReplicaAddress("1.2.3.4", 0))
+	assert.Equal("1.2.3.4", GetReplicaAddress("1.2.3.4", 9502))
+	assert.Equal("1.2.3.4:10000", GetReplicaAddress("1.2.3.4", 10000))
+
+	assert.Equal("tcp://1.2.3.4:9502", GetReplicaURL("1.2.3.4"))
+	assert.Equal("tcp://1.2.3.4:10000", GetReplicaURL("1.2.3.4:10000"))
+
+	assert.Equal("1.2.3.4", GetReplicaAddressFromURL("tcp://1.2.3.4:9502"))
+	assert.Equal("1.2.3.4:10000", GetReplicaAddressFromURL("tcp://1.2.3.4:10000"))
+
+	assert.Equal("http://1.2.3.4:9501", GetControllerURL("1.2.3.4", 0))
+	assert.Equal("http://1.2.3.4:10003", GetControllerURL("1.2.3.4", 10003))
+}
@@ -9,7 +9,6 @@ import (
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +resource:path=volume
-// +genclient:noStatus
 
 type Volume struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -30,7 +29,6 @@ type VolumeList struct {
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +resource:path=engine
-// +genclient:noStatus
 
 type Engine struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -51,7 +49,6 @@ type EngineList struct {
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +resource:path=replica
-// +genclient:noStatus
 
 type Replica struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -77,6 +74,7 @@ type Setting struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata"`
 	types.Setting
+	Status types.SettingStatus `json:"status"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -91,7 +89,6 @@ type SettingList struct {
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +resource:path=replica
-// +genclient:noStatus
 
 type EngineImage struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -111,7 +108,6 @@ type EngineImageList struct {
 
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
-// +genclient:noStatus
 
 type Node struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -127,3 +123,21 @@ type NodeList struct {
 	metav1.ListMeta `json:"metadata"`
 	Items           []Node `json:"items"`
 }
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type Snapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              types.SnapshotSpec   `json:"spec"`
+	Status            types.SnapshotStatus `json:"status"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type SnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+	Items           []Snapshot `json:"items"`
+}
@@ -100,6 +100,18 @@ func (c *FakeEngineImages) Update(engineImage *v1alpha1.EngineImage) (result *v1
 	return obj.(*v1alpha1.EngineImage), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakeEngineImages) UpdateStatus(engineImage *v1alpha1.EngineImage) (*v1alpha1.EngineImage, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewUpdateSubresourceAction(engineimagesResource, "status", c.ns, engineImage), &v1alpha1.EngineImage{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*v1alpha1.EngineImage), err
+}
+
 // Delete takes name of the engineImage and deletes it. Returns an error if one occurs.
 func (c *FakeEngineImages) Delete(name string, options *v1.DeleteOptions) error {
 	_, err := c.Fake.
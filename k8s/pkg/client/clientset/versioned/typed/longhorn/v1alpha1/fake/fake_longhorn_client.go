@@ -48,6 +48,10 @@ func (c *FakeLonghornV1alpha1) Settings(namespace string) v1alpha1.SettingInterf
 	return &FakeSettings{c, namespace}
 }
 
+func (c *FakeLonghornV1alpha1) Snapshots(namespace string) v1alpha1.SnapshotInterface {
+	return &FakeSnapshots{c, namespace}
+}
+
 func (c *FakeLonghornV1alpha1) Volumes(namespace string) v1alpha1.VolumeInterface {
 	return &FakeVolumes{c, namespace}
 }
@@ -28,4 +28,6 @@ type ReplicaExpansion interface{}
 
 type SettingExpansion interface{}
 
+type SnapshotExpansion interface{}
+
 type VolumeExpansion interface{}
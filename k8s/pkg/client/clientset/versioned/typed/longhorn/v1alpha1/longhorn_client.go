@@ -32,6 +32,7 @@ type LonghornV1alpha1Interface interface {
 	NodesGetter
 	ReplicasGetter
 	SettingsGetter
+	SnapshotsGetter
 	VolumesGetter
 }
 
@@ -60,6 +61,10 @@ func (c *LonghornV1alpha1Client) Settings(namespace string) SettingInterface {
 	return newSettings(c, namespace)
 }
 
+func (c *LonghornV1alpha1Client) Snapshots(namespace string) SnapshotInterface {
+	return newSnapshots(c, namespace)
+}
+
 func (c *LonghornV1alpha1Client) Volumes(namespace string) VolumeInterface {
 	return newVolumes(c, namespace)
 }
@@ -37,6 +37,7 @@ type ReplicasGetter interface {
 type ReplicaInterface interface {
 	Create(*v1alpha1.Replica) (*v1alpha1.Replica, error)
 	Update(*v1alpha1.Replica) (*v1alpha1.Replica, error)
+	UpdateStatus(*v1alpha1.Replica) (*v1alpha1.Replica, error)
 	Delete(name string, options *v1.DeleteOptions) error
 	DeleteCollection(options *v1.DeleteOptions, listOptions v1.ListOptions) error
 	Get(name string, options v1.GetOptions) (*v1alpha1.Replica, error)
@@ -120,6 +121,22 @@ func (c *replicas) Update(replica *v1alpha1.Replica) (result *v1alpha1.Replica,
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+
+func (c *replicas) UpdateStatus(replica *v1alpha1.Replica) (result *v1alpha1.Replica, err error) {
+	result = &v1alpha1.Replica{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("replicas").
+		Name(replica.Name).
+		SubResource("status").
+		Body(replica).
+		Do().
+		Into(result)
+	return
+}
+
 // Delete takes name of the replica and deletes it. Returns an error if one occurs.
 func (c *replicas) Delete(name string, options *v1.DeleteOptions) error {
 	return c.client.Delete().
@@ -8,10 +8,9 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/rancher/longhorn-manager/app"
+	"github.com/rancher/longhorn-manager/meta"
 )
 
-var VERSION = "0.2.0"
-
 func cmdNotFound(c *cli.Context, command string) {
 	panic(fmt.Errorf("Unrecognized command: %s", command))
 }
@@ -24,13 +23,16 @@ func main() {
 	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
 
 	a := cli.NewApp()
-	a.Version = VERSION
+	a.Version = meta.Version
 	a.Usage = "Longhorn Manager"
 
 	a.Before = func(c *cli.Context) error {
 		if c.GlobalBool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+		if c.GlobalBool("log-json") {
+			logrus.SetFormatter(&logrus.JSONFormatter{})
+		}
 		return nil
 	}
 
@@ -40,12 +42,18 @@ func main() {
 			Usage:  "enable debug logging level",
 			EnvVar: "RANCHER_DEBUG",
 		},
+		cli.BoolFlag{
+			Name:   "log-json",
+			Usage:  "output the logs in JSON format for structured ingestion",
+			EnvVar: "LONGHORN_LOG_JSON",
+		},
 	}
 	a.Commands = []cli.Command{
 		app.DaemonCmd(),
 		app.SnapshotCmd(),
 		app.DeployDriverCmd(),
 		app.CSICommand(),
+		app.UninstallCmd(),
 	}
 	a.CommandNotFound = cmdNotFound
 	a.OnUsageError = onUsageError
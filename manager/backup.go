@@ -0,0 +1,713 @@
+package manager
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	// how often to check if the backupstore listing cache is due to refresh
+	backupStoreCacheCheckPeriod = 5 * time.Second
+	// how often the unchanged availability of the backup target is recorded
+	backupTargetAvailabilityRecordPeriod = time.Minute
+
+	EventReasonBackupTargetUnavailable = "BackupTargetUnavailable"
+	EventReasonBackupTargetAvailable   = "BackupTargetAvailable"
+)
+
+// backupStoreCache caches the backup volumes and the backups listed from the
+// backupstore, since each listing costs seconds and the requests to the
+// object store. The backups are only cached for the volumes ever requested,
+// or backed up by Longhorn.
+type backupStoreCache struct {
+	// serializes the listing of the backupstore, so the concurrent requests
+	// of the same listing won't hit the backupstore more than once
+	refreshLock sync.Mutex
+
+	lock             sync.RWMutex
+	targetURL        string
+	volumes          []*engineapi.BackupVolume
+	volumesRefreshed time.Time
+	// volumesErr is the failure of the last listing of the backup volumes
+	volumesErr error
+	backups    map[string]*backupCacheEntry
+
+	// pending are the volumes whose backups were created or deleted by
+	// Longhorn, to be refreshed by the poller right away
+	pending   map[string]struct{}
+	refreshCh chan struct{}
+}
+
+type backupCacheEntry struct {
+	backups   []*engineapi.Backup
+	refreshed time.Time
+	// err is the failure of the last listing of the backups
+	err error
+}
+
+// BackupStoreListingStatus tells how up to date the listing from the
+// backupstore is
+type BackupStoreListingStatus struct {
+	// Refreshed is when the listing was last refreshed from the backupstore
+	Refreshed time.Time
+	// Error is the failure of the refresh since then, e.g. the backupstore
+	// is unreachable
+	Error error
+}
+
+// Stale tells the listing may be outdated since the backupstore couldn't be
+// listed in the last refresh
+func (s BackupStoreListingStatus) Stale() bool {
+	return s.Error != nil
+}
+
+func newBackupStoreCache() *backupStoreCache {
+	return &backupStoreCache{
+		backups:   map[string]*backupCacheEntry{},
+		pending:   map[string]struct{}{},
+		refreshCh: make(chan struct{}, 1),
+	}
+}
+
+// resetIfTargetChanged drops everything cached of the previous backup target.
+// Must be called with the lock held.
+func (c *backupStoreCache) resetIfTargetChanged(targetURL string) {
+	if c.targetURL == targetURL {
+		return
+	}
+	c.targetURL = targetURL
+	c.volumes = nil
+	c.volumesRefreshed = time.Time{}
+	c.volumesErr = nil
+	c.backups = map[string]*backupCacheEntry{}
+}
+
+func (c *backupStoreCache) getVolumes(targetURL string) ([]*engineapi.BackupVolume, BackupStoreListingStatus, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.targetURL != targetURL || c.volumesRefreshed.IsZero() {
+		return nil, BackupStoreListingStatus{}, false
+	}
+	return c.volumes, BackupStoreListingStatus{Refreshed: c.volumesRefreshed, Error: c.volumesErr}, true
+}
+
+func (c *backupStoreCache) getBackups(targetURL, volumeName string) ([]*engineapi.Backup, BackupStoreListingStatus, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.targetURL != targetURL {
+		return nil, BackupStoreListingStatus{}, false
+	}
+	entry := c.backups[volumeName]
+	if entry == nil {
+		return nil, BackupStoreListingStatus{}, false
+	}
+	return entry.backups, BackupStoreListingStatus{Refreshed: entry.refreshed, Error: entry.err}, true
+}
+
+// refreshVolumes lists the backup volumes from the backupstore. If failed,
+// the previous listing is kept but marked as stale.
+func (c *backupStoreCache) refreshVolumes(backupTarget *engineapi.BackupTarget) ([]*engineapi.BackupVolume, BackupStoreListingStatus, error) {
+	requested := time.Now()
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	// refreshed by others while waiting
+	if volumes, status, ok := c.getVolumes(backupTarget.URL); ok && !status.Stale() && status.Refreshed.After(requested) {
+		return volumes, status, nil
+	}
+
+	volumes, err := backupTarget.ListVolumes()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.resetIfTargetChanged(backupTarget.URL)
+	if err != nil {
+		c.volumesErr = err
+		return nil, BackupStoreListingStatus{}, err
+	}
+	c.volumes = volumes
+	c.volumesRefreshed = time.Now()
+	c.volumesErr = nil
+	return volumes, BackupStoreListingStatus{Refreshed: c.volumesRefreshed}, nil
+}
+
+// refreshBackups lists the backups of the volume from the backupstore. If
+// failed, the previous listing is kept but marked as stale.
+func (c *backupStoreCache) refreshBackups(backupTarget *engineapi.BackupTarget, volumeName string) ([]*engineapi.Backup, BackupStoreListingStatus, error) {
+	requested := time.Now()
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	// refreshed by others while waiting
+	if backups, status, ok := c.getBackups(backupTarget.URL, volumeName); ok && !status.Stale() && status.Refreshed.After(requested) {
+		return backups, status, nil
+	}
+
+	backups, err := backupTarget.List(volumeName)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.resetIfTargetChanged(backupTarget.URL)
+	if err != nil {
+		if entry := c.backups[volumeName]; entry != nil {
+			entry.err = err
+		}
+		return nil, BackupStoreListingStatus{}, err
+	}
+	entry := &backupCacheEntry{
+		backups:   backups,
+		refreshed: time.Now(),
+	}
+	c.backups[volumeName] = entry
+	return backups, BackupStoreListingStatus{Refreshed: entry.refreshed}, nil
+}
+
+// requestRefresh queues the volume for the poller to refresh the backup
+// volumes and the backups of the volume right away, after Longhorn created
+// or deleted a backup of the volume. The previous listing is served until
+// then.
+func (c *backupStoreCache) requestRefresh(volumeName string) {
+	c.lock.Lock()
+	c.pending[volumeName] = struct{}{}
+	c.lock.Unlock()
+
+	select {
+	case c.refreshCh <- struct{}{}:
+	default:
+		// the poller hasn't picked up the previous request yet
+	}
+}
+
+func (c *backupStoreCache) takePending() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	volumeNames := []string{}
+	for volumeName := range c.pending {
+		volumeNames = append(volumeNames, volumeName)
+	}
+	c.pending = map[string]struct{}{}
+	return volumeNames
+}
+
+// removeVolume drops the backup volume deleted by Longhorn from the cache,
+// so it's gone from the listing before the next refresh
+func (c *backupStoreCache) removeVolume(targetURL, volumeName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.targetURL != targetURL {
+		return
+	}
+	volumes := []*engineapi.BackupVolume{}
+	for _, v := range c.volumes {
+		if v.Name != volumeName {
+			volumes = append(volumes, v)
+		}
+	}
+	c.volumes = volumes
+	delete(c.backups, volumeName)
+}
+
+// refresh lists the backup volumes and the backups of the cached volumes
+// again, and drops the backups of the volumes no longer in the backupstore
+func (c *backupStoreCache) refresh(backupTarget *engineapi.BackupTarget) error {
+	volumes, _, err := c.refreshVolumes(backupTarget)
+	if err != nil {
+		return err
+	}
+	existing := map[string]struct{}{}
+	for _, v := range volumes {
+		existing[v.Name] = struct{}{}
+	}
+
+	cachedVolumeNames := []string{}
+	c.lock.Lock()
+	for volumeName := range c.backups {
+		if _, ok := existing[volumeName]; !ok {
+			delete(c.backups, volumeName)
+			continue
+		}
+		cachedVolumeNames = append(cachedVolumeNames, volumeName)
+	}
+	c.lock.Unlock()
+
+	for _, volumeName := range cachedVolumeNames {
+		if _, _, err := c.refreshBackups(backupTarget, volumeName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshVolumeBackups lists the backup volumes and the backups of the
+// volumes again
+func (c *backupStoreCache) refreshVolumeBackups(backupTarget *engineapi.BackupTarget, volumeNames []string) error {
+	if _, _, err := c.refreshVolumes(backupTarget); err != nil {
+		return err
+	}
+	for _, volumeName := range volumeNames {
+		if _, _, err := c.refreshBackups(backupTarget, volumeName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartBackupStoreCacheRefresh refreshes the backupstore listing cache in the
+// background, on the interval of the setting backupstore-poll-interval and
+// right after Longhorn created or deleted a backup. The refreshes are done
+// one at a time, so a slow backupstore won't pile up the listings.
+func (m *VolumeManager) StartBackupStoreCacheRefresh(stopCh <-chan struct{}) {
+	// the poll interval or the backup target changed is checked right away
+	settingCh := make(chan struct{}, 1)
+	m.ds.OnSettingChange(func(name types.SettingName) {
+		select {
+		case settingCh <- struct{}{}:
+		default:
+		}
+	}, types.SettingNameBackupstorePollInterval, types.SettingNameBackupTarget)
+	go func() {
+		ticker := time.NewTicker(backupStoreCacheCheckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-m.backupStoreCache.refreshCh:
+				m.refreshBackupStoreCacheRequested()
+			case <-ticker.C:
+				m.refreshBackupStoreCacheIfDue()
+			case <-settingCh:
+				m.refreshBackupStoreCacheIfDue()
+			}
+		}
+	}()
+}
+
+func (m *VolumeManager) refreshBackupStoreCacheRequested() {
+	volumeNames := m.backupStoreCache.takePending()
+	if len(volumeNames) == 0 {
+		return
+	}
+	targetURL, err := m.GetSettingValueExisted(types.SettingNameBackupTarget)
+	if err != nil || targetURL == "" {
+		// no backup target is set
+		return
+	}
+	backupTarget, err := m.getBackupTarget()
+	if err != nil {
+		logrus.Warnf("Fail to refresh the backupstore listing of volumes %v: %v", volumeNames, err)
+		return
+	}
+	// the listing is marked as stale if failed, and retried in the next
+	// poll
+	if err := m.backupStoreCache.refreshVolumeBackups(backupTarget, volumeNames); err != nil {
+		logrus.Warnf("Fail to refresh the backupstore listing of volumes %v: %v", volumeNames, err)
+	}
+}
+
+func (m *VolumeManager) refreshBackupStoreCacheIfDue() {
+	intervalSetting, err := m.GetSettingValueExisted(types.SettingNameBackupstorePollInterval)
+	if err != nil {
+		logrus.Warnf("Fail to get setting %v: %v", types.SettingNameBackupstorePollInterval, err)
+		return
+	}
+	interval, err := strconv.ParseInt(intervalSetting, 10, 64)
+	if err != nil {
+		logrus.Warnf("Invalid setting %v %v: %v", types.SettingNameBackupstorePollInterval, intervalSetting, err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	targetURL, err := m.GetSettingValueExisted(types.SettingNameBackupTarget)
+	if err != nil || targetURL == "" {
+		// no backup target is set
+		return
+	}
+	if _, status, ok := m.backupStoreCache.getVolumes(targetURL); ok && time.Since(status.Refreshed) < time.Duration(interval)*time.Second {
+		return
+	}
+
+	backupTarget, err := m.getBackupTarget()
+	if err == nil {
+		err = m.backupStoreCache.refresh(backupTarget)
+	}
+	if err != nil {
+		logrus.Warnf("Fail to refresh the backupstore listing: %v", err)
+	}
+	if err := m.recordBackupTargetAvailability(targetURL, err); err != nil {
+		logrus.Warnf("Fail to record the availability of the backup target: %v", err)
+	}
+}
+
+// recordBackupTargetAvailability records the result of the backupstore poll
+// in the status of the backup target setting. Every manager polls, but the
+// condition is updated with the conflict check, so only the one changed it
+// emits the event of the transition.
+func (m *VolumeManager) recordBackupTargetAvailability(targetURL string, probeErr error) error {
+	setting, err := m.ds.GetSetting(types.SettingNameBackupTarget)
+	if err != nil {
+		return err
+	}
+	if setting.Value != targetURL {
+		// changed since the poll
+		return nil
+	}
+
+	status := types.ConditionStatusTrue
+	reason := ""
+	message := ""
+	if probeErr != nil {
+		status = types.ConditionStatusFalse
+		reason = string(engineapi.ClassifyBackupTargetError(probeErr))
+		message = probeErr.Error()
+	}
+	// the failed poll is retried on every check, so the same result is
+	// only recorded once in a while
+	condition := types.GetSettingConditionFromStatus(setting.Status, types.SettingConditionTypeBackupTargetAvailable)
+	if setting.Status.BackupTarget == targetURL && condition.Status == status && condition.Message == message {
+		if probed, err := util.ParseTime(condition.LastProbeTime); err == nil && time.Since(probed) < backupTargetAvailabilityRecordPeriod {
+			return nil
+		}
+	}
+
+	previous := types.ConditionStatusUnknown
+	setting, err = m.ds.UpdateSettingStatusWithRetry(setting, func(s *longhorn.Setting) {
+		now := util.Now()
+		if s.Status.BackupTarget != targetURL {
+			// the availability of the previous target doesn't count
+			s.Status = types.SettingStatus{BackupTarget: targetURL, History: s.Status.History}
+		}
+		if s.Status.Conditions == nil {
+			s.Status.Conditions = map[types.SettingConditionType]types.Condition{}
+		}
+		condition := types.GetSettingConditionFromStatus(s.Status, types.SettingConditionTypeBackupTargetAvailable)
+		previous = condition.Status
+		if condition.Status != status {
+			condition.LastTransitionTime = now
+		}
+		condition.Status = status
+		condition.LastProbeTime = now
+		condition.Reason = reason
+		condition.Message = message
+		s.Status.Conditions[types.SettingConditionTypeBackupTargetAvailable] = condition
+		if probeErr == nil {
+			s.Status.LastAvailable = now
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if status == types.ConditionStatusFalse && previous != types.ConditionStatusFalse {
+		m.eventRecorder.Eventf(setting, corev1.EventTypeWarning, EventReasonBackupTargetUnavailable,
+			"Backup target %v is unavailable: %v: %v", targetURL, reason, message)
+	} else if status == types.ConditionStatusTrue && previous == types.ConditionStatusFalse {
+		m.eventRecorder.Eventf(setting, corev1.EventTypeNormal, EventReasonBackupTargetAvailable,
+			"Backup target %v is available again", targetURL)
+	}
+	return nil
+}
+
+// ListBackupVolumes returns the backup volumes and how up to date the
+// listing from the backupstore is. The cache is bypassed if refresh is set.
+func (m *VolumeManager) ListBackupVolumes(refresh bool) ([]*engineapi.BackupVolume, BackupStoreListingStatus, error) {
+	backupTarget, err := m.getBackupTarget()
+	if err != nil {
+		return nil, BackupStoreListingStatus{}, err
+	}
+	if !refresh {
+		if volumes, status, ok := m.backupStoreCache.getVolumes(backupTarget.URL); ok {
+			return volumes, status, nil
+		}
+	}
+	return m.backupStoreCache.refreshVolumes(backupTarget)
+}
+
+func (m *VolumeManager) GetBackupVolume(volumeName string, refresh bool) (*engineapi.BackupVolume, BackupStoreListingStatus, error) {
+	volumes, status, err := m.ListBackupVolumes(refresh)
+	if err != nil {
+		return nil, BackupStoreListingStatus{}, err
+	}
+	for _, v := range volumes {
+		if v.Name == volumeName {
+			return v, status, nil
+		}
+	}
+	return nil, status, nil
+}
+
+// ListBackupsForVolume returns the backups of the volume and how up to date
+// the listing from the backupstore is. The cache is bypassed if refresh is
+// set.
+func (m *VolumeManager) ListBackupsForVolume(volumeName string, refresh bool) ([]*engineapi.Backup, BackupStoreListingStatus, error) {
+	if volumeName == "" {
+		return nil, BackupStoreListingStatus{}, nil
+	}
+	backupTarget, err := m.getBackupTarget()
+	if err != nil {
+		return nil, BackupStoreListingStatus{}, err
+	}
+	if !refresh {
+		if backups, status, ok := m.backupStoreCache.getBackups(backupTarget.URL, volumeName); ok {
+			return backups, status, nil
+		}
+	}
+	return m.backupStoreCache.refreshBackups(backupTarget, volumeName)
+}
+
+func (m *VolumeManager) GetBackup(backupName, volumeName string, refresh bool) (*engineapi.Backup, BackupStoreListingStatus, error) {
+	backups, status, err := m.ListBackupsForVolume(volumeName, refresh)
+	if err != nil {
+		return nil, BackupStoreListingStatus{}, err
+	}
+	for _, b := range backups {
+		if b.Name == backupName {
+			return b, status, nil
+		}
+	}
+	return nil, status, nil
+}
+
+func (m *VolumeManager) DeleteBackup(backupName, volumeName string) error {
+	backupTarget, err := m.getBackupTarget()
+	if err != nil {
+		return err
+	}
+
+	url := engineapi.GetBackupURL(backupTarget.URL, backupName, volumeName)
+	if err := backupTarget.DeleteBackup(url); err != nil {
+		return err
+	}
+	m.backupStoreCache.requestRefresh(volumeName)
+	return nil
+}
+
+// BackupVolumeDeletion is what's removed from the backupstore by deleting
+// the backup volume, or would be in the dry run
+type BackupVolumeDeletion struct {
+	Volume  string
+	Backups []string
+	DryRun  bool
+}
+
+// DeleteBackupVolume removes the backup volume with all its backups from the
+// backupstore. It's refused while the volume is backing up or any volume is
+// restoring from it. Nothing is removed in the dry run.
+func (m *VolumeManager) DeleteBackupVolume(volumeName string, dryRun bool) (*BackupVolumeDeletion, error) {
+	if volumeName == "" {
+		return nil, newError(ErrorReasonInvalidInput, "backup volume name required")
+	}
+	if err := m.checkBackupVolumeNotInUse(volumeName); err != nil {
+		return nil, err
+	}
+
+	// list from the backupstore, so the dry run reports exactly what
+	// would be removed
+	bv, _, err := m.GetBackupVolume(volumeName, true)
+	if err != nil {
+		return nil, err
+	}
+	if bv == nil {
+		return nil, newError(ErrorReasonNotFound, "cannot find backup volume '%s'", volumeName)
+	}
+	backups, _, err := m.ListBackupsForVolume(volumeName, true)
+	if err != nil {
+		return nil, err
+	}
+	deletion := &BackupVolumeDeletion{
+		Volume:  volumeName,
+		Backups: []string{},
+		DryRun:  dryRun,
+	}
+	for _, b := range backups {
+		deletion.Backups = append(deletion.Backups, b.Name)
+	}
+	sort.Strings(deletion.Backups)
+	if dryRun {
+		return deletion, nil
+	}
+
+	backupTarget, err := m.getBackupTarget()
+	if err != nil {
+		return nil, err
+	}
+	if err := backupTarget.DeleteVolume(volumeName); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Deleted backup volume %v with %v backups", volumeName, len(deletion.Backups))
+	m.backupStoreCache.removeVolume(backupTarget.URL, volumeName)
+	m.backupStoreCache.requestRefresh(volumeName)
+	return deletion, nil
+}
+
+// checkBackupVolumeNotInUse checks no backup of the volume is waiting or in
+// progress, and no replica is restoring from the backup volume. The replicas
+// are matched by the name of the backup volume only, so the ones restoring
+// from another backup target with the same name still block the deletion.
+func (m *VolumeManager) checkBackupVolumeNotInUse(volumeName string) error {
+	tickets, err := m.ListBackupStatus(volumeName)
+	if err != nil {
+		return err
+	}
+	for _, t := range tickets {
+		if !t.IsFinished() {
+			return newError(ErrorReasonInvalidState, "backup %v of volume %v is %v", t.ID, volumeName, t.State)
+		}
+	}
+
+	replicas, err := m.ds.ListReplicasRO()
+	if err != nil {
+		return err
+	}
+	for _, r := range replicas {
+		// the replica becomes healthy once the restore is done
+		if r.Spec.RestoreFrom == "" || r.Spec.HealthyAt != "" {
+			continue
+		}
+		restoreVolumeName, err := util.GetBackupVolumeName(r.Spec.RestoreFrom)
+		if err != nil {
+			logrus.Warnf("Cannot parse the backup %v restored by replica %v: %v", r.Spec.RestoreFrom, r.Name, err)
+			continue
+		}
+		if restoreVolumeName == volumeName {
+			return newError(ErrorReasonInvalidState, "volume %v is restoring from backup volume %v", r.Spec.VolumeName, volumeName)
+		}
+	}
+	return nil
+}
+
+// ListBackupTickets returns the status of the backups waiting, in progress
+// or finished within the retention, by volume
+func (m *VolumeManager) ListBackupTickets() (map[string][]types.BackupTicket, error) {
+	tickets, err := m.backupAdmission.ListBackupTickets()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string][]types.BackupTicket{}
+	for _, t := range tickets {
+		result[t.Volume] = append(result[t.Volume], t)
+	}
+	return result, nil
+}
+
+func (m *VolumeManager) ListBackupStatus(volumeName string) ([]types.BackupTicket, error) {
+	tickets, err := m.ListBackupTickets()
+	if err != nil {
+		return nil, err
+	}
+	return tickets[volumeName], nil
+}
+
+func (m *VolumeManager) GetBackupStatus(id, volumeName string) (*types.BackupTicket, error) {
+	if volumeName == "" || id == "" {
+		return nil, newError(ErrorReasonInvalidInput, "volume name and backup status ID required")
+	}
+	tickets, err := m.ListBackupStatus(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tickets {
+		if tickets[i].ID == id {
+			return &tickets[i], nil
+		}
+	}
+	return nil, newError(ErrorReasonNotFound, "cannot find backup status '%s' for volume '%s', it may be dropped after %v",
+		id, volumeName, datastore.BackupStatusRetention)
+}
+
+// BackupTargetTestResult is the result of probing a backup target. The
+// ErrorType categorizes the failure.
+type BackupTargetTestResult struct {
+	BackupTarget     string                          `json:"backupTarget"`
+	CredentialSecret string                          `json:"credentialSecret"`
+	Success          bool                            `json:"success"`
+	ErrorType        engineapi.BackupTargetErrorType `json:"errorType"`
+	Message          string                          `json:"message"`
+}
+
+// TestBackupTarget probes the backup target with the credential secret by
+// listing the root of the backupstore, without changing the settings
+func (m *VolumeManager) TestBackupTarget(targetURL, credentialSecret string) (*BackupTargetTestResult, error) {
+	if targetURL == "" {
+		return nil, newError(ErrorReasonInvalidInput, "backup target is required")
+	}
+	if err := m.SettingValidation(string(types.SettingNameBackupTarget), targetURL); err != nil {
+		return nil, newError(ErrorReasonInvalidInput, "invalid backup target %v: %v", targetURL, err)
+	}
+	backupType, err := util.CheckBackupType(targetURL)
+	if err != nil {
+		return nil, newError(ErrorReasonInvalidInput, "invalid backup target %v: %v", targetURL, err)
+	}
+	engineImage, err := m.GetSettingValueExisted(types.SettingNameDefaultEngineImage)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BackupTargetTestResult{
+		BackupTarget:     targetURL,
+		CredentialSecret: credentialSecret,
+	}
+	var credential map[string]string
+	if backupType == util.BackupStoreTypeS3 {
+		if credentialSecret == "" {
+			result.ErrorType = engineapi.BackupTargetErrorTypeCredentialMissing
+			result.Message = "credential secret is required for the S3 backup target"
+			return result, nil
+		}
+		credential, err = m.ds.GetCredentialFromSecret(credentialSecret)
+		if err != nil {
+			result.ErrorType = engineapi.BackupTargetErrorTypeCredentialMissing
+			result.Message = err.Error()
+			return result, nil
+		}
+		if err := util.ValidateBackupCredential(credential); err != nil {
+			result.ErrorType = engineapi.BackupTargetErrorTypeCredentialInvalid
+			result.Message = err.Error()
+			return result, nil
+		}
+	}
+
+	if err := engineapi.NewBackupTarget(targetURL, engineImage, credential).Test(); err != nil {
+		result.ErrorType = engineapi.ClassifyBackupTargetError(err)
+		result.Message = err.Error()
+		return result, nil
+	}
+	result.Success = true
+	return result, nil
+}
+
+// TestBackupTargetSetting probes the backup target with the credential secret
+// of the settings and logs the failure. It's used to warn about the update of
+// the settings without blocking it, so only the result is returned.
+func (m *VolumeManager) TestBackupTargetSetting(targetURL string) *BackupTargetTestResult {
+	if targetURL == "" {
+		return nil
+	}
+	credentialSecret := ""
+	if s, err := m.GetSetting(types.SettingNameBackupTargetCredentialSecret); err == nil {
+		credentialSecret = s.Value
+	}
+	result, err := m.TestBackupTarget(targetURL, credentialSecret)
+	if err != nil {
+		logrus.Warnf("Fail to test backup target %v: %v", targetURL, err)
+		return nil
+	}
+	if !result.Success {
+		logrus.Warnf("Backup target %v is unreachable: %v: %v", targetURL, result.ErrorType, result.Message)
+	}
+	return result
+}
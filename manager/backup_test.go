@@ -0,0 +1,198 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	TestBackupTarget        = "nfs://nfs.example.com:/opt/backupstore"
+	TestAnotherBackupTarget = "nfs://nfs.example.com:/opt/another-backupstore"
+	// the engine binary of the image isn't there, so listing the
+	// backupstore fails
+	TestUnreachableEngineImage = "longhorn-engine:not-deployed"
+	TestBackupVolume           = "backup-vol-1"
+	TestAnotherBackupVolume    = "backup-vol-2"
+)
+
+// newTestBackupStoreCache returns the cache with the listing of the backup
+// target refreshed at the time
+func newTestBackupStoreCache(targetURL string, refreshed time.Time) *backupStoreCache {
+	c := newBackupStoreCache()
+	c.targetURL = targetURL
+	c.volumes = []*engineapi.BackupVolume{
+		{Name: TestBackupVolume},
+		{Name: TestAnotherBackupVolume},
+	}
+	c.volumesRefreshed = refreshed
+	for _, volumeName := range []string{TestBackupVolume, TestAnotherBackupVolume} {
+		c.backups[volumeName] = &backupCacheEntry{
+			backups:   []*engineapi.Backup{{Name: "backup-1", VolumeName: volumeName}},
+			refreshed: refreshed,
+		}
+	}
+	return c
+}
+
+func newTestSetting(name types.SettingName, value string) *longhorn.Setting {
+	return &longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{Name: string(name)},
+		Setting:    types.Setting{Value: value},
+	}
+}
+
+func TestBackupStoreCacheTargetChanged(t *testing.T) {
+	assert := require.New(t)
+
+	c := newTestBackupStoreCache(TestBackupTarget, time.Now())
+	volumes, status, ok := c.getVolumes(TestBackupTarget)
+	assert.True(ok)
+	assert.Len(volumes, 2)
+	assert.False(status.Stale())
+	_, _, ok = c.getBackups(TestBackupTarget, TestBackupVolume)
+	assert.True(ok)
+
+	// the listing of the previous backup target is never served for the
+	// new one
+	_, _, ok = c.getVolumes(TestAnotherBackupTarget)
+	assert.False(ok)
+	_, _, ok = c.getBackups(TestAnotherBackupTarget, TestBackupVolume)
+	assert.False(ok)
+
+	// and dropped by the first listing of the new one, even if failed
+	backupTarget := engineapi.NewBackupTarget(TestAnotherBackupTarget, TestUnreachableEngineImage, nil)
+	_, _, err := c.refreshVolumes(backupTarget)
+	assert.NotNil(err)
+	for _, targetURL := range []string{TestBackupTarget, TestAnotherBackupTarget} {
+		_, _, ok = c.getVolumes(targetURL)
+		assert.False(ok, targetURL)
+		_, _, ok = c.getBackups(targetURL, TestBackupVolume)
+		assert.False(ok, targetURL)
+	}
+	assert.Equal(TestAnotherBackupTarget, c.targetURL)
+	assert.Empty(c.backups)
+}
+
+func TestBackupStoreCacheRefreshFailed(t *testing.T) {
+	assert := require.New(t)
+
+	refreshed := time.Now().Add(-time.Minute)
+	c := newTestBackupStoreCache(TestBackupTarget, refreshed)
+	backupTarget := engineapi.NewBackupTarget(TestBackupTarget, TestUnreachableEngineImage, nil)
+
+	// the previous listing is kept, but marked as stale
+	_, _, err := c.refreshVolumes(backupTarget)
+	assert.NotNil(err)
+	volumes, status, ok := c.getVolumes(TestBackupTarget)
+	assert.True(ok)
+	assert.Len(volumes, 2)
+	assert.True(status.Stale())
+	assert.Equal(refreshed, status.Refreshed)
+
+	_, _, err = c.refreshBackups(backupTarget, TestBackupVolume)
+	assert.NotNil(err)
+	backups, status, ok := c.getBackups(TestBackupTarget, TestBackupVolume)
+	assert.True(ok)
+	assert.Len(backups, 1)
+	assert.True(status.Stale())
+	_, status, ok = c.getBackups(TestBackupTarget, TestAnotherBackupVolume)
+	assert.True(ok)
+	assert.False(status.Stale())
+}
+
+func TestBackupStoreCacheBackupChanged(t *testing.T) {
+	assert := require.New(t)
+
+	c := newTestBackupStoreCache(TestBackupTarget, time.Now())
+
+	// the refreshes requested before the poller picks them up are merged
+	c.requestRefresh(TestBackupVolume)
+	c.requestRefresh(TestAnotherBackupVolume)
+	c.requestRefresh(TestBackupVolume)
+	assert.Len(c.refreshCh, 1)
+	<-c.refreshCh
+	assert.ElementsMatch([]string{TestBackupVolume, TestAnotherBackupVolume}, c.takePending())
+	assert.Empty(c.takePending())
+	// the previous listing is served until refreshed
+	_, _, ok := c.getBackups(TestBackupTarget, TestBackupVolume)
+	assert.True(ok)
+
+	// the deleted backup volume is gone from the listing right away, but
+	// not from the listing of another backup target
+	c.removeVolume(TestAnotherBackupTarget, TestBackupVolume)
+	volumes, _, _ := c.getVolumes(TestBackupTarget)
+	assert.Len(volumes, 2)
+	c.removeVolume(TestBackupTarget, TestBackupVolume)
+	volumes, _, _ = c.getVolumes(TestBackupTarget)
+	assert.Len(volumes, 1)
+	assert.Equal(TestAnotherBackupVolume, volumes[0].Name)
+	_, _, ok = c.getBackups(TestBackupTarget, TestBackupVolume)
+	assert.False(ok)
+	_, _, ok = c.getBackups(TestBackupTarget, TestAnotherBackupVolume)
+	assert.True(ok)
+}
+
+func TestRefreshBackupStoreCacheIfDue(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestVolumeManager()
+	m.backupStoreCache = newTestBackupStoreCache(TestBackupTarget, time.Now())
+	m.addObjects(t,
+		newTestSetting(types.SettingNameBackupTarget, TestBackupTarget),
+		newTestSetting(types.SettingNameBackupstorePollInterval, "300"),
+		newTestSetting(types.SettingNameDefaultEngineImage, TestUnreachableEngineImage))
+	getAvailability := func() types.Condition {
+		setting, err := m.lhClient.LonghornV1alpha1().Settings(TestNamespace).Get(string(types.SettingNameBackupTarget), metav1.GetOptions{})
+		assert.Nil(err)
+		return types.GetSettingConditionFromStatus(setting.Status, types.SettingConditionTypeBackupTargetAvailable)
+	}
+
+	// the listing within the poll interval isn't refreshed
+	m.refreshBackupStoreCacheIfDue()
+	assert.Equal(types.ConditionStatusUnknown, getAvailability().Status)
+	_, status, ok := m.backupStoreCache.getVolumes(TestBackupTarget)
+	assert.True(ok)
+	assert.False(status.Stale())
+
+	// the listing expired is refreshed, and the failure is recorded
+	m.backupStoreCache.volumesRefreshed = time.Now().Add(-301 * time.Second)
+	m.refreshBackupStoreCacheIfDue()
+	assert.Equal(types.ConditionStatusFalse, getAvailability().Status)
+	_, status, ok = m.backupStoreCache.getVolumes(TestBackupTarget)
+	assert.True(ok)
+	assert.True(status.Stale())
+
+	// the backup target changed is listed right away
+	m.backupStoreCache = newTestBackupStoreCache(TestBackupTarget, time.Now())
+	setting, err := m.lhClient.LonghornV1alpha1().Settings(TestNamespace).Get(string(types.SettingNameBackupTarget), metav1.GetOptions{})
+	assert.Nil(err)
+	setting.Value = TestAnotherBackupTarget
+	setting, err = m.lhClient.LonghornV1alpha1().Settings(TestNamespace).Update(setting)
+	assert.Nil(err)
+	assert.Nil(m.lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer().Update(setting))
+	m.refreshBackupStoreCacheIfDue()
+	assert.Equal(TestAnotherBackupTarget, m.backupStoreCache.targetURL)
+	_, _, ok = m.backupStoreCache.getVolumes(TestBackupTarget)
+	assert.False(ok)
+	setting, err = m.lhClient.LonghornV1alpha1().Settings(TestNamespace).Get(string(types.SettingNameBackupTarget), metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Equal(TestAnotherBackupTarget, setting.Status.BackupTarget)
+
+	// no backup target, nothing to refresh
+	m.backupStoreCache = newTestBackupStoreCache(TestBackupTarget, time.Time{})
+	setting.Value = ""
+	setting, err = m.lhClient.LonghornV1alpha1().Settings(TestNamespace).Update(setting)
+	assert.Nil(err)
+	assert.Nil(m.lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer().Update(setting))
+	m.refreshBackupStoreCacheIfDue()
+	assert.Equal(TestBackupTarget, m.backupStoreCache.targetURL)
+}
@@ -3,9 +3,18 @@ package manager
 import (
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/rancher/longhorn-manager/datastore"
 	"github.com/rancher/longhorn-manager/engineapi"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
@@ -13,153 +22,363 @@ import (
 	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
 )
 
-func (m *VolumeManager) ListSnapshots(volumeName string) (map[string]*engineapi.Snapshot, error) {
+const (
+	EventReasonSnapshotRevert       = "SnapshotRevert"
+	EventReasonFailedSnapshotRevert = "FailedSnapshotRevert"
+	EventReasonSnapshotPurge        = "SnapshotPurge"
+	EventReasonFailedSnapshotPurge  = "FailedSnapshotPurge"
+	EventReasonSnapshotBackup       = "SnapshotBackup"
+	EventReasonFailedSnapshotBackup = "FailedSnapshotBackup"
+)
+
+const (
+	WaitForSnapshotCount    = 30
+	WaitForSnapshotInterval = 1 * time.Second
+)
+
+// engineOperationLocks serializes the operations against the same engine, so
+// e.g. a revert won't run in the middle of a purge of the same volume
+type engineOperationLocks struct {
+	lock  sync.Mutex
+	locks map[string]*engineOperationLock
+}
+
+type engineOperationLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func newEngineOperationLocks() *engineOperationLocks {
+	return &engineOperationLocks{
+		locks: map[string]*engineOperationLock{},
+	}
+}
+
+func (l *engineOperationLocks) Lock(engineName string) {
+	l.lock.Lock()
+	el := l.locks[engineName]
+	if el == nil {
+		el = &engineOperationLock{}
+		l.locks[engineName] = el
+	}
+	el.waiters++
+	l.lock.Unlock()
+
+	el.Lock()
+}
+
+func (l *engineOperationLocks) Unlock(engineName string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	el := l.locks[engineName]
+	if el == nil {
+		logrus.Errorf("BUG: unlock engine %v which is not locked", engineName)
+		return
+	}
+	el.waiters--
+	if el.waiters == 0 {
+		delete(l.locks, engineName)
+	}
+	el.Unlock()
+}
+
+// getSnapshotEngine returns the engine of the volume if the snapshots of the
+// volume can be operated
+func (m *VolumeManager) getSnapshotEngine(volumeName string) (*longhorn.Volume, *longhorn.Engine, error) {
 	if volumeName == "" {
-		return nil, fmt.Errorf("volume name required")
+		return nil, nil, newError(ErrorReasonInvalidInput, "volume name required")
 	}
-	engine, err := m.GetEngineClient(volumeName)
+	v, err := m.ds.GetVolume(volumeName)
 	if err != nil {
-		return nil, err
+		if datastore.ErrorIsNotFound(err) {
+			return nil, nil, newError(ErrorReasonNotFound, "cannot find volume %v", volumeName)
+		}
+		return nil, nil, err
+	}
+	if v.Status.State != types.VolumeStateAttached {
+		return nil, nil, newError(ErrorReasonInvalidState, "volume %v is not attached but %v", volumeName, v.Status.State)
+	}
+	if v.Spec.MigrationNodeID != "" {
+		return nil, nil, newError(ErrorReasonInvalidState, "cannot operate during migration of volume %v", volumeName)
 	}
-	return engine.SnapshotList()
+	e, err := m.getEngine(volumeName)
+	if err != nil {
+		return nil, nil, newError(ErrorReasonInvalidState, "%v", err)
+	}
+	return v, e, nil
 }
 
-func (m *VolumeManager) GetSnapshot(snapshotName, volumeName string) (*engineapi.Snapshot, error) {
-	if volumeName == "" || snapshotName == "" {
-		return nil, fmt.Errorf("volume and snapshot name required")
+// operateSnapshots runs the operation against the engine of the volume after
+// the previous operations of the engine done
+func (m *VolumeManager) operateSnapshots(volumeName string, noRebuilding bool, op func(v *longhorn.Volume, client engineapi.EngineClient) error) error {
+	v, e, err := m.getSnapshotEngine(volumeName)
+	if err != nil {
+		return err
+	}
+	if noRebuilding {
+		for replicaName, mode := range e.Status.ReplicaModeMap {
+			if mode == types.ReplicaModeWO {
+				return newError(ErrorReasonInvalidState, "replica %v of volume %v is rebuilding", replicaName, volumeName)
+			}
+		}
 	}
-	engine, err := m.GetEngineClient(volumeName)
+
+	m.engineLocks.Lock(e.Name)
+	defer m.engineLocks.Unlock(e.Name)
+
+	client, err := m.getEngineClient(e)
 	if err != nil {
-		return nil, err
+		return newError(ErrorReasonInvalidState, "%v", err)
 	}
-	snapshot, err := engine.SnapshotGet(snapshotName)
+	return op(v, client)
+}
+
+// checkSnapshotExists returns the error of NotFound if the snapshot is not in
+// the engine, so the caller won't get the opaque error of the engine
+func checkSnapshotExists(client engineapi.EngineClient, snapshotName, volumeName string) error {
+	snapshot, err := client.SnapshotGet(snapshotName)
 	if err != nil {
-		return nil, err
+		return newError(ErrorReasonEngineFailure, "%v", err)
 	}
 	if snapshot == nil {
-		return nil, fmt.Errorf("cannot find snapshot '%s' for volume '%s'", snapshotName, volumeName)
+		return newError(ErrorReasonNotFound, "cannot find snapshot '%s' for volume '%s'", snapshotName, volumeName)
 	}
-	return snapshot, nil
+	return nil
 }
 
-func (m *VolumeManager) CreateSnapshot(snapshotName string, labels map[string]string, volumeName string) (*engineapi.Snapshot, error) {
+// ListSnapshots returns the snapshot objects of the volume, whose status is
+// kept in sync with the engine while the volume is attached
+func (m *VolumeManager) ListSnapshots(volumeName string) ([]*longhorn.Snapshot, error) {
 	if volumeName == "" {
-		return nil, fmt.Errorf("volume name required")
+		return nil, newError(ErrorReasonInvalidInput, "volume name required")
 	}
+	if _, err := m.ds.GetVolumeRO(volumeName); err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", volumeName)
+		}
+		return nil, err
+	}
+	return m.ds.ListSnapshotsByVolumeRO(volumeName)
+}
 
+func (m *VolumeManager) GetSnapshot(snapshotName, volumeName string) (*longhorn.Snapshot, error) {
+	if volumeName == "" || snapshotName == "" {
+		return nil, newError(ErrorReasonInvalidInput, "volume and snapshot name required")
+	}
+	snapshot, err := m.ds.GetSnapshotRO(snapshotName)
+	if err != nil && !datastore.ErrorIsNotFound(err) {
+		return nil, err
+	}
+	if snapshot == nil || snapshot.Spec.Volume != volumeName {
+		return nil, newError(ErrorReasonNotFound, "cannot find snapshot '%s' for volume '%s'", snapshotName, volumeName)
+	}
+	return snapshot, nil
+}
+
+// CreateSnapshot creates the snapshot object, then waits for the snapshot to
+// be taken in the engine by the snapshot controller, so it can be backed up
+// at once
+func (m *VolumeManager) CreateSnapshot(snapshotName string, labels map[string]string, volumeName string) ([]*longhorn.Snapshot, error) {
 	for k, v := range labels {
 		if strings.Contains(k, "=") || strings.Contains(v, "=") {
-			return nil, fmt.Errorf("labels cannot contain '='")
+			return nil, newError(ErrorReasonInvalidInput, "labels cannot contain '='")
 		}
 	}
-
-	if err := m.checkVolumeNotInMigration(volumeName); err != nil {
+	if _, _, err := m.getSnapshotEngine(volumeName); err != nil {
 		return nil, err
 	}
-	engine, err := m.GetEngineClient(volumeName)
+	// the name is generated here rather than by the engine, since it's the
+	// name of the object as well
+	if snapshotName == "" {
+		snapshotName = util.UUID()
+	}
+	if errs := validation.IsDNS1123Subdomain(snapshotName); len(errs) != 0 {
+		return nil, newError(ErrorReasonInvalidInput, "invalid snapshot name %v: %v", snapshotName, strings.Join(errs, ", "))
+	}
+
+	snapshot, err := m.ds.CreateSnapshot(&longhorn.Snapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: snapshotName,
+		},
+		Spec: types.SnapshotSpec{
+			Volume:         volumeName,
+			CreateSnapshot: true,
+			Labels:         labels,
+		},
+	})
 	if err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return nil, newError(ErrorReasonInvalidInput, "snapshot %v already exists", snapshotName)
+		}
 		return nil, err
 	}
-	snapshotName, err = engine.SnapshotCreate(snapshotName, labels)
-	if err != nil {
+	if err := m.waitForSnapshot(snapshot.Name); err != nil {
 		return nil, err
 	}
-	snap, err := engine.SnapshotGet(snapshotName)
-	if err != nil {
+	return m.ListSnapshots(volumeName)
+}
+
+func (m *VolumeManager) waitForSnapshot(snapshotName string) error {
+	for i := 0; i < WaitForSnapshotCount; i++ {
+		snapshot, err := m.ds.GetSnapshotRO(snapshotName)
+		if err != nil && !datastore.ErrorIsNotFound(err) {
+			return err
+		}
+		if snapshot != nil {
+			if snapshot.Status.ReadyToUse {
+				return nil
+			}
+			condition := types.GetSnapshotConditionFromStatus(snapshot.Status, types.SnapshotConditionTypeSynced)
+			if condition.Reason == types.SnapshotConditionReasonCreationFailed {
+				return newError(ErrorReasonEngineFailure, "failed to create snapshot %v: %v", snapshotName, condition.Message)
+			}
+		}
+		time.Sleep(WaitForSnapshotInterval)
+	}
+	return newError(ErrorReasonEngineFailure, "timed out waiting for snapshot %v to be created", snapshotName)
+}
+
+// DeleteSnapshot deletes the snapshot object, which is held until the
+// snapshot is deleted and purged from the engine by the snapshot controller
+func (m *VolumeManager) DeleteSnapshot(snapshotName, volumeName string) ([]*longhorn.Snapshot, error) {
+	if _, err := m.GetSnapshot(snapshotName, volumeName); err != nil {
 		return nil, err
 	}
-	if snap == nil {
-		return nil, fmt.Errorf("cannot found just created snapshot '%s', for volume '%s'", snapshotName, volumeName)
+	if err := m.ds.DeleteSnapshot(snapshotName); err != nil && !datastore.ErrorIsNotFound(err) {
+		return nil, err
 	}
-	return snap, nil
+	return m.ListSnapshots(volumeName)
 }
 
-func (m *VolumeManager) DeleteSnapshot(snapshotName, volumeName string) error {
+func (m *VolumeManager) RevertSnapshot(snapshotName, volumeName string) ([]*longhorn.Snapshot, error) {
 	if volumeName == "" || snapshotName == "" {
-		return fmt.Errorf("volume and snapshot name required")
+		return nil, newError(ErrorReasonInvalidInput, "volume and snapshot name required")
 	}
 
-	if err := m.checkVolumeNotInMigration(volumeName); err != nil {
-		return err
+	if err := m.operateSnapshots(volumeName, true, func(v *longhorn.Volume, client engineapi.EngineClient) error {
+		if err := checkSnapshotExists(client, snapshotName, volumeName); err != nil {
+			return err
+		}
+		if err := client.SnapshotRevert(snapshotName); err != nil {
+			m.eventRecorder.Eventf(v, corev1.EventTypeWarning, EventReasonFailedSnapshotRevert, "Failed to revert to snapshot %v: %v", snapshotName, err)
+			return newError(ErrorReasonEngineFailure, "%v", err)
+		}
+		m.eventRecorder.Eventf(v, corev1.EventTypeNormal, EventReasonSnapshotRevert, "Reverted to snapshot %v", snapshotName)
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	engine, err := m.GetEngineClient(volumeName)
-	if err != nil {
-		return err
+	return m.ListSnapshots(volumeName)
+}
+
+func (m *VolumeManager) PurgeSnapshot(volumeName string) ([]*longhorn.Snapshot, error) {
+	//TODO time consuming operation, move it out of API server path
+	if err := m.operateSnapshots(volumeName, false, func(v *longhorn.Volume, client engineapi.EngineClient) error {
+		if err := client.SnapshotPurge(); err != nil {
+			m.eventRecorder.Eventf(v, corev1.EventTypeWarning, EventReasonFailedSnapshotPurge, "Failed to purge snapshots: %v", err)
+			return newError(ErrorReasonEngineFailure, "%v", err)
+		}
+		m.eventRecorder.Eventf(v, corev1.EventTypeNormal, EventReasonSnapshotPurge, "Purged snapshots")
+		return nil
+	}); err != nil {
+		return nil, err
 	}
-	return engine.SnapshotDelete(snapshotName)
+	return m.ListSnapshots(volumeName)
 }
 
-func (m *VolumeManager) RevertSnapshot(snapshotName, volumeName string) error {
+// BackupSnapshot backs up the snapshot once admitted under the limits of
+// the concurrent backups. The priority backup is admitted before the others
+// waiting, e.g. requested by the user.
+// BackupSnapshot queues the backup of the snapshot and returns its status,
+// while the backup goes on in the background
+func (m *VolumeManager) BackupSnapshot(snapshotName string, labels map[string]string, volumeName string, priority bool) (*types.BackupTicket, error) {
 	if volumeName == "" || snapshotName == "" {
-		return fmt.Errorf("volume and snapshot name required")
+		return nil, fmt.Errorf("volume and snapshot name required")
 	}
 
 	if err := m.checkVolumeNotInMigration(volumeName); err != nil {
-		return err
+		return nil, err
 	}
-	engine, err := m.GetEngineClient(volumeName)
+	backupTarget, err := m.GetSettingValueExisted(types.SettingNameBackupTarget)
 	if err != nil {
-		return err
-	}
-	if err := engine.SnapshotRevert(snapshotName); err != nil {
-		return err
+		return nil, err
 	}
-	snapshot, err := engine.SnapshotGet(snapshotName)
+	v, err := m.ds.GetVolume(volumeName)
 	if err != nil {
-		return err
-	}
-	if snapshot == nil {
-		return fmt.Errorf("not found snapshot '%s', for volume '%s'", snapshotName, volumeName)
+		return nil, err
 	}
-	return nil
-}
-
-func (m *VolumeManager) PurgeSnapshot(volumeName string) error {
-	if volumeName == "" {
-		return fmt.Errorf("volume name required")
+	credential, err := m.getBackupCredentialConfig(v.Spec.BackupTargetCredentialSecret)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := m.checkVolumeNotInMigration(volumeName); err != nil {
-		return err
+	e, err := m.getEngine(volumeName)
+	if err != nil {
+		return nil, err
 	}
-	engine, err := m.GetEngineClient(volumeName)
+	ticket, err := m.backupAdmission.Queue(types.BackupTicket{
+		Volume:   volumeName,
+		Node:     e.Spec.NodeID,
+		Snapshot: snapshotName,
+		Priority: priority,
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	//TODO time consuming operation, move it out of API server path
-	return engine.SnapshotPurge()
+	go m.backupSnapshot(v, ticket, backupTarget, labels, credential)
+	return &ticket, nil
 }
 
-func (m *VolumeManager) BackupSnapshot(snapshotName string, labels map[string]string, volumeName string) error {
-	if volumeName == "" || snapshotName == "" {
-		return fmt.Errorf("volume and snapshot name required")
-	}
-
-	if err := m.checkVolumeNotInMigration(volumeName); err != nil {
-		return err
-	}
-	backupTarget, err := m.GetSettingValueExisted(types.SettingNameBackupTarget)
+func (m *VolumeManager) backupSnapshot(v *longhorn.Volume, ticket types.BackupTicket, backupTarget string, labels, credential map[string]string) {
+	// the ticket is marked as error on shutdown, instead of holding the slot
+	// until the heartbeat expires
+	finish, err := m.backupAdmission.Acquire(ticket, m.stopCh)
 	if err != nil {
-		return err
+		logrus.Errorf("Fail to wait for the backup slot of snapshot %v of volume %v: %v", ticket.Snapshot, v.Name, err)
+		return
 	}
-	credential, err := m.getBackupCredentialConfig()
+	url, err := m.doBackupSnapshot(v, ticket.Snapshot, backupTarget, labels, credential)
+	finish(url, err)
 	if err != nil {
-		return err
+		logrus.Errorf("Fail to back up snapshot %v of volume %v: %v", ticket.Snapshot, v.Name, err)
+		return
 	}
-	engine, err := m.GetEngineClient(volumeName)
+	m.backupStoreCache.requestRefresh(v.Name)
+}
+
+func (m *VolumeManager) doBackupSnapshot(v *longhorn.Volume, snapshotName, backupTarget string, labels, credential map[string]string) (string, error) {
+	// the engine may have changed while waiting
+	engine, err := m.GetEngineClient(v.Name)
 	if err != nil {
-		return err
+		return "", err
 	}
-	//TODO time consuming operation, move it out of API server path
-	return engine.SnapshotBackup(snapshotName, backupTarget, labels, credential)
+	url, err := engine.SnapshotBackup(snapshotName, backupTarget, labels, credential)
+	if err != nil {
+		// the type tells the wrong credential from the unreachable
+		// endpoint without digging into the output of the engine
+		errorType := engineapi.ClassifyBackupTargetError(err)
+		m.eventRecorder.Eventf(v, corev1.EventTypeWarning, EventReasonFailedSnapshotBackup,
+			"Failed to back up snapshot %v to %v: %v: %v", snapshotName, backupTarget, errorType, err)
+		return "", errors.Wrapf(err, "failed to back up snapshot %v (%v)", snapshotName, errorType)
+	}
+	m.eventRecorder.Eventf(v, corev1.EventTypeNormal, EventReasonSnapshotBackup, "Backed up snapshot %v to %v", snapshotName, backupTarget)
+	return url, nil
 }
 
 func (m *VolumeManager) GetEngineClient(volumeName string) (client engineapi.EngineClient, err error) {
-	var e *longhorn.Engine
-
 	defer func() {
 		err = errors.Wrapf(err, "cannot get client for volume %v", volumeName)
 	}()
+	e, err := m.getEngine(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	return m.getEngineClient(e)
+}
+
+// getEngine returns the only running engine of the volume
+func (m *VolumeManager) getEngine(volumeName string) (*longhorn.Engine, error) {
+	var e *longhorn.Engine
+
 	es, err := m.ds.ListVolumeEngines(volumeName)
 	if err != nil {
 		return nil, err
@@ -176,7 +395,11 @@ func (m *VolumeManager) GetEngineClient(volumeName string) (client engineapi.Eng
 	if e.Status.CurrentState != types.InstanceStateRunning {
 		return nil, fmt.Errorf("engine is not running")
 	}
-	if err := m.CheckEngineImageReadiness(e.Status.CurrentImage); err != nil {
+	return e, nil
+}
+
+func (m *VolumeManager) getEngineClient(e *longhorn.Engine) (engineapi.EngineClient, error) {
+	if err := m.CheckEngineImageReadiness(e.Status.CurrentImage, e.Spec.NodeID); err != nil {
 		return nil, errors.Wrapf(err, "cannot get engine client with image %v", e.Status.CurrentImage)
 	}
 
@@ -185,10 +408,17 @@ func (m *VolumeManager) GetEngineClient(volumeName string) (client engineapi.Eng
 		VolumeName:  e.Spec.VolumeName,
 		EngineImage: e.Status.CurrentImage,
 		IP:          e.Status.IP,
+		Port:        e.Status.Port,
 	})
 }
 
 func (m *VolumeManager) getBackupTarget() (*engineapi.BackupTarget, error) {
+	return m.getBackupTargetWithCredentialSecret("")
+}
+
+// getBackupTargetWithCredentialSecret returns the backup target accessed
+// with the secret, or with the global one if the secret is empty
+func (m *VolumeManager) getBackupTargetWithCredentialSecret(credentialSecret string) (*engineapi.BackupTarget, error) {
 	targetURL, err := m.GetSettingValueExisted(types.SettingNameBackupTarget)
 	if err != nil {
 		return nil, err
@@ -197,14 +427,14 @@ func (m *VolumeManager) getBackupTarget() (*engineapi.BackupTarget, error) {
 	if err != nil {
 		return nil, err
 	}
-	credential, err := m.getBackupCredentialConfig()
+	credential, err := m.getBackupCredentialConfig(credentialSecret)
 	if err != nil {
 		return nil, err
 	}
 	return engineapi.NewBackupTarget(targetURL, engineImage, credential), nil
 }
 
-func (m *VolumeManager) getBackupCredentialConfig() (map[string]string, error) {
+func (m *VolumeManager) getBackupCredentialConfig(credentialSecret string) (map[string]string, error) {
 	backupTarget, err := m.GetSettingValueExisted(types.SettingNameBackupTarget)
 	if err != nil {
 		return nil, fmt.Errorf("cannot backup: unable to get settings %v",
@@ -215,10 +445,13 @@ func (m *VolumeManager) getBackupCredentialConfig() (map[string]string, error) {
 		return nil, err
 	}
 	if backupType == util.BackupStoreTypeS3 {
-		secretName, err := m.GetSettingValueExisted(types.SettingNameBackupTargetCredentialSecret)
-		if err != nil {
-			return nil, fmt.Errorf("cannot backup: unable to get settings %v",
-				types.SettingNameBackupTargetCredentialSecret)
+		secretName := credentialSecret
+		if secretName == "" {
+			secretName, err = m.GetSettingValueExisted(types.SettingNameBackupTargetCredentialSecret)
+			if err != nil {
+				return nil, fmt.Errorf("cannot backup: unable to get settings %v",
+					types.SettingNameBackupTargetCredentialSecret)
+			}
 		}
 		if secretName == "" {
 			return nil, errors.New("Could not backup for s3 without credential secret")
@@ -227,50 +460,3 @@ func (m *VolumeManager) getBackupCredentialConfig() (map[string]string, error) {
 	}
 	return nil, nil
 }
-
-func (m *VolumeManager) ListBackupVolumes() ([]*engineapi.BackupVolume, error) {
-	backupTarget, err := m.getBackupTarget()
-	if err != nil {
-		return nil, err
-	}
-
-	return backupTarget.ListVolumes()
-}
-
-func (m *VolumeManager) GetBackupVolume(volumeName string) (*engineapi.BackupVolume, error) {
-	backupTarget, err := m.getBackupTarget()
-	if err != nil {
-		return nil, err
-	}
-
-	return backupTarget.GetVolume(volumeName)
-}
-
-func (m *VolumeManager) ListBackupsForVolume(volumeName string) ([]*engineapi.Backup, error) {
-	backupTarget, err := m.getBackupTarget()
-	if err != nil {
-		return nil, err
-	}
-
-	return backupTarget.List(volumeName)
-}
-
-func (m *VolumeManager) GetBackup(backupName, volumeName string) (*engineapi.Backup, error) {
-	backupTarget, err := m.getBackupTarget()
-	if err != nil {
-		return nil, err
-	}
-
-	url := engineapi.GetBackupURL(backupTarget.URL, backupName, volumeName)
-	return backupTarget.GetBackup(url)
-}
-
-func (m *VolumeManager) DeleteBackup(backupName, volumeName string) error {
-	backupTarget, err := m.getBackupTarget()
-	if err != nil {
-		return err
-	}
-
-	url := engineapi.GetBackupURL(backupTarget.URL, backupName, volumeName)
-	return backupTarget.DeleteBackup(url)
-}
@@ -84,15 +84,8 @@ func (m *VolumeManager) DeleteEngineImageByName(name string) error {
 		}
 		return errors.Wrapf(err, "unable to get engine image '%s'", name)
 	}
-	defaultImage, err := m.GetSettingValueExisted(types.SettingNameDefaultEngineImage)
-	if err != nil {
-		return errors.Wrap(err, "unable to delete engine image")
-	}
-	if ei.Spec.Image == defaultImage {
-		return fmt.Errorf("unable to delete the default engine image")
-	}
-	if ei.Status.RefCount != 0 {
-		return fmt.Errorf("unable to delete the engine image while being used")
+	if err := m.ds.CheckEngineImageDeletable(ei); err != nil {
+		return newError(ErrorReasonInvalidState, "%v", err)
 	}
 	return m.ds.DeleteEngineImage(name)
 }
@@ -129,13 +122,22 @@ func (m *VolumeManager) WaitForEngineImage(image string) error {
 	return fmt.Errorf("Wait for engine image %v timed out", image)
 }
 
-func (m *VolumeManager) CheckEngineImageReadiness(image string) error {
-	ei, err := m.GetEngineImage(image)
+// CheckEngineImageReadiness returns error if the engine image is incompatible
+// or not deployed on the nodes yet, or on all the ready nodes if none is given
+func (m *VolumeManager) CheckEngineImageReadiness(image string, nodeIDs ...string) error {
+	return m.ds.CheckEngineImageReadiness(image, nodeIDs...)
+}
+
+// getVolumeInstanceNodes returns the node the engine of the volume runs on
+// and the nodes of its replicas
+func (m *VolumeManager) getVolumeInstanceNodes(v *longhorn.Volume, engineNodeID string) ([]string, error) {
+	replicas, err := m.ds.ListReplicasByVolumeRO(v.Name)
 	if err != nil {
-		return errors.Wrapf(err, "unable to get engine image %v", image)
+		return nil, err
 	}
-	if ei.Status.State != types.EngineImageStateReady {
-		return fmt.Errorf("engine image %v (%v) is not ready, it's %v", ei.Name, image, ei.Status.State)
+	nodeIDs := []string{engineNodeID}
+	for _, r := range replicas {
+		nodeIDs = append(nodeIDs, r.Spec.NodeID)
 	}
-	return nil
+	return nodeIDs, nil
 }
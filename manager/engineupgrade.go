@@ -0,0 +1,480 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	EventReasonEngineUpgradeRollout = "EngineUpgradeRollout"
+)
+
+type EngineUpgradeState string
+
+const (
+	EngineUpgradeStatePending   = EngineUpgradeState("Pending")
+	EngineUpgradeStateUpgrading = EngineUpgradeState("Upgrading")
+	EngineUpgradeStateCompleted = EngineUpgradeState("Completed")
+	EngineUpgradeStateFailed    = EngineUpgradeState("Failed")
+	// EngineUpgradeStateSkipped is the volume not eligible for the upgrade
+	EngineUpgradeStateSkipped = EngineUpgradeState("Skipped")
+
+	DefaultEngineUpgradeConcurrency = 3
+
+	engineUpgradeCheckInterval = 5 * time.Second
+	engineUpgradeVolumeTimeout = 10 * time.Minute
+)
+
+// EngineUpgradeJob is the status of upgrading the engines of all the volumes
+// on an engine image. The job runs on the node creating it and is kept in
+// memory only. The paused job starts no more volumes, but keeps tracking the
+// ones being upgraded.
+type EngineUpgradeJob struct {
+	Name        string                 `json:"name"`
+	NodeID      string                 `json:"nodeID"`
+	FromImage   string                 `json:"fromImage"`
+	ToImage     string                 `json:"toImage"`
+	Concurrency int                    `json:"concurrency"`
+	State       EngineUpgradeState     `json:"state"`
+	Paused      bool                   `json:"paused"`
+	Error       string                 `json:"error"`
+	Progress    EngineUpgradeProgress  `json:"progress"`
+	Volumes     []*EngineUpgradeVolume `json:"volumes"`
+}
+
+// EngineUpgradeProgress counts the volumes of the job by the state
+type EngineUpgradeProgress struct {
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Upgrading int `json:"upgrading"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+}
+
+// EngineUpgradeVolume is the upgrade of a volume in the job. The error is
+// why the volume failed or was skipped.
+type EngineUpgradeVolume struct {
+	VolumeName string             `json:"volumeName"`
+	State      EngineUpgradeState `json:"state"`
+	Error      string             `json:"error"`
+
+	started time.Time
+}
+
+type engineUpgradeJobs struct {
+	lock sync.RWMutex
+	jobs map[string]*EngineUpgradeJob
+}
+
+func newEngineUpgradeJobs() engineUpgradeJobs {
+	return engineUpgradeJobs{
+		jobs: map[string]*EngineUpgradeJob{},
+	}
+}
+
+func (j *engineUpgradeJobs) get(name string) *EngineUpgradeJob {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	job := j.jobs[name]
+	if job == nil {
+		return nil
+	}
+	copied := *job
+	copied.Progress = EngineUpgradeProgress{Total: len(job.Volumes)}
+	copied.Volumes = make([]*EngineUpgradeVolume, len(job.Volumes))
+	for i, v := range job.Volumes {
+		volume := *v
+		copied.Volumes[i] = &volume
+		switch v.State {
+		case EngineUpgradeStatePending:
+			copied.Progress.Pending++
+		case EngineUpgradeStateUpgrading:
+			copied.Progress.Upgrading++
+		case EngineUpgradeStateCompleted:
+			copied.Progress.Completed++
+		case EngineUpgradeStateFailed:
+			copied.Progress.Failed++
+		case EngineUpgradeStateSkipped:
+			copied.Progress.Skipped++
+		}
+	}
+	return &copied
+}
+
+func (j *engineUpgradeJobs) update(name string, f func(job *EngineUpgradeJob)) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if job := j.jobs[name]; job != nil {
+		f(job)
+	}
+}
+
+func isEngineUpgradeDone(state EngineUpgradeState) bool {
+	return state == EngineUpgradeStateCompleted || state == EngineUpgradeStateFailed || state == EngineUpgradeStateSkipped
+}
+
+func IsEngineUpgradeJobDone(job *EngineUpgradeJob) bool {
+	return isEngineUpgradeDone(job.State)
+}
+
+// UpgradeVolumeEngines starts upgrading the engines of all the volumes
+// currently on fromImage to toImage in the background, at most concurrency
+// volumes at a time, and returns the status of the job. The volumes opted
+// out by the annotation are skipped.
+func (m *VolumeManager) UpgradeVolumeEngines(fromImage, toImage string, concurrency int) (*EngineUpgradeJob, error) {
+	if fromImage == "" || toImage == "" {
+		return nil, newError(ErrorReasonInvalidInput, "both the engine image to upgrade from and to are required")
+	}
+	if fromImage == toImage {
+		return nil, newError(ErrorReasonInvalidInput, "cannot upgrade engine image %v to itself", fromImage)
+	}
+	if concurrency == 0 {
+		concurrency = DefaultEngineUpgradeConcurrency
+	}
+	if concurrency < 0 {
+		return nil, newError(ErrorReasonInvalidInput, "invalid concurrency %v", concurrency)
+	}
+	if _, err := m.ds.GetEngineImage(types.GetEngineImageChecksumName(toImage)); err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonInvalidInput, "engine image %v is not deployed", toImage)
+		}
+		return nil, err
+	}
+
+	volumes, err := m.ds.ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+	volumeNames := []string{}
+	optedOut := map[string]bool{}
+	for _, v := range volumes {
+		if v.Spec.EngineImage == fromImage {
+			volumeNames = append(volumeNames, v.Name)
+			optedOut[v.Name] = v.Annotations[types.VolumeEngineUpgradeOptOutAnnotation] == "true"
+		}
+	}
+	sort.Strings(volumeNames)
+
+	job := &EngineUpgradeJob{
+		Name:        fmt.Sprintf("engine-upgrade-%v-%v", m.currentNodeID, time.Now().UTC().Format("20060102t150405z")),
+		NodeID:      m.currentNodeID,
+		FromImage:   fromImage,
+		ToImage:     toImage,
+		Concurrency: concurrency,
+		State:       EngineUpgradeStatePending,
+		Volumes:     []*EngineUpgradeVolume{},
+	}
+	for _, name := range volumeNames {
+		uv := &EngineUpgradeVolume{
+			VolumeName: name,
+			State:      EngineUpgradeStatePending,
+		}
+		if optedOut[name] {
+			uv.State = EngineUpgradeStateSkipped
+			uv.Error = fmt.Sprintf("opted out by annotation %v", types.VolumeEngineUpgradeOptOutAnnotation)
+		}
+		job.Volumes = append(job.Volumes, uv)
+	}
+
+	m.engineUpgrades.lock.Lock()
+	for _, existing := range m.engineUpgrades.jobs {
+		if existing.FromImage == fromImage && !isEngineUpgradeDone(existing.State) {
+			m.engineUpgrades.lock.Unlock()
+			return nil, newError(ErrorReasonInvalidState, "engine upgrade %v from image %v is in progress", existing.Name, fromImage)
+		}
+	}
+	if _, ok := m.engineUpgrades.jobs[job.Name]; ok {
+		m.engineUpgrades.lock.Unlock()
+		return nil, newError(ErrorReasonInvalidState, "engine upgrade %v already exists", job.Name)
+	}
+	m.engineUpgrades.jobs[job.Name] = job
+	m.engineUpgrades.lock.Unlock()
+
+	logrus.Infof("Upgrading engines of %v volumes from image %v to %v, %v at a time", len(volumeNames), fromImage, toImage, concurrency)
+	go m.runEngineUpgradeJob(job.Name)
+
+	return m.engineUpgrades.get(job.Name), nil
+}
+
+// CountRunningEngineUpgradeJobs returns the number of the engine upgrade jobs
+// not done yet
+func (m *VolumeManager) CountRunningEngineUpgradeJobs() int {
+	m.engineUpgrades.lock.RLock()
+	defer m.engineUpgrades.lock.RUnlock()
+	count := 0
+	for _, job := range m.engineUpgrades.jobs {
+		if !isEngineUpgradeDone(job.State) {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *VolumeManager) GetEngineUpgradeJob(name string) *EngineUpgradeJob {
+	return m.engineUpgrades.get(name)
+}
+
+// PauseEngineUpgradeJob stops the job from starting more volumes, and
+// ResumeEngineUpgradeJob lets it continue
+func (m *VolumeManager) PauseEngineUpgradeJob(name string) (*EngineUpgradeJob, error) {
+	return m.setEngineUpgradeJobPaused(name, true)
+}
+
+func (m *VolumeManager) ResumeEngineUpgradeJob(name string) (*EngineUpgradeJob, error) {
+	return m.setEngineUpgradeJobPaused(name, false)
+}
+
+func (m *VolumeManager) setEngineUpgradeJobPaused(name string, paused bool) (*EngineUpgradeJob, error) {
+	var err error
+	found := false
+	m.engineUpgrades.update(name, func(job *EngineUpgradeJob) {
+		found = true
+		if isEngineUpgradeDone(job.State) {
+			err = newError(ErrorReasonInvalidState, "engine upgrade %v is %v already", name, job.State)
+			return
+		}
+		if job.Paused != paused {
+			job.Paused = paused
+			logrus.Infof("Engine upgrade %v from image %v to %v is paused: %v", name, job.FromImage, job.ToImage, paused)
+		}
+	})
+	if !found {
+		return nil, newError(ErrorReasonNotFound, "cannot find engine upgrade %v", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.engineUpgrades.get(name), nil
+}
+
+func (m *VolumeManager) runEngineUpgradeJob(name string) {
+	job := m.engineUpgrades.get(name)
+	if job == nil {
+		return
+	}
+	if err := m.WaitForEngineImage(job.ToImage); err != nil {
+		logrus.Errorf("Fail to upgrade engines for %v: %v", name, err)
+		m.engineUpgrades.update(name, func(job *EngineUpgradeJob) {
+			job.State = EngineUpgradeStateFailed
+			job.Error = err.Error()
+			for _, v := range job.Volumes {
+				v.State = EngineUpgradeStateFailed
+				v.Error = "engine image is not ready"
+			}
+		})
+		return
+	}
+	m.engineUpgrades.update(name, func(job *EngineUpgradeJob) {
+		job.State = EngineUpgradeStateUpgrading
+	})
+
+	for {
+		if m.syncEngineUpgradeJob(name) {
+			break
+		}
+		select {
+		case <-m.stopCh:
+			// the upgrades already started are left to the controllers
+			logrus.Infof("Stop engine upgrade %v since the manager is shutting down", name)
+			return
+		case <-time.After(engineUpgradeCheckInterval):
+		}
+	}
+
+	m.engineUpgrades.update(name, func(job *EngineUpgradeJob) {
+		job.State = EngineUpgradeStateCompleted
+		failed, skipped := 0, 0
+		for _, v := range job.Volumes {
+			switch v.State {
+			case EngineUpgradeStateFailed:
+				failed++
+			case EngineUpgradeStateSkipped:
+				skipped++
+			}
+		}
+		if failed != 0 {
+			job.State = EngineUpgradeStateFailed
+			job.Error = fmt.Sprintf("fail to upgrade %v of %v volumes", failed, len(job.Volumes))
+		}
+		logrus.Infof("Engine upgrade %v from image %v to %v is %v, %v of %v volumes skipped",
+			job.Name, job.FromImage, job.ToImage, job.State, skipped, len(job.Volumes))
+	})
+}
+
+// syncEngineUpgradeJob checks the volumes being upgraded and starts the
+// pending ones up to the concurrency. Returns true if all the volumes are done.
+func (m *VolumeManager) syncEngineUpgradeJob(name string) bool {
+	job := m.engineUpgrades.get(name)
+	if job == nil {
+		return true
+	}
+
+	upgrading := 0
+	for _, uv := range job.Volumes {
+		if uv.State != EngineUpgradeStateUpgrading {
+			continue
+		}
+		state, errMsg := m.checkVolumeEngineUpgrade(uv, job.ToImage)
+		m.setEngineUpgradeVolumeState(name, uv.VolumeName, state, errMsg)
+		if state == EngineUpgradeStateUpgrading {
+			upgrading++
+		}
+	}
+	// with the upgrades just done, the job may be done now
+	if job = m.engineUpgrades.get(name); job == nil {
+		return true
+	}
+
+	done := true
+	for _, uv := range job.Volumes {
+		if uv.State != EngineUpgradeStatePending {
+			if uv.State == EngineUpgradeStateUpgrading {
+				done = false
+			}
+			continue
+		}
+		if job.Paused || upgrading >= job.Concurrency {
+			done = false
+			continue
+		}
+		if reason, err := m.getEngineUpgradeSkipReason(uv.VolumeName); err != nil || reason != "" {
+			if err != nil {
+				logrus.Warnf("Fail to check engine upgrade of volume %v for %v: %v", uv.VolumeName, name, err)
+				done = false
+				continue
+			}
+			logrus.Infof("Skip upgrading engine of volume %v for %v: %v", uv.VolumeName, name, reason)
+			m.setEngineUpgradeVolumeState(name, uv.VolumeName, EngineUpgradeStateSkipped, reason)
+			continue
+		}
+		if _, err := m.EngineUpgrade(uv.VolumeName, job.ToImage); err != nil {
+			logrus.Warnf("Fail to upgrade engine of volume %v for %v: %v", uv.VolumeName, name, err)
+			m.setEngineUpgradeVolumeState(name, uv.VolumeName, EngineUpgradeStateFailed, err.Error())
+			continue
+		}
+		m.setEngineUpgradeVolumeState(name, uv.VolumeName, EngineUpgradeStateUpgrading, "")
+		upgrading++
+		done = false
+	}
+	return done
+}
+
+// getEngineUpgradeSkipReason returns why the volume is not eligible for the
+// upgrade now, or empty if it is. The volume attached is upgraded live,
+// which requires the volume to be healthy, and the volume detached is
+// upgraded offline. The volume in the trash is left as it is, to be restored
+// or deleted.
+func (m *VolumeManager) getEngineUpgradeSkipReason(volumeName string) (string, error) {
+	v, err := m.ds.GetVolume(volumeName)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return "volume has been deleted", nil
+		}
+		return "", err
+	}
+	if v.Annotations[types.VolumeEngineUpgradeOptOutAnnotation] == "true" {
+		return fmt.Sprintf("opted out by annotation %v", types.VolumeEngineUpgradeOptOutAnnotation), nil
+	}
+	if v.Spec.TrashedAt != "" {
+		return "volume is in the trash", nil
+	}
+	if v.Status.Robustness == types.VolumeRobustnessDegraded || v.Status.Robustness == types.VolumeRobustnessFaulted {
+		return fmt.Sprintf("volume is %v", v.Status.Robustness), nil
+	}
+	restoring, err := m.isVolumeRestoring(v)
+	if err != nil {
+		return "", err
+	}
+	if restoring {
+		return "volume is restoring", nil
+	}
+	return "", nil
+}
+
+func (m *VolumeManager) checkVolumeEngineUpgrade(uv *EngineUpgradeVolume, image string) (EngineUpgradeState, string) {
+	v, err := m.ds.GetVolume(uv.VolumeName)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return EngineUpgradeStateFailed, "volume has been deleted"
+		}
+		logrus.Warnf("Fail to check engine upgrade of volume %v: %v", uv.VolumeName, err)
+		return EngineUpgradeStateUpgrading, ""
+	}
+	if v.Spec.EngineImage != image {
+		return EngineUpgradeStateFailed, fmt.Sprintf("engine image was changed to %v", v.Spec.EngineImage)
+	}
+	if v.Status.CurrentImage == image {
+		return EngineUpgradeStateCompleted, ""
+	}
+	if time.Since(uv.started) > engineUpgradeVolumeTimeout {
+		return EngineUpgradeStateFailed, fmt.Sprintf("timed out after %v, the current engine image is %v", engineUpgradeVolumeTimeout, v.Status.CurrentImage)
+	}
+	return EngineUpgradeStateUpgrading, ""
+}
+
+func (m *VolumeManager) setEngineUpgradeVolumeState(name, volumeName string, state EngineUpgradeState, errMsg string) {
+	m.engineUpgrades.update(name, func(job *EngineUpgradeJob) {
+		for _, v := range job.Volumes {
+			if v.VolumeName != volumeName {
+				continue
+			}
+			if v.State != EngineUpgradeStateUpgrading && state == EngineUpgradeStateUpgrading {
+				v.started = time.Now()
+			}
+			v.State = state
+			v.Error = errMsg
+		}
+	})
+}
+
+// autoUpgradeEngineToDefaultImage upgrades the volumes on the previous default
+// engine image if the setting auto-upgrade-engine-to-default-image is enabled.
+// It waits for the new engine image to be deployed, so should be called in
+// the background.
+func (m *VolumeManager) autoUpgradeEngineToDefaultImage(oldImage, newImage string) {
+	value, err := m.GetSettingValueExisted(types.SettingNameAutoUpgradeEngineToDefaultImage)
+	if err != nil {
+		logrus.Warnf("Fail to get setting %v: %v", types.SettingNameAutoUpgradeEngineToDefaultImage, err)
+		return
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		logrus.Warnf("Invalid setting %v %v: %v", types.SettingNameAutoUpgradeEngineToDefaultImage, value, err)
+		return
+	}
+	if !enabled {
+		return
+	}
+	if err := m.DeployAndWaitForEngineImage(newImage); err != nil {
+		logrus.Errorf("Fail to automatically upgrade engines to default engine image %v: %v", newImage, err)
+		return
+	}
+	concurrency, err := m.ds.GetSettingAsInt(types.SettingNameAutoUpgradeEngineConcurrency)
+	if err != nil {
+		logrus.Errorf("Fail to get setting %v: %v", types.SettingNameAutoUpgradeEngineConcurrency, err)
+		return
+	}
+	job, err := m.UpgradeVolumeEngines(oldImage, newImage, int(concurrency))
+	if err != nil {
+		logrus.Errorf("Fail to automatically upgrade engines to default engine image %v: %v", newImage, err)
+		return
+	}
+	logrus.Infof("Automatically upgrading engines from %v to default engine image %v by %v", oldImage, newImage, job.Name)
+	// the job is only known to this node, the event tells where to find it
+	if setting, err := m.ds.GetSetting(types.SettingNameDefaultEngineImage); err == nil {
+		m.eventRecorder.Eventf(setting, corev1.EventTypeNormal, EventReasonEngineUpgradeRollout,
+			"Upgrading engines of %v volumes from %v to %v by engine upgrade %v/%v",
+			len(job.Volumes), oldImage, newImage, job.NodeID, job.Name)
+	}
+}
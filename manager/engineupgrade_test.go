@@ -0,0 +1,321 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	TestEngineUpgradeFromImage = "longhorn-engine:previous"
+	TestEngineUpgradeJob       = "test-engine-upgrade"
+)
+
+// newTestEngineUpgradeManager returns the manager with both engine images
+// deployed on the nodes, and the volumes on the image to upgrade from
+func newTestEngineUpgradeManager(t *testing.T, volumes ...*longhorn.Volume) *testVolumeManager {
+	m := newTestVolumeManager()
+	for _, image := range []string{TestEngineUpgradeFromImage, TestEngineImage} {
+		ei := newTestEngineImage(image, engineapi.FrontendReadOnlyMinCLIAPIVersion)
+		ei.Status.Conditions = map[types.EngineImageConditionType]types.Condition{
+			types.EngineImageConditionTypeIncompatible: {
+				Type:   types.EngineImageConditionTypeIncompatible,
+				Status: types.ConditionStatusFalse,
+			},
+		}
+		ei.Status.NodeDeploymentMap = map[string]bool{TestNode1: true, TestNode2: true}
+		m.addObjects(t, ei)
+	}
+	m.addObjects(t, newTestNode(TestNode1), newTestNode(TestNode2))
+	for _, v := range volumes {
+		m.addObjects(t, v)
+	}
+	return m
+}
+
+func newTestEngineUpgradeVolume(name string, state types.VolumeState, nodeID string) *longhorn.Volume {
+	v := newTestVolume(name, 1024, 100, state, nodeID)
+	v.Spec.NumberOfReplicas = 2
+	v.Spec.EngineImage = TestEngineUpgradeFromImage
+	v.Status.CurrentImage = TestEngineUpgradeFromImage
+	if state == types.VolumeStateAttached {
+		v.Status.Robustness = types.VolumeRobustnessHealthy
+	} else {
+		v.Status.Robustness = types.VolumeRobustnessUnknown
+	}
+	return v
+}
+
+// addTestEngineUpgradeJob adds the job as UpgradeVolumeEngines does, without
+// running it in the background, so the test can sync it step by step
+func (m *testVolumeManager) addTestEngineUpgradeJob(concurrency int, volumeNames ...string) {
+	job := &EngineUpgradeJob{
+		Name:        TestEngineUpgradeJob,
+		NodeID:      TestNode1,
+		FromImage:   TestEngineUpgradeFromImage,
+		ToImage:     TestEngineImage,
+		Concurrency: concurrency,
+		State:       EngineUpgradeStateUpgrading,
+		Volumes:     []*EngineUpgradeVolume{},
+	}
+	for _, name := range volumeNames {
+		job.Volumes = append(job.Volumes, &EngineUpgradeVolume{
+			VolumeName: name,
+			State:      EngineUpgradeStatePending,
+		})
+	}
+	m.engineUpgrades.jobs[job.Name] = job
+}
+
+// updateTestVolume changes the volume as the volume controller would, in
+// both the client and the indexer
+func (m *testVolumeManager) updateTestVolume(t *testing.T, name string, f func(v *longhorn.Volume)) {
+	assert := require.New(t)
+
+	v := m.getVolume(t, name)
+	f(v)
+	v, err := m.lhClient.LonghornV1alpha1().Volumes(TestNamespace).Update(v)
+	assert.Nil(err)
+	assert.Nil(m.lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer().Update(v))
+}
+
+func getTestEngineUpgradeVolumeStates(job *EngineUpgradeJob) map[string]EngineUpgradeState {
+	states := map[string]EngineUpgradeState{}
+	for _, v := range job.Volumes {
+		states[v.VolumeName] = v.State
+	}
+	return states
+}
+
+func TestEngineUpgradeJobConcurrency(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestEngineUpgradeManager(t,
+		newTestEngineUpgradeVolume("vol-1", types.VolumeStateAttached, TestNode1),
+		newTestEngineUpgradeVolume("vol-2", types.VolumeStateAttached, TestNode2),
+		newTestEngineUpgradeVolume("vol-3", types.VolumeStateDetached, ""))
+	m.addTestEngineUpgradeJob(2, "vol-1", "vol-2", "vol-3")
+
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	job := m.GetEngineUpgradeJob(TestEngineUpgradeJob)
+	assert.Equal(map[string]EngineUpgradeState{
+		"vol-1": EngineUpgradeStateUpgrading,
+		"vol-2": EngineUpgradeStateUpgrading,
+		"vol-3": EngineUpgradeStatePending,
+	}, getTestEngineUpgradeVolumeStates(job))
+	assert.Equal(EngineUpgradeProgress{Total: 3, Pending: 1, Upgrading: 2}, job.Progress)
+	assert.Equal(TestEngineImage, m.getVolume(t, "vol-1").Spec.EngineImage)
+	assert.Equal(TestEngineUpgradeFromImage, m.getVolume(t, "vol-3").Spec.EngineImage)
+
+	// nothing more is started until one of the upgrades is done
+	for _, name := range []string{"vol-1", "vol-2"} {
+		m.updateTestVolume(t, name, func(v *longhorn.Volume) {})
+	}
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	assert.Equal(EngineUpgradeStatePending, getTestEngineUpgradeVolumeStates(m.GetEngineUpgradeJob(TestEngineUpgradeJob))["vol-3"])
+
+	m.updateTestVolume(t, "vol-1", func(v *longhorn.Volume) {
+		v.Status.CurrentImage = TestEngineImage
+	})
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	assert.Equal(map[string]EngineUpgradeState{
+		"vol-1": EngineUpgradeStateCompleted,
+		"vol-2": EngineUpgradeStateUpgrading,
+		"vol-3": EngineUpgradeStateUpgrading,
+	}, getTestEngineUpgradeVolumeStates(m.GetEngineUpgradeJob(TestEngineUpgradeJob)))
+
+	// the detached volume is upgraded offline
+	for _, name := range []string{"vol-2", "vol-3"} {
+		m.updateTestVolume(t, name, func(v *longhorn.Volume) {
+			v.Status.CurrentImage = TestEngineImage
+		})
+	}
+	assert.True(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	job = m.GetEngineUpgradeJob(TestEngineUpgradeJob)
+	assert.Equal(EngineUpgradeProgress{Total: 3, Completed: 3}, job.Progress)
+}
+
+func TestEngineUpgradeJobPause(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestEngineUpgradeManager(t,
+		newTestEngineUpgradeVolume("vol-1", types.VolumeStateAttached, TestNode1),
+		newTestEngineUpgradeVolume("vol-2", types.VolumeStateAttached, TestNode2))
+	m.addTestEngineUpgradeJob(1, "vol-1", "vol-2")
+
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	m.updateTestVolume(t, "vol-1", func(v *longhorn.Volume) {})
+
+	job, err := m.PauseEngineUpgradeJob(TestEngineUpgradeJob)
+	assert.Nil(err)
+	assert.True(job.Paused)
+
+	// the upgrade in flight is still tracked till it's done, but no more
+	// volume is started
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	assert.Equal(EngineUpgradeStateUpgrading, getTestEngineUpgradeVolumeStates(m.GetEngineUpgradeJob(TestEngineUpgradeJob))["vol-1"])
+	m.updateTestVolume(t, "vol-1", func(v *longhorn.Volume) {
+		v.Status.CurrentImage = TestEngineImage
+	})
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	assert.Equal(map[string]EngineUpgradeState{
+		"vol-1": EngineUpgradeStateCompleted,
+		"vol-2": EngineUpgradeStatePending,
+	}, getTestEngineUpgradeVolumeStates(m.GetEngineUpgradeJob(TestEngineUpgradeJob)))
+	assert.Equal(TestEngineUpgradeFromImage, m.getVolume(t, "vol-2").Spec.EngineImage)
+
+	job, err = m.ResumeEngineUpgradeJob(TestEngineUpgradeJob)
+	assert.Nil(err)
+	assert.False(job.Paused)
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	assert.Equal(EngineUpgradeStateUpgrading, getTestEngineUpgradeVolumeStates(m.GetEngineUpgradeJob(TestEngineUpgradeJob))["vol-2"])
+	assert.Equal(TestEngineImage, m.getVolume(t, "vol-2").Spec.EngineImage)
+
+	_, err = m.PauseEngineUpgradeJob("nonexistent")
+	assert.NotNil(err)
+	managerErr, ok := errors.Cause(err).(*Error)
+	assert.True(ok)
+	assert.Equal(ErrorReasonNotFound, managerErr.Reason)
+
+	m.engineUpgrades.update(TestEngineUpgradeJob, func(job *EngineUpgradeJob) {
+		job.State = EngineUpgradeStateCompleted
+	})
+	_, err = m.PauseEngineUpgradeJob(TestEngineUpgradeJob)
+	assert.NotNil(err)
+	managerErr, ok = errors.Cause(err).(*Error)
+	assert.True(ok)
+	assert.Equal(ErrorReasonInvalidState, managerErr.Reason)
+}
+
+func TestEngineUpgradeJobSkip(t *testing.T) {
+	assert := require.New(t)
+
+	degraded := newTestEngineUpgradeVolume("vol-degraded", types.VolumeStateAttached, TestNode1)
+	degraded.Status.Robustness = types.VolumeRobustnessDegraded
+	faulted := newTestEngineUpgradeVolume("vol-faulted", types.VolumeStateDetached, "")
+	faulted.Status.Robustness = types.VolumeRobustnessFaulted
+	trashed := newTestEngineUpgradeVolume("vol-trashed", types.VolumeStateDetached, "")
+	trashed.Spec.TrashedAt = util.Now()
+	optedOut := newTestEngineUpgradeVolume("vol-opted-out", types.VolumeStateAttached, TestNode1)
+	optedOut.Annotations = map[string]string{types.VolumeEngineUpgradeOptOutAnnotation: "true"}
+	detached := newTestEngineUpgradeVolume("vol-detached", types.VolumeStateDetached, "")
+	m := newTestEngineUpgradeManager(t, degraded, faulted, trashed, optedOut, detached)
+	m.addTestEngineUpgradeJob(10, "vol-degraded", "vol-deleted", "vol-detached", "vol-faulted", "vol-opted-out", "vol-trashed")
+
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	job := m.GetEngineUpgradeJob(TestEngineUpgradeJob)
+	assert.Equal(map[string]EngineUpgradeState{
+		"vol-degraded":  EngineUpgradeStateSkipped,
+		"vol-deleted":   EngineUpgradeStateSkipped,
+		"vol-detached":  EngineUpgradeStateUpgrading,
+		"vol-faulted":   EngineUpgradeStateSkipped,
+		"vol-opted-out": EngineUpgradeStateSkipped,
+		"vol-trashed":   EngineUpgradeStateSkipped,
+	}, getTestEngineUpgradeVolumeStates(job))
+	for _, uv := range job.Volumes {
+		if uv.State == EngineUpgradeStateSkipped {
+			assert.NotEmpty(uv.Error, uv.VolumeName)
+		}
+	}
+	assert.Equal("volume is in the trash", job.Volumes[5].Error)
+	// the skipped volumes are left on the old image
+	for _, name := range []string{"vol-degraded", "vol-faulted", "vol-opted-out", "vol-trashed"} {
+		assert.Equal(TestEngineUpgradeFromImage, m.getVolume(t, name).Spec.EngineImage, name)
+	}
+	assert.Equal(TestEngineImage, m.getVolume(t, "vol-detached").Spec.EngineImage)
+}
+
+func TestEngineUpgradeJobFailure(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestEngineUpgradeManager(t,
+		newTestEngineUpgradeVolume("vol-changed", types.VolumeStateAttached, TestNode1),
+		newTestEngineUpgradeVolume("vol-deleted", types.VolumeStateAttached, TestNode1),
+		newTestEngineUpgradeVolume("vol-timeout", types.VolumeStateAttached, TestNode2))
+	m.addTestEngineUpgradeJob(10, "vol-changed", "vol-deleted", "vol-timeout")
+
+	assert.False(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	assert.Equal(EngineUpgradeProgress{Total: 3, Upgrading: 3},
+		m.GetEngineUpgradeJob(TestEngineUpgradeJob).Progress)
+
+	m.updateTestVolume(t, "vol-changed", func(v *longhorn.Volume) {
+		v.Spec.EngineImage = TestEngineUpgradeFromImage
+	})
+	assert.Nil(m.lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer().Delete(m.getVolume(t, "vol-deleted")))
+	m.updateTestVolume(t, "vol-timeout", func(v *longhorn.Volume) {})
+	m.engineUpgrades.update(TestEngineUpgradeJob, func(job *EngineUpgradeJob) {
+		job.Volumes[2].started = time.Now().Add(-engineUpgradeVolumeTimeout - time.Second)
+	})
+
+	assert.True(m.syncEngineUpgradeJob(TestEngineUpgradeJob))
+	job := m.GetEngineUpgradeJob(TestEngineUpgradeJob)
+	assert.Equal(EngineUpgradeProgress{Total: 3, Failed: 3}, job.Progress)
+	assert.Contains(job.Volumes[0].Error, "engine image was changed")
+	assert.Equal("volume has been deleted", job.Volumes[1].Error)
+	assert.Contains(job.Volumes[2].Error, "timed out")
+
+	// the job is failed once all the volumes are done
+	m.runEngineUpgradeJob(TestEngineUpgradeJob)
+	job = m.GetEngineUpgradeJob(TestEngineUpgradeJob)
+	assert.Equal(EngineUpgradeStateFailed, job.State)
+	assert.Equal("fail to upgrade 3 of 3 volumes", job.Error)
+	assert.True(IsEngineUpgradeJobDone(job))
+	assert.Equal(0, m.CountRunningEngineUpgradeJobs())
+}
+
+func TestEngineUpgradeJobCompleted(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestEngineUpgradeManager(t)
+	m.addTestEngineUpgradeJob(1, "vol-1", "vol-2")
+	m.engineUpgrades.update(TestEngineUpgradeJob, func(job *EngineUpgradeJob) {
+		job.Volumes[0].State = EngineUpgradeStateCompleted
+		job.Volumes[1].State = EngineUpgradeStateSkipped
+	})
+	assert.Equal(1, m.CountRunningEngineUpgradeJobs())
+
+	// the skipped volumes don't fail the job
+	m.runEngineUpgradeJob(TestEngineUpgradeJob)
+	job := m.GetEngineUpgradeJob(TestEngineUpgradeJob)
+	assert.Equal(EngineUpgradeStateCompleted, job.State)
+	assert.Empty(job.Error)
+	assert.Equal(0, m.CountRunningEngineUpgradeJobs())
+}
+
+func TestUpgradeVolumeEnginesValidation(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestEngineUpgradeManager(t)
+	m.addTestEngineUpgradeJob(1, "vol-1")
+
+	for _, tc := range []struct {
+		fromImage   string
+		toImage     string
+		concurrency int
+		reason      ErrorReason
+	}{
+		{"", TestEngineImage, 1, ErrorReasonInvalidInput},
+		{TestEngineUpgradeFromImage, "", 1, ErrorReasonInvalidInput},
+		{TestEngineImage, TestEngineImage, 1, ErrorReasonInvalidInput},
+		{TestEngineUpgradeFromImage, TestEngineImage, -1, ErrorReasonInvalidInput},
+		{TestEngineUpgradeFromImage, "longhorn-engine:undeployed", 1, ErrorReasonInvalidInput},
+		// only one job at a time for the engine image
+		{TestEngineUpgradeFromImage, TestEngineImage, 1, ErrorReasonInvalidState},
+	} {
+		_, err := m.UpgradeVolumeEngines(tc.fromImage, tc.toImage, tc.concurrency)
+		assert.NotNil(err, "%+v", tc)
+		managerErr, ok := errors.Cause(err).(*Error)
+		assert.True(ok, "%+v", tc)
+		assert.Equal(tc.reason, managerErr.Reason, "%+v", tc)
+	}
+	assert.Len(m.engineUpgrades.jobs, 1)
+}
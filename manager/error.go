@@ -0,0 +1,33 @@
+package manager
+
+import (
+	"fmt"
+)
+
+type ErrorReason string
+
+const (
+	ErrorReasonInvalidInput  = ErrorReason("InvalidInput")
+	ErrorReasonNotFound      = ErrorReason("NotFound")
+	ErrorReasonInvalidState  = ErrorReason("InvalidState")
+	ErrorReasonEngineFailure = ErrorReason("EngineFailure")
+	ErrorReasonForbidden     = ErrorReason("Forbidden")
+)
+
+// Error is returned by the operations of the manager when the caller should
+// be able to tell the bad requests apart from the internal failures
+type Error struct {
+	Reason  ErrorReason
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(reason ErrorReason, format string, args ...interface{}) error {
+	return &Error{
+		Reason:  reason,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
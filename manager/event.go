@@ -1,7 +1,21 @@
 package manager
 
 import (
+	"sort"
+	"time"
+
 	"k8s.io/api/core/v1"
+
+	"github.com/rancher/longhorn-manager/datastore"
+)
+
+const (
+	MaxVolumeEvents = 500
+
+	eventKindVolume  = "Volume"
+	eventKindEngine  = "Engine"
+	eventKindReplica = "Replica"
+	eventKindPod     = "Pod"
 )
 
 func (m *VolumeManager) ListEvent() ([]*v1.Event, error) {
@@ -11,3 +25,84 @@ func (m *VolumeManager) ListEvent() ([]*v1.Event, error) {
 	}
 	return eventList, nil
 }
+
+// ListVolumeEvents returns the events of the volume, its engines, its
+// replicas and the instance pods of them, sorted by time. Only the events
+// after since are returned if it's set, and only the latest limit ones are
+// returned, which is capped by MaxVolumeEvents.
+func (m *VolumeManager) ListVolumeEvents(volumeName string, since time.Time, limit int) ([]*v1.Event, error) {
+	if limit <= 0 || limit > MaxVolumeEvents {
+		limit = MaxVolumeEvents
+	}
+	if _, err := m.ds.GetVolume(volumeName); err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", volumeName)
+		}
+		return nil, err
+	}
+
+	// the engines and the replicas of the volume are found by the volume
+	// label, and the instance pods share the names with them
+	instances := map[string]struct{}{}
+	es, err := m.ds.ListVolumeEngines(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	for name := range es {
+		instances[name] = struct{}{}
+	}
+	rs, err := m.ds.ListVolumeReplicas(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	for name := range rs {
+		instances[name] = struct{}{}
+	}
+
+	events, err := m.ds.ListEventsRO()
+	if err != nil {
+		return nil, err
+	}
+	result := []*v1.Event{}
+	for _, event := range events {
+		obj := event.InvolvedObject
+		switch obj.Kind {
+		case eventKindVolume:
+			if obj.Name != volumeName {
+				continue
+			}
+		case eventKindEngine, eventKindReplica, eventKindPod:
+			if _, ok := instances[obj.Name]; !ok {
+				continue
+			}
+		default:
+			continue
+		}
+		if !since.IsZero() && !getEventTime(event).After(since) {
+			continue
+		}
+		result = append(result, event.DeepCopy())
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return getEventTime(result[i]).Before(getEventTime(result[j]))
+	})
+	if len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result, nil
+}
+
+// getEventTime returns when the event last happened
+func getEventTime(event *v1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	if !event.FirstTimestamp.IsZero() {
+		return event.FirstTimestamp.Time
+	}
+	return event.CreationTimestamp.Time
+}
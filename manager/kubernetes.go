@@ -0,0 +1,221 @@
+package manager
+
+import (
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/csi"
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	DefaultPVFSType        = "ext4"
+	DefaultPVReclaimPolicy = corev1.PersistentVolumeReclaimRetain
+	// the PV and the PVC created for the existing volumes use the storage
+	// class of the examples, so the PVC binds to the PV statically
+	PVStorageClassName = "longhorn"
+
+	annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+)
+
+// PVCreate creates the CSI PV bound to the volume, so the volume can be used
+// by the Kubernetes workloads. The PV is annotated as provisioned by Longhorn,
+// so the volume is deleted with the PV if the reclaim policy is Delete.
+func (m *VolumeManager) PVCreate(volumeName, pvName, fsType string, reclaimPolicy corev1.PersistentVolumeReclaimPolicy) (v *longhorn.Volume, err error) {
+	defer func() {
+		err = errors.Wrapf(err, "unable to create PV for volume %v", volumeName)
+	}()
+
+	if pvName == "" {
+		pvName = volumeName
+	}
+	if fsType == "" {
+		fsType = DefaultPVFSType
+	}
+	if reclaimPolicy == "" {
+		reclaimPolicy = DefaultPVReclaimPolicy
+	}
+	if reclaimPolicy != corev1.PersistentVolumeReclaimRetain && reclaimPolicy != corev1.PersistentVolumeReclaimDelete {
+		return nil, newError(ErrorReasonInvalidInput, "invalid reclaim policy %v, must be %v or %v",
+			reclaimPolicy, corev1.PersistentVolumeReclaimRetain, corev1.PersistentVolumeReclaimDelete)
+	}
+
+	v, err = m.getVolumeForKubernetes(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if v.Status.KubernetesStatus.PVName != "" {
+		if _, err := m.ds.GetPersistentVolume(v.Status.KubernetesStatus.PVName); err == nil {
+			return nil, newError(ErrorReasonInvalidState, "volume %v already has PV %v", volumeName, v.Status.KubernetesStatus.PVName)
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: pvName,
+			Annotations: map[string]string{
+				annProvisionedBy: csi.DefaultCSIProvisionerName,
+			},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: *resource.NewQuantity(v.Spec.Size, resource.BinarySI),
+			},
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
+			StorageClassName:              PVStorageClassName,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       csi.DefaultCSIDriverName,
+					VolumeHandle: v.Name,
+					FSType:       fsType,
+					VolumeAttributes: map[string]string{
+						types.OptionNumberOfReplicas:    strconv.Itoa(v.Spec.NumberOfReplicas),
+						types.OptionStaleReplicaTimeout: strconv.Itoa(v.Spec.StaleReplicaTimeout),
+						types.OptionFromBackup:          v.Spec.FromBackup,
+						types.OptionBaseImage:           v.Spec.BaseImage,
+					},
+				},
+			},
+		},
+	}
+	if _, err := m.ds.CreatePersistentVolume(pv); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return nil, newError(ErrorReasonInvalidState, "PV %v already exists", pvName)
+		}
+		return nil, err
+	}
+
+	v, err = m.ds.UpdateVolumeStatusWithRetry(v, func(v *longhorn.Volume) {
+		v.Status.KubernetesStatus = types.KubernetesStatus{
+			PVName: pvName,
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Created PV %v for volume %v", pvName, volumeName)
+	return v, nil
+}
+
+// PVCCreate creates the PVC bound to the PV of the volume in the namespace
+func (m *VolumeManager) PVCCreate(volumeName, namespace, pvcName string) (v *longhorn.Volume, err error) {
+	defer func() {
+		err = errors.Wrapf(err, "unable to create PVC for volume %v", volumeName)
+	}()
+
+	if namespace == "" {
+		return nil, newError(ErrorReasonInvalidInput, "namespace is required")
+	}
+	if pvcName == "" {
+		pvcName = volumeName
+	}
+
+	v, err = m.getVolumeForKubernetes(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	ks := v.Status.KubernetesStatus
+	if ks.PVName == "" {
+		return nil, newError(ErrorReasonInvalidState, "volume %v has no PV", volumeName)
+	}
+	pv, err := m.ds.GetPersistentVolume(ks.PVName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, newError(ErrorReasonInvalidState, "cannot find PV %v of volume %v", ks.PVName, volumeName)
+		}
+		return nil, err
+	}
+	if pv.Spec.ClaimRef != nil {
+		return nil, newError(ErrorReasonInvalidState, "PV %v of volume %v is already claimed by PVC %v/%v",
+			pv.Name, volumeName, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+	}
+
+	storageClassName := pv.Spec.StorageClassName
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: pvcName,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: pv.Spec.AccessModes,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: pv.Spec.Capacity[corev1.ResourceStorage],
+				},
+			},
+			StorageClassName: &storageClassName,
+			VolumeName:       pv.Name,
+		},
+	}
+	if _, err := m.ds.CreatePersistentVolumeClaim(namespace, pvc); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return nil, newError(ErrorReasonInvalidState, "PVC %v/%v already exists", namespace, pvcName)
+		}
+		return nil, err
+	}
+
+	v, err = m.ds.UpdateVolumeStatusWithRetry(v, func(v *longhorn.Volume) {
+		v.Status.KubernetesStatus.Namespace = namespace
+		v.Status.KubernetesStatus.PVCName = pvcName
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Created PVC %v/%v for volume %v", namespace, pvcName, volumeName)
+	return v, nil
+}
+
+func (m *VolumeManager) getVolumeForKubernetes(volumeName string) (*longhorn.Volume, error) {
+	v, err := m.ds.GetVolume(volumeName)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", volumeName)
+		}
+		return nil, err
+	}
+	if v.DeletionTimestamp != nil {
+		return nil, newError(ErrorReasonInvalidState, "volume %v is being deleted", volumeName)
+	}
+	return v, nil
+}
+
+// cleanupPVForVolume deletes the PV created for the volume if its reclaim
+// policy is Delete. The PV with the policy Retain is kept for the user.
+func (m *VolumeManager) cleanupPVForVolume(v *longhorn.Volume) error {
+	pvName := v.Status.KubernetesStatus.PVName
+	if pvName == "" {
+		return nil
+	}
+	pv, err := m.ds.GetPersistentVolume(pvName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.VolumeHandle != v.Name {
+		// not the PV of the volume anymore
+		return nil
+	}
+	if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimDelete {
+		logrus.Infof("Keeping PV %v of volume %v with reclaim policy %v", pvName, v.Name, pv.Spec.PersistentVolumeReclaimPolicy)
+		return nil
+	}
+	if err := m.ds.DeletePersistentVolume(pvName); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	logrus.Infof("Deleted PV %v of volume %v", pvName, v.Name)
+	return nil
+}
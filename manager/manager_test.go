@@ -0,0 +1,176 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/scheduler"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+)
+
+const (
+	TestNamespace   = "default"
+	TestNode1       = "test-node-1"
+	TestNode2       = "test-node-2"
+	TestEngineImage = "longhorn-engine:latest"
+)
+
+// testVolumeManager is the volume manager on the fake clients. The objects
+// are read by the datastore from the informer indexers, which aren't synced
+// with the clients, so the objects are added to both by addObjects.
+type testVolumeManager struct {
+	*VolumeManager
+
+	lhClient            *lhfake.Clientset
+	kubeClient          *fake.Clientset
+	lhInformerFactory   lhinformerfactory.SharedInformerFactory
+	kubeInformerFactory informers.SharedInformerFactory
+	recorder            *record.FakeRecorder
+}
+
+func newTestVolumeManager() *testVolumeManager {
+	lhClient := lhfake.NewSimpleClientset()
+	kubeClient := fake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, 0)
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	ds := datastore.NewDataStore(
+		lhInformerFactory.Longhorn().V1alpha1().Volumes(),
+		lhInformerFactory.Longhorn().V1alpha1().Engines(),
+		lhInformerFactory.Longhorn().V1alpha1().Replicas(),
+		lhInformerFactory.Longhorn().V1alpha1().EngineImages(),
+		lhInformerFactory.Longhorn().V1alpha1().Nodes(),
+		lhInformerFactory.Longhorn().V1alpha1().Settings(),
+		lhInformerFactory.Longhorn().V1alpha1().Snapshots(),
+		lhClient,
+		kubeInformerFactory.Core().V1().Pods(),
+		kubeInformerFactory.Batch().V1beta1().CronJobs(),
+		kubeInformerFactory.Apps().V1beta2().DaemonSets(),
+		kubeInformerFactory.Core().V1().Events(),
+		kubeInformerFactory.Core().V1().PersistentVolumes(),
+		kubeInformerFactory.Core().V1().PersistentVolumeClaims(),
+		kubeInformerFactory.Storage().V1beta1().VolumeAttachments(),
+		kubeClient, TestNamespace)
+
+	recorder := record.NewFakeRecorder(100)
+	return &testVolumeManager{
+		VolumeManager: &VolumeManager{
+			ds:        ds,
+			scheduler: scheduler.NewReplicaScheduler(ds),
+
+			currentNodeID: TestNode1,
+
+			eventRecorder:    recorder,
+			engineLocks:      newEngineOperationLocks(),
+			backupStoreCache: newBackupStoreCache(),
+			backupAdmission:  ds.NewBackupAdmission(),
+			engineUpgrades:   newEngineUpgradeJobs(),
+		},
+		lhClient:            lhClient,
+		kubeClient:          kubeClient,
+		lhInformerFactory:   lhInformerFactory,
+		kubeInformerFactory: kubeInformerFactory,
+		recorder:            recorder,
+	}
+}
+
+// addObjects creates the Longhorn objects in the test namespace with the
+// client and adds them to the informer indexers
+func (m *testVolumeManager) addObjects(t *testing.T, objs ...runtime.Object) {
+	assert := require.New(t)
+
+	lh := m.lhClient.LonghornV1alpha1()
+	lhInformers := m.lhInformerFactory.Longhorn().V1alpha1()
+	for _, obj := range objs {
+		accessor, err := meta.Accessor(obj)
+		assert.Nil(err)
+		accessor.SetNamespace(TestNamespace)
+		switch o := obj.(type) {
+		case *longhorn.Volume:
+			o, err = lh.Volumes(TestNamespace).Create(o)
+			assert.Nil(err)
+			err = lhInformers.Volumes().Informer().GetIndexer().Add(o)
+		case *longhorn.Engine:
+			o, err = lh.Engines(TestNamespace).Create(o)
+			assert.Nil(err)
+			err = lhInformers.Engines().Informer().GetIndexer().Add(o)
+		case *longhorn.Replica:
+			o, err = lh.Replicas(TestNamespace).Create(o)
+			assert.Nil(err)
+			err = lhInformers.Replicas().Informer().GetIndexer().Add(o)
+		case *longhorn.EngineImage:
+			o, err = lh.EngineImages(TestNamespace).Create(o)
+			assert.Nil(err)
+			err = lhInformers.EngineImages().Informer().GetIndexer().Add(o)
+		case *longhorn.Node:
+			o, err = lh.Nodes(TestNamespace).Create(o)
+			assert.Nil(err)
+			err = lhInformers.Nodes().Informer().GetIndexer().Add(o)
+		case *longhorn.Setting:
+			o, err = lh.Settings(TestNamespace).Create(o)
+			assert.Nil(err)
+			err = lhInformers.Settings().Informer().GetIndexer().Add(o)
+		default:
+			t.Fatalf("unsupported object %T", obj)
+		}
+		assert.Nil(err)
+	}
+}
+
+// getVolume returns the volume from the client, which has the updates not
+// in the indexer
+func (m *testVolumeManager) getVolume(t *testing.T, name string) *longhorn.Volume {
+	v, err := m.lhClient.LonghornV1alpha1().Volumes(TestNamespace).Get(name, metav1.GetOptions{})
+	require.New(t).Nil(err)
+	return v
+}
+
+func newTestNode(name string) *longhorn.Node {
+	return &longhorn.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: TestNamespace,
+		},
+		Spec: types.NodeSpec{
+			AllowScheduling: true,
+		},
+		Status: types.NodeStatus{
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady: {
+					Type:   types.NodeConditionTypeReady,
+					Status: types.ConditionStatusTrue,
+				},
+			},
+		},
+	}
+}
+
+func newTestEngineImage(image string, cliAPIVersion int) *longhorn.EngineImage {
+	return &longhorn.EngineImage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      types.GetEngineImageChecksumName(image),
+			Namespace: TestNamespace,
+		},
+		Spec: types.EngineImageSpec{
+			Image: image,
+		},
+		Status: types.EngineImageStatus{
+			State: types.EngineImageStateReady,
+			EngineVersionDetails: types.EngineVersionDetails{
+				CLIAPIVersion: cliAPIVersion,
+			},
+		},
+	}
+}
@@ -2,8 +2,13 @@ package manager
 
 import (
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
+
+	"github.com/rancher/longhorn-manager/datastore"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 
@@ -14,12 +19,117 @@ func (m *VolumeManager) GetNode(name string) (*longhorn.Node, error) {
 	return m.ds.GetNode(name)
 }
 
-func (m *VolumeManager) UpdateNode(name string, allowScheduling bool) (*longhorn.Node, error) {
+// getNodeForUpdate returns the node, or the error of NotFound so the caller
+// can tell it apart from the failures of the datastore
+func (m *VolumeManager) getNodeForUpdate(name string) (*longhorn.Node, error) {
 	node, err := m.ds.GetNode(name)
 	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find node %v", name)
+		}
+		return nil, err
+	}
+	return node, nil
+}
+
+func (m *VolumeManager) UpdateNode(name string, allowScheduling, evictionRequested bool, tags []string) (*longhorn.Node, error) {
+	node, err := m.getNodeForUpdate(name)
+	if err != nil {
+		return nil, err
+	}
+	validTags, err := util.ValidateTags(tags)
+	if err != nil {
+		return nil, newError(ErrorReasonInvalidInput, "invalid tags of node %v: %v", name, err)
+	}
+	if err := m.warnRemovedNodeTags(node, validTags); err != nil {
 		return nil, err
 	}
 	node.Spec.AllowScheduling = allowScheduling
+	node.Spec.EvictionRequested = evictionRequested
+	// changing the tags only affects the replicas scheduled afterwards
+	node.Spec.Tags = validTags
+	return m.ds.UpdateNode(node)
+}
+
+// warnRemovedNodeTags logs a warning if a tag to be removed from the node is
+// required by a volume failed to schedule replicas. The removal is allowed,
+// since the volume may be satisfied by the other nodes.
+func (m *VolumeManager) warnRemovedNodeTags(node *longhorn.Node, tags []string) error {
+	removedTags := map[string]struct{}{}
+	for _, tag := range node.Spec.Tags {
+		removedTags[tag] = struct{}{}
+	}
+	for _, tag := range tags {
+		delete(removedTags, tag)
+	}
+	if len(removedTags) == 0 {
+		return nil
+	}
+	volumes, err := m.ds.ListVolumes()
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		condition := types.GetVolumeConditionFromStatus(v.Status, types.VolumeConditionTypeScheduled)
+		if condition.Status != types.ConditionStatusFalse {
+			continue
+		}
+		for _, tag := range v.Spec.NodeSelector {
+			if _, removed := removedTags[tag]; removed {
+				logrus.Warnf("Removing tag %v from node %v, which is required by volume %v failed to schedule replicas", tag, node.Name, v.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// EnterNodeMaintenanceMode stops scheduling to the node, and the volumes
+// attached to the node would be detached by the volume controller. It's
+// refused if any of the volumes has no healthy replica on the other nodes.
+func (m *VolumeManager) EnterNodeMaintenanceMode(name string) (*longhorn.Node, error) {
+	node, err := m.ds.GetNode(name)
+	if err != nil {
+		return nil, err
+	}
+	if node.Spec.MaintenanceMode {
+		return node, nil
+	}
+	volumes, err := m.ds.ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+	blockingVolumes := []string{}
+	for _, v := range volumes {
+		if v.Spec.NodeID != name {
+			continue
+		}
+		ok, err := m.ds.HasHealthyReplicaOnOtherNodes(v.Name, name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			blockingVolumes = append(blockingVolumes, v.Name)
+		}
+	}
+	if len(blockingVolumes) > 0 {
+		sort.Strings(blockingVolumes)
+		return nil, newError(ErrorReasonInvalidState, "cannot enter maintenance mode on node %v: volumes %v have no healthy replica on the other nodes", name, strings.Join(blockingVolumes, ", "))
+	}
+	node.Spec.MaintenanceMode = true
+	logrus.Infof("Node %v entered maintenance mode", name)
+	return m.ds.UpdateNode(node)
+}
+
+func (m *VolumeManager) ExitNodeMaintenanceMode(name string) (*longhorn.Node, error) {
+	node, err := m.ds.GetNode(name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.Spec.MaintenanceMode {
+		return node, nil
+	}
+	node.Spec.MaintenanceMode = false
+	logrus.Infof("Node %v exited maintenance mode", name)
 	return m.ds.UpdateNode(node)
 }
 
@@ -48,8 +158,10 @@ func (m *VolumeManager) ListNodesSorted() ([]*longhorn.Node, error) {
 	return nodes, nil
 }
 
+// DiskUpdate replaces the disks of the node. It must be called on the node,
+// since the disks are checked on the file system.
 func (m *VolumeManager) DiskUpdate(name string, updateDisks []types.DiskSpec) (*longhorn.Node, error) {
-	node, err := m.ds.GetNode(name)
+	node, err := m.getNodeForUpdate(name)
 	if err != nil {
 		return nil, err
 	}
@@ -57,10 +169,24 @@ func (m *VolumeManager) DiskUpdate(name string, updateDisks []types.DiskSpec) (*
 	originDisks := node.Spec.Disks
 	diskUpdateMap := map[string]types.DiskSpec{}
 
-	for _, uDisk := range updateDisks {
+	for i, uDisk := range updateDisks {
+		if !filepath.IsAbs(uDisk.Path) {
+			return nil, newError(ErrorReasonInvalidInput, "Add Disk on node %v error: The path %v of disk is not an absolute path", name, uDisk.Path)
+		}
 		diskInfo, err := util.GetDiskInfo(uDisk.Path)
 		if err != nil {
-			return nil, err
+			return nil, newError(ErrorReasonInvalidInput, "Add Disk on node %v error: %v", name, err)
+		}
+		if util.IsVirtualFilesystem(diskInfo.Type) {
+			return nil, newError(ErrorReasonInvalidInput, "Add Disk on node %v error: The disk %v is on %v file system, which is not backed by a storage device", name, uDisk.Path, diskInfo.Type)
+		}
+		for _, disk := range updateDisks[i+1:] {
+			if util.IsPathNested(disk.Path, uDisk.Path) {
+				return nil, newError(ErrorReasonInvalidInput, "Add Disk on node %v error: The disk %v overlaps with the disk %v", name, uDisk.Path, disk.Path)
+			}
+		}
+		if uDisk.Tags, err = util.ValidateTags(uDisk.Tags); err != nil {
+			return nil, newError(ErrorReasonInvalidInput, "Update disk on node %v error: The tags of disk %v are not valid: %v", name, uDisk.Path, err)
 		}
 		isInvalid := false
 		for fsid, oDisk := range originDisks {
@@ -73,13 +199,13 @@ func (m *VolumeManager) DiskUpdate(name string, updateDisks []types.DiskSpec) (*
 		}
 		if !isInvalid {
 			if uDisk.StorageReserved < 0 || uDisk.StorageReserved > diskInfo.StorageMaximum {
-				return nil, fmt.Errorf("Update disk on node %v error: The storageReserved setting of disk %v is not valid, should be positive and no more than storageMaximum and storageAvailable", name, uDisk.Path)
+				return nil, newError(ErrorReasonInvalidInput, "Update disk on node %v error: The storageReserved setting of disk %v is not valid, should be positive and no more than storageMaximum and storageAvailable", name, uDisk.Path)
 			}
 			// update disks
 			if oDisk, ok := originDisks[diskInfo.Fsid]; ok {
 				if oDisk.Path != uDisk.Path {
 					// current disk is the same file system with exist disk
-					return nil, fmt.Errorf("Add Disk on node %v error: The disk %v is the same file system with %v ", name, uDisk.Path, oDisk.Path)
+					return nil, newError(ErrorReasonInvalidInput, "Add Disk on node %v error: The disk %v is the same file system with %v ", name, uDisk.Path, oDisk.Path)
 				}
 				diskUpdateMap[diskInfo.Fsid] = uDisk
 			} else {
@@ -90,38 +216,92 @@ func (m *VolumeManager) DiskUpdate(name string, updateDisks []types.DiskSpec) (*
 	}
 
 	// delete disks
+	replicaDiskMap, err := m.ds.ListReplicasByNode(name)
+	if err != nil {
+		return nil, err
+	}
 	for fsid, oDisk := range originDisks {
-		if _, ok := diskUpdateMap[fsid]; !ok {
-			if oDisk.AllowScheduling || node.Status.DiskStatus[fsid].StorageScheduled != 0 {
-				return nil, fmt.Errorf("Delete Disk on node %v error: Please disable the disk %v and remove all replicas first ", name, oDisk.Path)
+		if _, ok := diskUpdateMap[fsid]; ok {
+			continue
+		}
+		if oDisk.AllowScheduling {
+			return nil, newError(ErrorReasonInvalidState, "Delete Disk on node %v error: Please disable the disk %v and remove all replicas first ", name, oDisk.Path)
+		}
+		// including the replicas accounted by the node controller but
+		// not in the cache yet
+		blockingReplicaSet := map[string]struct{}{}
+		for _, r := range replicaDiskMap[fsid] {
+			blockingReplicaSet[r.Name] = struct{}{}
+		}
+		if diskStatus, ok := node.Status.DiskStatus[fsid]; ok {
+			for rName := range diskStatus.ScheduledReplica {
+				blockingReplicaSet[rName] = struct{}{}
 			}
 		}
+		if len(blockingReplicaSet) > 0 {
+			blockingReplicas := []string{}
+			for rName := range blockingReplicaSet {
+				blockingReplicas = append(blockingReplicas, rName)
+			}
+			sort.Strings(blockingReplicas)
+			return nil, newError(ErrorReasonInvalidState, "Delete Disk on node %v error: Please remove the replicas %v on the disk %v first", name, strings.Join(blockingReplicas, ", "), oDisk.Path)
+		}
 	}
 	node.Spec.Disks = diskUpdateMap
 
 	return m.ds.UpdateNode(node)
 }
 
-func (m *VolumeManager) DeleteNode(name string) error {
+// DeleteOrphanedReplicaDirectory deletes the replica directory on the disk
+// which has been reported as orphaned by the node controller
+func (m *VolumeManager) DeleteOrphanedReplicaDirectory(name, diskID, dirName string) (*longhorn.Node, error) {
 	node, err := m.ds.GetNode(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// only remove node from longhorn without any volumes on it
-	replicas, err := m.ds.ListReplicasByNode(name)
+	disk, ok := node.Spec.Disks[diskID]
+	if !ok {
+		return nil, fmt.Errorf("cannot find disk %v on node %v", diskID, name)
+	}
+	diskStatus := node.Status.DiskStatus[diskID]
+	if _, ok := diskStatus.OrphanedReplicaDirectories[dirName]; !ok {
+		return nil, fmt.Errorf("cannot find orphaned replica directory %v of disk %v on node %v", dirName, disk.Path, name)
+	}
+
+	// the replica may have been scheduled to the disk after the scan
+	replicaDiskMap, err := m.ds.ListReplicasByNode(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	engines, err := m.ds.ListEnginesByNode(name)
+	for _, r := range replicaDiskMap[diskID] {
+		if filepath.Base(r.Spec.DataPath) == dirName {
+			return nil, fmt.Errorf("replica directory %v of disk %v on node %v is in use by replica %v", dirName, disk.Path, name, r.Name)
+		}
+	}
+
+	if err := util.DeleteReplicaDirectory(disk.Path, dirName); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Deleted orphaned replica directory %v of disk %v on node %v", dirName, disk.Path, name)
+
+	return m.ds.UpdateNodeStatusWithRetry(node, func(n *longhorn.Node) {
+		diskStatus, ok := n.Status.DiskStatus[diskID]
+		if !ok {
+			return
+		}
+		delete(diskStatus.OrphanedReplicaDirectories, dirName)
+		n.Status.DiskStatus[diskID] = diskStatus
+	})
+}
+
+func (m *VolumeManager) DeleteNode(name string) error {
+	node, err := m.ds.GetNode(name)
 	if err != nil {
 		return err
 	}
-	condition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
-	// Only could delete node from longhorn if kubernetes node missing
-	if condition.Status == types.ConditionStatusTrue || condition.Reason != types.NodeConditionReasonKubernetesNodeDown ||
-		node.Spec.AllowScheduling || len(replicas) > 0 || len(engines) > 0 {
-		return fmt.Errorf("Could not delete node %v with node ready condition is %v, reason is %v, node schedulable %v, and %v replica, %v engine running on it", name,
-			condition.Status, condition.Reason, node.Spec.AllowScheduling, len(replicas), len(engines))
+	// only remove node from longhorn without any volumes on it
+	if err := m.ds.CheckNodeDeletable(node); err != nil {
+		return err
 	}
 	// before delete, clear ownerID of volumes and engine images handle by removed node
 	eiList, err := m.ds.ListEngineImages()
@@ -0,0 +1,57 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+func newTestHealthyReplica(name, volumeName, nodeID string) *longhorn.Replica {
+	return &longhorn.Replica{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{datastore.LonghornVolumeKey: volumeName},
+		},
+		Spec: types.ReplicaSpec{
+			InstanceSpec: types.InstanceSpec{
+				VolumeName: volumeName,
+				NodeID:     nodeID,
+			},
+			DiskID:    "test-disk",
+			HealthyAt: "2019-01-01T00:00:00Z",
+		},
+	}
+}
+
+func TestEnterNodeMaintenanceMode(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestVolumeManager()
+	v := newTestVolume("vol-attached", 1024, 100, types.VolumeStateAttached, TestNode1)
+	m.addObjects(t, v, newTestNode(TestNode1), newTestNode(TestNode2),
+		newTestHealthyReplica("vol-attached-r-1", v.Name, TestNode1))
+
+	// the volume would lose its only healthy replica
+	_, err := m.EnterNodeMaintenanceMode(TestNode1)
+	assert.NotNil(err)
+	e, ok := errors.Cause(err).(*Error)
+	assert.True(ok)
+	assert.Equal(ErrorReasonInvalidState, e.Reason)
+	assert.Contains(e.Message, v.Name)
+	node, err := m.lhClient.LonghornV1alpha1().Nodes(TestNamespace).Get(TestNode1, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.False(node.Spec.MaintenanceMode)
+
+	m.addObjects(t, newTestHealthyReplica("vol-attached-r-2", v.Name, TestNode2))
+	node, err = m.EnterNodeMaintenanceMode(TestNode1)
+	assert.Nil(err)
+	assert.True(node.Spec.MaintenanceMode)
+}
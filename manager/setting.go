@@ -3,8 +3,12 @@ package manager
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/Sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
 	"github.com/rancher/longhorn-manager/types"
@@ -13,6 +17,11 @@ import (
 	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
 )
 
+const (
+	EventReasonUpdateSetting       = "UpdateSetting"
+	EventReasonForcedSettingChange = "ForcedSettingChange"
+)
+
 func (m *VolumeManager) GetSettingValueExisted(sName types.SettingName) (string, error) {
 	setting, err := m.GetSetting(sName)
 	if err != nil {
@@ -28,6 +37,10 @@ func (m *VolumeManager) GetSetting(sName types.SettingName) (*longhorn.Setting,
 	return m.ds.GetSetting(sName)
 }
 
+func (m *VolumeManager) GetSettingAsInt(sName types.SettingName) (int64, error) {
+	return m.ds.GetSettingAsInt(sName)
+}
+
 func (m *VolumeManager) ListSettings() (map[types.SettingName]*longhorn.Setting, error) {
 	return m.ds.ListSettings()
 }
@@ -49,24 +62,157 @@ func (m *VolumeManager) ListSettingsSorted() ([]*longhorn.Setting, error) {
 	return settings, nil
 }
 
-func (m *VolumeManager) CreateOrUpdateSetting(s *longhorn.Setting) (*longhorn.Setting, error) {
+// CreateOrUpdateSetting sets the value of the setting. The change is
+// recorded as an event of the setting and in the history in its status,
+// with the requester if known.
+//
+// The change disrupting the operations in progress is rejected, unless
+// forced, in which case a warning event is recorded.
+func (m *VolumeManager) CreateOrUpdateSetting(s *longhorn.Setting, requester string, force bool) (*longhorn.Setting, error) {
 	err := m.SettingValidation(s.Name, s.Value)
 	if err != nil {
 		return nil, err
 	}
+	sName := types.SettingName(s.Name)
+	oldValue := ""
+	if old, err := m.ds.GetSetting(sName); err == nil {
+		oldValue = old.Value
+	}
+	changed := oldValue != s.Value
+	blocker := ""
+	if changed {
+		if blocker, err = m.getSettingChangeBlocker(sName); err != nil {
+			return nil, err
+		}
+		if blocker != "" && !force {
+			return nil, newError(ErrorReasonInvalidState, "cannot change setting %v while %v", sName, blocker)
+		}
+		s.Status.History = types.AppendSettingChange(s.Status.History, types.SettingChange{
+			Time:      util.Now(),
+			OldValue:  scrubSettingValue(sName, oldValue),
+			NewValue:  scrubSettingValue(sName, s.Value),
+			Requester: requester,
+		})
+	}
 	setting, err := m.ds.UpdateSetting(s)
 	if err != nil {
-		if apierrors.IsNotFound(err) {
-			return m.ds.CreateSetting(s)
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		if setting, err = m.ds.CreateSetting(s); err != nil {
+			return nil, err
+		}
+	}
+	if changed {
+		m.recordSettingChange(setting, oldValue, requester)
+		if blocker != "" {
+			m.eventRecorder.Eventf(setting, corev1.EventTypeWarning, EventReasonForcedSettingChange,
+				"Forced to change setting %v while %v", sName, blocker)
+			logrus.Warnf("Forced to change setting %v while %v", sName, blocker)
 		}
-		return nil, err
+	}
+	if sName == types.SettingNameDefaultEngineImage && oldValue != "" && changed {
+		go m.autoUpgradeEngineToDefaultImage(oldValue, setting.Value)
 	}
 	return setting, nil
 }
 
+func (m *VolumeManager) recordSettingChange(setting *longhorn.Setting, oldValue, requester string) {
+	sName := types.SettingName(setting.Name)
+	by := ""
+	if requester != "" {
+		by = " by " + requester
+	}
+	m.eventRecorder.Eventf(setting, corev1.EventTypeNormal, EventReasonUpdateSetting,
+		"Changed setting %v from %q to %q%v", sName,
+		scrubSettingValue(sName, oldValue), scrubSettingValue(sName, setting.Value), by)
+	logrus.Infof("Changed setting %v%v", sName, by)
+}
+
+// getSettingChangeBlocker describes the operations in progress the change of
+// the setting would disrupt, or returns empty if there is none:
+//   - the backups and the restores keep using the backup target and the
+//     credential they started with
+//   - the engine upgrades are on the way to the default engine image
+func (m *VolumeManager) getSettingChangeBlocker(name types.SettingName) (string, error) {
+	switch name {
+	case types.SettingNameBackupTarget, types.SettingNameBackupTargetCredentialSecret:
+		volumes, err := m.listVolumesUsingBackupTarget()
+		if err != nil {
+			return "", err
+		}
+		if len(volumes) != 0 {
+			return fmt.Sprintf("backups or restores are in progress for volumes %v", strings.Join(volumes, ", ")), nil
+		}
+	case types.SettingNameDefaultEngineImage:
+		if count := m.CountRunningEngineUpgradeJobs(); count != 0 {
+			return fmt.Sprintf("%v engine upgrade jobs are running", count), nil
+		}
+		volumes, err := m.listVolumesUpgradingEngine()
+		if err != nil {
+			return "", err
+		}
+		if len(volumes) != 0 {
+			return fmt.Sprintf("engine upgrades are in progress for volumes %v", strings.Join(volumes, ", ")), nil
+		}
+	}
+	return "", nil
+}
+
+// listVolumesUsingBackupTarget returns the volumes backing up or restoring,
+// sorted by name
+func (m *VolumeManager) listVolumesUsingBackupTarget() ([]string, error) {
+	volumes := map[string]struct{}{}
+	tickets, err := m.ListBackupTickets()
+	if err != nil {
+		return nil, err
+	}
+	for volumeName, volumeTickets := range tickets {
+		for _, t := range volumeTickets {
+			if !t.IsFinished() {
+				volumes[volumeName] = struct{}{}
+			}
+		}
+	}
+	replicas, err := m.ds.ListReplicasRO()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range replicas {
+		// the replica becomes healthy once the restore is done
+		if r.Spec.RestoreFrom != "" && r.Spec.HealthyAt == "" {
+			volumes[r.Spec.VolumeName] = struct{}{}
+		}
+	}
+	return sortKeys(volumes)
+}
+
+// listVolumesUpgradingEngine returns the volumes whose engine upgrade hasn't
+// been done, sorted by name
+func (m *VolumeManager) listVolumesUpgradingEngine() ([]string, error) {
+	volumes, err := m.ds.ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, v := range volumes {
+		if v.Status.CurrentImage != "" && v.Status.CurrentImage != v.Spec.EngineImage {
+			result = append(result, v.Name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// SettingValidation checks the value against the setting definition, then
+// the change requirement of the setting if any
 func (m *VolumeManager) SettingValidation(name, value string) error {
 	sName := types.SettingName(name)
 
+	if err := types.ValidateSettingValue(sName, value); err != nil {
+		return newError(ErrorReasonInvalidInput, "fail to set settings: %v", err)
+	}
+
 	switch sName {
 	case types.SettingNameBackupTarget:
 		// additional check whether have $ or , have been set in BackupTarget
@@ -74,20 +220,30 @@ func (m *VolumeManager) SettingValidation(name, value string) error {
 		reg := regexp.MustCompile(regStr)
 		findStr := reg.FindAllString(value, -1)
 		if len(findStr) != 0 {
-			return fmt.Errorf("fail to set settings with invalid BackupTarget %s, contains %v", value, strings.Join(findStr, " or "))
-		}
-	case types.SettingNameStorageOverProvisioningPercentage:
-		// additional check whether over provisioning percentage is positive
-		value, err := util.ConvertSize(value)
-		if err != nil || value < 0 {
-			return fmt.Errorf("fail to set settings with invalid StorageOverProvisioningPercentag %v, value should be positive", value)
+			return newError(ErrorReasonInvalidInput, "fail to set settings with invalid BackupTarget %s, contains %v", value, strings.Join(findStr, " or "))
 		}
-	case types.SettingNameStorageMinimalAvailablePercentage:
-		// additional check whether minimal available percentage is between 0 to 100
-		value, err := util.ConvertSize(value)
-		if err != nil || value < 0 || value > 100 {
-			return fmt.Errorf("fail to set settings with invalid StorageMinimalAvailablePercentage %v, value should between 0 to 100", value)
+	case types.SettingNameBackupTargetCredentialSecret:
+		if err := m.validateBackupTargetCredentialSecret(value); err != nil {
+			return newError(ErrorReasonInvalidInput, "fail to set settings with invalid BackupTargetCredentialSecret %v: %v", value, err)
 		}
 	}
 	return nil
 }
+
+// validateBackupTargetCredentialSecret checks the content of the backup
+// target credential secret. The secret may be created after it's referred,
+// but what's in it must be valid.
+func (m *VolumeManager) validateBackupTargetCredentialSecret(secretName string) error {
+	if secretName == "" {
+		return nil
+	}
+	credential, err := m.ds.GetCredentialFromSecret(secretName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			logrus.Warnf("Backup target credential secret %v doesn't exist yet", secretName)
+			return nil
+		}
+		return err
+	}
+	return util.ValidateBackupCredential(credential)
+}
@@ -0,0 +1,27 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/rancher/longhorn-manager/types"
+)
+
+func TestSettingValidationConcurrentDiskEvictionLimit(t *testing.T) {
+	assert := require.New(t)
+
+	m := &VolumeManager{}
+	for _, value := range []string{"1", "3", "100"} {
+		assert.Nil(m.SettingValidation(string(types.SettingNameConcurrentDiskEvictionLimit), value), value)
+	}
+	// the limit is a plain count, not a size
+	for _, value := range []string{"", "0", "-1", "1Ki", "1.5", "one"} {
+		err := m.SettingValidation(string(types.SettingNameConcurrentDiskEvictionLimit), value)
+		assert.NotNil(err, value)
+		managerErr, ok := errors.Cause(err).(*Error)
+		assert.True(ok, value)
+		assert.Equal(ErrorReasonInvalidInput, managerErr.Reason, value)
+	}
+}
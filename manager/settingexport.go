@@ -0,0 +1,199 @@
+package manager
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/rancher/longhorn-manager/meta"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	SettingsExportFormatVersion = "v1"
+
+	SettingImportStatusApplied   = "applied"
+	SettingImportStatusUnchanged = "unchanged"
+	SettingImportStatusSkipped   = "skipped"
+	SettingImportStatusFailed    = "failed"
+)
+
+var (
+	// environmentSpecificSettings depend on the nodes of the cluster, or
+	// the registries the nodes can pull from, so they're only imported if
+	// forced
+	environmentSpecificSettings = map[types.SettingName]bool{
+		types.SettingNameTaintToleration:               true,
+		types.SettingNameCreateDefaultDiskLabeledNodes: true,
+		types.SettingNameCSIAttacherImage:              true,
+		types.SettingNameCSIProvisionerImage:           true,
+		types.SettingNameCSIDriverRegistrarImage:       true,
+		types.SettingNameCSISnapshotterImage:           true,
+		types.SettingNameCSINodeSelector:               true,
+		types.SettingNameCSIPriorityClass:              true,
+	}
+)
+
+// SettingsExport is the document of all the settings which can be set, to
+// be imported to another cluster. The read-only settings are left out.
+type SettingsExport struct {
+	FormatVersion   string `json:"formatVersion"`
+	LonghornVersion string `json:"longhornVersion"`
+	ExportedAt      string `json:"exportedAt"`
+
+	Settings map[types.SettingName]string `json:"settings"`
+	// Redacted are the settings carrying the credentials whose values are
+	// left out of the export. They're skipped on import.
+	Redacted []types.SettingName `json:"redacted"`
+}
+
+type SettingImportResult struct {
+	Name    types.SettingName `json:"name"`
+	Status  string            `json:"status"`
+	Message string            `json:"message"`
+}
+
+// isCredentialSettingValue returns true if the value of the setting carries
+// the credential: the credential secret, or the backup target URL with a
+// password
+func isCredentialSettingValue(name types.SettingName, value string) bool {
+	switch name {
+	case types.SettingNameBackupTargetCredentialSecret:
+		return value != ""
+	case types.SettingNameBackupTarget:
+		u, err := url.Parse(value)
+		if err != nil {
+			return strings.Contains(value, "@")
+		}
+		if u.User == nil {
+			return false
+		}
+		_, hasPassword := u.User.Password()
+		return hasPassword
+	}
+	return false
+}
+
+// ExportSettings exports the values of the settings, leaving the credentials
+// out unless included
+func (m *VolumeManager) ExportSettings(includeCredentials bool) (*SettingsExport, error) {
+	settings, err := m.ListSettings()
+	if err != nil {
+		return nil, err
+	}
+	export := &SettingsExport{
+		FormatVersion:   SettingsExportFormatVersion,
+		LonghornVersion: meta.Version,
+		ExportedAt:      util.Now(),
+		Settings:        map[types.SettingName]string{},
+		Redacted:        []types.SettingName{},
+	}
+	for name, definition := range types.SettingDefinitions {
+		if definition.ReadOnly {
+			continue
+		}
+		value := definition.Default
+		if setting, ok := settings[name]; ok {
+			value = setting.Value
+		}
+		if !includeCredentials && isCredentialSettingValue(name, value) {
+			export.Redacted = append(export.Redacted, name)
+			continue
+		}
+		export.Settings[name] = value
+	}
+	sort.Slice(export.Redacted, func(i, j int) bool { return export.Redacted[i] < export.Redacted[j] })
+	return export, nil
+}
+
+// ImportSettings applies the settings of the export one by one through the
+// same validation as setting them by the API. Each setting is either applied
+// as a whole or not at all, and the failure of one doesn't stop the others.
+// The settings already having the value are left untouched, so importing the
+// same document again changes nothing.
+func (m *VolumeManager) ImportSettings(export *SettingsExport, force bool, requester string) ([]SettingImportResult, error) {
+	if export.FormatVersion != SettingsExportFormatVersion {
+		return nil, newError(ErrorReasonInvalidInput, "unsupported settings export format version %q, expect %v",
+			export.FormatVersion, SettingsExportFormatVersion)
+	}
+
+	names := []string{}
+	for name := range export.Settings {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	results := []SettingImportResult{}
+	for _, name := range names {
+		sName := types.SettingName(name)
+		result := m.importSetting(sName, strings.TrimSpace(export.Settings[sName]), force, requester)
+		if result.Status == SettingImportStatusFailed {
+			logrus.Warnf("Fail to import setting %v: %v", name, result.Message)
+		}
+		results = append(results, result)
+	}
+	for _, name := range export.Redacted {
+		if _, ok := export.Settings[name]; ok {
+			continue
+		}
+		results = append(results, SettingImportResult{
+			Name:    name,
+			Status:  SettingImportStatusSkipped,
+			Message: "the value was redacted in the export",
+		})
+	}
+	return results, nil
+}
+
+func (m *VolumeManager) importSetting(name types.SettingName, value string, force bool, requester string) SettingImportResult {
+	result := SettingImportResult{Name: name}
+	definition, ok := types.SettingDefinitions[name]
+	if !ok {
+		result.Status = SettingImportStatusFailed
+		result.Message = "unknown setting"
+		return result
+	}
+	if definition.ReadOnly {
+		result.Status = SettingImportStatusSkipped
+		result.Message = "the setting is read-only"
+		return result
+	}
+	if environmentSpecificSettings[name] && !force {
+		result.Status = SettingImportStatusSkipped
+		result.Message = "the setting is specific to the cluster, import it by force"
+		return result
+	}
+
+	current, err := m.GetSetting(name)
+	if err != nil {
+		result.Status = SettingImportStatusFailed
+		result.Message = err.Error()
+		return result
+	}
+	if current.Value == value {
+		result.Status = SettingImportStatusUnchanged
+		return result
+	}
+	if err := m.SettingValidation(string(name), value); err != nil {
+		result.Status = SettingImportStatusFailed
+		result.Message = err.Error()
+		return result
+	}
+	if _, err := util.RetryOnConflictCause(func() (interface{}, error) {
+		setting, err := m.GetSetting(name)
+		if err != nil {
+			return nil, err
+		}
+		setting.Value = value
+		return m.CreateOrUpdateSetting(setting, requester, false)
+	}); err != nil {
+		result.Status = SettingImportStatusFailed
+		result.Message = err.Error()
+		return result
+	}
+	result.Status = SettingImportStatusApplied
+	return result
+}
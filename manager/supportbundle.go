@@ -0,0 +1,485 @@
+package manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+type SupportBundleState string
+
+const (
+	SupportBundleStateInProgress       = SupportBundleState("InProgress")
+	SupportBundleStateReadyForDownload = SupportBundleState("ReadyForDownload")
+	SupportBundleStateError            = SupportBundleState("Error")
+
+	// the log of each container is truncated to this size
+	supportBundleLogLimitBytes = 20 * 1024 * 1024
+
+	supportBundleRedacted = "REDACTED"
+)
+
+var supportBundleDirectory = filepath.Join(os.TempDir(), "longhorn-support-bundles")
+
+// SupportBundle is the status of the support bundle generated by the manager.
+// The bundle is kept on the node generating it, and only the latest one is
+// kept.
+type SupportBundle struct {
+	Name     string             `json:"name"`
+	NodeID   string             `json:"nodeID"`
+	State    SupportBundleState `json:"state"`
+	Progress int                `json:"progress"`
+	Errors   []string           `json:"errors"`
+	Filename string             `json:"filename"`
+	Size     int64              `json:"size"`
+
+	path string
+}
+
+type supportBundleItem struct {
+	// the path of the file in the bundle
+	name    string
+	collect func() ([]byte, error)
+}
+
+type supportBundles struct {
+	lock   sync.RWMutex
+	latest *SupportBundle
+}
+
+func (b *supportBundles) get(name string) *SupportBundle {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.latest == nil || b.latest.Name != name {
+		return nil
+	}
+	bundle := *b.latest
+	bundle.Errors = append([]string{}, b.latest.Errors...)
+	return &bundle
+}
+
+func (b *supportBundles) update(name string, f func(bundle *SupportBundle)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.latest == nil || b.latest.Name != name {
+		return
+	}
+	f(b.latest)
+}
+
+// CreateSupportBundle starts collecting the support bundle in the background
+// and returns the status of it. Only one bundle is collected at a time.
+func (m *VolumeManager) CreateSupportBundle() (*SupportBundle, error) {
+	now := time.Now().UTC()
+	name := fmt.Sprintf("longhorn-support-bundle_%v_%v", m.currentNodeID, now.Format("2006-01-02T15-04-05Z"))
+	bundle := &SupportBundle{
+		Name:     name,
+		NodeID:   m.currentNodeID,
+		State:    SupportBundleStateInProgress,
+		Errors:   []string{},
+		Filename: name + ".tar.gz",
+		path:     filepath.Join(supportBundleDirectory, name+".tar.gz"),
+	}
+
+	m.supportBundles.lock.Lock()
+	previous := m.supportBundles.latest
+	if previous != nil && previous.State == SupportBundleStateInProgress {
+		m.supportBundles.lock.Unlock()
+		return nil, fmt.Errorf("support bundle %v is in progress", previous.Name)
+	}
+	m.supportBundles.latest = bundle
+	m.supportBundles.lock.Unlock()
+
+	if previous != nil {
+		if err := os.Remove(previous.path); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Fail to remove the previous support bundle %v: %v", previous.path, err)
+		}
+	}
+
+	go m.collectSupportBundle(name, bundle.path)
+
+	return m.supportBundles.get(name), nil
+}
+
+// IsSupportBundleInProgress returns if a support bundle is being collected
+func (m *VolumeManager) IsSupportBundleInProgress() bool {
+	m.supportBundles.lock.RLock()
+	defer m.supportBundles.lock.RUnlock()
+	return m.supportBundles.latest != nil && m.supportBundles.latest.State == SupportBundleStateInProgress
+}
+
+func (m *VolumeManager) GetSupportBundle(name string) *SupportBundle {
+	return m.supportBundles.get(name)
+}
+
+// OpenSupportBundle returns the file of the bundle ready for download
+func (m *VolumeManager) OpenSupportBundle(name string) (*SupportBundle, io.ReadCloser, error) {
+	bundle := m.supportBundles.get(name)
+	if bundle == nil {
+		return nil, nil, nil
+	}
+	if bundle.State != SupportBundleStateReadyForDownload {
+		return nil, nil, fmt.Errorf("support bundle %v is not ready for download but %v", name, bundle.State)
+	}
+	f, err := os.Open(bundle.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bundle, f, nil
+}
+
+func (m *VolumeManager) collectSupportBundle(name, path string) {
+	if err := m.writeSupportBundle(name, path); err != nil {
+		logrus.Errorf("Fail to collect support bundle %v: %v", name, err)
+		m.supportBundles.update(name, func(bundle *SupportBundle) {
+			bundle.State = SupportBundleStateError
+			bundle.Errors = append(bundle.Errors, err.Error())
+		})
+		return
+	}
+	fi, err := os.Stat(path)
+	m.supportBundles.update(name, func(bundle *SupportBundle) {
+		if err != nil {
+			bundle.State = SupportBundleStateError
+			bundle.Errors = append(bundle.Errors, err.Error())
+			return
+		}
+		bundle.State = SupportBundleStateReadyForDownload
+		bundle.Progress = 100
+		bundle.Size = fi.Size()
+	})
+	logrus.Infof("Support bundle %v is ready for download", name)
+}
+
+// writeSupportBundle writes the items into the tar.gz file. The failure of
+// an item is recorded in the status of the bundle rather than failing the
+// whole bundle.
+func (m *VolumeManager) writeSupportBundle(name, path string) (err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	gw := gzip.NewWriter(f)
+	defer func() {
+		if closeErr := gw.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	tw := tar.NewWriter(gw)
+	defer func() {
+		if closeErr := tw.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	items := m.getSupportBundleItems()
+	secrets := m.getSupportBundleSecrets()
+	itemErrors := []string{}
+	for i, item := range items {
+		data, err := item.collect()
+		if err != nil {
+			itemErr := string(redactSecrets([]byte(fmt.Sprintf("fail to collect %v: %v", item.name, err)), secrets))
+			itemErrors = append(itemErrors, itemErr)
+			m.supportBundles.update(name, func(bundle *SupportBundle) {
+				bundle.Errors = append(bundle.Errors, itemErr)
+			})
+		} else if err := writeTarFile(tw, filepath.Join(name, item.name), redactSecrets(data, secrets)); err != nil {
+			return errors.Wrapf(err, "fail to write %v", item.name)
+		}
+		progress := (i + 1) * 100 / (len(items) + 1)
+		m.supportBundles.update(name, func(bundle *SupportBundle) {
+			bundle.Progress = progress
+		})
+	}
+	if len(itemErrors) != 0 {
+		data := []byte(strings.Join(itemErrors, "\n") + "\n")
+		if err := writeTarFile(tw, filepath.Join(name, "errors.log"), data); err != nil {
+			return errors.Wrap(err, "fail to write errors.log")
+		}
+	}
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func toYAML(obj interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(obj)
+}
+
+func (m *VolumeManager) getSupportBundleItems() []supportBundleItem {
+	items := []supportBundleItem{
+		{"yamls/longhorn/volumes.yaml", func() ([]byte, error) {
+			volumes, err := m.ds.ListVolumes()
+			if err != nil {
+				return nil, err
+			}
+			return yaml.Marshal(scrubVolumes(volumes))
+		}},
+		{"yamls/longhorn/engines.yaml", func() ([]byte, error) {
+			return toYAML(m.ds.ListEnginesRO())
+		}},
+		{"yamls/longhorn/replicas.yaml", func() ([]byte, error) {
+			replicas, err := m.ds.ListReplicasRO()
+			if err != nil {
+				return nil, err
+			}
+			return yaml.Marshal(scrubReplicas(replicas))
+		}},
+		{"yamls/longhorn/engineimages.yaml", func() ([]byte, error) {
+			return toYAML(m.ds.ListEngineImages())
+		}},
+		// the status of the nodes includes the status of the disks
+		{"yamls/longhorn/nodes.yaml", func() ([]byte, error) {
+			return toYAML(m.ds.ListNodes())
+		}},
+		{"yamls/longhorn/settings.yaml", func() ([]byte, error) {
+			settings, err := m.ds.ListSettings()
+			if err != nil {
+				return nil, err
+			}
+			return yaml.Marshal(scrubSettings(settings))
+		}},
+		{"yamls/kubernetes/pods.yaml", func() ([]byte, error) {
+			return toYAML(m.ds.ListPodsRO())
+		}},
+		{"yamls/kubernetes/events.yaml", func() ([]byte, error) {
+			return toYAML(m.ds.ListNamespaceEvents())
+		}},
+	}
+
+	pods, err := m.ds.ListPodsRO()
+	if err != nil {
+		// reported by the item of pods.yaml
+		logrus.Warnf("Fail to list pods for the logs of the support bundle: %v", err)
+		return items
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Name < pods[j].Name
+	})
+	for _, pod := range pods {
+		for _, container := range pod.Spec.Containers {
+			podName := pod.Name
+			containerName := container.Name
+			items = append(items, supportBundleItem{
+				name: filepath.Join("logs", podName, containerName+".log"),
+				collect: func() ([]byte, error) {
+					return m.ds.GetPodContainerLog(podName, containerName, supportBundleLogLimitBytes)
+				},
+			})
+		}
+	}
+	return items
+}
+
+// scrubSettings returns the copy of the settings without the credentials
+func scrubSettings(settings map[types.SettingName]*longhorn.Setting) map[types.SettingName]*longhorn.Setting {
+	result := map[types.SettingName]*longhorn.Setting{}
+	for name, setting := range settings {
+		s := setting.DeepCopy()
+		s.Value = scrubSettingValue(name, s.Value)
+		s.Status.BackupTarget = scrubURL(s.Status.BackupTarget)
+		for i := range s.Status.History {
+			change := &s.Status.History[i]
+			change.OldValue = scrubSettingValue(name, change.OldValue)
+			change.NewValue = scrubSettingValue(name, change.NewValue)
+		}
+		result[name] = s
+	}
+	return result
+}
+
+// scrubSettingValue returns the value of the setting without the credentials
+func scrubSettingValue(name types.SettingName, value string) string {
+	switch name {
+	case types.SettingNameBackupTargetCredentialSecret:
+		return scrubCredentialSecret(value)
+	case types.SettingNameBackupTarget:
+		return scrubURL(value)
+	}
+	return value
+}
+
+// scrubVolumes returns the copy of the volumes without the credential
+// secrets, as the global one is scrubbed from the settings
+func scrubVolumes(volumes map[string]*longhorn.Volume) map[string]*longhorn.Volume {
+	result := map[string]*longhorn.Volume{}
+	for name, volume := range volumes {
+		v := volume.DeepCopy()
+		v.Spec.BackupTargetCredentialSecret = scrubCredentialSecret(v.Spec.BackupTargetCredentialSecret)
+		for i := range v.Spec.RecurringJobs {
+			job := &v.Spec.RecurringJobs[i]
+			job.BackupTargetCredentialSecret = scrubCredentialSecret(job.BackupTargetCredentialSecret)
+		}
+		v.Spec.FromBackup = scrubURL(v.Spec.FromBackup)
+		result[name] = v
+	}
+	return result
+}
+
+// scrubReplicas returns the copy of the replicas without the credential
+// secrets
+func scrubReplicas(replicas []*longhorn.Replica) []*longhorn.Replica {
+	result := make([]*longhorn.Replica, 0, len(replicas))
+	for _, replica := range replicas {
+		r := replica.DeepCopy()
+		r.Spec.RestoreCredentialSecret = scrubCredentialSecret(r.Spec.RestoreCredentialSecret)
+		r.Spec.RestoreFrom = scrubURL(r.Spec.RestoreFrom)
+		result = append(result, r)
+	}
+	return result
+}
+
+func scrubCredentialSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return supportBundleRedacted
+}
+
+// scrubURL removes the password in the URL. The user is kept, since the
+// bucket of the S3 backup target is in place of the user.
+func scrubURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		// not a URL, but may still contain the credential
+		if strings.Contains(value, "@") {
+			return supportBundleRedacted
+		}
+		return value
+	}
+	if u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), supportBundleRedacted)
+	}
+	return u.String()
+}
+
+// getSupportBundleSecrets returns the passwords in the backup target URLs and
+// the keys in the backup target credential secrets. Besides the objects
+// scrubbed field by field, they may be in the events, the conditions or the
+// logs, so they're redacted from everything in the bundle.
+func (m *VolumeManager) getSupportBundleSecrets() []string {
+	urls := []string{}
+	secretNames := []string{}
+	if settings, err := m.ds.ListSettings(); err != nil {
+		logrus.Warnf("Fail to list settings for the secrets of the support bundle: %v", err)
+	} else {
+		for _, name := range []types.SettingName{types.SettingNameBackupTarget, types.SettingNameBackupTargetCredentialSecret} {
+			setting := settings[name]
+			values := []string{setting.Value, setting.Status.BackupTarget}
+			for _, change := range setting.Status.History {
+				values = append(values, change.OldValue, change.NewValue)
+			}
+			if name == types.SettingNameBackupTarget {
+				urls = append(urls, values...)
+			} else {
+				secretNames = append(secretNames, values...)
+			}
+		}
+	}
+	if volumes, err := m.ds.ListVolumes(); err != nil {
+		logrus.Warnf("Fail to list volumes for the secrets of the support bundle: %v", err)
+	} else {
+		for _, v := range volumes {
+			urls = append(urls, v.Spec.FromBackup)
+			secretNames = append(secretNames, v.Spec.BackupTargetCredentialSecret)
+			for _, job := range v.Spec.RecurringJobs {
+				secretNames = append(secretNames, job.BackupTargetCredentialSecret)
+			}
+		}
+	}
+	if replicas, err := m.ds.ListReplicasRO(); err != nil {
+		logrus.Warnf("Fail to list replicas for the secrets of the support bundle: %v", err)
+	} else {
+		for _, r := range replicas {
+			urls = append(urls, r.Spec.RestoreFrom)
+			secretNames = append(secretNames, r.Spec.RestoreCredentialSecret)
+		}
+	}
+
+	secrets := map[string]bool{}
+	for _, value := range urls {
+		u, err := url.Parse(value)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if password, ok := u.User.Password(); ok && password != "" {
+			secrets[password] = true
+		}
+	}
+	checked := map[string]bool{}
+	for _, name := range secretNames {
+		if name == "" || checked[name] {
+			continue
+		}
+		checked[name] = true
+		credential, err := m.ds.GetCredentialFromSecret(name)
+		if err != nil {
+			logrus.Warnf("Fail to get credential secret %v for the support bundle: %v", name, err)
+			continue
+		}
+		for _, key := range []string{types.AWSAccessKey, types.AWSSecretKey} {
+			if credential[key] != "" {
+				secrets[credential[key]] = true
+			}
+		}
+	}
+
+	result := []string{}
+	for secret := range secrets {
+		result = append(result, secret)
+	}
+	// the longer first, in case one contains another
+	sort.Slice(result, func(i, j int) bool {
+		return len(result[i]) > len(result[j])
+	})
+	return result
+}
+
+func redactSecrets(data []byte, secrets []string) []byte {
+	for _, secret := range secrets {
+		data = bytes.Replace(data, []byte(secret), []byte(supportBundleRedacted), -1)
+	}
+	return data
+}
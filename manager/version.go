@@ -0,0 +1,81 @@
+package manager
+
+import (
+	"github.com/Sirupsen/logrus"
+
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/meta"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+)
+
+const (
+	APIVersion    = "v1"
+	APIMinVersion = "v1"
+)
+
+// Version describes the manager and the default engine image. The engine
+// part is left empty if it's not available yet, e.g. the datastore is still
+// syncing or the default engine image is not deployed.
+type Version struct {
+	ManagerVersion   string `json:"managerVersion"`
+	ManagerGitCommit string `json:"managerGitCommit"`
+	ManagerBuildDate string `json:"managerBuildDate"`
+
+	APIVersion    string `json:"apiVersion"`
+	APIMinVersion string `json:"apiMinVersion"`
+
+	// the engine CLI API version the manager uses, the engine image is
+	// compatible if it falls into the CLI API version range of the image
+	EngineCLIAPIVersion int `json:"engineCLIAPIVersion"`
+
+	// CurrentVersion is the running Longhorn release. The latest one is
+	// only known if the upgrade checker is enabled
+	CurrentVersion   string `json:"currentVersion"`
+	LatestVersion    string `json:"latestVersion"`
+	UpgradeAvailable bool   `json:"upgradeAvailable"`
+
+	DefaultEngineImage        string                      `json:"defaultEngineImage"`
+	DefaultEngineImageState   types.EngineImageState      `json:"defaultEngineImageState"`
+	DefaultEngineImageVersion *types.EngineVersionDetails `json:"defaultEngineImageVersion"`
+}
+
+func (m *VolumeManager) GetVersion() *Version {
+	version := &Version{
+		ManagerVersion:   meta.Version,
+		ManagerGitCommit: meta.GitCommit,
+		ManagerBuildDate: meta.BuildDate,
+
+		APIVersion:    APIVersion,
+		APIMinVersion: APIMinVersion,
+
+		EngineCLIAPIVersion: engineapi.CurrentCLIVersion,
+
+		CurrentVersion: meta.Version,
+	}
+
+	if enabled, err := m.ds.GetSettingAsBool(types.SettingNameUpgradeChecker); err == nil && enabled {
+		if latest, err := m.ds.GetSettingValue(types.SettingNameLatestLonghornVersion); err == nil {
+			version.LatestVersion = latest
+			version.UpgradeAvailable = util.IsNewerVersion(meta.Version, latest)
+		}
+	}
+
+	image, err := m.GetSettingValueExisted(types.SettingNameDefaultEngineImage)
+	if err != nil {
+		logrus.Debugf("Cannot get the default engine image for the version: %v", err)
+		return version
+	}
+	version.DefaultEngineImage = image
+	ei, err := m.GetEngineImage(image)
+	if err != nil {
+		logrus.Debugf("Cannot get the default engine image %v for the version: %v", image, err)
+		return version
+	}
+	version.DefaultEngineImageState = ei.Status.State
+	if ei.Status.State == types.EngineImageStateReady {
+		details := ei.Status.EngineVersionDetails
+		version.DefaultEngineImageVersion = &details
+	}
+	return version
+}
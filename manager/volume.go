@@ -1,33 +1,69 @@
 package manager
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/scheduler"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
 
 	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
 )
 
+const (
+	EventReasonUpdateReplicaCount                 = "UpdateReplicaCount"
+	EventReasonUpdateQoS                          = "UpdateQoS"
+	EventReasonUpdateBackupTargetCredentialSecret = "UpdateBackupTargetCredentialSecret"
+	EventReasonTrash                              = "Trash"
+	EventReasonRestoreTrashed                     = "RestoreTrashed"
+)
+
 type VolumeManager struct {
-	ds *datastore.DataStore
+	ds        *datastore.DataStore
+	scheduler *scheduler.ReplicaScheduler
 
 	currentNodeID string
+
+	eventRecorder    record.EventRecorder
+	engineLocks      *engineOperationLocks
+	backupStoreCache *backupStoreCache
+	backupAdmission  *datastore.BackupAdmission
+	supportBundles   supportBundles
+	engineUpgrades   engineUpgradeJobs
+
+	// stopCh is closed when the manager is shutting down, which the
+	// background operations started by the API requests observe
+	stopCh <-chan struct{}
 }
 
-func NewVolumeManager(currentNodeID string, ds *datastore.DataStore) *VolumeManager {
+func NewVolumeManager(currentNodeID string, ds *datastore.DataStore, stopCh <-chan struct{}) *VolumeManager {
 	return &VolumeManager{
-		ds: ds,
+		ds:        ds,
+		scheduler: scheduler.NewReplicaScheduler(ds),
 
 		currentNodeID: currentNodeID,
+
+		eventRecorder:    ds.NewEventRecorder("longhorn-api-server"),
+		engineLocks:      newEngineOperationLocks(),
+		backupStoreCache: newBackupStoreCache(),
+		backupAdmission:  ds.NewBackupAdmission(),
+		engineUpgrades:   newEngineUpgradeJobs(),
+
+		stopCh: stopCh,
 	}
 }
 
@@ -89,6 +125,171 @@ func (m *VolumeManager) ListSorted() ([]*longhorn.Volume, error) {
 	return volumes, nil
 }
 
+const (
+	VolumeSortByName    = "name"
+	VolumeSortBySize    = "size"
+	VolumeSortByCreated = "created"
+)
+
+// VolumeListOptions selects a page of the volumes. The zero value selects all
+// the volumes sorted by name.
+type VolumeListOptions struct {
+	// Limit is the maximum number of volumes in the page, 0 means no limit
+	Limit int
+	// Marker is the continuation token returned with the previous page
+	Marker     string
+	SortBy     string
+	Descending bool
+
+	// the filters, the empty ones match all the volumes
+	State  string
+	NodeID string
+	// NameContains matches the volumes with the substring in the names
+	NameContains string
+}
+
+// VolumePage is a page of the volumes. Marker is the continuation token of
+// the next page, empty if it's the last page. Total is the number of the
+// volumes matching the filters in all pages.
+type VolumePage struct {
+	Volumes []*longhorn.Volume
+	Marker  string
+	Total   int
+}
+
+// volumeListMarker is the position of the last volume of the page. The pages
+// continue after the position rather than an offset, so the volumes created
+// or deleted between the requests won't shift the following pages.
+type volumeListMarker struct {
+	SortBy     string `json:"sortBy"`
+	Descending bool   `json:"descending"`
+	Name       string `json:"name"`
+	Size       int64  `json:"size"`
+	Created    int64  `json:"created"`
+}
+
+func newVolumeListMarker(v *longhorn.Volume, opts VolumeListOptions) *volumeListMarker {
+	return &volumeListMarker{
+		SortBy:     opts.SortBy,
+		Descending: opts.Descending,
+		Name:       v.Name,
+		Size:       v.Spec.Size,
+		Created:    v.CreationTimestamp.Unix(),
+	}
+}
+
+func encodeVolumeListMarker(marker *volumeListMarker) (string, error) {
+	encoded, err := json.Marshal(marker)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+func decodeVolumeListMarker(token string, opts VolumeListOptions) (*volumeListMarker, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, newError(ErrorReasonInvalidInput, "invalid marker %v", token)
+	}
+	marker := &volumeListMarker{}
+	if err := json.Unmarshal(decoded, marker); err != nil {
+		return nil, newError(ErrorReasonInvalidInput, "invalid marker %v", token)
+	}
+	if marker.SortBy != opts.SortBy || marker.Descending != opts.Descending {
+		return nil, newError(ErrorReasonInvalidInput, "marker %v doesn't match the sort order", token)
+	}
+	return marker, nil
+}
+
+// before returns true if position a comes before position b in the order.
+// The ties are broken by the names, so the order is total.
+func (a *volumeListMarker) before(b *volumeListMarker) bool {
+	if a.SortBy == VolumeSortBySize && a.Size != b.Size {
+		return (a.Size < b.Size) != a.Descending
+	}
+	if a.SortBy == VolumeSortByCreated && a.Created != b.Created {
+		return (a.Created < b.Created) != a.Descending
+	}
+	if a.Name == b.Name {
+		return false
+	}
+	return (a.Name < b.Name) != a.Descending
+}
+
+func (opts VolumeListOptions) match(v *longhorn.Volume) bool {
+	if opts.State != "" && string(v.Status.State) != opts.State {
+		return false
+	}
+	if opts.NodeID != "" && v.Spec.NodeID != opts.NodeID {
+		return false
+	}
+	return strings.Contains(v.Name, opts.NameContains)
+}
+
+// ListPage returns a page of the volumes matching the filters in the order
+func (m *VolumeManager) ListPage(opts VolumeListOptions) (*VolumePage, error) {
+	if opts.SortBy == "" {
+		opts.SortBy = VolumeSortByName
+	}
+	switch opts.SortBy {
+	case VolumeSortByName, VolumeSortBySize, VolumeSortByCreated:
+	default:
+		return nil, newError(ErrorReasonInvalidInput, "invalid sort key %v, should be one of %v, %v and %v",
+			opts.SortBy, VolumeSortByName, VolumeSortBySize, VolumeSortByCreated)
+	}
+	if opts.Limit < 0 {
+		return nil, newError(ErrorReasonInvalidInput, "invalid limit %v", opts.Limit)
+	}
+	var start *volumeListMarker
+	if opts.Marker != "" {
+		marker, err := decodeVolumeListMarker(opts.Marker, opts)
+		if err != nil {
+			return nil, err
+		}
+		start = marker
+	}
+
+	volumeMap, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	return pageVolumes(volumeMap, start, opts)
+}
+
+func pageVolumes(volumeMap map[string]*longhorn.Volume, start *volumeListMarker, opts VolumeListOptions) (page *VolumePage, err error) {
+	volumes := []*longhorn.Volume{}
+	positions := map[string]*volumeListMarker{}
+	for _, v := range volumeMap {
+		if !opts.match(v) {
+			continue
+		}
+		volumes = append(volumes, v)
+		positions[v.Name] = newVolumeListMarker(v, opts)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return positions[volumes[i].Name].before(positions[volumes[j].Name])
+	})
+
+	page = &VolumePage{
+		Volumes: []*longhorn.Volume{},
+		Total:   len(volumes),
+	}
+	for _, v := range volumes {
+		if start != nil && !start.before(positions[v.Name]) {
+			continue
+		}
+		if opts.Limit != 0 && len(page.Volumes) == opts.Limit {
+			last := page.Volumes[len(page.Volumes)-1]
+			if page.Marker, err = encodeVolumeListMarker(positions[last.Name]); err != nil {
+				return nil, err
+			}
+			break
+		}
+		page.Volumes = append(page.Volumes, v)
+	}
+	return page, nil
+}
+
 func (m *VolumeManager) Get(vName string) (*longhorn.Volume, error) {
 	return m.ds.GetVolume(vName)
 }
@@ -144,9 +345,20 @@ func (m *VolumeManager) Create(name string, spec *types.VolumeSpec) (v *longhorn
 		return nil, fmt.Errorf("invalid name %v", name)
 	}
 
+	if err := m.validateBackupTargetCredentialSecret(spec.BackupTargetCredentialSecret); err != nil {
+		return nil, errors.Wrapf(err, "invalid backup target credential secret %v", spec.BackupTargetCredentialSecret)
+	}
+	credentialSecret := spec.BackupTargetCredentialSecret
+
 	size := spec.Size
 	if spec.FromBackup != "" {
-		backupTarget, err := m.getBackupTarget()
+		// the restore keeps reading the backup with the secret even if
+		// the global one changes later
+		credentialSecret, err = m.ds.ResolveBackupTargetCredentialSecret(spec.BackupTargetCredentialSecret)
+		if err != nil {
+			return nil, err
+		}
+		backupTarget, err := m.getBackupTargetWithCredentialSecret(credentialSecret)
 		if err != nil {
 			return nil, err
 		}
@@ -169,8 +381,12 @@ func (m *VolumeManager) Create(name string, spec *types.VolumeSpec) (v *longhorn
 	size = util.RoundUpSize(size)
 
 	if spec.NumberOfReplicas == 0 {
-		logrus.Warnf("Invalid number of replicas %v, override it to default", spec.NumberOfReplicas)
-		spec.NumberOfReplicas = 3
+		defaultReplicaCount, err := m.ds.GetSettingAsInt(types.SettingNameDefaultReplicaCount)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Debugf("Number of replicas is not specified, use the default %v", defaultReplicaCount)
+		spec.NumberOfReplicas = int(defaultReplicaCount)
 	}
 	defaultEngineImage, err := m.GetSettingValueExisted(types.SettingNameDefaultEngineImage)
 	if defaultEngineImage == "" {
@@ -179,11 +395,29 @@ func (m *VolumeManager) Create(name string, spec *types.VolumeSpec) (v *longhorn
 	if err := m.CheckEngineImageReadiness(defaultEngineImage); err != nil {
 		return nil, errors.Wrapf(err, "cannot create volume with image %v", defaultEngineImage)
 	}
+	if err := types.ValidateVolumeQoS(spec.QoS); err != nil {
+		return nil, err
+	}
+	if err := m.checkQoSSupported(defaultEngineImage, spec.QoS); err != nil {
+		return nil, err
+	}
 
 	if spec.Frontend != types.VolumeFrontendBlockDev && spec.Frontend != types.VolumeFrontendISCSI {
 		return nil, fmt.Errorf("invalid volume frontend specified: %v", spec.Frontend)
 	}
 
+	if spec.AccessMode == "" {
+		spec.AccessMode = types.VolumeAccessModeReadWriteOnce
+	}
+	if spec.AccessMode != types.VolumeAccessModeReadWriteOnce && spec.AccessMode != types.VolumeAccessModeReadOnlyMany {
+		return nil, fmt.Errorf("invalid volume access mode specified: %v", spec.AccessMode)
+	}
+	// the other nodes reach the volume through the iSCSI target exported
+	// by the engine
+	if spec.AccessMode == types.VolumeAccessModeReadOnlyMany && spec.Frontend != types.VolumeFrontendISCSI {
+		return nil, fmt.Errorf("volume with access mode %v must use frontend %v", spec.AccessMode, types.VolumeFrontendISCSI)
+	}
+
 	if spec.BaseImage != "" {
 		nodes, err := m.ListNodes()
 		if err != nil {
@@ -197,6 +431,15 @@ func (m *VolumeManager) Create(name string, spec *types.VolumeSpec) (v *longhorn
 		}
 	}
 
+	diskSelector, err := util.ValidateTags(spec.DiskSelector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid disk selector")
+	}
+	nodeSelector, err := util.ValidateTags(spec.NodeSelector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid node selector")
+	}
+
 	v = &longhorn.Volume{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: name,
@@ -210,6 +453,13 @@ func (m *VolumeManager) Create(name string, spec *types.VolumeSpec) (v *longhorn
 			NumberOfReplicas:    spec.NumberOfReplicas,
 			StaleReplicaTimeout: spec.StaleReplicaTimeout,
 			BaseImage:           spec.BaseImage,
+			DiskSelector:        diskSelector,
+			NodeSelector:        nodeSelector,
+			ZoneSelector:        spec.ZoneSelector,
+			AccessMode:          spec.AccessMode,
+			QoS:                 spec.QoS,
+
+			BackupTargetCredentialSecret: credentialSecret,
 		},
 	}
 	v, err = m.ds.CreateVolume(v)
@@ -220,40 +470,177 @@ func (m *VolumeManager) Create(name string, spec *types.VolumeSpec) (v *longhorn
 	return v, nil
 }
 
-func (m *VolumeManager) Delete(name string) error {
+// Delete deletes the volume. With the volume deletion grace period set, the
+// volume is detached and moved to the trash instead, and cleaned up by the
+// volume controller once the grace period expires. The force deletion cleans
+// up the volume right away, in the trash or not.
+func (m *VolumeManager) Delete(name string, force bool) error {
+	v, err := m.ds.GetVolume(name)
+	if err != nil {
+		return err
+	}
+	if err := m.cleanupPVForVolume(v); err != nil {
+		return errors.Wrapf(err, "unable to cleanup PV of volume %v", name)
+	}
+	if !force {
+		gracePeriod, err := m.ds.GetSettingAsInt(types.SettingNameVolumeDeletionGracePeriod)
+		if err != nil {
+			return err
+		}
+		if gracePeriod > 0 || v.Spec.TrashedAt != "" {
+			_, err := m.trash(v)
+			return err
+		}
+	}
 	return m.ds.DeleteVolume(name)
 }
 
-func (m *VolumeManager) Attach(name, nodeID string) (v *longhorn.Volume, err error) {
+// trash detaches the volume and records when it's moved to the trash. It's
+// idempotent, so deleting the volume in the trash again without force won't
+// reset the grace period or clean it up early.
+func (m *VolumeManager) trash(v *longhorn.Volume) (*longhorn.Volume, error) {
+	if v.Spec.TrashedAt != "" {
+		return v, nil
+	}
+	if v.Spec.MigrationNodeID != "" {
+		return nil, newError(ErrorReasonInvalidState, "cannot move volume %v to the trash during migration, use force to delete it anyway", v.Name)
+	}
+
+	v.Spec.TrashedAt = util.Now()
+	if v.Spec.NodeID != "" {
+		// the same ownership transfer as detaching
+		v.Spec.OwnerID = m.currentNodeID
+	}
+	v.Spec.NodeID = ""
+	v.Spec.PendingNodeID = ""
+	v.Spec.DisableFrontend = false
+	v.Spec.ReadOnlyNodeIDs = nil
+	v, err := m.ds.UpdateVolumeAndOwner(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to move volume %v to the trash", v.Name)
+	}
+	m.eventRecorder.Eventf(v, corev1.EventTypeNormal, EventReasonTrash, "Moved volume %v to the trash", v.Name)
+	logrus.Debugf("Moved volume %v to the trash", v.Name)
+	return v, nil
+}
+
+// RestoreTrashed takes the volume out of the trash before the grace period
+// expires. The volume is restored detached, and the PV and the PVC deleted
+// with it have to be created again.
+func (m *VolumeManager) RestoreTrashed(name string) (v *longhorn.Volume, err error) {
+	defer func() {
+		err = errors.Wrapf(err, "unable to restore volume %v from the trash", name)
+	}()
+
+	v, err = m.ds.GetVolume(name)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", name)
+		}
+		return nil, err
+	}
+	if v.DeletionTimestamp != nil {
+		return nil, newError(ErrorReasonInvalidState, "volume %v is being deleted", name)
+	}
+	if v.Spec.TrashedAt == "" {
+		return nil, newError(ErrorReasonInvalidState, "volume %v is not in the trash", name)
+	}
+
+	trashedAt := v.Spec.TrashedAt
+	v.Spec.TrashedAt = ""
+	v, err = m.ds.UpdateVolume(v)
+	if err != nil {
+		return nil, err
+	}
+	m.eventRecorder.Eventf(v, corev1.EventTypeNormal, EventReasonRestoreTrashed, "Restored volume %v moved to the trash at %v", v.Name, trashedAt)
+	logrus.Debugf("Restored volume %v from the trash", v.Name)
+	return v, nil
+}
+
+// Attach requests the volume to be attached to the node by the volume
+// controller. With disableFrontend, the volume is attached without the
+// frontend for the maintenance. With readOnly, the rox volume is attached
+// read-only, to the other nodes as well as long as all of them are read-only.
+func (m *VolumeManager) Attach(name, nodeID string, disableFrontend, readOnly bool) (v *longhorn.Volume, err error) {
 	defer func() {
 		err = errors.Wrapf(err, "unable to attach volume %v to %v", name, nodeID)
 	}()
 
 	v, err = m.ds.GetVolume(name)
 	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", name)
+		}
 		return nil, err
 	}
+	node, err := m.ds.GetNode(nodeID)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonInvalidInput, "cannot find node %v", nodeID)
+		}
+		return nil, err
+	}
+	readyCondition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
+	if readyCondition.Status != types.ConditionStatusTrue {
+		return nil, newError(ErrorReasonInvalidState, "node %v is not ready", nodeID)
+	}
+	if v.Spec.TrashedAt != "" {
+		return nil, newError(ErrorReasonInvalidState, "volume %v is in the trash, restore it before attaching", name)
+	}
+	if v.Status.Robustness == types.VolumeRobustnessFaulted {
+		return nil, newError(ErrorReasonInvalidState, "volume %v is faulted, salvage it before attaching", name)
+	}
+	if readOnly {
+		if v.Spec.AccessMode != types.VolumeAccessModeReadOnlyMany {
+			return nil, newError(ErrorReasonInvalidInput, "volume %v with access mode %v cannot be attached read-only", name, v.Spec.AccessMode)
+		}
+		if disableFrontend {
+			return nil, newError(ErrorReasonInvalidInput, "volume %v cannot be attached read-only without the frontend", name)
+		}
+		if v.Spec.NodeID != "" {
+			return m.attachReadOnlyToMoreNode(v, nodeID)
+		}
+		if err := m.checkFrontendReadOnlySupported(v.Spec.EngineImage); err != nil {
+			return nil, err
+		}
+	} else if len(v.Spec.ReadOnlyNodeIDs) != 0 {
+		return nil, newError(ErrorReasonInvalidState, "volume %v is attached read-only to %v, cannot attach it read-write", name, v.Spec.ReadOnlyNodeIDs)
+	}
 	if v.Status.State != types.VolumeStateDetached {
-		return nil, fmt.Errorf("invalid state to attach %v: %v", name, v.Status.State)
+		return nil, newError(ErrorReasonInvalidState, "invalid state to attach %v: %v", name, v.Status.State)
+	}
+	nodeIDs, err := m.getVolumeInstanceNodes(v, nodeID)
+	if err != nil {
+		return nil, err
 	}
-	if err := m.CheckEngineImageReadiness(v.Spec.EngineImage); err != nil {
-		return nil, errors.Wrapf(err, "cannot attach volume %v with image %v", v.Name, v.Spec.EngineImage)
+	if err := m.CheckEngineImageReadiness(v.Spec.EngineImage, nodeIDs...); err != nil {
+		return nil, newError(ErrorReasonInvalidState, "cannot attach volume %v with image %v: %v", v.Name, v.Spec.EngineImage, err)
 	}
 
 	condition := types.GetVolumeConditionFromStatus(v.Status, types.VolumeConditionTypeScheduled)
 	if condition.Status != types.ConditionStatusTrue {
-		return nil, fmt.Errorf("volume %v not scheduled", name)
+		return nil, newError(ErrorReasonInvalidState, "volume %v not scheduled", name)
 	}
 
 	// already desired to be attached
 	if v.Spec.NodeID != "" {
 		if v.Spec.NodeID != nodeID {
-			return nil, fmt.Errorf("Node to be attached %v is different from previous spec %v", nodeID, v.Spec.NodeID)
+			return nil, newError(ErrorReasonInvalidState, "Node to be attached %v is different from previous spec %v", nodeID, v.Spec.NodeID)
+		}
+		if v.Spec.DisableFrontend != disableFrontend {
+			return nil, newError(ErrorReasonInvalidState, "volume %v is being attached with disableFrontend %v", name, v.Spec.DisableFrontend)
 		}
 		return v, nil
 	}
+	if err := m.scheduler.CheckEngineNode(nodeID, true); err != nil {
+		return nil, newError(ErrorReasonInvalidState, "%v", err)
+	}
 	v.Spec.NodeID = nodeID
 	v.Spec.OwnerID = v.Spec.NodeID
+	v.Spec.DisableFrontend = disableFrontend
+	if readOnly {
+		v.Spec.ReadOnlyNodeIDs = []string{nodeID}
+	}
 
 	// Must be owned by the manager on the same node
 	v, err = m.ds.UpdateVolumeAndOwner(v)
@@ -261,21 +648,104 @@ func (m *VolumeManager) Attach(name, nodeID string) (v *longhorn.Volume, err err
 		return nil, err
 	}
 
-	logrus.Debugf("Attaching volume %v to %v", v.Name, v.Spec.NodeID)
+	logrus.Debugf("Attaching volume %v to %v, disableFrontend %v", v.Name, v.Spec.NodeID, v.Spec.DisableFrontend)
 	return v, nil
 }
 
-func (m *VolumeManager) Detach(name string) (v *longhorn.Volume, err error) {
+// checkFrontendReadOnlySupported returns error if the engine image cannot
+// export the frontend read-only. The read-only attachment is refused rather
+// than relying on the nodes alone to not write.
+func (m *VolumeManager) checkFrontendReadOnlySupported(image string) error {
+	ei, err := m.ds.GetEngineImage(types.GetEngineImageChecksumName(image))
+	if err != nil {
+		return errors.Wrapf(err, "cannot get engine image %v", image)
+	}
+	if ei.Status.CLIAPIVersion < engineapi.FrontendReadOnlyMinCLIAPIVersion {
+		return newError(ErrorReasonInvalidState, "engine image %v cannot export the volume read-only, requires CLI API version %v or later",
+			image, engineapi.FrontendReadOnlyMinCLIAPIVersion)
+	}
+	return nil
+}
+
+// attachReadOnlyToMoreNode adds the node to the read-only attachment of the
+// volume already attached. The engine stays on its node, and the node reads
+// the volume through the iSCSI target exported by the engine.
+func (m *VolumeManager) attachReadOnlyToMoreNode(v *longhorn.Volume, nodeID string) (*longhorn.Volume, error) {
+	if len(v.Spec.ReadOnlyNodeIDs) == 0 {
+		return nil, newError(ErrorReasonInvalidState, "volume %v is attached read-write to %v, cannot attach it read-only", v.Name, v.Spec.NodeID)
+	}
+	if v.Spec.MigrationNodeID != "" {
+		return nil, newError(ErrorReasonInvalidState, "cannot attach volume %v read-only to more node during migration", v.Name)
+	}
+	for _, id := range v.Spec.ReadOnlyNodeIDs {
+		if id == nodeID {
+			return v, nil
+		}
+	}
+
+	v.Spec.ReadOnlyNodeIDs = append(v.Spec.ReadOnlyNodeIDs, nodeID)
+	v, err := m.ds.UpdateVolume(v)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Attaching volume %v read-only to %v, engine on %v", v.Name, nodeID, v.Spec.NodeID)
+	return v, nil
+}
+
+// Detach requests the volume to be detached by the volume controller. It's
+// refused while the volume is restoring from the backup, or not attached,
+// unless forced. With nodeID, only the attachment to the node is removed, so
+// the volume stays attached read-only to the other nodes if there are.
+func (m *VolumeManager) Detach(name, nodeID string, force bool) (v *longhorn.Volume, err error) {
 	defer func() {
 		err = errors.Wrapf(err, "unable to detach volume %v", name)
 	}()
 
 	v, err = m.ds.GetVolume(name)
 	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", name)
+		}
 		return nil, err
 	}
-	if v.Status.State != types.VolumeStateAttached && v.Status.State != types.VolumeStateAttaching {
-		return nil, fmt.Errorf("invalid state to detach %v: %v", v.Name, v.Status.State)
+	if nodeID != "" && v.Spec.NodeID != "" {
+		if len(v.Spec.ReadOnlyNodeIDs) == 0 && nodeID != v.Spec.NodeID {
+			// not attached to the node
+			return v, nil
+		}
+		if len(v.Spec.ReadOnlyNodeIDs) != 0 {
+			readOnlyNodeIDs := []string{}
+			for _, id := range v.Spec.ReadOnlyNodeIDs {
+				if id != nodeID {
+					readOnlyNodeIDs = append(readOnlyNodeIDs, id)
+				}
+			}
+			if len(readOnlyNodeIDs) == len(v.Spec.ReadOnlyNodeIDs) {
+				return v, nil
+			}
+			if len(readOnlyNodeIDs) != 0 {
+				// the engine stays on its node for the others
+				v.Spec.ReadOnlyNodeIDs = readOnlyNodeIDs
+				v, err = m.ds.UpdateVolume(v)
+				if err != nil {
+					return nil, err
+				}
+				logrus.Debugf("Detaching volume %v from read-only node %v, still attached to %v", v.Name, nodeID, v.Spec.ReadOnlyNodeIDs)
+				return v, nil
+			}
+		}
+	}
+	if !force {
+		if v.Status.State != types.VolumeStateAttached && v.Status.State != types.VolumeStateAttaching {
+			return nil, newError(ErrorReasonInvalidState, "invalid state to detach %v: %v", v.Name, v.Status.State)
+		}
+		restoring, err := m.isVolumeRestoring(v)
+		if err != nil {
+			return nil, err
+		}
+		if restoring {
+			return nil, newError(ErrorReasonInvalidState, "volume %v is restoring from backup %v, use force to detach it anyway", v.Name, v.Spec.FromBackup)
+		}
 	}
 
 	oldNodeID := v.Spec.NodeID
@@ -285,6 +755,8 @@ func (m *VolumeManager) Detach(name string) (v *longhorn.Volume, err error) {
 
 	v.Spec.OwnerID = m.currentNodeID
 	v.Spec.NodeID = ""
+	v.Spec.DisableFrontend = false
+	v.Spec.ReadOnlyNodeIDs = nil
 
 	// Ownership transfer to the one called detach in case the original
 	// owner is down (so it cannot do anything to proceed)
@@ -293,10 +765,29 @@ func (m *VolumeManager) Detach(name string) (v *longhorn.Volume, err error) {
 		return nil, err
 	}
 
-	logrus.Debugf("Detaching volume %v from %v", v.Name, oldNodeID)
+	logrus.Debugf("Detaching volume %v from %v, force %v", v.Name, oldNodeID, force)
 	return v, nil
 }
 
+// isVolumeRestoring returns true if any replica of the volume is starting
+// with the restore from the backup, which is done before the replica runs
+func (m *VolumeManager) isVolumeRestoring(v *longhorn.Volume) (bool, error) {
+	if v.Spec.FromBackup == "" {
+		return false, nil
+	}
+	rs, err := m.ds.ListVolumeReplicas(v.Name)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rs {
+		if r.Spec.RestoreFrom != "" && r.Spec.DesireState == types.InstanceStateRunning &&
+			r.Status.CurrentState == types.InstanceStateStarting {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (m *VolumeManager) Salvage(volumeName string, replicaNames []string) (v *longhorn.Volume, err error) {
 	defer func() {
 		err = errors.Wrapf(err, "unable to salvage volume %v", volumeName)
@@ -325,6 +816,9 @@ func (m *VolumeManager) Salvage(volumeName string, replicaNames []string) (v *lo
 			// already updated, ignore it for idempotency
 			continue
 		}
+		if r.Status.FailureReason == types.ReplicaFailureReasonRebuildFailed {
+			return nil, fmt.Errorf("replica %v failed during rebuilding, there is no complete data to salvage", r.Name)
+		}
 		r.Spec.FailedAt = ""
 		if _, err := m.ds.UpdateReplica(r); err != nil {
 			return nil, err
@@ -332,11 +826,16 @@ func (m *VolumeManager) Salvage(volumeName string, replicaNames []string) (v *lo
 	}
 
 	v.Spec.NodeID = ""
-	v.Status.Robustness = types.VolumeRobustnessUnknown
 	v, err = m.ds.UpdateVolume(v)
 	if err != nil {
 		return nil, err
 	}
+	v, err = m.ds.UpdateVolumeStatusWithRetry(v, func(v *longhorn.Volume) {
+		v.Status.Robustness = types.VolumeRobustnessUnknown
+	})
+	if err != nil {
+		return nil, err
+	}
 	logrus.Debugf("Salvaged replica %+v for volume %v", replicaNames, v.Name)
 	return v, nil
 }
@@ -353,6 +852,17 @@ func (m *VolumeManager) UpdateRecurringJobs(volumeName string, jobs []types.Recu
 		if len(job.Name) > types.MaximumJobNameSize {
 			return nil, fmt.Errorf("job name %v is too long, must be %v characters or less", job.Name, types.MaximumJobNameSize)
 		}
+		if _, _, err := types.ParseRecurringJobSchedule(&job); err != nil {
+			return nil, errors.Wrapf(err, "invalid schedule of job %v", job.Name)
+		}
+		if job.BackupTargetCredentialSecret != "" {
+			if job.Type != types.RecurringJobTypeBackup {
+				return nil, fmt.Errorf("job %v doesn't back up, cannot set the backup target credential secret", job.Name)
+			}
+			if err := m.validateBackupTargetCredentialSecret(job.BackupTargetCredentialSecret); err != nil {
+				return nil, errors.Wrapf(err, "invalid backup target credential secret %v of job %v", job.BackupTargetCredentialSecret, job.Name)
+			}
+		}
 	}
 
 	v, err = m.ds.GetVolume(volumeName)
@@ -369,6 +879,130 @@ func (m *VolumeManager) UpdateRecurringJobs(volumeName string, jobs []types.Recu
 	return v, nil
 }
 
+// UpdateReplicaCount changes the number of replicas of the volume. The
+// missing replicas are rebuilt by the volume controller, while the extra ones
+// are kept until removed by the user.
+func (m *VolumeManager) UpdateReplicaCount(volumeName string, replicaCount int) (v *longhorn.Volume, err error) {
+	defer func() {
+		err = errors.Wrapf(err, "unable to update replica count for volume %v", volumeName)
+	}()
+
+	if replicaCount < 1 {
+		return nil, newError(ErrorReasonInvalidInput, "invalid replica count %v, must be at least 1", replicaCount)
+	}
+
+	v, err = m.ds.GetVolume(volumeName)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", volumeName)
+		}
+		return nil, err
+	}
+	if v.Spec.MigrationNodeID != "" {
+		return nil, newError(ErrorReasonInvalidState, "cannot update replica count during migration")
+	}
+	oldCount := v.Spec.NumberOfReplicas
+	if oldCount == replicaCount {
+		return v, nil
+	}
+
+	v.Spec.NumberOfReplicas = replicaCount
+	v, err = m.ds.UpdateVolume(v)
+	if err != nil {
+		return nil, err
+	}
+	m.eventRecorder.Eventf(v, corev1.EventTypeNormal, EventReasonUpdateReplicaCount, "Updated replica count from %v to %v", oldCount, replicaCount)
+	logrus.Debugf("Updated volume %v replica count from %v to %v", v.Name, oldCount, replicaCount)
+	return v, nil
+}
+
+// UpdateQoS changes the I/O limits of the volume, which are applied to the
+// running engine by the engine controller
+func (m *VolumeManager) UpdateQoS(volumeName string, qos types.VolumeQoS) (v *longhorn.Volume, err error) {
+	defer func() {
+		err = errors.Wrapf(err, "unable to update QoS for volume %v", volumeName)
+	}()
+
+	if err := types.ValidateVolumeQoS(qos); err != nil {
+		return nil, newError(ErrorReasonInvalidInput, "%v", err)
+	}
+
+	v, err = m.ds.GetVolume(volumeName)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", volumeName)
+		}
+		return nil, err
+	}
+	if v.Spec.QoS == qos {
+		return v, nil
+	}
+	if err := m.checkQoSSupported(v.Spec.EngineImage, qos); err != nil {
+		return nil, err
+	}
+
+	oldQoS := v.Spec.QoS
+	v.Spec.QoS = qos
+	v, err = m.ds.UpdateVolume(v)
+	if err != nil {
+		return nil, err
+	}
+	m.eventRecorder.Eventf(v, corev1.EventTypeNormal, EventReasonUpdateQoS, "Updated QoS from %+v to %+v", oldQoS, qos)
+	logrus.Debugf("Updated volume %v QoS from %+v to %+v", v.Name, oldQoS, qos)
+	return v, nil
+}
+
+// checkQoSSupported returns error if the limits are set but the engine image
+// doesn't support them
+func (m *VolumeManager) checkQoSSupported(image string, qos types.VolumeQoS) error {
+	if qos == (types.VolumeQoS{}) {
+		return nil
+	}
+	ei, err := m.ds.GetEngineImage(types.GetEngineImageChecksumName(image))
+	if err != nil {
+		return errors.Wrapf(err, "cannot get engine image %v", image)
+	}
+	if ei.Status.CLIAPIVersion < engineapi.QoSMinCLIAPIVersion {
+		return newError(ErrorReasonInvalidInput, "engine image %v doesn't support QoS, requires CLI API version %v or later",
+			image, engineapi.QoSMinCLIAPIVersion)
+	}
+	return nil
+}
+
+// UpdateBackupTargetCredentialSecret changes the secret overriding the
+// global backup target credential secret for the backups of the volume. The
+// empty secret falls back to the global one. The restore in progress keeps
+// using the secret recorded in the replicas.
+func (m *VolumeManager) UpdateBackupTargetCredentialSecret(volumeName, credentialSecret string) (v *longhorn.Volume, err error) {
+	defer func() {
+		err = errors.Wrapf(err, "unable to update backup target credential secret for volume %v", volumeName)
+	}()
+
+	if err := m.validateBackupTargetCredentialSecret(credentialSecret); err != nil {
+		return nil, newError(ErrorReasonInvalidInput, "invalid backup target credential secret %v: %v", credentialSecret, err)
+	}
+
+	v, err = m.ds.GetVolume(volumeName)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", volumeName)
+		}
+		return nil, err
+	}
+	if v.Spec.BackupTargetCredentialSecret == credentialSecret {
+		return v, nil
+	}
+
+	v.Spec.BackupTargetCredentialSecret = credentialSecret
+	v, err = m.ds.UpdateVolume(v)
+	if err != nil {
+		return nil, err
+	}
+	m.eventRecorder.Eventf(v, corev1.EventTypeNormal, EventReasonUpdateBackupTargetCredentialSecret, "Updated backup target credential secret to %q", credentialSecret)
+	logrus.Debugf("Updated volume %v backup target credential secret to %q", v.Name, credentialSecret)
+	return v, nil
+}
+
 func (m *VolumeManager) DeleteReplica(replicaName string) error {
 	return m.ds.DeleteReplica(replicaName)
 }
@@ -393,26 +1027,47 @@ func (m *VolumeManager) EngineUpgrade(volumeName, image string) (v *longhorn.Vol
 	defer func() {
 		err = errors.Wrapf(err, "cannot upgrade engine for volume %v using image %v", volumeName, image)
 	}()
-	if err := m.CheckEngineImageReadiness(image); err != nil {
+	ei, err := m.ds.GetEngineImage(types.GetEngineImageChecksumName(image))
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonInvalidInput, "engine image %v is not deployed", image)
+		}
 		return nil, err
 	}
 
 	v, err = m.ds.GetVolume(volumeName)
 	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil, newError(ErrorReasonNotFound, "cannot find volume %v", volumeName)
+		}
 		return nil, err
 	}
 
 	if v.Spec.EngineImage == image {
-		return nil, fmt.Errorf("upgrading in process for volume %v engine image from %v to %v already",
+		return nil, newError(ErrorReasonInvalidState, "upgrading in process for volume %v engine image from %v to %v already",
 			v.Name, v.Status.CurrentImage, v.Spec.EngineImage)
 	}
 
 	if v.Spec.EngineImage != v.Status.CurrentImage && image != v.Status.CurrentImage {
-		return nil, fmt.Errorf("upgrading in process for volume %v engine image from %v to %v, cannot upgrade to another engine image",
+		return nil, newError(ErrorReasonInvalidState, "upgrading in process for volume %v engine image from %v to %v, cannot upgrade to another engine image",
 			v.Name, v.Status.CurrentImage, v.Spec.EngineImage)
 	}
 	if v.Spec.MigrationNodeID != "" {
-		return nil, fmt.Errorf("cannot upgrade during migration")
+		return nil, newError(ErrorReasonInvalidState, "cannot upgrade during migration")
+	}
+	if v.Spec.TrashedAt != "" {
+		return nil, newError(ErrorReasonInvalidState, "cannot upgrade volume %v in the trash", v.Name)
+	}
+	// the versions of the image are known once it's checked ready
+	nodeIDs, err := m.getVolumeInstanceNodes(v, v.Spec.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.CheckEngineImageReadiness(image, nodeIDs...); err != nil {
+		return nil, newError(ErrorReasonInvalidState, "%v", err)
+	}
+	if err := m.checkVolumeUpgradable(v, ei); err != nil {
+		return nil, err
 	}
 
 	oldImage := v.Spec.EngineImage
@@ -431,6 +1086,69 @@ func (m *VolumeManager) EngineUpgrade(volumeName, image string) (v *longhorn.Vol
 	return v, nil
 }
 
+// checkVolumeUpgradable rejects the upgrade of the volume rebuilding or
+// restoring, the upgrade to the engine image which cannot serve the data
+// format of the volume, and the live upgrade to the engine image whose
+// controller API is not compatible with the running one
+func (m *VolumeManager) checkVolumeUpgradable(v *longhorn.Volume, ei *longhorn.EngineImage) error {
+	restoring, err := m.isVolumeRestoring(v)
+	if err != nil {
+		return err
+	}
+	if restoring {
+		return newError(ErrorReasonInvalidState, "cannot upgrade volume %v during restoring", v.Name)
+	}
+	// the limits would be gone with the engine upgraded
+	if v.Spec.QoS != (types.VolumeQoS{}) && ei.Status.CLIAPIVersion < engineapi.QoSMinCLIAPIVersion {
+		return newError(ErrorReasonInvalidInput, "cannot upgrade volume %v with QoS to engine image %v not supporting it", v.Name, ei.Spec.Image)
+	}
+	// the new engine must keep the frontend read-only
+	if len(v.Spec.ReadOnlyNodeIDs) != 0 && ei.Status.CLIAPIVersion < engineapi.FrontendReadOnlyMinCLIAPIVersion {
+		return newError(ErrorReasonInvalidInput, "cannot upgrade volume %v attached read-only to engine image %v not supporting it", v.Name, ei.Spec.Image)
+	}
+	// the volume never started has no data written yet
+	if v.Status.CurrentImage == "" {
+		return nil
+	}
+	current, err := m.ds.GetEngineImage(types.GetEngineImageChecksumName(v.Status.CurrentImage))
+	if err != nil {
+		return errors.Wrapf(err, "cannot get current engine image %v", v.Status.CurrentImage)
+	}
+	if err := engineapi.CheckDataFormatCompatibility(&current.Status.EngineVersionDetails, &ei.Status.EngineVersionDetails); err != nil {
+		return newError(ErrorReasonInvalidInput, "cannot upgrade volume %v from engine image %v to %v: %v",
+			v.Name, current.Spec.Image, ei.Spec.Image, err)
+	}
+	if v.Status.State != types.VolumeStateAttached {
+		return nil
+	}
+
+	es, err := m.ds.ListVolumeEngines(v.Name)
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		// the engine process is started without the launcher doing the
+		// live upgrade
+		if e.Status.InstanceManagerName != "" {
+			return newError(ErrorReasonInvalidState, "cannot live upgrade volume %v whose engine runs in instance manager %v, detach the volume to upgrade",
+				v.Name, e.Status.InstanceManagerName)
+		}
+		for replicaName, mode := range e.Status.ReplicaModeMap {
+			if mode == types.ReplicaModeWO {
+				return newError(ErrorReasonInvalidState, "cannot upgrade volume %v during rebuilding replica %v", v.Name, replicaName)
+			}
+		}
+	}
+
+	if ei.Status.ControllerAPIMinVersion > current.Status.ControllerAPIVersion ||
+		current.Status.ControllerAPIMinVersion > ei.Status.ControllerAPIVersion {
+		return newError(ErrorReasonInvalidInput, "cannot live upgrade volume %v from engine image %v (controller API %v-%v) to %v (controller API %v-%v)",
+			v.Name, current.Spec.Image, current.Status.ControllerAPIMinVersion, current.Status.ControllerAPIVersion,
+			ei.Spec.Image, ei.Status.ControllerAPIMinVersion, ei.Status.ControllerAPIVersion)
+	}
+	return nil
+}
+
 func (m *VolumeManager) checkVolumeNotInMigration(volumeName string) error {
 	v, err := m.Get(volumeName)
 	if err != nil {
@@ -463,6 +1181,9 @@ func (m *VolumeManager) MigrationStart(name, nodeID string) (v *longhorn.Volume,
 	if v.Spec.MigrationNodeID != "" {
 		return nil, fmt.Errorf("migration already started")
 	}
+	if len(v.Spec.ReadOnlyNodeIDs) != 0 {
+		return nil, fmt.Errorf("cannot migrate volume attached read-only to %v", v.Spec.ReadOnlyNodeIDs)
+	}
 	if v.Spec.NodeID == nodeID {
 		return nil, fmt.Errorf("cannot migrate to the same node as volume currently attached to")
 	}
@@ -473,6 +1194,9 @@ func (m *VolumeManager) MigrationStart(name, nodeID string) (v *longhorn.Volume,
 	if _, err := m.Node2APIAddress(nodeID); err != nil {
 		return nil, err
 	}
+	if err := m.scheduler.CheckEngineNode(nodeID, true); err != nil {
+		return nil, err
+	}
 
 	v.Spec.MigrationNodeID = nodeID
 	v, err = m.ds.UpdateVolume(v)
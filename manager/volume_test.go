@@ -0,0 +1,431 @@
+package manager
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/engineapi"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+func newTestVolume(name string, size int64, created int64, state types.VolumeState, nodeID string) *longhorn.Volume {
+	return &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(time.Unix(created, 0)),
+		},
+		Spec: types.VolumeSpec{
+			Size:   size,
+			NodeID: nodeID,
+		},
+		Status: types.VolumeStatus{
+			State: state,
+		},
+	}
+}
+
+func newTestVolumeMap(volumes ...*longhorn.Volume) map[string]*longhorn.Volume {
+	volumeMap := map[string]*longhorn.Volume{}
+	for _, v := range volumes {
+		volumeMap[v.Name] = v
+	}
+	return volumeMap
+}
+
+// listTestVolumePage pages the volumes as ListPage does, without the
+// datastore
+func listTestVolumePage(volumeMap map[string]*longhorn.Volume, opts VolumeListOptions) (*VolumePage, error) {
+	if opts.SortBy == "" {
+		opts.SortBy = VolumeSortByName
+	}
+	var start *volumeListMarker
+	if opts.Marker != "" {
+		marker, err := decodeVolumeListMarker(opts.Marker, opts)
+		if err != nil {
+			return nil, err
+		}
+		start = marker
+	}
+	return pageVolumes(volumeMap, start, opts)
+}
+
+func volumePageNames(page *VolumePage) []string {
+	names := []string{}
+	for _, v := range page.Volumes {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+// listAllTestVolumePages follows the markers until the last page, and returns
+// the names of the volumes of each page
+func listAllTestVolumePages(t *testing.T, volumeMap map[string]*longhorn.Volume, opts VolumeListOptions) [][]string {
+	assert := require.New(t)
+
+	pages := [][]string{}
+	for {
+		page, err := listTestVolumePage(volumeMap, opts)
+		assert.Nil(err)
+		assert.Equal(len(volumeMap), page.Total)
+		pages = append(pages, volumePageNames(page))
+		if page.Marker == "" {
+			return pages
+		}
+		opts.Marker = page.Marker
+	}
+}
+
+func TestPageVolumesMarker(t *testing.T) {
+	assert := require.New(t)
+
+	volumeMap := newTestVolumeMap(
+		newTestVolume("vol-c", 3, 300, types.VolumeStateDetached, ""),
+		newTestVolume("vol-a", 1, 100, types.VolumeStateDetached, ""),
+		newTestVolume("vol-e", 5, 500, types.VolumeStateDetached, ""),
+		newTestVolume("vol-b", 2, 200, types.VolumeStateDetached, ""),
+		newTestVolume("vol-d", 4, 400, types.VolumeStateDetached, ""),
+	)
+
+	// all in one page without the limit
+	page, err := listTestVolumePage(volumeMap, VolumeListOptions{})
+	assert.Nil(err)
+	assert.Equal([]string{"vol-a", "vol-b", "vol-c", "vol-d", "vol-e"}, volumePageNames(page))
+	assert.Equal("", page.Marker)
+	assert.Equal(5, page.Total)
+
+	assert.Equal([][]string{
+		{"vol-a", "vol-b"},
+		{"vol-c", "vol-d"},
+		{"vol-e"},
+	}, listAllTestVolumePages(t, volumeMap, VolumeListOptions{Limit: 2}))
+
+	// the limit of exactly the number of the volumes
+	assert.Equal([][]string{
+		{"vol-a", "vol-b", "vol-c", "vol-d", "vol-e"},
+	}, listAllTestVolumePages(t, volumeMap, VolumeListOptions{Limit: 5}))
+
+	// the pages continue after the position of the marker, so the volumes
+	// created or deleted in the meantime don't shift the next page
+	page, err = listTestVolumePage(volumeMap, VolumeListOptions{Limit: 2})
+	assert.Nil(err)
+	volumeMap["vol-aa"] = newTestVolume("vol-aa", 1, 600, types.VolumeStateDetached, "")
+	volumeMap["vol-bb"] = newTestVolume("vol-bb", 2, 700, types.VolumeStateDetached, "")
+	delete(volumeMap, "vol-b")
+	page, err = listTestVolumePage(volumeMap, VolumeListOptions{Limit: 2, Marker: page.Marker})
+	assert.Nil(err)
+	assert.Equal([]string{"vol-bb", "vol-c"}, volumePageNames(page))
+	assert.Equal(6, page.Total)
+}
+
+func TestPageVolumesDescending(t *testing.T) {
+	assert := require.New(t)
+
+	volumeMap := newTestVolumeMap(
+		newTestVolume("vol-a", 3, 200, types.VolumeStateDetached, ""),
+		newTestVolume("vol-b", 1, 300, types.VolumeStateDetached, ""),
+		newTestVolume("vol-c", 2, 100, types.VolumeStateDetached, ""),
+	)
+
+	assert.Equal([][]string{
+		{"vol-c", "vol-b"},
+		{"vol-a"},
+	}, listAllTestVolumePages(t, volumeMap, VolumeListOptions{Limit: 2, Descending: true}))
+	assert.Equal([][]string{
+		{"vol-a", "vol-c"},
+		{"vol-b"},
+	}, listAllTestVolumePages(t, volumeMap, VolumeListOptions{Limit: 2, SortBy: VolumeSortBySize, Descending: true}))
+	assert.Equal([][]string{
+		{"vol-b", "vol-a"},
+		{"vol-c"},
+	}, listAllTestVolumePages(t, volumeMap, VolumeListOptions{Limit: 2, SortBy: VolumeSortByCreated, Descending: true}))
+}
+
+func TestPageVolumesTies(t *testing.T) {
+	assert := require.New(t)
+
+	// the volumes of the same size and creation time are ordered by the
+	// names, so no volume is skipped or repeated across the pages
+	volumeMap := newTestVolumeMap(
+		newTestVolume("vol-d", 2, 100, types.VolumeStateDetached, ""),
+		newTestVolume("vol-b", 1, 100, types.VolumeStateDetached, ""),
+		newTestVolume("vol-c", 1, 100, types.VolumeStateDetached, ""),
+		newTestVolume("vol-a", 1, 100, types.VolumeStateDetached, ""),
+		newTestVolume("vol-e", 2, 100, types.VolumeStateDetached, ""),
+	)
+
+	for _, tc := range []struct {
+		name  string
+		opts  VolumeListOptions
+		pages [][]string
+	}{
+		{
+			"size",
+			VolumeListOptions{Limit: 2, SortBy: VolumeSortBySize},
+			[][]string{{"vol-a", "vol-b"}, {"vol-c", "vol-d"}, {"vol-e"}},
+		},
+		{
+			"size descending",
+			VolumeListOptions{Limit: 2, SortBy: VolumeSortBySize, Descending: true},
+			[][]string{{"vol-e", "vol-d"}, {"vol-c", "vol-b"}, {"vol-a"}},
+		},
+		{
+			"created",
+			VolumeListOptions{Limit: 2, SortBy: VolumeSortByCreated},
+			[][]string{{"vol-a", "vol-b"}, {"vol-c", "vol-d"}, {"vol-e"}},
+		},
+		{
+			"created descending",
+			VolumeListOptions{Limit: 2, SortBy: VolumeSortByCreated, Descending: true},
+			[][]string{{"vol-e", "vol-d"}, {"vol-c", "vol-b"}, {"vol-a"}},
+		},
+	} {
+		assert.Equal(tc.pages, listAllTestVolumePages(t, volumeMap, tc.opts), tc.name)
+	}
+}
+
+func TestPageVolumesFilters(t *testing.T) {
+	assert := require.New(t)
+
+	volumeMap := newTestVolumeMap(
+		newTestVolume("db-1", 1, 100, types.VolumeStateAttached, "node-1"),
+		newTestVolume("db-2", 1, 100, types.VolumeStateAttached, "node-2"),
+		newTestVolume("web-1", 1, 100, types.VolumeStateAttached, "node-1"),
+		newTestVolume("web-2", 1, 100, types.VolumeStateDetached, ""),
+		newTestVolume("cache", 1, 100, types.VolumeStateDetached, ""),
+	)
+
+	for _, tc := range []struct {
+		name    string
+		opts    VolumeListOptions
+		volumes []string
+	}{
+		{"state", VolumeListOptions{State: string(types.VolumeStateDetached)}, []string{"cache", "web-2"}},
+		{"node", VolumeListOptions{NodeID: "node-1"}, []string{"db-1", "web-1"}},
+		{"name", VolumeListOptions{NameContains: "db-"}, []string{"db-1", "db-2"}},
+		{"all filters", VolumeListOptions{State: string(types.VolumeStateAttached), NodeID: "node-1", NameContains: "web"}, []string{"web-1"}},
+		{"no match", VolumeListOptions{NodeID: "node-3"}, []string{}},
+	} {
+		page, err := listTestVolumePage(volumeMap, tc.opts)
+		assert.Nil(err, tc.name)
+		assert.Equal(tc.volumes, volumePageNames(page), tc.name)
+		// the total only counts the matching volumes
+		assert.Equal(len(tc.volumes), page.Total, tc.name)
+	}
+
+	// the filters apply to the following pages as well
+	page, err := listTestVolumePage(volumeMap, VolumeListOptions{Limit: 1, NodeID: "node-1"})
+	assert.Nil(err)
+	assert.Equal([]string{"db-1"}, volumePageNames(page))
+	page, err = listTestVolumePage(volumeMap, VolumeListOptions{Limit: 1, NodeID: "node-1", Marker: page.Marker})
+	assert.Nil(err)
+	assert.Equal([]string{"web-1"}, volumePageNames(page))
+	assert.Equal("", page.Marker)
+	assert.Equal(2, page.Total)
+}
+
+func TestPageVolumesInvalidMarker(t *testing.T) {
+	assert := require.New(t)
+
+	volumeMap := newTestVolumeMap(
+		newTestVolume("vol-a", 1, 100, types.VolumeStateDetached, ""),
+		newTestVolume("vol-b", 2, 200, types.VolumeStateDetached, ""),
+	)
+	page, err := listTestVolumePage(volumeMap, VolumeListOptions{Limit: 1, SortBy: VolumeSortBySize})
+	assert.Nil(err)
+	assert.NotEqual("", page.Marker)
+
+	for _, tc := range []struct {
+		name string
+		opts VolumeListOptions
+	}{
+		{"not base64", VolumeListOptions{Marker: "not a marker!"}},
+		{"not json", VolumeListOptions{Marker: base64.RawURLEncoding.EncodeToString([]byte("vol-a"))}},
+		{"other sort key", VolumeListOptions{Marker: page.Marker, SortBy: VolumeSortByCreated}},
+		{"other order", VolumeListOptions{Marker: page.Marker, SortBy: VolumeSortBySize, Descending: true}},
+	} {
+		_, err := listTestVolumePage(volumeMap, tc.opts)
+		assert.NotNil(err, tc.name)
+		managerErr, ok := errors.Cause(err).(*Error)
+		assert.True(ok, tc.name)
+		assert.Equal(ErrorReasonInvalidInput, managerErr.Reason, tc.name)
+	}
+}
+
+func TestListPageInvalidOptions(t *testing.T) {
+	assert := require.New(t)
+
+	// the options are checked before listing the volumes
+	m := &VolumeManager{}
+	for _, opts := range []VolumeListOptions{
+		{SortBy: "replicas"},
+		{Limit: -1},
+		{Marker: "not a marker!"},
+	} {
+		_, err := m.ListPage(opts)
+		managerErr, ok := errors.Cause(err).(*Error)
+		assert.True(ok, "%+v", opts)
+		assert.Equal(ErrorReasonInvalidInput, managerErr.Reason, "%+v", opts)
+	}
+}
+
+func newTestROXVolume(name string) *longhorn.Volume {
+	v := newTestVolume(name, 1024, 100, types.VolumeStateDetached, "")
+	v.Spec.NumberOfReplicas = 2
+	v.Spec.AccessMode = types.VolumeAccessModeReadOnlyMany
+	v.Spec.Frontend = types.VolumeFrontendISCSI
+	v.Spec.EngineImage = TestEngineImage
+	return v
+}
+
+func TestAttachReadWriteWithReadOnlyAttachments(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestVolumeManager()
+	v := newTestROXVolume("vol-rox")
+	v.Spec.NodeID = TestNode1
+	v.Spec.ReadOnlyNodeIDs = []string{TestNode1, TestNode2}
+	v.Status.State = types.VolumeStateAttached
+	m.addObjects(t, v, newTestNode(TestNode1), newTestNode(TestNode2),
+		newTestEngineImage(TestEngineImage, engineapi.FrontendReadOnlyMinCLIAPIVersion))
+
+	// neither the node of the engine nor the other nodes can write
+	for _, nodeID := range []string{TestNode1, TestNode2} {
+		_, err := m.Attach(v.Name, nodeID, false, false)
+		assert.NotNil(err, nodeID)
+		managerErr, ok := errors.Cause(err).(*Error)
+		assert.True(ok, nodeID)
+		assert.Equal(ErrorReasonInvalidState, managerErr.Reason, nodeID)
+	}
+	assert.Equal([]string{TestNode1, TestNode2}, m.getVolume(t, v.Name).Spec.ReadOnlyNodeIDs)
+
+	// one of the read-only nodes detached, the others still block the
+	// read-write attachment
+	_, err := m.Detach(v.Name, TestNode2, false)
+	assert.Nil(err)
+	v = m.getVolume(t, v.Name)
+	assert.Equal([]string{TestNode1}, v.Spec.ReadOnlyNodeIDs)
+	assert.Nil(m.lhInformerFactory.Longhorn().V1alpha1().Volumes().Informer().GetIndexer().Update(v))
+	_, err = m.Attach(v.Name, TestNode2, false, false)
+	assert.NotNil(err)
+	managerErr, ok := errors.Cause(err).(*Error)
+	assert.True(ok)
+	assert.Equal(ErrorReasonInvalidState, managerErr.Reason)
+}
+
+func TestAttachReadOnlyEngineImageSupport(t *testing.T) {
+	assert := require.New(t)
+
+	// the engine image not able to export the volume read-only would
+	// leave the volume writable to any node logged in the target
+	m := newTestVolumeManager()
+	v := newTestROXVolume("vol-rox")
+	m.addObjects(t, v, newTestNode(TestNode1),
+		newTestEngineImage(TestEngineImage, engineapi.FrontendReadOnlyMinCLIAPIVersion-1))
+	_, err := m.Attach(v.Name, TestNode1, false, true)
+	assert.NotNil(err)
+	managerErr, ok := errors.Cause(err).(*Error)
+	assert.True(ok)
+	assert.Equal(ErrorReasonInvalidState, managerErr.Reason)
+	assert.Contains(err.Error(), "cannot export the volume read-only")
+	assert.Empty(m.getVolume(t, v.Name).Spec.ReadOnlyNodeIDs)
+}
+
+func newTestFailedReplica(name, volumeName string, reason types.ReplicaFailureReason) *longhorn.Replica {
+	return &longhorn.Replica{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: types.ReplicaSpec{
+			InstanceSpec: types.InstanceSpec{
+				VolumeName: volumeName,
+				NodeID:     TestNode1,
+			},
+			DiskID:   "test-disk",
+			FailedAt: "2019-01-01T00:00:00Z",
+		},
+		Status: types.ReplicaStatus{
+			FailureReason: reason,
+		},
+	}
+}
+
+func TestSalvageRebuildFailedReplica(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestVolumeManager()
+	v := newTestVolume("vol-faulted", 1024, 100, types.VolumeStateDetached, "")
+	v.Spec.NumberOfReplicas = 2
+	v.Status.Robustness = types.VolumeRobustnessFaulted
+	rebuildFailed := newTestFailedReplica("r-rebuild-failed", v.Name, types.ReplicaFailureReasonRebuildFailed)
+	nodeDown := newTestFailedReplica("r-node-down", v.Name, types.ReplicaFailureReasonNodeDown)
+	m.addObjects(t, v, newTestNode(TestNode1), rebuildFailed, nodeDown)
+
+	// the replica failed during the rebuilding never had the complete data
+	_, err := m.Salvage(v.Name, []string{rebuildFailed.Name})
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "failed during rebuilding")
+	r, err := m.lhClient.LonghornV1alpha1().Replicas(TestNamespace).Get(rebuildFailed.Name, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.NotEmpty(r.Spec.FailedAt)
+	assert.Equal(types.VolumeRobustnessFaulted, m.getVolume(t, v.Name).Status.Robustness)
+
+	_, err = m.Salvage(v.Name, []string{nodeDown.Name})
+	assert.Nil(err)
+	r, err = m.lhClient.LonghornV1alpha1().Replicas(TestNamespace).Get(nodeDown.Name, metav1.GetOptions{})
+	assert.Nil(err)
+	assert.Empty(r.Spec.FailedAt)
+	// the failure reason is kept for the next salvage
+	assert.Equal(types.ReplicaFailureReasonNodeDown, r.Status.FailureReason)
+	assert.Equal(types.VolumeRobustnessUnknown, m.getVolume(t, v.Name).Status.Robustness)
+}
+
+func TestUpdateReplicaCount(t *testing.T) {
+	assert := require.New(t)
+
+	m := newTestVolumeManager()
+	v := newTestVolume("vol-1", 1024, 100, types.VolumeStateDetached, "")
+	v.Spec.NumberOfReplicas = 3
+	migrating := newTestVolume("vol-migrating", 1024, 100, types.VolumeStateAttached, TestNode1)
+	migrating.Spec.NumberOfReplicas = 3
+	migrating.Spec.MigrationNodeID = TestNode2
+	m.addObjects(t, v, migrating)
+
+	for name, tc := range map[string]struct {
+		volumeName   string
+		replicaCount int
+		reason       ErrorReason
+	}{
+		"zero":      {v.Name, 0, ErrorReasonInvalidInput},
+		"negative":  {v.Name, -1, ErrorReasonInvalidInput},
+		"not found": {"vol-nonexistent", 2, ErrorReasonNotFound},
+		"migrating": {migrating.Name, 2, ErrorReasonInvalidState},
+	} {
+		_, err := m.UpdateReplicaCount(tc.volumeName, tc.replicaCount)
+		managerErr, ok := errors.Cause(err).(*Error)
+		assert.True(ok, name)
+		assert.Equal(tc.reason, managerErr.Reason, name)
+	}
+	assert.Equal(3, m.getVolume(t, v.Name).Spec.NumberOfReplicas)
+	assert.Equal(3, m.getVolume(t, migrating.Name).Spec.NumberOfReplicas)
+	assert.Len(m.recorder.Events, 0)
+
+	// the same count changes nothing
+	_, err := m.UpdateReplicaCount(v.Name, 3)
+	assert.Nil(err)
+	assert.Len(m.recorder.Events, 0)
+
+	updated, err := m.UpdateReplicaCount(v.Name, 2)
+	assert.Nil(err)
+	assert.Equal(2, updated.Spec.NumberOfReplicas)
+	assert.Equal(2, m.getVolume(t, v.Name).Spec.NumberOfReplicas)
+	assert.Len(m.recorder.Events, 1)
+	assert.Equal("Normal "+EventReasonUpdateReplicaCount+" Updated replica count from 3 to 2", <-m.recorder.Events)
+}
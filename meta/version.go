@@ -0,0 +1,8 @@
+package meta
+
+// The values are set at build time by the ldflags in scripts/build
+var (
+	Version   = "0.2.0"
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
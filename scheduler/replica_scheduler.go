@@ -3,8 +3,11 @@ package scheduler
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
 	"github.com/rancher/longhorn-manager/datastore"
 	"github.com/rancher/longhorn-manager/types"
 	"github.com/rancher/longhorn-manager/util"
@@ -14,178 +17,485 @@ import (
 
 type ReplicaScheduler struct {
 	ds *datastore.DataStore
+
+	weights ScoringWeights
 }
 
 type Disk struct {
 	types.DiskSpec
-	NodeID string
+	NodeID   string
+	DiskUUID string
+
+	StorageScheduled   int64
+	StorageSchedulable int64
+	StorageAvailable   int64
+	StorageMaximum     int64
 }
 
 type DiskSchedulingInfo struct {
-	StorageAvailable           int64
-	StorageMaximum             int64
-	StorageReserved            int64
+	StorageAvailable int64
+	StorageMaximum   int64
+	StorageReserved  int64
+	// StorageScheduled is the estimated size of the replicas on the disk,
+	// weighted between their volume sizes and their actual sizes
 	StorageScheduled           int64
 	OverProvisioningPercentage int64
 	MinimalAvailablePercentage int64
+	ActualUsageWeight          int64
 }
 
 func NewReplicaScheduler(ds *datastore.DataStore) *ReplicaScheduler {
 	rcScheduler := &ReplicaScheduler{
 		ds: ds,
+
+		weights: DefaultScoringWeights,
 	}
 	return rcScheduler
 }
 
-// ScheduleReplica will return (nil, nil) for unschedulable replica
-func (rcs *ReplicaScheduler) ScheduleReplica(replica *longhorn.Replica, replicas map[string]*longhorn.Replica) (*longhorn.Replica, error) {
+// ScheduleReplica will return (nil, failure, nil) for unschedulable replica,
+// and the failure records why the replica cannot be scheduled to each node
+func (rcs *ReplicaScheduler) ScheduleReplica(replica *longhorn.Replica, replicas map[string]*longhorn.Replica, volume *longhorn.Volume) (*longhorn.Replica, *SchedulingFailure, error) {
 	// only called when replica is starting for the first time
 	if replica.Spec.NodeID != "" {
-		return nil, fmt.Errorf("BUG: Replica %v has been scheduled to node %v", replica.Name, replica.Spec.NodeID)
+		return nil, nil, fmt.Errorf("BUG: Replica %v has been scheduled to node %v", replica.Name, replica.Spec.NodeID)
 	}
 
-	// get all hosts
-	nodeInfo, err := rcs.getNodeInfo()
+	// get all hosts, including the ones not schedulable but having the
+	// existing replicas
+	nodes, err := rcs.ds.ListNodesRO()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	nodeZones := map[string]string{}
+	for name, node := range nodes {
+		nodeZones[name] = node.Status.Zone
 	}
-	if len(nodeInfo) == 0 {
-		logrus.Errorf("There's no available node for replica %+v", replica)
-		return nil, nil
+	zoneSoftAntiAffinity, err := rcs.ds.GetReplicaZoneSoftAntiAffinity()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// find proper node and disk
-	diskCandidates := rcs.chooseDiskCandidates(nodeInfo, replicas, replica)
+	failure := NewSchedulingFailure()
+	diskCandidates, decision := rcs.chooseDiskCandidates(nodes, nodeZones, replicas, replica, volume, zoneSoftAntiAffinity, failure)
 
 	// there's no disk that fit for current replica
 	if len(diskCandidates) == 0 {
-		logrus.Errorf("There's no available disk for replica %+v", replica)
-		return nil, nil
+		logrus.Errorf("There's no available disk for replica %v: %v", replica.Name, failure.Message())
+		return nil, failure, nil
+	}
+	diskCandidates, err = rcs.preferEngineImageReadyNodes(diskCandidates, replica.Spec.EngineImage)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// schedule replica to disk
-	rcs.scheduleReplicaToDisk(replica, diskCandidates)
+	// schedule replica to the disk with the highest score
+	fsid, disk := pickDisk(nodes, diskCandidates, replicas, rcs.weights)
+	rcs.scheduleReplicaToDisk(replica, fsid, disk)
+	replica.Status.Zone = nodeZones[replica.Spec.NodeID]
+	if decision == types.ReplicaSchedulingDecisionNewZone && replica.Status.Zone == "" {
+		decision = types.ReplicaSchedulingDecisionNewNode
+	}
+	replica.Status.SchedulingDecision = decision
 
-	return replica, nil
+	return replica, nil, nil
 }
 
-func (rcs *ReplicaScheduler) chooseDiskCandidates(nodeInfo map[string]*longhorn.Node, replicas map[string]*longhorn.Replica, replica *longhorn.Replica) map[string]*Disk {
-	diskCandidates := map[string]*Disk{}
+// chooseDiskCandidates prefers the nodes in the zones without other replicas
+// of the volume, then the nodes without other replicas but in the same zones
+// with them, then the nodes already having replicas. The nodes in the same
+// zones are skipped if the zone level soft anti-affinity is disabled, unless
+// the zone of the node is unknown. The disk candidates of all the nodes with
+// the same preference are returned, indexed by the node name.
+func (rcs *ReplicaScheduler) chooseDiskCandidates(nodes map[string]*longhorn.Node, nodeZones map[string]string, replicas map[string]*longhorn.Replica, replica *longhorn.Replica, volume *longhorn.Volume, zoneSoftAntiAffinity bool, failure *SchedulingFailure) (map[string]map[string]*Disk, types.ReplicaSchedulingDecision) {
+	usedNodes := map[string]struct{}{}
+	usedZones := map[string]struct{}{}
+	for _, r := range replicas {
+		// filter replica in deleting process
+		if r.Spec.NodeID == "" || r.DeletionTimestamp != nil {
+			continue
+		}
+		usedNodes[r.Spec.NodeID] = struct{}{}
+		if zone := nodeZones[r.Spec.NodeID]; zone != "" {
+			usedZones[zone] = struct{}{}
+		}
+	}
+
+	newZoneNodes := []*longhorn.Node{}
+	sameZoneNodes := []*longhorn.Node{}
 	filterdNode := []*longhorn.Node{}
-	for nodeName, node := range nodeInfo {
-		isFilterd := false
-		for _, r := range replicas {
-			// filter replica in deleting process
-			if r.Spec.NodeID != "" && r.Spec.NodeID == nodeName && r.DeletionTimestamp == nil {
+	for nodeName, node := range nodes {
+		if reason := rcs.getNodeUnschedulableReason(node); reason != "" {
+			failure.Add(nodeName, reason)
+			continue
+		}
+		// the tags only affect the replicas going to be scheduled, the
+		// existing replicas won't be touched if the tags changed
+		if missingTags := getMissingTags(node.Spec.Tags, volume.Spec.NodeSelector); len(missingTags) != 0 {
+			failure.Add(nodeName, fmt.Sprintf(schedulingFailureReasonMissingNodeTag, strings.Join(missingTags, ",")))
+			continue
+		}
+		zone := node.Status.Zone
+		if !isZoneSelected(zone, volume.Spec.ZoneSelector) {
+			failure.Add(nodeName, SchedulingFailureReasonZoneNotSelected)
+			continue
+		}
+		if _, ok := usedNodes[nodeName]; ok {
+			if zone == "" || zoneSoftAntiAffinity {
 				filterdNode = append(filterdNode, node)
-				isFilterd = true
-				break
+			} else {
+				failure.Add(nodeName, SchedulingFailureReasonAntiAffinity)
 			}
+			continue
 		}
-		if !isFilterd {
-			diskCandidates = rcs.filterNodeDisksForReplica(node, replica, replicas)
-			if len(diskCandidates) > 0 {
-				return diskCandidates
+		if _, ok := usedZones[zone]; ok {
+			if zoneSoftAntiAffinity {
+				sameZoneNodes = append(sameZoneNodes, node)
+			} else {
+				failure.Add(nodeName, SchedulingFailureReasonAntiAffinity)
 			}
+			continue
 		}
+		newZoneNodes = append(newZoneNodes, node)
+	}
+
+	// the decision would be corrected to new node by the caller if the
+	// zone of the chosen node is unknown
+	if diskCandidates := rcs.filterNodesDisksForReplica(newZoneNodes, replica, replicas, volume, failure); len(diskCandidates) > 0 {
+		return diskCandidates, types.ReplicaSchedulingDecisionNewZone
+	}
+	if diskCandidates := rcs.filterNodesDisksForReplica(sameZoneNodes, replica, replicas, volume, failure); len(diskCandidates) > 0 {
+		return diskCandidates, types.ReplicaSchedulingDecisionSameZone
 	}
 	// If there's no disk fit for replica on other nodes,
 	// try to schedule to node that has been scheduled replicas.
-	for _, node := range filterdNode {
-		diskCandidates = rcs.filterNodeDisksForReplica(node, replica, replicas)
+	if diskCandidates := rcs.filterNodesDisksForReplica(filterdNode, replica, replicas, volume, failure); len(diskCandidates) > 0 {
+		return diskCandidates, types.ReplicaSchedulingDecisionSameNode
 	}
 
+	return map[string]map[string]*Disk{}, ""
+}
+
+// preferEngineImageReadyNodes drops the disk candidates on the nodes where
+// the engine image hasn't been deployed yet, e.g. still pulling the image,
+// unless there is no candidate on the nodes with the image ready
+func (rcs *ReplicaScheduler) preferEngineImageReadyNodes(diskCandidates map[string]map[string]*Disk, image string) (map[string]map[string]*Disk, error) {
+	ei, err := rcs.ds.GetEngineImage(types.GetEngineImageChecksumName(image))
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return diskCandidates, nil
+		}
+		return nil, err
+	}
+	readyCandidates := map[string]map[string]*Disk{}
+	for nodeName, disks := range diskCandidates {
+		if ei.Status.NodeDeploymentMap[nodeName] {
+			readyCandidates[nodeName] = disks
+		}
+	}
+	if len(readyCandidates) == 0 {
+		return diskCandidates, nil
+	}
+	return readyCandidates, nil
+}
+
+func (rcs *ReplicaScheduler) filterNodesDisksForReplica(nodes []*longhorn.Node, replica *longhorn.Replica, replicas map[string]*longhorn.Replica, volume *longhorn.Volume, failure *SchedulingFailure) map[string]map[string]*Disk {
+	diskCandidates := map[string]map[string]*Disk{}
+	for _, node := range nodes {
+		disks, reason := rcs.filterNodeDisksForReplica(node, replica, replicas, volume)
+		if len(disks) == 0 {
+			failure.Add(node.Name, reason)
+			continue
+		}
+		diskCandidates[node.Name] = disks
+	}
 	return diskCandidates
 }
 
-func (rcs *ReplicaScheduler) filterNodeDisksForReplica(node *longhorn.Node, replica *longhorn.Replica, replicas map[string]*longhorn.Replica) map[string]*Disk {
+// filterNodeDisksForReplica returns the disks on the node fit for the
+// replica. If there is none, the reason of the disk closest to fit would be
+// returned.
+func (rcs *ReplicaScheduler) filterNodeDisksForReplica(node *longhorn.Node, replica *longhorn.Replica, replicas map[string]*longhorn.Replica, volume *longhorn.Volume) (map[string]*Disk, string) {
 	preferredDisk := map[string]*Disk{}
+	// the reason with higher priority is the one closer to fit
+	reason, priority := SchedulingFailureReasonNoDisk, 0
+	addReason := func(r string, p int) {
+		if p >= priority {
+			reason, priority = r, p
+		}
+	}
 	// find disk that fit for current replica
 	disks := node.Spec.Disks
 	diskStatus := node.Status.DiskStatus
 	for fsid, disk := range disks {
 		status := diskStatus[fsid]
+		// account the other replicas of the volume scheduled to the disk
+		// but not recorded by the node controller yet
+		usage := NewDiskStorageUsage(status)
+		for _, r := range replicas {
+			if r.Spec.NodeID == node.Name && r.Spec.DiskID == fsid {
+				usage.AddReplica(r)
+			}
+		}
+		status.StorageScheduled = usage.StorageScheduled
+		status.StorageUsed = usage.StorageUsed
 		info, err := rcs.GetDiskSchedulingInfo(disk, status)
 		if err != nil {
 			logrus.Errorf("Fail to get settings when scheduling replica: %v", err)
-			return preferredDisk
-		}
-		scheduledReplica := status.ScheduledReplica
-		// check other replicas for the same volume has been accounted on current node
-		var storageScheduled int64
-		for rName, r := range replicas {
-			if _, ok := scheduledReplica[rName]; !ok && r.Spec.NodeID != "" && r.Spec.NodeID == node.Name {
-				storageScheduled += r.Spec.VolumeSize
-			}
+			return preferredDisk, SchedulingFailureReasonSettingError
+		}
+		// the node controller marks the disk unschedulable if the free space
+		// of the disk drops below the minimal available percentage. The disk
+		// being evicted, or on the node being evicted, takes no new replica.
+		schedulableCondition := types.GetDiskConditionFromStatus(status, types.DiskConditionTypeSchedulable)
+		if !disk.AllowScheduling || disk.EvictionRequested || node.Spec.EvictionRequested ||
+			schedulableCondition.Status == types.ConditionStatusFalse ||
+			!rcs.IsSchedulableToDisk(0, info) {
+			addReason(SchedulingFailureReasonDiskUnschedulable, 1)
+			continue
 		}
-		if storageScheduled > 0 {
-			info.StorageScheduled += storageScheduled
+		if missingTags := getMissingTags(disk.Tags, volume.Spec.DiskSelector); len(missingTags) != 0 {
+			addReason(fmt.Sprintf(schedulingFailureReasonMissingDiskTag, strings.Join(missingTags, ",")), 2)
+			continue
 		}
-		if !disk.AllowScheduling ||
-			!rcs.IsSchedulableToDisk(replica.Spec.VolumeSize, info) {
+		if !rcs.IsSchedulableToDisk(replica.Spec.VolumeSize, info) {
+			addReason(SchedulingFailureReasonInsufficientSpace, 3)
 			continue
 		}
 		suggestDisk := &Disk{
 			DiskSpec: disk,
 			NodeID:   node.Name,
+			DiskUUID: status.DiskUUID,
+
+			StorageScheduled:   info.StorageScheduled,
+			StorageSchedulable: GetStorageSchedulable(info),
+			StorageAvailable:   info.StorageAvailable,
+			StorageMaximum:     info.StorageMaximum,
 		}
 		preferredDisk[fsid] = suggestDisk
 	}
 
-	return preferredDisk
+	return preferredDisk, reason
 }
 
-func (rcs *ReplicaScheduler) getNodeInfo() (map[string]*longhorn.Node, error) {
-	nodeInfo, err := rcs.ds.ListNodes()
+// getNodeUnschedulableReason checks both the Longhorn node and the
+// Kubernetes node, since the Ready condition of the Longhorn node is only
+// synced from the Kubernetes node periodically
+func (rcs *ReplicaScheduler) getNodeUnschedulableReason(node *longhorn.Node) string {
+	nodeReadyCondition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
+	if node.DeletionTimestamp != nil || nodeReadyCondition.Status != types.ConditionStatusTrue {
+		return SchedulingFailureReasonNodeNotReady
+	}
+	kubeNode, err := rcs.ds.GetKubernetesNode(node.Name)
 	if err != nil {
-		return nil, err
+		logrus.Warnf("Cannot get Kubernetes node %v for scheduling: %v", node.Name, err)
+		return SchedulingFailureReasonNodeNotReady
+	}
+	if !isKubernetesNodeReady(kubeNode) {
+		return SchedulingFailureReasonNodeNotReady
+	}
+	// the node not checked yet has no such condition
+	if types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeRequiredPackages).Status == types.ConditionStatusFalse {
+		return SchedulingFailureReasonMissingPackages
+	}
+	if kubeNode.Spec.Unschedulable {
+		return SchedulingFailureReasonKubernetesNodeCordoned
+	}
+	if node.Spec.MaintenanceMode {
+		return SchedulingFailureReasonNodeMaintenance
+	}
+	if !node.Spec.AllowScheduling {
+		return SchedulingFailureReasonNodeUnschedulable
 	}
-	scheduledNode := map[string]*longhorn.Node{}
-	for _, node := range nodeInfo {
-		nodeReadyCondition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeReady)
-		if node != nil && node.DeletionTimestamp == nil && nodeReadyCondition.Status == types.ConditionStatusTrue && node.Spec.AllowScheduling {
-			scheduledNode[node.Name] = node
+	return ""
+}
+
+func isKubernetesNodeReady(kubeNode *corev1.Node) bool {
+	for _, con := range kubeNode.Status.Conditions {
+		if con.Type == corev1.NodeReady {
+			return con.Status == corev1.ConditionTrue
 		}
 	}
-	return scheduledNode, nil
+	return false
+}
+
+// CheckEngineNode returns error if the engine of the volume cannot be placed
+// on the node. The node requested explicitly by the user is allowed even if
+// it's unschedulable, unless it's in the maintenance mode, it's missing the
+// packages required to attach, or it's cordoned in Kubernetes and the cordon
+// policy is to block everything. The node without the mount propagation is
+// never allowed.
+func (rcs *ReplicaScheduler) CheckEngineNode(nodeID string, requested bool) error {
+	node, err := rcs.ds.GetNodeRO(nodeID)
+	if err != nil {
+		return err
+	}
+	// the volume cannot reach the workload without the mount propagation,
+	// even if the node is requested
+	mountPropagationCondition := types.GetNodeConditionFromStatus(node.Status, types.NodeConditionTypeMountPropagation)
+	if mountPropagationCondition.Status == types.ConditionStatusFalse {
+		return fmt.Errorf("node %v doesn't support the mount propagation required by the engine: %v", nodeID, mountPropagationCondition.Message)
+	}
+	reason := rcs.getNodeUnschedulableReason(node)
+	if reason == "" {
+		return nil
+	}
+	if !requested {
+		return fmt.Errorf("node %v is unschedulable: %v", nodeID, reason)
+	}
+	if reason == SchedulingFailureReasonNodeMaintenance {
+		return fmt.Errorf("node %v is in maintenance mode", nodeID)
+	}
+	if reason == SchedulingFailureReasonMissingPackages {
+		return fmt.Errorf("node %v is missing the packages required by Longhorn", nodeID)
+	}
+	if reason != SchedulingFailureReasonKubernetesNodeCordoned {
+		return nil
+	}
+	policy, err := rcs.ds.GetKubernetesNodeCordonPolicy()
+	if err != nil {
+		return err
+	}
+	if policy == types.KubernetesNodeCordonPolicyBlockAll {
+		return fmt.Errorf("node %v is cordoned in Kubernetes", nodeID)
+	}
+	return nil
 }
 
-func (rcs *ReplicaScheduler) scheduleReplicaToDisk(replica *longhorn.Replica, diskCandidates map[string]*Disk) {
-	// get a random disk from diskCandidates
-	var fsid string
-	var disk *Disk
-	for fsid, disk = range diskCandidates {
-		break
+// getMissingTags returns the tags in the selector but not in the tags
+func getMissingTags(tags, selector []string) []string {
+	missingTags := []string{}
+	for _, s := range selector {
+		found := false
+		for _, tag := range tags {
+			if tag == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missingTags = append(missingTags, s)
+		}
 	}
+	return missingTags
+}
+
+// isZoneSelected returns true if the selector is empty or contains the zone.
+// The node in the unknown zone is never selected by a non-empty selector.
+func isZoneSelected(zone string, selector []string) bool {
+	if len(selector) == 0 {
+		return true
+	}
+	for _, s := range selector {
+		if s == zone {
+			return true
+		}
+	}
+	return false
+}
+
+func (rcs *ReplicaScheduler) scheduleReplicaToDisk(replica *longhorn.Replica, fsid string, disk *Disk) {
 	replica.Spec.NodeID = disk.NodeID
 	replica.Spec.DiskID = fsid
+	replica.Spec.DiskUUID = disk.DiskUUID
 	replica.Spec.DataPath = filepath.Join(disk.Path, "replicas", replica.Spec.VolumeName+"-"+util.RandomID())
 }
 
+// IsSchedulableToDisk returns false if scheduling the size on the disk would
+// exceed the schedulable storage of the disk, or the disk is under pressure
 func (rcs *ReplicaScheduler) IsSchedulableToDisk(size int64, info *DiskSchedulingInfo) bool {
+	// the part of the new replica expected to be written must fit in the
+	// space actually available on the disk
+	storageAvailable := info.StorageAvailable - size*info.ActualUsageWeight/100
 	return info.StorageMaximum > 0 && info.StorageAvailable > 0 &&
-		(size+info.StorageScheduled) <= (info.StorageMaximum-info.StorageReserved)*(info.OverProvisioningPercentage/100) &&
-		info.StorageAvailable > info.StorageMaximum*info.MinimalAvailablePercentage/100 &&
-		info.StorageAvailable > info.StorageReserved
+		(size+info.StorageScheduled) <= GetStorageSchedulable(info) &&
+		storageAvailable > info.StorageMaximum*info.MinimalAvailablePercentage/100 &&
+		storageAvailable > info.StorageReserved
+}
+
+// GetStorageSchedulable returns the storage can be scheduled to the disk in
+// total. Since the volumes are thin provisioned, it's the usable storage of
+// the disk, the maximum minus the reserved, multiplied by the over
+// provisioning percentage.
+func GetStorageSchedulable(info *DiskSchedulingInfo) int64 {
+	usable := info.StorageMaximum - info.StorageReserved
+	if usable < 0 {
+		return 0
+	}
+	return usable * info.OverProvisioningPercentage / 100
+}
+
+// DiskStorageUsage is the storage taken by the replicas on a disk
+type DiskStorageUsage struct {
+	ScheduledReplica   map[string]int64
+	ReplicaStorageUsed map[string]int64
+	StorageScheduled   int64
+	StorageUsed        int64
+}
+
+// NewDiskStorageUsage returns the usage of the replicas recorded in the disk
+// status by the node controller
+func NewDiskStorageUsage(diskStatus types.DiskStatus) *DiskStorageUsage {
+	usage := &DiskStorageUsage{
+		ScheduledReplica:   map[string]int64{},
+		ReplicaStorageUsed: map[string]int64{},
+		StorageScheduled:   diskStatus.StorageScheduled,
+		StorageUsed:        diskStatus.StorageUsed,
+	}
+	for name, size := range diskStatus.ScheduledReplica {
+		usage.ScheduledReplica[name] = size
+	}
+	for name, used := range diskStatus.ReplicaStorageUsed {
+		usage.ReplicaStorageUsed[name] = used
+	}
+	return usage
+}
+
+// AddReplica accounts the replica on the disk, unless it has been accounted.
+// The node controller and the scheduler both account the replicas on the disk
+// this way. The replica being deleted still counts, since its data stays on
+// the disk until it's gone.
+func (u *DiskStorageUsage) AddReplica(r *longhorn.Replica) {
+	if _, ok := u.ScheduledReplica[r.Name]; ok {
+		return
+	}
+	u.ScheduledReplica[r.Name] = r.Spec.VolumeSize
+	u.StorageScheduled += r.Spec.VolumeSize
+	u.ReplicaStorageUsed[r.Name] = r.Status.FileStats.TotalSize
+	u.StorageUsed += r.Status.FileStats.TotalSize
+}
+
+// GetStorageScheduledEstimate returns the size of the replicas on the disk
+// weighted between the volume sizes and the actual sizes. The actual sizes
+// can be much smaller than the volume sizes for the thin volumes, or larger
+// for the volumes with long snapshot chains.
+func GetStorageScheduledEstimate(storageScheduled, storageUsed, actualUsageWeight int64) int64 {
+	return (storageScheduled*(100-actualUsageWeight) + storageUsed*actualUsageWeight) / 100
 }
 
 func (rcs *ReplicaScheduler) GetDiskSchedulingInfo(disk types.DiskSpec, diskStatus types.DiskStatus) (*DiskSchedulingInfo, error) {
 	// get StorageOverProvisioningPercentage and StorageMinimalAvailablePercentage settings
-	overProvisioningPercentage, err := rcs.ds.GetSettingAsInt(types.SettingNameStorageOverProvisioningPercentage)
+	overProvisioningPercentage, err := rcs.ds.GetStorageOverProvisioningPercentage()
+	if err != nil {
+		return nil, err
+	}
+	minimalAvailablePercentage, err := rcs.ds.GetStorageMinimalAvailablePercentage()
 	if err != nil {
 		return nil, err
 	}
-	minimalAvailablePercentage, err := rcs.ds.GetSettingAsInt(types.SettingNameStorageMinimalAvailablePercentage)
+	actualUsageWeight, err := rcs.ds.GetStorageActualUsageWeight()
 	if err != nil {
 		return nil, err
 	}
 	info := &DiskSchedulingInfo{
 		StorageAvailable:           diskStatus.StorageAvailable,
-		StorageScheduled:           diskStatus.StorageScheduled,
+		StorageScheduled:           GetStorageScheduledEstimate(diskStatus.StorageScheduled, diskStatus.StorageUsed, actualUsageWeight),
 		StorageReserved:            disk.StorageReserved,
 		StorageMaximum:             diskStatus.StorageMaximum,
 		OverProvisioningPercentage: overProvisioningPercentage,
 		MinimalAvailablePercentage: minimalAvailablePercentage,
+		ActualUsageWeight:          actualUsageWeight,
 	}
 	return info, nil
 }
@@ -2,6 +2,8 @@ package scheduler
 
 import (
 	"fmt"
+	"math/rand"
+	"sort"
 	"testing"
 
 	"k8s.io/api/core/v1"
@@ -29,6 +31,8 @@ const (
 	TestNode1     = "test-node-name-1"
 	TestNode2     = "test-node-name-2"
 	TestNode3     = "test-node-name-3"
+	TestNode4     = "test-node-name-4"
+	TestNode5     = "test-node-name-5"
 
 	TestOwnerID1    = TestNode1
 	TestEngineImage = "longhorn-engine:latest"
@@ -38,6 +42,8 @@ const (
 	TestVolumeStaleTimeout = 60
 
 	TestDefaultDataPath = "/var/lib/rancher/longhorn"
+	TestZone1           = "test-zone-1"
+	TestZone2           = "test-zone-2"
 
 	TestDaemon1 = "longhorn-manager-1"
 	TestDaemon2 = "longhorn-manager-2"
@@ -59,16 +65,22 @@ func newReplicaScheduler(lhInformerFactory lhinformerfactory.SharedInformerFacto
 	engineImageInformer := lhInformerFactory.Longhorn().V1alpha1().EngineImages()
 	nodeInformer := lhInformerFactory.Longhorn().V1alpha1().Nodes()
 	settingInformer := lhInformerFactory.Longhorn().V1alpha1().Settings()
+	snapshotInformer := lhInformerFactory.Longhorn().V1alpha1().Snapshots()
 
 	podInformer := kubeInformerFactory.Core().V1().Pods()
 	cronJobInformer := kubeInformerFactory.Batch().V1beta1().CronJobs()
 	daemonSetInformer := kubeInformerFactory.Apps().V1beta2().DaemonSets()
+	eventInformer := kubeInformerFactory.Core().V1().Events()
+	persistentVolumeInformer := kubeInformerFactory.Core().V1().PersistentVolumes()
+	persistentVolumeClaimInformer := kubeInformerFactory.Core().V1().PersistentVolumeClaims()
+	volumeAttachmentInformer := kubeInformerFactory.Storage().V1beta1().VolumeAttachments()
 
 	ds := datastore.NewDataStore(
 		volumeInformer, engineInformer, replicaInformer,
 		engineImageInformer, nodeInformer, settingInformer,
-		lhClient,
-		podInformer, cronJobInformer, daemonSetInformer,
+		snapshotInformer, lhClient,
+		podInformer, cronJobInformer, daemonSetInformer, eventInformer,
+		persistentVolumeInformer, persistentVolumeClaimInformer, volumeAttachmentInformer,
 		kubeClient, TestNamespace)
 
 	return NewReplicaScheduler(ds)
@@ -110,6 +122,25 @@ func newNode(name, namespace string, allowScheduling bool, status types.Conditio
 	}
 }
 
+func newKubernetesNode(name string, readyStatus v1.ConditionStatus, unschedulable bool) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1.NodeSpec{
+			Unschedulable: unschedulable,
+		},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{
+				{
+					Type:   v1.NodeReady,
+					Status: readyStatus,
+				},
+			},
+		},
+	}
+}
+
 func newCondition(conditionType string, status types.ConditionStatus) types.Condition {
 	return types.Condition{
 		Type:    conditionType,
@@ -165,6 +196,22 @@ func newReplicaForVolume(v *longhorn.Volume) *longhorn.Replica {
 	}
 }
 
+func newNodeInZone(name, zone string) *longhorn.Node {
+	node := newNode(name, TestNamespace, true, types.ConditionStatusTrue)
+	node.Spec.Disks = map[string]types.DiskSpec{
+		TestDiskID1: newDisk(TestDefaultDataPath, true, 0),
+	}
+	node.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			StorageAvailable: TestDiskAvailableSize,
+			StorageScheduled: 0,
+			StorageMaximum:   TestDiskSize,
+		},
+	}
+	node.Status.Zone = zone
+	return node
+}
+
 func initSettings(name, value string) *longhorn.Setting {
 	setting := &longhorn.Setting{
 		ObjectMeta: metav1.ObjectMeta{
@@ -188,15 +235,27 @@ func (s *TestSuite) SetUpTest(c *C) {
 }
 
 type ReplicaSchedulerTestCase struct {
-	volume                            *longhorn.Volume
-	replicas                          map[string]*longhorn.Replica
-	daemons                           []*v1.Pod
-	nodes                             map[string]*longhorn.Node
+	volume   *longhorn.Volume
+	replicas map[string]*longhorn.Replica
+	daemons  []*v1.Pod
+	nodes    map[string]*longhorn.Node
+	// the Kubernetes nodes are ready and schedulable if not specified
+	kubeNodes                         map[string]*v1.Node
 	storageOverProvisioningPercentage string
 	storageMinimalAvailablePercentage string
+	replicaZoneSoftAntiAffinity       string
+	storageActualUsageWeight          string
+
+	// the replicas have been scheduled before the test
+	existingReplicas map[string]*longhorn.Replica
 
 	// schedule state
-	expectedNodes map[string]*longhorn.Node
+	expectedNodes    map[string]*longhorn.Node
+	expectedDiskID   string
+	expectedZone     string
+	expectedDecision types.ReplicaSchedulingDecision
+	// the message of the scheduling failure
+	expectedFailureMessage string
 	// scheduler exception
 	err bool
 	// couldn't schedule replica
@@ -217,6 +276,59 @@ func generateSchedulerTestCase() *ReplicaSchedulerTestCase {
 	}
 }
 
+// generateZoneSchedulerTestCase returns the test case with an existing
+// replica on node1, and a replica to be scheduled. Both node1 and node2 are
+// in zone1.
+func generateZoneSchedulerTestCase() *ReplicaSchedulerTestCase {
+	v := newVolume(TestVolumeName, 2)
+	existingReplica := newReplicaForVolume(v)
+	existingReplica.Spec.NodeID = TestNode1
+	existingReplica.Spec.DiskID = TestDiskID1
+	replica := newReplicaForVolume(v)
+	return &ReplicaSchedulerTestCase{
+		volume: v,
+		replicas: map[string]*longhorn.Replica{
+			replica.Name: replica,
+		},
+		existingReplicas: map[string]*longhorn.Replica{
+			existingReplica.Name: existingReplica,
+		},
+		daemons: []*v1.Pod{
+			newDaemonPod(v1.PodRunning, TestDaemon1, TestNamespace, TestNode1, TestIP1),
+			newDaemonPod(v1.PodRunning, TestDaemon2, TestNamespace, TestNode2, TestIP2),
+			newDaemonPod(v1.PodRunning, TestDaemon3, TestNamespace, TestNode3, TestIP3),
+		},
+		nodes: map[string]*longhorn.Node{
+			TestNode1: newNodeInZone(TestNode1, TestZone1),
+			TestNode2: newNodeInZone(TestNode2, TestZone1),
+		},
+		expectedNodes: map[string]*longhorn.Node{},
+	}
+}
+
+// generateUsageSchedulerTestCase returns the test case with a replica to be
+// scheduled to the only disk on node1 with the disk status
+func generateUsageSchedulerTestCase(actualUsageWeight string, diskStatus types.DiskStatus) *ReplicaSchedulerTestCase {
+	v := newVolume(TestVolumeName, 1)
+	replica := newReplicaForVolume(v)
+	node := newNodeInZone(TestNode1, "")
+	node.Status.DiskStatus[TestDiskID1] = diskStatus
+	return &ReplicaSchedulerTestCase{
+		volume: v,
+		replicas: map[string]*longhorn.Replica{
+			replica.Name: replica,
+		},
+		daemons: []*v1.Pod{
+			newDaemonPod(v1.PodRunning, TestDaemon1, TestNamespace, TestNode1, TestIP1),
+		},
+		nodes: map[string]*longhorn.Node{
+			TestNode1: node,
+		},
+		storageActualUsageWeight: actualUsageWeight,
+		expectedNodes:            map[string]*longhorn.Node{},
+	}
+}
+
 func (s *TestSuite) TestReplicaScheduler(c *C) {
 	testCases := map[string]*ReplicaSchedulerTestCase{}
 	// Test only node1 could schedule replica
@@ -455,6 +567,303 @@ func (s *TestSuite) TestReplicaScheduler(c *C) {
 	tc.storageMinimalAvailablePercentage = "100"
 	testCases["there's no available disks for scheduling"] = tc
 
+	// Test only the disks and nodes with the selected tags could be scheduled
+	tc = generateSchedulerTestCase()
+	tc.volume.Spec.NodeSelector = []string{"storage"}
+	tc.volume.Spec.DiskSelector = []string{"ssd"}
+	daemon1 = newDaemonPod(v1.PodRunning, TestDaemon1, TestNamespace, TestNode1, TestIP1)
+	daemon2 = newDaemonPod(v1.PodRunning, TestDaemon2, TestNamespace, TestNode2, TestIP2)
+	daemon3 = newDaemonPod(v1.PodRunning, TestDaemon3, TestNamespace, TestNode3, TestIP3)
+	tc.daemons = []*v1.Pod{
+		daemon1,
+		daemon2,
+		daemon3,
+	}
+	diskStatus := map[string]types.DiskStatus{
+		TestDiskID1: {
+			StorageAvailable: TestDiskAvailableSize,
+			StorageScheduled: 0,
+			StorageMaximum:   TestDiskSize,
+		},
+	}
+	// node1 has both the node tag and the disk tag
+	node1 = newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue)
+	node1.Spec.Tags = []string{"fast", "storage"}
+	disk = newDisk(TestDefaultDataPath, true, 0)
+	disk.Tags = []string{"ssd"}
+	node1.Spec.Disks = map[string]types.DiskSpec{
+		TestDiskID1: disk,
+	}
+	node1.Status.DiskStatus = diskStatus
+	// node2 has the node tag only
+	node2 = newNode(TestNode2, TestNamespace, true, types.ConditionStatusTrue)
+	node2.Spec.Tags = []string{"storage"}
+	node2.Spec.Disks = map[string]types.DiskSpec{
+		TestDiskID1: newDisk(TestDefaultDataPath, true, 0),
+	}
+	node2.Status.DiskStatus = diskStatus
+	// node3 has the disk tag only
+	node3 = newNode(TestNode3, TestNamespace, true, types.ConditionStatusTrue)
+	node3.Spec.Disks = map[string]types.DiskSpec{
+		TestDiskID1: disk,
+	}
+	node3.Status.DiskStatus = diskStatus
+	nodes = map[string]*longhorn.Node{
+		TestNode1: node1,
+		TestNode2: node2,
+		TestNode3: node3,
+	}
+	tc.nodes = nodes
+	expectedNodes = map[string]*longhorn.Node{
+		TestNode1: node1,
+	}
+	tc.expectedNodes = expectedNodes
+	tc.err = false
+	tc.isNilReplica = false
+	testCases["schedule to nodes and disks with selected tags"] = tc
+
+	// Test no replica should be scheduled to the disk marked unschedulable,
+	// even if there is enough storage for the replica
+	tc = generateSchedulerTestCase()
+	daemon1 = newDaemonPod(v1.PodRunning, TestDaemon1, TestNamespace, TestNode1, TestIP1)
+	tc.daemons = []*v1.Pod{
+		daemon1,
+	}
+	node1 = newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue)
+	node1.Spec.Disks = map[string]types.DiskSpec{
+		TestDiskID1: newDisk(TestDefaultDataPath, true, 0),
+	}
+	node1.Status.DiskStatus = map[string]types.DiskStatus{
+		TestDiskID1: {
+			StorageAvailable: TestDiskAvailableSize,
+			StorageScheduled: 0,
+			StorageMaximum:   TestDiskSize,
+			Conditions: map[types.DiskConditionType]types.Condition{
+				types.DiskConditionTypeSchedulable: newCondition(types.DiskConditionTypeSchedulable, types.ConditionStatusFalse),
+			},
+		},
+	}
+	tc.nodes = map[string]*longhorn.Node{
+		TestNode1: node1,
+	}
+	tc.expectedNodes = map[string]*longhorn.Node{}
+	tc.err = false
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/1 nodes available: 1 disk unschedulable"
+	testCases["disk marked unschedulable"] = tc
+
+	// Test no replica should be scheduled to the disk being evicted
+	tc = generateUsageSchedulerTestCase("", newNodeInZone(TestNode1, "").Status.DiskStatus[TestDiskID1])
+	disk = tc.nodes[TestNode1].Spec.Disks[TestDiskID1]
+	disk.EvictionRequested = true
+	tc.nodes[TestNode1].Spec.Disks[TestDiskID1] = disk
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/1 nodes available: 1 disk unschedulable"
+	testCases["disk eviction requested"] = tc
+
+	// Test no replica should be scheduled to the node being evicted
+	tc = generateUsageSchedulerTestCase("", newNodeInZone(TestNode1, "").Status.DiskStatus[TestDiskID1])
+	tc.nodes[TestNode1].Spec.EvictionRequested = true
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/1 nodes available: 1 disk unschedulable"
+	testCases["node eviction requested"] = tc
+
+	// Test replica should be scheduled to the zone without other replicas
+	tc = generateZoneSchedulerTestCase()
+	tc.nodes[TestNode3] = newNodeInZone(TestNode3, TestZone2)
+	tc.expectedNodes = map[string]*longhorn.Node{
+		TestNode3: tc.nodes[TestNode3],
+	}
+	tc.expectedZone = TestZone2
+	tc.expectedDecision = types.ReplicaSchedulingDecisionNewZone
+	testCases["zone anti-affinity"] = tc
+
+	// Test replica should be scheduled to the same zone if there is no
+	// other zone and soft anti-affinity is enabled
+	tc = generateZoneSchedulerTestCase()
+	tc.replicaZoneSoftAntiAffinity = "true"
+	tc.expectedNodes = map[string]*longhorn.Node{
+		TestNode2: tc.nodes[TestNode2],
+	}
+	tc.expectedZone = TestZone1
+	tc.expectedDecision = types.ReplicaSchedulingDecisionSameZone
+	testCases["zone soft anti-affinity"] = tc
+
+	// Test replica shouldn't be scheduled to the same zone if soft
+	// anti-affinity is disabled
+	tc = generateZoneSchedulerTestCase()
+	tc.replicaZoneSoftAntiAffinity = "false"
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/2 nodes available: 2 anti-affinity conflict"
+	testCases["zone hard anti-affinity"] = tc
+
+	// Test replica is only scheduled to the selected zones, even if there
+	// is another zone without replicas
+	tc = generateZoneSchedulerTestCase()
+	tc.volume.Spec.ZoneSelector = []string{TestZone1}
+	tc.replicaZoneSoftAntiAffinity = "true"
+	tc.nodes[TestNode3] = newNodeInZone(TestNode3, TestZone2)
+	tc.expectedNodes = map[string]*longhorn.Node{
+		TestNode2: tc.nodes[TestNode2],
+	}
+	tc.expectedZone = TestZone1
+	tc.expectedDecision = types.ReplicaSchedulingDecisionSameZone
+	testCases["zone selector"] = tc
+
+	// Test the nodes in the other zones or the unknown zone are not
+	// selected
+	tc = generateZoneSchedulerTestCase()
+	tc.volume.Spec.ZoneSelector = []string{TestZone1}
+	tc.replicaZoneSoftAntiAffinity = "false"
+	tc.nodes[TestNode3] = newNodeInZone(TestNode3, TestZone2)
+	tc.nodes[TestNode4] = newNodeInZone(TestNode4, "")
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/4 nodes available: 2 anti-affinity conflict, 2 zone not selected"
+	testCases["zone selector with hard anti-affinity"] = tc
+
+	// Test the failure reasons of each node are aggregated
+	tc = generateZoneSchedulerTestCase()
+	tc.volume.Spec.DiskSelector = []string{"ssd"}
+	tc.nodes[TestNode3] = newNodeInZone(TestNode3, TestZone2)
+	tc.nodes[TestNode3].Spec.AllowScheduling = false
+	node4 := newNodeInZone(TestNode4, TestZone2)
+	node4.Spec.Disks[TestDiskID1] = newDisk(TestDefaultDataPath, true, TestDiskSize)
+	tc.nodes[TestNode4] = node4
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/4 nodes available: 2 missing disk tag ssd, 1 cordoned, 1 disk unschedulable"
+	testCases["aggregate scheduling failure reasons"] = tc
+
+	// Test the disk without any replica but physically nearly full by other
+	// data is refused once the actual usage is taken into account
+	nearlyFullDiskStatus := types.DiskStatus{
+		StorageAvailable: TestDiskSize/10 + TestVolumeSize/4,
+		StorageScheduled: 0,
+		StorageMaximum:   TestDiskSize,
+	}
+	tc = generateUsageSchedulerTestCase("50", nearlyFullDiskStatus)
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/1 nodes available: 1 insufficient space"
+	testCases["physically nearly full disk"] = tc
+
+	// Test the same disk is schedulable with pure reservation
+	tc = generateUsageSchedulerTestCase("0", nearlyFullDiskStatus)
+	tc.expectedNodes[TestNode1] = tc.nodes[TestNode1]
+	testCases["physically nearly full disk with pure reservation"] = tc
+
+	// Test the disk fully reserved by nearly empty thin volumes is
+	// schedulable once the actual usage is taken into account
+	thinDiskStatus := types.DiskStatus{
+		StorageAvailable: TestDiskAvailableSize,
+		StorageScheduled: TestDiskSize * 5,
+		StorageMaximum:   TestDiskSize,
+		StorageUsed:      TestVolumeSize,
+	}
+	tc = generateUsageSchedulerTestCase("100", thinDiskStatus)
+	tc.expectedNodes[TestNode1] = tc.nodes[TestNode1]
+	testCases["fully reserved disk with thin volumes"] = tc
+
+	// Test the same disk is refused with pure reservation
+	tc = generateUsageSchedulerTestCase("0", thinDiskStatus)
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/1 nodes available: 1 insufficient space"
+	testCases["fully reserved disk with thin volumes and pure reservation"] = tc
+
+	// Test the node with fewer replicas of other volumes is preferred
+	tc = generateUsageSchedulerTestCase("", types.DiskStatus{
+		StorageAvailable: TestDiskAvailableSize,
+		StorageScheduled: TestVolumeSize * 2,
+		StorageMaximum:   TestDiskSize,
+		ScheduledReplica: map[string]int64{
+			"other-volume-1-r-1": TestVolumeSize,
+			"other-volume-2-r-1": TestVolumeSize,
+		},
+	})
+	tc.nodes[TestNode2] = newNodeInZone(TestNode2, "")
+	tc.daemons = append(tc.daemons, newDaemonPod(v1.PodRunning, TestDaemon2, TestNamespace, TestNode2, TestIP2))
+	tc.expectedNodes[TestNode2] = tc.nodes[TestNode2]
+	testCases["prefer node with fewer replicas"] = tc
+
+	// Test the ties are broken by the node name
+	tc = generateUsageSchedulerTestCase("", newNodeInZone(TestNode1, "").Status.DiskStatus[TestDiskID1])
+	tc.nodes[TestNode2] = newNodeInZone(TestNode2, "")
+	tc.daemons = append(tc.daemons, newDaemonPod(v1.PodRunning, TestDaemon2, TestNamespace, TestNode2, TestIP2))
+	tc.expectedNodes[TestNode1] = tc.nodes[TestNode1]
+	testCases["deterministic tie-breaking"] = tc
+
+	// Test the least utilized disk on the node is chosen, considering both
+	// the scheduled and the actual usage
+	tc = generateUsageSchedulerTestCase("0", newNodeInZone(TestNode1, "").Status.DiskStatus[TestDiskID1])
+	node1 = tc.nodes[TestNode1]
+	for i := 1; i <= 4; i++ {
+		diskID := fmt.Sprintf("diskID%d", i)
+		node1.Spec.Disks[diskID] = newDisk(fmt.Sprintf("/mnt/disk%d", i), true, 0)
+		node1.Status.DiskStatus[diskID] = types.DiskStatus{
+			StorageAvailable: TestDiskAvailableSize,
+			StorageScheduled: 0,
+			StorageMaximum:   TestDiskSize,
+		}
+	}
+	// diskID1 has the most scheduled storage, diskID2 has the most actual
+	// usage, and diskID4 has slightly more scheduled storage than diskID3
+	diskStatus1 := node1.Status.DiskStatus["diskID1"]
+	diskStatus1.StorageScheduled = TestDiskSize * 2
+	node1.Status.DiskStatus["diskID1"] = diskStatus1
+	diskStatus2 := node1.Status.DiskStatus["diskID2"]
+	diskStatus2.StorageAvailable = TestDiskSize / 5
+	node1.Status.DiskStatus["diskID2"] = diskStatus2
+	diskStatus4 := node1.Status.DiskStatus["diskID4"]
+	diskStatus4.StorageScheduled = TestDiskSize / 10
+	node1.Status.DiskStatus["diskID4"] = diskStatus4
+	tc.expectedNodes[TestNode1] = node1
+	tc.expectedDiskID = "diskID3"
+	testCases["least utilized disk on the node"] = tc
+
+	// Test the node cordoned in Kubernetes is excluded
+	tc = generateUsageSchedulerTestCase("", newNodeInZone(TestNode1, "").Status.DiskStatus[TestDiskID1])
+	tc.nodes[TestNode2] = newNodeInZone(TestNode2, "")
+	tc.daemons = append(tc.daemons, newDaemonPod(v1.PodRunning, TestDaemon2, TestNamespace, TestNode2, TestIP2))
+	tc.kubeNodes = map[string]*v1.Node{
+		TestNode1: newKubernetesNode(TestNode1, v1.ConditionTrue, true),
+	}
+	tc.expectedNodes[TestNode2] = tc.nodes[TestNode2]
+	testCases["kubernetes node cordoned"] = tc
+
+	// Test the node not ready in Kubernetes is excluded, even if the Longhorn
+	// node hasn't been updated yet
+	tc = generateUsageSchedulerTestCase("", newNodeInZone(TestNode1, "").Status.DiskStatus[TestDiskID1])
+	tc.nodes[TestNode2] = newNodeInZone(TestNode2, "")
+	tc.daemons = append(tc.daemons, newDaemonPod(v1.PodRunning, TestDaemon2, TestNamespace, TestNode2, TestIP2))
+	tc.kubeNodes = map[string]*v1.Node{
+		TestNode1: newKubernetesNode(TestNode1, v1.ConditionTrue, true),
+		TestNode2: newKubernetesNode(TestNode2, v1.ConditionFalse, false),
+	}
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/2 nodes available: 1 kubernetes node cordoned, 1 node not ready"
+	testCases["kubernetes node cordoned or not ready"] = tc
+
+	// Test the tags are matched case sensitively
+	tc = generateUsageSchedulerTestCase("", newNodeInZone(TestNode1, "").Status.DiskStatus[TestDiskID1])
+	tc.nodes[TestNode1].Spec.Tags = []string{"Storage"}
+	tc.volume.Spec.NodeSelector = []string{"storage"}
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/1 nodes available: 1 missing node tag storage"
+	testCases["node tag case sensitive"] = tc
+
+	// Test no replica should be scheduled to the node missing the required
+	// packages
+	tc = generateUsageSchedulerTestCase("", newNodeInZone(TestNode1, "").Status.DiskStatus[TestDiskID1])
+	tc.nodes[TestNode1].Status.Conditions[types.NodeConditionTypeRequiredPackages] = newCondition(types.NodeConditionTypeRequiredPackages, types.ConditionStatusFalse)
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/1 nodes available: 1 missing required packages"
+	testCases["node missing required packages"] = tc
+
+	// Test no replica should be scheduled to the node in maintenance mode
+	tc = generateUsageSchedulerTestCase("", newNodeInZone(TestNode1, "").Status.DiskStatus[TestDiskID1])
+	tc.nodes[TestNode1].Spec.MaintenanceMode = true
+	tc.isNilReplica = true
+	tc.expectedFailureMessage = "0/1 nodes available: 1 maintenance"
+	testCases["node maintenance mode"] = tc
+
 	for name, tc := range testCases {
 		fmt.Printf("testing %v\n", name)
 
@@ -478,11 +887,18 @@ func (s *TestSuite) TestReplicaScheduler(c *C) {
 			pIndexer.Add(p)
 		}
 		// create node
-		for _, node := range tc.nodes {
+		for name, node := range tc.nodes {
 			n, err := lhClient.Longhorn().Nodes(TestNamespace).Create(node)
 			c.Assert(err, IsNil)
 			c.Assert(n, NotNil)
 			nIndexer.Add(n)
+
+			kubeNode, ok := tc.kubeNodes[name]
+			if !ok {
+				kubeNode = newKubernetesNode(name, v1.ConditionTrue, false)
+			}
+			_, err = kubeClient.CoreV1().Nodes().Create(kubeNode)
+			c.Assert(err, IsNil)
 		}
 		// create volume
 		volume, err := lhClient.LonghornV1alpha1().Volumes(TestNamespace).Create(tc.volume)
@@ -501,6 +917,28 @@ func (s *TestSuite) TestReplicaScheduler(c *C) {
 			c.Assert(err, IsNil)
 			sIndexer.Add(setting)
 		}
+		if tc.replicaZoneSoftAntiAffinity != "" {
+			s := initSettings(string(types.SettingNameReplicaZoneSoftAntiAffinity), tc.replicaZoneSoftAntiAffinity)
+			setting, err := lhClient.Longhorn().Settings(TestNamespace).Create(s)
+			c.Assert(err, IsNil)
+			sIndexer.Add(setting)
+		}
+		if tc.storageActualUsageWeight != "" {
+			s := initSettings(string(types.SettingNameStorageActualUsageWeight), tc.storageActualUsageWeight)
+			setting, err := lhClient.Longhorn().Settings(TestNamespace).Create(s)
+			c.Assert(err, IsNil)
+			sIndexer.Add(setting)
+		}
+		allReplicas := map[string]*longhorn.Replica{}
+		for name, replica := range tc.existingReplicas {
+			r, err := lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(replica)
+			c.Assert(err, IsNil)
+			rIndexer.Add(r)
+			allReplicas[name] = r
+		}
+		for name, replica := range tc.replicas {
+			allReplicas[name] = replica
+		}
 		// validate scheduler
 		for _, replica := range tc.replicas {
 			r, err := lhClient.LonghornV1alpha1().Replicas(TestNamespace).Create(replica)
@@ -508,12 +946,16 @@ func (s *TestSuite) TestReplicaScheduler(c *C) {
 			c.Assert(r, NotNil)
 			rIndexer.Add(r)
 
-			sr, err := s.ScheduleReplica(r, tc.replicas)
+			sr, failure, err := s.ScheduleReplica(r, allReplicas, volume)
 			if tc.err {
 				c.Assert(err, NotNil)
 			} else {
 				if tc.isNilReplica {
 					c.Assert(sr, IsNil)
+					c.Assert(failure, NotNil)
+					if tc.expectedFailureMessage != "" {
+						c.Assert(failure.Message(), Equals, tc.expectedFailureMessage)
+					}
 				} else {
 					c.Assert(err, IsNil)
 					c.Assert(sr, NotNil)
@@ -521,6 +963,14 @@ func (s *TestSuite) TestReplicaScheduler(c *C) {
 					c.Assert(sr.Spec.DataPath, Not(Equals), "")
 					c.Assert(sr.Spec.DiskID, Not(Equals), "")
 					tc.replicas[sr.Name] = sr
+					allReplicas[sr.Name] = sr
+					if tc.expectedDiskID != "" {
+						c.Assert(sr.Spec.DiskID, Equals, tc.expectedDiskID)
+					}
+					if tc.expectedDecision != "" {
+						c.Assert(sr.Status.Zone, Equals, tc.expectedZone)
+						c.Assert(sr.Status.SchedulingDecision, Equals, tc.expectedDecision)
+					}
 					// check expected node
 					for nname, node := range tc.expectedNodes {
 						if sr.Spec.NodeID == nname {
@@ -534,3 +984,357 @@ func (s *TestSuite) TestReplicaScheduler(c *C) {
 		c.Assert(len(tc.expectedNodes), Equals, 0)
 	}
 }
+
+func (s *TestSuite) TestIsSchedulableToDisk(c *C) {
+	rcs := &ReplicaScheduler{}
+	info := &DiskSchedulingInfo{
+		StorageAvailable:           TestDiskAvailableSize,
+		StorageMaximum:             TestDiskSize,
+		StorageReserved:            0,
+		StorageScheduled:           0,
+		OverProvisioningPercentage: 150,
+		MinimalAvailablePercentage: 10,
+	}
+	c.Assert(GetStorageSchedulable(info), Equals, int64(TestDiskSize*3/2))
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize, info), Equals, true)
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize*3/2, info), Equals, true)
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize*3/2+1, info), Equals, false)
+
+	// the storage has been scheduled should be deducted
+	info.StorageScheduled = TestDiskSize
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize/2, info), Equals, true)
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize/2+1, info), Equals, false)
+
+	// the reserved storage cannot be over provisioned
+	info.StorageScheduled = 0
+	info.StorageReserved = TestDiskSize / 2
+	c.Assert(GetStorageSchedulable(info), Equals, int64(TestDiskSize*3/4))
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize, info), Equals, false)
+
+	// over provisioning percentage less than 100 means under provisioning
+	info.StorageReserved = 0
+	info.OverProvisioningPercentage = 50
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize/2, info), Equals, true)
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize/2+1, info), Equals, false)
+
+	// the actual usage of the existing replicas is weighted in
+	c.Assert(GetStorageScheduledEstimate(TestDiskSize, 0, 0), Equals, int64(TestDiskSize))
+	c.Assert(GetStorageScheduledEstimate(TestDiskSize, 0, 50), Equals, int64(TestDiskSize/2))
+	// the snapshot chains can make the actual size larger than volume size
+	c.Assert(GetStorageScheduledEstimate(TestDiskSize, TestDiskSize*3, 50), Equals, int64(TestDiskSize*2))
+
+	// the new replica must fit in the available space in proportion
+	info.OverProvisioningPercentage = 500
+	info.StorageAvailable = TestDiskSize/10 + TestDiskSize/4
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize, info), Equals, true)
+	info.ActualUsageWeight = 25
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize, info), Equals, false)
+	c.Assert(rcs.IsSchedulableToDisk(TestDiskSize-4, info), Equals, true)
+}
+
+func (s *TestSuite) TestDiskStorageUsage(c *C) {
+	v := newVolume(TestVolumeName, 2)
+	replica1 := newReplicaForVolume(v)
+	replica1.Status.FileStats.TotalSize = TestVolumeSize / 2
+	replica2 := newReplicaForVolume(v)
+
+	usage := NewDiskStorageUsage(types.DiskStatus{
+		StorageScheduled: TestVolumeSize,
+		StorageUsed:      TestVolumeSize / 2,
+		ScheduledReplica: map[string]int64{
+			replica1.Name: TestVolumeSize,
+		},
+		ReplicaStorageUsed: map[string]int64{
+			replica1.Name: TestVolumeSize / 2,
+		},
+	})
+
+	// the replica is accounted only once
+	usage.AddReplica(replica1)
+	usage.AddReplica(replica2)
+	usage.AddReplica(replica2)
+	c.Assert(usage.StorageScheduled, Equals, int64(TestVolumeSize*2))
+	c.Assert(usage.StorageUsed, Equals, int64(TestVolumeSize/2))
+	c.Assert(usage.ScheduledReplica, HasLen, 2)
+}
+
+// TestDiskStorageInvariant schedules and deletes the replicas in random
+// order, with the node controller syncing the disk status now and then. The
+// storage scheduled to the disk must never exceed the maximum minus the
+// reserved without over provisioning, and the recorded storage must match
+// the replicas on the disk after each sync.
+func (s *TestSuite) TestDiskStorageInvariant(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+
+	rcs := newReplicaScheduler(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient)
+
+	settings := map[types.SettingName]string{
+		types.SettingNameStorageOverProvisioningPercentage: "100",
+		types.SettingNameStorageMinimalAvailablePercentage: "0",
+		types.SettingNameStorageActualUsageWeight:          "0",
+	}
+	for name, value := range settings {
+		setting := initSettings(string(name), value)
+		setting.Namespace = TestNamespace
+		c.Assert(sIndexer.Add(setting), IsNil)
+	}
+
+	storageReserved := int64(TestDiskSize / 5)
+	node := newNodeInZone(TestNode1, "")
+	node.Spec.Disks[TestDiskID1] = newDisk(TestDefaultDataPath, true, storageReserved)
+	node.Status.DiskStatus[TestDiskID1] = types.DiskStatus{
+		StorageAvailable: TestDiskSize,
+		StorageMaximum:   TestDiskSize,
+	}
+	c.Assert(nIndexer.Add(node), IsNil)
+	_, err := kubeClient.CoreV1().Nodes().Create(newKubernetesNode(TestNode1, v1.ConditionTrue, false))
+	c.Assert(err, IsNil)
+
+	syncDiskStatus := func(replicas map[string]*longhorn.Replica) types.DiskStatus {
+		usage := NewDiskStorageUsage(types.DiskStatus{})
+		for _, r := range replicas {
+			usage.AddReplica(r)
+		}
+		status := node.Status.DiskStatus[TestDiskID1]
+		status.ScheduledReplica = usage.ScheduledReplica
+		status.ReplicaStorageUsed = usage.ReplicaStorageUsed
+		status.StorageScheduled = usage.StorageScheduled
+		status.StorageUsed = usage.StorageUsed
+		node.Status.DiskStatus[TestDiskID1] = status
+		c.Assert(nIndexer.Update(node), IsNil)
+		return status
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	volume := newVolume(TestVolumeName, 1)
+	replicas := map[string]*longhorn.Replica{}
+	for i := 0; i < 500; i++ {
+		if len(replicas) != 0 && rng.Intn(3) == 0 {
+			names := []string{}
+			for name := range replicas {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			delete(replicas, names[rng.Intn(len(names))])
+		} else {
+			r := newReplicaForVolume(volume)
+			r.Spec.VolumeSize = rng.Int63n(TestDiskSize/4) + 1
+			sr, _, err := rcs.ScheduleReplica(r, replicas, volume)
+			c.Assert(err, IsNil)
+			if sr != nil {
+				replicas[sr.Name] = sr
+			}
+		}
+
+		var storageScheduled int64
+		for _, r := range replicas {
+			storageScheduled += r.Spec.VolumeSize
+		}
+		c.Assert(storageScheduled <= TestDiskSize-storageReserved, Equals, true,
+			Commentf("step %v: scheduled %v exceeds the usable storage", i, storageScheduled))
+		if rng.Intn(2) == 0 {
+			status := syncDiskStatus(replicas)
+			c.Assert(status.StorageScheduled, Equals, storageScheduled)
+			c.Assert(status.ScheduledReplica, HasLen, len(replicas))
+		}
+	}
+}
+
+func (s *TestSuite) TestScoreDisks(c *C) {
+	node1 := newNodeInZone(TestNode1, "")
+	node1.Status.DiskStatus[TestDiskID1] = types.DiskStatus{
+		ScheduledReplica: map[string]int64{
+			"other-volume-1-r-1": TestVolumeSize,
+			"other-volume-2-r-1": TestVolumeSize,
+		},
+	}
+	node2 := newNodeInZone(TestNode2, "")
+	nodes := map[string]*longhorn.Node{
+		TestNode1: node1,
+		TestNode2: node2,
+	}
+	newDiskCandidate := func(nodeID string, scheduled int64) *Disk {
+		return &Disk{
+			DiskSpec:           newDisk(TestDefaultDataPath, true, 0),
+			NodeID:             nodeID,
+			StorageScheduled:   scheduled,
+			StorageSchedulable: TestDiskSize,
+		}
+	}
+
+	// the disk with lower utilization is preferred on the same node
+	diskCandidates := map[string]map[string]*Disk{
+		TestNode2: {
+			TestDiskID1: newDiskCandidate(TestNode2, TestDiskSize/2),
+			TestDiskID2: newDiskCandidate(TestNode2, TestDiskSize/5),
+		},
+	}
+	fsid, disk := pickDisk(nodes, diskCandidates, nil, DefaultScoringWeights)
+	c.Assert(fsid, Equals, TestDiskID2)
+	c.Assert(disk.NodeID, Equals, TestNode2)
+
+	// the disk with lower actual usage is preferred if scheduled equally
+	diskCandidates[TestNode2][TestDiskID1].StorageScheduled = TestDiskSize / 5
+	diskCandidates[TestNode2][TestDiskID1].StorageMaximum = TestDiskSize
+	diskCandidates[TestNode2][TestDiskID1].StorageAvailable = TestDiskSize / 2
+	diskCandidates[TestNode2][TestDiskID2].StorageMaximum = TestDiskSize
+	diskCandidates[TestNode2][TestDiskID2].StorageAvailable = TestDiskSize / 10
+	fsid, _ = pickDisk(nodes, diskCandidates, nil, DefaultScoringWeights)
+	c.Assert(fsid, Equals, TestDiskID1)
+
+	// the node with fewer replicas outweighs the disk utilization
+	diskCandidates = map[string]map[string]*Disk{
+		TestNode1: {
+			TestDiskID1: newDiskCandidate(TestNode1, 0),
+		},
+		TestNode2: {
+			TestDiskID1: newDiskCandidate(TestNode2, TestDiskSize/2),
+		},
+	}
+	fsid, disk = pickDisk(nodes, diskCandidates, nil, DefaultScoringWeights)
+	c.Assert(fsid, Equals, TestDiskID1)
+	c.Assert(disk.NodeID, Equals, TestNode2)
+
+	// the replicas not accounted by the node controller yet are counted
+	v := newVolume(TestVolumeName, 3)
+	replicas := map[string]*longhorn.Replica{}
+	for i := 0; i < 3; i++ {
+		r := newReplicaForVolume(v)
+		r.Spec.NodeID = TestNode2
+		replicas[r.Name] = r
+	}
+	_, disk = pickDisk(nodes, diskCandidates, replicas, DefaultScoringWeights)
+	c.Assert(disk.NodeID, Equals, TestNode1)
+
+	// only the disk utilization matters without the weight of the node
+	_, disk = pickDisk(nodes, diskCandidates, nil, ScoringWeights{DiskUtilization: 1})
+	c.Assert(disk.NodeID, Equals, TestNode1)
+
+	// the ties are broken by the node name then the disk ID
+	diskCandidates = map[string]map[string]*Disk{
+		TestNode1: {
+			TestDiskID2: newDiskCandidate(TestNode1, 0),
+			TestDiskID1: newDiskCandidate(TestNode1, 0),
+		},
+		TestNode2: {
+			TestDiskID1: newDiskCandidate(TestNode2, 0),
+		},
+	}
+	for i := 0; i < 10; i++ {
+		fsid, disk = pickDisk(nodes, diskCandidates, nil, ScoringWeights{})
+		c.Assert(fsid, Equals, TestDiskID1)
+		c.Assert(disk.NodeID, Equals, TestNode1)
+	}
+
+	fsid, disk = pickDisk(nodes, map[string]map[string]*Disk{}, nil, DefaultScoringWeights)
+	c.Assert(fsid, Equals, "")
+	c.Assert(disk, IsNil)
+}
+
+func (s *TestSuite) TestPreferEngineImageReadyNodes(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	eiIndexer := lhInformerFactory.Longhorn().V1alpha1().EngineImages().Informer().GetIndexer()
+
+	rcs := newReplicaScheduler(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient)
+
+	diskCandidates := map[string]map[string]*Disk{
+		TestNode1: {TestDiskID1: &Disk{NodeID: TestNode1}},
+		TestNode2: {TestDiskID1: &Disk{NodeID: TestNode2}},
+	}
+
+	// the candidates are kept as they are without the engine image
+	candidates, err := rcs.preferEngineImageReadyNodes(diskCandidates, TestEngineImage)
+	c.Assert(err, IsNil)
+	c.Assert(candidates, HasLen, 2)
+
+	ei := &longhorn.EngineImage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: types.GetEngineImageChecksumName(TestEngineImage),
+		},
+		Spec: types.EngineImageSpec{
+			Image: TestEngineImage,
+		},
+		Status: types.EngineImageStatus{
+			NodeDeploymentMap: map[string]bool{
+				TestNode1: false,
+				TestNode2: false,
+			},
+		},
+	}
+	ei, err = lhClient.Longhorn().EngineImages(TestNamespace).Create(ei)
+	c.Assert(err, IsNil)
+	eiIndexer.Add(ei)
+
+	// all the nodes are still pulling the image
+	candidates, err = rcs.preferEngineImageReadyNodes(diskCandidates, TestEngineImage)
+	c.Assert(err, IsNil)
+	c.Assert(candidates, HasLen, 2)
+
+	ei.Status.NodeDeploymentMap[TestNode2] = true
+	eiIndexer.Update(ei)
+	candidates, err = rcs.preferEngineImageReadyNodes(diskCandidates, TestEngineImage)
+	c.Assert(err, IsNil)
+	c.Assert(candidates, HasLen, 1)
+	c.Assert(candidates[TestNode2], NotNil)
+}
+
+func (s *TestSuite) TestCheckEngineNode(c *C) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, controller.NoResyncPeriodFunc())
+
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, controller.NoResyncPeriodFunc())
+	nIndexer := lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer()
+	sIndexer := lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer()
+
+	rcs := newReplicaScheduler(lhInformerFactory, kubeInformerFactory, lhClient, kubeClient)
+
+	// node1 is schedulable, node2 is disabled in Longhorn, node3 is cordoned
+	// in Kubernetes, node4 is in maintenance mode, node5 doesn't support the
+	// mount propagation
+	node4 := newNode(TestNode4, TestNamespace, true, types.ConditionStatusTrue)
+	node4.Spec.MaintenanceMode = true
+	node5 := newNode(TestNode5, TestNamespace, true, types.ConditionStatusTrue)
+	node5.Status.Conditions[types.NodeConditionTypeMountPropagation] = newCondition(types.NodeConditionTypeMountPropagation, types.ConditionStatusFalse)
+	nodes := []*longhorn.Node{
+		newNode(TestNode1, TestNamespace, true, types.ConditionStatusTrue),
+		newNode(TestNode2, TestNamespace, false, types.ConditionStatusTrue),
+		newNode(TestNode3, TestNamespace, true, types.ConditionStatusTrue),
+		node4,
+		node5,
+	}
+	for _, node := range nodes {
+		n, err := lhClient.Longhorn().Nodes(TestNamespace).Create(node)
+		c.Assert(err, IsNil)
+		nIndexer.Add(n)
+		_, err = kubeClient.CoreV1().Nodes().Create(newKubernetesNode(node.Name, v1.ConditionTrue, node.Name == TestNode3))
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(rcs.CheckEngineNode(TestNode1, false), IsNil)
+	c.Assert(rcs.CheckEngineNode(TestNode1, true), IsNil)
+	c.Assert(rcs.CheckEngineNode(TestNode2, false), NotNil)
+	c.Assert(rcs.CheckEngineNode(TestNode2, true), IsNil)
+	c.Assert(rcs.CheckEngineNode(TestNode3, false), NotNil)
+	c.Assert(rcs.CheckEngineNode(TestNode3, true), IsNil)
+	c.Assert(rcs.CheckEngineNode(TestNode4, false), NotNil)
+	c.Assert(rcs.CheckEngineNode(TestNode4, true), NotNil)
+	c.Assert(rcs.CheckEngineNode(TestNode5, false), NotNil)
+	c.Assert(rcs.CheckEngineNode(TestNode5, true), NotNil)
+
+	setting, err := lhClient.Longhorn().Settings(TestNamespace).Create(initSettings(string(types.SettingNameKubernetesNodeCordonPolicy), types.KubernetesNodeCordonPolicyBlockAll))
+	c.Assert(err, IsNil)
+	sIndexer.Add(setting)
+	c.Assert(rcs.CheckEngineNode(TestNode2, true), IsNil)
+	c.Assert(rcs.CheckEngineNode(TestNode3, true), NotNil)
+}
@@ -0,0 +1,118 @@
+package scheduler
+
+import (
+	"sort"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+// ScoringWeights decides how much each factor contributes to the score of a
+// disk candidate. Each factor is scored from 0 to 100 before weighted.
+type ScoringWeights struct {
+	// prefer the nodes with fewer replicas, so the rebuilding caused by
+	// a node down won't be concentrated on a few nodes
+	NodeReplicaCount int64
+	// prefer the disks with lower utilization of the schedulable storage
+	DiskUtilization int64
+	// prefer the disks with lower actual usage reported by the file system
+	DiskActualUtilization int64
+}
+
+var DefaultScoringWeights = ScoringWeights{
+	NodeReplicaCount:      2,
+	DiskUtilization:       1,
+	DiskActualUtilization: 1,
+}
+
+type scoredDisk struct {
+	*Disk
+	DiskID string
+	Score  int64
+}
+
+// pickDisk returns the disk candidate with the highest score. The ties are
+// broken by the node name then the disk ID, so the result is deterministic.
+func pickDisk(nodes map[string]*longhorn.Node, diskCandidates map[string]map[string]*Disk, replicas map[string]*longhorn.Replica, weights ScoringWeights) (string, *Disk) {
+	scoredDisks := scoreDisks(nodes, diskCandidates, replicas, weights)
+	if len(scoredDisks) == 0 {
+		return "", nil
+	}
+	return scoredDisks[0].DiskID, scoredDisks[0].Disk
+}
+
+// scoreDisks returns the disk candidates sorted by the score in descending
+// order
+func scoreDisks(nodes map[string]*longhorn.Node, diskCandidates map[string]map[string]*Disk, replicas map[string]*longhorn.Replica, weights ScoringWeights) []*scoredDisk {
+	nodeReplicaCounts := map[string]int64{}
+	maxNodeReplicaCount := int64(0)
+	for nodeName := range diskCandidates {
+		count := getNodeReplicaCount(nodes[nodeName], replicas)
+		nodeReplicaCounts[nodeName] = count
+		if count > maxNodeReplicaCount {
+			maxNodeReplicaCount = count
+		}
+	}
+
+	scoredDisks := []*scoredDisk{}
+	for nodeName, disks := range diskCandidates {
+		nodeScore := int64(100)
+		if maxNodeReplicaCount > 0 {
+			nodeScore = 100 - nodeReplicaCounts[nodeName]*100/maxNodeReplicaCount
+		}
+		for diskID, disk := range disks {
+			diskScore := getFreeScore(disk.StorageScheduled, disk.StorageSchedulable)
+			diskActualScore := getFreeScore(disk.StorageMaximum-disk.StorageAvailable, disk.StorageMaximum)
+			scoredDisks = append(scoredDisks, &scoredDisk{
+				Disk:   disk,
+				DiskID: diskID,
+				Score: weights.NodeReplicaCount*nodeScore +
+					weights.DiskUtilization*diskScore +
+					weights.DiskActualUtilization*diskActualScore,
+			})
+		}
+	}
+	sort.Slice(scoredDisks, func(i, j int) bool {
+		if scoredDisks[i].Score != scoredDisks[j].Score {
+			return scoredDisks[i].Score > scoredDisks[j].Score
+		}
+		if scoredDisks[i].NodeID != scoredDisks[j].NodeID {
+			return scoredDisks[i].NodeID < scoredDisks[j].NodeID
+		}
+		return scoredDisks[i].DiskID < scoredDisks[j].DiskID
+	})
+	return scoredDisks
+}
+
+// getFreeScore returns the percentage of the storage not used, from 0 to 100
+func getFreeScore(used, total int64) int64 {
+	if total <= 0 {
+		return 100
+	}
+	score := 100 - used*100/total
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// getNodeReplicaCount returns the number of the replicas on the node of all
+// volumes, including the replicas of the volume just scheduled but not
+// accounted by the node controller yet
+func getNodeReplicaCount(node *longhorn.Node, replicas map[string]*longhorn.Replica) int64 {
+	if node == nil {
+		return 0
+	}
+	accounted := map[string]struct{}{}
+	for _, diskStatus := range node.Status.DiskStatus {
+		for rName := range diskStatus.ScheduledReplica {
+			accounted[rName] = struct{}{}
+		}
+	}
+	count := int64(len(accounted))
+	for rName, r := range replicas {
+		if _, ok := accounted[rName]; !ok && r.Spec.NodeID == node.Name {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	SchedulingFailureReasonNodeNotReady           = "node not ready"
+	SchedulingFailureReasonNodeUnschedulable      = "cordoned"
+	SchedulingFailureReasonKubernetesNodeCordoned = "kubernetes node cordoned"
+	SchedulingFailureReasonNodeMaintenance        = "maintenance"
+	SchedulingFailureReasonMissingPackages        = "missing required packages"
+	SchedulingFailureReasonZoneNotSelected        = "zone not selected"
+	SchedulingFailureReasonAntiAffinity           = "anti-affinity conflict"
+	SchedulingFailureReasonNoDisk                 = "no disk"
+	SchedulingFailureReasonDiskUnschedulable      = "disk unschedulable"
+	SchedulingFailureReasonInsufficientSpace      = "insufficient space"
+	SchedulingFailureReasonSettingError           = "settings unavailable"
+
+	schedulingFailureReasonMissingNodeTag = "missing node tag %v"
+	schedulingFailureReasonMissingDiskTag = "missing disk tag %v"
+)
+
+// SchedulingFailure records why each node cannot take the replica
+type SchedulingFailure struct {
+	NodeReasons map[string]string
+}
+
+func NewSchedulingFailure() *SchedulingFailure {
+	return &SchedulingFailure{
+		NodeReasons: map[string]string{},
+	}
+}
+
+func (f *SchedulingFailure) Add(nodeName, reason string) {
+	f.NodeReasons[nodeName] = reason
+}
+
+// Reasons returns the sorted reasons without duplications
+func (f *SchedulingFailure) Reasons() []string {
+	reasonSet := map[string]struct{}{}
+	for _, reason := range f.NodeReasons {
+		reasonSet[reason] = struct{}{}
+	}
+	reasons := []string{}
+	for reason := range reasonSet {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// Message aggregates the reasons, e.g. "0/6 nodes available: 3 insufficient
+// space, 2 missing disk tag ssd, 1 cordoned"
+func (f *SchedulingFailure) Message() string {
+	counts := map[string]int{}
+	for _, reason := range f.NodeReasons {
+		counts[reason]++
+	}
+	reasons := f.Reasons()
+	sort.SliceStable(reasons, func(i, j int) bool {
+		return counts[reasons[i]] > counts[reasons[j]]
+	})
+	msgs := []string{}
+	for _, reason := range reasons {
+		msgs = append(msgs, fmt.Sprintf("%d %v", counts[reason], reason))
+	}
+	msg := fmt.Sprintf("0/%d nodes available", len(f.NodeReasons))
+	if len(msgs) == 0 {
+		return msg
+	}
+	return msg + ": " + strings.Join(msgs, ", ")
+}
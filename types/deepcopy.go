@@ -2,12 +2,33 @@ package types
 
 func (v *VolumeSpec) DeepCopyInto(to *VolumeSpec) {
 	*to = *v
-	if v.RecurringJobs == nil {
-		return
+	if v.RecurringJobs != nil {
+		to.RecurringJobs = make([]RecurringJob, len(v.RecurringJobs))
+		for i := 0; i < len(v.RecurringJobs); i++ {
+			to.RecurringJobs[i] = v.RecurringJobs[i]
+			if v.RecurringJobs[i].Labels != nil {
+				to.RecurringJobs[i].Labels = make(map[string]string)
+				for key, value := range v.RecurringJobs[i].Labels {
+					to.RecurringJobs[i].Labels[key] = value
+				}
+			}
+		}
+	}
+	if v.DiskSelector != nil {
+		to.DiskSelector = make([]string, len(v.DiskSelector))
+		copy(to.DiskSelector, v.DiskSelector)
+	}
+	if v.NodeSelector != nil {
+		to.NodeSelector = make([]string, len(v.NodeSelector))
+		copy(to.NodeSelector, v.NodeSelector)
+	}
+	if v.ZoneSelector != nil {
+		to.ZoneSelector = make([]string, len(v.ZoneSelector))
+		copy(to.ZoneSelector, v.ZoneSelector)
 	}
-	to.RecurringJobs = make([]RecurringJob, len(v.RecurringJobs))
-	for i := 0; i < len(v.RecurringJobs); i++ {
-		to.RecurringJobs[i] = v.RecurringJobs[i]
+	if v.ReadOnlyNodeIDs != nil {
+		to.ReadOnlyNodeIDs = make([]string, len(v.ReadOnlyNodeIDs))
+		copy(to.ReadOnlyNodeIDs, v.ReadOnlyNodeIDs)
 	}
 }
 
@@ -19,6 +40,16 @@ func (v *VolumeStatus) DeepCopyInto(to *VolumeStatus) {
 			to.Conditions[key] = value
 		}
 	}
+	if v.RecurringJobStatus != nil {
+		to.RecurringJobStatus = make(map[string]RecurringJobStatus)
+		for key, value := range v.RecurringJobStatus {
+			to.RecurringJobStatus[key] = value
+		}
+	}
+	if v.SkippedRecurringJobRuns != nil {
+		to.SkippedRecurringJobRuns = make([]SkippedRecurringJobRun, len(v.SkippedRecurringJobRuns))
+		copy(to.SkippedRecurringJobRuns, v.SkippedRecurringJobRuns)
+	}
 }
 
 func (e *EngineSpec) DeepCopyInto(to *EngineSpec) {
@@ -39,34 +70,53 @@ func (e *EngineSpec) DeepCopyInto(to *EngineSpec) {
 
 func (e *EngineStatus) DeepCopyInto(to *EngineStatus) {
 	*to = *e
-	if e.ReplicaModeMap == nil {
-		return
+	if e.ReplicaModeMap != nil {
+		to.ReplicaModeMap = make(map[string]ReplicaMode)
+		for key, value := range e.ReplicaModeMap {
+			to.ReplicaModeMap[key] = value
+		}
 	}
-	to.ReplicaModeMap = make(map[string]ReplicaMode)
-	for key, value := range e.ReplicaModeMap {
-		to.ReplicaModeMap[key] = value
+	if e.RebuildStatus != nil {
+		to.RebuildStatus = make(map[string]RebuildStatus)
+		for key, value := range e.RebuildStatus {
+			to.RebuildStatus[key] = value
+		}
 	}
 }
 
 func (n *NodeSpec) DeepCopyInto(to *NodeSpec) {
 	*to = *n
-	if n.Disks == nil {
-		return
+	if n.Disks != nil {
+		to.Disks = make(map[string]DiskSpec)
+		for key, value := range n.Disks {
+			var disk DiskSpec
+			value.DeepCopyInto(&disk)
+			to.Disks[key] = disk
+		}
 	}
-	to.Disks = make(map[string]DiskSpec)
-	for key, value := range n.Disks {
-		to.Disks[key] = value
+	if n.Tags != nil {
+		to.Tags = make([]string, len(n.Tags))
+		copy(to.Tags, n.Tags)
 	}
 }
 
-func (n *NodeStatus) DeepCopyInto(to *NodeStatus) {
+func (n *DiskSpec) DeepCopyInto(to *DiskSpec) {
 	*to = *n
-	if n.DiskStatus == nil {
-		return
+	if n.Tags != nil {
+		to.Tags = make([]string, len(n.Tags))
+		copy(to.Tags, n.Tags)
 	}
-	to.DiskStatus = make(map[string]DiskStatus)
-	for key, value := range n.DiskStatus {
-		to.DiskStatus[key] = value
+}
+
+func (n *NodeStatus) DeepCopyInto(to *NodeStatus) {
+	*to = *n
+	if n.DiskStatus != nil {
+		to.DiskStatus = make(map[string]DiskStatus)
+		for key, value := range n.DiskStatus {
+			var status DiskStatus
+			value.DeepCopyInto(&status)
+			to.DiskStatus[key] = status
+		}
 	}
 	if n.Conditions != nil {
 		to.Conditions = make(map[NodeConditionType]Condition)
@@ -78,11 +128,96 @@ func (n *NodeStatus) DeepCopyInto(to *NodeStatus) {
 
 func (n *DiskStatus) DeepCopyInto(to *DiskStatus) {
 	*to = *n
-	if n.Conditions == nil {
-		return
+	if n.Conditions != nil {
+		to.Conditions = make(map[DiskConditionType]Condition)
+		for key, value := range n.Conditions {
+			to.Conditions[key] = value
+		}
 	}
-	to.Conditions = make(map[DiskConditionType]Condition)
-	for key, value := range n.Conditions {
-		to.Conditions[key] = value
+	if n.ScheduledReplica != nil {
+		to.ScheduledReplica = make(map[string]int64)
+		for key, value := range n.ScheduledReplica {
+			to.ScheduledReplica[key] = value
+		}
+	}
+	if n.ReplicaStorageUsed != nil {
+		to.ReplicaStorageUsed = make(map[string]int64)
+		for key, value := range n.ReplicaStorageUsed {
+			to.ReplicaStorageUsed[key] = value
+		}
+	}
+	if n.OrphanedReplicaDirectories != nil {
+		to.OrphanedReplicaDirectories = make(map[string]OrphanedReplicaDirectory)
+		for key, value := range n.OrphanedReplicaDirectories {
+			to.OrphanedReplicaDirectories[key] = value
+		}
+	}
+}
+
+func (s *EngineImageStatus) DeepCopyInto(to *EngineImageStatus) {
+	*to = *s
+	if s.Conditions != nil {
+		to.Conditions = make(map[EngineImageConditionType]Condition)
+		for key, value := range s.Conditions {
+			to.Conditions[key] = value
+		}
+	}
+	if s.NodeDeploymentMap != nil {
+		to.NodeDeploymentMap = make(map[string]bool)
+		for key, value := range s.NodeDeploymentMap {
+			to.NodeDeploymentMap[key] = value
+		}
+	}
+	if s.NodePullStatus != nil {
+		to.NodePullStatus = make(map[string]EngineImageNodePullStatus)
+		for key, value := range s.NodePullStatus {
+			to.NodePullStatus[key] = value
+		}
+	}
+}
+
+func (s *SettingStatus) DeepCopyInto(to *SettingStatus) {
+	*to = *s
+	if s.Conditions != nil {
+		to.Conditions = make(map[SettingConditionType]Condition)
+		for key, value := range s.Conditions {
+			to.Conditions[key] = value
+		}
+	}
+	if s.History != nil {
+		to.History = make([]SettingChange, len(s.History))
+		copy(to.History, s.History)
+	}
+}
+
+func (s *SnapshotSpec) DeepCopyInto(to *SnapshotSpec) {
+	*to = *s
+	if s.Labels != nil {
+		to.Labels = make(map[string]string)
+		for key, value := range s.Labels {
+			to.Labels[key] = value
+		}
+	}
+}
+
+func (s *SnapshotStatus) DeepCopyInto(to *SnapshotStatus) {
+	*to = *s
+	if s.Children != nil {
+		to.Children = make(map[string]bool)
+		for key, value := range s.Children {
+			to.Children[key] = value
+		}
+	}
+	if s.Labels != nil {
+		to.Labels = make(map[string]string)
+		for key, value := range s.Labels {
+			to.Labels[key] = value
+		}
+	}
+	if s.Conditions != nil {
+		to.Conditions = make(map[SnapshotConditionType]Condition)
+		for key, value := range s.Conditions {
+			to.Conditions[key] = value
+		}
 	}
 }
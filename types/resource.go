@@ -9,6 +9,9 @@ const (
 	VolumeStateAttaching = VolumeState("attaching")
 	VolumeStateDetaching = VolumeState("detaching")
 	VolumeStateDeleting  = VolumeState("deleting")
+	// VolumeStateTrashed is the volume deleted and detached, kept for the
+	// volume deletion grace period
+	VolumeStateTrashed = VolumeState("trashed")
 )
 
 type VolumeRobustness string
@@ -27,6 +30,16 @@ const (
 	VolumeFrontendISCSI    = VolumeFrontend("iscsi")
 )
 
+type VolumeAccessMode string
+
+const (
+	VolumeAccessModeReadWriteOnce = VolumeAccessMode("rwo")
+	// VolumeAccessModeReadOnlyMany allows the volume to be attached
+	// read-only to multiple nodes at the same time, with the engine
+	// exporting it through the iSCSI frontend
+	VolumeAccessModeReadOnlyMany = VolumeAccessMode("rox")
+)
+
 type ConditionStatus string
 
 const (
@@ -47,11 +60,13 @@ type Condition struct {
 type VolumeConditionType string
 
 const (
-	VolumeConditionTypeScheduled = "scheduled"
+	VolumeConditionTypeScheduled    = "scheduled"
+	VolumeConditionTypeQoSSupported = "qosSupported"
 )
 
 const (
 	VolumeConditionReasonReplicaSchedulingFailure = "ReplicaSchedulingFailure"
+	VolumeConditionReasonEngineImageUnsupported   = "EngineImageUnsupported"
 )
 
 type VolumeSpec struct {
@@ -67,6 +82,38 @@ type VolumeSpec struct {
 	EngineImage         string         `json:"engineImage"`
 	RecurringJobs       []RecurringJob `json:"recurringJobs"`
 	BaseImage           string         `json:"baseImage"`
+	DiskSelector        []string       `json:"diskSelector"`
+	NodeSelector        []string       `json:"nodeSelector"`
+	// ZoneSelector restricts the replicas to the nodes in the zones, e.g.
+	// the ones the workload can be scheduled to. Empty means any zone.
+	ZoneSelector []string `json:"zoneSelector"`
+	// DisableFrontend attaches the volume without the frontend, e.g. for
+	// the maintenance like reverting a snapshot
+	DisableFrontend bool `json:"disableFrontend"`
+	// BackupTargetCredentialSecret overrides the global backup target
+	// credential secret for the volume. For the volume restored from a
+	// backup, it's the secret the backup is read with.
+	BackupTargetCredentialSecret string `json:"backupTargetCredentialSecret"`
+	// TrashedAt is when the volume was deleted and moved to the trash. It's
+	// cleaned up once the volume deletion grace period expires.
+	TrashedAt string `json:"trashedAt"`
+	// AccessMode is set at creation. The empty one is rwo.
+	AccessMode VolumeAccessMode `json:"accessMode"`
+	// ReadOnlyNodeIDs are the nodes the rox volume is attached read-only
+	// to, with the engine on NodeID. It's empty if the volume is attached
+	// read-write.
+	ReadOnlyNodeIDs []string `json:"readOnlyNodeIDs"`
+	// QoS limits the I/O of the volume, applied by the engine
+	QoS VolumeQoS `json:"qos"`
+}
+
+// VolumeQoS is the I/O limits of the volume. The bandwidth is in MB/s, and
+// zero means unlimited.
+type VolumeQoS struct {
+	ReadIOPS       int `json:"readIOPS"`
+	WriteIOPS      int `json:"writeIOPS"`
+	ReadBandwidth  int `json:"readBandwidth"`
+	WriteBandwidth int `json:"writeBandwidth"`
 }
 
 type VolumeStatus struct {
@@ -75,6 +122,34 @@ type VolumeStatus struct {
 	CurrentImage string           `json:"currentImage"`
 
 	Conditions map[VolumeConditionType]Condition `json:"conditions"`
+
+	// EvictingReplica is the replica being moved off the disk requested
+	// eviction, and ReplacementReplica is the one rebuilding to replace it
+	EvictingReplica    string `json:"evictingReplica"`
+	ReplacementReplica string `json:"replacementReplica"`
+
+	KubernetesStatus KubernetesStatus `json:"kubernetesStatus"`
+
+	// RemountRequestedAt is when the volume was detached unexpectedly, so
+	// the pods using it since before have to mount it again
+	RemountRequestedAt string `json:"remountRequestedAt"`
+
+	// CurrentQoS is the I/O limits applied by the engine
+	CurrentQoS VolumeQoS `json:"currentQoS"`
+
+	// RecurringJobStatus is the schedules of the recurring jobs by name
+	RecurringJobStatus map[string]RecurringJobStatus `json:"recurringJobStatus"`
+	// SkippedRecurringJobRuns are the latest scheduled runs skipped, the
+	// oldest first
+	SkippedRecurringJobRuns []SkippedRecurringJobRun `json:"skippedRecurringJobRuns"`
+}
+
+// KubernetesStatus records the PV and the PVC created for the volume by the
+// Longhorn API
+type KubernetesStatus struct {
+	PVName    string `json:"pvName"`
+	Namespace string `json:"namespace"`
+	PVCName   string `json:"pvcName"`
 }
 
 type RecurringJobType string
@@ -89,6 +164,87 @@ type RecurringJob struct {
 	Type   RecurringJobType `json:"task"`
 	Cron   string           `json:"cron"`
 	Retain int              `json:"retain"`
+	// BackupTargetCredentialSecret overrides the secret of the volume for
+	// the backup job
+	BackupTargetCredentialSecret string `json:"backupTargetCredentialSecret"`
+	// Jitter delays the start of the job by up to the seconds, to spread
+	// the jobs of many volumes on the same schedule
+	Jitter int `json:"jitter"`
+	// Labels are set on the snapshots and the backups by the job, besides
+	// the label of the job name
+	Labels map[string]string `json:"labels"`
+	// Timezone is the IANA name of the time zone the cron is evaluated in,
+	// e.g. "Europe/Berlin". The empty one is UTC.
+	Timezone string `json:"timezone"`
+}
+
+// RecurringJobStatus is the schedule of the recurring job followed by the
+// volume controller
+type RecurringJobStatus struct {
+	// LastScheduledTime is the latest time the job was due, or when the
+	// controller started following the schedule
+	LastScheduledTime string `json:"lastScheduledTime"`
+	// PendingCatchUpTime is the latest run skipped since the volume wasn't
+	// attached, which is caught up if the volume is attached again within
+	// the recurring job catch up window
+	PendingCatchUpTime string `json:"pendingCatchUpTime"`
+}
+
+const (
+	RecurringJobSkipReasonVolumeDetached = "VolumeDetached"
+	RecurringJobSkipReasonVolumeFaulted  = "VolumeFaulted"
+	RecurringJobSkipReasonJobRunning     = "JobRunning"
+
+	// MaxSkippedRecurringJobRuns is the number of the latest skipped runs
+	// kept in the volume status
+	MaxSkippedRecurringJobRuns = 10
+)
+
+// SkippedRecurringJobRun is a scheduled run of the recurring job which
+// couldn't execute
+type SkippedRecurringJobRun struct {
+	Job           string `json:"job"`
+	ScheduledTime string `json:"scheduledTime"`
+	Reason        string `json:"reason"`
+	Message       string `json:"message"`
+}
+
+type BackupTicketState string
+
+const (
+	BackupTicketStatePending    = BackupTicketState("pending")
+	BackupTicketStateInProgress = BackupTicketState("inProgress")
+	BackupTicketStateCompleted  = BackupTicketState("completed")
+	BackupTicketStateError      = BackupTicketState("error")
+)
+
+// BackupTicket is a backup waiting for or holding one of the slots of the
+// concurrent backups. It's kept with the result for a while after the
+// backup is finished, as the status of the backup.
+type BackupTicket struct {
+	ID       string `json:"id"`
+	Volume   string `json:"volume"`
+	Node     string `json:"node"`
+	Snapshot string `json:"snapshot"`
+	// Priority tickets are admitted before the others, e.g. the backups
+	// requested by the user
+	Priority  bool              `json:"priority"`
+	State     BackupTicketState `json:"state"`
+	Requested string            `json:"requested"`
+	// Heartbeat is renewed by the backup waiting or in progress, so the
+	// ticket of the one gone is marked as error after the timeout
+	Heartbeat string `json:"heartbeat"`
+	// Progress is in percentage. The engine doesn't report the progress
+	// of the backup, so it's 100 once completed and 0 before.
+	Progress int    `json:"progress"`
+	Error    string `json:"error"`
+	// URL is the backup created
+	URL      string `json:"url"`
+	Finished string `json:"finished"`
+}
+
+func (t *BackupTicket) IsFinished() bool {
+	return t.State == BackupTicketStateCompleted || t.State == BackupTicketStateError
 }
 
 type InstanceState string
@@ -116,19 +272,44 @@ type InstanceStatus struct {
 	IP           string        `json:"ip"`
 	Started      bool          `json:"started"`
 	NodeBootID   string        `json:"nodeBootID"`
+	// InstanceManagerName is the instance manager pod running the instance
+	// as a process, or empty if the instance runs in a pod of its own
+	InstanceManagerName string `json:"instanceManagerName"`
+	// Port is the port of the process, the instance in a pod of its own
+	// listens on the default port
+	Port int `json:"port"`
 }
 
 type EngineSpec struct {
 	InstanceSpec
 	Frontend                  VolumeFrontend    `json:"frontend"`
+	DisableFrontend           bool              `json:"disableFrontend"`
 	ReplicaAddressMap         map[string]string `json:"replicaAddressMap"`
 	UpgradedReplicaAddressMap map[string]string `json:"upgradedReplicaAddressMap"`
+	QoS                       VolumeQoS         `json:"qos"`
+	// FrontendReadOnly exports the frontend read-only, so the writes are
+	// rejected by the engine whichever node they come from
+	FrontendReadOnly bool `json:"frontendReadOnly"`
 }
 
 type EngineStatus struct {
 	InstanceStatus
-	ReplicaModeMap map[string]ReplicaMode `json:"replicaModeMap"`
-	Endpoint       string                 `json:"endpoint"`
+	ReplicaModeMap map[string]ReplicaMode   `json:"replicaModeMap"`
+	Endpoint       string                   `json:"endpoint"`
+	RebuildStatus  map[string]RebuildStatus `json:"rebuildStatus"`
+	// CurrentQoS is the I/O limits applied to the running engine, reset
+	// once it's restarted or upgraded
+	CurrentQoS VolumeQoS `json:"currentQoS"`
+}
+
+// RebuildStatus records which healthy replica was asked to act as the
+// source when a replica was added to the engine
+type RebuildStatus struct {
+	SourceReplica string `json:"sourceReplica"`
+	SourceNodeID  string `json:"sourceNodeID"`
+	SourceZone    string `json:"sourceZone"`
+	SameZone      bool   `json:"sameZone"`
+	StartedAt     string `json:"startedAt"`
 }
 
 type ReplicaSpec struct {
@@ -139,15 +320,67 @@ type ReplicaSpec struct {
 	HealthyAt   string `json:"healthyAt"`
 	FailedAt    string `json:"failedAt"`
 	DiskID      string `json:"diskID"`
+	DiskUUID    string `json:"diskUUID"`
 	DataPath    string `json:"dataPath"`
 	BaseImage   string `json:"baseImage"`
 	Active      bool   `json:"active"`
+	// RestoreCredentialSecret is the credential secret resolved when the
+	// replica was created to restore, so the restore keeps reading the
+	// backup with it after the settings change
+	RestoreCredentialSecret string `json:"restoreCredentialSecret"`
 }
 
 type ReplicaStatus struct {
 	InstanceStatus
+	// the record of the last failure. Unlike Spec.FailedAt, it won't be
+	// cleared by salvage and will be kept until the replica is deleted
+	FailedAt      string               `json:"failedAt"`
+	FailureReason ReplicaFailureReason `json:"failureReason"`
+	FailedNodeID  string               `json:"failedNodeID"`
+	FailedDiskID  string               `json:"failedDiskID"`
+
+	FileStats ReplicaFileStats `json:"fileStats"`
+
+	// Zone is the zone of the node the replica scheduled to
+	Zone               string                    `json:"zone"`
+	SchedulingDecision ReplicaSchedulingDecision `json:"schedulingDecision"`
 }
 
+type ReplicaSchedulingDecision string
+
+const (
+	// the replica is on a node in a zone without other replicas of the volume
+	ReplicaSchedulingDecisionNewZone = ReplicaSchedulingDecision("new-zone")
+	// the replica is on a node without other replicas of the volume, and
+	// the zone of the node is unknown
+	ReplicaSchedulingDecisionNewNode = ReplicaSchedulingDecision("new-node")
+	// spreading replicas across zones is impossible, the replica is on a
+	// node without other replicas but in the same zone with them
+	ReplicaSchedulingDecisionSameZone = ReplicaSchedulingDecision("same-zone")
+	// the replica is on a node with other replicas of the volume
+	ReplicaSchedulingDecisionSameNode = ReplicaSchedulingDecision("same-node")
+)
+
+type ReplicaFileStats struct {
+	SnapshotCount       int    `json:"snapshotCount"`
+	TotalSize           int64  `json:"totalSize"`
+	HeadSize            int64  `json:"headSize"`
+	LargestSnapshot     string `json:"largestSnapshot"`
+	LargestSnapshotSize int64  `json:"largestSnapshotSize"`
+}
+
+type ReplicaFailureReason string
+
+const (
+	ReplicaFailureReasonNodeDown          = ReplicaFailureReason("node-down")
+	ReplicaFailureReasonNodeRemoved       = ReplicaFailureReason("node-removed")
+	ReplicaFailureReasonDiskUnschedulable = ReplicaFailureReason("disk-unschedulable")
+	ReplicaFailureReasonEngineMarkedERR   = ReplicaFailureReason("engine-marked-ERR")
+	ReplicaFailureReasonRebuildFailed     = ReplicaFailureReason("rebuild-failed")
+	ReplicaFailureReasonCrashLoop         = ReplicaFailureReason("crash-loop")
+	ReplicaFailureReasonDiskUnhealthy     = ReplicaFailureReason("disk-unhealthy")
+)
+
 type EngineImageState string
 
 const (
@@ -162,11 +395,55 @@ type EngineImageSpec struct {
 	Image   string `json:"image"`
 }
 
+type EngineImageConditionType string
+
+const (
+	// EngineImageConditionTypeReady is true once the binaries are deployed
+	// on all the ready nodes
+	EngineImageConditionTypeReady = "Ready"
+	// EngineImageConditionTypeIncompatible is true if the API version of
+	// the image is out of the range supported by the manager
+	EngineImageConditionTypeIncompatible = "Incompatible"
+)
+
+const (
+	EngineImageConditionReasonDaemonSetNotReady  = "DaemonSetNotReady"
+	EngineImageConditionReasonBinaryNotDeployed  = "BinaryNotDeployed"
+	EngineImageConditionReasonImagePulling       = "ImagePulling"
+	EngineImageConditionReasonImagePullFailed    = "ImagePullFailed"
+	EngineImageConditionReasonAPIVersionMismatch = "APIVersionMismatch"
+)
+
+type EngineImagePullState string
+
+const (
+	// EngineImagePullStateWaiting means the pod of the daemon set hasn't
+	// been created on the node yet
+	EngineImagePullStateWaiting = EngineImagePullState("waiting")
+	EngineImagePullStatePulling = EngineImagePullState("pulling")
+	EngineImagePullStateReady   = EngineImagePullState("ready")
+	// EngineImagePullStateError means the kubelet failed to pull the image,
+	// the message records the error reported by the kubelet
+	EngineImagePullStateError = EngineImagePullState("error")
+)
+
+type EngineImageNodePullStatus struct {
+	State   EngineImagePullState `json:"state"`
+	Message string               `json:"message"`
+}
+
 type EngineImageStatus struct {
 	State      EngineImageState `json:"state"`
 	RefCount   int              `json:"refCount"`
 	NoRefSince string           `json:"noRefSince"`
 
+	Conditions map[EngineImageConditionType]Condition `json:"conditions"`
+	// NodeDeploymentMap records by the node whether the binaries have been
+	// deployed on it
+	NodeDeploymentMap map[string]bool `json:"nodeDeploymentMap"`
+	// NodePullStatus records by the node the progress of pulling the image
+	NodePullStatus map[string]EngineImageNodePullStatus `json:"nodePullStatus"`
+
 	EngineVersionDetails
 }
 
@@ -185,12 +462,25 @@ type EngineVersionDetails struct {
 	ControllerAPIMinVersion int `json:"controllerAPIMinVersion"`
 	DataFormatVersion       int `json:"dataFormatVersion"`
 	DataFormatMinVersion    int `json:"dataFormatMinVersion"`
+
+	// InstanceManagerAPIVersion is the version of the process management
+	// API of the instance manager shipped in the engine image, or 0 if the
+	// engine image doesn't ship one
+	InstanceManagerAPIVersion    int `json:"instanceManagerAPIVersion"`
+	InstanceManagerAPIMinVersion int `json:"instanceManagerAPIMinVersion"`
 }
 
 type NodeSpec struct {
 	Name            string              `json:"name"`
 	Disks           map[string]DiskSpec `json:"disks"`
 	AllowScheduling bool                `json:"allowScheduling"`
+	Tags            []string            `json:"tags"`
+	// EvictionRequested stops scheduling new replicas to all the disks of
+	// the node and moves the existing replicas off the node
+	EvictionRequested bool `json:"evictionRequested"`
+	// MaintenanceMode stops scheduling new replicas and engines to the node
+	// and detaches the volumes attached to the node
+	MaintenanceMode bool `json:"maintenanceMode"`
 }
 
 type NodeConditionType string
@@ -198,15 +488,26 @@ type NodeConditionType string
 const (
 	NodeConditionTypeReady            = "Ready"
 	NodeConditionTypeMountPropagation = "MountPropagation"
+	NodeConditionTypeEvicted          = "Evicted"
+	NodeConditionTypeMaintenance      = "Maintenance"
+	NodeConditionTypeRequiredPackages = "RequiredPackages"
 )
 
 const (
-	NodeConditionReasonManagerPodDown            = "ManagerPodDown"
-	NodeConditionReasonManagerPodMissing         = "ManagerPodMissing"
-	NodeConditionReasonKubernetesNodeDown        = "KubernetesNodeDown"
-	NodeConditionReasonKubernetesNodeNotReady    = "KubernetesNodeNotReady"
-	NodeConditionReasonKubernetesNodePressure    = "KubernetesNodePressure"
-	NodeConditionReasonNoMountPropagationSupport = "NoMountPropagationSupport"
+	NodeConditionReasonManagerPodDown              = "ManagerPodDown"
+	NodeConditionReasonManagerPodMissing           = "ManagerPodMissing"
+	NodeConditionReasonKubernetesNodeDown          = "KubernetesNodeDown"
+	NodeConditionReasonKubernetesNodeNotReady      = "KubernetesNodeNotReady"
+	NodeConditionReasonKubernetesNodePressure      = "KubernetesNodePressure"
+	NodeConditionReasonNoMountPropagationSupport   = "NoMountPropagationSupport"
+	NodeConditionReasonMountPropagationProbeFailed = "MountPropagationProbeFailed"
+	NodeConditionReasonEvictionInProgress          = "EvictionInProgress"
+	NodeConditionReasonEvictionBlocked             = "EvictionBlocked"
+	NodeConditionReasonDetachingVolumes            = "DetachingVolumes"
+	NodeConditionReasonMaintenanceBlocked          = "MaintenanceBlocked"
+	NodeConditionReasonBinariesMissing             = "BinariesMissing"
+	NodeConditionReasonKernelModulesMissing        = "KernelModulesMissing"
+	NodeConditionReasonISCSIDUnreachable           = "ISCSIDUnreachable"
 )
 
 type DiskConditionType string
@@ -220,17 +521,38 @@ const (
 	DiskConditionReasonDiskPressure          = "DiskPressure"
 	DiskConditionReasonDiskFilesystemChanged = "DiskFilesystemChanged"
 	DiskConditionReasonNoDiskInfo            = "NoDiskInfo"
+	DiskConditionReasonDiskUUIDMismatch      = "DiskUUIDMismatch"
+	DiskConditionReasonDiskReadOnly          = "DiskReadOnly"
+	DiskConditionReasonDiskNotReady          = "DiskNotReady"
+	DiskConditionReasonInvalidDiskPath       = "InvalidDiskPath"
+	DiskConditionReasonInvalidFilesystem     = "InvalidFilesystem"
+	DiskConditionReasonDiskNested            = "DiskNested"
+	DiskConditionReasonDuplicatedFilesystem  = "DuplicatedFilesystem"
+	DiskConditionReasonRemovalRejected       = "RemovalRejected"
+	DiskConditionReasonEvictionRequested     = "EvictionRequested"
+	DiskConditionReasonEvictionBlocked       = "EvictionBlocked"
+	DiskConditionReasonDiskHealthProbeFailed = "DiskHealthProbeFailed"
 )
 
 type NodeStatus struct {
 	Conditions map[NodeConditionType]Condition `json:"conditions"`
 	DiskStatus map[string]DiskStatus           `json:"diskStatus"`
+	Zone       string                          `json:"zone"`
+	// EvictionRemainingReplicas is the number of the replicas not moved off
+	// the node yet since the eviction was requested
+	EvictionRemainingReplicas int `json:"evictionRemainingReplicas"`
+	// Tags are the valid tags in the spec, sorted
+	Tags []string `json:"tags"`
 }
 
 type DiskSpec struct {
-	Path            string `json:"path"`
-	AllowScheduling bool   `json:"allowScheduling"`
-	StorageReserved int64  `json:"storageReserved"`
+	Path            string   `json:"path"`
+	AllowScheduling bool     `json:"allowScheduling"`
+	StorageReserved int64    `json:"storageReserved"`
+	Tags            []string `json:"tags"`
+	// EvictionRequested stops scheduling new replicas to the disk and moves
+	// the existing replicas off the disk
+	EvictionRequested bool `json:"evictionRequested"`
 }
 
 type DiskStatus struct {
@@ -239,4 +561,59 @@ type DiskStatus struct {
 	StorageScheduled int64                           `json:"storageScheduled"`
 	StorageMaximum   int64                           `json:"storageMaximum"`
 	ScheduledReplica map[string]int64                `json:"scheduledReplica"`
+	DiskUUID         string                          `json:"diskUUID"`
+	// StorageUsed is the sum of the file sizes of the replicas on the disk
+	StorageUsed        int64            `json:"storageUsed"`
+	ReplicaStorageUsed map[string]int64 `json:"replicaStorageUsed"`
+	// OrphanedReplicaDirectories are the directories under `replicas/`
+	// of the disk which no replica scheduled to the disk refers to
+	OrphanedReplicaDirectories map[string]OrphanedReplicaDirectory `json:"orphanedReplicaDirectories"`
+	// EvictionRemainingReplicas is the number of the replicas not moved off
+	// the disk yet since the eviction was requested
+	EvictionRemainingReplicas int `json:"evictionRemainingReplicas"`
+}
+
+type OrphanedReplicaDirectory struct {
+	Name             string `json:"name"`
+	Size             int64  `json:"size"`
+	ModificationTime string `json:"modificationTime"`
+}
+
+type SnapshotSpec struct {
+	Volume string `json:"volume"`
+	// CreateSnapshot asks the engine to take the snapshot if it doesn't
+	// exist yet. It's false for the snapshots found in the engine.
+	CreateSnapshot bool              `json:"createSnapshot"`
+	Labels         map[string]string `json:"labels"`
+}
+
+type SnapshotConditionType string
+
+const (
+	// SnapshotConditionTypeSynced is true once the requested creation or
+	// deletion has been applied to the engine
+	SnapshotConditionTypeSynced = "Synced"
+)
+
+const (
+	SnapshotConditionReasonVolumeDetached    = "VolumeDetached"
+	SnapshotConditionReasonEngineUnavailable = "EngineUnavailable"
+	SnapshotConditionReasonCreationFailed    = "CreationFailed"
+	SnapshotConditionReasonDeletionFailed    = "DeletionFailed"
+)
+
+// SnapshotStatus is the state of the snapshot in the engine, which is
+// refreshed by the engine monitor
+type SnapshotStatus struct {
+	Parent       string            `json:"parent"`
+	Children     map[string]bool   `json:"children"`
+	MarkRemoved  bool              `json:"markRemoved"`
+	UserCreated  bool              `json:"userCreated"`
+	CreationTime string            `json:"creationTime"`
+	Size         int64             `json:"size"`
+	Labels       map[string]string `json:"labels"`
+	// ReadyToUse is true once the snapshot has been found in the engine
+	ReadyToUse bool `json:"readyToUse"`
+
+	Conditions map[SnapshotConditionType]Condition `json:"conditions"`
 }
@@ -1,15 +1,75 @@
 package types
 
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/rancher/longhorn-manager/util"
+)
+
 type Setting struct {
 	Value string `json:"value"`
 }
 
+type SettingConditionType string
+
+const (
+	SettingConditionTypeBackupTargetAvailable = "BackupTargetAvailable"
+)
+
+// SettingStatus records the recent changes of the setting. The conditions
+// are only used by the backup target setting for now, to record the
+// availability of the backup target checked by the backupstore poll
+type SettingStatus struct {
+	Conditions map[SettingConditionType]Condition `json:"conditions"`
+	// BackupTarget is the one the conditions are for, since the setting
+	// may have been changed after the last check
+	BackupTarget string `json:"backupTarget"`
+	// LastAvailable is when the backup target was last reachable
+	LastAvailable string `json:"lastAvailable"`
+	// History is the last SettingHistoryLimit changes made through the
+	// API, the oldest first
+	History []SettingChange `json:"history,omitempty"`
+}
+
+// SettingHistoryLimit is the number of the changes kept in the setting
+// status. The older ones can still be found in the events of the setting
+const SettingHistoryLimit = 10
+
+// SettingChange is a change of the setting value. The values of the
+// settings carrying the credentials are redacted.
+type SettingChange struct {
+	Time     string `json:"time"`
+	OldValue string `json:"oldValue"`
+	NewValue string `json:"newValue"`
+	// Requester is who made the change, if known
+	Requester string `json:"requester,omitempty"`
+}
+
+// AppendSettingChange adds the change to the history, dropping the oldest
+// ones over the limit
+func AppendSettingChange(history []SettingChange, change SettingChange) []SettingChange {
+	history = append(history, change)
+	if len(history) > SettingHistoryLimit {
+		history = append([]SettingChange{}, history[len(history)-SettingHistoryLimit:]...)
+	}
+	return history
+}
+
 type SettingType string
 
 const (
-	SettingTypeString = SettingType("string")
-	SettingTypeInt    = SettingType("int")
-	SettingTypeBool   = SettingType("bool")
+	SettingTypeString   = SettingType("string")
+	SettingTypeInt      = SettingType("int")
+	SettingTypeBool     = SettingType("bool")
+	SettingTypeDuration = SettingType("duration")
+	// SettingTypeEnum is a string setting with the value in the options
+	SettingTypeEnum = SettingType("enum")
 )
 
 type SettingName string
@@ -20,6 +80,79 @@ const (
 	SettingNameDefaultEngineImage                = SettingName("default-engine-image")
 	SettingNameStorageOverProvisioningPercentage = SettingName("storage-over-provisioning-percentage")
 	SettingNameStorageMinimalAvailablePercentage = SettingName("storage-minimal-available-percentage")
+	SettingNameOrphanAutoDeletion                = SettingName("orphan-auto-deletion")
+	SettingNameReplicaZoneSoftAntiAffinity       = SettingName("replica-zone-soft-anti-affinity")
+	SettingNameStorageActualUsageWeight          = SettingName("storage-actual-usage-weight")
+	SettingNameKubernetesNodeCordonPolicy        = SettingName("kubernetes-node-cordon-policy")
+	SettingNameConcurrentDiskEvictionLimit       = SettingName("concurrent-disk-eviction-limit")
+	SettingNameRemovedNodeDeletionGracePeriod    = SettingName("removed-node-deletion-grace-period")
+	SettingNameCreateDefaultDiskLabeledNodes     = SettingName("create-default-disk-labeled-nodes")
+	SettingNameDiskHealthProbe                   = SettingName("disk-health-probe")
+	SettingNameDiskHealthProbeInterval           = SettingName("disk-health-probe-interval")
+	SettingNameDiskHealthProbeReplicaRebuild     = SettingName("disk-health-probe-replica-rebuild")
+	SettingNameBackupstorePollInterval           = SettingName("backupstore-poll-interval")
+	SettingNameAutoUpgradeEngineToDefaultImage   = SettingName("auto-upgrade-engine-to-default-image")
+	SettingNameAutoUpgradeEngineConcurrency      = SettingName("auto-upgrade-engine-concurrency")
+	SettingNameConcurrentBackupstoreAccessLimit  = SettingName("concurrent-backupstore-access-limit")
+	SettingNameConcurrentEngineUpgradeJobLimit   = SettingName("concurrent-engine-upgrade-job-limit")
+	SettingNameConcurrentBackupLimitPerNode      = SettingName("concurrent-backup-limit-per-node")
+	SettingNameConcurrentBackupLimit             = SettingName("concurrent-backup-limit")
+	SettingNameTaintToleration                   = SettingName("taint-toleration")
+	SettingNameLogLevel                          = SettingName("log-level")
+	SettingNameDefaultReplicaCount               = SettingName("default-replica-count")
+	SettingNameManageDefaultStorageClass         = SettingName("manage-default-storage-class")
+	SettingNameUpgradeChecker                    = SettingName("upgrade-checker")
+	SettingNameUpgradeCheckerInterval            = SettingName("upgrade-checker-interval")
+	SettingNameUpgradeCheckerURL                 = SettingName("upgrade-checker-url")
+	SettingNameLatestLonghornVersion             = SettingName("latest-longhorn-version")
+	SettingNameSettingMigrationLevel             = SettingName("setting-migration-level")
+	SettingNameResourceMigrationLevel            = SettingName("resource-migration-level")
+	SettingNameAutoCleanupUnusedEngineImages     = SettingName("auto-cleanup-unused-engine-images")
+	SettingNameUnusedEngineImageGracePeriod      = SettingName("unused-engine-image-grace-period")
+	SettingNameDebugEndpoints                    = SettingName("debug-endpoints")
+	SettingNameWorkloadPodDeletionPolicy         = SettingName("workload-pod-deletion-policy")
+	SettingNameVolumeDeletionGracePeriod         = SettingName("volume-deletion-grace-period")
+	SettingNameAdmissionWebhookFailurePolicy     = SettingName("admission-webhook-failure-policy")
+	SettingNameRecurringJobCatchUpWindow         = SettingName("recurring-job-catch-up-window")
+	SettingNameCSIAttacherImage                  = SettingName("csi-attacher-image")
+	SettingNameCSIProvisionerImage               = SettingName("csi-provisioner-image")
+	SettingNameCSIDriverRegistrarImage           = SettingName("csi-driver-registrar-image")
+	SettingNameCSISnapshotterImage               = SettingName("csi-snapshotter-image")
+	SettingNameCSINodeSelector                   = SettingName("csi-node-selector")
+	SettingNameCSIPriorityClass                  = SettingName("csi-priority-class")
+	SettingNameCSIAttacherResources              = SettingName("csi-attacher-resources")
+	SettingNameCSIProvisionerResources           = SettingName("csi-provisioner-resources")
+	SettingNameCSIDriverRegistrarResources       = SettingName("csi-driver-registrar-resources")
+	SettingNameCSISnapshotterResources           = SettingName("csi-snapshotter-resources")
+	SettingNameCSIPluginResources                = SettingName("csi-plugin-resources")
+)
+
+const (
+	// KubernetesNodeCordonPolicyAllowExisting blocks the new replicas and
+	// the automatic attachment on the cordoned node, but the volume can
+	// still be attached to the node on request
+	KubernetesNodeCordonPolicyAllowExisting = "allow-existing"
+	// KubernetesNodeCordonPolicyBlockAll blocks the requested attachment
+	// and migration to the cordoned node as well
+	KubernetesNodeCordonPolicyBlockAll = "block-all"
+)
+
+const (
+	WorkloadPodDeletionPolicyDoNothing = "do-nothing"
+	WorkloadPodDeletionPolicyDeletePod = "delete-pod"
+	// WorkloadPodDeletionPolicyDeletePodAndVolumeAttachment deletes the
+	// VolumeAttachments left on the down node as well, since they're only
+	// cleaned up by Kubernetes after the node is gone for a while
+	WorkloadPodDeletionPolicyDeletePodAndVolumeAttachment = "delete-pod-and-volume-attachment"
+)
+
+const (
+	AdmissionWebhookFailurePolicyIgnore = "Ignore"
+	AdmissionWebhookFailurePolicyFail   = "Fail"
+)
+
+const (
+	csiResourcesChangeRequirement = "The resources must be separated by ; and each in the form of key=quantity, where the key is one of requests.cpu, requests.memory, limits.cpu and limits.memory. The request can't be greater than the limit"
 )
 
 type SettingCategory string
@@ -38,6 +171,94 @@ type SettingDefinition struct {
 	Required    bool            `json:"required"`
 	ReadOnly    bool            `json:"readOnly"`
 	Default     string          `json:"default"`
+	// Options are the valid values of the enum setting
+	Options []string `json:"options"`
+	// Min and Max bound the value of the int setting, if set
+	Min *int64 `json:"min"`
+	Max *int64 `json:"max"`
+	// ChangeRequirement describes what's checked beyond the type when the
+	// setting is changed
+	ChangeRequirement string `json:"changeRequirement"`
+	// RequiresRestart is true if the running components pick up the change
+	// only after restarted
+	RequiresRestart bool `json:"requiresRestart"`
+}
+
+func settingBound(v int64) *int64 {
+	return &v
+}
+
+// ValidateSettingValue checks the value against the type and the constraints
+// of the setting definition. The error describes the constraints.
+func ValidateSettingValue(name SettingName, value string) error {
+	definition, ok := SettingDefinitions[name]
+	if !ok {
+		return fmt.Errorf("setting %v is not supported", name)
+	}
+	if value == "" {
+		if definition.Required {
+			return fmt.Errorf("setting %v is required", name)
+		}
+		return nil
+	}
+	switch definition.Type {
+	case SettingTypeInt:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || (definition.Min != nil && v < *definition.Min) || (definition.Max != nil && v > *definition.Max) {
+			return fmt.Errorf("invalid value %v of setting %v, should be an integer%v", value, name, definition.describeBounds())
+		}
+	case SettingTypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid value %v of setting %v, should be true or false", value, name)
+		}
+	case SettingTypeDuration:
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid value %v of setting %v, should be a duration like 30s or 5m", value, name)
+		}
+	case SettingTypeEnum:
+		for _, option := range definition.Options {
+			if value == option {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid value %v of setting %v, should be one of %v", value, name, strings.Join(definition.Options, ", "))
+	}
+	switch name {
+	case SettingNameTaintToleration:
+		if _, err := util.UnmarshalTolerations(value); err != nil {
+			return fmt.Errorf("invalid value %v of setting %v: %v", value, name, err)
+		}
+	case SettingNameCSINodeSelector:
+		if _, err := util.UnmarshalNodeSelector(value); err != nil {
+			return fmt.Errorf("invalid value %v of setting %v: %v", value, name, err)
+		}
+	case SettingNameCSIPriorityClass:
+		if errs := validation.IsDNS1123Subdomain(value); len(errs) != 0 {
+			return fmt.Errorf("invalid value %v of setting %v: %v", value, name, strings.Join(errs, ", "))
+		}
+	case SettingNameCSIAttacherResources, SettingNameCSIProvisionerResources, SettingNameCSIDriverRegistrarResources,
+		SettingNameCSISnapshotterResources, SettingNameCSIPluginResources:
+		if _, err := util.UnmarshalResourceRequirements(value); err != nil {
+			return fmt.Errorf("invalid value %v of setting %v: %v", value, name, err)
+		}
+	case SettingNameUpgradeCheckerURL:
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid value %v of setting %v, should be an http or https URL", value, name)
+		}
+	}
+	return nil
+}
+
+func (d SettingDefinition) describeBounds() string {
+	switch {
+	case d.Min != nil && d.Max != nil:
+		return fmt.Sprintf(" between %v and %v", *d.Min, *d.Max)
+	case d.Min != nil:
+		return fmt.Sprintf(" of at least %v", *d.Min)
+	case d.Max != nil:
+		return fmt.Sprintf(" of at most %v", *d.Max)
+	}
+	return ""
 }
 
 var (
@@ -47,24 +268,71 @@ var (
 		SettingNameDefaultEngineImage:                SettingDefinitionDefaultEngineImage,
 		SettingNameStorageOverProvisioningPercentage: SettingDefinitionStorageOverProvisioningPercentage,
 		SettingNameStorageMinimalAvailablePercentage: SettingDefinitionStorageMinimalAvailablePercentage,
+		SettingNameOrphanAutoDeletion:                SettingDefinitionOrphanAutoDeletion,
+		SettingNameReplicaZoneSoftAntiAffinity:       SettingDefinitionReplicaZoneSoftAntiAffinity,
+		SettingNameStorageActualUsageWeight:          SettingDefinitionStorageActualUsageWeight,
+		SettingNameKubernetesNodeCordonPolicy:        SettingDefinitionKubernetesNodeCordonPolicy,
+		SettingNameConcurrentDiskEvictionLimit:       SettingDefinitionConcurrentDiskEvictionLimit,
+		SettingNameRemovedNodeDeletionGracePeriod:    SettingDefinitionRemovedNodeDeletionGracePeriod,
+		SettingNameCreateDefaultDiskLabeledNodes:     SettingDefinitionCreateDefaultDiskLabeledNodes,
+		SettingNameDiskHealthProbe:                   SettingDefinitionDiskHealthProbe,
+		SettingNameDiskHealthProbeInterval:           SettingDefinitionDiskHealthProbeInterval,
+		SettingNameDiskHealthProbeReplicaRebuild:     SettingDefinitionDiskHealthProbeReplicaRebuild,
+		SettingNameBackupstorePollInterval:           SettingDefinitionBackupstorePollInterval,
+		SettingNameAutoUpgradeEngineToDefaultImage:   SettingDefinitionAutoUpgradeEngineToDefaultImage,
+		SettingNameAutoUpgradeEngineConcurrency:      SettingDefinitionAutoUpgradeEngineConcurrency,
+		SettingNameConcurrentBackupstoreAccessLimit:  SettingDefinitionConcurrentBackupstoreAccessLimit,
+		SettingNameConcurrentEngineUpgradeJobLimit:   SettingDefinitionConcurrentEngineUpgradeJobLimit,
+		SettingNameConcurrentBackupLimitPerNode:      SettingDefinitionConcurrentBackupLimitPerNode,
+		SettingNameConcurrentBackupLimit:             SettingDefinitionConcurrentBackupLimit,
+		SettingNameTaintToleration:                   SettingDefinitionTaintToleration,
+		SettingNameLogLevel:                          SettingDefinitionLogLevel,
+		SettingNameDefaultReplicaCount:               SettingDefinitionDefaultReplicaCount,
+		SettingNameManageDefaultStorageClass:         SettingDefinitionManageDefaultStorageClass,
+		SettingNameUpgradeChecker:                    SettingDefinitionUpgradeChecker,
+		SettingNameUpgradeCheckerInterval:            SettingDefinitionUpgradeCheckerInterval,
+		SettingNameUpgradeCheckerURL:                 SettingDefinitionUpgradeCheckerURL,
+		SettingNameLatestLonghornVersion:             SettingDefinitionLatestLonghornVersion,
+		SettingNameSettingMigrationLevel:             SettingDefinitionSettingMigrationLevel,
+		SettingNameResourceMigrationLevel:            SettingDefinitionResourceMigrationLevel,
+		SettingNameAutoCleanupUnusedEngineImages:     SettingDefinitionAutoCleanupUnusedEngineImages,
+		SettingNameUnusedEngineImageGracePeriod:      SettingDefinitionUnusedEngineImageGracePeriod,
+		SettingNameDebugEndpoints:                    SettingDefinitionDebugEndpoints,
+		SettingNameWorkloadPodDeletionPolicy:         SettingDefinitionWorkloadPodDeletionPolicy,
+		SettingNameVolumeDeletionGracePeriod:         SettingDefinitionVolumeDeletionGracePeriod,
+		SettingNameAdmissionWebhookFailurePolicy:     SettingDefinitionAdmissionWebhookFailurePolicy,
+		SettingNameRecurringJobCatchUpWindow:         SettingDefinitionRecurringJobCatchUpWindow,
+		SettingNameCSIAttacherImage:                  SettingDefinitionCSIAttacherImage,
+		SettingNameCSIProvisionerImage:               SettingDefinitionCSIProvisionerImage,
+		SettingNameCSIDriverRegistrarImage:           SettingDefinitionCSIDriverRegistrarImage,
+		SettingNameCSISnapshotterImage:               SettingDefinitionCSISnapshotterImage,
+		SettingNameCSINodeSelector:                   SettingDefinitionCSINodeSelector,
+		SettingNameCSIPriorityClass:                  SettingDefinitionCSIPriorityClass,
+		SettingNameCSIAttacherResources:              SettingDefinitionCSIAttacherResources,
+		SettingNameCSIProvisionerResources:           SettingDefinitionCSIProvisionerResources,
+		SettingNameCSIDriverRegistrarResources:       SettingDefinitionCSIDriverRegistrarResources,
+		SettingNameCSISnapshotterResources:           SettingDefinitionCSISnapshotterResources,
+		SettingNameCSIPluginResources:                SettingDefinitionCSIPluginResources,
 	}
 
 	SettingDefinitionBackupTarget = SettingDefinition{
-		DisplayName: "Backup Target",
-		Description: "The target used for backup. Support NFS or S3.",
-		Category:    SettingCategoryBackup,
-		Type:        SettingTypeString,
-		Required:    false,
-		ReadOnly:    false,
+		DisplayName:       "Backup Target",
+		Description:       "The target used for backup. Support NFS or S3.",
+		Category:          SettingCategoryBackup,
+		Type:              SettingTypeString,
+		Required:          false,
+		ReadOnly:          false,
+		ChangeRequirement: "The target must be a URL without $ or ,",
 	}
 
 	SettingDefinitionBackupTargetCredentialSecret = SettingDefinition{
-		DisplayName: "Backup Target Credential Secret",
-		Description: "The Kubernetes secret associated with the backup target.",
-		Category:    SettingCategoryBackup,
-		Type:        SettingTypeString,
-		Required:    false,
-		ReadOnly:    false,
+		DisplayName:       "Backup Target Credential Secret",
+		Description:       "The Kubernetes secret associated with the backup target.",
+		Category:          SettingCategoryBackup,
+		Type:              SettingTypeString,
+		Required:          false,
+		ReadOnly:          false,
+		ChangeRequirement: "The secret must hold a valid credential if it exists",
 	}
 
 	SettingDefinitionDefaultEngineImage = SettingDefinition{
@@ -84,6 +352,7 @@ var (
 		Required:    true,
 		ReadOnly:    false,
 		Default:     "500",
+		Min:         settingBound(0),
 	}
 
 	SettingDefinitionStorageMinimalAvailablePercentage = SettingDefinition{
@@ -94,5 +363,479 @@ var (
 		Required:    true,
 		ReadOnly:    false,
 		Default:     "10",
+		Min:         settingBound(0),
+		Max:         settingBound(100),
+	}
+
+	SettingDefinitionOrphanAutoDeletion = SettingDefinition{
+		DisplayName: "Orphaned Replica Directory Auto Deletion",
+		Description: "Delete the replica directories which no replica refers to automatically. The directory would be deleted only if it's found orphaned by two consecutive scans.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "false",
+	}
+
+	SettingDefinitionReplicaZoneSoftAntiAffinity = SettingDefinition{
+		DisplayName: "Replica Zone Level Soft Anti-Affinity",
+		Description: "Allow scheduling new replicas of a volume to the nodes in the same zone as existing replicas, if spreading the replicas across zones is impossible. The zone of the node is read from the Kubernetes node label.",
+		Category:    SettingCategoryScheduling,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "true",
+	}
+
+	SettingDefinitionStorageActualUsageWeight = SettingDefinition{
+		DisplayName: "Storage Actual Usage Weight",
+		Description: "The weight in % of the actual usage of the disk when scheduling replicas. The existing replicas are accounted by the mix of their volume sizes and their actual sizes including snapshots, and the new replica must fit in the available space reported by the file system in the same proportion. Set it to 0 to schedule by the volume sizes only.",
+		Category:    SettingCategoryScheduling,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "50",
+		Min:         settingBound(0),
+		Max:         settingBound(100),
+	}
+
+	SettingDefinitionKubernetesNodeCordonPolicy = SettingDefinition{
+		DisplayName: "Kubernetes Node Cordon Policy",
+		Description: "The new replicas are never scheduled to the cordoned Kubernetes node. With `allow-existing`, the volumes can still be attached to the cordoned node on request. With `block-all`, attaching or migrating the volumes to the cordoned node is refused as well.",
+		Category:    SettingCategoryScheduling,
+		Type:        SettingTypeEnum,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     KubernetesNodeCordonPolicyAllowExisting,
+		Options:     []string{KubernetesNodeCordonPolicyAllowExisting, KubernetesNodeCordonPolicyBlockAll},
+	}
+
+	SettingDefinitionConcurrentDiskEvictionLimit = SettingDefinition{
+		DisplayName: "Concurrent Disk Eviction Limit",
+		Description: "The maximum number of volumes rebuilding a replica at the same time to move it off a disk requested eviction. Each volume moves one replica at a time.",
+		Category:    SettingCategoryScheduling,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "1",
+		Min:         settingBound(1),
+	}
+
+	SettingDefinitionRemovedNodeDeletionGracePeriod = SettingDefinition{
+		DisplayName: "Removed Node Deletion Grace Period",
+		Description: "In minutes. How long Longhorn keeps a node after the Kubernetes node has been removed from the cluster. The replicas on the node are failed right away, and the node is deleted once no replica refers to it after the grace period.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "60",
+		Min:         settingBound(0),
+	}
+
+	SettingDefinitionCreateDefaultDiskLabeledNodes = SettingDefinition{
+		DisplayName: "Create Default Disk Only on Labeled Node",
+		Description: "If enabled, the default disks are only created on the new nodes labeled with node.longhorn.io/create-default-disk. The label value `true` creates a disk at the default data path, and the value `config` creates the disks described by the annotation node.longhorn.io/default-disks-config. The existing nodes are not affected.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "false",
+	}
+
+	SettingDefinitionDiskHealthProbe = SettingDefinition{
+		DisplayName: "Disk Health Probe",
+		Description: "Write, fsync, read back and delete a small file on each disk periodically. The disk failing the probe is marked not ready and unschedulable.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "false",
+	}
+
+	SettingDefinitionDiskHealthProbeInterval = SettingDefinition{
+		DisplayName: "Disk Health Probe Interval",
+		Description: "In seconds. How often each disk is probed if the disk health probe is enabled. The minimum is 10.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "60",
+		Min:         settingBound(10),
+	}
+
+	SettingDefinitionDiskHealthProbeReplicaRebuild = SettingDefinition{
+		DisplayName: "Rebuild Replicas on Disk Failing Health Probe",
+		Description: "Fail the replicas on the disk failing the health probe, so they are rebuilt on the other disks. A replica is only failed if the volume has another healthy replica.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "false",
+	}
+
+	SettingDefinitionBackupstorePollInterval = SettingDefinition{
+		DisplayName: "Backupstore Poll Interval",
+		Description: "In seconds. How often the backup volumes and the backups listed from the backupstore are refreshed in the background. 0 means only refreshing when the listing is outdated by the backups created or deleted by Longhorn, or requested by the user.",
+		Category:    SettingCategoryBackup,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "300",
+		Min:         settingBound(0),
+	}
+
+	SettingDefinitionAutoUpgradeEngineToDefaultImage = SettingDefinition{
+		DisplayName: "Automatically Upgrade Engine to Default Engine Image",
+		Description: "Upgrade the engines of the volumes on the previous default engine image when the default engine image changes, e.g. after upgrading Longhorn. The volumes are upgraded a few at a time. Volumes that are degraded, rebuilding or restoring are skipped, as are volumes annotated with volume.longhorn.io/engine-upgrade-opt-out: \"true\".",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "false",
+	}
+
+	SettingDefinitionAutoUpgradeEngineConcurrency = SettingDefinition{
+		DisplayName: "Automatic Engine Upgrade Concurrency",
+		Description: "The maximum number of the volumes upgraded at the same time when upgrading the engines to the default engine image automatically.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "3",
+		Min:         settingBound(1),
+	}
+
+	SettingDefinitionConcurrentBackupstoreAccessLimit = SettingDefinition{
+		DisplayName: "Concurrent Backupstore Access Limit",
+		Description: "The maximum number of the API requests accessing the backupstore at the same time on each manager, e.g. refreshing the backup listing or testing the backup target. The requests over the limit are rejected with 429 until the others are done.",
+		Category:    SettingCategoryBackup,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "5",
+		Min:         settingBound(1),
+	}
+
+	SettingDefinitionConcurrentEngineUpgradeJobLimit = SettingDefinition{
+		DisplayName: "Concurrent Engine Upgrade Job Limit",
+		Description: "The maximum number of the bulk engine upgrade jobs running at the same time on each manager. The requests over the limit are rejected with 429 until the running jobs are done.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "2",
+		Min:         settingBound(1),
+	}
+
+	SettingDefinitionConcurrentBackupLimitPerNode = SettingDefinition{
+		DisplayName: "Concurrent Backup Limit per Node",
+		Description: "The maximum number of the backups in progress at the same time for the volumes attached to each node. The backups over the limit wait in the pending state, and start as the others are done. 0 means unlimited.",
+		Category:    SettingCategoryBackup,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "0",
+		Min:         settingBound(0),
+	}
+
+	SettingDefinitionConcurrentBackupLimit = SettingDefinition{
+		DisplayName: "Concurrent Backup Limit",
+		Description: "The maximum number of the backups in progress at the same time in the cluster. The backups over the limit wait in the pending state, and start as the others are done. 0 means unlimited.",
+		Category:    SettingCategoryBackup,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "0",
+		Min:         settingBound(0),
+	}
+
+	SettingDefinitionTaintToleration = SettingDefinition{
+		DisplayName:       "Kubernetes Taint Toleration",
+		Description:       "The taints tolerated by the pods Longhorn creates, e.g. `key1=value1:NoSchedule; key2:NoExecute`. The new engine, replica and recurring job pods tolerate the taints right away, and the CSI components are redeployed. The running engines and replicas, and the engine image daemon sets, pick the change up only after they are restarted.",
+		Category:          SettingCategoryGeneral,
+		Type:              SettingTypeString,
+		Required:          false,
+		ReadOnly:          false,
+		ChangeRequirement: "The taints must be separated by ; and each in the form of key=value:effect or key:effect",
+		RequiresRestart:   true,
+	}
+
+	SettingDefinitionLogLevel = SettingDefinition{
+		DisplayName: "Log Level",
+		Description: "The log level of the managers. Applied to the running managers right away. The --debug flag of the manager overrides it.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeEnum,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "info",
+		Options:     []string{"error", "warn", "info", "debug"},
+	}
+
+	SettingDefinitionDefaultReplicaCount = SettingDefinition{
+		DisplayName: "Default Replica Count",
+		Description: "The number of replicas of the volume created without specifying it. It's also the numberOfReplicas parameter of the default StorageClass, if the template doesn't set it.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     DefaultNumberOfReplicas,
+		Min:         settingBound(1),
+		Max:         settingBound(20),
+	}
+
+	SettingDefinitionManageDefaultStorageClass = SettingDefinition{
+		DisplayName: "Manage Default StorageClass",
+		Description: "Create and keep the StorageClass `longhorn` in sync with the template in the ConfigMap `longhorn-storageclass` and the default settings. The StorageClass is recreated if deleted, and replaced if the template or the defaults change. A StorageClass of the same name not created by Longhorn is left alone. Disable it to manage the StorageClass by yourself.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "true",
+	}
+
+	SettingDefinitionUpgradeChecker = SettingDefinition{
+		DisplayName: "Enable Upgrade Checker",
+		Description: "Check periodically whether a newer Longhorn release is available. Only the current Longhorn version and the number of nodes are sent to the upgrade checker URL. Disabled by default for the air-gapped clusters.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "false",
+	}
+
+	SettingDefinitionUpgradeCheckerInterval = SettingDefinition{
+		DisplayName: "Upgrade Checker Interval",
+		Description: "In hours. How often the upgrade checker queries the upgrade checker URL.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "24",
+		Min:         settingBound(1),
+	}
+
+	SettingDefinitionUpgradeCheckerURL = SettingDefinition{
+		DisplayName: "Upgrade Checker URL",
+		Description: "The endpoint queried by the upgrade checker for the latest Longhorn release.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeString,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "https://longhorn-upgrade-responder.rancher.io/v1/checkupgrade",
+	}
+
+	SettingDefinitionLatestLonghornVersion = SettingDefinition{
+		DisplayName: "Latest Longhorn Version",
+		Description: "The latest Longhorn release found by the upgrade checker.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeString,
+		Required:    false,
+		ReadOnly:    true,
+	}
+
+	SettingDefinitionSettingMigrationLevel = SettingDefinition{
+		DisplayName: "Setting Migration Level",
+		Description: "The number of the setting migrations applied, which carry the settings of the older versions over to the renamed or reformatted ones at startup.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    true,
+		Default:     "0",
+		Min:         settingBound(0),
+	}
+
+	SettingDefinitionResourceMigrationLevel = SettingDefinition{
+		DisplayName: "Resource Migration Level",
+		Description: "The number of the resource migrations applied, which rewrite the objects of the older versions, e.g. the volumes, engines and replicas, to the current shape at startup.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    true,
+		Default:     "0",
+		Min:         settingBound(0),
+	}
+
+	SettingDefinitionAutoCleanupUnusedEngineImages = SettingDefinition{
+		DisplayName: "Automatically Clean up Unused Engine Images",
+		Description: "Delete the engine images no volume, engine or replica has referred to for the grace period, along with their daemon sets. The default engine image is never deleted.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "true",
+	}
+
+	SettingDefinitionUnusedEngineImageGracePeriod = SettingDefinition{
+		DisplayName: "Unused Engine Image Grace Period",
+		Description: "In minutes. How long an engine image is kept after the last reference to it is gone before it's cleaned up automatically.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "60",
+		Min:         settingBound(0),
+	}
+
+	SettingDefinitionDebugEndpoints = SettingDefinition{
+		DisplayName: "Debug Endpoints",
+		Description: "Serve the profiles, the goroutine dump and the internals of the managers on the debug address of the manager, localhost:6060 by default. Applied to the running managers right away. Enable it temporarily for troubleshooting, the --debug-endpoints flag of the manager overrides it.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeBool,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "false",
+	}
+
+	SettingDefinitionWorkloadPodDeletionPolicy = SettingDefinition{
+		DisplayName: "Workload Pod Deletion Policy",
+		Description: "What to do with the pods using the Longhorn volumes when the node of the pod goes down, or the volume is detached unexpectedly, e.g. its engine crashed. Only the pods managed by a controller, e.g. a StatefulSet or a Deployment, are deleted, so they're recreated and attach the volume again cleanly. With `delete-pod`, the pods are deleted. With `delete-pod-and-volume-attachment`, the VolumeAttachments of the volumes on the down node are deleted as well, so the volumes can be attached elsewhere without waiting for them to time out.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeEnum,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     WorkloadPodDeletionPolicyDoNothing,
+		Options: []string{
+			WorkloadPodDeletionPolicyDoNothing,
+			WorkloadPodDeletionPolicyDeletePod,
+			WorkloadPodDeletionPolicyDeletePodAndVolumeAttachment,
+		},
+	}
+
+	SettingDefinitionVolumeDeletionGracePeriod = SettingDefinition{
+		DisplayName: "Volume Deletion Grace Period",
+		Description: "In minutes. How long a deleted volume is kept in the trash before it's cleaned up. The volume is detached, and its replicas and data are kept, so it can be restored until the grace period expires. The force deletion cleans up the volume right away. 0 to clean up the deleted volumes right away.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "0",
+		Min:         settingBound(0),
+	}
+
+	SettingDefinitionAdmissionWebhookFailurePolicy = SettingDefinition{
+		DisplayName: "Admission Webhook Failure Policy",
+		Description: "What the Kubernetes API server does with the changes of the Longhorn objects if no manager can validate them. With `Ignore`, the changes are accepted without the validation, so the cluster can be recovered while the managers are down. With `Fail`, the changes are rejected until a manager is up.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeEnum,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     AdmissionWebhookFailurePolicyIgnore,
+		Options:     []string{AdmissionWebhookFailurePolicyIgnore, AdmissionWebhookFailurePolicyFail},
+	}
+
+	SettingDefinitionRecurringJobCatchUpWindow = SettingDefinition{
+		DisplayName: "Recurring Job Catch Up Window",
+		Description: "In minutes. If the scheduled run of a recurring job is skipped since the volume is detached or faulted, one run is started to catch up once the volume is attached again within the window after the scheduled time. 0 to not catch up on the skipped runs.",
+		Category:    SettingCategoryBackup,
+		Type:        SettingTypeInt,
+		Required:    true,
+		ReadOnly:    false,
+		Default:     "0",
+		Min:         settingBound(0),
+	}
+
+	SettingDefinitionCSIAttacherImage = SettingDefinition{
+		DisplayName: "CSI Attacher Image",
+		Description: "The image of the CSI attacher, e.g. mirrored to a private registry. Empty to use the `--csi-attacher-image` of the driver deployer. The CSI attacher is redeployed once it's changed.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeString,
+		Required:    false,
+		ReadOnly:    false,
+	}
+
+	SettingDefinitionCSIProvisionerImage = SettingDefinition{
+		DisplayName: "CSI Provisioner Image",
+		Description: "The image of the CSI provisioner, e.g. mirrored to a private registry. Empty to use the `--csi-provisioner-image` of the driver deployer. The CSI provisioner is redeployed once it's changed.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeString,
+		Required:    false,
+		ReadOnly:    false,
+	}
+
+	SettingDefinitionCSIDriverRegistrarImage = SettingDefinition{
+		DisplayName: "CSI Driver Registrar Image",
+		Description: "The image of the CSI driver registrar, e.g. mirrored to a private registry. Empty to use the `--csi-driver-registrar-image` of the driver deployer. The CSI plugin is redeployed once it's changed, and the volumes can't be mounted or unmounted until the plugin is back on the node.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeString,
+		Required:    false,
+		ReadOnly:    false,
+	}
+
+	SettingDefinitionCSISnapshotterImage = SettingDefinition{
+		DisplayName: "CSI Snapshotter Image",
+		Description: "The image of the CSI snapshotter, e.g. mirrored to a private registry. Empty to use the `--csi-snapshotter-image` of the driver deployer. The CSI snapshotter is redeployed once it's changed.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeString,
+		Required:    false,
+		ReadOnly:    false,
+	}
+
+	SettingDefinitionCSINodeSelector = SettingDefinition{
+		DisplayName:       "CSI Node Selector",
+		Description:       "The node labels the pods of the CSI components are restricted to, e.g. `storage=longhorn; kubernetes.io/os=linux`. The CSI plugin only runs on the matching nodes, so the volumes can only be used by the workloads on them. The CSI components are redeployed once it's changed.",
+		Category:          SettingCategoryGeneral,
+		Type:              SettingTypeString,
+		Required:          false,
+		ReadOnly:          false,
+		ChangeRequirement: "The labels must be separated by ; and each in the form of key=value",
+	}
+
+	SettingDefinitionCSIPriorityClass = SettingDefinition{
+		DisplayName: "CSI Priority Class",
+		Description: "The PriorityClass of the pods of the CSI components, e.g. `system-node-critical`, so the CSI plugin isn't evicted before the workloads using the volumes when the node is under resource pressure. The PriorityClass must exist. The CSI components are redeployed once it's changed.",
+		Category:    SettingCategoryGeneral,
+		Type:        SettingTypeString,
+		Required:    false,
+		ReadOnly:    false,
+	}
+
+	SettingDefinitionCSIAttacherResources = SettingDefinition{
+		DisplayName:       "CSI Attacher Resources",
+		Description:       "The CPU and memory requests and limits of the CSI attacher, e.g. `requests.cpu=100m; requests.memory=64Mi; limits.memory=128Mi`, for the namespace with a ResourceQuota. Empty for none. The CSI attacher is redeployed once it's changed.",
+		Category:          SettingCategoryGeneral,
+		Type:              SettingTypeString,
+		Required:          false,
+		ReadOnly:          false,
+		ChangeRequirement: csiResourcesChangeRequirement,
+	}
+
+	SettingDefinitionCSIProvisionerResources = SettingDefinition{
+		DisplayName:       "CSI Provisioner Resources",
+		Description:       "The CPU and memory requests and limits of the CSI provisioner, e.g. `requests.cpu=100m; requests.memory=64Mi; limits.memory=128Mi`, for the namespace with a ResourceQuota. Empty for none. The CSI provisioner is redeployed once it's changed.",
+		Category:          SettingCategoryGeneral,
+		Type:              SettingTypeString,
+		Required:          false,
+		ReadOnly:          false,
+		ChangeRequirement: csiResourcesChangeRequirement,
+	}
+
+	SettingDefinitionCSIDriverRegistrarResources = SettingDefinition{
+		DisplayName:       "CSI Driver Registrar Resources",
+		Description:       "The CPU and memory requests and limits of the driver registrar container of the CSI plugin, e.g. `requests.cpu=100m; requests.memory=64Mi; limits.memory=128Mi`, for the namespace with a ResourceQuota. Empty for none. The CSI plugin is redeployed on all the nodes once it's changed.",
+		Category:          SettingCategoryGeneral,
+		Type:              SettingTypeString,
+		Required:          false,
+		ReadOnly:          false,
+		ChangeRequirement: csiResourcesChangeRequirement,
+	}
+
+	SettingDefinitionCSISnapshotterResources = SettingDefinition{
+		DisplayName:       "CSI Snapshotter Resources",
+		Description:       "The CPU and memory requests and limits of the CSI snapshotter, e.g. `requests.cpu=100m; requests.memory=64Mi; limits.memory=128Mi`, for the namespace with a ResourceQuota. Empty for none. The CSI snapshotter is redeployed once it's changed.",
+		Category:          SettingCategoryGeneral,
+		Type:              SettingTypeString,
+		Required:          false,
+		ReadOnly:          false,
+		ChangeRequirement: csiResourcesChangeRequirement,
+	}
+
+	SettingDefinitionCSIPluginResources = SettingDefinition{
+		DisplayName:       "CSI Plugin Resources",
+		Description:       "The CPU and memory requests and limits of the longhorn-csi-plugin container of the CSI plugin, e.g. `requests.cpu=100m; requests.memory=64Mi; limits.memory=128Mi`, for the namespace with a ResourceQuota. Empty for none. The CSI plugin is redeployed on all the nodes once it's changed.",
+		Category:          SettingCategoryGeneral,
+		Type:              SettingTypeString,
+		Required:          false,
+		ReadOnly:          false,
+		ChangeRequirement: csiResourcesChangeRequirement,
 	}
 )
@@ -1,17 +1,28 @@
 package types
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/rancher/longhorn-manager/util"
 )
 
 const (
 	DefaultAPIPort = 9500
+	// DefaultWebhookPort is where the manager serves the admission webhook,
+	// reached by the API server through the service on port 443
+	DefaultWebhookPort = 9443
+
+	AdmissionWebhookServiceName       = "longhorn-admission-webhook"
+	AdmissionWebhookConfigurationName = "longhorn-admission-webhook"
+	AdmissionWebhookTLSSecretName     = "longhorn-admission-webhook-tls"
 
 	DefaultEngineBinaryPath          = "/usr/local/bin/longhorn"
 	EngineBinaryDirectoryInContainer = "/engine-binaries/"
@@ -24,6 +35,21 @@ const (
 	LonghornNodeKey = "longhornnode"
 
 	BaseImageLabel = "ranchervm-base-image"
+	// RecurringJobLabel is set on the snapshots and the backups by the
+	// recurring job to the job name, for the retention of the job
+	RecurringJobLabel = "RecurringJob"
+
+	// KubeNodeZoneLabel is the zone label of Kubernetes node, it will take
+	// precedence over the deprecated KubeNodeLegacyZoneLabel
+	KubeNodeZoneLabel       = "topology.kubernetes.io/zone"
+	KubeNodeLegacyZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+
+	// KubeNodeCreateDefaultDiskLabel decides the default disks of the new
+	// node if the setting create-default-disk-labeled-nodes is enabled
+	KubeNodeCreateDefaultDiskLabel            = "node.longhorn.io/create-default-disk"
+	KubeNodeCreateDefaultDiskLabelValueTrue   = "true"
+	KubeNodeCreateDefaultDiskLabelValueConfig = "config"
+	KubeNodeDefaultDisksConfigAnnotation      = "node.longhorn.io/default-disks-config"
 )
 
 const (
@@ -31,6 +57,66 @@ const (
 	KubeletPluginWatcherMinVersion = "v1.12.0"
 )
 
+// GetZoneFromKubeNodeLabels returns the zone of the Kubernetes node, or empty
+// if the node isn't labelled with any zone
+func GetZoneFromKubeNodeLabels(labels map[string]string) string {
+	if zone := labels[KubeNodeZoneLabel]; zone != "" {
+		return zone
+	}
+	return labels[KubeNodeLegacyZoneLabel]
+}
+
+type defaultDiskConfig struct {
+	Path            string   `json:"path"`
+	AllowScheduling *bool    `json:"allowScheduling"`
+	StorageReserved int64    `json:"storageReserved"`
+	Tags            []string `json:"tags"`
+}
+
+// GetDefaultDisksFromKubeNodeAnnotations parses the JSON array of the disks
+// in the annotation KubeNodeDefaultDisksConfigAnnotation. The scheduling of
+// a disk is allowed unless allowScheduling is set to false.
+func GetDefaultDisksFromKubeNodeAnnotations(annotations map[string]string) ([]DiskSpec, error) {
+	config, ok := annotations[KubeNodeDefaultDisksConfigAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("missing annotation %v", KubeNodeDefaultDisksConfigAnnotation)
+	}
+	configs := []defaultDiskConfig{}
+	if err := json.Unmarshal([]byte(config), &configs); err != nil {
+		return nil, errors.Wrapf(err, "invalid annotation %v", KubeNodeDefaultDisksConfigAnnotation)
+	}
+	disks := []DiskSpec{}
+	paths := map[string]struct{}{}
+	for _, c := range configs {
+		if !filepath.IsAbs(c.Path) {
+			return nil, fmt.Errorf("disk path %v is not an absolute path", c.Path)
+		}
+		path := filepath.Clean(c.Path)
+		if _, ok := paths[path]; ok {
+			return nil, fmt.Errorf("duplicate disk path %v", path)
+		}
+		paths[path] = struct{}{}
+		if c.StorageReserved < 0 {
+			return nil, fmt.Errorf("invalid storageReserved %v of disk %v", c.StorageReserved, path)
+		}
+		tags, err := util.ValidateTags(c.Tags)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tags of disk %v", path)
+		}
+		disk := DiskSpec{
+			Path:            path,
+			AllowScheduling: true,
+			StorageReserved: c.StorageReserved,
+			Tags:            tags,
+		}
+		if c.AllowScheduling != nil {
+			disk.AllowScheduling = *c.AllowScheduling
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
 type ReplicaMode string
 
 const (
@@ -52,10 +138,26 @@ const (
 	OptionStaleReplicaTimeout = "staleReplicaTimeout"
 	OptionBaseImage           = "baseImage"
 	OptionFrontend            = "frontend"
+	OptionReadIOPS            = "readIOPS"
+	OptionWriteIOPS           = "writeIOPS"
+	OptionReadBandwidth       = "readBandwidth"
+	OptionWriteBandwidth      = "writeBandwidth"
 
 	DefaultNumberOfReplicas    = "3"
 	DefaultStaleReplicaTimeout = "30"
 
+	DefaultStorageClassName          = "longhorn"
+	DefaultStorageClassConfigMapName = "longhorn-storageclass"
+	DefaultStorageClassConfigMapKey  = "storageclass.yaml"
+	// StorageClassManagedByAnnotation marks the StorageClass created by
+	// Longhorn, the only one Longhorn would replace
+	StorageClassManagedByAnnotation = "storageclass.longhorn.io/managed-by"
+	StorageClassManagedByLonghorn   = "longhorn-manager"
+	// VolumeEngineUpgradeOptOutAnnotation set to "true" excludes the volume
+	// from upgrading the engines of all the volumes on an engine image, e.g.
+	// the rollout of the default engine image
+	VolumeEngineUpgradeOptOutAnnotation = "volume.longhorn.io/engine-upgrade-opt-out"
+
 	EngineImageChecksumNameLength = 8
 )
 
@@ -80,9 +182,89 @@ const (
 	// 5. Dash and buffer for 2
 	MaximumJobNameSize = 8
 
-	engineImagePrefix = "ei-"
+	engineImagePrefix     = "ei-"
+	instanceManagerPrefix = "instance-manager-"
 )
 
+// volumeQoSLimits returns the limits of qos by the options
+func volumeQoSLimits(qos *VolumeQoS) []struct {
+	option string
+	limit  *int
+} {
+	return []struct {
+		option string
+		limit  *int
+	}{
+		{OptionReadIOPS, &qos.ReadIOPS},
+		{OptionWriteIOPS, &qos.WriteIOPS},
+		{OptionReadBandwidth, &qos.ReadBandwidth},
+		{OptionWriteBandwidth, &qos.WriteBandwidth},
+	}
+}
+
+// GetVolumeQoSFromOptions parses the I/O limits in the options of the
+// volume, e.g. the parameters of the StorageClass
+func GetVolumeQoSFromOptions(options map[string]string) (VolumeQoS, error) {
+	qos := VolumeQoS{}
+	for _, l := range volumeQoSLimits(&qos) {
+		value, ok := options[l.option]
+		if !ok {
+			continue
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return VolumeQoS{}, errors.Wrapf(err, "invalid option %v", l.option)
+		}
+		*l.limit = limit
+	}
+	if err := ValidateVolumeQoS(qos); err != nil {
+		return VolumeQoS{}, err
+	}
+	return qos, nil
+}
+
+// ValidateVolumeQoS rejects the negative limits
+func ValidateVolumeQoS(qos VolumeQoS) error {
+	for _, l := range volumeQoSLimits(&qos) {
+		if *l.limit < 0 {
+			return fmt.Errorf("invalid %v %v, must be at least 0", l.option, *l.limit)
+		}
+	}
+	return nil
+}
+
+// ParseRecurringJobSchedule returns the schedule of the recurring job, and
+// the time zone it's evaluated in
+func ParseRecurringJobSchedule(job *RecurringJob) (*util.CronSchedule, *time.Location, error) {
+	schedule, err := util.ParseCronSchedule(job.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc, err := LoadRecurringJobLocation(job.Timezone)
+	if err != nil {
+		return nil, nil, err
+	}
+	return schedule, loc, nil
+}
+
+// LoadRecurringJobLocation returns the time zone of the IANA name, or UTC if
+// it's empty
+func LoadRecurringJobLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.UTC, nil
+	}
+	// "Local" is the zone of the manager, which is exactly what the time
+	// zone is set to avoid
+	if timezone == "Local" {
+		return nil, fmt.Errorf("invalid time zone %q, must be an IANA time zone name", timezone)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q, must be an IANA time zone name", timezone)
+	}
+	return loc, nil
+}
+
 func GenerateEngineNameForVolume(vName string) string {
 	return vName + engineSuffix + "-" + util.RandomID()
 }
@@ -99,6 +281,10 @@ func GetAPIServerAddressFromIP(ip string) string {
 	return ip + ":" + strconv.Itoa(DefaultAPIPort)
 }
 
+func GetWebhookServerAddressFromIP(ip string) string {
+	return ip + ":" + strconv.Itoa(DefaultWebhookPort)
+}
+
 func GetImageCanonicalName(image string) string {
 	return strings.Replace(strings.Replace(image, ":", "-", -1), "/", "-", -1)
 }
@@ -119,9 +305,22 @@ func EngineBinaryExistOnHostForImage(image string) bool {
 }
 
 var (
-	LonghornSystemKey              = "longhorn"
-	LonghornSystemValueManager     = "manager"
-	LonghornSystemValueEngineImage = "engine-image"
+	LonghornSystemKey                  = "longhorn"
+	LonghornSystemValueManager         = "manager"
+	LonghornSystemValueEngineImage     = "engine-image"
+	LonghornSystemValueInstanceManager = "instance-manager"
+	LonghornInstanceManagerTypeKey     = "longhorn-instance-manager-type"
+	LonghornEngineImageKey             = "longhorn-engine-image"
+	// LonghornCronJobKey is set on the Kubernetes jobs running a recurring
+	// job, with the name of the CronJob
+	LonghornCronJobKey = "longhorn-cronjob"
+)
+
+type InstanceManagerType string
+
+const (
+	InstanceManagerTypeEngine  = InstanceManagerType("engine")
+	InstanceManagerTypeReplica = InstanceManagerType("replica")
 )
 
 func GetEngineImageLabel() map[string]string {
@@ -134,6 +333,28 @@ func GetEngineImageChecksumName(image string) string {
 	return engineImagePrefix + util.GetStringChecksum(strings.TrimSpace(image))[:EngineImageChecksumNameLength]
 }
 
+// GetInstanceManagerName returns the name of the instance manager pod of the
+// type running the processes of the engine image on the node
+func GetInstanceManagerName(imType InstanceManagerType, nodeID, image string) string {
+	checksum := util.GetStringChecksum(nodeID + "/" + strings.TrimSpace(image))[:EngineImageChecksumNameLength]
+	return instanceManagerPrefix + string(imType)[:1] + "-" + checksum
+}
+
+func GetInstanceManagerLabels(imType InstanceManagerType, nodeID, image string) map[string]string {
+	return map[string]string{
+		LonghornSystemKey:              LonghornSystemValueInstanceManager,
+		LonghornInstanceManagerTypeKey: string(imType),
+		LonghornNodeKey:                nodeID,
+		LonghornEngineImageKey:         GetEngineImageChecksumName(image),
+	}
+}
+
+// IsInstanceManagerPod returns true if the labels are of an instance manager
+// pod
+func IsInstanceManagerPod(labels map[string]string) bool {
+	return labels[LonghornSystemKey] == LonghornSystemValueInstanceManager
+}
+
 // GetVolumeConditionFromStatus returns a copy of v.Status.Condition[conditionType]
 func GetVolumeConditionFromStatus(status VolumeStatus, conditionType VolumeConditionType) Condition {
 	condition, exists := status.Conditions[conditionType]
@@ -159,6 +380,30 @@ func GetNodeConditionFromStatus(status NodeStatus, conditionType NodeConditionTy
 	return condition
 }
 
+func GetEngineImageConditionFromStatus(status EngineImageStatus, conditionType EngineImageConditionType) Condition {
+	condition, exists := status.Conditions[conditionType]
+	if !exists {
+		condition = getUnknownCondition(string(conditionType))
+	}
+	return condition
+}
+
+func GetSettingConditionFromStatus(status SettingStatus, conditionType SettingConditionType) Condition {
+	condition, exists := status.Conditions[conditionType]
+	if !exists {
+		condition = getUnknownCondition(string(conditionType))
+	}
+	return condition
+}
+
+func GetSnapshotConditionFromStatus(status SnapshotStatus, conditionType SnapshotConditionType) Condition {
+	condition, exists := status.Conditions[conditionType]
+	if !exists {
+		condition = getUnknownCondition(string(conditionType))
+	}
+	return condition
+}
+
 func GetDiskConditionFromStatus(status DiskStatus, conditionType DiskConditionType) Condition {
 	condition, exists := status.Conditions[conditionType]
 	if !exists {
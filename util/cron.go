@@ -0,0 +1,186 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is the schedule in the standard cron format, with the
+// minute, hour, day of month, month and day of week fields
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// the day matches either the day of month or the day of week if both
+	// are restricted, as cron does
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronFields = []cronField{
+		{min: 0, max: 59},
+		{min: 0, max: 23},
+		{min: 1, max: 31},
+		{min: 1, max: 12, names: map[string]int{
+			"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+			"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+		}},
+		// both 0 and 7 are Sunday
+		{min: 0, max: 7, names: map[string]int{
+			"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+		}},
+	}
+
+	cronMacros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+
+	// the schedule never matching in the period, e.g. Feb 30, has no next
+	// time
+	cronSearchLimitYears = 5
+)
+
+// ParseCronSchedule parses the schedule in the format of the Kubernetes
+// CronJob, e.g. "0 2 * * mon-fri" or "@daily"
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	expr := strings.TrimSpace(spec)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron %q, expected %v fields", spec, len(cronFields))
+	}
+	bits := make([]uint64, len(cronFields))
+	for i, field := range cronFields {
+		b, err := field.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron %q: %v", spec, err)
+		}
+		bits[i] = b
+	}
+	s := &CronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2][0] == '*' || fields[2][0] == '?',
+		dowStar: fields[4][0] == '*' || fields[4][0] == '?',
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func (f cronField) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, step, hasStep := part, 1, false
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangeExpr, step, hasStep = part[:i], n, true
+		}
+		lo, hi := f.min, f.max
+		if rangeExpr != "*" && rangeExpr != "?" {
+			bounds := strings.SplitN(rangeExpr, "-", 2)
+			var err error
+			if lo, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "5/10" starts from 5 up to the max
+				hi = f.max
+			}
+		}
+		if lo > hi {
+			return 0, fmt.Errorf("invalid range %q", part)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%q is not in [%v-%v]", s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// Next returns the first time matching the schedule after t, evaluated in
+// the location of t. It returns the zero time if there is none in five
+// years.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// the wall clock is followed by the absolute time within a day, so the
+	// hour repeated at the end of the daylight saving time matches twice,
+	// and the skipped one never does
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	limit := t.AddDate(cronSearchLimitYears, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Latest returns the last time matching the schedule in (from, to], or the
+// zero time if there is none
+func (s *CronSchedule) Latest(from, to time.Time) time.Time {
+	latest := time.Time{}
+	for t := s.Next(from); !t.IsZero() && !t.After(to); t = s.Next(t) {
+		latest = t
+	}
+	return latest
+}
+
+func (s *CronSchedule) matchDay(t time.Time) bool {
+	domMatched := s.dom&(1<<uint(t.Day())) != 0
+	dowMatched := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatched && dowMatched
+	}
+	return domMatched || dowMatched
+}
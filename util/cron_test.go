@@ -0,0 +1,85 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	assert := require.New(t)
+
+	for _, spec := range []string{
+		"* * * * *",
+		"*/5 * * * *",
+		"0 2 * * mon-fri",
+		"30 1,13 1-7/2 JAN,jul ?",
+		"5/15 * * * 7",
+		"@daily",
+		"@Weekly",
+	} {
+		_, err := ParseCronSchedule(spec)
+		assert.Nil(err, spec)
+	}
+
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"@every 5m",
+	} {
+		_, err := ParseCronSchedule(spec)
+		assert.NotNil(err, spec)
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	assert := require.New(t)
+
+	next := func(spec, from string, loc *time.Location) string {
+		s, err := ParseCronSchedule(spec)
+		assert.Nil(err)
+		t, err := time.ParseInLocation("2006-01-02T15:04:05", from, loc)
+		assert.Nil(err)
+		n := s.Next(t)
+		if n.IsZero() {
+			return ""
+		}
+		return n.Format(time.RFC3339)
+	}
+
+	assert.Equal("2019-03-01T10:01:00Z", next("* * * * *", "2019-03-01T10:00:00", time.UTC))
+	assert.Equal("2019-03-01T10:01:00Z", next("* * * * *", "2019-03-01T10:00:30", time.UTC))
+	assert.Equal("2019-03-01T10:15:00Z", next("*/15 * * * *", "2019-03-01T10:00:00", time.UTC))
+	assert.Equal("2019-03-02T02:00:00Z", next("0 2 * * *", "2019-03-01T10:00:00", time.UTC))
+	assert.Equal("2019-04-01T00:00:00Z", next("@monthly", "2019-03-01T10:00:00", time.UTC))
+	// 2019-03-01 is Friday
+	assert.Equal("2019-03-04T02:00:00Z", next("0 2 * * mon-thu", "2019-03-01T10:00:00", time.UTC))
+	assert.Equal("2019-03-03T00:00:00Z", next("0 0 * * 7", "2019-03-01T10:00:00", time.UTC))
+	// either the day of month or the day of week
+	assert.Equal("2019-03-02T00:00:00Z", next("0 0 15 * sat", "2019-03-01T10:00:00", time.UTC))
+	assert.Equal("2020-02-29T00:00:00Z", next("0 0 29 2 *", "2019-03-01T10:00:00", time.UTC))
+	assert.Equal("", next("0 0 30 2 *", "2019-03-01T10:00:00", time.UTC))
+
+	loc, err := time.LoadLocation("America/New_York")
+	assert.Nil(err)
+	assert.Equal("2019-03-01T02:00:00-05:00", next("0 2 * * *", "2019-03-01T00:00:00", loc))
+	// 2:30 is skipped when the daylight saving time starts
+	assert.Equal("2019-03-11T02:30:00-04:00", next("30 2 * * *", "2019-03-10T00:00:00", loc))
+	assert.Equal("2019-03-10T03:00:00-04:00", next("0 3 * * *", "2019-03-10T00:00:00", loc))
+
+	s, err := ParseCronSchedule("0 * * * *")
+	assert.Nil(err)
+	from := time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(time.Date(2019, 3, 1, 13, 0, 0, 0, time.UTC), s.Latest(from, from.Add(3*time.Hour+30*time.Minute)))
+	assert.True(s.Latest(from, from.Add(30*time.Minute)).IsZero())
+}
@@ -3,16 +3,21 @@ package util
 import (
 	"crypto/md5"
 	"crypto/sha512"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -26,6 +31,9 @@ import (
 	"k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/kubernetes/pkg/util/version"
 )
 
 const (
@@ -37,11 +45,48 @@ const (
 	AWSAccessKey      = "AWS_ACCESS_KEY_ID"
 	AWSSecretKey      = "AWS_SECRET_ACCESS_KEY"
 	AWSEndPoint       = "AWS_ENDPOINTS"
+	// AWSRegion overrides the region in the backup target URL, for the
+	// S3-compatible stores which don't follow the AWS region names
+	AWSRegion = "AWS_REGION"
+	// AWSVirtualHostedStyle is "true" to address the bucket as a subdomain
+	// of the endpoint instead of a path of it
+	AWSVirtualHostedStyle = "VIRTUAL_HOSTED_STYLE"
+	// AWSCert is the PEM encoded CA certificate of the endpoint, for the
+	// store with the certificate issued by an internal CA
+	AWSCert = "AWS_CERT"
+	// AWSInsecureSkipTLSVerify is "true" to skip the verification of the
+	// certificate of the endpoint
+	AWSInsecureSkipTLSVerify = "AWS_INSECURE_SKIP_TLS_VERIFY"
+
+	// HTTPProxy, HTTPSProxy and NoProxy configure the proxy of the backup
+	// traffic, for the cluster which reaches the backupstore only through
+	// a proxy
+	HTTPProxy  = "HTTP_PROXY"
+	HTTPSProxy = "HTTPS_PROXY"
+	NoProxy    = "NO_PROXY"
+	// BackupNoProxyEnv holds NO_PROXY of the secret in the pod, since
+	// NO_PROXY of the pod includes the in-cluster addresses as well
+	BackupNoProxyEnv = "LONGHORN_BACKUP_NO_PROXY"
+
+	// DiskConfigFile is written to the root of each disk to identify the disk
+	DiskConfigFile = "longhorn-disk.cfg"
+	// DiskHealthProbeDirectory holds the canary file of the disk health
+	// probe, under the root of each disk
+	DiskHealthProbeDirectory = ".longhorn-health-probe"
+
+	MaxTagLength = 63
+	MaxTagCount  = 32
+
+	// VolumeNameMaximumLength restricted the length due to Kubernetes name
+	// limitation
+	VolumeNameMaximumLength = 40
 )
 
 var (
 	cmdTimeout = time.Minute // one minute by default
 
+	validTag = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
 	ConflictRetryInterval = 20 * time.Millisecond
 	ConflictRetryCounts   = 100
 )
@@ -53,6 +98,10 @@ type MetadataConfig struct {
 	DriverContainerName string
 }
 
+type DiskConfig struct {
+	DiskUUID string `json:"diskUUID"`
+}
+
 type DiskInfo struct {
 	Fsid             string
 	Path             string
@@ -62,6 +111,7 @@ type DiskInfo struct {
 	BlockSize        int64
 	StorageMaximum   int64
 	StorageAvailable int64
+	ReadOnly         bool
 }
 
 func VolumeStackName(volumeName string) string {
@@ -210,9 +260,22 @@ func Execute(binary string, args ...string) (string, error) {
 }
 
 func ExecuteWithTimeout(timeout time.Duration, binary string, args ...string) (string, error) {
+	return ExecuteWithTimeoutAndEnv(timeout, nil, binary, args...)
+}
+
+// ExecuteWithEnv runs the binary with the environment variables in the form
+// of key=value, in addition to the environment of the process
+func ExecuteWithEnv(env []string, binary string, args ...string) (string, error) {
+	return ExecuteWithTimeoutAndEnv(cmdTimeout, env, binary, args...)
+}
+
+func ExecuteWithTimeoutAndEnv(timeout time.Duration, env []string, binary string, args ...string) (string, error) {
 	var output []byte
 	var err error
 	cmd := exec.Command(binary, args...)
+	if len(env) != 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	done := make(chan struct{})
 
 	go func() {
@@ -254,18 +317,86 @@ func ValidateName(name string) bool {
 	return validName.MatchString(name)
 }
 
+// ValidateVolumeName checks the name of the volume, which is also used in
+// the names of the Kubernetes objects of the volume so the length is limited
+func ValidateVolumeName(name string) error {
+	if !ValidateName(name) {
+		return fmt.Errorf("invalid name %v, must start with a letter or a digit, and contain only letters, digits, '_', '.' and '-'", name)
+	}
+	if len(name) > VolumeNameMaximumLength {
+		return fmt.Errorf("invalid name %v, must be %v characters or less", name, VolumeNameMaximumLength)
+	}
+	return nil
+}
+
+// ValidateVolumeSize returns the size in bytes, or error if it's not a
+// positive quantity
+func ValidateVolumeSize(size string) (int64, error) {
+	value, err := ConvertSize(size)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("invalid size %v, must be positive", size)
+	}
+	return value, nil
+}
+
+// ValidateTags returns the sorted tags without duplications, or error if
+// there is any invalid tag. The tags are case sensitive.
+func ValidateTags(inputTags []string) ([]string, error) {
+	foundTags := map[string]struct{}{}
+	for _, tag := range inputTags {
+		if err := ValidateTag(tag); err != nil {
+			return nil, err
+		}
+		foundTags[tag] = struct{}{}
+	}
+	if len(foundTags) > MaxTagCount {
+		return nil, fmt.Errorf("too many tags: %v, at most %v tags are allowed", len(foundTags), MaxTagCount)
+	}
+	tags := []string{}
+	for tag := range foundTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func ValidateTag(tag string) error {
+	if !validTag.MatchString(tag) {
+		return fmt.Errorf("invalid tag %v", tag)
+	}
+	if len(tag) > MaxTagLength {
+		return fmt.Errorf("invalid tag %v: longer than %v characters", tag, MaxTagLength)
+	}
+	return nil
+}
+
 func GetBackupID(backupURL string) (string, error) {
+	backupName, _, err := parseBackupURL(backupURL)
+	return backupName, err
+}
+
+// GetBackupVolumeName returns the name of the backup volume the backup
+// belongs to
+func GetBackupVolumeName(backupURL string) (string, error) {
+	_, volumeName, err := parseBackupURL(backupURL)
+	return volumeName, err
+}
+
+func parseBackupURL(backupURL string) (string, string, error) {
 	u, err := url.Parse(backupURL)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	v := u.Query()
 	volumeName := v.Get("volume")
 	backupName := v.Get("backup")
 	if !ValidateName(volumeName) || !ValidateName(backupName) {
-		return "", fmt.Errorf("Invalid name parsed, got %v and %v", backupName, volumeName)
+		return "", "", fmt.Errorf("Invalid name parsed, got %v and %v", backupName, volumeName)
 	}
-	return backupName, nil
+	return backupName, volumeName, nil
 }
 
 func GetRequiredEnv(key string) (string, error) {
@@ -276,6 +407,143 @@ func GetRequiredEnv(key string) (string, error) {
 	return env, nil
 }
 
+// ValidateLabels checks the keys and the values of the labels of the
+// snapshots and the backups
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !ValidateName(key) {
+			return fmt.Errorf("Invalid key %v for label %v=%v", key, key, value)
+		}
+		if !ValidateName(value) {
+			return fmt.Errorf("Invalid value %v for label %v=%v", value, key, value)
+		}
+	}
+	return nil
+}
+
+// UnmarshalTolerations parses the taint tolerations separated by ; in the
+// form of key=value:effect, or key:effect to tolerate any value of the key.
+// An empty key tolerates all the taints with the effect.
+func UnmarshalTolerations(s string) ([]v1.Toleration, error) {
+	tolerations := []v1.Toleration{}
+	for _, t := range strings.Split(s, ";") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		parts := strings.Split(t, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid toleration %v, should be key=value:effect or key:effect", t)
+		}
+		toleration := v1.Toleration{
+			Operator: v1.TolerationOpExists,
+			Effect:   v1.TaintEffect(parts[1]),
+		}
+		switch toleration.Effect {
+		case v1.TaintEffectNoSchedule, v1.TaintEffectPreferNoSchedule, v1.TaintEffectNoExecute:
+		default:
+			return nil, fmt.Errorf("invalid effect %v of toleration %v", parts[1], t)
+		}
+		kv := strings.SplitN(parts[0], "=", 2)
+		toleration.Key = kv[0]
+		if len(kv) == 2 {
+			toleration.Operator = v1.TolerationOpEqual
+			toleration.Value = kv[1]
+			if toleration.Key == "" {
+				return nil, fmt.Errorf("invalid toleration %v, the value requires a key", t)
+			}
+			if errs := validation.IsValidLabelValue(toleration.Value); len(errs) != 0 {
+				return nil, fmt.Errorf("invalid value of toleration %v: %v", t, strings.Join(errs, ", "))
+			}
+		}
+		if toleration.Key != "" {
+			if errs := validation.IsQualifiedName(toleration.Key); len(errs) != 0 {
+				return nil, fmt.Errorf("invalid key of toleration %v: %v", t, strings.Join(errs, ", "))
+			}
+		}
+		tolerations = append(tolerations, toleration)
+	}
+	return tolerations, nil
+}
+
+// UnmarshalNodeSelector parses the node labels separated by ; in the form of
+// key=value. The node must have all of them.
+func UnmarshalNodeSelector(s string) (map[string]string, error) {
+	nodeSelector := map[string]string{}
+	for _, l := range strings.Split(s, ";") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid node selector %v, should be key=value", l)
+		}
+		if errs := validation.IsQualifiedName(kv[0]); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid key of node selector %v: %v", l, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(kv[1]); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid value of node selector %v: %v", l, strings.Join(errs, ", "))
+		}
+		if _, ok := nodeSelector[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate key of node selector %v", l)
+		}
+		nodeSelector[kv[0]] = kv[1]
+	}
+	return nodeSelector, nil
+}
+
+// UnmarshalResourceRequirements parses the CPU and memory requests and
+// limits separated by ; in the form of key=quantity, e.g. requests.cpu=100m.
+// The keys are requests.cpu, requests.memory, limits.cpu and limits.memory.
+func UnmarshalResourceRequirements(s string) (v1.ResourceRequirements, error) {
+	requirements := v1.ResourceRequirements{}
+	for _, r := range strings.Split(s, ";") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		kv := strings.SplitN(r, "=", 2)
+		if len(kv) != 2 {
+			return v1.ResourceRequirements{}, fmt.Errorf("invalid resource requirement %v, should be key=quantity", r)
+		}
+		var resources *v1.ResourceList
+		var name v1.ResourceName
+		switch strings.TrimSpace(kv[0]) {
+		case "requests.cpu":
+			resources, name = &requirements.Requests, v1.ResourceCPU
+		case "requests.memory":
+			resources, name = &requirements.Requests, v1.ResourceMemory
+		case "limits.cpu":
+			resources, name = &requirements.Limits, v1.ResourceCPU
+		case "limits.memory":
+			resources, name = &requirements.Limits, v1.ResourceMemory
+		default:
+			return v1.ResourceRequirements{}, fmt.Errorf("invalid key of resource requirement %v, should be one of requests.cpu, requests.memory, limits.cpu and limits.memory", r)
+		}
+		quantity, err := resource.ParseQuantity(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return v1.ResourceRequirements{}, fmt.Errorf("invalid quantity of resource requirement %v: %v", r, err)
+		}
+		if quantity.Sign() <= 0 {
+			return v1.ResourceRequirements{}, fmt.Errorf("invalid quantity of resource requirement %v, should be positive", r)
+		}
+		if *resources == nil {
+			*resources = v1.ResourceList{}
+		}
+		if _, ok := (*resources)[name]; ok {
+			return v1.ResourceRequirements{}, fmt.Errorf("duplicate key of resource requirement %v", r)
+		}
+		(*resources)[name] = quantity
+	}
+	for name, request := range requirements.Requests {
+		if limit, ok := requirements.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return v1.ResourceRequirements{}, fmt.Errorf("the %v request %v is greater than the limit %v", name, request.String(), limit.String())
+		}
+	}
+	return requirements, nil
+}
+
 func ParseLabels(labels []string) (map[string]string, error) {
 	result := map[string]string{}
 	for _, label := range labels {
@@ -338,6 +606,86 @@ func CheckBackupType(backupTarget string) (string, error) {
 	return u.Scheme, nil
 }
 
+// BackupCredentialKeys are the keys of the backup credential secret passed
+// to the engine as the environment variables
+var BackupCredentialKeys = []string{
+	AWSAccessKey,
+	AWSSecretKey,
+	AWSEndPoint,
+	AWSRegion,
+	AWSVirtualHostedStyle,
+	AWSCert,
+	AWSInsecureSkipTLSVerify,
+	HTTPProxy,
+	HTTPSProxy,
+	NoProxy,
+}
+
+// BackupProxyKeys are passed to the engine invocations touching the
+// backupstore only, so the traffic of Longhorn itself isn't proxied
+var BackupProxyKeys = []string{
+	HTTPProxy,
+	HTTPSProxy,
+	NoProxy,
+}
+
+// DefaultNoProxy are the in-cluster addresses always bypassing the proxy of
+// the backup traffic
+var DefaultNoProxy = []string{
+	"localhost",
+	"127.0.0.1",
+	"0.0.0.0",
+	"::1",
+	".svc",
+	".cluster.local",
+}
+
+var awsRegionRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// ValidateBackupCredential checks the values of the backup credential secret
+// of the S3 backup target. The missing optional keys are fine
+func ValidateBackupCredential(credential map[string]string) error {
+	if credential[AWSAccessKey] == "" || credential[AWSSecretKey] == "" {
+		return fmt.Errorf("both %v and %v are required", AWSAccessKey, AWSSecretKey)
+	}
+	if endpoint := credential[AWSEndPoint]; endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %v %v", AWSEndPoint, endpoint)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid %v %v, should be like https://minio.example.com:9000", AWSEndPoint, endpoint)
+		}
+	}
+	if region := credential[AWSRegion]; region != "" && !awsRegionRegex.MatchString(region) {
+		return fmt.Errorf("invalid %v %v", AWSRegion, region)
+	}
+	for _, key := range []string{AWSVirtualHostedStyle, AWSInsecureSkipTLSVerify} {
+		if value := credential[key]; value != "" {
+			if _, err := strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid %v %v, should be true or false", key, value)
+			}
+		}
+	}
+	if cert := credential[AWSCert]; cert != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(cert)) {
+			return fmt.Errorf("invalid %v, no PEM encoded certificate found", AWSCert)
+		}
+	}
+	for _, key := range []string{HTTPProxy, HTTPSProxy} {
+		if proxy := credential[key]; proxy != "" {
+			u, err := url.Parse(proxy)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %v", key)
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid %v, should be like http://proxy.example.com:3128", key)
+			}
+		}
+	}
+	return nil
+}
+
 func ConfigBackupCredential(backupTarget string, credential map[string]string) error {
 	backupType, err := CheckBackupType(backupTarget)
 	if err != nil {
@@ -346,9 +694,18 @@ func ConfigBackupCredential(backupTarget string, credential map[string]string) e
 	if backupType == BackupStoreTypeS3 {
 		// environment variable has been set in cronjob
 		if credential != nil && credential[AWSAccessKey] != "" && credential[AWSSecretKey] != "" {
-			os.Setenv(AWSAccessKey, credential[AWSAccessKey])
-			os.Setenv(AWSSecretKey, credential[AWSSecretKey])
-			os.Setenv(AWSEndPoint, credential[AWSEndPoint])
+			// the options of the previous credential must not be left.
+			// The proxy is set per invocation by GetBackupProxyEnv
+			for _, key := range BackupCredentialKeys {
+				if isBackupProxyKey(key) {
+					continue
+				}
+				if credential[key] == "" {
+					os.Unsetenv(key)
+					continue
+				}
+				os.Setenv(key, credential[key])
+			}
 		} else if os.Getenv(AWSAccessKey) == "" || os.Getenv(AWSSecretKey) == "" {
 			return fmt.Errorf("Could not backup for %s without credential secret", backupType)
 		}
@@ -356,48 +713,98 @@ func ConfigBackupCredential(backupTarget string, credential map[string]string) e
 	return nil
 }
 
+func isBackupProxyKey(key string) bool {
+	for _, k := range BackupProxyKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBackupProxyEnv returns the proxy environment of the engine invocation
+// touching the S3 backupstore, taken from the credential or, without one,
+// from the environment set by ConfigEnvWithCredential. NO_PROXY always
+// includes the in-cluster addresses and the hosts given, e.g. of the engine
+// and the replicas the invocation talks to.
+func GetBackupProxyEnv(backupTarget string, credential map[string]string, noProxyHosts ...string) []string {
+	backupType, err := CheckBackupType(backupTarget)
+	if err != nil || backupType != BackupStoreTypeS3 {
+		return nil
+	}
+	proxy := map[string]string{}
+	for _, key := range BackupProxyKeys {
+		if credential != nil {
+			proxy[key] = credential[key]
+		} else {
+			proxy[key] = os.Getenv(key)
+		}
+	}
+	if proxy[HTTPProxy] == "" && proxy[HTTPSProxy] == "" {
+		return nil
+	}
+
+	noProxy := []string{}
+	seen := map[string]bool{}
+	hosts := append(strings.Split(proxy[NoProxy], ","), DefaultNoProxy...)
+	if host := os.Getenv("KUBERNETES_SERVICE_HOST"); host != "" {
+		hosts = append(hosts, host)
+	}
+	for _, host := range append(hosts, noProxyHosts...) {
+		host = strings.TrimSpace(host)
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		noProxy = append(noProxy, host)
+	}
+
+	env := []string{}
+	for _, key := range []string{HTTPProxy, HTTPSProxy} {
+		if proxy[key] != "" {
+			// the lower case ones take precedence in some clients
+			env = append(env, key+"="+proxy[key], strings.ToLower(key)+"="+proxy[key])
+		}
+	}
+	value := strings.Join(noProxy, ",")
+	return append(env, NoProxy+"="+value, strings.ToLower(NoProxy)+"="+value)
+}
+
 func ConfigEnvWithCredential(backupTarget string, credentialSecret string, container *v1.Container) error {
 	backupType, err := CheckBackupType(backupTarget)
 	if err != nil {
 		return err
 	}
 	if backupType == BackupStoreTypeS3 && credentialSecret != "" {
-		accessKeyEnv := v1.EnvVar{
-			Name: AWSAccessKey,
-			ValueFrom: &v1.EnvVarSource{
-				SecretKeyRef: &v1.SecretKeySelector{
-					LocalObjectReference: v1.LocalObjectReference{
-						Name: credentialSecret,
-					},
-					Key: AWSAccessKey,
-				},
-			},
-		}
-		container.Env = append(container.Env, accessKeyEnv)
-		secreKeyEnv := v1.EnvVar{
-			Name: AWSSecretKey,
-			ValueFrom: &v1.EnvVarSource{
-				SecretKeyRef: &v1.SecretKeySelector{
-					LocalObjectReference: v1.LocalObjectReference{
-						Name: credentialSecret,
-					},
-					Key: AWSSecretKey,
-				},
-			},
-		}
-		container.Env = append(container.Env, secreKeyEnv)
-		endpointEnv := v1.EnvVar{
-			Name: AWSEndPoint,
-			ValueFrom: &v1.EnvVarSource{
-				SecretKeyRef: &v1.SecretKeySelector{
-					LocalObjectReference: v1.LocalObjectReference{
-						Name: credentialSecret,
+		for _, key := range BackupCredentialKeys {
+			// only the keys are required, the options may not be in
+			// the secret
+			optional := key != AWSAccessKey && key != AWSSecretKey
+			name := key
+			if key == NoProxy {
+				// merged with the in-cluster addresses below
+				name = BackupNoProxyEnv
+			}
+			container.Env = append(container.Env, v1.EnvVar{
+				Name: name,
+				ValueFrom: &v1.EnvVarSource{
+					SecretKeyRef: &v1.SecretKeySelector{
+						LocalObjectReference: v1.LocalObjectReference{
+							Name: credentialSecret,
+						},
+						Key:      key,
+						Optional: &optional,
 					},
-					Key: AWSEndPoint,
 				},
-			},
+			})
 		}
-		container.Env = append(container.Env, endpointEnv)
+		// the reference to the variable undefined, e.g. without NO_PROXY
+		// in the secret, is left as is and matches no host
+		noProxy := append([]string{"$(" + BackupNoProxyEnv + ")", "$(KUBERNETES_SERVICE_HOST)"}, DefaultNoProxy...)
+		container.Env = append(container.Env, v1.EnvVar{
+			Name:  NoProxy,
+			Value: strings.Join(noProxy, ","),
+		})
 	}
 	return nil
 }
@@ -417,6 +824,9 @@ func GetInitiatorNSPath() string {
 func GetDiskInfo(directory string) (*DiskInfo, error) {
 	initiatorNSPath := GetInitiatorNSPath()
 	mountPath := fmt.Sprintf("--mount=%s/mnt", initiatorNSPath)
+	if _, err := Execute("nsenter", mountPath, "test", "-d", directory); err != nil {
+		return nil, fmt.Errorf("path %v is not a directory", directory)
+	}
 	output, err := Execute("nsenter", mountPath, "stat", "-fc", "{\"path\":\"%n\",\"fsid\":\"%i\",\"type\":\"%T\",\"freeBlock\":%f,\"totalBlock\":%b,\"blockSize\":%S}", directory)
 	if err != nil {
 		return nil, err
@@ -431,10 +841,237 @@ func GetDiskInfo(directory string) (*DiskInfo, error) {
 
 	diskInfo.StorageMaximum = diskInfo.TotalBlock * diskInfo.BlockSize
 	diskInfo.StorageAvailable = diskInfo.FreeBlock * diskInfo.BlockSize
+	// access(2) fails with EROFS on a read-only file system even for root
+	if _, err := Execute("nsenter", mountPath, "test", "-w", directory); err != nil {
+		diskInfo.ReadOnly = true
+	}
 
 	return diskInfo, nil
 }
 
+// NodeEnvironment is the result of checking the host for the packages and
+// kernel modules required by Longhorn
+type NodeEnvironment struct {
+	MissingBinaries []string
+	MissingModules  []string
+	// ISCSIDError is set if the iSCSI daemon cannot be reached
+	ISCSIDError string
+}
+
+var (
+	requiredBinaries      = []string{"iscsiadm", "mkfs.ext4", "mkfs.xfs"}
+	requiredKernelModules = []string{"iscsi_tcp"}
+)
+
+func CheckNodeEnvironment() *NodeEnvironment {
+	initiatorNSPath := GetInitiatorNSPath()
+	mountPath := fmt.Sprintf("--mount=%s/mnt", initiatorNSPath)
+	netPath := fmt.Sprintf("--net=%s/net", initiatorNSPath)
+
+	env := &NodeEnvironment{}
+	iscsiadmFound := true
+	for _, binary := range requiredBinaries {
+		if _, err := Execute("nsenter", mountPath, "sh", "-c", "command -v "+binary); err != nil {
+			env.MissingBinaries = append(env.MissingBinaries, binary)
+			if binary == "iscsiadm" {
+				iscsiadmFound = false
+			}
+		}
+	}
+	for _, module := range requiredKernelModules {
+		// succeeds if the module is loaded, built in, or can be loaded
+		if _, err := Execute("nsenter", mountPath, "modprobe", "--dry-run", module); err != nil {
+			env.MissingModules = append(env.MissingModules, module)
+		}
+	}
+	if iscsiadmFound {
+		// iscsiadm fails with "No active sessions" if the daemon is
+		// reachable but there is no session yet
+		if _, err := Execute("nsenter", mountPath, netPath, "iscsiadm", "-m", "session"); err != nil && !strings.Contains(err.Error(), "No active sessions") {
+			env.ISCSIDError = err.Error()
+		}
+	}
+	return env
+}
+
+// CheckMountPropagation mounts a tmpfs under the directory shared with the
+// host in the container, and checks whether the mount is propagated to the
+// host mount namespace
+func CheckMountPropagation(directory string) error {
+	probeDir, err := ioutil.TempDir(directory, "mount-propagation-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(probeDir)
+	if _, err := Execute("mount", "-t", "tmpfs", "tmpfs", probeDir); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := Execute("umount", probeDir); err != nil {
+			logrus.Warnf("Failed to unmount the mount propagation probe %v: %v", probeDir, err)
+		}
+	}()
+
+	initiatorNSPath := GetInitiatorNSPath()
+	mountPath := fmt.Sprintf("--mount=%s/mnt", initiatorNSPath)
+	// the mount point is the fifth field of mountinfo
+	if _, err := Execute("nsenter", mountPath, "grep", "-q", " "+probeDir+" ", "/proc/self/mountinfo"); err != nil {
+		return fmt.Errorf("mount %v is not visible on the host", probeDir)
+	}
+	return nil
+}
+
+// virtualFilesystems are the file system types reported by `stat -f` which
+// are not backed by a persistent storage device
+var virtualFilesystems = map[string]struct{}{
+	"tmpfs":      {},
+	"ramfs":      {},
+	"proc":       {},
+	"sysfs":      {},
+	"devtmpfs":   {},
+	"devpts":     {},
+	"cgroupfs":   {},
+	"cgroup2fs":  {},
+	"debugfs":    {},
+	"securityfs": {},
+	"overlayfs":  {},
+	"squashfs":   {},
+}
+
+func IsVirtualFilesystem(fsType string) bool {
+	_, ok := virtualFilesystems[fsType]
+	return ok
+}
+
+// IsPathNested returns true if one of the paths is the same as or inside the
+// other one
+func IsPathNested(path1, path2 string) bool {
+	isInside := func(parent, child string) bool {
+		rel, err := filepath.Rel(parent, child)
+		if err != nil {
+			return false
+		}
+		return rel != ".." && !strings.HasPrefix(rel, "../")
+	}
+	path1 = filepath.Clean(path1)
+	path2 = filepath.Clean(path2)
+	return isInside(path1, path2) || isInside(path2, path1)
+}
+
+// GetDiskConfig returns nil if the disk config file doesn't exist in the
+// directory on the host
+func GetDiskConfig(directory string) (*DiskConfig, error) {
+	initiatorNSPath := GetInitiatorNSPath()
+	mountPath := fmt.Sprintf("--mount=%s/mnt", initiatorNSPath)
+	filePath := filepath.Join(directory, DiskConfigFile)
+	output, err := Execute("nsenter", mountPath, "sh", "-c", fmt.Sprintf("if [ -f %s ]; then cat %s; fi", filePath, filePath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read disk config file %v", filePath)
+	}
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return nil, nil
+	}
+
+	cfg := &DiskConfig{}
+	if err := json.Unmarshal([]byte(output), cfg); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse disk config file %v: %v", filePath, output)
+	}
+	return cfg, nil
+}
+
+func GenerateDiskConfig(directory string) (*DiskConfig, error) {
+	cfg := &DiskConfig{
+		DiskUUID: UUID(),
+	}
+	encoded, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	initiatorNSPath := GetInitiatorNSPath()
+	mountPath := fmt.Sprintf("--mount=%s/mnt", initiatorNSPath)
+	filePath := filepath.Join(directory, DiskConfigFile)
+	if _, err := Execute("nsenter", mountPath, "sh", "-c", fmt.Sprintf("printf '%s' > %s", encoded, filePath)); err != nil {
+		return nil, errors.Wrapf(err, "cannot write disk config file %v", filePath)
+	}
+	return cfg, nil
+}
+
+type ReplicaDirectory struct {
+	Name             string
+	Size             int64
+	ModificationTime string
+}
+
+// ListReplicaDirectories returns the directories under `replicas/` of the
+// disk on the host, along with their sizes and modification times
+func ListReplicaDirectories(diskPath string) ([]ReplicaDirectory, error) {
+	initiatorNSPath := GetInitiatorNSPath()
+	mountPath := fmt.Sprintf("--mount=%s/mnt", initiatorNSPath)
+	replicasPath := filepath.Join(diskPath, "replicas")
+	script := fmt.Sprintf("if [ -d %s ]; then for d in %s/*/; do if [ -d \"$d\" ]; then echo \"$(basename \"$d\") $(du -sb \"$d\" | cut -f1) $(stat -c %%Y \"$d\")\"; fi; done; fi", replicasPath, replicasPath)
+	output, err := Execute("nsenter", mountPath, "sh", "-c", script)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot list replica directories in %v", replicasPath)
+	}
+
+	dirs := []ReplicaDirectory{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid replica directory info %v in %v", line, replicasPath)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid size of replica directory %v", fields[0])
+		}
+		mtime, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid modification time of replica directory %v", fields[0])
+		}
+		dirs = append(dirs, ReplicaDirectory{
+			Name:             fields[0],
+			Size:             size,
+			ModificationTime: time.Unix(mtime, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	return dirs, nil
+}
+
+func DeleteReplicaDirectory(diskPath, name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid replica directory name %v", name)
+	}
+	initiatorNSPath := GetInitiatorNSPath()
+	mountPath := fmt.Sprintf("--mount=%s/mnt", initiatorNSPath)
+	dirPath := filepath.Join(diskPath, "replicas", name)
+	if _, err := Execute("nsenter", mountPath, "rm", "-rf", dirPath); err != nil {
+		return errors.Wrapf(err, "cannot delete replica directory %v", dirPath)
+	}
+	return nil
+}
+
+// ProbeDiskHealth writes, fsyncs, reads back and deletes a small canary file
+// on the disk on the host, so the disk failing underneath can be detected
+// before the replicas on it error out
+func ProbeDiskHealth(diskPath string) error {
+	initiatorNSPath := GetInitiatorNSPath()
+	mountPath := fmt.Sprintf("--mount=%s/mnt", initiatorNSPath)
+	probeDir := filepath.Join(diskPath, DiskHealthProbeDirectory)
+	probeFile := filepath.Join(probeDir, "canary")
+	content := UUID()
+	script := fmt.Sprintf("mkdir -p %s && printf '%s' | dd of=%s conv=fsync 2>/dev/null && [ \"$(cat %s)\" = '%s' ] && rm -f %s",
+		probeDir, content, probeFile, probeFile, content, probeFile)
+	if _, err := Execute("nsenter", mountPath, "sh", "-c", script); err != nil {
+		return errors.Wrapf(err, "disk health probe failed on %v", diskPath)
+	}
+	return nil
+}
+
 func RetryOnConflictCause(fn func() (interface{}, error)) (obj interface{}, err error) {
 	for i := 0; i < ConflictRetryCounts; i++ {
 		obj, err = fn()
@@ -456,3 +1093,52 @@ func RunAsync(wg *sync.WaitGroup, f func()) {
 		f()
 	}()
 }
+
+// WaitGroupWithTimeout waits for the wait group, and returns false if it
+// isn't done within the timeout
+func WaitGroupWithTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// RunConcurrent runs the functions concurrently and waits for all of them to
+// finish, even if some fail. The errors are aggregated in the order of the
+// functions rather than the order they failed in, and nil is returned if all
+// succeed.
+func RunConcurrent(funcs ...func() error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(funcs))
+	for i, f := range funcs {
+		i, f := i, f
+		RunAsync(&wg, func() {
+			errs[i] = f()
+		})
+	}
+	wg.Wait()
+	return utilerrors.NewAggregate(errs)
+}
+
+// IsNewerVersion returns true if the latest version is newer than the
+// current one. The versions are semantic versions with an optional leading
+// v. A version failing to parse, e.g. the one of a dev build, is never
+// older nor newer.
+func IsNewerVersion(current, latest string) bool {
+	currentVersion, err := version.ParseSemantic(current)
+	if err != nil {
+		return false
+	}
+	latestVersion, err := version.ParseSemantic(latest)
+	if err != nil {
+		return false
+	}
+	return currentVersion.LessThan(latestVersion)
+}
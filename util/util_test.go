@@ -1,8 +1,25 @@
 package util
 
 import (
-	"github.com/stretchr/testify/require"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 )
 
 func TestConvertSize(t *testing.T) {
@@ -51,3 +68,389 @@ func TestReplicaName(t *testing.T) {
 	assert.Equal("replica-XX", ReplicaName("tcp://replica-XX.rancher.internal:9502", "tt"))
 	assert.Equal("replica-XX", ReplicaName("tcp://replica-XX.volume-tt:9502", "tt"))
 }
+
+func TestIsPathNested(t *testing.T) {
+	assert := require.New(t)
+
+	assert.True(IsPathNested("/var/lib/longhorn", "/var/lib/longhorn"))
+	assert.True(IsPathNested("/var/lib/longhorn", "/var/lib/longhorn/"))
+	assert.True(IsPathNested("/var/lib/longhorn", "/var/lib/longhorn/disk1"))
+	assert.True(IsPathNested("/var/lib/longhorn/disk1", "/var/lib/longhorn"))
+	assert.False(IsPathNested("/var/lib/longhorn", "/var/lib/longhorn-disk1"))
+	assert.False(IsPathNested("/mnt/disk1", "/mnt/disk2"))
+	assert.True(IsPathNested("/mnt", "/mnt/..disk1"))
+}
+
+func TestValidateTags(t *testing.T) {
+	assert := require.New(t)
+
+	tags, err := ValidateTags([]string{"ssd", "SSD", "fast", "ssd"})
+	assert.Nil(err)
+	assert.Equal([]string{"SSD", "fast", "ssd"}, tags)
+
+	_, err = ValidateTags([]string{"-ssd"})
+	assert.NotNil(err)
+	_, err = ValidateTags([]string{"ssd fast"})
+	assert.NotNil(err)
+	_, err = ValidateTags([]string{strings.Repeat("a", MaxTagLength+1)})
+	assert.NotNil(err)
+
+	tooManyTags := []string{}
+	for i := 0; i <= MaxTagCount; i++ {
+		tooManyTags = append(tooManyTags, fmt.Sprintf("tag%v", i))
+	}
+	_, err = ValidateTags(tooManyTags)
+	assert.NotNil(err)
+}
+
+func TestValidateVolumeName(t *testing.T) {
+	assert := require.New(t)
+
+	for _, name := range []string{"vol", "vol-1", "vol_1.a", "1vol", strings.Repeat("a", VolumeNameMaximumLength)} {
+		assert.Nil(ValidateVolumeName(name), name)
+	}
+	for _, name := range []string{"", "v", "-vol", ".vol", "vol/1", "vol 1", "Vol!", strings.Repeat("a", VolumeNameMaximumLength+1)} {
+		assert.NotNil(ValidateVolumeName(name), name)
+	}
+}
+
+func TestValidateVolumeSize(t *testing.T) {
+	assert := require.New(t)
+
+	size, err := ValidateVolumeSize("1Gi")
+	assert.Nil(err)
+	assert.Equal(int64(1024*1024*1024), size)
+
+	size, err = ValidateVolumeSize("4096")
+	assert.Nil(err)
+	assert.Equal(int64(4096), size)
+
+	for _, size := range []string{"", "0", "0Gi", "-1Gi", "1Gx", "abc"} {
+		_, err := ValidateVolumeSize(size)
+		assert.NotNil(err, size)
+	}
+}
+
+func TestGetBackupVolumeName(t *testing.T) {
+	assert := require.New(t)
+
+	backupURL := "s3://backupbucket@us-east-1/backupstore?backup=backup-1234&volume=vol-1"
+	volumeName, err := GetBackupVolumeName(backupURL)
+	assert.Nil(err)
+	assert.Equal("vol-1", volumeName)
+	backupName, err := GetBackupID(backupURL)
+	assert.Nil(err)
+	assert.Equal("backup-1234", backupName)
+
+	for _, backupURL := range []string{"", "s3://backupbucket@us-east-1/backupstore", "nfs://server:/path?backup=backup-1234"} {
+		_, err := GetBackupVolumeName(backupURL)
+		assert.NotNil(err, backupURL)
+	}
+}
+
+func newTestCACert(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestValidateBackupCredential(t *testing.T) {
+	assert := require.New(t)
+
+	valid := map[string]string{
+		AWSAccessKey:             "minio",
+		AWSSecretKey:             "minio123",
+		AWSEndPoint:              "https://minio.longhorn-system:9000",
+		AWSRegion:                "us-east-1",
+		AWSVirtualHostedStyle:    "false",
+		AWSCert:                  newTestCACert(t),
+		AWSInsecureSkipTLSVerify: "true",
+		HTTPProxy:                "http://proxy.example.com:3128",
+		HTTPSProxy:               "http://proxy.example.com:3128",
+		NoProxy:                  "minio.example.com",
+	}
+	assert.Nil(ValidateBackupCredential(valid))
+	// the options are optional
+	assert.Nil(ValidateBackupCredential(map[string]string{
+		AWSAccessKey: "minio",
+		AWSSecretKey: "minio123",
+	}))
+
+	invalid := map[string]string{
+		AWSAccessKey:             "",
+		AWSEndPoint:              "minio.longhorn-system:9000",
+		AWSRegion:                "US East",
+		AWSVirtualHostedStyle:    "path",
+		AWSCert:                  "not a certificate",
+		AWSInsecureSkipTLSVerify: "yes please",
+		HTTPProxy:                "proxy.example.com:3128",
+		HTTPSProxy:               "socks5://proxy.example.com:1080",
+	}
+	for key, value := range invalid {
+		credential := map[string]string{}
+		for k, v := range valid {
+			credential[k] = v
+		}
+		credential[key] = value
+		assert.NotNil(ValidateBackupCredential(credential), key)
+	}
+}
+
+func TestConfigBackupCredential(t *testing.T) {
+	assert := require.New(t)
+
+	for _, key := range BackupCredentialKeys {
+		defer os.Unsetenv(key)
+	}
+
+	assert.Nil(ConfigBackupCredential("s3://backupbucket@us-east-1/", map[string]string{
+		AWSAccessKey:          "minio",
+		AWSSecretKey:          "minio123",
+		AWSEndPoint:           "https://minio:9000",
+		AWSVirtualHostedStyle: "true",
+	}))
+	assert.Equal("https://minio:9000", os.Getenv(AWSEndPoint))
+	assert.Equal("true", os.Getenv(AWSVirtualHostedStyle))
+
+	// the options of the previous credential are cleared
+	assert.Nil(ConfigBackupCredential("s3://backupbucket@us-east-1/", map[string]string{
+		AWSAccessKey: "minio",
+		AWSSecretKey: "minio123",
+	}))
+	_, ok := os.LookupEnv(AWSEndPoint)
+	assert.False(ok)
+	_, ok = os.LookupEnv(AWSVirtualHostedStyle)
+	assert.False(ok)
+}
+
+func TestConfigEnvWithCredential(t *testing.T) {
+	assert := require.New(t)
+
+	container := &v1.Container{}
+	assert.Nil(ConfigEnvWithCredential("nfs://longhorn-test-nfs-svc:/opt/backupstore", "secret", container))
+	assert.Len(container.Env, 0)
+
+	assert.Nil(ConfigEnvWithCredential("s3://backupbucket@us-east-1/", "secret", container))
+	assert.Len(container.Env, len(BackupCredentialKeys)+1)
+	for _, env := range container.Env[:len(BackupCredentialKeys)] {
+		ref := env.ValueFrom.SecretKeyRef
+		assert.Equal("secret", ref.Name)
+		if ref.Key == NoProxy {
+			assert.Equal(BackupNoProxyEnv, env.Name)
+		} else {
+			assert.Equal(env.Name, ref.Key)
+		}
+		required := env.Name == AWSAccessKey || env.Name == AWSSecretKey
+		assert.Equal(!required, *ref.Optional, env.Name)
+	}
+	noProxy := container.Env[len(BackupCredentialKeys)]
+	assert.Equal(NoProxy, noProxy.Name)
+	assert.Equal("$(LONGHORN_BACKUP_NO_PROXY),$(KUBERNETES_SERVICE_HOST),localhost,127.0.0.1,0.0.0.0,::1,.svc,.cluster.local", noProxy.Value)
+}
+
+func TestGetBackupProxyEnv(t *testing.T) {
+	assert := require.New(t)
+
+	defer os.Setenv("KUBERNETES_SERVICE_HOST", os.Getenv("KUBERNETES_SERVICE_HOST"))
+	os.Setenv("KUBERNETES_SERVICE_HOST", "10.43.0.1")
+
+	credential := map[string]string{
+		AWSAccessKey: "minio",
+		AWSSecretKey: "minio123",
+	}
+	assert.Len(GetBackupProxyEnv("s3://backupbucket@us-east-1/", credential), 0)
+
+	credential[HTTPSProxy] = "http://proxy.example.com:3128"
+	credential[NoProxy] = "minio.example.com, localhost"
+	assert.Len(GetBackupProxyEnv("nfs://longhorn-test-nfs-svc:/opt/backupstore", credential), 0)
+	noProxy := "minio.example.com,localhost,127.0.0.1,0.0.0.0,::1,.svc,.cluster.local,10.43.0.1,10.42.0.5"
+	assert.Equal([]string{
+		"HTTPS_PROXY=http://proxy.example.com:3128",
+		"https_proxy=http://proxy.example.com:3128",
+		"NO_PROXY=" + noProxy,
+		"no_proxy=" + noProxy,
+	}, GetBackupProxyEnv("s3://backupbucket@us-east-1/", credential, "10.42.0.5", "127.0.0.1"))
+
+	// without a credential, the proxy is taken from the environment
+	for _, key := range BackupProxyKeys {
+		defer os.Unsetenv(key)
+	}
+	os.Setenv(HTTPProxy, "http://proxy.example.com:3128")
+	env := GetBackupProxyEnv("s3://backupbucket@us-east-1/", nil)
+	assert.Contains(env, "HTTP_PROXY=http://proxy.example.com:3128")
+	assert.Contains(env, "NO_PROXY=localhost,127.0.0.1,0.0.0.0,::1,.svc,.cluster.local,10.43.0.1")
+}
+
+func TestUnmarshalTolerations(t *testing.T) {
+	assert := require.New(t)
+
+	tolerations, err := UnmarshalTolerations("")
+	assert.Nil(err)
+	assert.Len(tolerations, 0)
+
+	tolerations, err = UnmarshalTolerations("key1=value1:NoSchedule; node-role.kubernetes.io/master:NoExecute;:PreferNoSchedule;")
+	assert.Nil(err)
+	assert.Equal([]v1.Toleration{
+		{Key: "key1", Operator: v1.TolerationOpEqual, Value: "value1", Effect: v1.TaintEffectNoSchedule},
+		{Key: "node-role.kubernetes.io/master", Operator: v1.TolerationOpExists, Effect: v1.TaintEffectNoExecute},
+		{Operator: v1.TolerationOpExists, Effect: v1.TaintEffectPreferNoSchedule},
+	}, tolerations)
+
+	for _, invalid := range []string{
+		"key1=value1",
+		"key1=value1:NoEvict",
+		"=value1:NoSchedule",
+		"key 1:NoSchedule",
+		"key1=value 1:NoSchedule",
+		"key1:NoSchedule:NoExecute",
+	} {
+		_, err := UnmarshalTolerations(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func TestUnmarshalNodeSelector(t *testing.T) {
+	assert := require.New(t)
+
+	nodeSelector, err := UnmarshalNodeSelector("")
+	assert.Nil(err)
+	assert.Len(nodeSelector, 0)
+
+	nodeSelector, err = UnmarshalNodeSelector("storage=longhorn; failure-domain.beta.kubernetes.io/zone=us-east-1a;")
+	assert.Nil(err)
+	assert.Equal(map[string]string{
+		"storage": "longhorn",
+		"failure-domain.beta.kubernetes.io/zone": "us-east-1a",
+	}, nodeSelector)
+
+	for _, invalid := range []string{
+		"storage",
+		"storage:longhorn",
+		"=longhorn",
+		"storage class=longhorn",
+		"storage=long horn",
+		"storage=longhorn; storage=ssd",
+	} {
+		_, err := UnmarshalNodeSelector(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func TestUnmarshalResourceRequirements(t *testing.T) {
+	assert := require.New(t)
+
+	requirements, err := UnmarshalResourceRequirements("")
+	assert.Nil(err)
+	assert.Len(requirements.Requests, 0)
+	assert.Len(requirements.Limits, 0)
+
+	requirements, err = UnmarshalResourceRequirements("requests.cpu=100m; requests.memory=64Mi; limits.memory=128Mi;")
+	assert.Nil(err)
+	assert.Len(requirements.Requests, 2)
+	assert.Len(requirements.Limits, 1)
+	assert.Equal("100m", requirements.Requests.Cpu().String())
+	assert.Equal("64Mi", requirements.Requests.Memory().String())
+	assert.Equal("128Mi", requirements.Limits.Memory().String())
+
+	for _, invalid := range []string{
+		"requests.cpu",
+		"requests.storage=1Gi",
+		"cpu=100m",
+		"requests.cpu=100x",
+		"requests.memory=0",
+		"requests.memory=-64Mi",
+		"requests.cpu=100m; requests.cpu=200m",
+		"requests.memory=256Mi; limits.memory=128Mi",
+	} {
+		_, err := UnmarshalResourceRequirements(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func TestIsNewerVersion(t *testing.T) {
+	assert := require.New(t)
+
+	testCases := map[string]struct {
+		current string
+		latest  string
+		newer   bool
+	}{
+		"newer patch":    {"0.2.0", "v0.2.1", true},
+		"newer minor":    {"v0.2.1", "v0.3.0", true},
+		"same":           {"v0.3.0", "v0.3.0", false},
+		"older":          {"v0.3.0", "v0.2.1", false},
+		"release of rc":  {"v0.3.0-rc1", "v0.3.0", true},
+		"dev build":      {"dev", "v0.3.0", false},
+		"unknown latest": {"v0.3.0", "", false},
+	}
+	for name, tc := range testCases {
+		assert.Equal(tc.newer, IsNewerVersion(tc.current, tc.latest), name)
+	}
+}
+
+func TestRunConcurrent(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Nil(RunConcurrent())
+	assert.Nil(RunConcurrent(func() error { return nil }, func() error { return nil }))
+
+	// all functions run even if the early ones fail, and the errors are in
+	// the order of the functions rather than the order they failed in
+	var count int32
+	err := RunConcurrent(
+		func() error {
+			atomic.AddInt32(&count, 1)
+			time.Sleep(50 * time.Millisecond)
+			return fmt.Errorf("first")
+		},
+		func() error {
+			atomic.AddInt32(&count, 1)
+			return fmt.Errorf("second")
+		},
+		func() error {
+			atomic.AddInt32(&count, 1)
+			return nil
+		},
+		func() error {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&count, 1)
+			return fmt.Errorf("fourth")
+		},
+	)
+	assert.Equal(int32(4), atomic.LoadInt32(&count))
+	assert.NotNil(err)
+	agg, ok := err.(utilerrors.Aggregate)
+	assert.True(ok)
+	assert.Len(agg.Errors(), 3)
+	assert.EqualError(agg.Errors()[0], "first")
+	assert.EqualError(agg.Errors()[1], "second")
+	assert.EqualError(agg.Errors()[2], "fourth")
+	assert.EqualError(err, "[first, second, fourth]")
+}
+
+func TestWaitGroupWithTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	var wg sync.WaitGroup
+	assert.True(WaitGroupWithTimeout(&wg, time.Millisecond))
+
+	release := make(chan struct{})
+	RunAsync(&wg, func() { <-release })
+	assert.False(WaitGroupWithTimeout(&wg, 10*time.Millisecond))
+	close(release)
+	assert.True(WaitGroupWithTimeout(&wg, time.Second))
+}
@@ -0,0 +1,47 @@
+package webhook
+
+import (
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	apitypes "k8s.io/apimachinery/pkg/types"
+)
+
+// The types of admission.k8s.io/v1beta1 the webhook exchanges with the API
+// server. Only the fields used by the webhook are kept.
+
+type Operation string
+
+const (
+	OperationCreate = Operation("CREATE")
+	OperationUpdate = Operation("UPDATE")
+	OperationDelete = Operation("DELETE")
+)
+
+type AdmissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Request  *AdmissionRequest  `json:"request,omitempty"`
+	Response *AdmissionResponse `json:"response,omitempty"`
+}
+
+type AdmissionRequest struct {
+	UID       apitypes.UID                `json:"uid"`
+	Kind      metav1.GroupVersionKind     `json:"kind"`
+	Resource  metav1.GroupVersionResource `json:"resource"`
+	Name      string                      `json:"name,omitempty"`
+	Namespace string                      `json:"namespace,omitempty"`
+	Operation Operation                   `json:"operation"`
+	UserInfo  authenticationv1.UserInfo   `json:"userInfo"`
+	// Object is empty for the deletion, and OldObject is empty for the
+	// creation. The API servers before 1.15 don't send OldObject for the
+	// deletion either.
+	Object    runtime.RawExtension `json:"object,omitempty"`
+	OldObject runtime.RawExtension `json:"oldObject,omitempty"`
+}
+
+type AdmissionResponse struct {
+	UID     apitypes.UID   `json:"uid"`
+	Allowed bool           `json:"allowed"`
+	Result  *metav1.Status `json:"status,omitempty"`
+}
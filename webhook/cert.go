@@ -0,0 +1,176 @@
+package webhook
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/cert"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+const (
+	secretKeyCACert = "ca.crt"
+	secretKeyCAKey  = "ca.key"
+
+	// the serving certificate is valid for a year, and renewed a month
+	// before it expires. The CA is valid for 10 years and kept on the
+	// renewal, so the API server keeps trusting the managers not having
+	// picked up the renewed certificate yet
+	certRenewBefore = 30 * 24 * time.Hour
+)
+
+// webhookCert is the serving certificate of the webhook, and the CA the API
+// server verifies it with
+type webhookCert struct {
+	cert     tls.Certificate
+	caBundle []byte
+	notAfter time.Time
+}
+
+// ensureCert returns the certificate from the secret shared by the managers,
+// created or renewed if needed. The first manager creating the secret wins,
+// the others pick it up.
+func ensureCert(ds *datastore.DataStore, namespace string) (*webhookCert, error) {
+	secret, err := ds.GetSecret(types.AdmissionWebhookTLSSecretName)
+	if err != nil && !datastore.ErrorIsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		wc, err := parseCertSecret(secret)
+		if err != nil {
+			logrus.Warnf("Regenerating the invalid certificate of the admission webhook: %v", err)
+		} else if time.Until(wc.notAfter) > certRenewBefore {
+			return wc, nil
+		} else {
+			logrus.Infof("Renewing the certificate of the admission webhook expiring at %v", wc.notAfter)
+		}
+		if err := fillCertSecret(secret, namespace); err != nil {
+			return nil, err
+		}
+		if secret, err = ds.UpdateSecret(secret); err != nil {
+			if apierrors.IsConflict(err) {
+				return nil, fmt.Errorf("the certificate of the admission webhook is being renewed by another manager, retry later")
+			}
+			return nil, err
+		}
+		return parseCertSecret(secret)
+	}
+
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: types.AdmissionWebhookTLSSecretName,
+		},
+		Type: corev1.SecretTypeTLS,
+	}
+	if err := fillCertSecret(secret, namespace); err != nil {
+		return nil, err
+	}
+	created, err := ds.CreateSecret(secret)
+	if err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return nil, err
+		}
+		if created, err = ds.GetSecret(types.AdmissionWebhookTLSSecretName); err != nil {
+			return nil, err
+		}
+	}
+	return parseCertSecret(created)
+}
+
+// fillCertSecret generates the serving certificate for the webhook service,
+// signed by the CA in the secret if it's still valid, or by a new one
+func fillCertSecret(secret *corev1.Secret, namespace string) error {
+	caCert, caKey := parseCA(secret)
+	if caCert == nil {
+		var err error
+		if caKey, err = cert.NewPrivateKey(); err != nil {
+			return errors.Wrap(err, "cannot generate the CA key of the admission webhook")
+		}
+		if caCert, err = cert.NewSelfSignedCACert(cert.Config{CommonName: "longhorn-admission-webhook-ca"}, caKey); err != nil {
+			return errors.Wrap(err, "cannot generate the CA certificate of the admission webhook")
+		}
+	}
+	key, err := cert.NewPrivateKey()
+	if err != nil {
+		return errors.Wrap(err, "cannot generate the key of the admission webhook")
+	}
+	serviceName := types.AdmissionWebhookServiceName + "." + namespace + ".svc"
+	servingCert, err := cert.NewSignedCert(cert.Config{
+		CommonName: serviceName,
+		AltNames: cert.AltNames{
+			DNSNames: []string{
+				types.AdmissionWebhookServiceName,
+				types.AdmissionWebhookServiceName + "." + namespace,
+				serviceName,
+			},
+		},
+		Usages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, key, caCert, caKey)
+	if err != nil {
+		return errors.Wrap(err, "cannot generate the certificate of the admission webhook")
+	}
+	secret.Data = map[string][]byte{
+		corev1.TLSCertKey:       cert.EncodeCertPEM(servingCert),
+		corev1.TLSPrivateKeyKey: cert.EncodePrivateKeyPEM(key),
+		secretKeyCACert:         cert.EncodeCertPEM(caCert),
+		secretKeyCAKey:          cert.EncodePrivateKeyPEM(caKey),
+	}
+	return nil
+}
+
+// parseCA returns the CA in the secret, or nil if it's missing, invalid or
+// expiring
+func parseCA(secret *corev1.Secret) (*x509.Certificate, *rsa.PrivateKey) {
+	certs, err := cert.ParseCertsPEM(secret.Data[secretKeyCACert])
+	if err != nil || len(certs) != 1 {
+		return nil, nil
+	}
+	key, err := cert.ParsePrivateKeyPEM(secret.Data[secretKeyCAKey])
+	if err != nil {
+		return nil, nil
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok || time.Until(certs[0].NotAfter) <= certRenewBefore {
+		return nil, nil
+	}
+	return certs[0], rsaKey
+}
+
+func parseCertSecret(secret *corev1.Secret) (*webhookCert, error) {
+	tlsCert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid certificate in secret %v", secret.Name)
+	}
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid certificate in secret %v", secret.Name)
+	}
+	caBundle := secret.Data[secretKeyCACert]
+	caCerts, err := cert.ParseCertsPEM(caBundle)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid CA certificate in secret %v", secret.Name)
+	}
+	// the certificate cannot be verified once the CA expires
+	notAfter := leaf.NotAfter
+	for _, caCert := range caCerts {
+		if caCert.NotAfter.Before(notAfter) {
+			notAfter = caCert.NotAfter
+		}
+	}
+	return &webhookCert{
+		cert:     tlsCert,
+		caBundle: caBundle,
+		notAfter: notAfter,
+	}, nil
+}
@@ -0,0 +1,126 @@
+package webhook
+
+import (
+	"reflect"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	webhookName = "validator.longhorn.rancher.io"
+	webhookPath = "/v1/validate"
+)
+
+// desiredConfiguration returns the configuration sending the changes of the
+// Longhorn objects to the webhook service. It's owned by the Longhorn
+// namespace, so it's cleaned up along with the namespace.
+func desiredConfiguration(namespace *corev1.Namespace, caBundle []byte, failurePolicy string) *admissionregistrationv1beta1.ValidatingWebhookConfiguration {
+	path := webhookPath
+	policy := admissionregistrationv1beta1.FailurePolicyType(failurePolicy)
+	sideEffects := admissionregistrationv1beta1.SideEffectClassNone
+	rule := func(resource string, operations ...admissionregistrationv1beta1.OperationType) admissionregistrationv1beta1.RuleWithOperations {
+		return admissionregistrationv1beta1.RuleWithOperations{
+			Operations: operations,
+			Rule: admissionregistrationv1beta1.Rule{
+				APIGroups:   []string{longhorn.SchemeGroupVersion.Group},
+				APIVersions: []string{longhorn.SchemeGroupVersion.Version},
+				Resources:   []string{resource},
+			},
+		}
+	}
+	return &admissionregistrationv1beta1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: types.AdmissionWebhookConfigurationName,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "Namespace",
+					Name:       namespace.Name,
+					UID:        namespace.UID,
+				},
+			},
+		},
+		Webhooks: []admissionregistrationv1beta1.Webhook{
+			{
+				Name: webhookName,
+				ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+					Service: &admissionregistrationv1beta1.ServiceReference{
+						Namespace: namespace.Name,
+						Name:      types.AdmissionWebhookServiceName,
+						Path:      &path,
+					},
+					CABundle: caBundle,
+				},
+				// the status subresources aren't matched, so the
+				// status updates by the controllers skip the webhook
+				Rules: []admissionregistrationv1beta1.RuleWithOperations{
+					rule(resourceVolumes, admissionregistrationv1beta1.Create, admissionregistrationv1beta1.Update),
+					rule(resourceEngineImages, admissionregistrationv1beta1.Create, admissionregistrationv1beta1.Delete),
+					rule(resourceNodes, admissionregistrationv1beta1.Delete),
+				},
+				FailurePolicy: &policy,
+				SideEffects:   &sideEffects,
+			},
+		},
+	}
+}
+
+// syncConfiguration creates the configuration or updates it if it drifted.
+// The managers may update it at the same time, the one conflicted leaves it
+// to the others since they update it the same way.
+func syncConfiguration(ds *datastore.DataStore, desired *admissionregistrationv1beta1.ValidatingWebhookConfiguration) error {
+	existing, err := ds.GetValidatingWebhookConfiguration(desired.Name)
+	if err != nil {
+		if !datastore.ErrorIsNotFound(err) {
+			return err
+		}
+		if _, err := ds.CreateValidatingWebhookConfiguration(desired); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "fail to create admission webhook configuration %v", desired.Name)
+		}
+		logrus.Infof("Created admission webhook configuration %v", desired.Name)
+		return nil
+	}
+	if !isConfigurationDrifted(existing, desired) {
+		return nil
+	}
+	existing.OwnerReferences = desired.OwnerReferences
+	existing.Webhooks = desired.Webhooks
+	if _, err := ds.UpdateValidatingWebhookConfiguration(existing); err != nil {
+		if apierrors.IsConflict(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "fail to update admission webhook configuration %v", desired.Name)
+	}
+	logrus.Infof("Updated admission webhook configuration %v", desired.Name)
+	return nil
+}
+
+// isConfigurationDrifted compares the fields set by the manager, not the ones
+// defaulted by Kubernetes
+func isConfigurationDrifted(existing, desired *admissionregistrationv1beta1.ValidatingWebhookConfiguration) bool {
+	if !reflect.DeepEqual(existing.OwnerReferences, desired.OwnerReferences) || len(existing.Webhooks) != len(desired.Webhooks) {
+		return true
+	}
+	for i := range desired.Webhooks {
+		e, d := existing.Webhooks[i], desired.Webhooks[i]
+		if e.Name != d.Name || !reflect.DeepEqual(e.ClientConfig, d.ClientConfig) ||
+			!reflect.DeepEqual(e.Rules, d.Rules) || !reflect.DeepEqual(e.FailurePolicy, d.FailurePolicy) {
+			return true
+		}
+	}
+	return false
+}
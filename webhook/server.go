@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+)
+
+var (
+	// the certificate is renewed and the configuration is fixed up this
+	// often, besides the changes of the failure policy setting
+	ReconcileInterval = time.Hour
+
+	// the garbage collector and the namespace controller clean up after
+	// the deleted owners and namespaces, which shouldn't be blocked
+	exemptUserPrefixes = []string{"system:serviceaccount:kube-system:"}
+)
+
+// Server is the validating admission webhook of the Longhorn objects. Every
+// manager serves it with the certificate shared through a secret, and keeps
+// the webhook configuration registered with the API server.
+//
+// The changes made by the managers themselves are not validated, since the
+// controllers and the uninstaller have to clean up the objects the users
+// can't, e.g. the nodes removed from the cluster with replicas left on them.
+type Server struct {
+	ds        *datastore.DataStore
+	validator *Validator
+	namespace string
+	// the user the managers access the API server as
+	managerUser string
+
+	lock sync.RWMutex
+	cert *webhookCert
+}
+
+func NewServer(ds *datastore.DataStore, namespace, serviceAccount string) *Server {
+	return &Server{
+		ds:          ds,
+		validator:   NewValidator(ds),
+		namespace:   namespace,
+		managerUser: fmt.Sprintf("system:serviceaccount:%v:%v", namespace, serviceAccount),
+	}
+}
+
+// GetCertificate returns the serving certificate for the TLS config of the
+// server. It fails the handshake until the certificate is ready, which the
+// API server treats by the failure policy.
+func (s *Server) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.cert == nil {
+		return nil, fmt.Errorf("the certificate of the admission webhook is not ready")
+	}
+	return &s.cert.cert, nil
+}
+
+func (s *Server) Run(stopCh <-chan struct{}) {
+	logrus.Infof("Start Longhorn admission webhook")
+	defer logrus.Infof("Shutting down Longhorn admission webhook")
+
+	settingCh := make(chan struct{}, 1)
+	s.ds.OnSettingChange(func(name types.SettingName) {
+		select {
+		case settingCh <- struct{}{}:
+		default:
+		}
+	}, types.SettingNameAdmissionWebhookFailurePolicy)
+
+	ticker := time.NewTicker(ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.reconcile(); err != nil {
+			logrus.Warnf("Fail to reconcile the admission webhook: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-settingCh:
+		}
+	}
+}
+
+func (s *Server) reconcile() error {
+	wc, err := ensureCert(s.ds, s.namespace)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.cert = wc
+	s.lock.Unlock()
+
+	failurePolicy, err := s.ds.GetSettingValue(types.SettingNameAdmissionWebhookFailurePolicy)
+	if err != nil {
+		return err
+	}
+	namespace, err := s.ds.GetNamespace()
+	if err != nil {
+		return err
+	}
+	return syncConfiguration(s.ds, desiredConfiguration(namespace, wc.caBundle, failurePolicy))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != webhookPath || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	review := &AdmissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(review); err != nil || review.Request == nil {
+		http.Error(w, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+	review.Response = s.admit(review.Request)
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		logrus.Warnf("Fail to write the admission review: %v", err)
+	}
+}
+
+func (s *Server) admit(req *AdmissionRequest) *AdmissionResponse {
+	response := &AdmissionResponse{
+		UID:     req.UID,
+		Allowed: true,
+	}
+	if s.isExempt(req.UserInfo.Username) {
+		return response
+	}
+	if err := s.validator.Validate(req); err != nil {
+		logrus.Infof("Rejected %v of %v %v by %v: %v", strings.ToLower(string(req.Operation)),
+			req.Resource.Resource, req.Name, req.UserInfo.Username, err)
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Message: err.Error(),
+		}
+	}
+	return response
+}
+
+func (s *Server) isExempt(username string) bool {
+	if username == s.managerUser {
+		return true
+	}
+	for _, prefix := range exemptUserPrefixes {
+		if strings.HasPrefix(username, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+	"github.com/rancher/longhorn-manager/util"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+)
+
+const (
+	resourceVolumes      = "volumes"
+	resourceEngineImages = "engineimages"
+	resourceNodes        = "nodes"
+)
+
+// Validator applies the rules of the API to the Longhorn objects changed
+// directly, e.g. by kubectl. The messages are the same as the API returns.
+type Validator struct {
+	ds *datastore.DataStore
+}
+
+func NewValidator(ds *datastore.DataStore) *Validator {
+	return &Validator{
+		ds: ds,
+	}
+}
+
+// Validate returns error if the request should be rejected. The error
+// describes why, as the message of the rejection.
+func (v *Validator) Validate(req *AdmissionRequest) error {
+	switch req.Resource.Resource {
+	case resourceVolumes:
+		return v.validateVolume(req)
+	case resourceEngineImages:
+		return v.validateEngineImage(req)
+	case resourceNodes:
+		return v.validateNode(req)
+	}
+	return nil
+}
+
+func (v *Validator) validateVolume(req *AdmissionRequest) error {
+	switch req.Operation {
+	case OperationCreate:
+		volume := &longhorn.Volume{}
+		if err := decodeObject(req.Object.Raw, volume); err != nil {
+			return err
+		}
+		return v.validateVolumeCreate(volume)
+	case OperationUpdate:
+		volume := &longhorn.Volume{}
+		if err := decodeObject(req.Object.Raw, volume); err != nil {
+			return err
+		}
+		oldVolume := &longhorn.Volume{}
+		if err := decodeObject(req.OldObject.Raw, oldVolume); err != nil {
+			return err
+		}
+		return v.validateVolumeUpdate(oldVolume, volume)
+	}
+	return nil
+}
+
+func (v *Validator) validateVolumeCreate(volume *longhorn.Volume) error {
+	if err := util.ValidateVolumeName(volume.Name); err != nil {
+		return err
+	}
+	// the size is from the backup if the volume is restored
+	if volume.Spec.FromBackup == "" {
+		if _, err := util.ValidateVolumeSize(strconv.FormatInt(volume.Spec.Size, 10)); err != nil {
+			return err
+		}
+	}
+	if volume.Spec.Frontend != types.VolumeFrontendBlockDev && volume.Spec.Frontend != types.VolumeFrontendISCSI {
+		return fmt.Errorf("invalid volume frontend specified: %v", volume.Spec.Frontend)
+	}
+	if volume.Spec.AccessMode != "" && volume.Spec.AccessMode != types.VolumeAccessModeReadWriteOnce &&
+		volume.Spec.AccessMode != types.VolumeAccessModeReadOnlyMany {
+		return fmt.Errorf("invalid volume access mode specified: %v", volume.Spec.AccessMode)
+	}
+	if volume.Spec.AccessMode == types.VolumeAccessModeReadOnlyMany && volume.Spec.Frontend != types.VolumeFrontendISCSI {
+		return fmt.Errorf("volume with access mode %v must use frontend %v", volume.Spec.AccessMode, types.VolumeFrontendISCSI)
+	}
+	if volume.Spec.NumberOfReplicas < 1 {
+		return fmt.Errorf("invalid replica count %v, must be at least 1", volume.Spec.NumberOfReplicas)
+	}
+	for _, zone := range volume.Spec.ZoneSelector {
+		if !util.ValidateName(zone) {
+			return fmt.Errorf("invalid zone %v in zone selector", zone)
+		}
+	}
+	if err := types.ValidateVolumeQoS(volume.Spec.QoS); err != nil {
+		return err
+	}
+	if err := validateRecurringJobs(volume.Spec.RecurringJobs); err != nil {
+		return err
+	}
+	return v.validateVolumeReferences(&longhorn.Volume{}, volume)
+}
+
+func (v *Validator) validateVolumeUpdate(oldVolume, volume *longhorn.Volume) error {
+	if volume.Spec.Size < oldVolume.Spec.Size {
+		return fmt.Errorf("cannot shrink volume %v from size %v to %v", volume.Name, oldVolume.Spec.Size, volume.Spec.Size)
+	}
+	if volume.Spec.FromBackup != oldVolume.Spec.FromBackup {
+		return fmt.Errorf("cannot change the backup volume %v is restored from", volume.Name)
+	}
+	if volume.Spec.BaseImage != oldVolume.Spec.BaseImage {
+		return fmt.Errorf("cannot change the base image of volume %v", volume.Name)
+	}
+	if getAccessMode(volume) != getAccessMode(oldVolume) {
+		return fmt.Errorf("cannot change the access mode of volume %v", volume.Name)
+	}
+	if volume.Spec.Frontend != oldVolume.Spec.Frontend && !isVolumeDetached(oldVolume) {
+		return fmt.Errorf("cannot change the frontend of volume %v while it's %v, detach it first", volume.Name, oldVolume.Status.State)
+	}
+	if volume.Spec.NumberOfReplicas < 1 {
+		return fmt.Errorf("invalid replica count %v, must be at least 1", volume.Spec.NumberOfReplicas)
+	}
+	if err := types.ValidateVolumeQoS(volume.Spec.QoS); err != nil {
+		return err
+	}
+	if err := validateRecurringJobs(volume.Spec.RecurringJobs); err != nil {
+		return err
+	}
+	return v.validateVolumeReferences(oldVolume, volume)
+}
+
+// validateVolumeReferences checks the nodes and the engine image newly
+// referred to exist. The ones referred to already are left alone, so the
+// volume on a removed node can still be changed, e.g. detached.
+func (v *Validator) validateVolumeReferences(oldVolume, volume *longhorn.Volume) error {
+	nodeIDs := []string{}
+	for _, nodeID := range []string{volume.Spec.NodeID, volume.Spec.MigrationNodeID, volume.Spec.PendingNodeID} {
+		if nodeID != "" && nodeID != oldVolume.Spec.NodeID && nodeID != oldVolume.Spec.MigrationNodeID && nodeID != oldVolume.Spec.PendingNodeID {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	oldReadOnlyNodeIDs := map[string]struct{}{}
+	for _, nodeID := range oldVolume.Spec.ReadOnlyNodeIDs {
+		oldReadOnlyNodeIDs[nodeID] = struct{}{}
+	}
+	for _, nodeID := range volume.Spec.ReadOnlyNodeIDs {
+		if _, ok := oldReadOnlyNodeIDs[nodeID]; !ok {
+			nodeIDs = append(nodeIDs, nodeID)
+		}
+	}
+	for _, nodeID := range nodeIDs {
+		if _, err := v.ds.GetNodeRO(nodeID); err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				return fmt.Errorf("cannot find node %v", nodeID)
+			}
+			return err
+		}
+	}
+
+	if volume.Spec.EngineImage != "" && volume.Spec.EngineImage != oldVolume.Spec.EngineImage {
+		if _, err := v.ds.GetEngineImage(types.GetEngineImageChecksumName(volume.Spec.EngineImage)); err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				return fmt.Errorf("engine image %v is not deployed", volume.Spec.EngineImage)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func validateRecurringJobs(jobs []types.RecurringJob) error {
+	for i := range jobs {
+		if _, _, err := types.ParseRecurringJobSchedule(&jobs[i]); err != nil {
+			return errors.Wrapf(err, "invalid schedule of job %v", jobs[i].Name)
+		}
+	}
+	return nil
+}
+
+// getAccessMode returns rwo for the older volumes without the access mode
+func getAccessMode(volume *longhorn.Volume) types.VolumeAccessMode {
+	if volume.Spec.AccessMode == "" {
+		return types.VolumeAccessModeReadWriteOnce
+	}
+	return volume.Spec.AccessMode
+}
+
+func isVolumeDetached(volume *longhorn.Volume) bool {
+	return volume.Spec.NodeID == "" && (volume.Status.State == "" || volume.Status.State == types.VolumeStateDetached)
+}
+
+func (v *Validator) validateEngineImage(req *AdmissionRequest) error {
+	switch req.Operation {
+	case OperationCreate:
+		ei := &longhorn.EngineImage{}
+		if err := decodeObject(req.Object.Raw, ei); err != nil {
+			return err
+		}
+		if ei.Spec.Image == "" {
+			return fmt.Errorf("cannot create engine image with empty image")
+		}
+		if ei.Name != types.GetEngineImageChecksumName(ei.Spec.Image) {
+			return fmt.Errorf("engine image %v must be named %v", ei.Spec.Image, types.GetEngineImageChecksumName(ei.Spec.Image))
+		}
+	case OperationDelete:
+		ei, err := v.ds.GetEngineImage(req.Name)
+		if err != nil {
+			if datastore.ErrorIsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		return v.ds.CheckEngineImageDeletable(ei)
+	}
+	return nil
+}
+
+func (v *Validator) validateNode(req *AdmissionRequest) error {
+	if req.Operation != OperationDelete {
+		return nil
+	}
+	node, err := v.ds.GetNode(req.Name)
+	if err != nil {
+		if datastore.ErrorIsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	// the deletion in progress is only waiting for the finalizer
+	if node.DeletionTimestamp != nil {
+		return nil
+	}
+	return v.ds.CheckNodeDeletable(node)
+}
+
+func decodeObject(raw []byte, obj interface{}) error {
+	if err := json.Unmarshal(raw, obj); err != nil {
+		return errors.Wrap(err, "cannot decode the object of the request")
+	}
+	return nil
+}
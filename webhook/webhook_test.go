@@ -0,0 +1,456 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/cert"
+
+	"github.com/rancher/longhorn-manager/datastore"
+	"github.com/rancher/longhorn-manager/types"
+
+	longhorn "github.com/rancher/longhorn-manager/k8s/pkg/apis/longhorn/v1alpha1"
+	lhfake "github.com/rancher/longhorn-manager/k8s/pkg/client/clientset/versioned/fake"
+	lhinformerfactory "github.com/rancher/longhorn-manager/k8s/pkg/client/informers/externalversions"
+)
+
+const (
+	testNamespace      = "longhorn-system"
+	testServiceAccount = "longhorn-service-account"
+	testVolume         = "test-volume"
+	testNode           = "test-node"
+	testDownNode       = "test-down-node"
+	testEngineImage    = "longhorn-engine:latest"
+	testDefaultImage   = "longhorn-engine:default"
+)
+
+type testIndexers struct {
+	settings     cache.Indexer
+	nodes        cache.Indexer
+	engineImages cache.Indexer
+	replicas     cache.Indexer
+}
+
+func newTestDataStore(kubeClient *fake.Clientset) (*datastore.DataStore, *testIndexers) {
+	lhClient := lhfake.NewSimpleClientset()
+	lhInformerFactory := lhinformerfactory.NewSharedInformerFactory(lhClient, 0)
+	kubeInformerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	ds := datastore.NewDataStore(
+		lhInformerFactory.Longhorn().V1alpha1().Volumes(),
+		lhInformerFactory.Longhorn().V1alpha1().Engines(),
+		lhInformerFactory.Longhorn().V1alpha1().Replicas(),
+		lhInformerFactory.Longhorn().V1alpha1().EngineImages(),
+		lhInformerFactory.Longhorn().V1alpha1().Nodes(),
+		lhInformerFactory.Longhorn().V1alpha1().Settings(),
+		lhInformerFactory.Longhorn().V1alpha1().Snapshots(),
+		lhClient,
+		kubeInformerFactory.Core().V1().Pods(),
+		kubeInformerFactory.Batch().V1beta1().CronJobs(),
+		kubeInformerFactory.Apps().V1beta2().DaemonSets(),
+		kubeInformerFactory.Core().V1().Events(),
+		kubeInformerFactory.Core().V1().PersistentVolumes(),
+		kubeInformerFactory.Core().V1().PersistentVolumeClaims(),
+		kubeInformerFactory.Storage().V1beta1().VolumeAttachments(),
+		kubeClient, testNamespace)
+	return ds, &testIndexers{
+		settings:     lhInformerFactory.Longhorn().V1alpha1().Settings().Informer().GetIndexer(),
+		nodes:        lhInformerFactory.Longhorn().V1alpha1().Nodes().Informer().GetIndexer(),
+		engineImages: lhInformerFactory.Longhorn().V1alpha1().EngineImages().Informer().GetIndexer(),
+		replicas:     lhInformerFactory.Longhorn().V1alpha1().Replicas().Informer().GetIndexer(),
+	}
+}
+
+func newTestNode(name string, ready bool) *longhorn.Node {
+	node := &longhorn.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+		},
+		Spec: types.NodeSpec{
+			AllowScheduling: ready,
+		},
+		Status: types.NodeStatus{
+			Conditions: map[types.NodeConditionType]types.Condition{
+				types.NodeConditionTypeReady: {
+					Type:   types.NodeConditionTypeReady,
+					Status: types.ConditionStatusTrue,
+				},
+			},
+		},
+	}
+	if !ready {
+		node.Status.Conditions[types.NodeConditionTypeReady] = types.Condition{
+			Type:   types.NodeConditionTypeReady,
+			Status: types.ConditionStatusFalse,
+			Reason: types.NodeConditionReasonKubernetesNodeDown,
+		}
+	}
+	return node
+}
+
+func newTestEngineImage(image string) *longhorn.EngineImage {
+	return &longhorn.EngineImage{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      types.GetEngineImageChecksumName(image),
+			Namespace: testNamespace,
+		},
+		Spec: types.EngineImageSpec{
+			Image: image,
+		},
+	}
+}
+
+func newTestVolume() *longhorn.Volume {
+	return &longhorn.Volume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testVolume,
+			Namespace: testNamespace,
+		},
+		Spec: types.VolumeSpec{
+			Size:             1073741824,
+			Frontend:         types.VolumeFrontendBlockDev,
+			NumberOfReplicas: 3,
+			EngineImage:      testEngineImage,
+		},
+		Status: types.VolumeStatus{
+			State: types.VolumeStateDetached,
+		},
+	}
+}
+
+func newTestValidator(t *testing.T) (*Validator, *testIndexers) {
+	assert := require.New(t)
+	ds, indexers := newTestDataStore(fake.NewSimpleClientset())
+	assert.Nil(indexers.settings.Add(&longhorn.Setting{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      string(types.SettingNameDefaultEngineImage),
+			Namespace: testNamespace,
+		},
+		Setting: types.Setting{Value: testDefaultImage},
+	}))
+	assert.Nil(indexers.nodes.Add(newTestNode(testNode, true)))
+	assert.Nil(indexers.nodes.Add(newTestNode(testDownNode, false)))
+	assert.Nil(indexers.engineImages.Add(newTestEngineImage(testEngineImage)))
+	assert.Nil(indexers.engineImages.Add(newTestEngineImage(testDefaultImage)))
+	return NewValidator(ds), indexers
+}
+
+func newTestRequest(t *testing.T, resource string, operation Operation, name string, obj, oldObj runtime.Object) *AdmissionRequest {
+	assert := require.New(t)
+	req := &AdmissionRequest{
+		UID:       "test-uid",
+		Resource:  metav1.GroupVersionResource{Group: longhorn.SchemeGroupVersion.Group, Version: "v1alpha1", Resource: resource},
+		Name:      name,
+		Namespace: testNamespace,
+		Operation: operation,
+	}
+	if obj != nil {
+		raw, err := json.Marshal(obj)
+		assert.Nil(err)
+		req.Object.Raw = raw
+	}
+	if oldObj != nil {
+		raw, err := json.Marshal(oldObj)
+		assert.Nil(err)
+		req.OldObject.Raw = raw
+	}
+	return req
+}
+
+func TestValidateVolume(t *testing.T) {
+	assert := require.New(t)
+	v, _ := newTestValidator(t)
+
+	testCases := map[string]struct {
+		update func(v *longhorn.Volume)
+		// create the volume instead of updating it
+		create bool
+		// attach the volume before the update
+		attached bool
+		err      string
+	}{
+		"create": {
+			create: true,
+		},
+		"create invalid name": {
+			create: true,
+			update: func(v *longhorn.Volume) { v.Name = "-vol" },
+			err:    "invalid name -vol",
+		},
+		"create zero size": {
+			create: true,
+			update: func(v *longhorn.Volume) { v.Spec.Size = 0 },
+			err:    "invalid size 0, must be positive",
+		},
+		"create restored without size": {
+			create: true,
+			update: func(v *longhorn.Volume) {
+				v.Spec.Size = 0
+				v.Spec.FromBackup = "s3://backupbucket@us-east-1/backupstore?backup=backup-1&volume=vol"
+			},
+		},
+		"create invalid frontend": {
+			create: true,
+			update: func(v *longhorn.Volume) { v.Spec.Frontend = "nvme" },
+			err:    "invalid volume frontend specified: nvme",
+		},
+		"create with invalid zone selector": {
+			create: true,
+			update: func(v *longhorn.Volume) { v.Spec.ZoneSelector = []string{"us-east-1a", "us east"} },
+			err:    "invalid zone us east in zone selector",
+		},
+		"create on unknown node": {
+			create: true,
+			update: func(v *longhorn.Volume) { v.Spec.NodeID = "bogus-node" },
+			err:    "cannot find node bogus-node",
+		},
+		"create with unknown engine image": {
+			create: true,
+			update: func(v *longhorn.Volume) { v.Spec.EngineImage = "longhorn-engine:bogus" },
+			err:    "engine image longhorn-engine:bogus is not deployed",
+		},
+		"expand": {
+			update: func(v *longhorn.Volume) { v.Spec.Size *= 2 },
+		},
+		"shrink": {
+			update: func(v *longhorn.Volume) { v.Spec.Size /= 2 },
+			err:    "cannot shrink volume test-volume from size 1073741824 to 536870912",
+		},
+		"change base image": {
+			update: func(v *longhorn.Volume) { v.Spec.BaseImage = "rancher/vm-ubuntu" },
+			err:    "cannot change the base image of volume test-volume",
+		},
+		"change access mode": {
+			update: func(v *longhorn.Volume) { v.Spec.AccessMode = types.VolumeAccessModeReadOnlyMany },
+			err:    "cannot change the access mode of volume test-volume",
+		},
+		"change frontend while detached": {
+			update: func(v *longhorn.Volume) { v.Spec.Frontend = types.VolumeFrontendISCSI },
+		},
+		"change frontend while attached": {
+			attached: true,
+			update:   func(v *longhorn.Volume) { v.Spec.Frontend = types.VolumeFrontendISCSI },
+			err:      "cannot change the frontend of volume test-volume while it's attached, detach it first",
+		},
+		"attach to node": {
+			update: func(v *longhorn.Volume) { v.Spec.NodeID = testNode },
+		},
+		"attach to unknown node": {
+			update: func(v *longhorn.Volume) { v.Spec.NodeID = "bogus-node" },
+			err:    "cannot find node bogus-node",
+		},
+		"attach read-only to unknown node": {
+			attached: true,
+			update:   func(v *longhorn.Volume) { v.Spec.ReadOnlyNodeIDs = []string{testNode, "bogus-node"} },
+			err:      "cannot find node bogus-node",
+		},
+		"zero replica": {
+			update: func(v *longhorn.Volume) { v.Spec.NumberOfReplicas = 0 },
+			err:    "invalid replica count 0, must be at least 1",
+		},
+		"negative qos": {
+			update: func(v *longhorn.Volume) { v.Spec.QoS.ReadIOPS = -1 },
+			err:    "invalid readIOPS -1, must be at least 0",
+		},
+		"recurring job in unknown time zone": {
+			update: func(v *longhorn.Volume) {
+				v.Spec.RecurringJobs = []types.RecurringJob{
+					{Name: "snap", Type: types.RecurringJobTypeSnapshot, Cron: "0 2 * * *", Retain: 1, Timezone: "Mars/Olympus"},
+				}
+			},
+			err: `invalid schedule of job snap: invalid time zone "Mars/Olympus", must be an IANA time zone name`,
+		},
+		"upgrade to unknown engine image": {
+			update: func(v *longhorn.Volume) { v.Spec.EngineImage = "longhorn-engine:bogus" },
+			err:    "engine image longhorn-engine:bogus is not deployed",
+		},
+	}
+	for name, tc := range testCases {
+		oldVolume := newTestVolume()
+		if tc.attached {
+			oldVolume.Spec.NodeID = testNode
+			oldVolume.Status.State = types.VolumeStateAttached
+		}
+		volume := oldVolume.DeepCopy()
+		if tc.update != nil {
+			tc.update(volume)
+		}
+		var req *AdmissionRequest
+		if tc.create {
+			req = newTestRequest(t, resourceVolumes, OperationCreate, volume.Name, volume, nil)
+		} else {
+			req = newTestRequest(t, resourceVolumes, OperationUpdate, volume.Name, volume, oldVolume)
+		}
+		err := v.Validate(req)
+		if tc.err == "" {
+			assert.Nil(err, name)
+		} else {
+			assert.NotNil(err, name)
+			assert.Contains(err.Error(), tc.err, name)
+		}
+	}
+
+	// the node referred to already is left alone, so the volume on a
+	// removed node can still be changed
+	oldVolume := newTestVolume()
+	oldVolume.Spec.NodeID = "removed-node"
+	oldVolume.Status.State = types.VolumeStateAttached
+	volume := oldVolume.DeepCopy()
+	volume.Spec.NumberOfReplicas = 2
+	assert.Nil(v.Validate(newTestRequest(t, resourceVolumes, OperationUpdate, volume.Name, volume, oldVolume)))
+}
+
+func TestValidateDeletion(t *testing.T) {
+	assert := require.New(t)
+	v, indexers := newTestValidator(t)
+
+	// the default engine image is protected with the message of the API
+	defaultImage := newTestEngineImage(testDefaultImage)
+	err := v.Validate(newTestRequest(t, resourceEngineImages, OperationDelete, defaultImage.Name, nil, nil))
+	assert.NotNil(err)
+	expected := v.ds.CheckEngineImageDeletable(defaultImage)
+	assert.NotNil(expected)
+	assert.Equal(expected.Error(), err.Error())
+
+	ei := newTestEngineImage(testEngineImage)
+	assert.Nil(v.Validate(newTestRequest(t, resourceEngineImages, OperationDelete, ei.Name, nil, nil)))
+	// gone already
+	assert.Nil(v.Validate(newTestRequest(t, resourceEngineImages, OperationDelete, "bogus", nil, nil)))
+
+	// the node is only deletable after removed from the cluster
+	err = v.Validate(newTestRequest(t, resourceNodes, OperationDelete, testNode, nil, nil))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "Could not delete node test-node")
+	assert.Nil(v.Validate(newTestRequest(t, resourceNodes, OperationDelete, testDownNode, nil, nil)))
+
+	// and without any replica on it
+	assert.Nil(indexers.replicas.Add(&longhorn.Replica{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testVolume + "-r-1",
+			Namespace: testNamespace,
+			Labels:    map[string]string{datastore.LonghornVolumeKey: testVolume},
+		},
+		Spec: types.ReplicaSpec{
+			InstanceSpec: types.InstanceSpec{
+				NodeID:     testDownNode,
+				VolumeName: testVolume,
+			},
+		},
+	}))
+	err = v.Validate(newTestRequest(t, resourceNodes, OperationDelete, testDownNode, nil, nil))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "1 replica, 0 engine running on it")
+
+	// the engine image must be named after its checksum
+	ei.Name = "bogus"
+	err = v.Validate(newTestRequest(t, resourceEngineImages, OperationCreate, ei.Name, ei, nil))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "must be named")
+}
+
+func TestServeHTTP(t *testing.T) {
+	assert := require.New(t)
+	v, _ := newTestValidator(t)
+	s := NewServer(v.ds, testNamespace, testServiceAccount)
+
+	review := func(username string) *AdmissionResponse {
+		req := newTestRequest(t, resourceNodes, OperationDelete, testNode, nil, nil)
+		req.UserInfo.Username = username
+		body, err := json.Marshal(&AdmissionReview{Request: req})
+		assert.Nil(err)
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, webhookPath, bytes.NewReader(body)))
+		assert.Equal(http.StatusOK, recorder.Code)
+		result := &AdmissionReview{}
+		assert.Nil(json.NewDecoder(recorder.Body).Decode(result))
+		assert.NotNil(result.Response)
+		assert.Equal(req.UID, result.Response.UID)
+		return result.Response
+	}
+
+	response := review("kubernetes-admin")
+	assert.False(response.Allowed)
+	assert.NotNil(response.Result)
+	assert.Equal(int32(http.StatusUnprocessableEntity), response.Result.Code)
+	assert.Contains(response.Result.Message, "Could not delete node test-node")
+
+	// the managers and the Kubernetes system components are trusted
+	assert.True(review("system:serviceaccount:longhorn-system:longhorn-service-account").Allowed)
+	assert.True(review("system:serviceaccount:kube-system:generic-garbage-collector").Allowed)
+	assert.False(review("system:serviceaccount:default:longhorn-service-account").Allowed)
+
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, webhookPath, bytes.NewReader([]byte("{}"))))
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+}
+
+func TestEnsureCert(t *testing.T) {
+	assert := require.New(t)
+	kubeClient := fake.NewSimpleClientset()
+	ds, _ := newTestDataStore(kubeClient)
+
+	wc, err := ensureCert(ds, testNamespace)
+	assert.Nil(err)
+	assert.NotEmpty(wc.caBundle)
+	assert.True(time.Until(wc.notAfter) > certRenewBefore)
+	leaf, err := x509.ParseCertificate(wc.cert.Certificate[0])
+	assert.Nil(err)
+	assert.Contains(leaf.DNSNames, "longhorn-admission-webhook.longhorn-system.svc")
+
+	// reused by the other managers
+	reused, err := ensureCert(ds, testNamespace)
+	assert.Nil(err)
+	assert.Equal(wc.cert.Certificate, reused.cert.Certificate)
+
+	// renewed with the same CA before it expires
+	secret, err := ds.GetSecret(types.AdmissionWebhookTLSSecretName)
+	assert.Nil(err)
+	caCert, caKey := parseCA(secret)
+	assert.NotNil(caCert)
+	secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey] = newTestExpiringCert(t, caCert, caKey)
+	_, err = ds.UpdateSecret(secret)
+	assert.Nil(err)
+	renewed, err := ensureCert(ds, testNamespace)
+	assert.Nil(err)
+	assert.NotEqual(wc.cert.Certificate, renewed.cert.Certificate)
+	assert.Equal(wc.caBundle, renewed.caBundle)
+	assert.True(time.Until(renewed.notAfter) > certRenewBefore)
+}
+
+// newTestExpiringCert returns the serving certificate expiring in a day and
+// its key
+func newTestExpiringCert(t *testing.T, caCert *x509.Certificate, caKey *rsa.PrivateKey) ([]byte, []byte) {
+	assert := require.New(t)
+	key, err := cert.NewPrivateKey()
+	assert.Nil(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: types.AdmissionWebhookServiceName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	assert.Nil(err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.Nil(err)
+	return cert.EncodeCertPEM(leaf), cert.EncodePrivateKeyPEM(key)
+}